@@ -54,6 +54,8 @@ type ImageRecorder struct {
 	r              *recorder.Recorder
 	index          []map[string]struct{}
 	manifestDigest digest.Digest
+	layers         []ocispec.Descriptor
+	cs             content.Store
 	recordW        content.Writer
 	recordWMu      sync.Mutex
 }
@@ -127,6 +129,8 @@ func imageRecorderFromManifest(ctx context.Context, cs content.Store, manifestDe
 		index:          filesMap,
 		recordW:        recordW,
 		manifestDigest: manifestDesc.Digest,
+		layers:         manifest.Layers,
+		cs:             cs,
 	}, nil
 }
 
@@ -172,7 +176,22 @@ func (r *ImageRecorder) Commit(ctx context.Context) (digest.Digest, error) {
 	if err := r.recordW.Commit(ctx, 0, ""); err != nil && !errdefs.IsAlreadyExists(err) {
 		return "", err
 	}
-	return r.recordW.Digest(), nil
+	dgst := r.recordW.Digest()
+
+	// Let the converter find the record from the layers.
+	for _, l := range r.layers {
+		info := content.Info{
+			Digest: l.Digest,
+			Labels: map[string]string{
+				recorder.RecordLabel:   dgst.String(),
+				recorder.RecordGCLabel: dgst.String(),
+			},
+		}
+		if _, err := r.cs.Update(ctx, info, "labels."+recorder.RecordLabel, "labels."+recorder.RecordGCLabel); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to label layer %q with the record", l.Digest)
+		}
+	}
+	return dgst, nil
 }
 
 func (r *ImageRecorder) Close() error {
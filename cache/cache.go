@@ -18,13 +18,19 @@ package cache
 
 import (
 	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/util/iouring"
 	"github.com/containerd/stargz-snapshotter/util/lrucache"
 	"github.com/containerd/stargz-snapshotter/util/namedmutex"
 	"github.com/hashicorp/go-multierror"
@@ -63,6 +69,35 @@ type DirectoryCacheConfig struct {
 	// Direct forcefully enables direct mode for all operation in cache.
 	// Thus operation won't use on-memory caches.
 	Direct bool
+
+	// Cipher encrypts the contents written to the directory (e.g. AES-GCM).
+	// Each entry is sealed as a whole with the key of the entry as additional
+	// data, so it is read from the disk as a whole. On-memory caches are not
+	// encrypted.
+	Cipher cipher.AEAD
+
+	// CompactionInterval enables the background compaction which packs cold
+	// entries into packfiles with this interval. Compaction is disabled if zero.
+	CompactionInterval time.Duration
+
+	// CompactColdAfter is the duration after the last access that an entry
+	// is regarded as cold and is packed by compaction (default: 10min).
+	CompactColdAfter time.Duration
+
+	// MaxPackSize is the max size of a packfile in bytes (default: 64MiB).
+	MaxPackSize int64
+
+	// DisableIOUring disables io_uring. By default, reads and writes of files
+	// in the directory which would block on the disk are submitted through
+	// io_uring if it's available on the kernel. Others use the standard file
+	// I/O.
+	DisableIOUring bool
+
+	// EvictionPolicy evicts entries from the disk. The policy can be shared
+	// among caches. If nil, entries are kept until the cache is closed. Entries
+	// packed into packfiles, entries being read and entries of pinned caches
+	// aren't evicted.
+	EvictionPolicy EvictionPolicy
 }
 
 // TODO: contents validation.
@@ -80,6 +115,25 @@ type BlobCache interface {
 	Close() error
 }
 
+// PinnableCache is a BlobCache whose entries can be exempted from eviction.
+type PinnableCache interface {
+	BlobCache
+
+	// Pin makes the entries of the cache exempt from eviction. Unpinned
+	// caches are evicted as usual.
+	Pin(pinned bool)
+}
+
+// RemovableCache is a BlobCache which can remove its entries (e.g. contents
+// which turn out to be stale).
+type RemovableCache interface {
+	BlobCache
+
+	// Remove removes the entry from the cache. Removing a missing entry isn't
+	// an error.
+	Remove(key string) error
+}
+
 // Reader provides the data cached.
 type Reader interface {
 	io.ReaderAt
@@ -153,19 +207,62 @@ func NewDirectoryCache(directory string, config DirectoryCacheConfig) (BlobCache
 	if err := os.MkdirAll(wipdir, 0700); err != nil {
 		return nil, err
 	}
+	packdir := filepath.Join(directory, packDirName)
+	if err := os.MkdirAll(packdir, 0700); err != nil {
+		return nil, err
+	}
+	coldAfter := config.CompactColdAfter
+	if coldAfter == 0 {
+		coldAfter = defaultCompactColdAfter
+	}
+	maxPackSize := config.MaxPackSize
+	if maxPackSize == 0 {
+		maxPackSize = defaultMaxPackSize
+	}
 	dc := &directoryCache{
-		cache:        dataCache,
-		fileCache:    fdCache,
-		wipLock:      new(namedmutex.NamedMutex),
-		directory:    directory,
-		wipDirectory: wipdir,
-		bufPool:      bufPool,
-		direct:       config.Direct,
+		cache:            dataCache,
+		fileCache:        fdCache,
+		wipLock:          new(namedmutex.NamedMutex),
+		directory:        directory,
+		wipDirectory:     wipdir,
+		packDirectory:    packdir,
+		bufPool:          bufPool,
+		direct:           config.Direct,
+		aead:             config.Cipher,
+		packed:           make(map[string]packedEntry),
+		compactColdAfter: coldAfter,
+		maxPackSize:      maxPackSize,
+		stopCompaction:   make(chan struct{}),
+		eviction:         config.EvictionPolicy,
+		evictables:       make(map[string]struct{}),
+		inUse:            make(map[string]int),
 	}
 	dc.syncAdd = config.SyncAdd
+	if !config.DisableIOUring {
+		ring, err := iouring.Default()
+		if err != nil {
+			log.L.WithError(err).Debug("io_uring is unavailable; falling back to standard file I/O")
+		} else {
+			dc.ring = ring
+		}
+	}
+	if err := dc.loadPacks(); err != nil {
+		dc.closePacks()
+		return nil, errors.Wrapf(err, "failed to load packfiles")
+	}
+	if dc.eviction != nil {
+		registerEvictable(dc)
+	}
+	if config.CompactionInterval > 0 {
+		go dc.compactLoop(config.CompactionInterval)
+	}
 	return dc, nil
 }
 
+var _ = (CompactableCache)((*directoryCache)(nil))
+var _ = (RemovableCache)((*directoryCache)(nil))
+var _ = (PinnableCache)((*directoryCache)(nil))
+
 // directoryCache is a cache implementation which backend is a directory.
 type directoryCache struct {
 	cache        *lrucache.Cache
@@ -174,10 +271,31 @@ type directoryCache struct {
 	directory    string
 	wipLock      *namedmutex.NamedMutex
 
+	packDirectory    string
+	packed           map[string]packedEntry
+	packFiles        []*os.File
+	packMu           sync.RWMutex
+	compactMu        sync.Mutex
+	compactColdAfter time.Duration
+	maxPackSize      int64
+	stopCompaction   chan struct{}
+
 	bufPool *sync.Pool
 
 	syncAdd bool
 	direct  bool
+	aead    cipher.AEAD
+	ring    *iouring.Ring // nil if io_uring is disabled or unavailable
+
+	eviction     EvictionPolicy // nil if eviction is disabled
+	evictables   map[string]struct{}
+	evictablesMu sync.Mutex
+	pinned       int32 // accessed atomically; non-zero if pinned
+
+	// inUse is the number of readers of each loose file. Entries being read
+	// aren't evicted.
+	inUse   map[string]int
+	inUseMu sync.Mutex
 
 	closed   bool
 	closedMu sync.Mutex
@@ -196,6 +314,7 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	if !dc.direct && !opt.direct {
 		// Get data from memory
 		if b, done, ok := dc.cache.Get(key); ok {
+			dc.accessed(key)
 			return &reader{
 				ReaderAt: bytes.NewReader(b.(*bytes.Buffer).Bytes()),
 				closeFunc: func() error {
@@ -207,9 +326,12 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 
 		// Get data from disk. If the file is already opened, use it.
 		if f, done, ok := dc.fileCache.Get(key); ok {
+			dc.accessed(key)
+			release := dc.use(key)
 			return &reader{
-				ReaderAt: f.(*os.File),
+				ReaderAt: dc.fileReaderAt(f.(*os.File)),
 				closeFunc: func() error {
+					release()
 					done() // file will be closed when it's evicted from the cache
 					return nil
 				},
@@ -217,21 +339,45 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 		}
 	}
 
+	if dc.aead != nil {
+		data, err := dc.readSealed(key)
+		if err != nil {
+			return nil, err
+		}
+		dc.accessed(key)
+		return &reader{
+			ReaderAt:  bytes.NewReader(data),
+			closeFunc: func() error { return nil },
+		}, nil
+	}
+
 	// Open the cache file and read the target region
 	// TODO: If the target cache is write-in-progress, should we wait for the completion
 	//       or simply report the cache miss?
 	file, err := os.Open(dc.cachePath(key))
 	if err != nil {
+		// The entry may be compacted into a packfile.
+		if e, ok := dc.getPacked(key); ok && os.IsNotExist(err) {
+			return &reader{
+				ReaderAt:  io.NewSectionReader(dc.fileReaderAt(e.pack), e.offset, e.size),
+				closeFunc: func() error { return nil }, // packfiles are closed with the cache
+			}, nil
+		}
 		return nil, errors.Wrapf(err, "failed to open blob file for %q", key)
 	}
+	dc.accessed(key)
+	release := dc.use(key)
 
 	// If "direct" option is specified, do not cache the file on memory.
 	// This option is useful for preventing memory cache from being polluted by data
 	// that won't be accessed immediately.
 	if dc.direct || opt.direct {
 		return &reader{
-			ReaderAt:  file,
-			closeFunc: func() error { return file.Close() },
+			ReaderAt: dc.fileReaderAt(file),
+			closeFunc: func() error {
+				release()
+				return file.Close()
+			},
 		}, nil
 	}
 
@@ -239,8 +385,9 @@ func (dc *directoryCache) Get(key string, opts ...Option) (Reader, error) {
 	//       but making I/O (possibly huge) on every fetching
 	//       might be costly.
 	return &reader{
-		ReaderAt: file,
+		ReaderAt: dc.fileReaderAt(file),
 		closeFunc: func() error {
+			release()
 			_, done, added := dc.fileCache.Add(key, file)
 			defer done() // Release it immediately. Cleaned up on eviction.
 			if !added {
@@ -266,7 +413,7 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 		return nil, err
 	}
 	w := &writer{
-		WriteCloser: wip,
+		WriteCloser: dc.fileWriter(wip),
 		commitFunc: func() error {
 			if dc.isClosed() {
 				return fmt.Errorf("cache is already closed")
@@ -281,12 +428,19 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 				return multierror.Append(allErr,
 					errors.Wrapf(err, "failed to create cache directory %q", c))
 			}
-			return os.Rename(wip.Name(), c)
+			if err := os.Rename(wip.Name(), c); err != nil {
+				return err
+			}
+			dc.added(key)
+			return nil
 		},
 		abortFunc: func() error {
 			return os.Remove(wip.Name())
 		},
 	}
+	if dc.aead != nil {
+		w = dc.sealingWriter(key, w)
+	}
 
 	// If "direct" option is specified, do not cache the passed data on memory.
 	// This option is useful for preventing memory cache from being polluted by data
@@ -339,19 +493,91 @@ func (dc *directoryCache) Add(key string, opts ...Option) (Writer, error) {
 	return memW, nil
 }
 
+// sealingWriter buffers the contents written to w and writes them encrypted on commit.
+func (dc *directoryCache) sealingWriter(key string, w *writer) *writer {
+	b := new(bytes.Buffer)
+	return &writer{
+		WriteCloser: &writeCloser{b, w.Close},
+		commitFunc: func() error {
+			nonce := make([]byte, dc.aead.NonceSize())
+			if _, err := rand.Read(nonce); err != nil {
+				w.Abort()
+				return errors.Wrap(err, "failed to generate nonce")
+			}
+			if _, err := w.Write(dc.aead.Seal(nonce, nonce, b.Bytes(), []byte(key))); err != nil {
+				w.Abort()
+				return err
+			}
+			return w.Commit()
+		},
+		abortFunc: w.Abort,
+	}
+}
+
+// readSealed reads and decrypts the contents of the entry.
+func (dc *directoryCache) readSealed(key string) ([]byte, error) {
+	sealed, err := ioutil.ReadFile(dc.cachePath(key))
+	if e, ok := dc.getPacked(key); ok && os.IsNotExist(err) {
+		sealed, err = ioutil.ReadAll(io.NewSectionReader(e.pack, e.offset, e.size))
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read blob file for %q", key)
+	}
+	nonceSize := dc.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, fmt.Errorf("encrypted blob file for %q is too short", key)
+	}
+	data, err := dc.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(key))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt blob file for %q", key)
+	}
+	return data, nil
+}
+
 func (dc *directoryCache) Close() error {
+	dc.compactMu.Lock() // wait for the running compaction
+	defer dc.compactMu.Unlock()
 	dc.closedMu.Lock()
 	defer dc.closedMu.Unlock()
 	if dc.closed {
 		return nil
 	}
 	dc.closed = true
+	close(dc.stopCompaction)
+	if dc.eviction != nil {
+		unregisterEvictable(dc)
+	}
+	dc.forgetEvictables()
+	if err := dc.closePacks(); err != nil {
+		return err
+	}
 	if err := os.RemoveAll(dc.directory); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Remove removes the entry from the memory, the loose file and the index of
+// packfiles. The contents in packfiles remain until the packfiles are removed
+// but they aren't looked up by this cache anymore.
+func (dc *directoryCache) Remove(key string) error {
+	dc.compactMu.Lock() // the entry must not be packed during removal
+	defer dc.compactMu.Unlock()
+	if dc.isClosed() {
+		return fmt.Errorf("cache is already closed")
+	}
+	dc.cache.Remove(key)
+	dc.fileCache.Remove(key)
+	dc.packMu.Lock()
+	delete(dc.packed, key)
+	dc.packMu.Unlock()
+	if err := os.Remove(dc.cachePath(key)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove cache file %q", key)
+	}
+	dc.removed(key)
+	return nil
+}
+
 func (dc *directoryCache) isClosed() bool {
 	dc.closedMu.Lock()
 	closed := dc.closed
@@ -359,6 +585,148 @@ func (dc *directoryCache) isClosed() bool {
 	return closed
 }
 
+// added records the committed entry to the eviction policy and evicts entries
+// following the policy.
+func (dc *directoryCache) added(key string) {
+	if dc.eviction == nil {
+		return
+	}
+	p := dc.cachePath(key)
+	fi, err := os.Stat(p)
+	if err != nil {
+		return // removed concurrently (e.g. packed).
+	}
+	dc.evictablesMu.Lock()
+	dc.evictables[p] = struct{}{}
+	dc.evictablesMu.Unlock()
+	dc.eviction.Add(p, fi.Size())
+	for _, e := range dc.eviction.Evict(keepEvictable) {
+		// The evicted entry can be the one of another cache sharing the policy.
+		if owner := evictableOwner(e); owner != nil {
+			owner.evict(filepath.Base(e))
+		} else if err := os.Remove(e); err != nil && !os.IsNotExist(err) {
+			log.L.WithError(err).Debugf("failed to evict cache file %q", e)
+		}
+	}
+}
+
+// evict removes the loose file of the entry evicted by the policy.
+func (dc *directoryCache) evict(key string) {
+	p := dc.cachePath(key)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		log.L.WithError(err).Debugf("failed to evict cache file %q", p)
+	}
+	// Release the opened file so that the space is reclaimed.
+	dc.fileCache.Remove(key)
+	dc.evictablesMu.Lock()
+	delete(dc.evictables, p)
+	dc.evictablesMu.Unlock()
+}
+
+// Pin makes the entries of the cache exempt from eviction.
+func (dc *directoryCache) Pin(pinned bool) {
+	var v int32
+	if pinned {
+		v = 1
+	}
+	atomic.StoreInt32(&dc.pinned, v)
+}
+
+func (dc *directoryCache) isPinned() bool {
+	return atomic.LoadInt32(&dc.pinned) != 0
+}
+
+// use marks the loose file of the entry being read until the returned function
+// is called.
+func (dc *directoryCache) use(key string) (release func()) {
+	dc.inUseMu.Lock()
+	dc.inUse[key]++
+	dc.inUseMu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			dc.inUseMu.Lock()
+			if dc.inUse[key]--; dc.inUse[key] <= 0 {
+				delete(dc.inUse, key)
+			}
+			dc.inUseMu.Unlock()
+		})
+	}
+}
+
+func (dc *directoryCache) isInUse(key string) bool {
+	dc.inUseMu.Lock()
+	defer dc.inUseMu.Unlock()
+	return dc.inUse[key] > 0
+}
+
+// evictables is the directory caches with eviction policies, keyed by their
+// directories. Policies can be shared among caches so entries (the paths of the
+// loose files) are mapped to their caches through this.
+var evictables = struct {
+	caches map[string]*directoryCache
+	mu     sync.Mutex
+}{caches: make(map[string]*directoryCache)}
+
+func registerEvictable(dc *directoryCache) {
+	evictables.mu.Lock()
+	evictables.caches[dc.directory] = dc
+	evictables.mu.Unlock()
+}
+
+func unregisterEvictable(dc *directoryCache) {
+	evictables.mu.Lock()
+	if evictables.caches[dc.directory] == dc {
+		delete(evictables.caches, dc.directory)
+	}
+	evictables.mu.Unlock()
+}
+
+// evictableOwner returns the cache of the entry. nil if the cache is closed.
+func evictableOwner(id string) *directoryCache {
+	evictables.mu.Lock()
+	defer evictables.mu.Unlock()
+	return evictables.caches[filepath.Dir(filepath.Dir(id))] // <dir>/<key[:2]>/<key>
+}
+
+// keepEvictable returns true if the entry is pinned or being read.
+func keepEvictable(id string) bool {
+	owner := evictableOwner(id)
+	return owner != nil && (owner.isPinned() || owner.isInUse(filepath.Base(id)))
+}
+
+// accessed records the access to the entry to the eviction policy.
+func (dc *directoryCache) accessed(key string) {
+	if dc.eviction != nil {
+		dc.eviction.Access(dc.cachePath(key))
+	}
+}
+
+// removed makes the eviction policy forget the entry removed from the disk.
+func (dc *directoryCache) removed(key string) {
+	if dc.eviction == nil {
+		return
+	}
+	p := dc.cachePath(key)
+	dc.evictablesMu.Lock()
+	delete(dc.evictables, p)
+	dc.evictablesMu.Unlock()
+	dc.eviction.Remove(p)
+}
+
+// forgetEvictables makes the eviction policy forget all entries of the cache.
+func (dc *directoryCache) forgetEvictables() {
+	if dc.eviction == nil {
+		return
+	}
+	dc.evictablesMu.Lock()
+	defer dc.evictablesMu.Unlock()
+	for p := range dc.evictables {
+		dc.eviction.Remove(p)
+	}
+	dc.evictables = make(map[string]struct{})
+}
+
 func (dc *directoryCache) cachePath(key string) string {
 	return filepath.Join(dc.directory, key[:2], key)
 }
@@ -403,6 +771,15 @@ func (mc *MemoryCache) Add(key string, opts ...Option) (Writer, error) {
 	}, nil
 }
 
+var _ = (RemovableCache)((*MemoryCache)(nil))
+
+func (mc *MemoryCache) Remove(key string) error {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	delete(mc.Membuf, key)
+	return nil
+}
+
 func (mc *MemoryCache) Close() error {
 	return nil
 }
@@ -23,12 +23,20 @@
 package cache
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/sha256"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/util/faultinject"
 )
 
 const (
@@ -70,12 +78,596 @@ func TestDirectoryCache(t *testing.T) {
 		return c, func() { os.RemoveAll(tmp) }
 	}
 	testCache(t, "dir-with-small-mem", newCache)
+
+	// with encryption
+	newCache = func() (BlobCache, cleanFunc) {
+		tmp, err := ioutil.TempDir("", "testcache")
+		if err != nil {
+			t.Fatalf("failed to make tempdir: %v", err)
+		}
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			MaxLRUCacheEntry: 1,
+			SyncAdd:          true,
+			Direct:           true,
+			Cipher:           newTestCipher(t, 1),
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() { os.RemoveAll(tmp) }
+	}
+	testCache(t, "dir-encrypted", newCache)
+
+	// without io_uring (the other caches use it if it's available)
+	newCache = func() (BlobCache, cleanFunc) {
+		tmp, err := ioutil.TempDir("", "testcache")
+		if err != nil {
+			t.Fatalf("failed to make tempdir: %v", err)
+		}
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			MaxLRUCacheEntry: 1,
+			SyncAdd:          true,
+			Direct:           true,
+			DisableIOUring:   true,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() { os.RemoveAll(tmp) }
+	}
+	testCache(t, "dir-no-io-uring", newCache)
+}
+
+func TestDirectoryCacheEncryption(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	newCache := func(aead cipher.AEAD) *directoryCache {
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			SyncAdd: true,
+			Direct:  true,
+			Cipher:  aead,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c.(*directoryCache)
+	}
+	c := newCache(newTestCipher(t, 1))
+	key := digestFor(sampleData)
+	w, err := c.Add(key)
+	if err != nil {
+		t.Fatalf("failed to add %v: %v", key, err)
+	}
+	if _, err := w.Write([]byte(sampleData)); err != nil {
+		t.Fatalf("failed to write %v: %v", key, err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit %v: %v", key, err)
+	}
+	w.Close()
+	testChunk(t, c, key, 0, sampleData)
+
+	// contents on the disk must not be plain
+	path := c.cachePath(key)
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read the cache file: %v", err)
+	}
+	if bytes.Contains(b, []byte(sampleData)) {
+		t.Errorf("cache file contains plain contents")
+	}
+
+	// wrong key must be rejected
+	if _, err := newCache(newTestCipher(t, 2)).Get(key); err == nil {
+		t.Errorf("cache must not be read with a wrong key")
+	}
+
+	// contents moved to another key must be rejected
+	key2 := digestFor("dummy")
+	if err := os.MkdirAll(filepath.Dir(c.cachePath(key2)), 0700); err != nil {
+		t.Fatalf("failed to prepare directory: %v", err)
+	}
+	if err := ioutil.WriteFile(c.cachePath(key2), b, 0600); err != nil {
+		t.Fatalf("failed to write the cache file: %v", err)
+	}
+	if _, err := c.Get(key2); err == nil {
+		t.Errorf("contents of other key must not be read")
+	}
+
+	// tampered contents must be rejected
+	b[len(b)-1] ^= 0xff
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatalf("failed to write the cache file: %v", err)
+	}
+	if _, err := c.Get(key); err == nil {
+		t.Errorf("tampered cache must not be read")
+	}
+}
+
+func TestDirectoryCacheCompaction(t *testing.T) {
+	for _, aead := range []cipher.AEAD{nil, newTestCipher(t, 1)} {
+		t.Run(fmt.Sprintf("encrypted=%v", aead != nil), func(t *testing.T) {
+			testDirectoryCacheCompaction(t, aead)
+		})
+	}
+}
+
+func testDirectoryCacheCompaction(t *testing.T, aead cipher.AEAD) {
+	tmp, err := ioutil.TempDir("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	newCache := func() *directoryCache {
+		c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{
+			SyncAdd:          true,
+			Direct:           true,
+			Cipher:           aead,
+			CompactColdAfter: time.Hour,
+			MaxPackSize:      50, // a few entries per packfile
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c.(*directoryCache)
+	}
+	c := newCache()
+	var (
+		cold = map[string]string{}
+		hot  = map[string]string{}
+	)
+	for i := 0; i < 10; i++ {
+		data := fmt.Sprintf("%s-%d", sampleData, i)
+		key := digestFor(data)
+		w, err := c.Add(key)
+		if err != nil {
+			t.Fatalf("failed to add %v: %v", key, err)
+		}
+		if _, err := w.Write([]byte(data)); err != nil {
+			t.Fatalf("failed to write %v: %v", key, err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit %v: %v", key, err)
+		}
+		w.Close()
+		if i%3 == 0 {
+			hot[key] = data
+			continue
+		}
+		cold[key] = data
+		past := time.Now().Add(-2 * time.Hour)
+		if err := os.Chtimes(c.cachePath(key), past, past); err != nil {
+			t.Fatalf("failed to change times: %v", err)
+		}
+	}
+	if err := c.Compact(); err != nil {
+		t.Fatalf("failed to compact: %v", err)
+	}
+
+	// cold entries must be packed and hot entries must be kept as loose files.
+	for key := range cold {
+		if _, err := os.Stat(c.cachePath(key)); !os.IsNotExist(err) {
+			t.Errorf("cold entry %q must be packed: %v", key, err)
+		}
+	}
+	for key := range hot {
+		if _, err := os.Stat(c.cachePath(key)); err != nil {
+			t.Errorf("hot entry %q must be kept as a loose file: %v", key, err)
+		}
+	}
+	packs, err := filepath.Glob(filepath.Join(c.packDirectory, "*"+packSuffix))
+	if err != nil {
+		t.Fatalf("failed to list packfiles: %v", err)
+	}
+	if len(packs) < 2 {
+		t.Errorf("entries must be split into packfiles by the max size; got %d", len(packs))
+	}
+
+	check := func(c BlobCache) {
+		for _, m := range []map[string]string{cold, hot} {
+			for key, data := range m {
+				testChunk(t, c, key, 0, data)
+				testChunk(t, c, key, 3, data[3:6])
+			}
+		}
+	}
+	check(c)
+
+	// packfiles must be loaded on restart
+	check(newCache())
+}
+
+func newTestCipher(t *testing.T, seed byte) cipher.AEAD {
+	block, err := aes.NewCipher(bytes.Repeat([]byte{seed}, 32))
+	if err != nil {
+		t.Fatalf("failed to make cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("failed to make cipher: %v", err)
+	}
+	return aead
+}
+
+// fakeCachefiles records the commands written to cachefiles and reports the
+// state of the cache.
+type fakeCachefiles struct {
+	cmds  []string
+	state string
+	mu    sync.Mutex
+}
+
+func (d *fakeCachefiles) Read(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return copy(p, d.state), nil
+}
+
+func (d *fakeCachefiles) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cmds = append(d.cmds, string(p))
+	return len(p), nil
+}
+
+func (d *fakeCachefiles) Close() error { return nil }
+
+func (d *fakeCachefiles) setState(state string) {
+	d.mu.Lock()
+	d.state = state
+	d.mu.Unlock()
+}
+
+func TestCullingCachefilesCache(t *testing.T) {
+	newCache := func() (BlobCache, cleanFunc) {
+		tmp, err := ioutil.TempDir("", "testcache")
+		if err != nil {
+			t.Fatalf("failed to make tempdir: %v", err)
+		}
+		fc, err := newCullingCachefilesCache(tmp, &fakeCachefiles{}, CullingCachefilesConfig{})
+		if err != nil {
+			t.Fatalf("failed to make cachefiles culling cache: %v", err)
+		}
+		c, err := fc.NewCache()
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c, func() { fc.Close(); os.RemoveAll(tmp) }
+	}
+	testCache(t, "cachefiles-culling", newCache)
+
+	if _, err := NewCullingCachefilesCache("/tmp/cachefiles-culling", CullingCachefilesConfig{Device: "/dev/nonexistent-cachefiles"}); err == nil {
+		t.Errorf("cachefiles culling cache must fail without cachefiles device")
+	}
+}
+
+func TestCullingCachefilesCacheCull(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	dev := &fakeCachefiles{}
+	fc, err := newCullingCachefilesCache(tmp, dev, CullingCachefilesConfig{Tag: "test", CullInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to make cachefiles culling cache: %v", err)
+	}
+	defer fc.Close()
+	wantCmds := []string{"dir " + tmp, "tag test", "bind"}
+	if fmt.Sprint(dev.cmds) != fmt.Sprint(wantCmds) {
+		t.Errorf("commands = %q; want %q", dev.cmds, wantCmds)
+	}
+	c, err := fc.NewCache()
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	defer c.Close()
+	var keys []string
+	for i := 0; i < 3; i++ {
+		key := digestFor(fmt.Sprintf("%s-%d", sampleData, i))
+		keys = append(keys, key)
+		w, err := c.Add(key)
+		if err != nil {
+			t.Fatalf("failed to add %q: %v", key, err)
+		}
+		if _, err := w.Write([]byte(sampleData)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+		w.Close()
+	}
+	// Nothing is culled unless the kernel requests it.
+	dev.setState("cull=0 frun=0 fcull=0 fstop=0 brun=0 bcull=0 bstop=0")
+	if err := fc.cullIfRequested(); err != nil {
+		t.Fatalf("failed to cull: %v", err)
+	}
+	for _, key := range keys {
+		if r, err := c.Get(key); err != nil {
+			t.Errorf("%q must not be culled: %v", key, err)
+		} else {
+			r.Close()
+		}
+	}
+
+	// keys[0] becomes the most recently used.
+	r, err := c.Get(keys[0])
+	if err != nil {
+		t.Fatalf("failed to get %q: %v", keys[0], err)
+	}
+	r.Close()
+
+	// The least recently used entry is culled first.
+	if n := fc.cull(1); n != 1 {
+		t.Fatalf("culled %d entries; want 1", n)
+	}
+	if _, err := c.Get(keys[1]); err == nil {
+		t.Errorf("least recently used entry %q must be culled", keys[1])
+	}
+
+	// All entries are culled while the kernel requests it.
+	dev.setState("cull=1 frun=0 fcull=0 fstop=0 brun=0 bcull=0 bstop=0")
+	if err := fc.cullIfRequested(); err != nil {
+		t.Fatalf("failed to cull: %v", err)
+	}
+	for _, key := range keys {
+		if _, err := c.Get(key); err == nil {
+			t.Errorf("%q must be culled", key)
+		}
+	}
+}
+
+func TestEvictionPolicies(t *testing.T) {
+	// size: least recently used entries are evicted.
+	sp := NewSizeEvictionPolicy(10)
+	sp.Add("a", 4)
+	sp.Add("b", 4)
+	sp.Access("a")
+	if evicted := sp.Evict(nil); len(evicted) != 0 {
+		t.Errorf("size: nothing must be evicted but got %v", evicted)
+	}
+	sp.Add("c", 4)
+	if evicted := sp.Evict(nil); fmt.Sprint(evicted) != "[b]" {
+		t.Errorf("size: evicted %v; want [b]", evicted)
+	}
+	sp.Remove("a")
+	sp.Add("d", 6)
+	if evicted := sp.Evict(nil); len(evicted) != 0 {
+		t.Errorf("size: removed entry must not be counted but evicted %v", evicted)
+	}
+
+	// lfu: least frequently used entries are evicted.
+	lp := NewLFUEvictionPolicy(2)
+	lp.Add("a", 1)
+	lp.Add("b", 1)
+	lp.Access("a")
+	lp.Access("b")
+	lp.Access("b")
+	lp.Add("c", 1)
+	lp.Access("c")
+	lp.Access("unknown")
+	if evicted := lp.Evict(nil); fmt.Sprint(evicted) != "[a]" {
+		t.Errorf("lfu: evicted %v; want [a]", evicted)
+	}
+
+	// lfu: kept entries are skipped and stay in the policy.
+	lp = NewLFUEvictionPolicy(2)
+	lp.Add("a", 1)
+	lp.Add("b", 1)
+	lp.Add("c", 1)
+	lp.Access("c")
+	if evicted := lp.Evict(func(id string) bool { return id == "a" }); fmt.Sprint(evicted) != "[b]" {
+		t.Errorf("lfu: evicted %v; want [b]", evicted)
+	}
+	lp.Add("d", 1)
+	if evicted := lp.Evict(nil); fmt.Sprint(evicted) != "[a]" {
+		t.Errorf("lfu: kept entry must remain; evicted %v; want [a]", evicted)
+	}
+
+	// size: kept entries are skipped.
+	sp = NewSizeEvictionPolicy(4)
+	sp.Add("a", 4)
+	sp.Add("b", 4)
+	if evicted := sp.Evict(func(id string) bool { return id == "a" }); fmt.Sprint(evicted) != "[b]" {
+		t.Errorf("size: evicted %v; want [b]", evicted)
+	}
+
+	// ttl: entries not accessed for the ttl are evicted.
+	now := time.Now()
+	tp := NewTTLEvictionPolicy(time.Minute).(*ttlPolicy)
+	tp.now = func() time.Time { return now }
+	tp.Add("a", 1)
+	tp.Add("b", 1)
+	now = now.Add(30 * time.Second)
+	tp.Access("a")
+	if evicted := tp.Evict(nil); len(evicted) != 0 {
+		t.Errorf("ttl: nothing must be evicted but got %v", evicted)
+	}
+	now = now.Add(45 * time.Second)
+	if evicted := tp.Evict(nil); fmt.Sprint(evicted) != "[b]" {
+		t.Errorf("ttl: evicted %v; want [b]", evicted)
+	}
+}
+
+func TestDirectoryCacheEviction(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	policy := NewSizeEvictionPolicy(int64(len(sampleData) * 2))
+	newCache := func(dir string) BlobCache {
+		c, err := NewDirectoryCache(filepath.Join(tmp, dir), DirectoryCacheConfig{
+			SyncAdd:        true,
+			Direct:         true,
+			EvictionPolicy: policy,
+		})
+		if err != nil {
+			t.Fatalf("failed to make cache: %v", err)
+		}
+		return c
+	}
+	add := func(c BlobCache, key string) {
+		w, err := c.Add(key)
+		if err != nil {
+			t.Fatalf("failed to add %q: %v", key, err)
+		}
+		defer w.Close()
+		if _, err := w.Write([]byte(sampleData)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatalf("failed to commit: %v", err)
+		}
+	}
+	cached := func(c BlobCache, key string) bool {
+		r, err := c.Get(key, Direct())
+		if err != nil {
+			return false
+		}
+		r.Close()
+		return true
+	}
+
+	// The policy is shared among caches.
+	c1, c2 := newCache("c1"), newCache("c2")
+	k1, k2, k3 := digestFor("1"), digestFor("2"), digestFor("3")
+	add(c1, k1)
+	add(c2, k2)
+	if !cached(c1, k1) || !cached(c2, k2) {
+		t.Fatalf("entries must be cached within the limit")
+	}
+	add(c2, k3)
+	if cached(c1, k1) {
+		t.Errorf("least recently used entry of another cache must be evicted")
+	}
+	if !cached(c2, k2) || !cached(c2, k3) {
+		t.Errorf("recently used entries must not be evicted")
+	}
+
+	// Entries of pinned caches and entries being read aren't evicted.
+	c1.(PinnableCache).Pin(true)
+	add(c1, k1)
+	if cached(c2, k2) {
+		t.Errorf("least recently used entry must be evicted")
+	}
+	r, err := c2.Get(k3, Direct())
+	if err != nil {
+		t.Fatalf("failed to get %q: %v", k3, err)
+	}
+	add(c2, k2)
+	r.Close()
+	if !cached(c1, k1) || !cached(c2, k3) {
+		t.Errorf("pinned and opened entries must not be evicted")
+	}
+	if cached(c2, k2) {
+		t.Errorf("unpinned entry must be evicted instead")
+	}
+	c1.(PinnableCache).Pin(false)
+
+	// Entries of the closed cache don't count.
+	if err := c2.Close(); err != nil {
+		t.Fatalf("failed to close cache: %v", err)
+	}
+	add(c1, k1)
+	add(c1, k2)
+	if !cached(c1, k1) || !cached(c1, k2) {
+		t.Errorf("entries of closed cache must not be counted")
+	}
+	c1.Close()
+}
+
+func TestDirectoryCacheRemove(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testcache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	c, err := NewDirectoryCache(tmp, DirectoryCacheConfig{SyncAdd: true})
+	if err != nil {
+		t.Fatalf("failed to make cache: %v", err)
+	}
+	defer c.Close()
+	key := digestFor(sampleData)
+	w, err := c.Add(key)
+	if err != nil {
+		t.Fatalf("failed to add %q: %v", key, err)
+	}
+	if _, err := w.Write([]byte(sampleData)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	w.Close()
+	testChunk(t, c, key, 0, sampleData) // entry is on the memory and the disk
+	if err := c.(RemovableCache).Remove(key); err != nil {
+		t.Fatalf("failed to remove: %v", err)
+	}
+	for _, opts := range [][]Option{nil, {Direct()}} {
+		if r, err := c.Get(key, opts...); err == nil {
+			r.Close()
+			t.Errorf("removed entry must not be cached (opts=%d)", len(opts))
+		}
+	}
+	if err := c.(RemovableCache).Remove(key); err != nil {
+		t.Errorf("removing missing entry must succeed: %v", err)
+	}
 }
 
 func TestMemoryCache(t *testing.T) {
 	testCache(t, "memory", func() (BlobCache, cleanFunc) { return NewMemoryCache(), func() {} })
 }
 
+func TestCacheFaults(t *testing.T) {
+	// Faults aren't injected when disabled.
+	c := WithFaults(NewMemoryCache(), faultinject.New(faultinject.Config{}))
+	if _, ok := c.(*MemoryCache); !ok {
+		t.Fatalf("cache must not be wrapped if faults are disabled")
+	}
+	testCache(t, "memory-faults-disabled", func() (BlobCache, cleanFunc) {
+		return WithFaults(NewMemoryCache(), faultinject.New(faultinject.Config{})), func() {}
+	})
+
+	i := faultinject.New(faultinject.Config{ErrorRate: 1.0})
+	c = WithFaults(NewMemoryCache(), i)
+	if _, err := c.Add("test"); err != faultinject.ErrInjected {
+		t.Errorf("Add must fail with injected fault but got %v", err)
+	}
+	i.Set(faultinject.Config{})
+	w, err := c.Add("test")
+	if err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	if _, err := w.Write([]byte(sampleData)); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	w.Close()
+	i.Set(faultinject.Config{ErrorRate: 1.0})
+	if _, err := c.Get("test"); err != faultinject.ErrInjected {
+		t.Errorf("Get must fail with injected fault but got %v", err)
+	}
+
+	// Short reads are reported as errors.
+	i.Set(faultinject.Config{ShortReadRate: 1.0})
+	r, err := c.Get("test")
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	defer r.Close()
+	p := make([]byte, len(sampleData))
+	if n, err := r.ReadAt(p, 0); err != io.ErrUnexpectedEOF || n >= len(p) {
+		t.Errorf("ReadAt must be short but got %d bytes: %v", n, err)
+	}
+}
+
 type cleanFunc func()
 
 func testCache(t *testing.T, name string, newCache func() (BlobCache, cleanFunc)) {
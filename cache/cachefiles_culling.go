@@ -0,0 +1,356 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultCachefilesDevice is the device of the kernel's cachefiles module.
+	DefaultCachefilesDevice = "/dev/cachefiles"
+
+	defaultCullingTag           = "stargz"
+	defaultCullingCullInterval  = time.Second
+	defaultCullingCullBatchSize = 64
+)
+
+// CullingCachefilesConfig is config for CullingCachefilesCache.
+type CullingCachefilesConfig struct {
+	// Tag is the tag of the cache in cachefiles (default: "stargz"). This must
+	// be unique among the caches bound on the host.
+	Tag string
+
+	// Device is the cachefiles device (default: DefaultCachefilesDevice).
+	Device string
+
+	// CullInterval is the interval of checking whether the kernel requests to
+	// cull the cache (default: 1s).
+	CullInterval time.Duration
+}
+
+// CullingCachefilesCache is the culling-only variant of cachefiles. It stores
+// cache entries in a directory bound to the kernel's cachefiles (fscache)
+// module. The kernel monitors the free space and files of
+// the filesystem of the directory (following the brun, bcull and bstop limits
+// of cachefiles) and requests culling when they are running out, then the
+// least recently used entries are removed.
+//
+// Only culling is delegated to the kernel. Entries are stored as plain files
+// and read by the filesystem in user space like the directory cache, so
+// contents are still served through FUSE (this isn't EROFS over fscache).
+type CullingCachefilesCache struct {
+	directory string
+	dev       io.ReadWriteCloser
+
+	// entries is the list of the paths of the entries ordered by the last
+	// access. The front is the least recently used one.
+	entries *list.List
+	index   map[string]*list.Element
+	mu      sync.Mutex
+
+	stopCull  chan struct{}
+	closeOnce sync.Once
+}
+
+// NewCullingCachefilesCache binds the directory to cachefiles. This fails if the kernel
+// doesn't support cachefiles or the caller doesn't have CAP_SYS_ADMIN. The
+// binding is released on Close.
+func NewCullingCachefilesCache(directory string, config CullingCachefilesConfig) (*CullingCachefilesCache, error) {
+	if !filepath.IsAbs(directory) {
+		return nil, fmt.Errorf("cachefiles culling cache path must be an absolute path; got %q", directory)
+	}
+	device := config.Device
+	if device == "" {
+		device = DefaultCachefilesDevice
+	}
+	dev, err := os.OpenFile(device, os.O_RDWR, 0)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cachefiles is unavailable")
+	}
+	fc, err := newCullingCachefilesCache(directory, dev, config)
+	if err != nil {
+		dev.Close()
+		return nil, err
+	}
+	return fc, nil
+}
+
+func newCullingCachefilesCache(directory string, dev io.ReadWriteCloser, config CullingCachefilesConfig) (*CullingCachefilesCache, error) {
+	tag := config.Tag
+	if tag == "" {
+		tag = defaultCullingTag
+	}
+	cullInterval := config.CullInterval
+	if cullInterval == 0 {
+		cullInterval = defaultCullingCullInterval
+	}
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	// cachefiles manages "cache" and "graveyard" directories under the bound
+	// directory. Entries are stored separately from them.
+	chunkdir := filepath.Join(directory, "chunks")
+	if err := os.RemoveAll(chunkdir); err != nil {
+		return nil, errors.Wrapf(err, "failed to clean up stale entries")
+	}
+	if err := os.MkdirAll(chunkdir, 0700); err != nil {
+		return nil, err
+	}
+	for _, cmd := range []string{"dir " + directory, "tag " + tag, "bind"} {
+		if _, err := dev.Write([]byte(cmd)); err != nil {
+			return nil, errors.Wrapf(err, "failed to bind cachefiles (%q)", cmd)
+		}
+	}
+	fc := &CullingCachefilesCache{
+		directory: chunkdir,
+		dev:       dev,
+		entries:   list.New(),
+		index:     make(map[string]*list.Element),
+		stopCull:  make(chan struct{}),
+	}
+	go fc.cullLoop(cullInterval)
+	return fc, nil
+}
+
+// NewCache returns a new cache stored in a unique directory under the
+// directory of the CullingCachefilesCache. The directory is removed on Close of the cache.
+func (fc *CullingCachefilesCache) NewCache() (BlobCache, error) {
+	dir, err := ioutil.TempDir(fc.directory, "")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to initialize cachefiles culling cache")
+	}
+	wipdir := filepath.Join(dir, "wip")
+	if err := os.MkdirAll(wipdir, 0700); err != nil {
+		return nil, err
+	}
+	return &cullingCache{fc: fc, directory: dir, wipDirectory: wipdir}, nil
+}
+
+// Close stops culling and releases the binding of cachefiles. Entries are
+// removed by the kernel afterwards.
+func (fc *CullingCachefilesCache) Close() (err error) {
+	fc.closeOnce.Do(func() {
+		close(fc.stopCull)
+		err = fc.dev.Close()
+	})
+	return
+}
+
+func (fc *CullingCachefilesCache) cullLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := fc.cullIfRequested(); err != nil {
+				log.L.WithError(err).Warn("failed to cull cachefiles culling cache")
+			}
+		case <-fc.stopCull:
+			return
+		}
+	}
+}
+
+// cullIfRequested reads the state of the cache from cachefiles and removes the
+// least recently used entries while the kernel requests culling.
+func (fc *CullingCachefilesCache) cullIfRequested() error {
+	for {
+		requested, err := fc.cullRequested()
+		if err != nil || !requested {
+			return err
+		}
+		if n := fc.cull(defaultCullingCullBatchSize); n == 0 {
+			return nil // nothing to cull
+		}
+	}
+}
+
+// cullRequested returns true if the state reported by cachefiles contains
+// "cull=1". cachefiles returns nothing if the state isn't changed since the
+// last read.
+func (fc *CullingCachefilesCache) cullRequested() (bool, error) {
+	buf := make([]byte, 512)
+	n, err := fc.dev.Read(buf)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	for _, f := range strings.Fields(string(buf[:n])) {
+		if f == "cull=1" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// cull removes at most n least recently used entries and returns the number of
+// removed entries.
+func (fc *CullingCachefilesCache) cull(n int) (culled int) {
+	fc.mu.Lock()
+	var paths []string
+	for e := fc.entries.Front(); e != nil && len(paths) < n; e = fc.entries.Front() {
+		p := fc.entries.Remove(e).(string)
+		delete(fc.index, p)
+		paths = append(paths, p)
+	}
+	fc.mu.Unlock()
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.L.WithError(err).Debugf("failed to cull %q", p)
+			continue
+		}
+		culled++
+	}
+	return
+}
+
+// touch marks the entry as the most recently used.
+func (fc *CullingCachefilesCache) touch(path string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if e, ok := fc.index[path]; ok {
+		fc.entries.MoveToBack(e)
+		return
+	}
+	fc.index[path] = fc.entries.PushBack(path)
+}
+
+// untrack stops tracking the entry.
+func (fc *CullingCachefilesCache) untrack(path string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if e, ok := fc.index[path]; ok {
+		fc.entries.Remove(e)
+		delete(fc.index, path)
+	}
+}
+
+// forget stops tracking the entries under the directory.
+func (fc *CullingCachefilesCache) forget(dir string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	prefix := dir + string(filepath.Separator)
+	for p, e := range fc.index {
+		if strings.HasPrefix(p, prefix) {
+			fc.entries.Remove(e)
+			delete(fc.index, p)
+		}
+	}
+}
+
+// cullingCache is a cache stored in a directory of CullingCachefilesCache.
+type cullingCache struct {
+	fc           *CullingCachefilesCache
+	directory    string
+	wipDirectory string
+
+	closed   bool
+	closedMu sync.Mutex
+}
+
+func (c *cullingCache) Get(key string, opts ...Option) (Reader, error) {
+	if c.isClosed() {
+		return nil, fmt.Errorf("cache is already closed")
+	}
+	p := c.cachePath(key)
+	file, err := os.Open(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open blob file for %q", key)
+	}
+	c.fc.touch(p)
+	return &reader{
+		ReaderAt:  file,
+		closeFunc: file.Close,
+	}, nil
+}
+
+func (c *cullingCache) Add(key string, opts ...Option) (Writer, error) {
+	if c.isClosed() {
+		return nil, fmt.Errorf("cache is already closed")
+	}
+	wip, err := ioutil.TempFile(c.wipDirectory, key+"-*")
+	if err != nil {
+		return nil, err
+	}
+	return &writer{
+		WriteCloser: wip,
+		commitFunc: func() error {
+			if c.isClosed() {
+				return fmt.Errorf("cache is already closed")
+			}
+			p := c.cachePath(key)
+			if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+				os.Remove(wip.Name())
+				return errors.Wrapf(err, "failed to create cache directory %q", p)
+			}
+			if err := os.Rename(wip.Name(), p); err != nil {
+				return err
+			}
+			c.fc.touch(p)
+			return nil
+		},
+		abortFunc: func() error {
+			return os.Remove(wip.Name())
+		},
+	}, nil
+}
+
+var _ = (RemovableCache)((*cullingCache)(nil))
+
+func (c *cullingCache) Remove(key string) error {
+	if c.isClosed() {
+		return fmt.Errorf("cache is already closed")
+	}
+	p := c.cachePath(key)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove cache file %q", key)
+	}
+	c.fc.untrack(p)
+	return nil
+}
+
+func (c *cullingCache) Close() error {
+	c.closedMu.Lock()
+	defer c.closedMu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.fc.forget(c.directory)
+	return os.RemoveAll(c.directory)
+}
+
+func (c *cullingCache) isClosed() bool {
+	c.closedMu.Lock()
+	defer c.closedMu.Unlock()
+	return c.closed
+}
+
+func (c *cullingCache) cachePath(key string) string {
+	return filepath.Join(c.directory, key[:2], key)
+}
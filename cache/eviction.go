@@ -0,0 +1,289 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// EvictionPolicy decides which entries of directory caches are evicted from
+// the disk. Entries are identified by the paths of their files so a policy can
+// be shared among caches to bound the total usage of them. Implementations
+// must be safe for concurrent use and must ignore unknown entries.
+type EvictionPolicy interface {
+	// Add records the entry written to the disk with its size in bytes.
+	Add(id string, size int64)
+
+	// Access records that the entry is read.
+	Access(id string)
+
+	// Remove forgets the entry removed from the disk (e.g. the cache is closed).
+	Remove(id string)
+
+	// Evict returns the entries to be evicted now. Entries for which keep
+	// returns true (e.g. pinned or in use) are kept and others are evicted
+	// instead. keep can be nil. The returned entries are forgotten by the
+	// policy.
+	Evict(keep func(id string) bool) []string
+}
+
+// NewSizeEvictionPolicy returns a policy which evicts the least recently used
+// entries while the total size of the entries exceeds maxBytes.
+func NewSizeEvictionPolicy(maxBytes int64) EvictionPolicy {
+	return &sizePolicy{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+type sizeEntry struct {
+	id   string
+	size int64
+}
+
+type sizePolicy struct {
+	maxBytes int64
+	total    int64
+	ll       *list.List // front is the least recently used
+	entries  map[string]*list.Element
+	mu       sync.Mutex
+}
+
+func (p *sizePolicy) Add(id string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[id]; ok {
+		p.total += size - e.Value.(*sizeEntry).size
+		e.Value.(*sizeEntry).size = size
+		p.ll.MoveToBack(e)
+		return
+	}
+	p.entries[id] = p.ll.PushBack(&sizeEntry{id, size})
+	p.total += size
+}
+
+func (p *sizePolicy) Access(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[id]; ok {
+		p.ll.MoveToBack(e)
+	}
+}
+
+func (p *sizePolicy) Remove(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[id]; ok {
+		p.remove(e)
+	}
+}
+
+func (p *sizePolicy) Evict(keep func(id string) bool) (evicted []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for e := p.ll.Front(); e != nil && p.total > p.maxBytes; {
+		next := e.Next()
+		if id := e.Value.(*sizeEntry).id; keep == nil || !keep(id) {
+			evicted = append(evicted, p.remove(e))
+		}
+		e = next
+	}
+	return
+}
+
+func (p *sizePolicy) remove(e *list.Element) string {
+	ent := p.ll.Remove(e).(*sizeEntry)
+	delete(p.entries, ent.id)
+	p.total -= ent.size
+	return ent.id
+}
+
+// NewLFUEvictionPolicy returns a policy which evicts the least frequently used
+// entries while the number of the entries exceeds maxEntries. The older one is
+// evicted among entries used the same times.
+func NewLFUEvictionPolicy(maxEntries int) EvictionPolicy {
+	return &lfuPolicy{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*lfuEntry),
+	}
+}
+
+type lfuEntry struct {
+	id    string
+	count int64
+	seq   int64 // order of addition
+	index int   // index in the heap
+}
+
+// lfuHeap is a min-heap of the entries ordered by the use count, then by the
+// order of addition.
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	return h[i].count < h[j].count || (h[i].count == h[j].count && h[i].seq < h[j].seq)
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+type lfuPolicy struct {
+	maxEntries int
+	entries    map[string]*lfuEntry
+	heap       lfuHeap
+	seq        int64
+	mu         sync.Mutex
+}
+
+func (p *lfuPolicy) Add(id string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.entries[id]; ok {
+		return
+	}
+	p.seq++
+	e := &lfuEntry{id: id, seq: p.seq}
+	p.entries[id] = e
+	heap.Push(&p.heap, e)
+}
+
+func (p *lfuPolicy) Access(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[id]; ok {
+		e.count++
+		heap.Fix(&p.heap, e.index)
+	}
+}
+
+func (p *lfuPolicy) Remove(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[id]; ok {
+		heap.Remove(&p.heap, e.index)
+		delete(p.entries, id)
+	}
+}
+
+func (p *lfuPolicy) Evict(keep func(id string) bool) (evicted []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var kept []*lfuEntry
+	for len(p.entries) > p.maxEntries && p.heap.Len() > 0 {
+		e := heap.Pop(&p.heap).(*lfuEntry)
+		if keep != nil && keep(e.id) {
+			kept = append(kept, e)
+			continue
+		}
+		delete(p.entries, e.id)
+		evicted = append(evicted, e.id)
+	}
+	for _, e := range kept {
+		heap.Push(&p.heap, e)
+	}
+	return
+}
+
+// NewTTLEvictionPolicy returns a policy which evicts the entries which haven't
+// been accessed for the ttl.
+func NewTTLEvictionPolicy(ttl time.Duration) EvictionPolicy {
+	return &ttlPolicy{
+		ttl:     ttl,
+		ll:      list.New(),
+		entries: make(map[string]*list.Element),
+		now:     time.Now,
+	}
+}
+
+type ttlEntry struct {
+	id         string
+	lastAccess time.Time
+}
+
+type ttlPolicy struct {
+	ttl     time.Duration
+	ll      *list.List // front is the least recently used
+	entries map[string]*list.Element
+	now     func() time.Time
+	mu      sync.Mutex
+}
+
+func (p *ttlPolicy) Add(id string, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.touch(id) {
+		p.entries[id] = p.ll.PushBack(&ttlEntry{id, p.now()})
+	}
+}
+
+func (p *ttlPolicy) Access(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.touch(id)
+}
+
+// touch updates the last access time of the entry if exists.
+func (p *ttlPolicy) touch(id string) bool {
+	e, ok := p.entries[id]
+	if ok {
+		e.Value.(*ttlEntry).lastAccess = p.now()
+		p.ll.MoveToBack(e)
+	}
+	return ok
+}
+
+func (p *ttlPolicy) Remove(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.entries[id]; ok {
+		p.ll.Remove(e)
+		delete(p.entries, id)
+	}
+}
+
+func (p *ttlPolicy) Evict(keep func(id string) bool) (evicted []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	deadline := p.now().Add(-p.ttl)
+	for e := p.ll.Front(); e != nil && e.Value.(*ttlEntry).lastAccess.Before(deadline); {
+		next := e.Next()
+		if id := e.Value.(*ttlEntry).id; keep == nil || !keep(id) {
+			p.ll.Remove(e)
+			delete(p.entries, id)
+			evicted = append(evicted, id)
+		}
+		e = next
+	}
+	return
+}
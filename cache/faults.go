@@ -0,0 +1,63 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"github.com/containerd/stargz-snapshotter/util/faultinject"
+)
+
+// WithFaults returns a BlobCache which injects faults into Get, Add and reads
+// from the cache using the injector. If the injector is nil, the cache is
+// returned as is.
+func WithFaults(c BlobCache, i *faultinject.Injector) BlobCache {
+	if i == nil {
+		return c
+	}
+	return &faultyCache{c, i}
+}
+
+type faultyCache struct {
+	BlobCache
+	i *faultinject.Injector
+}
+
+func (fc *faultyCache) Get(key string, opts ...Option) (Reader, error) {
+	if err := fc.i.Fault(); err != nil {
+		return nil, err
+	}
+	r, err := fc.BlobCache.Get(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &reader{
+		ReaderAt:  fc.i.ReaderAt(r),
+		closeFunc: r.Close,
+	}, nil
+}
+
+func (fc *faultyCache) Add(key string, opts ...Option) (Writer, error) {
+	if err := fc.i.Fault(); err != nil {
+		return nil, err
+	}
+	return fc.BlobCache.Add(key, opts...)
+}
+
+func (fc *faultyCache) Pin(pinned bool) {
+	if pc, ok := fc.BlobCache.(PinnableCache); ok {
+		pc.Pin(pinned)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"io"
+	"os"
+
+	"github.com/containerd/stargz-snapshotter/util/iouring"
+)
+
+// fileReaderAt returns io.ReaderAt of the file. If io_uring is enabled,
+// reads are submitted through the ring.
+func (dc *directoryCache) fileReaderAt(f *os.File) io.ReaderAt {
+	if dc.ring == nil {
+		return f
+	}
+	return &ringReaderAt{dc.ring, f}
+}
+
+// fileWriter returns io.WriteCloser of the file. If io_uring is enabled,
+// writes are submitted through the ring.
+func (dc *directoryCache) fileWriter(f *os.File) io.WriteCloser {
+	if dc.ring == nil {
+		return f
+	}
+	return &ringWriter{ring: dc.ring, f: f}
+}
+
+type ringReaderAt struct {
+	ring *iouring.Ring
+	f    *os.File
+}
+
+func (r *ringReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.ring.ReadAt(r.f, p, off)
+}
+
+// ringWriter sequentially writes to the file through the ring.
+type ringWriter struct {
+	ring *iouring.Ring
+	f    *os.File
+	off  int64
+}
+
+func (w *ringWriter) Write(p []byte) (int, error) {
+	n, err := w.ring.WriteAt(w.f, p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+func (w *ringWriter) Close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,315 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+)
+
+// Packfiles
+//
+// Directory caches store each entry as a loose file under
+// "<directory>/<key[:2]>/<key>". Compaction packs cold loose files (i.e. not
+// accessed for a while) into packfiles under "<directory>/packs" and removes
+// them. Each packfile "<id>.pack" is a concatenation of the contents of the
+// entries and is accompanied by an index "<id>.idx" which records the offset
+// and the size of each entry in the packfile. Hot entries are kept as loose
+// files. Entries are looked up from loose files first then from packfiles.
+
+const (
+	packDirName   = "packs"
+	packSuffix    = ".pack"
+	packIdxSuffix = ".idx"
+	tmpSuffix     = ".tmp"
+
+	defaultCompactColdAfter = 10 * time.Minute
+	defaultMaxPackSize      = 64 * 1024 * 1024 // 64MiB
+)
+
+// CompactableCache is a cache which can pack its entries into packfiles.
+type CompactableCache interface {
+	BlobCache
+
+	// Compact packs the cold entries into packfiles.
+	Compact() error
+}
+
+// packIndexEntry is an entry of the index of a packfile.
+type packIndexEntry struct {
+	Key    string `json:"key"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// packedEntry is the location of an entry stored in a packfile.
+type packedEntry struct {
+	pack   *os.File
+	offset int64
+	size   int64
+}
+
+// loosePackCandidate is a loose file which can be packed.
+type loosePackCandidate struct {
+	key  string
+	path string
+	size int64
+}
+
+// loadPacks loads the indexes of the packfiles existing in the directory.
+func (dc *directoryCache) loadPacks() error {
+	ents, err := ioutil.ReadDir(dc.packDirectory)
+	if err != nil {
+		return err
+	}
+	for _, e := range ents {
+		name := e.Name()
+		if strings.HasSuffix(name, tmpSuffix) {
+			// Leftover of an interrupted compaction.
+			if err := os.Remove(filepath.Join(dc.packDirectory, name)); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasSuffix(name, packIdxSuffix) {
+			continue
+		}
+		id := strings.TrimSuffix(name, packIdxSuffix)
+		idx, err := readPackIndex(filepath.Join(dc.packDirectory, name))
+		if err != nil {
+			return err
+		}
+		pack, err := os.Open(filepath.Join(dc.packDirectory, id+packSuffix))
+		if err != nil {
+			return errors.Wrapf(err, "failed to open packfile of %q", name)
+		}
+		dc.registerPack(pack, idx)
+	}
+	return nil
+}
+
+func readPackIndex(p string) ([]packIndexEntry, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read pack index %q", p)
+	}
+	var idx []packIndexEntry
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse pack index %q", p)
+	}
+	return idx, nil
+}
+
+func (dc *directoryCache) registerPack(pack *os.File, idx []packIndexEntry) {
+	dc.packMu.Lock()
+	defer dc.packMu.Unlock()
+	dc.packFiles = append(dc.packFiles, pack)
+	for _, e := range idx {
+		dc.packed[e.Key] = packedEntry{pack: pack, offset: e.Offset, size: e.Size}
+	}
+}
+
+// getPacked returns the location of the entry if it's stored in a packfile.
+func (dc *directoryCache) getPacked(key string) (packedEntry, bool) {
+	dc.packMu.RLock()
+	defer dc.packMu.RUnlock()
+	e, ok := dc.packed[key]
+	return e, ok
+}
+
+func (dc *directoryCache) closePacks() error {
+	dc.packMu.Lock()
+	defer dc.packMu.Unlock()
+	var retErr error
+	for _, f := range dc.packFiles {
+		if err := f.Close(); err != nil {
+			retErr = err
+		}
+	}
+	dc.packFiles = nil
+	dc.packed = make(map[string]packedEntry)
+	return retErr
+}
+
+// Compact packs loose files which haven't been accessed for the configured
+// duration into packfiles. Packed loose files are removed.
+func (dc *directoryCache) Compact() error {
+	dc.compactMu.Lock()
+	defer dc.compactMu.Unlock()
+	if dc.isClosed() {
+		return fmt.Errorf("cache is already closed")
+	}
+	cands, err := dc.coldEntries(time.Now().Add(-dc.compactColdAfter))
+	if err != nil {
+		return err
+	}
+	for len(cands) > 0 {
+		n, err := dc.pack(cands)
+		if err != nil {
+			return err
+		}
+		cands = cands[n:]
+	}
+	return nil
+}
+
+// coldEntries lists loose files which haven't been accessed since the threshold.
+func (dc *directoryCache) coldEntries(threshold time.Time) ([]loosePackCandidate, error) {
+	dirs, err := ioutil.ReadDir(dc.directory)
+	if err != nil {
+		return nil, err
+	}
+	var cands []loosePackCandidate
+	for _, d := range dirs {
+		if !d.IsDir() || len(d.Name()) != 2 {
+			continue // not a directory of loose files (e.g. wip, packs)
+		}
+		dir := filepath.Join(dc.directory, d.Name())
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if !f.Mode().IsRegular() || !lastAccessed(f).Before(threshold) {
+				continue
+			}
+			cands = append(cands, loosePackCandidate{
+				key:  f.Name(),
+				path: filepath.Join(dir, f.Name()),
+				size: f.Size(),
+			})
+		}
+	}
+	sort.Slice(cands, func(i, j int) bool { return cands[i].key < cands[j].key })
+	return cands, nil
+}
+
+// lastAccessed returns the later one of the access time and the modification time.
+func lastAccessed(fi os.FileInfo) time.Time {
+	t := fi.ModTime()
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		if at := time.Unix(st.Atim.Unix()); at.After(t) {
+			t = at
+		}
+	}
+	return t
+}
+
+// pack packs the leading candidates into a packfile until the packfile
+// reaches the max size. This returns the number of the consumed candidates.
+func (dc *directoryCache) pack(cands []loosePackCandidate) (n int, retErr error) {
+	pf, err := ioutil.TempFile(dc.packDirectory, "pack-*"+tmpSuffix)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if retErr != nil {
+			pf.Close()
+			os.Remove(pf.Name())
+		}
+	}()
+	var (
+		idx    []packIndexEntry
+		offset int64
+	)
+	for _, c := range cands {
+		if offset > 0 && offset+c.size > dc.maxPackSize {
+			break
+		}
+		n++
+		f, err := os.Open(c.path)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // removed concurrently.
+			}
+			return 0, err
+		}
+		size, err := io.Copy(pf, f)
+		f.Close()
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to pack %q", c.key)
+		}
+		idx = append(idx, packIndexEntry{Key: c.key, Offset: offset, Size: size})
+		offset += size
+	}
+	if len(idx) == 0 {
+		pf.Close()
+		return n, os.Remove(pf.Name())
+	}
+	if err := pf.Sync(); err != nil {
+		return 0, err
+	}
+	idxData, err := json.Marshal(idx)
+	if err != nil {
+		return 0, err
+	}
+	id := strings.TrimSuffix(filepath.Base(pf.Name()), tmpSuffix)
+	idxPath := filepath.Join(dc.packDirectory, id+packIdxSuffix)
+	idxTmp := idxPath + tmpSuffix
+	if err := ioutil.WriteFile(idxTmp, idxData, 0600); err != nil {
+		os.Remove(idxTmp)
+		return 0, err
+	}
+	// The index is committed at last so the existence of the index means the
+	// packfile is complete.
+	if err := os.Rename(pf.Name(), filepath.Join(dc.packDirectory, id+packSuffix)); err != nil {
+		os.Remove(idxTmp)
+		return 0, err
+	}
+	if err := os.Rename(idxTmp, idxPath); err != nil {
+		os.Remove(idxTmp)
+		os.Remove(filepath.Join(dc.packDirectory, id+packSuffix))
+		return 0, err
+	}
+	dc.registerPack(pf, idx)
+
+	// Remove the packed loose files. Readers fall back to the packfile.
+	for _, e := range idx {
+		if err := os.Remove(dc.cachePath(e.Key)); err != nil && !os.IsNotExist(err) {
+			log.L.WithError(err).Warnf("failed to remove packed cache file %q", e.Key)
+		}
+		dc.removed(e.Key)
+	}
+	return n, nil
+}
+
+// compactLoop runs compaction periodically until the cache is closed.
+func (dc *directoryCache) compactLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := dc.Compact(); err != nil {
+				log.L.WithError(err).Warn("failed to compact cache")
+			}
+		case <-dc.stopCompaction:
+			return
+		}
+	}
+}
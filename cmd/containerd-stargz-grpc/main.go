@@ -18,6 +18,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	golog "log"
@@ -35,9 +36,8 @@ import (
 	"github.com/containerd/containerd/pkg/dialer"
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/stargz-snapshotter/service"
+	"github.com/containerd/stargz-snapshotter/service/admin"
 	"github.com/containerd/stargz-snapshotter/service/keychain/cri"
-	"github.com/containerd/stargz-snapshotter/service/keychain/dockerconfig"
-	"github.com/containerd/stargz-snapshotter/service/keychain/kubeconfig"
 	"github.com/containerd/stargz-snapshotter/service/resolver"
 	"github.com/containerd/stargz-snapshotter/version"
 	sddaemon "github.com/coreos/go-systemd/v22/daemon"
@@ -65,12 +65,17 @@ var (
 	logLevel     = flag.String("log-level", defaultLogLevel.String(), "set the logging level [trace, debug, info, warn, error, fatal, panic]")
 	rootDir      = flag.String("root", defaultRootDir, "path to the root directory for this snapshotter")
 	printVersion = flag.Bool("version", false, "print the version")
+	printOps     = flag.Bool("print-operations", false, "print the privileged operations performed with the configuration as JSON")
+	fsck         = flag.Bool("fsck", false, "validate and repair the metadata against the snapshot directories and mounts then exit (the snapshotter must be stopped)")
+	fsckDryRun   = flag.Bool("fsck-dry-run", false, "report inconsistencies found by --fsck without repairing them")
 )
 
 type snapshotterConfig struct {
 	service.Config
 
-	// MetricsAddress is address for the metrics API
+	// MetricsAddress is address for the metrics API. The localities of images
+	// (see service.ImageLocality) are also served on "/image-locality" and the
+	// version and the capabilities (see service.Info) are served on "/version".
 	MetricsAddress string `toml:"metrics_address"`
 
 	// NoPrometheus is a flag to disable the emission of the metrics
@@ -109,6 +114,27 @@ func main() {
 	if err := tree.Unmarshal(&config); err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to unmarshal config file %q", *configPath)
 	}
+	if *printOps {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(service.Operations(&config.Config)); err != nil {
+			log.G(ctx).WithError(err).Fatal("failed to print operations")
+		}
+		return
+	}
+
+	if *fsck || *fsckDryRun {
+		actions, err := service.Fsck(ctx, *rootDir, &config.Config, !*fsckDryRun)
+		if err != nil {
+			log.G(ctx).WithError(err).Fatal("failed to run fsck")
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(actions); err != nil {
+			log.G(ctx).WithError(err).Fatal("failed to print fsck results")
+		}
+		return
+	}
 
 	if err := service.Supported(*rootDir); err != nil {
 		log.G(ctx).WithError(err).Fatalf("snapshotter is not supported")
@@ -118,14 +144,7 @@ func main() {
 	rpc := grpc.NewServer()
 
 	// Configure keychain
-	credsFuncs := []resolver.Credential{dockerconfig.NewDockerconfigKeychain(ctx)}
-	if config.Config.KubeconfigKeychainConfig.EnableKeychain {
-		var opts []kubeconfig.Option
-		if kcp := config.Config.KubeconfigKeychainConfig.KubeconfigPath; kcp != "" {
-			opts = append(opts, kubeconfig.WithKubeconfigPath(kcp))
-		}
-		credsFuncs = append(credsFuncs, kubeconfig.NewKubeconfigKeychain(ctx, opts...))
-	}
+	var criCreds resolver.Credential
 	if config.Config.CRIKeychainConfig.EnableKeychain {
 		// connects to the backend CRI service (defaults to containerd socket)
 		criAddr := defaultImageServiceAddress
@@ -154,9 +173,14 @@ func main() {
 		}
 		f, criServer := cri.NewCRIKeychain(ctx, connectCRI)
 		runtime.RegisterImageServiceServer(rpc, criServer)
-		credsFuncs = append(credsFuncs, f)
+		criCreds = f
+	}
+	credsNotifier := new(resolver.CredentialsNotifier)
+	credsFuncs, err := service.NewCredsFuncs(ctx, &config.Config, criCreds, credsNotifier)
+	if err != nil {
+		log.G(ctx).WithError(err).Fatalf("failed to configure keychain")
 	}
-	rs, err := service.NewStargzSnapshotterService(ctx, *rootDir, &config.Config, service.WithCredsFuncs(credsFuncs...))
+	rs, err := service.NewStargzSnapshotterService(ctx, *rootDir, &config.Config, service.WithCredsFuncs(credsFuncs...), service.WithCredentialsNotifier(credsNotifier))
 	if err != nil {
 		log.G(ctx).WithError(err).Fatalf("failed to configure snapshotter")
 	}
@@ -180,6 +204,9 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 	// Register the service with the gRPC server
 	snapshotsapi.RegisterSnapshotsServer(rpc, snsvc)
 
+	// Register the admin service for operating the snapshotter
+	admin.RegisterAdminServer(rpc, admin.NewServer(rs))
+
 	// Prepare the directory for the socket
 	if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
 		return false, errors.Wrapf(err, "failed to create directory %q", filepath.Dir(addr))
@@ -200,6 +227,8 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 		}
 		m := http.NewServeMux()
 		m.Handle("/metrics", metrics.Handler())
+		m.Handle("/image-locality", service.ImageLocalityHandler(rs))
+		m.Handle("/version", service.InfoHandler(rs))
 		go func() {
 			if err := http.Serve(l, m); err != nil {
 				errCh <- errors.Wrapf(err, "error on serving metrics via socket %q", addr)
@@ -231,12 +260,22 @@ func serve(ctx context.Context, rpc *grpc.Server, addr string, rs snapshots.Snap
 
 	var s os.Signal
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, unix.SIGINT, unix.SIGTERM)
-	select {
-	case s = <-sigCh:
-		log.G(ctx).Infof("Got %v", s)
-	case err := <-errCh:
-		return false, err
+	signal.Notify(sigCh, unix.SIGINT, unix.SIGTERM, unix.SIGUSR1)
+	for s == nil {
+		select {
+		case sig := <-sigCh:
+			log.G(ctx).Infof("Got %v", sig)
+			if sig == unix.SIGUSR1 {
+				// Dump diagnostics and keep serving.
+				if _, err := service.LogDiagnostics(ctx, rs); err != nil {
+					log.G(ctx).WithError(err).Warn("failed to dump diagnostics")
+				}
+				continue
+			}
+			s = sig
+		case err := <-errCh:
+			return false, err
+		}
 	}
 	if s == unix.SIGINT {
 		return true, nil // do cleanup on SIGINT
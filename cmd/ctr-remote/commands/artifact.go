@@ -0,0 +1,119 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"compress/gzip"
+	"fmt"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	estargzconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// ArtifactCommand packs a directory or a tarball as an eStargz OCI artifact.
+var ArtifactCommand = cli.Command{
+	Name:      "artifact",
+	Usage:     "pack a directory or a tarball as a lazily-mountable OCI artifact",
+	ArgsUsage: "[flags] <dir|tarball> <target_ref>",
+	Description: `Build an eStargz blob from a directory or a tarball and store it as an OCI artifact.
+
+e.g., 'ctr-remote images artifact --push --prefetch-file model/index.json ./model example.com/models/foo:v1'
+`,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "artifact-type",
+			Usage: "config media type of the artifact",
+			Value: estargzconvert.DefaultArtifactType,
+		},
+		cli.StringSliceFlag{
+			Name:  "prefetch-file",
+			Usage: "file to be prefetched on mount. Can be specified multiple times",
+			Value: &cli.StringSlice{},
+		},
+		cli.IntFlag{
+			Name:  "estargz-compression-level",
+			Usage: "eStargz compression level",
+			Value: gzip.BestCompression,
+		},
+		cli.IntFlag{
+			Name:  "estargz-chunk-size",
+			Usage: "eStargz chunk size",
+			Value: 0,
+		},
+		cli.BoolFlag{
+			Name:  "push",
+			Usage: "push the artifact to the registry",
+		},
+	}, commands.RegistryFlags...),
+	Action: func(context *cli.Context) error {
+		src := context.Args().Get(0)
+		targetRef := context.Args().Get(1)
+		if src == "" || targetRef == "" {
+			return errors.New("source and target reference need to be specified")
+		}
+		esgzOpts := []estargz.Option{
+			estargz.WithCompressionLevel(context.Int("estargz-compression-level")),
+			estargz.WithChunkSize(context.Int("estargz-chunk-size")),
+		}
+		if files := context.StringSlice("prefetch-file"); len(files) > 0 {
+			esgzOpts = append(esgzOpts, estargz.WithPrioritizedFiles(files))
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+
+		desc, err := estargzconvert.ArtifactConvert(ctx, client.ContentStore(), src, context.String("artifact-type"), esgzOpts...)
+		if err != nil {
+			return err
+		}
+		is := client.ImageService()
+		img := images.Image{Name: targetRef, Target: desc}
+		if _, err := is.Create(ctx, img); err != nil {
+			if !errdefs.IsAlreadyExists(err) {
+				return err
+			}
+			if _, err := is.Update(ctx, img); err != nil {
+				return err
+			}
+		}
+		if context.Bool("push") {
+			resolver, err := commands.GetResolver(ctx, context)
+			if err != nil {
+				return err
+			}
+			if err := client.Push(ctx, targetRef, desc, containerd.WithResolver(resolver)); err != nil {
+				return errors.Wrap(err, "failed to push artifact")
+			}
+		}
+		fmt.Fprintln(context.App.Writer, desc.Digest.String())
+		return nil
+	},
+}
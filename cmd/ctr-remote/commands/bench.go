@@ -0,0 +1,408 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	dockerconfig "github.com/containerd/containerd/remotes/docker/config"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	fsconfig "github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// BenchCommand measures the performance of lazy pulling of an image.
+var BenchCommand = cli.Command{
+	Name:      "bench",
+	Usage:     "measure the performance of lazily pulling an image with stargz filesystem",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Mount all layers of an image with stargz filesystem in this process and measure
+mount latency, prefetch effectiveness and cold/warm read throughput. The result is
+printed as JSON so that configurations (e.g. chunk size, caches) can be compared.
+This requires root privileges and FUSE.
+
+e.g., 'ctr-remote bench --config /etc/containerd-stargz-grpc/config.toml ghcr.io/stargz-containers/python:3.9-esgz'
+`,
+	Flags: append([]cli.Flag{
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "path to the configuration file of stargz snapshotter (filesystem configuration is used)",
+		},
+		cli.Int64Flag{
+			Name:  "prefetch-size",
+			Usage: "prefetch size passed to each layer (0 uses the configuration)",
+		},
+		cli.BoolFlag{
+			Name:  "background-fetch",
+			Usage: "enable background fetch during the benchmark (this affects the measured fetched size)",
+		},
+		cli.BoolFlag{
+			Name:  "skip-warm",
+			Usage: "skip measuring warm read",
+		},
+	}, commands.RegistryFlags...),
+	Action: func(clicontext *cli.Context) error {
+		ref := clicontext.Args().First()
+		if ref == "" {
+			return fmt.Errorf("please provide an image reference")
+		}
+		var cfg fsconfig.Config
+		if p := clicontext.String("config"); p != "" {
+			tree, err := toml.LoadFile(p)
+			if err != nil {
+				return errors.Wrapf(err, "failed to load config file %q", p)
+			}
+			if err := tree.Unmarshal(&cfg); err != nil {
+				return errors.Wrapf(err, "failed to unmarshal config file %q", p)
+			}
+		}
+		cfg.NoPrometheus = true
+		cfg.NoBackgroundFetch = !clicontext.Bool("background-fetch")
+		hosts, err := benchHosts(clicontext)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+		res, err := bench(ctx, ref, hosts, cfg, benchOptions{
+			prefetchSize: clicontext.Int64("prefetch-size"),
+			skipWarm:     clicontext.Bool("skip-warm"),
+		})
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(clicontext.App.Writer)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	},
+}
+
+type benchOptions struct {
+	prefetchSize int64
+	skipWarm     bool
+}
+
+// BenchResult is the result of the benchmark.
+type BenchResult struct {
+	Image  string             `json:"image"`
+	Layers []BenchLayerResult `json:"layers"`
+
+	// MountLatencyMsec is the total time to mount all layers.
+	MountLatencyMsec int64 `json:"mount_latency_msec"`
+
+	// PrefetchMsec is the time to wait for the completion of prefetch of all
+	// layers after mounting.
+	PrefetchMsec int64 `json:"prefetch_msec"`
+
+	// PrefetchedSize is the size fetched until the completion of prefetch.
+	PrefetchedSize int64 `json:"prefetched_size"`
+
+	// PrefetchEffectiveness is the ratio of the size fetched by prefetch to the
+	// size fetched until the cold read completes.
+	PrefetchEffectiveness float64 `json:"prefetch_effectiveness"`
+
+	ColdRead *BenchReadResult `json:"cold_read"`
+	WarmRead *BenchReadResult `json:"warm_read,omitempty"`
+}
+
+// BenchLayerResult is the result of the benchmark of a layer.
+type BenchLayerResult struct {
+	Digest           string `json:"digest"`
+	Size             int64  `json:"size"`
+	MountLatencyMsec int64  `json:"mount_latency_msec"`
+	PrefetchedSize   int64  `json:"prefetched_size"`
+	FetchedSize      int64  `json:"fetched_size"`
+}
+
+// BenchReadResult is the result of reading all files in the image.
+type BenchReadResult struct {
+	Files          int64   `json:"files"`
+	Bytes          int64   `json:"bytes"`
+	DurationMsec   int64   `json:"duration_msec"`
+	ThroughputMBps float64 `json:"throughput_mbps"`
+}
+
+func bench(ctx context.Context, ref string, hosts docker.RegistryHosts, cfg fsconfig.Config, opts benchOptions) (_ *BenchResult, retErr error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	target, manifest, err := fetchManifest(ctx, ref, hosts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch manifest of %q", ref)
+	}
+	layerLabels, err := benchLayerLabels(ctx, ref, target, manifest, opts.prefetchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := ioutil.TempDir("", "ctr-remote-bench")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(root)
+	fs, err := stargzfs.NewFilesystem(filepath.Join(root, "stargz"), cfg,
+		stargzfs.WithGetSources(source.FromDefaultLabels(func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+			return hosts(refspec.Hostname())
+		})))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure filesystem")
+	}
+
+	res := &BenchResult{Image: refspec.String()}
+	var mountpoints []string
+	defer func() {
+		for _, mp := range mountpoints {
+			if err := fs.Unmount(ctx, mp); err != nil && retErr == nil {
+				retErr = errors.Wrapf(err, "failed to unmount %q", mp)
+			}
+		}
+	}()
+
+	// Mount all layers
+	mountStart := time.Now()
+	for i, l := range manifest.Layers {
+		mp := filepath.Join(root, "layers", fmt.Sprintf("%d", i))
+		if err := os.MkdirAll(mp, 0700); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		if err := fs.Mount(ctx, mp, layerLabels[i]); err != nil {
+			return nil, errors.Wrapf(err, "failed to mount layer %s", l.Digest)
+		}
+		mountpoints = append(mountpoints, mp)
+		res.Layers = append(res.Layers, BenchLayerResult{
+			Digest:           l.Digest.String(),
+			Size:             l.Size,
+			MountLatencyMsec: time.Since(start).Milliseconds(),
+		})
+	}
+	res.MountLatencyMsec = time.Since(mountStart).Milliseconds()
+
+	// Wait for prefetch. Check waits for the completion of prefetch.
+	prefetchStart := time.Now()
+	for i, mp := range mountpoints {
+		if err := fs.Check(ctx, mp, layerLabels[i]); err != nil {
+			return nil, errors.Wrapf(err, "failed to check layer %s", manifest.Layers[i].Digest)
+		}
+	}
+	res.PrefetchMsec = time.Since(prefetchStart).Milliseconds()
+	for i, mp := range mountpoints {
+		st, err := fs.Stats(ctx, mp)
+		if err != nil {
+			return nil, err
+		}
+		res.Layers[i].PrefetchedSize = st.FetchedSize
+		res.PrefetchedSize += st.FetchedSize
+	}
+
+	// Cold read
+	if res.ColdRead, err = readAll(mountpoints); err != nil {
+		return nil, errors.Wrap(err, "failed to read files")
+	}
+	var fetched int64
+	for i, mp := range mountpoints {
+		st, err := fs.Stats(ctx, mp)
+		if err != nil {
+			return nil, err
+		}
+		res.Layers[i].FetchedSize = st.FetchedSize
+		fetched += st.FetchedSize
+	}
+	if fetched > 0 {
+		res.PrefetchEffectiveness = float64(res.PrefetchedSize) / float64(fetched)
+	}
+
+	// Warm read
+	if !opts.skipWarm {
+		if res.WarmRead, err = readAll(mountpoints); err != nil {
+			return nil, errors.Wrap(err, "failed to read files")
+		}
+	}
+
+	return res, nil
+}
+
+func readAll(dirs []string) (*BenchReadResult, error) {
+	var res BenchReadResult
+	start := time.Now()
+	for _, dir := range dirs {
+		if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			n, err := io.Copy(ioutil.Discard, f)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read %q", path)
+			}
+			res.Files++
+			res.Bytes += n
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	d := time.Since(start)
+	res.DurationMsec = d.Milliseconds()
+	if d > 0 {
+		res.ThroughputMBps = float64(res.Bytes) / (1024 * 1024) / d.Seconds()
+	}
+	return &res, nil
+}
+
+// benchLayerLabels returns the snapshot labels of the layers which are passed
+// by containerd during lazy pulling.
+func benchLayerLabels(ctx context.Context, ref string, target ocispec.Descriptor, manifest ocispec.Manifest, prefetchSize int64) ([]map[string]string, error) {
+	h := source.AppendDefaultLabelsHandlerWrapper(ref, prefetchSize)(
+		images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			var layers []ocispec.Descriptor
+			for _, l := range manifest.Layers {
+				annotations := make(map[string]string)
+				for k, v := range l.Annotations {
+					annotations[k] = v
+				}
+				l.Annotations = annotations
+				layers = append(layers, l)
+			}
+			return layers, nil
+		}))
+	layers, err := h.Handle(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	var labels []map[string]string
+	for _, l := range layers {
+		if prefetchSize == 0 {
+			// Use the prefetch size of the configuration
+			delete(l.Annotations, fsconfig.TargetPrefetchSizeLabel)
+		}
+		if l.MediaType != "" && !strings.Contains(l.MediaType, "gzip") {
+			return nil, fmt.Errorf("layer %s isn't gzip-compressed (%s)", l.Digest, l.MediaType)
+		}
+		labels = append(labels, l.Annotations)
+	}
+	return labels, nil
+}
+
+// fetchManifest fetches the manifest of the image. If the image is an index,
+// the manifest for the current platform is returned.
+func fetchManifest(ctx context.Context, ref string, hosts docker.RegistryHosts) (ocispec.Descriptor, ocispec.Manifest, error) {
+	resolver := docker.NewResolver(docker.ResolverOptions{Hosts: hosts})
+	_, desc, err := resolver.Resolve(ctx, ref)
+	if err != nil {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, err
+	}
+	fetcher, err := resolver.Fetcher(ctx, ref)
+	if err != nil {
+		return ocispec.Descriptor{}, ocispec.Manifest{}, err
+	}
+	for {
+		data, err := fetchAll(ctx, fetcher, desc)
+		if err != nil {
+			return ocispec.Descriptor{}, ocispec.Manifest{}, err
+		}
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+			var manifest ocispec.Manifest
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return ocispec.Descriptor{}, ocispec.Manifest{}, err
+			}
+			return desc, manifest, nil
+		case ocispec.MediaTypeImageIndex, images.MediaTypeDockerSchema2ManifestList:
+			var index ocispec.Index
+			if err := json.Unmarshal(data, &index); err != nil {
+				return ocispec.Descriptor{}, ocispec.Manifest{}, err
+			}
+			var found bool
+			for _, m := range index.Manifests {
+				if m.Platform == nil || platforms.Default().Match(*m.Platform) {
+					desc, found = m, true
+					break
+				}
+			}
+			if !found {
+				return ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("no manifest for the current platform")
+			}
+		default:
+			return ocispec.Descriptor{}, ocispec.Manifest{}, fmt.Errorf("unsupported media type %q", desc.MediaType)
+		}
+	}
+}
+
+func fetchAll(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor) ([]byte, error) {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(io.LimitReader(rc, desc.Size))
+}
+
+// benchHosts returns the registry hosts configured by the registry flags.
+func benchHosts(clicontext *cli.Context) (docker.RegistryHosts, error) {
+	username := clicontext.String("user")
+	var secret string
+	if i := strings.IndexByte(username, ':'); i > 0 {
+		secret = username[i+1:]
+		username = username[0:i]
+	}
+	if username != "" && secret == "" {
+		return nil, fmt.Errorf("password must be specified with --user")
+	}
+	hostOptions := dockerconfig.HostOptions{
+		Credentials: func(host string) (string, string, error) {
+			return username, secret, nil
+		},
+	}
+	if clicontext.Bool("plain-http") {
+		hostOptions.DefaultScheme = "http"
+	}
+	if clicontext.Bool("skip-verify") {
+		hostOptions.DefaultTLS = &tls.Config{InsecureSkipVerify: true}
+	}
+	if hostDir := clicontext.String("hosts-dir"); hostDir != "" {
+		hostOptions.HostDir = dockerconfig.HostDirFromRoot(hostDir)
+	}
+	return dockerconfig.ConfigureHosts(context.Background(), hostOptions), nil
+}
@@ -0,0 +1,113 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	fsconfig "github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/opencontainers/image-spec/identity"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// CacheCommand manages the caches of images kept by stargz snapshotter.
+var CacheCommand = cli.Command{
+	Name:  "cache",
+	Usage: "manage the caches of images kept by stargz snapshotter",
+	Subcommands: []cli.Command{
+		{
+			Name:      "pin",
+			Usage:     "pin the caches of images so that they are never evicted",
+			ArgsUsage: "<ref> [<ref>...]",
+			Flags:     cacheFlags,
+			Action: func(context *cli.Context) error {
+				return setPinned(context, true)
+			},
+		},
+		{
+			Name:      "unpin",
+			Usage:     "unpin the caches of images",
+			ArgsUsage: "<ref> [<ref>...]",
+			Flags:     cacheFlags,
+			Action: func(context *cli.Context) error {
+				return setPinned(context, false)
+			},
+		},
+	},
+}
+
+var cacheFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "snapshotter",
+		Usage: "snapshotter name",
+		Value: remoteSnapshotterName,
+	},
+}
+
+func setPinned(clicontext *cli.Context, pinned bool) error {
+	refs := clicontext.Args()
+	if len(refs) == 0 {
+		return fmt.Errorf("please provide image references")
+	}
+	client, ctx, cancel, err := commands.NewClient(clicontext)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+	for _, ref := range refs {
+		if err := setImagePinned(ctx, client, clicontext.String("snapshotter"), ref, pinned); err != nil {
+			return errors.Wrapf(err, "failed to update %q", ref)
+		}
+		fmt.Println(ref)
+	}
+	return nil
+}
+
+// setImagePinned sets (or removes) the label of pinning to all snapshots of the image.
+func setImagePinned(ctx context.Context, client *containerd.Client, snapshotter, ref string, pinned bool) error {
+	img, err := client.GetImage(ctx, ref)
+	if err != nil {
+		return err
+	}
+	diffIDs, err := img.RootFS(ctx)
+	if err != nil {
+		return err
+	}
+	var value string
+	if pinned {
+		value = "true"
+	}
+	sn := client.SnapshotService(snapshotter)
+	for _, chainID := range identity.ChainIDs(diffIDs) {
+		info, err := sn.Stat(ctx, chainID.String())
+		if err != nil {
+			return errors.Wrapf(err, "failed to get snapshot %q", chainID)
+		}
+		if info.Labels == nil {
+			info.Labels = make(map[string]string)
+		}
+		info.Labels[fsconfig.TargetPinnedLabel] = value // empty value removes the label
+		if _, err := sn.Update(ctx, info, "labels."+fsconfig.TargetPinnedLabel); err != nil {
+			return errors.Wrapf(err, "failed to update snapshot %q", chainID)
+		}
+	}
+	return nil
+}
@@ -66,6 +66,10 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			Usage: "eStargz chunk size",
 			Value: 0,
 		},
+		cli.BoolFlag{
+			Name:  "estargz-keep-original",
+			Usage: "make an image index carrying both the original and eStargz variants of each platform. Runtimes unaware of eStargz pull the original one while 'ctr-remote rpull' prefers eStargz",
+		},
 		// generic flags
 		cli.BoolFlag{
 			Name:  "uncompress",
@@ -89,6 +93,7 @@ When '--all-platforms' is given all images in a manifest list must be available.
 	Action: func(context *cli.Context) error {
 		var (
 			convertOpts = []converter.Opt{}
+			platformMC  = platforms.All
 		)
 		srcRef := context.Args().Get(0)
 		targetRef := context.Args().Get(1)
@@ -106,10 +111,11 @@ When '--all-platforms' is given all images in a manifest list must be available.
 					}
 					all = append(all, p)
 				}
-				convertOpts = append(convertOpts, converter.WithPlatform(platforms.Ordered(all...)))
+				platformMC = platforms.Ordered(all...)
 			} else {
-				convertOpts = append(convertOpts, converter.WithPlatform(platforms.DefaultStrict()))
+				platformMC = platforms.DefaultStrict()
 			}
+			convertOpts = append(convertOpts, converter.WithPlatform(platformMC))
 		}
 
 		if context.Bool("estargz") {
@@ -117,7 +123,13 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			if err != nil {
 				return err
 			}
-			convertOpts = append(convertOpts, converter.WithLayerConvertFunc(estargzconvert.LayerConvertFunc(esgzOpts...)))
+			lcf := estargzconvert.LayerConvertFunc(esgzOpts...)
+			if context.Bool("estargz-keep-original") {
+				convertOpts = append(convertOpts, converter.WithIndexConvertFunc(
+					estargzconvert.DualVariantIndexConvertFunc(lcf, context.Bool("oci"), platformMC)))
+			} else {
+				convertOpts = append(convertOpts, converter.WithLayerConvertFunc(lcf))
+			}
 			if !context.Bool("oci") {
 				logrus.Warn("option --estargz should be used in conjunction with --oci")
 			}
@@ -126,6 +138,10 @@ When '--all-platforms' is given all images in a manifest list must be available.
 			}
 		}
 
+		if context.Bool("estargz-keep-original") && !context.Bool("estargz") {
+			return errors.New("option --estargz-keep-original must be used with --estargz")
+		}
+
 		if context.Bool("uncompress") {
 			convertOpts = append(convertOpts, converter.WithLayerConvertFunc(uncompress.LayerConvertFunc))
 		}
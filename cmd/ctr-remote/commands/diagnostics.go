@@ -0,0 +1,75 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/stargz-snapshotter/service/admin"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// DiagnosticsCommand dumps what stargz snapshotter is doing right now to its
+// log and prints it as JSON. This is the same as sending SIGUSR1 to the
+// snapshotter.
+var DiagnosticsCommand = cli.Command{
+	Name:  "snapshotter-diagnostics",
+	Usage: "dump mounts, fetch progress, cache statistics, in-flight requests and goroutine stacks of stargz snapshotter",
+	Flags: adminFlags,
+	Action: func(clicontext *cli.Context) error {
+		client, closeFn, err := newAdminClient(clicontext)
+		if err != nil {
+			return err
+		}
+		defer closeFn()
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+		resp, err := client.DumpDiagnostics(ctx, &admin.DumpDiagnosticsRequest{})
+		if err != nil {
+			return errors.Wrap(err, "failed to dump diagnostics")
+		}
+		_, err = os.Stdout.Write(resp.Diagnostics)
+		return err
+	},
+}
+
+// InfoCommand prints the build information and the capabilities (e.g. the
+// supported compressions of layers) of stargz snapshotter as JSON.
+var InfoCommand = cli.Command{
+	Name:  "snapshotter-info",
+	Usage: "print the version and the capabilities of stargz snapshotter",
+	Flags: adminFlags,
+	Action: func(clicontext *cli.Context) error {
+		client, closeFn, err := newAdminClient(clicontext)
+		if err != nil {
+			return err
+		}
+		defer closeFn()
+		ctx, cancel := commands.AppContext(clicontext)
+		defer cancel()
+		resp, err := client.GetInfo(ctx, &admin.GetInfoRequest{})
+		if err != nil {
+			return errors.Wrap(err, "failed to get info")
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(resp)
+	},
+}
@@ -0,0 +1,264 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/recorder"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	landmarkPrefetch   = "prefetch"
+	landmarkNoPrefetch = "no-prefetch"
+	landmarkNone       = "none"
+)
+
+// CheckLandmarkCommand reports the prefetch landmark placement of an eStargz image.
+var CheckLandmarkCommand = cli.Command{
+	Name:      "check-landmark",
+	Usage:     "report the prefetch landmark placement of an eStargz image",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Inspect each layer of an eStargz image in the content store and report the landmark
+placement, the prioritized entries and bytes and the estimated prefetch size. If a record
+file (e.g. the output of 'optimize --record-out') is specified, files accessed at runtime
+but placed after the landmark (i.e. not prefetched) are reported. This helps to debug
+why prefetch yields no speedup. The result is printed as JSON.
+
+e.g., 'ctr-remote images check-landmark --record-in record.json ghcr.io/stargz-containers/python:3.9-esgz'
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "record-in",
+			Usage: "record file of the files accessed at runtime",
+		},
+		cli.Int64Flag{
+			Name:  "prefetch-size",
+			Usage: "prefetch size configured to the filesystem (used for layers without landmark)",
+		},
+	},
+	Action: func(clicontext *cli.Context) error {
+		ref := clicontext.Args().First()
+		if ref == "" {
+			return fmt.Errorf("please provide an image reference")
+		}
+		var accessed []recorder.Entry
+		if p := clicontext.String("record-in"); p != "" {
+			var err error
+			accessed, err = readRecordFile(p)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read record file %q", p)
+			}
+		}
+		client, ctx, cancel, err := commands.NewClient(clicontext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		img, err := client.GetImage(ctx, ref)
+		if err != nil {
+			return err
+		}
+		cs := client.ContentStore()
+		manifest, err := images.Manifest(ctx, cs, img.Target(), platforms.Default())
+		if err != nil {
+			return errors.Wrapf(err, "failed to get manifest of %q", ref)
+		}
+		res := &LandmarkReport{Image: ref}
+		for i, desc := range manifest.Layers {
+			var layerAccessed []string
+			for _, e := range accessed {
+				if e.LayerIndex == nil || *e.LayerIndex == i {
+					layerAccessed = append(layerAccessed, e.Path)
+				}
+			}
+			lr, err := checkLayerLandmark(ctx, cs, desc, clicontext.Int64("prefetch-size"), layerAccessed)
+			if err != nil {
+				return errors.Wrapf(err, "failed to check layer %v", desc.Digest)
+			}
+			res.Layers = append(res.Layers, *lr)
+			res.EstimatedPrefetchSize += lr.EstimatedPrefetchSize
+		}
+		enc := json.NewEncoder(clicontext.App.Writer)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res)
+	},
+}
+
+// LandmarkReport is the result of checking the landmarks of an image.
+type LandmarkReport struct {
+	Image  string                `json:"image"`
+	Layers []LandmarkLayerReport `json:"layers"`
+
+	// EstimatedPrefetchSize is the total size prefetched from all layers.
+	EstimatedPrefetchSize int64 `json:"estimated_prefetch_size"`
+}
+
+// LandmarkLayerReport is the result of checking the landmark of a layer.
+type LandmarkLayerReport struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+
+	// EStargz is true if the layer is an eStargz layer.
+	EStargz bool `json:"estargz"`
+
+	// Landmark is the kind of the landmark ("prefetch", "no-prefetch" or "none").
+	Landmark string `json:"landmark,omitempty"`
+
+	// LandmarkOffset is the offset of the prefetch landmark in the blob.
+	LandmarkOffset int64 `json:"landmark_offset,omitempty"`
+
+	// Entries is the number of regular files in the layer.
+	Entries int `json:"entries"`
+
+	// PrioritizedEntries is the number of regular files placed before the landmark.
+	PrioritizedEntries int `json:"prioritized_entries"`
+
+	// PrioritizedBytes is the uncompressed size of the prioritized files.
+	PrioritizedBytes int64 `json:"prioritized_bytes"`
+
+	// EstimatedPrefetchSize is the size of the blob fetched by prefetch.
+	EstimatedPrefetchSize int64 `json:"estimated_prefetch_size"`
+
+	// AccessedAfterLandmark is the files accessed at runtime but not prefetched.
+	AccessedAfterLandmark []string `json:"accessed_after_landmark,omitempty"`
+
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+func checkLayerLandmark(ctx context.Context, cs content.Store, desc ocispec.Descriptor, prefetchSize int64, accessed []string) (*LandmarkLayerReport, error) {
+	res := &LandmarkLayerReport{Digest: desc.Digest.String(), Size: desc.Size}
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer ra.Close()
+	r, err := estargz.Open(io.NewSectionReader(ra, 0, ra.Size()))
+	if err != nil {
+		res.Warnings = append(res.Warnings,
+			fmt.Sprintf("not an eStargz layer (%v); lazy pulling and prefetch are unavailable", err))
+		return res, nil
+	}
+	res.EStargz = true
+
+	// prefetched reports whether the file at the offset is prefetched.
+	var prefetched func(offset int64) bool
+	if _, ok := r.Lookup(estargz.NoPrefetchLandmark); ok {
+		res.Landmark = landmarkNoPrefetch
+		prefetched = func(int64) bool { return false }
+		res.Warnings = append(res.Warnings,
+			"layer isn't prefetched because no prioritized file was specified on conversion")
+	} else if e, ok := r.Lookup(estargz.PrefetchLandmark); ok {
+		res.Landmark = landmarkPrefetch
+		res.LandmarkOffset = e.Offset
+		res.EstimatedPrefetchSize = e.Offset
+		prefetched = func(offset int64) bool { return offset < e.Offset }
+	} else {
+		res.Landmark = landmarkNone
+		if prefetchSize > ra.Size() {
+			prefetchSize = ra.Size()
+		}
+		res.EstimatedPrefetchSize = prefetchSize
+		prefetched = func(offset int64) bool { return offset < prefetchSize }
+		res.Warnings = append(res.Warnings,
+			"layer has no landmark so prefetch is done based on the configured prefetch size")
+	}
+
+	for _, e := range regularEntries(r) {
+		switch e.Name {
+		case estargz.PrefetchLandmark, estargz.NoPrefetchLandmark:
+			continue
+		}
+		res.Entries++
+		if res.Landmark == landmarkPrefetch && prefetched(e.Offset) {
+			res.PrioritizedEntries++
+			res.PrioritizedBytes += e.Size
+		}
+	}
+	if res.Landmark == landmarkPrefetch && res.PrioritizedEntries == 0 {
+		res.Warnings = append(res.Warnings, "landmark is placed at the top so nothing is prefetched")
+	}
+
+	for _, p := range accessed {
+		e, ok := r.Lookup(p)
+		if !ok || e.Type != "reg" || e.Size == 0 {
+			continue
+		}
+		if !prefetched(e.Offset) {
+			res.AccessedAfterLandmark = append(res.AccessedAfterLandmark, e.Name)
+		}
+	}
+	if n := len(res.AccessedAfterLandmark); n > 0 {
+		res.Warnings = append(res.Warnings, fmt.Sprintf(
+			"%d files accessed at runtime aren't prefetched; convert the image with the record to prioritize them", n))
+	}
+	return res, nil
+}
+
+// regularEntries returns all regular files in the layer sorted by the offset.
+func regularEntries(r *estargz.Reader) (ents []*estargz.TOCEntry) {
+	root, ok := r.Lookup("")
+	if !ok {
+		return nil
+	}
+	var walk func(e *estargz.TOCEntry)
+	walk = func(e *estargz.TOCEntry) {
+		e.ForeachChild(func(_ string, ent *estargz.TOCEntry) bool {
+			switch ent.Type {
+			case "dir":
+				walk(ent)
+			case "reg":
+				ents = append(ents, ent)
+			}
+			return true
+		})
+	}
+	walk(root)
+	sort.Slice(ents, func(i, j int) bool { return ents[i].Offset < ents[j].Offset })
+	return ents
+}
+
+func readRecordFile(filename string) ([]recorder.Entry, error) {
+	r, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	dec := json.NewDecoder(r)
+	var ents []recorder.Entry
+	for dec.More() {
+		var e recorder.Entry
+		if err := dec.Decode(&e); err != nil {
+			return nil, err
+		}
+		ents = append(ents, e)
+	}
+	return ents, nil
+}
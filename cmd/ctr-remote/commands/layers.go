@@ -0,0 +1,190 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/stargz-snapshotter/service/admin"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// LayersCommand operates the layers mounted by stargz snapshotter through its
+// admin API.
+var LayersCommand = cli.Command{
+	Name:  "snapshotter-layers",
+	Usage: "operate the layers mounted by stargz snapshotter",
+	Subcommands: []cli.Command{
+		{
+			Name:  "ls",
+			Usage: "list the layers mounted as remote snapshots with their fetch progress",
+			Flags: adminFlags,
+			Action: func(clicontext *cli.Context) error {
+				client, closeFn, err := newAdminClient(clicontext)
+				if err != nil {
+					return err
+				}
+				defer closeFn()
+				ctx, cancel := commands.AppContext(clicontext)
+				defer cancel()
+				resp, err := client.ListLayers(ctx, &admin.ListLayersRequest{})
+				if err != nil {
+					return errors.Wrap(err, "failed to list layers")
+				}
+				tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+				fmt.Fprintln(tw, "KEY\tREF\tDIGEST\tFETCHED\tSIZE\tDEGRADED")
+				for _, l := range resp.Layers {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%.1f%%\t%d\t%s\n",
+						l.Key, l.Ref, l.Digest, l.FetchedPercent, l.Size, strings.Join(l.Degraded, "; "))
+				}
+				return tw.Flush()
+			},
+		},
+		{
+			Name:      "refresh",
+			Usage:     "re-establish the connection of the layer to the registry",
+			ArgsUsage: "<key> [<key>...]",
+			Flags:     adminFlags,
+			Action: func(clicontext *cli.Context) error {
+				if clicontext.NArg() == 0 {
+					return fmt.Errorf("please provide the keys of remote snapshots")
+				}
+				client, closeFn, err := newAdminClient(clicontext)
+				if err != nil {
+					return err
+				}
+				defer closeFn()
+				ctx, cancel := commands.AppContext(clicontext)
+				defer cancel()
+				for _, key := range clicontext.Args() {
+					if _, err := client.RefreshLayer(ctx, &admin.RefreshLayerRequest{Key: key}); err != nil {
+						return errors.Wrapf(err, "failed to refresh %q", key)
+					}
+					fmt.Println(key)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "reauth",
+			Usage: "make all layers re-authenticate to registries on their next fetch",
+			Flags: adminFlags,
+			Action: func(clicontext *cli.Context) error {
+				client, closeFn, err := newAdminClient(clicontext)
+				if err != nil {
+					return err
+				}
+				defer closeFn()
+				ctx, cancel := commands.AppContext(clicontext)
+				defer cancel()
+				if _, err := client.Reauthenticate(ctx, &admin.ReauthenticateRequest{}); err != nil {
+					return errors.Wrap(err, "failed to re-authenticate")
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "evict-caches",
+			Usage: "evict the layers which aren't mounted from the caches and remove their contents",
+			Flags: adminFlags,
+			Action: func(clicontext *cli.Context) error {
+				client, closeFn, err := newAdminClient(clicontext)
+				if err != nil {
+					return err
+				}
+				defer closeFn()
+				ctx, cancel := commands.AppContext(clicontext)
+				defer cancel()
+				resp, err := client.EvictCaches(ctx, &admin.EvictCachesRequest{})
+				if err != nil {
+					return errors.Wrap(err, "failed to evict caches")
+				}
+				for _, e := range resp.Evicted {
+					fmt.Printf("filesystem %s: evicted %d layers and %d blobs\n", e.Filesystem, e.Layers, e.Blobs)
+				}
+				return nil
+			},
+		},
+		{
+			Name:  "background-fetch",
+			Usage: "show, pause, resume or throttle background fetch of layers",
+			Flags: append([]cli.Flag{
+				cli.BoolFlag{
+					Name:  "pause",
+					Usage: "pause background fetch",
+				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "resume background fetch",
+				},
+				cli.Int64Flag{
+					Name:  "bandwidth",
+					Usage: "bandwidth limit of background fetch in bytes per second (0 means no limit)",
+				},
+			}, adminFlags...),
+			Action: func(clicontext *cli.Context) error {
+				if clicontext.Bool("pause") && clicontext.Bool("resume") {
+					return fmt.Errorf("--pause and --resume can't be specified at once")
+				}
+				client, closeFn, err := newAdminClient(clicontext)
+				if err != nil {
+					return err
+				}
+				defer closeFn()
+				ctx, cancel := commands.AppContext(clicontext)
+				defer cancel()
+				resp, err := client.GetBackgroundFetch(ctx, &admin.GetBackgroundFetchRequest{})
+				if err != nil {
+					return errors.Wrap(err, "failed to get state of background fetch")
+				}
+				if clicontext.Bool("pause") || clicontext.Bool("resume") || clicontext.IsSet("bandwidth") {
+					// Unspecified settings are kept as the current ones.
+					var req admin.SetBackgroundFetchRequest
+					if len(resp.States) > 0 {
+						req.Paused, req.Bandwidth = resp.States[0].Paused, resp.States[0].Bandwidth
+					}
+					if clicontext.Bool("pause") {
+						req.Paused = true
+					} else if clicontext.Bool("resume") {
+						req.Paused = false
+					}
+					if clicontext.IsSet("bandwidth") {
+						req.Bandwidth = clicontext.Int64("bandwidth")
+					}
+					if resp, err = client.SetBackgroundFetch(ctx, &req); err != nil {
+						return errors.Wrap(err, "failed to set background fetch")
+					}
+				}
+				tw := tabwriter.NewWriter(os.Stdout, 1, 8, 1, ' ', 0)
+				fmt.Fprintln(tw, "FILESYSTEM\tPAUSED\tBANDWIDTH")
+				for _, st := range resp.States {
+					bandwidth := "unlimited"
+					if st.Bandwidth > 0 {
+						bandwidth = fmt.Sprintf("%d B/s", st.Bandwidth)
+					}
+					fmt.Fprintf(tw, "%s\t%v\t%s\n", st.Filesystem, st.Paused, bandwidth)
+				}
+				return tw.Flush()
+			},
+		},
+	},
+}
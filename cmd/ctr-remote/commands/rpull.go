@@ -18,16 +18,29 @@ package commands
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/cmd/ctr/commands"
 	"github.com/containerd/containerd/cmd/ctr/commands/content"
+	ctdcontent "github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/pkg/progress"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/stargz-snapshotter/filesystems/s3"
 	fsconfig "github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/ipfs"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	estargzconvert "github.com/containerd/stargz-snapshotter/nativeconverter/estargz"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
 )
@@ -35,6 +48,9 @@ import (
 const (
 	remoteSnapshotterName = "stargz"
 	skipContentVerifyOpt  = "skip-content-verify"
+	s3LocationOpt         = "s3-location"
+	ipfsOpt               = "ipfs"
+	passCredentialsOpt    = "pass-credentials"
 )
 
 var RpullCommand = cli.Command{
@@ -45,12 +61,29 @@ var RpullCommand = cli.Command{
 
 After pulling an image, it should be ready to use the same reference in a run
 command. 
+
+Only manifests and configs are downloaded to the content store. eStargz layers
+are prepared as remote snapshots which fetch their contents on demand. Other
+layers are fully downloaded. The summary shows the size of contents deferred by
+lazy pulling.
 `,
 	Flags: append(commands.RegistryFlags, commands.LabelFlag,
 		cli.BoolFlag{
 			Name:  skipContentVerifyOpt,
 			Usage: "Skip content verification for layers contained in this image.",
 		},
+		cli.StringFlag{
+			Name:  s3LocationOpt,
+			Usage: "Mount layers from the OCI image layout in the S3 bucket (s3://<bucket>[/<prefix>]) instead of the registry.",
+		},
+		cli.BoolFlag{
+			Name:  ipfsOpt,
+			Usage: "Mount layers from IPFS if their descriptors have URLs of ipfs://<cid>.",
+		},
+		cli.BoolFlag{
+			Name:  passCredentialsOpt,
+			Usage: "Pass the credentials specified by --user (user:password) to the snapshotter through the snapshot label.",
+		},
 	),
 	Action: func(context *cli.Context) error {
 		var (
@@ -82,6 +115,30 @@ command.
 		if context.Bool(skipContentVerifyOpt) {
 			config.skipVerify = true
 		}
+		if loc := context.String(s3LocationOpt); loc != "" {
+			if _, err := s3.ParseLocation(loc); err != nil {
+				return err
+			}
+			config.s3Location = loc
+		}
+		if context.Bool(ipfsOpt) {
+			config.ipfs = true
+		}
+		if context.Bool(passCredentialsOpt) {
+			user := context.String("user")
+			i := strings.IndexByte(user, ':')
+			if i < 0 {
+				return fmt.Errorf("--%s requires --user in the form of user:password", passCredentialsOpt)
+			}
+			auth, err := json.Marshal(map[string]string{
+				"username": user[:i],
+				"password": user[i+1:],
+			})
+			if err != nil {
+				return err
+			}
+			config.auth = string(auth)
+		}
 
 		if err := pull(ctx, client, ref, config); err != nil {
 			return err
@@ -93,38 +150,202 @@ command.
 type rPullConfig struct {
 	*content.FetchConfig
 	skipVerify bool
+	s3Location string
+	ipfs       bool
+	auth       string
 }
 
 func pull(ctx context.Context, client *containerd.Client, ref string, config *rPullConfig) error {
 	pCtx := ctx
+	ongoing := content.NewJobs(ref)
 	h := images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
 		if desc.MediaType != images.MediaTypeDockerSchema1Manifest {
-			fmt.Printf("fetching %v... %v\n", desc.Digest.String()[:15], desc.MediaType)
+			if config.ProgressOutput != nil {
+				ongoing.Add(desc)
+			} else {
+				fmt.Printf("fetching %v... %v\n", desc.Digest.String()[:15], desc.MediaType)
+			}
 		}
 		return nil, nil
 	})
 
 	var snOpts []snapshots.Opt
+	snLabels := make(map[string]string)
 	if config.skipVerify {
 		log.G(pCtx).WithField("image", ref).Warn("content verification disabled")
-		snOpts = append(snOpts, snapshots.WithLabels(map[string]string{
-			fsconfig.TargetSkipVerifyLabel: "true",
-		}))
+		snLabels[fsconfig.TargetSkipVerifyLabel] = "true"
+	}
+	if config.s3Location != "" {
+		snLabels[s3.LocationLabel] = config.s3Location
+	}
+	if config.auth != "" {
+		snLabels[fsconfig.TargetAuthLabel] = config.auth
+	}
+	if len(snLabels) > 0 {
+		snOpts = append(snOpts, snapshots.WithLabels(snLabels))
 	}
 
 	log.G(pCtx).WithField("image", ref).Debug("fetching")
 	labels := commands.LabelArgs(config.Labels)
-	if _, err := client.Pull(pCtx, ref, []containerd.RemoteOpt{
+	handlerWrapper := source.AppendDefaultLabelsHandlerWrapper(ref, 10*1024*1024)
+	if config.ipfs {
+		appendCID := ipfs.AppendCIDLabelsHandlerWrapper()
+		appendDefault := handlerWrapper
+		handlerWrapper = func(f images.Handler) images.Handler {
+			return appendCID(appendDefault(f))
+		}
+	}
+	// Layers don't reach the image handler because they are unpacked (i.e.
+	// prepared as remote snapshots or downloaded) by the unpacker. Track them
+	// through the handler wrapper which sees the children of manifests.
+	layers := content.NewJobs(ref)
+	appendLabels := handlerWrapper
+	handlerWrapper = func(f images.Handler) images.Handler {
+		return trackLayers(appendLabels(f), layers, ongoing)
+	}
+
+	stopProgress := make(chan struct{})
+	progressDone := make(chan struct{})
+	start := time.Now()
+	go func() {
+		if config.ProgressOutput != nil {
+			showProgress(pCtx, stopProgress, ongoing, client.ContentStore(), config.ProgressOutput, start)
+		}
+		close(progressDone)
+	}()
+	_, err := client.Pull(pCtx, ref, []containerd.RemoteOpt{
 		containerd.WithPullLabels(labels),
+		containerd.WithPlatformMatcher(estargzconvert.PreferEStargz(platforms.Default())),
 		containerd.WithResolver(config.Resolver),
 		containerd.WithImageHandler(h),
 		containerd.WithSchema1Conversion,
 		containerd.WithPullUnpack,
 		containerd.WithPullSnapshotter(remoteSnapshotterName, snOpts...),
-		containerd.WithImageHandlerWrapper(source.AppendDefaultLabelsHandlerWrapper(ref, 10*1024*1024)),
-	}...); err != nil {
+		containerd.WithImageHandlerWrapper(handlerWrapper),
+	}...)
+	close(stopProgress)
+	<-progressDone
+	if err != nil {
 		return err
 	}
 
+	return printPullSummary(pCtx, client.ContentStore(), layers.Jobs(), time.Since(start))
+}
+
+// trackLayers adds the layers of manifests handled by f to layers. The layers
+// are also added to ongoing for displaying the progress.
+func trackLayers(f images.Handler, layers, ongoing *content.Jobs) images.Handler {
+	return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		children, err := f.Handle(ctx, desc)
+		if err != nil || !images.IsManifestType(desc.MediaType) {
+			return children, err
+		}
+		for _, c := range children {
+			if images.IsLayerType(c.MediaType) {
+				layers.Add(c)
+				ongoing.Add(c)
+			}
+		}
+		return children, nil
+	})
+}
+
+// showProgress displays the progress of the pull until stop is closed. Layers
+// which aren't downloaded to the content store by then are shown as "lazy"
+// because they are prepared as remote snapshots.
+func showProgress(ctx context.Context, stop <-chan struct{}, ongoing *content.Jobs, cs ctdcontent.Store, out io.Writer, start time.Time) {
+	var (
+		ticker = time.NewTicker(100 * time.Millisecond)
+		fw     = progress.NewWriter(out)
+		done   bool
+	)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			done = true // update the display once more
+		}
+		statuses, err := pullStatuses(ctx, ongoing, cs, start, done)
+		if err != nil {
+			log.G(ctx).WithError(err).Error("failed to get pull status")
+			if done {
+				return
+			}
+			continue
+		}
+		fw.Flush()
+		tw := tabwriter.NewWriter(fw, 1, 8, 1, ' ', 0)
+		content.Display(tw, statuses, start)
+		tw.Flush()
+		if done {
+			fw.Flush()
+			return
+		}
+	}
+}
+
+// pullStatuses returns the statuses of the contents being pulled.
+func pullStatuses(ctx context.Context, ongoing *content.Jobs, cs ctdcontent.Store, start time.Time, done bool) ([]content.StatusInfo, error) {
+	active, err := cs.ListStatuses(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	activeStatus := make(map[string]ctdcontent.Status)
+	for _, s := range active {
+		activeStatus[s.Ref] = s
+	}
+	var statuses []content.StatusInfo
+	for _, desc := range ongoing.Jobs() {
+		key := remotes.MakeRefKey(ctx, desc)
+		if s, ok := activeStatus[key]; ok {
+			statuses = append(statuses, content.StatusInfo{
+				Ref:       key,
+				Status:    "downloading",
+				Offset:    s.Offset,
+				Total:     s.Total,
+				StartedAt: s.StartedAt,
+				UpdatedAt: s.UpdatedAt,
+			})
+			continue
+		}
+		status := content.StatusInfo{Ref: key, Status: "waiting"}
+		if info, err := cs.Info(ctx, desc.Digest); err == nil {
+			status.Status = "exists"
+			if info.CreatedAt.After(start) {
+				status.Status = "done"
+				status.Offset, status.Total, status.UpdatedAt = info.Size, info.Size, info.CreatedAt
+			}
+		} else if !errdefs.IsNotFound(err) {
+			return nil, err
+		} else if done && images.IsLayerType(desc.MediaType) {
+			status.Status = "lazy"
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// printPullSummary prints how the layers of the pulled image are prepared.
+// Layers which aren't in the content store are lazily pulled by the
+// snapshotter and their contents are fetched on demand (deferred).
+func printPullSummary(ctx context.Context, cs ctdcontent.Store, layers []ocispec.Descriptor, elapsed time.Duration) error {
+	var (
+		lazy, full         int
+		deferred, download int64
+	)
+	for _, l := range layers {
+		if _, err := cs.Info(ctx, l.Digest); err == nil {
+			full++
+			download += l.Size
+		} else if errdefs.IsNotFound(err) {
+			lazy++
+			deferred += l.Size
+		} else {
+			return err
+		}
+	}
+	fmt.Printf("pulled %d layers in %.1fs: %d lazily (%v deferred), %d fully (%v downloaded)\n",
+		len(layers), elapsed.Seconds(), lazy, progress.Bytes(deferred), full, progress.Bytes(download))
 	return nil
 }
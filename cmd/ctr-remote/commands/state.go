@@ -0,0 +1,114 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/pkg/dialer"
+	"github.com/containerd/stargz-snapshotter/service/admin"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"google.golang.org/grpc"
+)
+
+const defaultSnapshotterAddress = "/run/containerd-stargz-grpc/containerd-stargz-grpc.sock"
+
+// StateCommand exports and imports the metadata of remote snapshots of stargz
+// snapshotter. This is useful for replacing nodes without preparing all
+// remote snapshots through containerd again.
+var StateCommand = cli.Command{
+	Name:  "snapshotter-state",
+	Usage: "export and import the metadata of remote snapshots of stargz snapshotter",
+	Subcommands: []cli.Command{
+		{
+			Name:      "export",
+			Usage:     "export the metadata (not the contents) of remote snapshots as JSON",
+			ArgsUsage: "[<file>]",
+			Flags:     adminFlags,
+			Action: func(clicontext *cli.Context) error {
+				client, closeFn, err := newAdminClient(clicontext)
+				if err != nil {
+					return err
+				}
+				defer closeFn()
+				ctx, cancel := commands.AppContext(clicontext)
+				defer cancel()
+				resp, err := client.ExportState(ctx, &admin.ExportStateRequest{})
+				if err != nil {
+					return errors.Wrap(err, "failed to export state")
+				}
+				if file := clicontext.Args().First(); file != "" {
+					return ioutil.WriteFile(file, resp.State, 0600)
+				}
+				_, err = os.Stdout.Write(resp.State)
+				return err
+			},
+		},
+		{
+			Name:      "import",
+			Usage:     "import the metadata exported by \"export\" and mount the remote snapshots",
+			ArgsUsage: "<file>",
+			Flags:     adminFlags,
+			Action: func(clicontext *cli.Context) error {
+				file := clicontext.Args().First()
+				if file == "" {
+					return fmt.Errorf("please provide the exported file")
+				}
+				data, err := ioutil.ReadFile(file)
+				if err != nil {
+					return err
+				}
+				client, closeFn, err := newAdminClient(clicontext)
+				if err != nil {
+					return err
+				}
+				defer closeFn()
+				ctx, cancel := commands.AppContext(clicontext)
+				defer cancel()
+				resp, err := client.ImportState(ctx, &admin.ImportStateRequest{State: data})
+				if err != nil {
+					return errors.Wrap(err, "failed to import state")
+				}
+				for _, name := range resp.Imported {
+					fmt.Println(name)
+				}
+				return nil
+			},
+		},
+	},
+}
+
+var adminFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "snapshotter-address",
+		Usage: "address of the gRPC server of stargz snapshotter",
+		Value: defaultSnapshotterAddress,
+	},
+}
+
+func newAdminClient(clicontext *cli.Context) (admin.AdminClient, func() error, error) {
+	conn, err := grpc.Dial(dialer.DialAddress(clicontext.String("snapshotter-address")),
+		grpc.WithInsecure(), grpc.WithContextDialer(dialer.ContextDialer))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to connect to snapshotter")
+	}
+	return admin.NewAdminClient(conn), conn.Close, nil
+}
@@ -0,0 +1,110 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/cmd/ctr/commands/content"
+	"github.com/containerd/stargz-snapshotter/warmup"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// WarmupCommand warms up all images of a compose file or Kubernetes manifests.
+var WarmupCommand = cli.Command{
+	Name:      "warmup",
+	Usage:     "warm up all images of a compose file or Kubernetes manifests leveraging stargz snapshotter",
+	ArgsUsage: "[flags] <spec file>...",
+	Description: `Resolve all images used by the compose files or Kubernetes manifests (pods and
+workloads) and pull them in parallel leveraging stargz snapshotter. eStargz layers are
+mounted lazily and prefetched so that the containers of the application can start quickly
+as a unit. Specify "-" to read the spec from stdin.
+
+e.g., 'ctr-remote images warmup docker-compose.yml'
+`,
+	Flags: append(commands.RegistryFlags, commands.LabelFlag,
+		cli.Int64Flag{
+			Name:  "prefetch-size",
+			Usage: "size to prefetch from layers without landmarks",
+			Value: 10 * 1024 * 1024,
+		},
+		cli.Int64Flag{
+			Name:  "max-concurrency",
+			Usage: "maximum number of images pulled in parallel",
+			Value: 4,
+		},
+	),
+	Action: func(context *cli.Context) error {
+		if context.NArg() == 0 {
+			return fmt.Errorf("please provide spec files")
+		}
+		var refs []string
+		for _, p := range context.Args() {
+			var (
+				data []byte
+				err  error
+			)
+			if p == "-" {
+				data, err = ioutil.ReadAll(os.Stdin)
+			} else {
+				data, err = ioutil.ReadFile(p)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "failed to read %q", p)
+			}
+			r, err := warmup.ImagesFromSpec(data)
+			if err != nil {
+				return errors.Wrapf(err, "failed to get images from %q", p)
+			}
+			refs = append(refs, r...)
+		}
+
+		client, ctx, cancel, err := commands.NewClient(context)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		ctx, done, err := client.WithLease(ctx)
+		if err != nil {
+			return err
+		}
+		defer done(ctx)
+
+		fc, err := content.NewFetchConfig(ctx, context)
+		if err != nil {
+			return err
+		}
+		reports, err := warmup.Warmup(ctx, client, refs,
+			warmup.WithResolver(fc.Resolver),
+			warmup.WithLabels(commands.LabelArgs(fc.Labels)),
+			warmup.WithPrefetchSize(context.Int64("prefetch-size")),
+			warmup.WithMaxConcurrency(context.Int64("max-concurrency")),
+		)
+		if err != nil {
+			return err
+		}
+		for _, r := range reports {
+			fmt.Printf("%s: %d/%d layers are eStargz (%v)\n", r.Ref, r.EStargzLayers, r.Layers, r.Duration)
+		}
+		return nil
+	},
+}
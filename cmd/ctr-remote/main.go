@@ -31,7 +31,7 @@ func init() {
 }
 
 func main() {
-	customCommands := []cli.Command{commands.RpullCommand, commands.OptimizeCommand, commands.ConvertCommand}
+	customCommands := []cli.Command{commands.RpullCommand, commands.OptimizeCommand, commands.ConvertCommand, commands.ArtifactCommand, commands.CheckLandmarkCommand, commands.WarmupCommand}
 	app := app.New()
 	for i := range app.Commands {
 		if app.Commands[i].Name == "images" {
@@ -57,7 +57,7 @@ func main() {
 			break
 		}
 	}
-	app.Commands = append(app.Commands, commands.FanotifyCommand)
+	app.Commands = append(app.Commands, commands.FanotifyCommand, commands.CacheCommand, commands.BenchCommand, commands.StateCommand, commands.DiagnosticsCommand, commands.InfoCommand, commands.LayersCommand)
 	if err := app.Run(os.Args); err != nil {
 		fmt.Fprintf(os.Stderr, "ctr: %v\n", err)
 		os.Exit(1)
@@ -0,0 +1,111 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// stargz-fuse-manager serves the FUSE mounts of the stargz filesystem on behalf
+// of containerd-stargz-grpc configured with "fuse_manager.enable". It's started
+// by the snapshotter and keeps serving the mounts after the snapshotter exits
+// so that running containers aren't broken by restarts of the snapshotter.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	golog "log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/service"
+	"github.com/containerd/stargz-snapshotter/service/fusemanager"
+	"github.com/containerd/stargz-snapshotter/version"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+)
+
+const (
+	defaultAddress  = "/run/containerd-stargz-grpc/fuse-manager.sock"
+	defaultLogLevel = logrus.InfoLevel
+)
+
+var (
+	address      = flag.String("address", defaultAddress, "address for the fuse manager's GRPC server")
+	logLevel     = flag.String("log-level", defaultLogLevel.String(), "set the logging level [trace, debug, info, warn, error, fatal, panic]")
+	printVersion = flag.Bool("version", false, "print the version")
+)
+
+func main() {
+	flag.Parse()
+	lvl, err := logrus.ParseLevel(*logLevel)
+	if err != nil {
+		log.L.WithError(err).Fatal("failed to prepare logger")
+	}
+	if *printVersion {
+		fmt.Println("stargz-fuse-manager", version.Version, version.Revision)
+		return
+	}
+	logrus.SetLevel(lvl)
+	logrus.SetFormatter(&logrus.JSONFormatter{
+		TimestampFormat: log.RFC3339NanoFixed,
+	})
+	ctx := log.WithLogger(context.Background(), log.L.WithField("component", "fuse-manager"))
+	// Streams log of standard lib (go-fuse uses this) into debug log
+	golog.SetOutput(log.G(ctx).WriterLevel(logrus.DebugLevel))
+
+	if err := serve(ctx, *address); err != nil {
+		log.G(ctx).WithError(err).Fatal("failed to serve fuse manager")
+	}
+	log.G(ctx).Info("Exiting")
+}
+
+func serve(ctx context.Context, addr string) error {
+	rpc := grpc.NewServer()
+	fusemanager.RegisterFuseManagerServer(rpc, fusemanager.NewServer(ctx, service.FuseManagerFilesystem()))
+
+	if err := os.MkdirAll(filepath.Dir(addr), 0700); err != nil {
+		return errors.Wrapf(err, "failed to create directory %q", filepath.Dir(addr))
+	}
+	if err := os.RemoveAll(addr); err != nil {
+		return errors.Wrapf(err, "failed to remove %q", addr)
+	}
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		return errors.Wrapf(err, "error on listen socket %q", addr)
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		if err := rpc.Serve(l); err != nil {
+			errCh <- errors.Wrapf(err, "error on serving via socket %q", addr)
+		}
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, unix.SIGINT, unix.SIGTERM)
+	select {
+	case sig := <-sigCh:
+		// The mounts become unavailable ("transport endpoint is not connected")
+		// until the fuse manager restarts and mounts them again.
+		log.G(ctx).Infof("Got %v", sig)
+		rpc.Stop()
+		return nil
+	case err := <-errCh:
+		return err
+	}
+}
@@ -0,0 +1,95 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// stargz-mount-helper is the mount helper invoked by mount.fuse for mounts of
+// type "fuse.stargz-mount-helper" returned by the snapshotter configured with
+// "mount_helper". It asks the snapshotter to mount the remote snapshots in the
+// current mount namespace and then mounts the rootfs on the target.
+//
+//	stargz-mount-helper <source> <target> -o <options>
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/stargz-snapshotter/snapshot"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "stargz-mount-helper: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	var (
+		pos  []string
+		opts []string
+	)
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-o" && i+1 < len(args) {
+			opts = append(opts, strings.Split(args[i+1], ",")...)
+			i++
+			continue
+		}
+		pos = append(pos, args[i])
+	}
+	if len(pos) != 2 {
+		return fmt.Errorf("usage: %s <source> <target> -o <options>", os.Args[0])
+	}
+	source, target := pos[0], pos[1]
+
+	var (
+		mountType string
+		socket    string
+		remotes   []string
+		options   []string
+	)
+	for _, o := range opts {
+		switch {
+		case strings.HasPrefix(o, "type="):
+			mountType = strings.TrimPrefix(o, "type=")
+		case strings.HasPrefix(o, snapshot.MountHelperSocketOption+"="):
+			socket = strings.TrimPrefix(o, snapshot.MountHelperSocketOption+"=")
+		case strings.HasPrefix(o, snapshot.MountHelperRemoteOption+"="):
+			remotes = strings.Split(strings.TrimPrefix(o, snapshot.MountHelperRemoteOption+"="), ":")
+		case o == "":
+		default:
+			options = append(options, o)
+		}
+	}
+	if mountType == "" || socket == "" {
+		return fmt.Errorf("\"type\" and %q options must be specified", snapshot.MountHelperSocketOption)
+	}
+	for _, r := range remotes {
+		if r == "" {
+			continue
+		}
+		if err := snapshot.RequestMount(socket, r); err != nil {
+			return err
+		}
+	}
+	m := mount.Mount{
+		Type:    mountType,
+		Source:  source,
+		Options: options,
+	}
+	return m.Mount(target)
+}
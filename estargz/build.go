@@ -48,6 +48,7 @@ type options struct {
 	compressionLevel       int
 	prioritizedFiles       []string
 	missedPrioritizedFiles *[]string
+	externalTOC            bool
 }
 
 type Option func(o *options) error
@@ -95,11 +96,29 @@ func WithAllowPrioritizeNotFound(missedFiles *[]string) Option {
 	}
 }
 
+// WithExternalTOC option makes Build store the TOC in a separate blob
+// (available through Blob.ExternalTOC) instead of the tail of the eStargz blob.
+// This reduces the size of the layer blob for layers with many files. The
+// digest of the TOC blob should be recorded in the layer annotation
+// ExternalTOCAnnotation and the TOC blob must be pushed to the same
+// repository as the layer. Readers need the TOC blob to open the layer (see
+// WithExternalTOCBlob).
+func WithExternalTOC() Option {
+	return func(o *options) error {
+		o.externalTOC = true
+		return nil
+	}
+}
+
 // Blob is an eStargz blob.
 type Blob struct {
 	io.ReadCloser
 	diffID    digest.Digester
 	tocDigest digest.Digest
+	tocBlob   []byte
+
+	prioritizedSize  int64
+	prioritizedFiles int
 }
 
 // DiffID returns the digest of uncompressed blob.
@@ -113,6 +132,23 @@ func (b *Blob) TOCDigest() digest.Digest {
 	return b.tocDigest
 }
 
+// ExternalTOC returns the blob of the TOC (gzip-compressed tar containing the
+// TOC JSON) if the eStargz blob is built with WithExternalTOC. nil otherwise.
+func (b *Blob) ExternalTOC() []byte {
+	return b.tocBlob
+}
+
+// PrioritizedSize returns the total uncompressed size of the prioritized files
+// (i.e. files placed before the prefetch landmark).
+func (b *Blob) PrioritizedSize() int64 {
+	return b.prioritizedSize
+}
+
+// PrioritizedFiles returns the number of the prioritized regular files.
+func (b *Blob) PrioritizedFiles() int {
+	return b.prioritizedFiles
+}
+
 // Build builds an eStargz blob which is an extended version of stargz, from a blob (gzip, zstd
 // or plain tar) passed through the argument. If there are some prioritized files are listed in
 // the option, these files are grouped as "prioritized" and can be used for runtime optimization
@@ -142,6 +178,7 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 	if err != nil {
 		return nil, err
 	}
+	prioritizedSize, prioritizedFiles := prioritizedStats(entries)
 	tarParts := divideEntries(entries, runtime.GOMAXPROCS(0))
 	writers := make([]*Writer, len(tarParts))
 	payloads := make([]*os.File, len(tarParts))
@@ -171,11 +208,23 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 		rErr = err
 		return nil, err
 	}
-	tocAndFooter, tocDgst, err := closeWithCombine(opts.compressionLevel, writers...)
+	toc, tocOffset, tocDgst, err := closeWithCombine(opts.compressionLevel, writers...)
 	if err != nil {
 		rErr = err
 		return nil, err
 	}
+	var tocBlob []byte
+	tocAndFooter := io.MultiReader(toc, bytes.NewReader(footerBytes(tocOffset)))
+	if opts.externalTOC {
+		tocBlob, err = ioutil.ReadAll(toc)
+		if err != nil {
+			rErr = err
+			return nil, err
+		}
+		// The TOC is replaced with the end of the tar archive which is
+		// otherwise contained in the TOC.
+		tocAndFooter = io.MultiReader(bytes.NewReader(tarTerminator()), bytes.NewReader(footerBytes(tocOffset)))
+	}
 	var rs []io.Reader
 	for _, p := range payloads {
 		fs, err := fileSectionReader(p)
@@ -203,30 +252,51 @@ func Build(tarBlob *io.SectionReader, opt ...Option) (_ *Blob, rErr error) {
 			Reader:    pr,
 			closeFunc: layerFiles.CleanupAll,
 		},
-		tocDigest: tocDgst,
-		diffID:    diffID,
+		tocDigest:        tocDgst,
+		tocBlob:          tocBlob,
+		diffID:           diffID,
+		prioritizedSize:  prioritizedSize,
+		prioritizedFiles: prioritizedFiles,
 	}, nil
 }
 
+// prioritizedStats returns the total size and the number of the regular files
+// placed before the prefetch landmark.
+func prioritizedStats(entries []*entry) (size int64, files int) {
+	for _, e := range entries {
+		switch cleanEntryName(e.header.Name) {
+		case PrefetchLandmark:
+			return size, files
+		case NoPrefetchLandmark:
+			return 0, 0
+		}
+		if e.header.Typeflag == tar.TypeReg || e.header.Typeflag == tar.TypeRegA {
+			size += e.header.Size
+			files++
+		}
+	}
+	return 0, 0 // no landmark
+}
+
 // closeWithCombine takes unclosed Writers and close them. This also returns the
 // toc that combined all Writers into.
 // Writers doesn't write TOC and footer to the underlying writers so they can be
-// combined into a single eStargz and tocAndFooter returned by this function can
-// be appended at the tail of that combined blob.
-func closeWithCombine(compressionLevel int, ws ...*Writer) (tocAndFooter io.Reader, tocDgst digest.Digest, err error) {
+// combined into a single eStargz and toc returned by this function and the
+// footer pointing to tocOffset can be appended at the tail of that combined blob.
+func closeWithCombine(compressionLevel int, ws ...*Writer) (toc io.Reader, tocOffset int64, tocDgst digest.Digest, err error) {
 	if len(ws) == 0 {
-		return nil, "", fmt.Errorf("at least one writer must be passed")
+		return nil, 0, "", fmt.Errorf("at least one writer must be passed")
 	}
 	for _, w := range ws {
 		if w.closed {
-			return nil, "", fmt.Errorf("writer must be unclosed")
+			return nil, 0, "", fmt.Errorf("writer must be unclosed")
 		}
 		defer func(w *Writer) { w.closed = true }(w)
 		if err := w.closeGz(); err != nil {
-			return nil, "", err
+			return nil, 0, "", err
 		}
 		if err := w.bw.Flush(); err != nil {
-			return nil, "", err
+			return nil, 0, "", err
 		}
 	}
 	var (
@@ -250,7 +320,7 @@ func closeWithCombine(compressionLevel int, ws ...*Writer) (tocAndFooter io.Read
 
 	tocJSON, err := json.MarshalIndent(mtoc, "", "\t")
 	if err != nil {
-		return nil, "", err
+		return nil, 0, "", err
 	}
 	pr, pw := io.Pipe()
 	go func() {
@@ -278,10 +348,17 @@ func closeWithCombine(compressionLevel int, ws ...*Writer) (tocAndFooter io.Read
 		}
 		pw.Close()
 	}()
-	return io.MultiReader(
-		pr,
-		bytes.NewReader(footerBytes(currentOffset)),
-	), digest.FromBytes(tocJSON), nil
+	return pr, currentOffset, digest.FromBytes(tocJSON), nil
+}
+
+// tarTerminator returns a gzip stream of the end-of-archive marker of tar.
+func tarTerminator() []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	tw.Close()
+	zw.Close()
+	return buf.Bytes()
 }
 
 // divideEntries divides passed entries to the parts at least the number specified by the
@@ -215,6 +215,69 @@ func TestBuild(t *testing.T) {
 	}
 }
 
+// TestBuildExternalTOC tests opening the blob built with WithExternalTOC using
+// the TOC blob.
+func TestBuildExternalTOC(t *testing.T) {
+	tarBlob := buildTarStatic(t, tarOf(
+		dir("foo/"),
+		file("foo/bar.txt", "test bar"),
+		file("baz.txt", "test baz"),
+	), "")
+	rc, err := Build(tarBlob, WithExternalTOC())
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	tocBlob := rc.ExternalTOC()
+	if tocBlob == nil {
+		t.Fatalf("TOC blob must be available")
+	}
+	sr := io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))
+	if _, err := Open(sr); err == nil {
+		t.Errorf("blob must not contain TOC")
+	}
+	r, err := Open(sr, WithExternalTOCBlob(tocBlob))
+	if err != nil {
+		t.Fatalf("failed to open with the TOC blob: %v", err)
+	}
+	if r.TOCDigest() != rc.TOCDigest() {
+		t.Errorf("TOC digest = %q; want %q", r.TOCDigest(), rc.TOCDigest())
+	}
+	if _, err := r.VerifyTOC(rc.TOCDigest()); err != nil {
+		t.Errorf("failed to verify TOC: %v", err)
+	}
+	hasFileContentsRange("foo/bar.txt", 0, "test bar").check(t, r)
+
+	// The blob is still a valid layer.
+	if got := diffIDOfGz(t, data); got != rc.DiffID().String() {
+		t.Errorf("DiffID = %q; want %q", rc.DiffID(), got)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	var names []string
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+		names = append(names, h.Name)
+	}
+	for _, name := range names {
+		if name == TOCTarName {
+			t.Errorf("blob must not contain TOC but got %v", names)
+		}
+	}
+}
+
 func isSameTarGz(t *testing.T, a, b []byte) bool {
 	aGz, err := gzip.NewReader(bytes.NewReader(a))
 	if err != nil {
@@ -402,6 +465,8 @@ func equalEntry(a, b *TOCEntry) bool {
 		a.Size == b.Size &&
 		a.ModTime3339 == b.ModTime3339 &&
 		a.Stat().ModTime().Equal(b.Stat().ModTime()) && // modTime     time.Time
+		a.ChangeTime3339 == b.ChangeTime3339 &&
+		a.ChangeTime().Equal(b.ChangeTime()) && // changeTime  time.Time
 		a.LinkName == b.LinkName &&
 		a.Mode == b.Mode &&
 		a.UID == b.UID &&
@@ -825,6 +890,19 @@ func TestSort(t *testing.T) {
 
 						// Compare all
 						wantTar := tar.NewReader(buildTarStatic(t, tt.want, tarprefix))
+						var (
+							wantPSize, wantPFiles = int64(0), 0
+							landmarkFound         bool
+						)
+						defer func() {
+							if !landmarkFound {
+								wantPSize, wantPFiles = 0, 0
+							}
+							if rc.PrioritizedSize() != wantPSize || rc.PrioritizedFiles() != wantPFiles {
+								t.Errorf("unexpected prioritized stats (size=%d, files=%d); want (size=%d, files=%d)",
+									rc.PrioritizedSize(), rc.PrioritizedFiles(), wantPSize, wantPFiles)
+							}
+						}()
 						for {
 							// Fetch and parse next header.
 							gotH, wantH, err := next(t, gotTar, wantTar)
@@ -835,6 +913,12 @@ func TestSort(t *testing.T) {
 									t.Fatalf("Failed to parse tar file: %v", err)
 								}
 							}
+							if cleanEntryName(wantH.Name) == PrefetchLandmark {
+								landmarkFound = true
+							} else if !landmarkFound && wantH.Typeflag == tar.TypeReg {
+								wantPSize += wantH.Size
+								wantPFiles++
+							}
 
 							if !reflect.DeepEqual(gotH, wantH) {
 								t.Errorf("different header (got = name:%q,type:%d,size:%d; want = name:%q,type:%d,size:%d)",
@@ -60,19 +60,62 @@ type Reader struct {
 	// are split up. For a file with a single chunk, it's only
 	// stored in m.
 	chunks map[string][]*TOCEntry
+
+	decompressor Decompressor
+}
+
+// Decompressor returns the reader of the decompressed contents of the gzip
+// stream read from r. The returned reader is closed after use.
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+// OpenOption is an option used during opening the layer.
+type OpenOption func(o *openOptions)
+
+type openOptions struct {
+	decompressor Decompressor
+	tocBlob      []byte
+}
+
+// WithDecompressor specifies the decompressor used for reading file payloads.
+// By default, compress/gzip of the standard library is used.
+func WithDecompressor(d Decompressor) OpenOption {
+	return func(o *openOptions) {
+		o.decompressor = d
+	}
+}
+
+// WithExternalTOCBlob specifies the blob of the TOC (gzip-compressed tar
+// containing the TOC JSON) of the layer built with WithExternalTOC. The TOC is
+// read from this blob instead of the tail of the eStargz blob.
+func WithExternalTOCBlob(tocBlob []byte) OpenOption {
+	return func(o *openOptions) {
+		o.tocBlob = tocBlob
+	}
+}
+
+func defaultDecompressor(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
 }
 
 // Open opens a stargz file for reading.
 //
 // Note that each entry name is normalized as the path that is relative to root.
-func Open(sr *io.SectionReader) (*Reader, error) {
-	tocOff, footerSize, err := OpenFooter(sr)
-	if err != nil {
-		return nil, errors.Wrapf(err, "error parsing footer")
+func Open(sr *io.SectionReader, opt ...OpenOption) (*Reader, error) {
+	opts := openOptions{decompressor: defaultDecompressor}
+	for _, o := range opt {
+		o(&opts)
 	}
-	tocTargz := make([]byte, sr.Size()-tocOff-footerSize)
-	if _, err := sr.ReadAt(tocTargz, tocOff); err != nil {
-		return nil, fmt.Errorf("error reading %d byte TOC targz: %v", len(tocTargz), err)
+
+	tocTargz := opts.tocBlob
+	if tocTargz == nil {
+		tocOff, footerSize, err := OpenFooter(sr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing footer")
+		}
+		tocTargz = make([]byte, sr.Size()-tocOff-footerSize)
+		if _, err := sr.ReadAt(tocTargz, tocOff); err != nil {
+			return nil, fmt.Errorf("error reading %d byte TOC targz: %v", len(tocTargz), err)
+		}
 	}
 	zr, err := gzip.NewReader(bytes.NewReader(tocTargz))
 	if err != nil {
@@ -92,7 +135,7 @@ func Open(sr *io.SectionReader) (*Reader, error) {
 	if err := json.NewDecoder(io.TeeReader(tr, dgstr.Hash())).Decode(&toc); err != nil {
 		return nil, fmt.Errorf("error decoding TOC JSON: %v", err)
 	}
-	r := &Reader{sr: sr, toc: toc, tocDigest: dgstr.Digest()}
+	r := &Reader{sr: sr, toc: toc, tocDigest: dgstr.Digest(), decompressor: opts.decompressor}
 	if err := r.initFields(); err != nil {
 		return nil, fmt.Errorf("failed to initialize fields of entries: %v", err)
 	}
@@ -151,6 +194,9 @@ func (r *Reader) initFields() error {
 			}
 
 			ent.modTime, _ = time.Parse(time.RFC3339, ent.ModTime3339)
+			if ent.ChangeTime3339 != "" {
+				ent.changeTime, _ = time.Parse(time.RFC3339, ent.ChangeTime3339)
+			}
 
 			if ent.Type == "dir" {
 				ent.NumLink++ // Parent dir links to this directory
@@ -243,6 +289,11 @@ func (r *Reader) getOrCreateDir(d string) *TOCEntry {
 	return e
 }
 
+// TOCDigest returns the digest of the TOC JSON in the blob.
+func (r *Reader) TOCDigest() digest.Digest {
+	return r.tocDigest
+}
+
 // VerifyTOC checks that the TOC JSON in the passed blob matches the
 // passed digests and that the TOC JSON contains digests for all chunks
 // contained in the blob. If the verification succceeds, this function
@@ -431,10 +482,11 @@ func (fr *fileReader) ReadAt(p []byte, off int64) (n int, err error) {
 		return 0, fmt.Errorf("fileReader.ReadAt.peek: %v", err)
 	}
 
-	gz, err := gzip.NewReader(br)
+	gz, err := fr.r.decompressor(br)
 	if err != nil {
 		return 0, fmt.Errorf("fileReader.ReadAt.gzipNewReader: %v", err)
 	}
+	defer gz.Close()
 	if n, err := io.CopyN(ioutil.Discard, gz, off); n != off || err != nil {
 		return 0, fmt.Errorf("discard of %d bytes = %v, %v", off, n, err)
 	}
@@ -630,14 +682,15 @@ func (w *Writer) AppendTar(r io.Reader) error {
 			}
 		}
 		ent := &TOCEntry{
-			Name:        h.Name,
-			Mode:        h.Mode,
-			UID:         h.Uid,
-			GID:         h.Gid,
-			Uname:       w.nameIfChanged(&w.lastUsername, h.Uid, h.Uname),
-			Gname:       w.nameIfChanged(&w.lastGroupname, h.Gid, h.Gname),
-			ModTime3339: formatModtime(h.ModTime),
-			Xattrs:      xattrs,
+			Name:           h.Name,
+			Mode:           h.Mode,
+			UID:            h.Uid,
+			GID:            h.Gid,
+			Uname:          w.nameIfChanged(&w.lastUsername, h.Uid, h.Uname),
+			Gname:          w.nameIfChanged(&w.lastGroupname, h.Gid, h.Gname),
+			ModTime3339:    formatModtime(h.ModTime),
+			ChangeTime3339: formatModtime(h.ChangeTime),
+			Xattrs:         xattrs,
 		}
 		w.condOpenGz()
 		tw := tar.NewWriter(currentGzipWriter{w})
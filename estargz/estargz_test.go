@@ -915,6 +915,26 @@ func TestChunkEntryForOffset(t *testing.T) {
 	}
 }
 
+// Tests *Reader.ChunkEntryForOffset with offsets beyond 4GiB.
+func TestChunkEntryForLargeOffset(t *testing.T) {
+	const chunkSize = 1 << 30
+	name := "test"
+	_, r := regularFileReader(name, 6*chunkSize+1, chunkSize)
+	for _, off := range []int64{1<<32 - 1, 1 << 32, 1<<32 + 1, 5*chunkSize + 7, 6 * chunkSize} {
+		ce, ok := r.ChunkEntryForOffset(name, off)
+		if !ok {
+			t.Errorf("offset %d: no chunk found", off)
+			continue
+		}
+		if off < ce.ChunkOffset || off >= ce.ChunkOffset+ce.ChunkSize {
+			t.Errorf("offset %d: got chunk [%d, %d)", off, ce.ChunkOffset, ce.ChunkOffset+ce.ChunkSize)
+		}
+	}
+	if _, ok := r.ChunkEntryForOffset(name, 6*chunkSize+1); ok {
+		t.Errorf("chunk found beyond the end of the file")
+	}
+}
+
 // regularFileReader makes a minimal Reader of "reg" and "chunk" without tar-related information.
 func regularFileReader(name string, size int64, chunkSize int64) (*TOCEntry, *Reader) {
 	ent := &TOCEntry{
@@ -73,12 +73,28 @@ const (
 	// of an image manifest.
 	TOCJSONDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
 
+	// ExternalTOCAnnotation is an annotation for an image layer built with
+	// WithExternalTOC. This stores the digest of the blob of the TOC, which is
+	// stored in the same repository as the layer.
+	// This annotation is valid only when it is specified in `.[]layers.annotations`
+	// of an image manifest.
+	ExternalTOCAnnotation = "containerd.io/snapshot/stargz/toc.external"
+
 	// StoreUncompressedSizeAnnotation is an additional annotation key for eStargz to enable lazy
 	// pulling on containers/storage. Stargz Store is required to expose the layer's uncompressed size
 	// to the runtime but current OCI image doesn't ship this information by default. So we store this
 	// to the special annotation.
 	StoreUncompressedSizeAnnotation = "io.containers.estargz.uncompressed-size"
 
+	// PrioritizedSizeAnnotation is an annotation for an image layer. This stores the
+	// total uncompressed size of the prioritized files (i.e. the files placed before
+	// the prefetch landmark) which are needed at the startup of the container.
+	PrioritizedSizeAnnotation = "containerd.io/snapshot/stargz/prioritized.size"
+
+	// PrioritizedFilesAnnotation is an annotation for an image layer. This stores
+	// the number of the prioritized regular files.
+	PrioritizedFilesAnnotation = "containerd.io/snapshot/stargz/prioritized.files"
+
 	// PrefetchLandmark is a file entry which indicates the end position of
 	// prefetch in the stargz file.
 	PrefetchLandmark = ".prefetch.landmark"
@@ -118,6 +134,12 @@ type TOCEntry struct {
 	ModTime3339 string `json:"modtime,omitempty"`
 	modTime     time.Time
 
+	// ChangeTime3339 is the change time of the tar entry. Empty
+	// means zero or unknown. Otherwise it's in UTC RFC3339
+	// format. Use the ChangeTime method to access the time.Time value.
+	ChangeTime3339 string `json:"changetime,omitempty"`
+	changeTime     time.Time
+
 	// LinkName, for symlinks and hardlinks, is the link target.
 	LinkName string `json:"linkName,omitempty"`
 
@@ -188,6 +210,9 @@ type TOCEntry struct {
 // ModTime returns the entry's modification time.
 func (e *TOCEntry) ModTime() time.Time { return e.modTime }
 
+// ChangeTime returns the entry's change time. Zero is returned if unknown.
+func (e *TOCEntry) ChangeTime() time.Time { return e.changeTime }
+
 // NextOffset returns the position (relative to the start of the
 // stargz file) of the next gzip boundary after e.Offset.
 func (e *TOCEntry) NextOffset() int64 { return e.nextOffset }
@@ -0,0 +1,160 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package s3 provides the sources of eStargz layers stored in S3-compatible
+// object storages (e.g. Amazon S3, MinIO) instead of registries so that the
+// stargz filesystem lazily mounts them. Blobs are read from the buckets laid out
+// as OCI image layout (i.e. "<prefix>/blobs/<algorithm>/<encoded>").
+package s3
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// LocationLabel is a label which contains the location of the OCI image
+	// layout in the bucket serving the layer (e.g. "s3://bucket/path/to/layout").
+	// Layers with this label are mounted from the bucket.
+	LocationLabel = "containerd.io/snapshot/remote/s3.location"
+
+	defaultRegion = "us-east-1"
+)
+
+// Config is config for the S3-compatible object storage.
+type Config struct {
+	// Endpoint is the URL of the object storage (e.g. "https://s3.amazonaws.com",
+	// "http://minio.local:9000"). Layers aren't mounted from S3 if empty.
+	Endpoint string `toml:"endpoint"`
+
+	// Region is the region of the buckets (default: "us-east-1").
+	Region string `toml:"region"`
+
+	// AccessKeyID and SecretAccessKey are the credentials for accessing the
+	// buckets. If empty, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment
+	// variables are used. Requests are sent anonymously if no credentials are
+	// available.
+	AccessKeyID     string `toml:"access_key_id"`
+	SecretAccessKey string `toml:"secret_access_key"`
+
+	// SessionToken is the token for temporary credentials. If empty,
+	// AWS_SESSION_TOKEN environment variable is used.
+	SessionToken string `toml:"session_token"`
+
+	// VirtualHostedStyle makes requests to "<bucket>.<endpoint>" instead of
+	// "<endpoint>/<bucket>" (path-style, supported by most S3-compatible storages).
+	VirtualHostedStyle bool `toml:"virtual_hosted_style"`
+}
+
+// Location is the location of the OCI image layout in a bucket.
+type Location struct {
+	Bucket string
+	Prefix string
+}
+
+// ParseLocation parses the location in the form of "s3://<bucket>[/<prefix>]".
+func ParseLocation(s string) (Location, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return Location{}, errors.Wrapf(err, "invalid location %q", s)
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return Location{}, fmt.Errorf("invalid location %q: must be s3://<bucket>[/<prefix>]", s)
+	}
+	return Location{Bucket: u.Host, Prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+// key returns the key of the object of the blob.
+func (l Location) key(dgst string) (string, error) {
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid digest %q", dgst)
+	}
+	k := "blobs/" + d.Algorithm().String() + "/" + d.Encoded()
+	if l.Prefix != "" {
+		k = l.Prefix + "/" + k
+	}
+	return k, nil
+}
+
+// Sources returns the function for converting the labels of the layers stored
+// in the object storage to their sources. Blobs are fetched through the
+// returned hosts with the signed requests sent over tr. Layers without
+// LocationLabel are rejected.
+func Sources(s3cfg Config, tr http.RoundTripper) (source.GetSources, error) {
+	endpoint, err := url.Parse(s3cfg.Endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid endpoint %q", s3cfg.Endpoint)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q: must be http(s)://<host>", s3cfg.Endpoint)
+	}
+	s := newSigner(s3cfg)
+	return func(labels map[string]string) ([]source.Source, error) {
+		locStr, ok := labels[LocationLabel]
+		if !ok {
+			return nil, fmt.Errorf("layer isn't stored in S3: %q label is missing", LocationLabel)
+		}
+		loc, err := ParseLocation(locStr)
+		if err != nil {
+			return nil, err
+		}
+		hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{{
+				Client: &http.Client{Transport: &transport{
+					inner:         tr,
+					endpoint:      endpoint,
+					loc:           loc,
+					signer:        s,
+					virtualHosted: s3cfg.VirtualHostedStyle,
+					maxRangeGap:   defaultMaxRangeGap,
+				}},
+				Host:         endpoint.Host,
+				Scheme:       endpoint.Scheme,
+				Path:         "/",
+				Capabilities: docker.HostCapabilityPull,
+			}}, nil
+		}
+		return source.FromDefaultLabels(hosts)(labels)
+	}, nil
+}
+
+// IsS3Layer returns true if the layer is labeled to be mounted from the object
+// storage.
+func IsS3Layer(labels map[string]string) bool {
+	_, ok := labels[LocationLabel]
+	return ok
+}
+
+func credentialsFromEnv(s3cfg Config) (id, secret, token string) {
+	id, secret, token = s3cfg.AccessKeyID, s3cfg.SecretAccessKey, s3cfg.SessionToken
+	if id == "" && secret == "" {
+		id, secret = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if token == "" {
+		token = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	return
+}
@@ -0,0 +1,308 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/util/byterange"
+)
+
+const (
+	signAlgorithm = "AWS4-HMAC-SHA256"
+	amzDateFormat = "20060102T150405Z"
+
+	// emptyPayloadHash is the SHA256 of empty payload. Requests to blobs don't
+	// have payloads.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// defaultMaxRangeGap is the max gap between the ranges fetched by a
+	// single request. S3 doesn't support multi-range requests so ranges
+	// separated by larger gaps are fetched by separate requests instead of
+	// fetching the unrequested bytes between them.
+	defaultMaxRangeGap = 1024 * 1024
+)
+
+// transport sends the requests for the blobs on the registry (i.e. ".../blobs/<digest>")
+// to the objects in the bucket as signed requests.
+type transport struct {
+	inner         http.RoundTripper
+	endpoint      *url.URL
+	loc           Location
+	signer        *signer
+	virtualHosted bool
+	maxRangeGap   int64
+}
+
+func (tr *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	blobs, dgst := path.Split(req.URL.Path)
+	if path.Base(blobs) != "blobs" {
+		return nil, fmt.Errorf("unexpected request to %q", req.URL)
+	}
+	key, err := tr.loc.key(dgst)
+	if err != nil {
+		return nil, err
+	}
+	u := *tr.endpoint
+	if tr.virtualHosted {
+		u.Host = tr.loc.Bucket + "." + u.Host
+		u.Path = path.Join("/", u.Path, key)
+	} else {
+		u.Path = path.Join("/", u.Path, tr.loc.Bucket, key)
+	}
+	u.RawPath = ""
+
+	req = req.Clone(req.Context())
+	req.URL = &u
+	req.Host = ""
+	r := req.Header.Get("Range")
+	if r == "" {
+		return tr.do(req)
+	}
+	rs, err := byterange.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	if rs = byterange.Coalesce(rs, tr.maxRangeGap); len(rs) == 1 {
+		req.Header.Set("Range", byterange.Header(rs[0]))
+		return tr.do(req)
+	}
+	return tr.multiRange(req, rs)
+}
+
+// do signs and sends the request.
+func (tr *transport) do(req *http.Request) (*http.Response, error) {
+	if tr.signer != nil {
+		tr.signer.sign(req, time.Now())
+	}
+	return tr.inner.RoundTrip(req)
+}
+
+// getRange sends the request for the range.
+func (tr *transport) getRange(req *http.Request, r byterange.Range) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Range", byterange.Header(r))
+	return tr.do(req)
+}
+
+// multiRange fetches the ranges by separate requests because S3 doesn't support
+// multi-range requests. They are served as the multipart response as registries
+// do. The first response is returned as is if it isn't partial (e.g. errors).
+func (tr *transport) multiRange(req *http.Request, rs []byterange.Range) (*http.Response, error) {
+	first, err := tr.getRange(req, rs[0])
+	if err != nil {
+		return nil, err
+	}
+	if first.StatusCode != http.StatusPartialContent {
+		return first, nil
+	}
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		res := first
+		for i := 0; ; i++ {
+			err := writePart(mw, res)
+			res.Body.Close()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if i+1 == len(rs) {
+				break
+			}
+			// The following ranges are requested lazily while the
+			// previous parts are read.
+			if res, err = tr.getRange(req, rs[i+1]); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			if res.StatusCode != http.StatusPartialContent {
+				res.Body.Close()
+				pw.CloseWithError(fmt.Errorf("unexpected status code %v on range %v", res.Status, rs[i+1]))
+				return
+			}
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+	header := first.Header.Clone()
+	header.Del("Content-Range")
+	header.Del("Content-Length")
+	header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	return &http.Response{
+		Status:        first.Status,
+		StatusCode:    first.StatusCode,
+		Proto:         first.Proto,
+		ProtoMajor:    first.ProtoMajor,
+		ProtoMinor:    first.ProtoMinor,
+		Header:        header,
+		Body:          pr,
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+func writePart(mw *multipart.Writer, res *http.Response) error {
+	contentType := res.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":  {contentType},
+		"Content-Range": {res.Header.Get("Content-Range")},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// signer signs requests with AWS Signature Version 4.
+type signer struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	region          string
+}
+
+// newSigner returns the signer with the configured credentials. nil is returned
+// if no credentials are available so requests are sent anonymously.
+func newSigner(s3cfg Config) *signer {
+	id, secret, token := credentialsFromEnv(s3cfg)
+	if id == "" || secret == "" {
+		return nil
+	}
+	region := s3cfg.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	return &signer{
+		accessKeyID:     id,
+		secretAccessKey: secret,
+		sessionToken:    token,
+		region:          region,
+	}
+}
+
+func (s *signer) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	// Host, Range and x-amz-* headers are signed.
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if lk == "range" || strings.HasPrefix(lk, "x-amz-") {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, s.region, "s3", "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		signAlgorithm,
+		amzDate,
+		scope,
+		hexSHA256(canonicalRequest),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), date)
+	for _, v := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		signAlgorithm, s.accessKeyID, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		vs := q[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode encodes the string as specified by Signature Version 4. Slashes are
+// kept if encodeSlash is false.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func hexSHA256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,175 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// allowRootFS is a fuse.RawFileSystem which rejects requests from users other
+// than root and the owner of the filesystem, following allow_root of libfuse.
+// The filesystem must be mounted with allow_other so that the kernel forwards
+// requests from all users. Requests on opened handles (e.g. reads) aren't
+// checked because only allowed users can open the handles.
+type allowRootFS struct {
+	fuse.RawFileSystem
+	owner uint32
+}
+
+func (fs *allowRootFS) allowed(h *fuse.InHeader) bool {
+	return h.Uid == 0 || h.Uid == fs.owner
+}
+
+func (fs *allowRootFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	if !fs.allowed(header) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.Lookup(cancel, header, name, out)
+}
+
+func (fs *allowRootFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if !fs.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.GetAttr(cancel, input, out)
+}
+
+func (fs *allowRootFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if !fs.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.SetAttr(cancel, input, out)
+}
+
+func (fs *allowRootFS) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !fs.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.Mknod(cancel, input, name, out)
+}
+
+func (fs *allowRootFS) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !fs.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.Mkdir(cancel, input, name, out)
+}
+
+func (fs *allowRootFS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if !fs.allowed(header) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.Unlink(cancel, header, name)
+}
+
+func (fs *allowRootFS) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if !fs.allowed(header) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.Rmdir(cancel, header, name)
+}
+
+func (fs *allowRootFS) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if !fs.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.Rename(cancel, input, oldName, newName)
+}
+
+func (fs *allowRootFS) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) fuse.Status {
+	if !fs.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.Link(cancel, input, filename, out)
+}
+
+func (fs *allowRootFS) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	if !fs.allowed(header) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+}
+
+func (fs *allowRootFS) Readlink(cancel <-chan struct{}, header *fuse.InHeader) ([]byte, fuse.Status) {
+	if !fs.allowed(header) {
+		return nil, fuse.EACCES
+	}
+	return fs.RawFileSystem.Readlink(cancel, header)
+}
+
+func (fs *allowRootFS) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
+	if !fs.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.Access(cancel, input)
+}
+
+func (fs *allowRootFS) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	if !fs.allowed(header) {
+		return 0, fuse.EACCES
+	}
+	return fs.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+}
+
+func (fs *allowRootFS) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	if !fs.allowed(header) {
+		return 0, fuse.EACCES
+	}
+	return fs.RawFileSystem.ListXAttr(cancel, header, dest)
+}
+
+func (fs *allowRootFS) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	if !fs.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.SetXAttr(cancel, input, attr, data)
+}
+
+func (fs *allowRootFS) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	if !fs.allowed(header) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.RemoveXAttr(cancel, header, attr)
+}
+
+func (fs *allowRootFS) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	if !fs.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.Create(cancel, input, name, out)
+}
+
+func (fs *allowRootFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if !fs.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.Open(cancel, input, out)
+}
+
+func (fs *allowRootFS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if !fs.allowed(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.OpenDir(cancel, input, out)
+}
+
+func (fs *allowRootFS) StatFs(cancel <-chan struct{}, header *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	if !fs.allowed(header) {
+		return fuse.EACCES
+	}
+	return fs.RawFileSystem.StatFs(cancel, header, out)
+}
@@ -0,0 +1,265 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package advisor detects images which are pulled faster without lazy pulling
+// on the node (e.g. tiny images on slow registries). Layers are observed while
+// they are used: the time reads of files waited for the registry is compared
+// with the estimated time of pulling the whole layers, based on the throughput
+// of the registry observed on fetching the layers. Images whose reads mostly
+// hit the cache (e.g. prefetched) keep being lazily pulled.
+//
+// Observations are recorded per repository so that new versions of an image
+// follow the evaluation of the older ones. They are persisted so that the
+// evaluations survive restarts and expire after a while so that lazy pulling
+// is tried again (e.g. after the registry gets faster).
+package advisor
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSlowdownRatio    = 1.0
+	defaultMinCacheHitRatio = 0.9
+	defaultExpiry           = 7 * 24 * time.Hour
+)
+
+// ErrFullPullPreferred is returned by Check when the image is pulled faster
+// without lazy pulling.
+var ErrFullPullPreferred = errors.New("image is pulled faster without lazy pulling on this node")
+
+// Sample is the observation of a layer.
+type Sample struct {
+	// Size is the size of the layer blob.
+	Size int64 `json:"size"`
+
+	// OnDemandFetchDuration is the time reads of files waited for the registry.
+	OnDemandFetchDuration time.Duration `json:"onDemandFetchDuration"`
+
+	// FetchedSize and FetchDuration are the size fetched from the registry and
+	// the time spent on it. These estimate the time of pulling the whole layer.
+	FetchedSize   int64         `json:"fetchedSize"`
+	FetchDuration time.Duration `json:"fetchDuration"`
+
+	// CachedSize and MissedSize are the sizes of reads of files which hit and
+	// missed the cache.
+	CachedSize int64 `json:"cachedSize"`
+	MissedSize int64 `json:"missedSize"`
+}
+
+// Recommendation is the evaluation of an image.
+type Recommendation struct {
+	// Image is the repository of the image (e.g. "docker.io/library/alpine").
+	Image string `json:"image"`
+
+	// LazyPullCost is the time reads of files waited for the registry.
+	LazyPullCost time.Duration `json:"lazyPullCost"`
+
+	// FullPullCost is the estimated time of pulling the whole layers.
+	FullPullCost time.Duration `json:"fullPullCost"`
+
+	// CacheHitRatio is the ratio of the size of reads served from the cache.
+	CacheHitRatio float64 `json:"cacheHitRatio"`
+
+	// FullPullPreferred is true if the image is pulled faster without lazy
+	// pulling.
+	FullPullPreferred bool `json:"fullPullPreferred"`
+
+	// Updated is when the image was observed last.
+	Updated time.Time `json:"updated"`
+}
+
+type image struct {
+	Layers  map[string]Sample `json:"layers"`
+	Updated time.Time         `json:"updated"`
+}
+
+// Advisor evaluates images from the observations of their layers.
+type Advisor struct {
+	path             string
+	auto             bool
+	slowdownRatio    float64
+	minCacheHitRatio float64
+	expiry           time.Duration
+
+	images map[string]*image
+	mu     sync.Mutex
+
+	now func() time.Time
+}
+
+// New returns the advisor configured by cfg. The observations are persisted in
+// the file specified by path.
+func New(path string, cfg config.LazyPullAdvisorConfig) (*Advisor, error) {
+	a := &Advisor{
+		path:             path,
+		slowdownRatio:    cfg.SlowdownRatio,
+		minCacheHitRatio: cfg.MinCacheHitRatio,
+		expiry:           time.Duration(cfg.ExpirySec) * time.Second,
+		images:           make(map[string]*image),
+		now:              time.Now,
+	}
+	switch cfg.Mode {
+	case config.LazyPullAdvisorRecommend:
+	case config.LazyPullAdvisorAuto:
+		a.auto = true
+	default:
+		return nil, errors.Errorf("unknown mode of lazy pull advisor %q", cfg.Mode)
+	}
+	if a.slowdownRatio < 0 {
+		return nil, errors.Errorf("invalid slowdown ratio %v", a.slowdownRatio)
+	} else if a.slowdownRatio == 0 {
+		a.slowdownRatio = defaultSlowdownRatio
+	}
+	if a.minCacheHitRatio == 0 {
+		a.minCacheHitRatio = defaultMinCacheHitRatio
+	}
+	if a.expiry <= 0 {
+		a.expiry = defaultExpiry
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	} else if err == nil {
+		if err := json.Unmarshal(b, &a.images); err != nil {
+			return nil, errors.Wrapf(err, "invalid observations %q", path)
+		}
+	}
+	return a, nil
+}
+
+// Observe records the sample of the layer of the image. The previous sample of
+// the layer is replaced.
+func (a *Advisor) Observe(ctx context.Context, refspec reference.Spec, dgst digest.Digest, s Sample) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	name := refspec.Locator
+	img, ok := a.images[name]
+	if !ok || a.expired(img) {
+		img = &image{Layers: make(map[string]Sample)}
+		a.images[name] = img
+	}
+	preferred := a.evaluate(name, img).FullPullPreferred
+	img.Layers[dgst.String()] = s
+	img.Updated = a.now()
+	if r := a.evaluate(name, img); r.FullPullPreferred && !preferred {
+		log.G(ctx).WithField("image", name).
+			WithField("lazy_pull_cost", r.LazyPullCost).
+			WithField("full_pull_cost", r.FullPullCost).
+			WithField("cache_hit_ratio", r.CacheHitRatio).
+			Warn("image is pulled faster without lazy pulling on this node")
+	}
+	if err := a.save(); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to save observations of lazy pulling")
+	}
+}
+
+// Check returns ErrFullPullPreferred if lazy pulling of the image is disabled.
+// Lazy pulling is disabled only in LazyPullAdvisorAuto mode.
+func (a *Advisor) Check(refspec reference.Spec) error {
+	if !a.auto {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	img, ok := a.images[refspec.Locator]
+	if !ok || a.expired(img) {
+		return nil
+	}
+	if r := a.evaluate(refspec.Locator, img); r.FullPullPreferred {
+		return errors.Wrapf(ErrFullPullPreferred, "%q waited %v for the registry; full pull estimated %v",
+			r.Image, r.LazyPullCost, r.FullPullCost)
+	}
+	return nil
+}
+
+// Recommendations returns the evaluations of the observed images sorted by
+// their names.
+func (a *Advisor) Recommendations() (recs []Recommendation) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name, img := range a.images {
+		if !a.expired(img) {
+			recs = append(recs, a.evaluate(name, img))
+		}
+	}
+	sort.Slice(recs, func(i, j int) bool { return recs[i].Image < recs[j].Image })
+	return recs
+}
+
+func (a *Advisor) expired(img *image) bool {
+	return a.now().Sub(img.Updated) > a.expiry
+}
+
+func (a *Advisor) evaluate(name string, img *image) Recommendation {
+	r := Recommendation{Image: name, Updated: img.Updated}
+	var cached, missed int64
+	for _, s := range img.Layers {
+		r.LazyPullCost += s.OnDemandFetchDuration
+		if s.FetchedSize > 0 {
+			r.FullPullCost += time.Duration(float64(s.FetchDuration) * float64(s.Size) / float64(s.FetchedSize))
+		}
+		cached += s.CachedSize
+		missed += s.MissedSize
+	}
+	if cached+missed == 0 {
+		return r // nothing is read
+	}
+	r.CacheHitRatio = float64(cached) / float64(cached+missed)
+	r.FullPullPreferred = (a.minCacheHitRatio < 0 || r.CacheHitRatio < a.minCacheHitRatio) &&
+		float64(r.LazyPullCost) > float64(r.FullPullCost)*a.slowdownRatio
+	return r
+}
+
+// save writes the observations to the file. Expired ones are discarded. The
+// file is replaced atomically.
+func (a *Advisor) save() error {
+	for name, img := range a.images {
+		if a.expired(img) {
+			delete(a.images, name)
+		}
+	}
+	b, err := json.Marshal(a.images)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(a.path), filepath.Base(a.path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), a.path)
+}
@@ -0,0 +1,164 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package advisor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+func TestAdvisor(t *testing.T) {
+	// slow is a sample of a layer whose reads waited for the registry much
+	// longer than pulling the whole layer.
+	slow := Sample{
+		Size:                  1000,
+		OnDemandFetchDuration: 5 * time.Second,
+		FetchedSize:           1000,
+		FetchDuration:         time.Second,
+		MissedSize:            100,
+	}
+	fast := slow
+	fast.OnDemandFetchDuration = 500 * time.Millisecond
+	cached := slow
+	cached.CachedSize, cached.MissedSize = 950, 50
+	partial := slow
+	partial.FetchedSize = 100 // full pull is estimated to take 10s
+	// idle is a sample of a layer which is large but never read.
+	idle := Sample{Size: 5000, FetchedSize: 5000, FetchDuration: 5 * time.Second}
+
+	tests := []struct {
+		name          string
+		mode          string
+		slowdownRatio float64
+		minHitRatio   float64
+		samples       []Sample
+		wantPreferred bool
+		wantDenied    bool
+	}{
+		{name: "slow", mode: config.LazyPullAdvisorAuto, samples: []Sample{slow}, wantPreferred: true, wantDenied: true},
+		{name: "recommend", mode: config.LazyPullAdvisorRecommend, samples: []Sample{slow}, wantPreferred: true},
+		{name: "fast", mode: config.LazyPullAdvisorAuto, samples: []Sample{fast}},
+		{name: "cache hit", mode: config.LazyPullAdvisorAuto, samples: []Sample{cached}},
+		{name: "cache hit disabled", mode: config.LazyPullAdvisorAuto, minHitRatio: -1, samples: []Sample{cached}, wantPreferred: true, wantDenied: true},
+		{name: "estimated by fetched size", mode: config.LazyPullAdvisorAuto, samples: []Sample{partial}},
+		{name: "slowdown ratio", mode: config.LazyPullAdvisorAuto, slowdownRatio: 10, samples: []Sample{slow}},
+		{name: "layers summed", mode: config.LazyPullAdvisorAuto, samples: []Sample{slow, idle}},
+		{name: "no reads", mode: config.LazyPullAdvisorAuto, samples: []Sample{{Size: 1000}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "advisortest")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			a, err := New(filepath.Join(dir, "lazypull.json"), config.LazyPullAdvisorConfig{
+				Mode:             tt.mode,
+				SlowdownRatio:    tt.slowdownRatio,
+				MinCacheHitRatio: tt.minHitRatio,
+			})
+			if err != nil {
+				t.Fatalf("failed to create advisor: %v", err)
+			}
+			refspec := reference.Spec{Locator: "registry.example.com/app", Object: "v1"}
+			for i, s := range tt.samples {
+				a.Observe(context.TODO(), refspec, digest.FromString(string(rune('a'+i))), s)
+			}
+			recs := a.Recommendations()
+			if len(recs) != 1 {
+				t.Fatalf("got %d recommendations; want 1", len(recs))
+			}
+			if recs[0].FullPullPreferred != tt.wantPreferred {
+				t.Errorf("full pull preferred = %v; want %v: %+v", recs[0].FullPullPreferred, tt.wantPreferred, recs[0])
+			}
+
+			// Other versions of the image follow the evaluation.
+			err = a.Check(reference.Spec{Locator: "registry.example.com/app", Object: "v2"})
+			if denied := errors.Is(err, ErrFullPullPreferred); denied != tt.wantDenied {
+				t.Errorf("denied = %v (%v); want %v", denied, err, tt.wantDenied)
+			}
+			if err := a.Check(reference.Spec{Locator: "registry.example.com/other", Object: "v1"}); err != nil {
+				t.Errorf("other image must be allowed: %v", err)
+			}
+		})
+	}
+}
+
+func TestAdvisorPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "advisortest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lazypull.json")
+	cfg := config.LazyPullAdvisorConfig{Mode: config.LazyPullAdvisorAuto, ExpirySec: 60}
+	a, err := New(path, cfg)
+	if err != nil {
+		t.Fatalf("failed to create advisor: %v", err)
+	}
+	refspec := reference.Spec{Locator: "registry.example.com/app", Object: "v1"}
+	a.Observe(context.TODO(), refspec, digest.FromString("a"), Sample{
+		Size:                  1000,
+		OnDemandFetchDuration: 5 * time.Second,
+		FetchedSize:           1000,
+		FetchDuration:         time.Second,
+		MissedSize:            100,
+	})
+
+	// The evaluation survives restarts.
+	a, err = New(path, cfg)
+	if err != nil {
+		t.Fatalf("failed to reload advisor: %v", err)
+	}
+	if err := a.Check(refspec); !errors.Is(err, ErrFullPullPreferred) {
+		t.Errorf("lazy pulling must be disabled after restart: %v", err)
+	}
+
+	// Lazy pulling is tried again after the observations expire.
+	a.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if err := a.Check(refspec); err != nil {
+		t.Errorf("lazy pulling must be enabled after expiry: %v", err)
+	}
+	if recs := a.Recommendations(); len(recs) != 0 {
+		t.Errorf("expired recommendations are reported: %+v", recs)
+	}
+}
+
+func TestAdvisorConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "advisortest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, cfg := range []config.LazyPullAdvisorConfig{
+		{Mode: "unknown"},
+		{Mode: config.LazyPullAdvisorAuto, SlowdownRatio: -1},
+	} {
+		if _, err := New(filepath.Join(dir, "lazypull.json"), cfg); err == nil {
+			t.Errorf("config %+v must be invalid", cfg)
+		}
+	}
+}
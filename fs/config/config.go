@@ -22,6 +22,10 @@
 
 package config
 
+import (
+	"github.com/containerd/stargz-snapshotter/util/faultinject"
+)
+
 const (
 	// TargetSkipVerifyLabel is a snapshot label key that indicates to skip content
 	// verification for the layer.
@@ -31,6 +35,121 @@ const (
 	// the layer. If the layer is eStargz and contains prefetch landmarks, these config
 	// will be respeced.
 	TargetPrefetchSizeLabel = "containerd.io/snapshot/remote/stargz.prefetch"
+
+	// TargetTenantLabel is a label key that indicates the tenant (containerd
+	// namespace) of the layer. The filesystem sets this to the labels passed to
+	// GetSources so that sources can partition credentials and connections to
+	// registries by tenants. Values specified by clients are ignored.
+	TargetTenantLabel = "containerd.io/snapshot/remote/stargz.tenant"
+
+	// TargetCreatedLabel is a snapshot label key that indicates the creation time
+	// of the layer in RFC 3339 format. This is used when TimestampMode is "layer".
+	TargetCreatedLabel = "containerd.io/snapshot/remote/stargz.created"
+
+	// TargetOwnerLabel is a snapshot label key that overrides the owner ("uid:gid")
+	// of all files in the layer. This takes precedence over Owner in the config.
+	TargetOwnerLabel = "containerd.io/snapshot/remote/stargz.owner"
+
+	// TargetUmaskLabel is a snapshot label key that specifies the umask (in octal)
+	// applied to all files in the layer. This takes precedence over Umask in the config.
+	TargetUmaskLabel = "containerd.io/snapshot/remote/stargz.umask"
+
+	// TargetPinnedLabel is a snapshot label key that pins the cache of the layer
+	// when the value is "true". Pinned layers are exempt from eviction.
+	TargetPinnedLabel = "containerd.io/snapshot/remote/stargz.pinned"
+
+	// TargetWritableLabel is a snapshot label key that makes the mounted layer
+	// writable. Modifications are stored in a directory on tmpfs ("memory") or
+	// under the root directory of the filesystem ("dir") and discarded on unmount.
+	// This is for binding a single layer without overlayfs.
+	TargetWritableLabel = "containerd.io/snapshot/remote/stargz.writable"
+
+	// TargetAuthLabel is a snapshot label key that passes the credentials of the
+	// registry of the image (e.g. an image pull secret forwarded from CRI). The
+	// value is the JSON of an auth entry of docker config ({"username": "...",
+	// "password": "..."}, {"auth": "..."} or {"identitytoken": "..."}). This is
+	// never persisted by the snapshotter.
+	TargetAuthLabel = "containerd.io/snapshot/remote/stargz.auth"
+
+	// WritableModeMemory stores modifications to the layer on tmpfs.
+	WritableModeMemory = "memory"
+
+	// WritableModeDir stores modifications to the layer under the root directory.
+	WritableModeDir = "dir"
+
+	// TimestampModeFixed presents FixedTimestamp as the timestamps of all files.
+	TimestampModeFixed = "fixed"
+
+	// TimestampModeLayer presents the creation time of the layer as the timestamps
+	// of all files. FixedTimestamp is used if the creation time isn't known.
+	TimestampModeLayer = "layer"
+
+	// AtimeModeNoatime never updates access times of files. Access times are the
+	// same as modification times.
+	AtimeModeNoatime = "noatime"
+
+	// AtimeModeRelatime updates access times of files following the semantics of
+	// relatime mount option. Access times are kept in memory.
+	AtimeModeRelatime = "relatime"
+
+	// FuseAccessOther allows all users to access layers (allow_other). This
+	// requires user_allow_other in /etc/fuse.conf if the filesystem isn't
+	// mounted by root.
+	FuseAccessOther = "other"
+
+	// FuseAccessRoot allows only root and the user who mounts layers to access
+	// them (allow_root). This also requires user_allow_other in /etc/fuse.conf
+	// if the filesystem isn't mounted by root.
+	FuseAccessRoot = "root"
+
+	// FuseAccessOwner allows only the user who mounts layers to access them.
+	FuseAccessOwner = "owner"
+
+	// DecompressionBackendStdlib decompresses layers using compress/gzip of the
+	// standard library.
+	DecompressionBackendStdlib = "stdlib"
+
+	// DecompressionBackendKlauspost decompresses layers using
+	// github.com/klauspost/compress/gzip, which is faster than the standard library.
+	DecompressionBackendKlauspost = "klauspost"
+
+	// CacheTypeMemory is the cache type (http_cache_type and
+	// filesystem_cache_type) which stores caches in memory.
+	CacheTypeMemory = "memory"
+
+	// CacheTypeCachefilesCulling is the cache type which stores caches in a
+	// directory bound to the kernel's cachefiles module only for culling. This
+	// isn't EROFS over fscache. See CachefilesCullingConfig.
+	CacheTypeCachefilesCulling = "cachefiles-culling"
+
+	// CacheBackendDisk stores directory caches on the snapshotter's root directory.
+	CacheBackendDisk = "disk"
+
+	// CacheBackendTmpfs stores directory caches on a tmpfs.
+	CacheBackendTmpfs = "tmpfs"
+
+	// CacheBackendFscrypt stores directory caches in a fscrypt-protected directory.
+	CacheBackendFscrypt = "fscrypt"
+
+	// EvictionPolicySize evicts the least recently used cache entries when the
+	// total size of them exceeds the limit.
+	EvictionPolicySize = "size"
+
+	// EvictionPolicyLFU evicts the least frequently used cache entries when the
+	// number of them exceeds the limit.
+	EvictionPolicyLFU = "lfu"
+
+	// EvictionPolicyTTL evicts cache entries which haven't been accessed for a
+	// duration.
+	EvictionPolicyTTL = "ttl"
+
+	// LazyPullAdvisorRecommend reports images which are pulled faster without
+	// lazy pulling on the node but keeps lazily pulling them.
+	LazyPullAdvisorRecommend = "recommend"
+
+	// LazyPullAdvisorAuto disables lazy pulling of images which are pulled
+	// faster without lazy pulling on the node.
+	LazyPullAdvisorAuto = "auto"
 )
 
 type Config struct {
@@ -47,11 +166,195 @@ type Config struct {
 	MaxConcurrency      int64  `toml:"max_concurrency"`
 	NoPrometheus        bool   `toml:"no_prometheus"`
 
+	// PrefetchCoordination makes layers of an image prefetched one by one from
+	// the upper layers. Files hidden by upper layers are neither prefetched nor
+	// fetched in background. By default, each layer is prefetched and fetched
+	// in background independently.
+	PrefetchCoordination bool `toml:"prefetch_coordination"`
+
+	// IsolateTenants partitions caches, credentials and connections to
+	// registries by tenants (containerd namespaces).
+	IsolateTenants bool `toml:"isolate_tenants"`
+
+	// MaxLayersPerTenant is the maximum number of layers each tenant can hold in
+	// the resolver's cache. Zero means no limit. Enabled only with IsolateTenants.
+	MaxLayersPerTenant int `toml:"max_layers_per_tenant"`
+
+	// TimestampMode overrides the timestamps of files in layers for workloads
+	// sensitive to reproducibility. Empty presents modification times recorded
+	// in the layer. TimestampModeFixed and TimestampModeLayer are also supported.
+	TimestampMode string `toml:"timestamp_mode"`
+
+	// FixedTimestamp is the timestamp in RFC 3339 format used by TimestampMode.
+	// Defaults to the Unix epoch.
+	FixedTimestamp string `toml:"fixed_timestamp"`
+
+	// AtimeMode is the behaviour of access times of files in layers. Defaults to
+	// AtimeModeNoatime. This is ignored if TimestampMode is specified.
+	AtimeMode string `toml:"atime_mode"`
+
+	// Owner overrides the owner ("uid:gid") of all files in layers. Empty presents
+	// the owners recorded in layers.
+	Owner string `toml:"owner"`
+
+	// Umask is the umask (in octal) applied to permission bits of all files in layers.
+	Umask string `toml:"umask"`
+
+	// FuseAccess is the users who can access the FUSE mounts of layers. This is
+	// FuseAccessOther (default), FuseAccessRoot or FuseAccessOwner.
+	FuseAccess string `toml:"fuse_access"`
+
+	// SpeculativeFetchSize enables fetching the remaining chunks of a file in
+	// background when its first chunk is read, because most applications read
+	// files fully after opening them. Only files up to this size are fetched.
+	// Zero disables it.
+	SpeculativeFetchSize int64 `toml:"speculative_fetch_size"`
+
+	// BackgroundFetchWorkers is the number of chunks fetched and decompressed in
+	// parallel during background fetch. Defaults to GOMAXPROCS.
+	BackgroundFetchWorkers int `toml:"background_fetch_workers"`
+
+	// BackgroundFetchBandwidth limits the bandwidth used by background fetch in
+	// bytes per second among all layers. Zero means no limit. This can be changed
+	// at runtime through the admin API.
+	BackgroundFetchBandwidth int64 `toml:"background_fetch_bandwidth"`
+
+	// PauseBackgroundFetch starts the filesystem with background fetch paused.
+	// This can be resumed at runtime through the admin API.
+	PauseBackgroundFetch bool `toml:"pause_background_fetch"`
+
+	// DecompressionBackend is the library used for decompressing layers. This is
+	// "stdlib" (default) or "klauspost".
+	DecompressionBackend string `toml:"decompression_backend"`
+
+	// MaxDecompressionWorkers is the maximum number of gzip streams decompressed
+	// concurrently among all layers. This bounds the CPU usage of the filesystem.
+	// Zero means no limit.
+	MaxDecompressionWorkers int64 `toml:"max_decompression_workers"`
+
+	// PinnedReferences is a list of image references whose layers are pinned in
+	// the cache. A reference without tag or digest pins all images in the repository.
+	PinnedReferences []string `toml:"pinned_references"`
+
+	// RestrictedOperations avoids privileged operations which hardened hosts
+	// (e.g. with seccomp or AppArmor profiles) often forbid. The filesystem
+	// doesn't unshare or enter namespaces, doesn't mount tmpfs and doesn't
+	// create mountpoints (they must be pre-created). FUSE is mounted only via
+	// fusermount. The performed operations can be listed by fs.Operations.
+	RestrictedOperations bool `toml:"restricted_operations"`
+
 	// BlobConfig is config for layer blob management.
 	BlobConfig `toml:"blob"`
 
 	// DirectoryCacheConfig is config for directory-based cache.
 	DirectoryCacheConfig `toml:"directory_cache"`
+
+	// CachefilesCullingConfig is config for "cachefiles-culling" cache type.
+	CachefilesCullingConfig `toml:"cachefiles_culling"`
+
+	// ConversionProxyConfig is config for converting non-eStargz layers on the fly.
+	ConversionProxyConfig `toml:"conversion_proxy"`
+
+	// MountPolicyConfig is config for the policy evaluated before mounting layers.
+	MountPolicyConfig `toml:"mount_policy"`
+
+	// FuseConfig is config for FUSE mounts of layers.
+	FuseConfig `toml:"fuse"`
+
+	// LazyPullAdvisorConfig is config for detecting images which are pulled
+	// faster without lazy pulling.
+	LazyPullAdvisorConfig `toml:"lazy_pull_advisor"`
+}
+
+// LazyPullAdvisorConfig is config for detecting images which are pulled faster
+// without lazy pulling on the node (e.g. tiny images on slow registries). The
+// time reads of files waited for the registry is compared with the estimated
+// time of pulling the whole layers, based on the throughput of the registry
+// observed while the layers were fetched.
+type LazyPullAdvisorConfig struct {
+	// Mode is LazyPullAdvisorRecommend or LazyPullAdvisorAuto. Empty disables
+	// the advisor.
+	Mode string `toml:"mode"`
+
+	// SlowdownRatio is how many times longer than the estimated full pull the
+	// reads must wait for the registry to prefer the full pull. Defaults to 1.
+	SlowdownRatio float64 `toml:"slowdown_ratio"`
+
+	// MinCacheHitRatio is the ratio of the size of reads served from the cache
+	// (e.g. prefetched) above which images keep being lazily pulled regardless
+	// of the latencies. Defaults to 0.9. Negative disables it.
+	MinCacheHitRatio float64 `toml:"min_cache_hit_ratio"`
+
+	// ExpirySec is the duration after which the observations of an image are
+	// discarded so that lazy pulling of the image is tried again. Defaults to
+	// 7 days.
+	ExpirySec int64 `toml:"expiry_sec"`
+}
+
+// FuseConfig is config for FUSE mounts of layers. Longer timeouts reduce
+// metadata requests of read-heavy workloads as layers are immutable.
+type FuseConfig struct {
+	// AttrTimeout is the duration in seconds the kernel caches attributes of
+	// files. Defaults to 1s. Negative disables the cache.
+	AttrTimeout int64 `toml:"attr_timeout"`
+
+	// EntryTimeout is the duration in seconds the kernel caches lookups of
+	// files. Defaults to 1s. Negative disables the cache.
+	EntryTimeout int64 `toml:"entry_timeout"`
+
+	// NegativeTimeout is the duration in seconds the kernel caches lookups of
+	// nonexistent files. Zero (default) disables the cache.
+	NegativeTimeout int64 `toml:"negative_timeout"`
+
+	// MaxReadAhead is the maximum size in bytes of read-ahead requested by the
+	// kernel. Zero uses the default of go-fuse.
+	MaxReadAhead int `toml:"max_read_ahead"`
+
+	// DirectIO makes reads of files bypass the page cache so that each read is
+	// served by the filesystem.
+	DirectIO bool `toml:"direct_io"`
+
+	// BlockSize is the block size in bytes reported as st_blksize of files and
+	// in statfs. Must be a power of two and at least 512. Defaults to 4096.
+	// Larger values make clients (e.g. cp) read large files in larger chunks.
+	BlockSize uint32 `toml:"block_size"`
+}
+
+// MountPolicyConfig is config for the policy evaluated before mounting remote
+// layers. The reference, digest, registry and annotations of the layer are
+// POSTed to the webhook as JSON and the webhook responds whether the layer is
+// allowed (e.g. {"allowed": false, "reason": "unapproved registry"}).
+type MountPolicyConfig struct {
+	// WebhookURL is the URL of the policy webhook. Empty disables the webhook.
+	WebhookURL string `toml:"webhook_url"`
+
+	// TimeoutSec is the timeout of a request to the webhook. Defaults to 5s.
+	TimeoutSec int64 `toml:"timeout_sec"`
+
+	// FailOpen allows mounting layers when the policy fails to be evaluated
+	// (e.g. the webhook is unreachable). By default, such layers are denied.
+	FailOpen bool `toml:"fail_open"`
+}
+
+// ConversionProxyConfig is config for the conversion proxy. Non-eStargz layers
+// are converted into eStargz and stored in the cache repository. Other nodes
+// lazily pull the converted layers from there.
+type ConversionProxyConfig struct {
+	// CacheRepository is the repository where converted layers are stored
+	// (e.g. "registry.example.com/esgz-cache"). The repository must be trusted
+	// because converted layers are verified with the TOC digests recorded there.
+	// Empty disables the conversion proxy.
+	CacheRepository string `toml:"cache_repository"`
+
+	// Convert enables converting non-eStargz layers on this node and pushing
+	// them to the CacheRepository. If false, this node only uses layers
+	// converted by other nodes.
+	Convert bool `toml:"convert"`
+
+	// MaxConcurrency is the max number of layers converted at once. Layers
+	// requested over this limit aren't converted until they're mounted again.
+	// Zero uses the default (2).
+	MaxConcurrency int `toml:"max_concurrency"`
 }
 
 type BlobConfig struct {
@@ -60,6 +363,34 @@ type BlobConfig struct {
 	ChunkSize            int64 `toml:"chunk_size"`
 	FetchTimeoutSec      int64 `toml:"fetching_timeout_sec"`
 	ForceSingleRangeMode bool  `toml:"force_single_range_mode"`
+
+	// DigestRefValidInterval is the interval (in seconds) of checking the
+	// availability of layers of images referenced by digest and verified with
+	// TOC digests. Contents of such layers never change so the check can be
+	// less frequent than ValidInterval. Negative disables the check of these
+	// layers entirely. Zero applies ValidInterval (and CheckAlways) as well.
+	DigestRefValidInterval int64 `toml:"digest_ref_valid_interval"`
+
+	// RaceMirrors sends the first request for a blob to all configured hosts
+	// simultaneously and sticks with the fastest one.
+	RaceMirrors bool `toml:"race_mirrors"`
+
+	// MinFetchSize and MaxFetchSize bound the size fetched per request on cache
+	// misses. The size adapts to the bandwidth-delay product observed on the
+	// connection to the registry. Adaptive fetch size is enabled when MaxFetchSize
+	// is larger than ChunkSize. MinFetchSize defaults to ChunkSize.
+	MinFetchSize int64 `toml:"min_fetch_size"`
+	MaxFetchSize int64 `toml:"max_fetch_size"`
+
+	// ContentStorePath is the root directory of containerd's content store
+	// (e.g. "/var/lib/containerd/io.containerd.content.v1.content"). If a layer
+	// blob already exists in the content store (e.g. pulled previously), its
+	// contents are read from there and the registry is used only as a fallback.
+	// Empty disables it.
+	ContentStorePath string `toml:"content_store_path"`
+
+	// Faults injects faults into requests to registries. This is for debugging.
+	Faults FaultInjectionConfig `toml:"debug_faults"`
 }
 
 type DirectoryCacheConfig struct {
@@ -67,4 +398,94 @@ type DirectoryCacheConfig struct {
 	MaxCacheFds      int  `toml:"max_cache_fds"`
 	SyncAdd          bool `toml:"sync_add"`
 	Direct           bool `toml:"direct"`
+
+	// EncryptionKeyFile is the path to a file containing a hex-encoded AES key
+	// (16, 24 or 32 bytes) of the node. If specified, the contents of directory
+	// caches are encrypted on the disk with AES-GCM using this key. The file can
+	// be provisioned by KMS (e.g. via a CSI secrets driver).
+	EncryptionKeyFile string `toml:"encryption_key_file"`
+
+	// Backend is the storage where directory caches are placed. The default
+	// ("" or "disk") uses the snapshotter's root directory. "tmpfs" stores caches
+	// on a tmpfs mounted by the snapshotter so that image data never reaches
+	// persistent disks. "fscrypt" stores caches in a directory protected by
+	// fscrypt which is unlocked by the snapshotter using FscryptKeyFile.
+	Backend string `toml:"backend"`
+
+	// TmpfsSize is the size limit of the tmpfs (e.g. "4g"). Used with "tmpfs"
+	// backend. Defaults to the kernel's default (half of the memory).
+	TmpfsSize string `toml:"tmpfs_size"`
+
+	// FscryptKeyFile is the path to a file containing a hex-encoded 64 bytes
+	// fscrypt master key. Used with "fscrypt" backend.
+	FscryptKeyFile string `toml:"fscrypt_key_file"`
+
+	// CompactionIntervalSec enables the background compaction of directory
+	// caches with this interval. Compaction packs cold cache entries into
+	// larger packfiles to save inodes. Disabled if zero.
+	CompactionIntervalSec int64 `toml:"compaction_interval_sec"`
+
+	// CompactColdAfterSec is the duration after the last access that a cache
+	// entry is packed by compaction (default: 600).
+	CompactColdAfterSec int64 `toml:"compact_cold_after_sec"`
+
+	// MaxPackSize is the max size of a packfile in bytes (default: 64MiB).
+	MaxPackSize int64 `toml:"max_pack_size"`
+
+	// DisableIOUring disables io_uring for cache files. By default, reads and
+	// writes of cache files which would block on the disk are submitted through
+	// io_uring if it's supported by the kernel (Linux 5.6+).
+	DisableIOUring bool `toml:"disable_io_uring"`
+
+	// EvictionPolicy is the policy of evicting cache entries from the disk.
+	// The policy is applied to all directory caches of the node together.
+	// Empty (default) keeps entries while the layer is cached. Supported
+	// policies are EvictionPolicySize, EvictionPolicyLFU and EvictionPolicyTTL.
+	EvictionPolicy string `toml:"eviction_policy"`
+
+	// EvictionMaxBytes is the max total size of cache entries on the disk in
+	// bytes. Used with "size" policy.
+	EvictionMaxBytes int64 `toml:"eviction_max_bytes"`
+
+	// EvictionMaxEntries is the max number of cache entries on the disk. Used
+	// with "lfu" policy.
+	EvictionMaxEntries int `toml:"eviction_max_entries"`
+
+	// EvictionTTLSec evicts cache entries which haven't been accessed for this
+	// duration. Used with "ttl" policy. Expired entries are evicted when a new
+	// entry is added.
+	EvictionTTLSec int64 `toml:"eviction_ttl_sec"`
+
+	// CacheMaxSizeBytes is the max total size of all directory caches of the
+	// node in bytes. This is a shorthand of EvictionPolicySize with
+	// EvictionMaxBytes so this can't be used with the other policies. Zero
+	// means no limit.
+	CacheMaxSizeBytes int64 `toml:"cache_max_size_bytes"`
+
+	// TrimIntervalSec is deprecated and ignored. Entries exceeding
+	// CacheMaxSizeBytes are evicted when new entries are added.
+	TrimIntervalSec int64 `toml:"trim_interval_sec"`
+
+	// Faults injects faults into caches. This is for debugging.
+	Faults FaultInjectionConfig `toml:"debug_faults"`
+}
+
+// CachefilesCullingConfig is config for caches stored in a directory bound to the
+// kernel's cachefiles module ("cachefiles-culling" for http_cache_type and
+// filesystem_cache_type). The kernel requests culling the caches when the
+// filesystem is running out of space. Contents are still read through FUSE;
+// only the culling is done by the kernel. This requires CAP_SYS_ADMIN.
+type CachefilesCullingConfig struct {
+	// Tag is the tag of the cache in cachefiles (default: "stargz"). This must
+	// be unique among the caches on the host (e.g. cachefilesd uses "CacheFiles").
+	Tag string `toml:"tag"`
+
+	// FallbackToDirectory uses the directory cache if cachefiles is unavailable
+	// (e.g. the kernel doesn't support it). By default, the filesystem fails to
+	// start in that case.
+	FallbackToDirectory bool `toml:"fallback_to_directory"`
 }
+
+// FaultInjectionConfig is config for injecting latency, errors and short reads
+// for testing the error handling.
+type FaultInjectionConfig faultinject.Config
@@ -0,0 +1,367 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package conversion provides the conversion proxy which converts non-eStargz
+// layers into eStargz on the fly and stores them in a cache repository. Nodes
+// encountering the same layer later lazily pull the converted layer from the
+// cache repository instead of pulling the original layer fully.
+//
+// A converted layer is stored as a single-layer image tagged with the digest
+// of the original layer ("<cache repository>:<algorithm>-<encoded digest>").
+// The TOC digest of the converted layer is recorded in the annotation of the
+// layer in that manifest so the cache repository must be trusted.
+package conversion
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sync"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxManifestSize is the max size of the manifest of a converted layer.
+	maxManifestSize = 4 * 1024 * 1024
+
+	// defaultMaxConcurrency is the default max number of layers converted at
+	// once.
+	defaultMaxConcurrency = 2
+)
+
+// Proxy converts non-eStargz layers and looks up converted layers.
+type Proxy struct {
+	root           string
+	repo           string
+	convert        bool
+	maxConcurrency int
+	opts           []estargz.Option
+
+	converting   map[digest.Digest]struct{}
+	convertingMu sync.Mutex
+}
+
+// NewProxy returns a new conversion proxy storing converted layers in the
+// cache repository of the config. Layers being converted are temporarily
+// stored under the root directory. Files left there by the previous run are
+// removed.
+func NewProxy(root string, cfg config.ConversionProxyConfig, opts ...estargz.Option) (*Proxy, error) {
+	if _, err := reference.Parse(cfg.CacheRepository + ":latest"); err != nil {
+		return nil, errors.Wrapf(err, "invalid cache repository %q", cfg.CacheRepository)
+	}
+	if err := os.RemoveAll(root); err != nil {
+		return nil, errors.Wrapf(err, "failed to cleanup %q", root)
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	maxConcurrency := cfg.MaxConcurrency
+	if maxConcurrency <= 0 {
+		maxConcurrency = defaultMaxConcurrency
+	}
+	return &Proxy{
+		root:           root,
+		repo:           cfg.CacheRepository,
+		convert:        cfg.Convert,
+		maxConcurrency: maxConcurrency,
+		opts:           opts,
+		converting:     make(map[digest.Digest]struct{}),
+	}, nil
+}
+
+// cacheRef returns the reference of the converted layer of the original layer.
+func (p *Proxy) cacheRef(dgst digest.Digest) (reference.Spec, error) {
+	return reference.Parse(fmt.Sprintf("%s:%s-%s", p.repo, dgst.Algorithm(), dgst.Encoded()))
+}
+
+// Lookup returns the source of the layer converted from the layer of the
+// passed sources. The cache repository is accessed with the hosts of each
+// source in order. This returns an error if it isn't converted yet.
+func (p *Proxy) Lookup(ctx context.Context, src []source.Source) (source.Source, error) {
+	lErr := fmt.Errorf("no source is available")
+	for _, s := range src {
+		cs, err := p.lookup(ctx, s)
+		if err == nil {
+			return cs, nil
+		}
+		lErr = errors.Wrapf(lErr, "failed to lookup converted layer of %q: %v", s.Name, err)
+	}
+	return source.Source{}, lErr
+}
+
+func (p *Proxy) lookup(ctx context.Context, src source.Source) (source.Source, error) {
+	refspec, err := p.cacheRef(src.Target.Digest)
+	if err != nil {
+		return source.Source{}, err
+	}
+	resolver := newResolver(src.Hosts, refspec)
+	_, desc, err := resolver.Resolve(ctx, refspec.String())
+	if err != nil {
+		return source.Source{}, errors.Wrapf(err, "failed to resolve %q", refspec)
+	}
+	if desc.Size > maxManifestSize {
+		return source.Source{}, fmt.Errorf("manifest of %q is too large", refspec)
+	}
+	fetcher, err := resolver.Fetcher(ctx, refspec.String())
+	if err != nil {
+		return source.Source{}, err
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return source.Source{}, errors.Wrapf(err, "failed to fetch manifest of %q", refspec)
+	}
+	defer rc.Close()
+	var manifest ocispec.Manifest
+	if err := json.NewDecoder(io.LimitReader(rc, maxManifestSize)).Decode(&manifest); err != nil {
+		return source.Source{}, errors.Wrapf(err, "failed to decode manifest of %q", refspec)
+	}
+	if len(manifest.Layers) != 1 {
+		return source.Source{}, fmt.Errorf("manifest of %q must contain one layer; got %d", refspec, len(manifest.Layers))
+	}
+	if _, ok := manifest.Layers[0].Annotations[estargz.TOCJSONDigestAnnotation]; !ok {
+		return source.Source{}, fmt.Errorf("converted layer %q doesn't have TOC digest", refspec)
+	}
+	return source.Source{
+		Hosts:    src.Hosts,
+		Name:     refspec,
+		Target:   manifest.Layers[0],
+		Manifest: manifest,
+	}, nil
+}
+
+// Convert starts converting the layer of the passed sources in background if
+// converting is enabled. The converted layer is pushed to the cache repository.
+// Only one conversion runs at once for a layer and the layer isn't converted
+// if the number of running conversions reaches the limit.
+func (p *Proxy) Convert(ctx context.Context, src []source.Source) {
+	if !p.convert || len(src) == 0 {
+		return
+	}
+	dgst := src[0].Target.Digest
+	p.convertingMu.Lock()
+	if _, ok := p.converting[dgst]; ok {
+		p.convertingMu.Unlock()
+		return
+	}
+	if len(p.converting) >= p.maxConcurrency {
+		p.convertingMu.Unlock()
+		log.G(ctx).WithField("digest", dgst).Debug("too many conversions are running; skip converting layer")
+		return
+	}
+	p.converting[dgst] = struct{}{}
+	p.convertingMu.Unlock()
+
+	// Avoids to get canceled by the client.
+	ctx = log.WithLogger(context.Background(), log.G(ctx).WithField("digest", dgst))
+	go func() {
+		defer func() {
+			p.convertingMu.Lock()
+			delete(p.converting, dgst)
+			p.convertingMu.Unlock()
+		}()
+		log.G(ctx).Info("converting layer to eStargz")
+		if err := p.ConvertLayer(ctx, src); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to convert layer")
+			return
+		}
+		log.G(ctx).Info("pushed converted layer to the cache repository")
+	}()
+}
+
+// ConvertLayer converts the layer of the passed sources into eStargz and
+// pushes it to the cache repository. The layer is fetched from the first
+// available source and the converted layer is pushed with its hosts.
+func (p *Proxy) ConvertLayer(ctx context.Context, src []source.Source) error {
+	if len(src) == 0 {
+		return fmt.Errorf("no source is available")
+	}
+	orig, err := ioutil.TempFile(p.root, "conversion-orig")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(orig.Name())
+	defer orig.Close()
+
+	// Fetch the original layer
+	fErr := fmt.Errorf("failed to fetch layer")
+	var (
+		s source.Source
+		n int64
+	)
+	for _, s = range src {
+		if n, err = fetchLayer(ctx, s, orig); err == nil {
+			break
+		}
+		fErr = errors.Wrapf(fErr, "failed to fetch layer from %q: %v", s.Name, err)
+	}
+	if err != nil {
+		return fErr
+	}
+	cacheRefspec, err := p.cacheRef(s.Target.Digest)
+	if err != nil {
+		return err
+	}
+
+	// Convert the layer
+	blob, err := estargz.Build(io.NewSectionReader(orig, 0, n), p.opts...)
+	if err != nil {
+		return errors.Wrapf(err, "failed to convert layer")
+	}
+	defer blob.Close()
+	converted, err := ioutil.TempFile(p.root, "conversion-esgz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(converted.Name())
+	defer converted.Close()
+	digester := digest.Canonical.Digester()
+	size, err := io.Copy(io.MultiWriter(converted, digester.Hash()), blob)
+	if err != nil {
+		return errors.Wrapf(err, "failed to convert layer")
+	}
+	if err := blob.Close(); err != nil {
+		return err
+	}
+	layerDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digester.Digest(),
+		Size:      size,
+		Annotations: map[string]string{
+			estargz.TOCJSONDigestAnnotation:    blob.TOCDigest().String(),
+			estargz.PrioritizedSizeAnnotation:  fmt.Sprintf("%d", blob.PrioritizedSize()),
+			estargz.PrioritizedFilesAnnotation: fmt.Sprintf("%d", blob.PrioritizedFiles()),
+		},
+	}
+	configData, err := json.Marshal(ocispec.Image{
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: []digest.Digest{blob.DiffID()},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	configDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromBytes(configData),
+		Size:      int64(len(configData)),
+	}
+	manifestData, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    configDesc,
+		Layers:    []ocispec.Descriptor{layerDesc},
+	})
+	if err != nil {
+		return err
+	}
+	manifestDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifestData),
+		Size:      int64(len(manifestData)),
+	}
+
+	// Push the converted layer. The manifest is pushed at last so the layer
+	// is visible only after all contents are pushed.
+	pusher, err := newResolver(s.Hosts, cacheRefspec).Pusher(ctx, cacheRefspec.String())
+	if err != nil {
+		return err
+	}
+	if _, err := converted.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	for _, c := range []struct {
+		desc ocispec.Descriptor
+		r    io.Reader
+	}{
+		{layerDesc, converted},
+		{configDesc, bytes.NewReader(configData)},
+		{manifestDesc, bytes.NewReader(manifestData)},
+	} {
+		if err := push(ctx, pusher, c.desc, c.r); err != nil {
+			return errors.Wrapf(err, "failed to push %v to %q", c.desc.Digest, cacheRefspec)
+		}
+	}
+	return nil
+}
+
+// fetchLayer fetches and verifies the layer of the source into the file. The
+// file is truncated in advance so that it can be reused for other sources.
+func fetchLayer(ctx context.Context, src source.Source, f *os.File) (int64, error) {
+	if err := f.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	fetcher, err := newResolver(src.Hosts, src.Name).Fetcher(ctx, src.Name.String())
+	if err != nil {
+		return 0, err
+	}
+	rc, err := fetcher.Fetch(ctx, src.Target)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	verifier := src.Target.Digest.Verifier()
+	n, err := io.Copy(io.MultiWriter(f, verifier), rc)
+	if err != nil {
+		return 0, err
+	}
+	if n != src.Target.Size || !verifier.Verified() {
+		return 0, fmt.Errorf("fetched layer doesn't match the descriptor")
+	}
+	return n, nil
+}
+
+func push(ctx context.Context, pusher remotes.Pusher, desc ocispec.Descriptor, r io.Reader) error {
+	w, err := pusher.Push(ctx, desc)
+	if err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	}
+	defer w.Close()
+	return content.Copy(ctx, w, r, desc.Size, desc.Digest)
+}
+
+func newResolver(hosts source.RegistryHosts, refspec reference.Spec) remotes.Resolver {
+	return docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(string) ([]docker.RegistryHost, error) {
+			return hosts(refspec)
+		},
+	})
+}
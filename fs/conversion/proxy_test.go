@@ -0,0 +1,153 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package conversion
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestConvertAndLookup(t *testing.T) {
+	ctx := context.Background()
+	reg := testutil.NewRegistry()
+	defer reg.Close()
+
+	// Push a non-eStargz layer
+	tarData, err := ioutil.ReadAll(testutil.BuildTar([]testutil.TarEntry{
+		testutil.Dir("foo/"),
+		testutil.File("foo/bar", "test"),
+	}))
+	if err != nil {
+		t.Fatalf("failed to build tar: %v", err)
+	}
+	var gzData bytes.Buffer
+	zw := gzip.NewWriter(&gzData)
+	if _, err := zw.Write(tarData); err != nil {
+		t.Fatalf("failed to compress layer: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to compress layer: %v", err)
+	}
+	l := testutil.Layer{
+		Data: gzData.Bytes(),
+		Desc: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    digest.FromBytes(gzData.Bytes()),
+			Size:      int64(gzData.Len()),
+		},
+		DiffID: digest.FromBytes(tarData),
+	}
+	img, err := reg.PushImage("orig", "latest", l)
+	if err != nil {
+		t.Fatalf("failed to push image: %v", err)
+	}
+	refspec, err := reference.Parse(img.Ref)
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	src := source.Source{Hosts: reg.Hosts(), Name: refspec, Target: l.Desc, Manifest: img.Manifest}
+
+	root := t.TempDir()
+	p, err := NewProxy(root, config.ConversionProxyConfig{CacheRepository: reg.Host() + "/cache", Convert: true})
+	if err != nil {
+		t.Fatalf("failed to create proxy: %v", err)
+	}
+	if _, err := p.Lookup(ctx, []source.Source{src}); err == nil {
+		t.Fatalf("layer must not be found before conversion")
+	}
+
+	// The layer is fetched from the next source if the first one is
+	// unavailable.
+	unavailable := src
+	unavailable.Name, err = reference.Parse(reg.Host() + "/notexist:latest")
+	if err != nil {
+		t.Fatalf("failed to parse ref: %v", err)
+	}
+	if err := p.ConvertLayer(ctx, []source.Source{unavailable, src}); err != nil {
+		t.Fatalf("failed to convert layer: %v", err)
+	}
+	if files, err := ioutil.ReadDir(root); err != nil || len(files) != 0 {
+		t.Errorf("temporary files must be removed from the root: %v, %v", files, err)
+	}
+	cs, err := p.Lookup(ctx, []source.Source{unavailable, src})
+	if err != nil {
+		t.Fatalf("failed to lookup converted layer: %v", err)
+	}
+	if want := reg.Host() + "/cache:" + l.Desc.Digest.Algorithm().String() + "-" + l.Desc.Digest.Encoded(); cs.Name.String() != want {
+		t.Errorf("converted layer is stored as %q; want %q", cs.Name, want)
+	}
+
+	// The converted layer must be a valid eStargz with the recorded TOC digest.
+	resp, err := http.Get("http://" + reg.Host() + "/v2/cache/blobs/" + cs.Target.Digest.String())
+	if err != nil {
+		t.Fatalf("failed to fetch converted layer: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to fetch converted layer: %v", err)
+	}
+	r, err := estargz.Open(io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))))
+	if err != nil {
+		t.Fatalf("converted layer isn't eStargz: %v", err)
+	}
+	if got, want := r.TOCDigest().String(), cs.Target.Annotations[estargz.TOCJSONDigestAnnotation]; got != want {
+		t.Errorf("TOC digest = %q; want %q", got, want)
+	}
+	if _, ok := r.Lookup("foo/bar"); !ok {
+		t.Errorf("converted layer doesn't contain foo/bar")
+	}
+}
+
+func TestConvertConcurrency(t *testing.T) {
+	root := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(root, "conversion-orig-leftover"), []byte("test"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewProxy(root, config.ConversionProxyConfig{CacheRepository: "registry.example.com/cache", Convert: true, MaxConcurrency: 1})
+	if err != nil {
+		t.Fatalf("failed to create proxy: %v", err)
+	}
+	if files, err := ioutil.ReadDir(root); err != nil || len(files) != 0 {
+		t.Errorf("files left by the previous run must be removed: %v, %v", files, err)
+	}
+
+	// Conversions over the limit are skipped.
+	running := digest.FromString("running")
+	p.converting[running] = struct{}{}
+	p.Convert(context.Background(), []source.Source{{Target: ocispec.Descriptor{Digest: digest.FromString("layer")}}})
+	p.convertingMu.Lock()
+	n := len(p.converting)
+	p.convertingMu.Unlock()
+	if n != 1 {
+		t.Errorf("%d conversions are running; want 1", n)
+	}
+}
@@ -39,20 +39,29 @@ package fs
 import (
 	"context"
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/advisor"
 	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/conversion"
 	"github.com/containerd/stargz-snapshotter/fs/layer"
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	layermetrics "github.com/containerd/stargz-snapshotter/fs/metrics/layer"
+	"github.com/containerd/stargz-snapshotter/fs/policy"
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	"github.com/containerd/stargz-snapshotter/snapshot"
 	"github.com/containerd/stargz-snapshotter/task"
@@ -62,17 +71,26 @@ import (
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
 const (
 	defaultMaxConcurrency = 2
 	fusermountBin         = "fusermount"
+	defaultName           = "stargz"
+
+	// mediaTypeImageLayerZstd is the media type of zstd-compressed OCI layers
+	// (not defined in the image-spec version used by this module).
+	mediaTypeImageLayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
 )
 
 type Option func(*options)
 
 type options struct {
-	getSources source.GetSources
+	getSources    source.GetSources
+	mountPolicy   policy.Policy
+	name          string
+	restoreMounts bool
 }
 
 func WithGetSources(s source.GetSources) Option {
@@ -81,6 +99,34 @@ func WithGetSources(s source.GetSources) Option {
 	}
 }
 
+// WithMountPolicy specifies the policy evaluated before mounting layers. This
+// takes precedence over the webhook specified in the config.
+func WithMountPolicy(p policy.Policy) Option {
+	return func(opts *options) {
+		opts.mountPolicy = p
+	}
+}
+
+// WithName specifies the name of the filesystem reported as its capabilities
+// (default: "stargz"). This must be specified when the snapshotter has several
+// filesystems created by NewFilesystem (e.g. with different sources). Layer
+// metrics of the filesystem are namespaced with the name as well.
+func WithName(name string) Option {
+	return func(opts *options) {
+		opts.name = name
+	}
+}
+
+// WithRestoreMounts makes NewFilesystem mount the layers which were mounted by
+// Mount before the filesystem restarted (e.g. the previous process crashed)
+// again on the same mountpoints. This is for users of the filesystem without
+// the snapshotter; the snapshotter restores remote snapshots by itself.
+func WithRestoreMounts() Option {
+	return func(opts *options) {
+		opts.restoreMounts = true
+	}
+}
+
 func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.FileSystem, err error) {
 	var fsOpts options
 	for _, o := range opts {
@@ -96,15 +142,75 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 			return docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchLocalhost))(refspec.Hostname())
 		})
 	}
+	switch cfg.TimestampMode {
+	case "", config.TimestampModeFixed, config.TimestampModeLayer:
+	default:
+		return nil, fmt.Errorf("unknown timestamp mode %q", cfg.TimestampMode)
+	}
+	switch cfg.AtimeMode {
+	case "", config.AtimeModeNoatime, config.AtimeModeRelatime:
+	default:
+		return nil, fmt.Errorf("unknown atime mode %q", cfg.AtimeMode)
+	}
+	switch cfg.FuseAccess {
+	case "", config.FuseAccessOther, config.FuseAccessRoot, config.FuseAccessOwner:
+	default:
+		return nil, fmt.Errorf("unknown FUSE access %q", cfg.FuseAccess)
+	}
+	if cfg.FuseConfig.MaxReadAhead < 0 {
+		return nil, fmt.Errorf("invalid max read-ahead %d", cfg.FuseConfig.MaxReadAhead)
+	}
+	if bs := cfg.FuseConfig.BlockSize; bs != 0 && (bs < 512 || bs&(bs-1) != 0) {
+		return nil, fmt.Errorf("invalid block size %d; must be a power of two and at least 512", bs)
+	}
+	if cfg.Owner != "" {
+		if _, _, err := parseOwner(cfg.Owner); err != nil {
+			return nil, errors.Wrapf(err, "invalid owner %q", cfg.Owner)
+		}
+	}
+	if cfg.Umask != "" {
+		if _, err := parseUmask(cfg.Umask); err != nil {
+			return nil, errors.Wrapf(err, "invalid umask %q", cfg.Umask)
+		}
+	}
+	fixedTimestamp := time.Unix(0, 0)
+	if cfg.FixedTimestamp != "" {
+		if fixedTimestamp, err = time.Parse(time.RFC3339, cfg.FixedTimestamp); err != nil {
+			return nil, errors.Wrapf(err, "invalid fixed timestamp %q", cfg.FixedTimestamp)
+		}
+	}
+	var convProxy *conversion.Proxy
+	if cfg.ConversionProxyConfig.CacheRepository != "" {
+		if convProxy, err = conversion.NewProxy(filepath.Join(root, "conversion"), cfg.ConversionProxyConfig); err != nil {
+			return nil, errors.Wrapf(err, "failed to setup conversion proxy")
+		}
+	}
+	if cfg.RestrictedOperations && cfg.DirectoryCacheConfig.Backend == config.CacheBackendTmpfs {
+		return nil, fmt.Errorf("cache backend %q is unavailable because restricted_operations is enabled", config.CacheBackendTmpfs)
+	}
+	mountPolicy := fsOpts.mountPolicy
+	if mountPolicy == nil && cfg.MountPolicyConfig.WebhookURL != "" {
+		mountPolicy = policy.NewWebhook(cfg.MountPolicyConfig)
+	}
 	tm := task.NewBackgroundTaskManager(maxConcurrency, 5*time.Second)
+	tm.SetBandwidth(cfg.BackgroundFetchBandwidth)
+	if cfg.PauseBackgroundFetch {
+		tm.Pause()
+	}
 	r, err := layer.NewResolver(root, tm, cfg)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to setup resolver")
 	}
 
+	name, subsystem := fsOpts.name, "fs"
+	if name == "" {
+		name = defaultName
+	} else if name != defaultName {
+		subsystem = name
+	}
 	var ns *metrics.Namespace
 	if !cfg.NoPrometheus {
-		ns = metrics.NewNamespace("stargz", "fs", nil)
+		ns = metrics.NewNamespace("stargz", subsystem, nil)
 		commonmetrics.Register() // Register common metrics. This will happen only once.
 	}
 	c := layermetrics.NewLayerMetrics(ns)
@@ -112,37 +218,215 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 		metrics.Register(ns) // Register layer metrics.
 	}
 
-	return &filesystem{
+	var prefetcher *prefetchCoordinator
+	if cfg.PrefetchCoordination && (!cfg.NoPrefetch || !cfg.NoBackgroundFetch) {
+		prefetcher = newPrefetchCoordinator(r)
+	}
+
+	// Mounts are recorded only if they are restored. Otherwise, records left by
+	// the previous run are removed.
+	var mountStates *mountStateStore
+	if fsOpts.restoreMounts {
+		if mountStates, err = newMountStateStore(filepath.Join(root, "mounts")); err != nil {
+			return nil, errors.Wrapf(err, "failed to setup mount state store")
+		}
+	} else if err := os.RemoveAll(filepath.Join(root, "mounts")); err != nil {
+		return nil, errors.Wrapf(err, "failed to remove mount states")
+	}
+
+	var lazyPullAdvisor *advisor.Advisor
+	if cfg.LazyPullAdvisorConfig.Mode != "" {
+		lazyPullAdvisor, err = advisor.New(filepath.Join(root, "lazypull.json"), cfg.LazyPullAdvisorConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to setup lazy pull advisor")
+		}
+	}
+
+	fs := &filesystem{
+		name:                  name,
 		resolver:              r,
 		getSources:            getSources,
 		prefetchSize:          cfg.PrefetchSize,
 		noprefetch:            cfg.NoPrefetch,
 		noBackgroundFetch:     cfg.NoBackgroundFetch,
 		debug:                 cfg.Debug,
-		layer:                 make(map[string]layer.Layer),
 		backgroundTaskManager: tm,
 		allowNoVerification:   cfg.AllowNoVerification,
 		disableVerification:   cfg.DisableVerification,
 		metricsController:     c,
-	}, nil
+		isolateTenants:        cfg.IsolateTenants,
+		timestampMode:         cfg.TimestampMode,
+		fixedTimestamp:        fixedTimestamp,
+		relatime:              cfg.AtimeMode == config.AtimeModeRelatime,
+		owner:                 cfg.Owner,
+		umask:                 cfg.Umask,
+		pinnedReferences:      cfg.PinnedReferences,
+		upperRoot:             filepath.Join(root, "upper"),
+		features:              features(cfg),
+		conversionProxy:       convProxy,
+		mountPolicy:           mountPolicy,
+		policyFailOpen:        cfg.MountPolicyConfig.FailOpen,
+		advisor:               lazyPullAdvisor,
+		restrictedOperations:  cfg.RestrictedOperations,
+		fuseAccess:            cfg.FuseAccess,
+		fuseConfig:            cfg.FuseConfig,
+		digestRefInterval:     cfg.BlobConfig.DigestRefValidInterval,
+		prefetcher:            prefetcher,
+		mountStates:           mountStates,
+	}
+	if fsOpts.restoreMounts {
+		if err := fs.restoreMounts(context.Background()); err != nil {
+			return nil, errors.Wrapf(err, "failed to restore mounts")
+		}
+	}
+	return fs, nil
 }
 
+// features returns the names of the features of the filesystem enabled by the
+// configuration. These are reported as capabilities so that nodes supporting
+// specific features can be audited.
+func features(cfg config.Config) (f []string) {
+	if !cfg.DisableVerification {
+		f = append(f, "verification")
+	}
+	if !cfg.NoPrefetch {
+		f = append(f, "prefetch")
+	}
+	if !cfg.NoBackgroundFetch {
+		f = append(f, "background-fetch")
+	}
+	if cfg.PrefetchCoordination && (!cfg.NoPrefetch || !cfg.NoBackgroundFetch) {
+		f = append(f, "prefetch-coordination")
+	}
+	if cfg.IsolateTenants {
+		f = append(f, "tenant-isolation")
+	}
+	if cfg.BlobConfig.RaceMirrors {
+		f = append(f, "race-mirrors")
+	}
+	if cfg.BlobConfig.ContentStorePath != "" {
+		f = append(f, "local-content-store")
+	}
+	if cfg.DirectoryCacheConfig.EncryptionKeyFile != "" {
+		f = append(f, "cache-encryption")
+	}
+	if cfg.ConversionProxyConfig.CacheRepository != "" {
+		f = append(f, "conversion-proxy")
+	}
+	if cfg.MountPolicyConfig.WebhookURL != "" {
+		f = append(f, "mount-policy")
+	}
+	if cfg.LazyPullAdvisorConfig.Mode == config.LazyPullAdvisorAuto {
+		f = append(f, "adaptive-lazy-pull")
+	}
+	if cfg.RestrictedOperations {
+		f = append(f, "restricted-operations")
+	} else {
+		f = append(f, "mount-in-namespace")
+	}
+	// always supported
+	return append(f, "artifact", "writable-upper")
+}
+
+// ArtifactMounter mounts OCI artifacts packaged as eStargz. The filesystem
+// returned by NewFilesystem implements this interface.
+type ArtifactMounter interface {
+	MountArtifact(ctx context.Context, mountpoint string, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error
+	Unmount(ctx context.Context, mountpoint string) error
+}
+
+var _ = (ArtifactMounter)((*filesystem)(nil))
+
+var _ = (snapshot.NotifyingFileSystem)((*filesystem)(nil))
+
+var _ = (snapshot.UpdatableFileSystem)((*filesystem)(nil))
+
+var _ = (snapshot.NamespacedFileSystem)((*filesystem)(nil))
+
+var _ = (snapshot.IdentifyingFileSystem)((*filesystem)(nil))
+
+var _ = (snapshot.SourceFileSystem)((*filesystem)(nil))
+
+var _ = (snapshot.CacheStatsFileSystem)((*filesystem)(nil))
+
+var _ = (snapshot.PrefetchWaitingFileSystem)((*filesystem)(nil))
+
 type filesystem struct {
+	name                  string
 	resolver              *layer.Resolver
 	prefetchSize          int64
 	noprefetch            bool
 	noBackgroundFetch     bool
 	debug                 bool
-	layer                 map[string]layer.Layer
-	layerMu               sync.Mutex
+	mounts                mountTable // layer instances are shared by digest
 	backgroundTaskManager *task.BackgroundTaskManager
 	allowNoVerification   bool
 	disableVerification   bool
 	getSources            source.GetSources
 	metricsController     *layermetrics.Controller
+	isolateTenants        bool
+	timestampMode         string
+	fixedTimestamp        time.Time
+	relatime              bool
+	features              []string
+	owner                 string
+	umask                 string
+	pinnedReferences      []string
+	upperRoot             string
+	conversionProxy       *conversion.Proxy
+	mountPolicy           policy.Policy
+	policyFailOpen        bool
+	advisor               *advisor.Advisor
+	restrictedOperations  bool
+	fuseAccess            string
+	fuseConfig            config.FuseConfig
+
+	// digestRefInterval is the interval of checking immutable mounts.
+	digestRefInterval int64
+
+	// prefetcher coordinates prefetch and background fetch across the layers
+	// of each image. nil if layers are fetched independently.
+	prefetcher *prefetchCoordinator
+
+	// mountStates records the layers mounted by Mount so that they can be
+	// restored after restart.
+	mountStates *mountStateStore
+
+	fullyCachedHandler   func(ctx context.Context, mountpoint string)
+	fullyCachedHandlerMu sync.Mutex
 }
 
-func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) (retErr error) {
+// SetFullyCachedHandler registers the function called when the background fetch
+// of the layer mounted on the mountpoint completes.
+func (fs *filesystem) SetFullyCachedHandler(h func(ctx context.Context, mountpoint string)) {
+	fs.fullyCachedHandlerMu.Lock()
+	fs.fullyCachedHandler = h
+	fs.fullyCachedHandlerMu.Unlock()
+}
+
+func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	if err := fs.mountLayer(ctx, mountpoint, labels, nil); err != nil {
+		return err
+	}
+	if err := fs.mountStates.add(ctx, mountpoint, labels); err != nil {
+		log.G(ctx).WithError(err).WithField("mountpoint", mountpoint).Warn("failed to record mount state")
+	}
+	return nil
+}
+
+// MountInNamespace mounts the layer on the mountpoint in the mount namespace
+// specified by mntns (e.g. an opened /proc/<pid>/ns/mnt). This allows mount
+// helpers running in the container's mount namespace to lazily mount layers
+// without long-lived mounts in the snapshotter's namespace. The layer is
+// released when the mount is destroyed along with the namespace.
+func (fs *filesystem) MountInNamespace(ctx context.Context, mountpoint string, labels map[string]string, mntns *os.File) error {
+	if err := fs.checkRestricted("mounting in namespace"); err != nil {
+		return err
+	}
+	return fs.mountLayer(ctx, mountpoint, labels, mntns)
+}
+
+func (fs *filesystem) mountLayer(ctx context.Context, mountpoint string, labels map[string]string, mntns *os.File) error {
 	// Setting the start time to measure the Mount operation duration.
 	start := time.Now()
 
@@ -153,30 +437,187 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	defer fs.backgroundTaskManager.DonePrioritizedTask()
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
 
+	// Partition caches by the tenant of this layer.
+	if fs.isolateTenants {
+		ctx = layer.WithTenant(ctx, fs.tenant(ctx))
+	}
+
 	// Get source information of this layer.
-	src, err := fs.getSources(labels)
+	src, err := fs.getSources(fs.sourceLabels(ctx, labels))
 	if err != nil {
 		return err
-	} else if len(src) == 0 {
+	}
+	for _, s := range src {
+		if s.PrivateCredentials {
+			// Don't share the layer with the tenants without the credentials.
+			ctx = layer.WithPrivateTenant(ctx, fs.tenant(ctx))
+			break
+		}
+	}
+	if len(src) == 0 {
 		return fmt.Errorf("source must be passed")
 	}
 
+	return fs.mount(ctx, mountpoint, src, labels, start, false, mntns)
+}
+
+// tenant returns the tenant of the request, which is the containerd namespace.
+// Clients can't claim the identity of other tenants with labels.
+func (fs *filesystem) tenant(ctx context.Context) string {
+	tenant, _ := namespaces.Namespace(ctx)
+	return tenant
+}
+
+// sourceLabels returns the labels passed to GetSources. config.TargetTenantLabel
+// is set to the tenant of the request so that the sources can partition
+// credentials and connections to registries by tenants. The label specified by
+// the client is never passed.
+func (fs *filesystem) sourceLabels(ctx context.Context, labels map[string]string) map[string]string {
+	l := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		l[k] = v
+	}
+	l[config.TargetTenantLabel] = fs.tenant(ctx)
+	return l
+}
+
+// MountArtifact mounts an OCI artifact (e.g. ML models, WASM bundles) packaged as
+// eStargz to the specified mountpoint as a read-only filesystem. Unlike Mount,
+// this doesn't require snapshot labels so runtimes can lazily mount artifacts
+// without the snapshot plumbing. The TOC digest of the artifact is read from
+// the annotation of the descriptor. The artifact can be unmounted by Unmount.
+func (fs *filesystem) MountArtifact(ctx context.Context, mountpoint string, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
+	start := time.Now()
+	fs.backgroundTaskManager.DoPrioritizedTask()
+	defer fs.backgroundTaskManager.DonePrioritizedTask()
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
+
+	labels := make(map[string]string)
+	for _, k := range []string{
+		estargz.TOCJSONDigestAnnotation,
+		estargz.PrioritizedSizeAnnotation,
+		estargz.PrioritizedFilesAnnotation,
+	} {
+		if v, ok := desc.Annotations[k]; ok {
+			labels[k] = v
+		}
+	}
+	if created, ok := desc.Annotations[ocispec.AnnotationCreated]; ok {
+		labels[config.TargetCreatedLabel] = created
+	}
+	src := []source.Source{{
+		Hosts:    hosts,
+		Name:     refspec,
+		Target:   desc,
+		Manifest: ocispec.Manifest{Layers: []ocispec.Descriptor{desc}},
+	}}
+	return fs.mount(ctx, mountpoint, src, labels, start, true, nil)
+}
+
+func (fs *filesystem) mount(ctx context.Context, mountpoint string, src []source.Source, labels map[string]string, start time.Time, readOnly bool, mntns *os.File) (retErr error) {
+	// key identifies the mount. Mounts in other namespaces can share the path.
+	key := mountpoint
+	if mntns != nil {
+		var st syscall.Stat_t
+		if err := syscall.Fstat(int(mntns.Fd()), &st); err != nil {
+			return errors.Wrap(err, "failed to stat mount namespace")
+		}
+		key = fmt.Sprintf("%s@mnt:[%d]", mountpoint, st.Ino)
+	} else if fs.restrictedOperations {
+		if fi, err := os.Stat(mountpoint); err != nil || !fi.IsDir() {
+			return fmt.Errorf("mountpoint %q must be pre-created in restricted mode", mountpoint)
+		}
+	}
+
+	// Use only sources allowed by the policy.
+	if fs.mountPolicy != nil {
+		var (
+			allowed []source.Source
+			denyErr error
+			denied  = true // all sources are denied by the policy (not by errors)
+		)
+		for _, s := range src {
+			if err := policy.Check(ctx, fs.mountPolicy, policy.InputFromSource(s), fs.policyFailOpen); err != nil {
+				log.G(ctx).WithError(err).Info("source isn't allowed by policy")
+				denyErr = err
+				if errors.Cause(err) != policy.ErrDenied {
+					denied = false
+				}
+				continue
+			}
+			allowed = append(allowed, s)
+		}
+		if len(allowed) == 0 {
+			if denied {
+				return errors.Wrapf(snapshot.ErrLayerUnsupported, "%v", denyErr)
+			}
+			return denyErr
+		}
+		src = allowed
+	}
+
+	// Don't lazily pull images which are pulled faster without lazy pulling.
+	if fs.advisor != nil {
+		var (
+			allowed []source.Source
+			advErr  error
+		)
+		for _, s := range src {
+			if err := fs.advisor.Check(s.Name); err != nil {
+				log.G(ctx).WithError(err).Info("lazy pulling is disabled for the image")
+				advErr = err
+				continue
+			}
+			allowed = append(allowed, s)
+		}
+		if len(allowed) == 0 {
+			return advErr
+		}
+		src = allowed
+	}
+
 	// Resolve the target layer
 	var (
-		resultChan = make(chan layer.Layer)
-		errChan    = make(chan error)
+		resultChan   = make(chan layer.Layer)
+		errChan      = make(chan error)
+		convertedTOC string        // TOC digest of the layer converted by the conversion proxy
+		resolved     source.Source // source of the resolved layer
 	)
 	go func() {
 		rErr := fmt.Errorf("failed to resolve target")
+		var notEStargz []source.Source // sources serving the layer as non-eStargz
 		for _, s := range src {
 			l, err := fs.resolver.Resolve(ctx, s.Hosts, s.Name, s.Target)
 			if err == nil {
+				resolved = s
 				resultChan <- l
 				return
 			}
+			if errors.Cause(err) == layer.ErrNotEStargz {
+				notEStargz = append(notEStargz, s)
+			}
 			rErr = errors.Wrapf(rErr, "failed to resolve layer %q from %q: %v",
 				s.Target.Digest, s.Name, err)
 		}
+		if fs.conversionProxy != nil && len(notEStargz) > 0 {
+			// The layer isn't eStargz. Use the converted one if exists.
+			var l layer.Layer
+			cs, err := fs.conversionProxy.Lookup(ctx, notEStargz)
+			if err == nil {
+				if l, err = fs.resolver.Resolve(ctx, cs.Hosts, cs.Name, cs.Target); err == nil {
+					log.G(ctx).Debugf("using converted layer %q", cs.Name)
+					convertedTOC = cs.Target.Annotations[estargz.TOCJSONDigestAnnotation]
+					resolved = notEStargz[0] // the original layer in the registry
+					resultChan <- l
+					return
+				}
+			}
+			log.G(ctx).WithError(err).Debug("converted layer is unavailable")
+			fs.conversionProxy.Convert(ctx, notEStargz)
+		} else if len(notEStargz) == len(src) {
+			// The layer can't be mounted without the conversion.
+			rErr = errors.Wrapf(snapshot.ErrLayerUnsupported, "%v", rErr)
+		}
 		errChan <- rErr
 	}()
 
@@ -186,7 +627,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		desc := desc
 		go func() {
 			// Avoids to get canceled by client.
-			ctx := log.WithLogger(context.Background(),
+			ctx := log.WithLogger(layer.WithTenantOf(context.Background(), ctx),
 				log.G(ctx).WithField("mountpoint", mountpoint))
 			err := fs.resolver.Cache(ctx, preResolve.Hosts, preResolve.Name, desc)
 			if err != nil {
@@ -211,8 +652,28 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 			l.Done() // don't use this layer.
 		}
 	}()
+	if convertedTOC != "" {
+		// Verify the converted layer with the TOC digest recorded in the
+		// cache repository.
+		converted := make(map[string]string, len(labels))
+		for k, v := range labels {
+			converted[k] = v
+		}
+		converted[estargz.TOCJSONDigestAnnotation] = convertedTOC
+		labels = converted
+	}
+
+	// Make sure that the layer is served with the same contents as when the
+	// snapshot was mounted first.
+	if want, ok := labels[snapshot.IdentityLabel]; ok {
+		if got := l.TOCDigest().String(); got != want {
+			log.G(ctx).Warnf("layer is served with different contents: TOC digest %q; want %q", got, want)
+			return fmt.Errorf("layer is served with different contents: TOC digest %q; want %q", got, want)
+		}
+	}
 
 	// Verify layer's content
+	verified := false
 	if fs.disableVerification {
 		// Skip if verification is disabled completely
 		l.SkipVerify()
@@ -228,6 +689,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 			log.G(ctx).WithError(err).Debugf("invalid layer")
 			return errors.Wrapf(err, "invalid stargz layer")
 		}
+		verified = true
 		log.G(ctx).Debugf("verified")
 	} else if _, ok := labels[config.TargetSkipVerifyLabel]; ok && fs.allowNoVerification {
 		// If unverified layer is allowed, use it with warning.
@@ -239,7 +701,25 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		// Verification must be done. Don't mount this layer.
 		return fmt.Errorf("digest of TOC JSON must be passed")
 	}
-	node, err := l.RootNode()
+	nodeOpts, err := fs.nodeOptions(ctx, labels)
+	if err != nil {
+		log.G(ctx).WithError(err).Warnf("Invalid options of the layer")
+		return err
+	}
+	if mode, ok := labels[config.TargetWritableLabel]; ok {
+		upper, err := fs.prepareUpper(key, mode)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("Failed to prepare writable upper directory")
+			return err
+		}
+		defer func() {
+			if retErr != nil {
+				fs.cleanupUpper(ctx, key)
+			}
+		}()
+		nodeOpts = append(nodeOpts, layer.WithWritableUpper(upper))
+	}
+	node, err := l.RootNode(nodeOpts...)
 	if err != nil {
 		log.G(ctx).WithError(err).Warnf("Failed to get root node")
 		return errors.Wrapf(err, "failed to get root node")
@@ -249,64 +729,176 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	digest := l.Info().Digest // get layer sha
 	defer commonmetrics.MeasureLatency(commonmetrics.Mount, digest, start)
 
+	// Background tasks of the mount (e.g. prefetch) are cancelled when the
+	// layer is unmounted. This context isn't canceled by the client.
+	mountCtx, cancel := context.WithCancel(log.WithLogger(
+		layer.WithTenantOf(context.Background(), ctx), log.G(ctx)))
+	defer func() {
+		if retErr != nil {
+			cancel()
+		}
+	}()
+
 	// Register the mountpoint layer
-	fs.layerMu.Lock()
-	fs.layer[mountpoint] = l
-	fs.layerMu.Unlock()
-	fs.metricsController.Add(mountpoint, l)
+	fs.mounts.update(key, func(m *mountState) {
+		m.layer, m.source, m.cancel = l, resolved, cancel
+		if verified && convertedTOC == "" && fs.digestRefInterval != 0 && digestReferenced(src) {
+			// The contents of the layer are immutable. Checks can be less frequent.
+			m.immutable = &immutableMount{lastCheck: time.Now()}
+		}
+	})
+	fs.metricsController.Add(key, l)
 
-	// Prefetch this layer. We prefetch several layers in parallel. The first
-	// Check() for this layer waits for the prefetch completion.
-	if !fs.noprefetch {
-		prefetchSize := fs.prefetchSize
-		if psStr, ok := labels[config.TargetPrefetchSizeLabel]; ok {
-			if ps, err := strconv.ParseInt(psStr, 10, 64); err == nil {
-				prefetchSize = ps
-			}
+	// Keep the caches of the layer of critical images.
+	if fs.isPinned(src, labels) {
+		l.Pin(true)
+		log.G(ctx).Debug("pinned layer")
+	}
+
+	// Report the size of the data needed at the startup of the container,
+	// recorded by the converter.
+	if sizeStr, ok := labels[estargz.PrioritizedSizeAnnotation]; ok {
+		size, sizeErr := strconv.ParseInt(sizeStr, 10, 64)
+		files, filesErr := strconv.ParseInt(labels[estargz.PrioritizedFilesAnnotation], 10, 64)
+		if sizeErr == nil && filesErr == nil {
+			log.G(ctx).WithField("startup_size", size).WithField("startup_files", files).
+				Info("startup set of the layer")
+			commonmetrics.SetStartupSet(digest, size, files)
 		}
-		go func() {
-			fs.backgroundTaskManager.DoPrioritizedTask()
-			defer fs.backgroundTaskManager.DonePrioritizedTask()
-			if err := l.Prefetch(prefetchSize); err != nil {
-				log.G(ctx).WithError(err).Debug("failed to prefetched layer")
-				return
-			}
-			log.G(ctx).Debug("completed to prefetch")
-		}()
+	}
+
+	// Prefetch this layer. We prefetch several images in parallel. Layers of
+	// an image are prefetched one by one from the upper layers if coordination
+	// is enabled. The first Check() for this layer waits for
+	// the prefetch completion.
+	prefetchSize := fs.prefetchSize
+	if psStr, ok := labels[config.TargetPrefetchSizeLabel]; ok {
+		if ps, err := strconv.ParseInt(psStr, 10, 64); err == nil {
+			prefetchSize = ps
+		}
+	}
+	prefetch := func(opts ...layer.PrefetchOption) {
+		fs.backgroundTaskManager.DoPrioritizedTask()
+		defer fs.backgroundTaskManager.DonePrioritizedTask()
+		if err := l.Prefetch(prefetchSize, append(opts, layer.WithContext(mountCtx))...); mountCtx.Err() != nil {
+			log.G(ctx).Debug("prefetch cancelled by unmount")
+			return
+		} else if err != nil {
+			// The layer is still served on demand. This is reported as
+			// the degradation of the layer.
+			log.G(ctx).WithError(err).Warn("failed to prefetch layer; serving contents on demand")
+			return
+		}
+		log.G(ctx).Debug("completed to prefetch")
 	}
 
 	// Fetch whole layer aggressively in background. We use background
 	// reader for this so prioritized tasks(Mount, Check, etc...) can
 	// interrupt the reading. This can avoid disturbing prioritized tasks
 	// about NW traffic.
-	if !fs.noBackgroundFetch {
-		go func() {
-			if err := l.BackgroundFetch(); err != nil {
-				log.G(ctx).WithError(err).Debug("failed to fetch whole layer")
-				return
+	backgroundFetch := func(opts ...layer.PrefetchOption) {
+		err := l.BackgroundFetch(append(opts, layer.WithContext(mountCtx))...)
+		if mountCtx.Err() != nil {
+			log.G(ctx).Debug("background fetch cancelled by unmount")
+			return
+		}
+		fs.observe(ctx, resolved, l)
+		if errors.Is(err, layer.ErrPartiallyFetched) {
+			// Files hidden by upper layers are skipped so the layer isn't
+			// reported as fully cached.
+			log.G(ctx).Debug("completed to fetch layer data visible in the image in background")
+			return
+		} else if err != nil {
+			log.G(ctx).WithError(err).Debug("failed to fetch whole layer")
+			return
+		}
+		log.G(ctx).Debug("completed to fetch all layer data in background")
+		fs.fullyCachedHandlerMu.Lock()
+		h := fs.fullyCachedHandler
+		fs.fullyCachedHandlerMu.Unlock()
+		if h != nil {
+			h(log.WithLogger(context.Background(), log.G(ctx)), mountpoint)
+		}
+	}
+
+	if idx := layerIndex(resolved.Manifest, resolved.Target); fs.prefetcher != nil && idx >= 0 {
+		// Files hidden by the upper layers of the image are skipped.
+		fs.prefetcher.add(ctx, resolved, idx, func(shadow *layer.Shadow) {
+			if mountCtx.Err() != nil {
+				return // already unmounted
 			}
-			log.G(ctx).Debug("completed to fetch all layer data in background")
-		}()
+			if !fs.noprefetch {
+				prefetch(layer.WithShadow(shadow))
+			}
+			if !fs.noBackgroundFetch {
+				go backgroundFetch(layer.WithShadow(shadow))
+			}
+		})
+	} else {
+		if !fs.noprefetch {
+			go prefetch()
+		}
+		if !fs.noBackgroundFetch {
+			go backgroundFetch()
+		}
 	}
 
 	// mount the node to the specified mountpoint
 	// TODO: bind mount the state directory as a read-only fs on snapshotter's side
-	timeSec := time.Second
+	attrTimeout := fuseTimeout(fs.fuseConfig.AttrTimeout, time.Second)
+	entryTimeout := fuseTimeout(fs.fuseConfig.EntryTimeout, time.Second)
+	negativeTimeout := fuseTimeout(fs.fuseConfig.NegativeTimeout, 0)
 	rawFS := fusefs.NewNodeFS(node, &fusefs.Options{
-		AttrTimeout:     &timeSec,
-		EntryTimeout:    &timeSec,
+		AttrTimeout:     &attrTimeout,
+		EntryTimeout:    &entryTimeout,
+		NegativeTimeout: &negativeTimeout,
 		NullPermissions: true,
 	})
 	mountOpts := &fuse.MountOptions{
-		AllowOther: true,     // allow users other than root&mounter to access fs
-		FsName:     "stargz", // name this filesystem as "stargz"
-		Debug:      fs.debug,
+		AllowOther:   true,     // allow users other than root&mounter to access fs
+		FsName:       "stargz", // name this filesystem as "stargz"
+		Debug:        fs.debug,
+		MaxReadAhead: fs.fuseConfig.MaxReadAhead,
+	}
+	switch fs.fuseAccess {
+	case config.FuseAccessOwner:
+		mountOpts.AllowOther = false
+	case config.FuseAccessRoot:
+		// The kernel forwards requests from all users and the filesystem rejects
+		// ones from users other than root and the mounter.
+		rawFS = &allowRootFS{RawFileSystem: rawFS, owner: uint32(os.Geteuid())}
 	}
 	if _, err := exec.LookPath(fusermountBin); err == nil {
 		mountOpts.Options = []string{"suid"} // option for fusermount; allow setuid inside container
+		if readOnly {
+			mountOpts.Options = []string{"ro"}
+		}
+	} else if fs.restrictedOperations {
+		return errors.Wrapf(err, "%s is required in restricted mode", fusermountBin)
 	} else {
 		log.G(ctx).WithError(err).Debugf("%s not installed; trying direct mount", fusermountBin)
 		mountOpts.DirectMount = true
+		if readOnly {
+			mountOpts.Options = append(mountOpts.Options, "ro")
+		}
+	}
+	if mntns != nil {
+		mountOpts.DirectMount = true
+		server, err := newServerInNamespace(rawFS, mountpoint, mountOpts, mntns)
+		if err != nil {
+			log.G(ctx).WithError(err).Debug("failed to make filesystem server in the namespace")
+			fs.mounts.unregister(key) // the layer is released by the caller
+			fs.metricsController.Remove(key)
+			return err
+		}
+		// The mountpoint isn't visible from here. The layer is released when the
+		// mount is destroyed.
+		go func() {
+			server.Serve()
+			log.G(ctx).Debug("mount in the namespace is destroyed")
+			fs.release(ctx, key)
+		}()
+		return nil
 	}
 	server, err := fuse.NewServer(rawFS, mountpoint, mountOpts)
 	if err != nil {
@@ -318,6 +910,48 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	return server.WaitMount()
 }
 
+// newServerInNamespace mounts FUSE in the mount namespace and returns the server.
+func newServerInNamespace(rawFS fuse.RawFileSystem, mountpoint string, opts *fuse.MountOptions, mntns *os.File) (*fuse.Server, error) {
+	type result struct {
+		server *fuse.Server
+		err    error
+	}
+	resCh := make(chan result)
+	go func() {
+		// The thread enters the namespace so it must not be reused by other
+		// goroutines. Keeping it locked terminates the thread when this
+		// goroutine exits.
+		runtime.LockOSThread()
+		if err := unix.Unshare(unix.CLONE_FS); err != nil {
+			resCh <- result{nil, errors.Wrap(err, "failed to unshare fs attributes")}
+			return
+		}
+		if err := unix.Setns(int(mntns.Fd()), unix.CLONE_NEWNS); err != nil {
+			resCh <- result{nil, errors.Wrap(err, "failed to enter mount namespace")}
+			return
+		}
+		server, err := fuse.NewServer(rawFS, mountpoint, opts)
+		resCh <- result{server, err}
+	}()
+	res := <-resCh
+	return res.server, res.err
+}
+
+// release releases the layer registered with the key.
+func (fs *filesystem) release(ctx context.Context, key string) {
+	m, ok := fs.mounts.get(key)
+	l := fs.mounts.unregister(key)
+	if l == nil {
+		return
+	}
+	if ok {
+		fs.observe(ctx, m.source, l)
+	}
+	l.Done()
+	fs.metricsController.Remove(key)
+	fs.cleanupUpper(ctx, key)
+}
+
 func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
 	// This is a prioritized task and all background tasks will be stopped
 	// execution so this can avoid being disturbed for NW traffic by background
@@ -327,18 +961,20 @@ func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[s
 
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
 
-	fs.layerMu.Lock()
-	l := fs.layer[mountpoint]
-	fs.layerMu.Unlock()
+	l := fs.mounts.layer(mountpoint)
 	if l == nil {
 		log.G(ctx).Debug("layer not registered")
 		return fmt.Errorf("layer not registered")
 	}
 
 	// Check the blob connectivity and try to refresh the connection on failure
-	if err := fs.check(ctx, l, labels); err != nil {
+	if fs.skipCheck(mountpoint) {
+		log.G(ctx).Debug("check skipped for the layer referenced by digest")
+	} else if err := fs.check(ctx, l, labels); err != nil {
 		log.G(ctx).WithError(err).Warn("check failed")
 		return err
+	} else {
+		fs.checked(mountpoint)
 	}
 
 	// Wait for prefetch compeletion
@@ -351,6 +987,66 @@ func (fs *filesystem) Check(ctx context.Context, mountpoint string, labels map[s
 	return nil
 }
 
+// observe records the statistics of the layer for the lazy pull advisor.
+func (fs *filesystem) observe(ctx context.Context, src source.Source, l layer.Layer) {
+	if fs.advisor == nil || src.Name.Locator == "" {
+		return
+	}
+	info := l.Info()
+	fs.advisor.Observe(ctx, src.Name, info.Digest, advisor.Sample{
+		Size:                  info.Size,
+		OnDemandFetchDuration: info.OnDemandFetchDuration,
+		FetchedSize:           info.FetchedSize,
+		FetchDuration:         info.FetchDuration,
+		CachedSize:            info.ReadCachedSize,
+		MissedSize:            info.ReadRequestedSize,
+	})
+}
+
+// immutableMount is a mount of a layer resolved by immutable digest references
+// and verified with the TOC digest. The availability of such a layer is
+// checked following BlobConfig.DigestRefValidInterval.
+type immutableMount struct {
+	lastCheck time.Time
+}
+
+// digestReferenced reports whether all sources reference the image by digest.
+func digestReferenced(src []source.Source) bool {
+	for _, s := range src {
+		if s.Name.Digest() == "" {
+			return false
+		}
+	}
+	return len(src) > 0
+}
+
+// skipCheck reports whether the check of the layer mounted on the mountpoint
+// can be skipped.
+func (fs *filesystem) skipCheck(mountpoint string) bool {
+	var lastCheck time.Time
+	fs.mounts.update(mountpoint, func(m *mountState) {
+		if m.immutable != nil {
+			lastCheck = m.immutable.lastCheck
+		}
+	})
+	if lastCheck.IsZero() {
+		return false
+	}
+	if fs.digestRefInterval < 0 {
+		return true
+	}
+	return time.Since(lastCheck) < time.Duration(fs.digestRefInterval)*time.Second
+}
+
+// checked records the successful check of the layer mounted on the mountpoint.
+func (fs *filesystem) checked(mountpoint string) {
+	fs.mounts.update(mountpoint, func(m *mountState) {
+		if m.immutable != nil {
+			m.immutable.lastCheck = time.Now()
+		}
+	})
+}
+
 func (fs *filesystem) check(ctx context.Context, l layer.Layer, labels map[string]string) error {
 	err := l.Check()
 	if err == nil {
@@ -359,7 +1055,23 @@ func (fs *filesystem) check(ctx context.Context, l layer.Layer, labels map[strin
 	log.G(ctx).WithError(err).Warn("failed to connect to blob")
 
 	// Check failed. Try to refresh the connection with fresh source information
-	src, err := fs.getSources(labels)
+	return fs.refresh(ctx, l, labels)
+}
+
+// Refresh re-resolves the layer mounted on the mountpoint with fresh source
+// information in the labels (i.e. re-establishes the connection to the
+// registry) even if the current connection is alive.
+func (fs *filesystem) Refresh(ctx context.Context, mountpoint string, labels map[string]string) error {
+	l := fs.mounts.layer(mountpoint)
+	if l == nil {
+		return fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
+	}
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
+	return fs.refresh(ctx, l, labels)
+}
+
+func (fs *filesystem) refresh(ctx context.Context, l layer.Layer, labels map[string]string) error {
+	src, err := fs.getSources(fs.sourceLabels(ctx, labels))
 	if err != nil {
 		return err
 	}
@@ -386,22 +1098,333 @@ func (fs *filesystem) check(ctx context.Context, l layer.Layer, labels map[strin
 }
 
 func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
-	fs.layerMu.Lock()
-	l, ok := fs.layer[mountpoint]
-	if !ok {
-		fs.layerMu.Unlock()
+	// The record is removed even if the layer isn't mounted (e.g. it failed to
+	// be restored) so that it's never restored after the unmount.
+	if err := fs.mountStates.remove(mountpoint); err != nil {
+		log.G(ctx).WithError(err).WithField("mountpoint", mountpoint).Warn("failed to remove mount state")
+	}
+	l := fs.mounts.unregister(mountpoint)
+	if l == nil {
 		return fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
 	}
-	delete(fs.layer, mountpoint) // unregisters the corresponding layer
 	l.Done()
-	fs.layerMu.Unlock()
 	fs.metricsController.Remove(mountpoint)
 	// The goroutine which serving the mountpoint possibly becomes not responding.
 	// In case of such situations, we use MNT_FORCE here and abort the connection.
 	// In the future, we might be able to consider to kill that specific hanging
 	// goroutine using channel, etc.
 	// See also: https://www.kernel.org/doc/html/latest/filesystems/fuse.html#aborting-a-filesystem-connection
-	return syscall.Unmount(mountpoint, syscall.MNT_FORCE)
+	if err := syscall.Unmount(mountpoint, syscall.MNT_FORCE); err != nil {
+		return err
+	}
+	fs.cleanupUpper(ctx, mountpoint)
+	return nil
+}
+
+// prepareUpper creates the directory where modifications to the layer mounted
+// on the mountpoint are stored.
+func (fs *filesystem) prepareUpper(mountpoint string, mode string) (string, error) {
+	dir := filepath.Join(fs.upperRoot, digest.FromString(mountpoint).Encoded())
+	if err := os.RemoveAll(dir); err != nil { // discard leftovers of the previous run
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	switch mode {
+	case config.WritableModeMemory:
+		if err := fs.checkRestricted("writable mode " + mode); err != nil {
+			os.Remove(dir)
+			return "", err
+		}
+		if err := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=0755"); err != nil {
+			os.Remove(dir)
+			return "", errors.Wrapf(err, "failed to mount tmpfs on %q", dir)
+		}
+	case config.WritableModeDir:
+		if err := os.Chmod(dir, 0755); err != nil {
+			return "", err
+		}
+	default:
+		os.Remove(dir)
+		return "", fmt.Errorf("unknown writable mode %q", mode)
+	}
+	fs.mounts.update(mountpoint, func(m *mountState) { m.upper = dir })
+	return dir, nil
+}
+
+// cleanupUpper discards modifications to the layer mounted on the mountpoint.
+func (fs *filesystem) cleanupUpper(ctx context.Context, mountpoint string) {
+	var dir string
+	fs.mounts.update(mountpoint, func(m *mountState) { dir, m.upper = m.upper, "" })
+	if dir == "" {
+		return
+	}
+	if err := syscall.Unmount(dir, 0); err != nil && err != syscall.EINVAL {
+		log.G(ctx).WithError(err).Warnf("failed to unmount writable upper directory %q", dir)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.G(ctx).WithError(err).Warnf("failed to remove writable upper directory %q", dir)
+	}
+}
+
+// UpdateLabels pins or unpins the layer mounted on the mountpoint following the
+// updated labels.
+func (fs *filesystem) UpdateLabels(ctx context.Context, mountpoint string, labels map[string]string) error {
+	l := fs.mounts.layer(mountpoint)
+	if l == nil {
+		return fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
+	}
+	src, err := fs.getSources(fs.sourceLabels(ctx, labels))
+	if err != nil {
+		log.G(ctx).WithError(err).Debug("failed to get sources of the layer")
+	}
+	l.Pin(fs.isPinned(src, labels))
+	return nil
+}
+
+// isPinned returns true if the layer is pinned by the label or by the references
+// in the config. Layers used by image volumes are also pinned because the
+// workloads can read them at any time.
+func (fs *filesystem) isPinned(src []source.Source, labels map[string]string) bool {
+	if labels[config.TargetPinnedLabel] == "true" || labels[snapshot.ImageVolumeLabel] == "true" {
+		return true
+	}
+	for _, ref := range fs.pinnedReferences {
+		for _, s := range src {
+			if ref == s.Name.String() || ref == s.Name.Locator {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (fs *filesystem) Stats(ctx context.Context, mountpoint string) (snapshot.Stats, error) {
+	l := fs.mounts.layer(mountpoint)
+	if l == nil {
+		return snapshot.Stats{}, fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
+	}
+	info := l.Info()
+	return snapshot.Stats{
+		Size:        info.Size,
+		FetchedSize: info.FetchedSize,
+		Degraded:    info.Degraded,
+	}, nil
+}
+
+// CacheStats returns the statistics of the in-memory caches of the layers.
+func (fs *filesystem) CacheStats(ctx context.Context) snapshot.CacheStats {
+	st := fs.resolver.CacheStats()
+	return snapshot.CacheStats{
+		Layers:      st.Layers,
+		Blobs:       st.Blobs,
+		LayersInUse: st.LayersInUse,
+	}
+}
+
+// EvictCaches evicts the resolved layers and blobs which aren't used by mounts
+// from the caches of the filesystem. The returned stats reports the numbers of
+// evicted layers and blobs.
+func (fs *filesystem) EvictCaches(ctx context.Context) snapshot.CacheStats {
+	st := fs.resolver.EvictCaches()
+	log.G(ctx).Infof("evicted %d layers and %d blobs from caches", st.Layers, st.Blobs)
+	return snapshot.CacheStats{
+		Layers: st.Layers,
+		Blobs:  st.Blobs,
+	}
+}
+
+// SetBackgroundFetch pauses or resumes background fetch of all layers and
+// limits its bandwidth in bytes per second (zero means no limit).
+func (fs *filesystem) SetBackgroundFetch(ctx context.Context, cfg snapshot.BackgroundFetchConfig) {
+	tm := fs.backgroundTaskManager
+	tm.SetBandwidth(cfg.Bandwidth)
+	if cfg.Paused {
+		tm.Pause()
+	} else {
+		tm.Resume()
+	}
+	log.G(ctx).Infof("background fetch: paused=%v, bandwidth=%d bytes/sec", cfg.Paused, cfg.Bandwidth)
+}
+
+// BackgroundFetch returns the current state of background fetch.
+func (fs *filesystem) BackgroundFetch(ctx context.Context) snapshot.BackgroundFetchConfig {
+	return snapshot.BackgroundFetchConfig{
+		Paused:    fs.backgroundTaskManager.Paused(),
+		Bandwidth: fs.backgroundTaskManager.Bandwidth(),
+	}
+}
+
+// InvalidateTransports makes the mounted layers re-resolve their transports to
+// registries (e.g. with rotated credentials) on their next fetch. Mounts are
+// kept.
+func (fs *filesystem) InvalidateTransports() {
+	fs.resolver.InvalidateTransports()
+}
+
+// WaitForPrefetch waits until the prefetch of the layer mounted on the
+// mountpoint completes or ctx is done.
+func (fs *filesystem) WaitForPrefetch(ctx context.Context, mountpoint string) error {
+	l := fs.mounts.layer(mountpoint)
+	if l == nil {
+		return fmt.Errorf("layer not registered")
+	}
+	if fs.noprefetch {
+		return nil
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- l.WaitForPrefetchCompletion()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Identity returns the digest of the TOC JSON of the layer mounted on the
+// mountpoint.
+func (fs *filesystem) Identity(ctx context.Context, mountpoint string) (string, error) {
+	l := fs.mounts.layer(mountpoint)
+	if l == nil {
+		return "", fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
+	}
+	return l.TOCDigest().String(), nil
+}
+
+func (fs *filesystem) Source(ctx context.Context, mountpoint string) (snapshot.Source, error) {
+	m, ok := fs.mounts.get(mountpoint)
+	if !ok {
+		return snapshot.Source{}, fmt.Errorf("specified path %q isn't a mountpoint", mountpoint)
+	}
+	return snapshot.Source{Ref: m.source.Name.String(), Digest: m.source.Target.Digest.String()}, nil
+}
+
+func (fs *filesystem) Capabilities(ctx context.Context) snapshot.Capabilities {
+	// eStargz and legacy stargz are gzip-compressed layers.
+	mediaTypes := []string{
+		ocispec.MediaTypeImageLayerGzip,
+		images.MediaTypeDockerSchema2LayerGzip,
+	}
+	// zstd (including zstd:chunked) layers can't be lazily pulled.
+	compressions := []string{"gzip"}
+	if fs.conversionProxy != nil {
+		// Other layers are lazily pulled after converted by the conversion
+		// proxy so they must reach Mount.
+		mediaTypes = append(mediaTypes,
+			ocispec.MediaTypeImageLayer,
+			mediaTypeImageLayerZstd,
+			images.MediaTypeDockerSchema2Layer,
+		)
+		compressions = append(compressions, "zstd", "uncompressed")
+	}
+	return snapshot.Capabilities{
+		Name:         fs.name,
+		MediaTypes:   mediaTypes,
+		Verification: !fs.disableVerification,
+		Offline:      false,
+		Features:     fs.features,
+		Compressions: compressions,
+	}
+}
+
+func (fs *filesystem) Health(ctx context.Context) error {
+	return nil
+}
+
+// nodeOptions returns options for the root node of the layer.
+func (fs *filesystem) nodeOptions(ctx context.Context, labels map[string]string) (opts []layer.NodeOption, _ error) {
+	switch fs.timestampMode {
+	case config.TimestampModeFixed:
+		opts = append(opts, layer.WithTimestamp(fs.fixedTimestamp))
+	case config.TimestampModeLayer:
+		timestamp := fs.fixedTimestamp
+		if createdStr, ok := labels[config.TargetCreatedLabel]; ok {
+			if created, err := time.Parse(time.RFC3339, createdStr); err == nil {
+				timestamp = created
+			} else {
+				log.G(ctx).WithError(err).Warnf("invalid creation time %q of the layer", createdStr)
+			}
+		}
+		opts = append(opts, layer.WithTimestamp(timestamp))
+	}
+	if fs.relatime {
+		opts = append(opts, layer.WithRelatime())
+	}
+	opts = append(opts, layer.WithFeatures(fs.features))
+	if fs.fuseConfig.DirectIO {
+		opts = append(opts, layer.WithDirectIO())
+	}
+	if fs.fuseConfig.BlockSize != 0 {
+		opts = append(opts, layer.WithBlockSize(fs.fuseConfig.BlockSize))
+	}
+	owner := fs.owner
+	if o, ok := labels[config.TargetOwnerLabel]; ok {
+		owner = o
+	}
+	if owner != "" {
+		uid, gid, err := parseOwner(owner)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid owner %q", owner)
+		}
+		opts = append(opts, layer.WithOwner(uid, gid))
+	}
+	umask := fs.umask
+	if u, ok := labels[config.TargetUmaskLabel]; ok {
+		umask = u
+	}
+	if umask != "" {
+		m, err := parseUmask(umask)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid umask %q", umask)
+		}
+		opts = append(opts, layer.WithUmask(m))
+	}
+	return opts, nil
+}
+
+// parseOwner parses the owner formatted as "uid:gid".
+func parseOwner(s string) (uid, gid uint32, _ error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("owner must be formatted as \"uid:gid\"")
+	}
+	u, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	g, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint32(u), uint32(g), nil
+}
+
+// fuseTimeout returns the FUSE cache timeout configured in seconds. Zero means
+// the default and negative disables the cache.
+func fuseTimeout(sec int64, def time.Duration) time.Duration {
+	switch {
+	case sec == 0:
+		return def
+	case sec < 0:
+		return 0
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// parseUmask parses the umask in octal.
+func parseUmask(s string) (uint32, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if m&^0777 != 0 {
+		return 0, fmt.Errorf("umask must be in the range of 0000-0777")
+	}
+	return uint32(m), nil
 }
 
 // neighboringLayers returns layer descriptors except the `target` layer in the specified manifest.
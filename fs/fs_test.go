@@ -25,16 +25,27 @@ package fs
 import (
 	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/pkg/testutil"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/conversion"
 	"github.com/containerd/stargz-snapshotter/fs/layer"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/snapshot"
 	"github.com/containerd/stargz-snapshotter/task"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -42,14 +53,12 @@ import (
 func TestCheck(t *testing.T) {
 	bl := &breakableLayer{}
 	fs := &filesystem{
-		layer: map[string]layer.Layer{
-			"test": bl,
-		},
 		backgroundTaskManager: task.NewBackgroundTaskManager(1, time.Millisecond),
 		getSources: source.FromDefaultLabels(func(refspec reference.Spec) (hosts []docker.RegistryHost, _ error) {
 			return docker.ConfigureDefaultRegistries(docker.WithPlainHTTP(docker.MatchLocalhost))(refspec.Hostname())
 		}),
 	}
+	fs.mounts.update("test", func(m *mountState) { m.layer = bl })
 	bl.success = true
 	if err := fs.Check(context.TODO(), "test", nil); err != nil {
 		t.Errorf("connection failed; wanted to succeed: %v", err)
@@ -61,18 +70,240 @@ func TestCheck(t *testing.T) {
 	}
 }
 
+func TestCheckDigestReferenced(t *testing.T) {
+	bl := &breakableLayer{}
+	fs := &filesystem{
+		backgroundTaskManager: task.NewBackgroundTaskManager(1, time.Millisecond),
+		getSources: func(map[string]string) ([]source.Source, error) {
+			return nil, fmt.Errorf("no source")
+		},
+	}
+	fs.mounts.update("test", func(m *mountState) {
+		m.layer, m.immutable = bl, &immutableMount{lastCheck: time.Now()}
+	})
+
+	// Never checked
+	fs.digestRefInterval = -1
+	if err := fs.Check(context.TODO(), "test", nil); err != nil {
+		t.Errorf("check must be skipped: %v", err)
+	}
+
+	// Checked after the interval
+	fs.digestRefInterval = 3600
+	if err := fs.Check(context.TODO(), "test", nil); err != nil {
+		t.Errorf("check must be skipped within the interval: %v", err)
+	}
+	fs.mounts.update("test", func(m *mountState) {
+		m.immutable.lastCheck = time.Now().Add(-2 * time.Hour)
+	})
+	if err := fs.Check(context.TODO(), "test", nil); err == nil {
+		t.Errorf("check must be done after the interval")
+	}
+	bl.success = true
+	if err := fs.Check(context.TODO(), "test", nil); err != nil {
+		t.Errorf("connection failed; wanted to succeed: %v", err)
+	}
+	bl.success = false
+	if err := fs.Check(context.TODO(), "test", nil); err != nil {
+		t.Errorf("check must be skipped after the successful check: %v", err)
+	}
+
+	byTag, _ := reference.Parse("example.com/foo:v1")
+	byDigest, _ := reference.Parse("example.com/foo@sha256:0000000000000000000000000000000000000000000000000000000000000000")
+	if digestReferenced([]source.Source{{Name: byDigest}, {Name: byTag}}) {
+		t.Errorf("sources must not be digest referenced if any is referenced by tag")
+	}
+	if !digestReferenced([]source.Source{{Name: byDigest}}) {
+		t.Errorf("sources must be digest referenced")
+	}
+}
+
+func TestUpdateLabelsPin(t *testing.T) {
+	bl := &breakableLayer{}
+	fs := &filesystem{
+		getSources: func(labels map[string]string) ([]source.Source, error) {
+			refspec, err := reference.Parse(labels["ref"])
+			if err != nil {
+				return nil, err
+			}
+			return []source.Source{{Name: refspec}}, nil
+		},
+		pinnedReferences: []string{"example.com/pinned", "example.com/tagged:v1"},
+	}
+	fs.mounts.update("test", func(m *mountState) { m.layer = bl })
+	tests := []struct {
+		labels map[string]string
+		want   bool
+	}{
+		{map[string]string{"ref": "example.com/other:v1"}, false},
+		{map[string]string{"ref": "example.com/other:v1", config.TargetPinnedLabel: "true"}, true},
+		{map[string]string{"ref": "example.com/pinned:v2"}, true},
+		{map[string]string{"ref": "example.com/tagged:v1"}, true},
+		{map[string]string{"ref": "example.com/tagged:v2"}, false},
+	}
+	for _, tt := range tests {
+		if err := fs.UpdateLabels(context.TODO(), "test", tt.labels); err != nil {
+			t.Fatalf("failed to update labels: %v", err)
+		}
+		if bl.pinned != tt.want {
+			t.Errorf("pinned = %v; want %v (labels: %v)", bl.pinned, tt.want, tt.labels)
+		}
+	}
+	if err := fs.UpdateLabels(context.TODO(), "unknown", nil); err == nil {
+		t.Errorf("updating labels of unknown mountpoint must fail")
+	}
+}
+
+func TestSourceLabelsTenant(t *testing.T) {
+	ctx := namespaces.WithNamespace(context.TODO(), "tenant-a")
+	labels := map[string]string{"ref": "example.com/foo:v1", config.TargetTenantLabel: "tenant-b"}
+	for _, isolate := range []bool{true, false} {
+		fs := &filesystem{isolateTenants: isolate}
+		got := fs.sourceLabels(ctx, labels)
+		if tenant := got[config.TargetTenantLabel]; tenant != "tenant-a" {
+			t.Errorf("tenant must be the namespace %q but got %q", "tenant-a", tenant)
+		}
+		if got["ref"] != "example.com/foo:v1" {
+			t.Errorf("other labels must be kept: %v", got)
+		}
+	}
+	if labels[config.TargetTenantLabel] != "tenant-b" {
+		t.Errorf("labels of the caller must not be modified")
+	}
+}
+
+func TestRestrictedOperations(t *testing.T) {
+	syscalls := func(ops []Operation) map[string]bool {
+		m := make(map[string]bool)
+		for _, op := range ops {
+			for _, s := range op.Syscalls {
+				m[s] = true
+			}
+		}
+		return m
+	}
+	if s := syscalls(Operations(config.Config{})); !s["unshare"] || !s["setns"] {
+		t.Errorf("unshare and setns must be listed by default: %v", s)
+	}
+	if s := syscalls(Operations(config.Config{RestrictedOperations: true})); s["unshare"] || s["setns"] || s["mount"] {
+		t.Errorf("unshare, setns and mount must not be listed in restricted mode: %v", s)
+	}
+
+	fs := &filesystem{restrictedOperations: true, upperRoot: t.TempDir()}
+	if err := fs.MountInNamespace(context.TODO(), t.TempDir(), nil, nil); err == nil {
+		t.Errorf("mounting in namespace must fail in restricted mode")
+	}
+	if _, err := fs.prepareUpper("test", config.WritableModeMemory); err == nil {
+		t.Errorf("preparing tmpfs upper must fail in restricted mode")
+	}
+}
+
+func TestAllowRootFS(t *testing.T) {
+	const owner = 1000
+	rawFS := &allowRootFS{RawFileSystem: fuse.NewDefaultRawFileSystem(), owner: owner}
+	header := func(uid uint32) *fuse.InHeader {
+		var h fuse.InHeader
+		h.Uid = uid
+		return &h
+	}
+	for _, tt := range []struct {
+		uid     uint32
+		allowed bool
+	}{
+		{uid: 0, allowed: true},
+		{uid: owner, allowed: true},
+		{uid: 2000, allowed: false},
+	} {
+		// The default filesystem returns ENOSYS for allowed requests.
+		if st := rawFS.Lookup(nil, header(tt.uid), "foo", &fuse.EntryOut{}); (st != fuse.EACCES) != tt.allowed {
+			t.Errorf("lookup by %d: status %v; allowed=%v", tt.uid, st, tt.allowed)
+		}
+		if st := rawFS.Open(nil, &fuse.OpenIn{InHeader: *header(tt.uid)}, &fuse.OpenOut{}); (st != fuse.EACCES) != tt.allowed {
+			t.Errorf("open by %d: status %v; allowed=%v", tt.uid, st, tt.allowed)
+		}
+		// Requests on opened handles aren't checked.
+		if _, st := rawFS.Read(nil, &fuse.ReadIn{InHeader: *header(tt.uid)}, nil); st == fuse.EACCES {
+			t.Errorf("read by %d must not be checked", tt.uid)
+		}
+	}
+
+	if _, err := NewFilesystem(t.TempDir(), config.Config{FuseAccess: "unknown"}); err == nil {
+		t.Errorf("unknown FUSE access must be rejected")
+	}
+}
+
+func TestFuseTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		sec  int64
+		want time.Duration
+	}{
+		{sec: 0, want: time.Second},
+		{sec: -1, want: 0},
+		{sec: 30, want: 30 * time.Second},
+	} {
+		if got := fuseTimeout(tt.sec, time.Second); got != tt.want {
+			t.Errorf("fuseTimeout(%d) = %v; want %v", tt.sec, got, tt.want)
+		}
+	}
+}
+
+func TestMountTable(t *testing.T) {
+	var mt mountTable
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(mp string) {
+			defer wg.Done()
+			mt.update(mp, func(m *mountState) { m.upper = "upper-" + mp })
+			mt.update(mp, func(m *mountState) { m.layer = &breakableLayer{} })
+		}(fmt.Sprintf("mp-%d", i))
+	}
+	wg.Wait()
+	for i := 0; i < 100; i++ {
+		mp := fmt.Sprintf("mp-%d", i)
+		m, ok := mt.get(mp)
+		if !ok || m.upper != "upper-"+mp {
+			t.Fatalf("state of %q isn't registered: %+v", mp, m)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		mt.update(mp, func(m *mountState) { m.cancel = cancel })
+		if l := mt.unregister(mp); l == nil {
+			t.Fatalf("layer of %q isn't registered", mp)
+		}
+		if ctx.Err() == nil {
+			t.Errorf("background tasks of %q must be cancelled", mp)
+		}
+		if mt.layer(mp) != nil {
+			t.Errorf("layer of %q must be unregistered", mp)
+		}
+
+		// The upper directory is kept until it's cleaned up.
+		var upper string
+		mt.update(mp, func(m *mountState) { upper, m.upper = m.upper, "" })
+		if upper != "upper-"+mp {
+			t.Errorf("upper of %q = %q; want %q", mp, upper, "upper-"+mp)
+		}
+		if s := mt.shard(mp); s.states[mp] != nil {
+			t.Errorf("empty state of %q must be removed", mp)
+		}
+	}
+}
+
 type breakableLayer struct {
 	success bool
+	pinned  bool
 }
 
-func (l *breakableLayer) Info() layer.Info                                    { return layer.Info{} }
-func (l *breakableLayer) RootNode() (fusefs.InodeEmbedder, error)             { return nil, nil }
-func (l *breakableLayer) Verify(tocDigest digest.Digest) error                { return nil }
-func (l *breakableLayer) SkipVerify()                                         {}
-func (l *breakableLayer) Prefetch(prefetchSize int64) error                   { return fmt.Errorf("fail") }
-func (l *breakableLayer) ReadAt([]byte, int64, ...remote.Option) (int, error) { return 0, nil }
-func (l *breakableLayer) WaitForPrefetchCompletion() error                    { return fmt.Errorf("fail") }
-func (l *breakableLayer) BackgroundFetch() error                              { return fmt.Errorf("fail") }
+func (l *breakableLayer) Info() layer.Info                                           { return layer.Info{} }
+func (l *breakableLayer) RootNode(...layer.NodeOption) (fusefs.InodeEmbedder, error) { return nil, nil }
+func (l *breakableLayer) Verify(tocDigest digest.Digest) error                       { return nil }
+func (l *breakableLayer) SkipVerify()                                                {}
+func (l *breakableLayer) TOCDigest() digest.Digest                                   { return "" }
+func (l *breakableLayer) Prefetch(int64, ...layer.PrefetchOption) error              { return fmt.Errorf("fail") }
+func (l *breakableLayer) Shadow() (*layer.Shadow, error)                             { return layer.NewShadow(), nil }
+func (l *breakableLayer) ReadAt([]byte, int64, ...remote.Option) (int, error)        { return 0, nil }
+func (l *breakableLayer) WaitForPrefetchCompletion() error                           { return fmt.Errorf("fail") }
+func (l *breakableLayer) BackgroundFetch(...layer.PrefetchOption) error              { return fmt.Errorf("fail") }
 func (l *breakableLayer) Check() error {
 	if !l.success {
 		return fmt.Errorf("failed")
@@ -85,4 +316,183 @@ func (l *breakableLayer) Refresh(ctx context.Context, hosts source.RegistryHosts
 	}
 	return nil
 }
-func (l *breakableLayer) Done() {}
+func (l *breakableLayer) Pin(pinned bool) { l.pinned = pinned }
+func (l *breakableLayer) Done()           {}
+
+func TestMountStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mountstatetest")
+	if err != nil {
+		t.Fatalf("failed to prepare directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newMountStateStore(filepath.Join(dir, "mounts"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "testns")
+	for _, mp := range []string{"/mnt/b", "/mnt/a", "/mnt/c"} {
+		if err := s.add(ctx, mp, map[string]string{"mp": mp}); err != nil {
+			t.Fatalf("failed to add %q: %v", mp, err)
+		}
+	}
+	// Overwriting keeps a single record per mountpoint. Credentials aren't recorded.
+	if err := s.add(ctx, "/mnt/a", map[string]string{"mp": "/mnt/a", "updated": "true",
+		config.TargetAuthLabel: `{"username":"user","password":"pass"}`}); err != nil {
+		t.Fatalf("failed to overwrite: %v", err)
+	}
+	if err := s.remove("/mnt/c"); err != nil {
+		t.Fatalf("failed to remove: %v", err)
+	}
+	if err := s.remove("/mnt/unknown"); err != nil {
+		t.Fatalf("removing unknown mountpoint must be allowed: %v", err)
+	}
+
+	// A new store on the same directory sees the records.
+	s, err = newMountStateStore(filepath.Join(dir, "mounts"))
+	if err != nil {
+		t.Fatalf("failed to reopen store: %v", err)
+	}
+	records, err := s.list()
+	if err != nil {
+		t.Fatalf("failed to list: %v", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d records; want 2: %+v", len(records), records)
+	}
+	for i, mp := range []string{"/mnt/a", "/mnt/b"} {
+		r := records[i]
+		if r.Mountpoint != mp || r.Labels["mp"] != mp || r.Namespace != "testns" {
+			t.Errorf("record %d = %+v; want mountpoint %q in namespace testns", i, r, mp)
+		}
+	}
+	if records[0].Labels["updated"] != "true" {
+		t.Errorf("record of /mnt/a isn't updated: %+v", records[0])
+	}
+	if _, ok := records[0].Labels[config.TargetAuthLabel]; ok {
+		t.Errorf("credentials are recorded: %+v", records[0])
+	}
+}
+
+func TestMountStateCleanup(t *testing.T) {
+	// Records left by the previous run aren't kept if mounts aren't restored.
+	root := t.TempDir()
+	s, err := newMountStateStore(filepath.Join(root, "mounts"))
+	if err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	if err := s.add(context.Background(), "/mnt/a", nil); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	fsys, err := NewFilesystem(root, config.Config{})
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+	if fsys.(*filesystem).mountStates != nil {
+		t.Errorf("mounts must not be recorded if they aren't restored")
+	}
+	if _, err := os.Stat(filepath.Join(root, "mounts")); !os.IsNotExist(err) {
+		t.Errorf("records of the previous run must be removed: %v", err)
+	}
+
+	// The record is removed on unmount even if the layer isn't mounted.
+	if s, err = newMountStateStore(filepath.Join(root, "mounts")); err != nil {
+		t.Fatalf("failed to create store: %v", err)
+	}
+	if err := s.add(context.Background(), "/mnt/a", nil); err != nil {
+		t.Fatalf("failed to add: %v", err)
+	}
+	if err := (&filesystem{mountStates: s}).Unmount(context.Background(), "/mnt/a"); err == nil {
+		t.Errorf("unmounting unknown mountpoint must fail")
+	}
+	if records, err := s.list(); err != nil || len(records) != 0 {
+		t.Errorf("record must be removed on unmount: %+v, %v", records, err)
+	}
+}
+
+func TestPrefetchCoordinatorChain(t *testing.T) {
+	var manifest ocispec.Manifest
+	for i := 0; i < 3; i++ {
+		manifest.Layers = append(manifest.Layers, ocispec.Descriptor{Digest: digest.FromString(fmt.Sprintf("layer-%d", i))})
+	}
+	c := newPrefetchCoordinator(nil)
+	c.settleTime = time.Minute // must not be waited because all layers are mounted
+	c.layerShadow = func(ctx context.Context, src source.Source, desc ocispec.Descriptor) *layer.Shadow {
+		return nil
+	}
+	var (
+		fetched []int
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+	)
+	src := source.Source{Manifest: manifest}
+	wg.Add(len(manifest.Layers))
+	for i := range manifest.Layers { // containerd mounts the lowest layer first
+		i := i
+		c.add(context.Background(), src, i, func(*layer.Shadow) {
+			mu.Lock()
+			fetched = append(fetched, i)
+			mu.Unlock()
+			wg.Done()
+		})
+	}
+	waitCh := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(waitCh)
+	}()
+	select {
+	case <-waitCh:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("layers aren't prefetched after the chain is mounted")
+	}
+	if want := []int{2, 1, 0}; fmt.Sprint(fetched) != fmt.Sprint(want) {
+		t.Errorf("layers are prefetched in %v; want %v (upper first)", fetched, want)
+	}
+
+	// The prefetch of a partially mounted chain starts after the settle time.
+	c.settleTime = 10 * time.Millisecond
+	wg.Add(1)
+	c.add(context.Background(), src, 0, func(*layer.Shadow) { wg.Done() })
+	wg.Wait()
+}
+
+// Tests layers which aren't eStargz reach Mount through the snapshotter only if
+// the conversion proxy is enabled.
+func TestPrepareConvertibleLayer(t *testing.T) {
+	testutil.RequiresRoot(t)
+	for _, withProxy := range []bool{false, true} {
+		t.Run(fmt.Sprintf("proxy=%v", withProxy), func(t *testing.T) {
+			ctx := namespaces.WithNamespace(context.Background(), "default")
+			var requested int
+			fs := &filesystem{
+				getSources: func(labels map[string]string) ([]source.Source, error) {
+					requested++
+					return nil, fmt.Errorf("no source")
+				},
+				backgroundTaskManager: task.NewBackgroundTaskManager(1, time.Second),
+			}
+			if withProxy {
+				p, err := conversion.NewProxy(t.TempDir(), config.ConversionProxyConfig{CacheRepository: "example.com/cache"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				fs.conversionProxy = p
+			}
+			sn, err := snapshot.NewSnapshotter(ctx, t.TempDir(), fs)
+			if err != nil {
+				t.Fatalf("failed to create snapshotter: %v", err)
+			}
+			defer sn.Close()
+
+			if _, err := sn.Prepare(ctx, "key", "", snapshots.WithLabels(map[string]string{
+				"containerd.io/snapshot.ref":  "target",
+				snapshot.TargetMediaTypeLabel: "application/vnd.oci.image.layer.v1.tar+zstd",
+			})); err != nil {
+				t.Fatalf("failed to prepare fallback snapshot: %v", err)
+			}
+			if mounted := requested > 0; mounted != withProxy {
+				t.Errorf("zstd layer is mounted: %v; want %v", mounted, withProxy)
+			}
+		})
+	}
+}
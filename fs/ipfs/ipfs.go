@@ -0,0 +1,172 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package ipfs provides the filesystem which lazily mounts eStargz layers
+// distributed over IPFS. Layers are resolved by their CIDs and read through the
+// HTTP API of an IPFS node (e.g. kubo) instead of registries.
+package ipfs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/snapshot"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// CIDLabel is a label which contains the CID of the layer on IPFS. Layers
+	// with this label are mounted from IPFS.
+	CIDLabel = "containerd.io/snapshot/remote/ipfs.cid"
+
+	// Name is the name of the filesystem.
+	Name = "ipfs"
+
+	// urlScheme is the scheme of the URLs of layer descriptors pointing to IPFS
+	// (i.e. "ipfs://<cid>").
+	urlScheme = "ipfs"
+)
+
+// Config is config for IPFS.
+type Config struct {
+	// APIEndpoint is the URL of the HTTP API of the IPFS node (e.g.
+	// "http://127.0.0.1:5001"). IPFS filesystem is disabled if empty.
+	APIEndpoint string `toml:"api_endpoint"`
+}
+
+// NewFilesystem returns the filesystem which mounts layers labeled with
+// CIDLabel from IPFS. Contents are served and cached in the same manner as the
+// stargz filesystem so cfg configures it as well.
+func NewFilesystem(root string, cfg config.Config, ipfscfg Config) (snapshot.FileSystem, error) {
+	getSources, err := Sources(ipfscfg, http.DefaultTransport)
+	if err != nil {
+		return nil, err
+	}
+	return stargzfs.NewFilesystem(root, cfg,
+		stargzfs.WithGetSources(getSources),
+		stargzfs.WithName(Name),
+	)
+}
+
+// Sources returns the function for converting the labels of the layers on IPFS
+// to their sources. Blobs are read through the API of the IPFS node with the
+// requests sent over tr. Layers without CIDLabel are rejected.
+func Sources(ipfscfg Config, tr http.RoundTripper) (source.GetSources, error) {
+	endpoint, err := url.Parse(ipfscfg.APIEndpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid API endpoint %q", ipfscfg.APIEndpoint)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid API endpoint %q: must be http(s)://<host>", ipfscfg.APIEndpoint)
+	}
+	return func(labels map[string]string) ([]source.Source, error) {
+		cid, ok := labels[CIDLabel]
+		if !ok {
+			return nil, fmt.Errorf("layer isn't on IPFS: %q label is missing", CIDLabel)
+		}
+		if err := validateCID(cid); err != nil {
+			return nil, err
+		}
+		hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+			return []docker.RegistryHost{{
+				Client: &http.Client{Transport: &transport{
+					inner:    tr,
+					endpoint: endpoint,
+					cid:      cid,
+				}},
+				Host:         endpoint.Host,
+				Scheme:       endpoint.Scheme,
+				Path:         "/",
+				Capabilities: docker.HostCapabilityPull,
+			}}, nil
+		}
+		return source.FromDefaultLabels(hosts)(labels)
+	}, nil
+}
+
+// IsIPFSLayer returns true if the layer is labeled to be mounted from IPFS.
+func IsIPFSLayer(labels map[string]string) bool {
+	_, ok := labels[CIDLabel]
+	return ok
+}
+
+// AppendCIDLabelsHandlerWrapper makes a handler which appends the CIDs of the
+// layers to their descriptors as annotations during unpack. CIDs are taken from
+// the URLs of the descriptors in the form of "ipfs://<cid>". Layers without such
+// URLs are left as is and pulled from the registry.
+func AppendCIDLabelsHandlerWrapper() func(f images.Handler) images.Handler {
+	return func(f images.Handler) images.Handler {
+		return images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			children, err := f.Handle(ctx, desc)
+			if err != nil {
+				return nil, err
+			}
+			switch desc.MediaType {
+			case ocispec.MediaTypeImageManifest, images.MediaTypeDockerSchema2Manifest:
+				for i := range children {
+					c := &children[i]
+					if !images.IsLayerType(c.MediaType) {
+						continue
+					}
+					if cid, ok := cidFromURLs(c.URLs); ok {
+						if c.Annotations == nil {
+							c.Annotations = make(map[string]string)
+						}
+						c.Annotations[CIDLabel] = cid
+					}
+				}
+			}
+			return children, nil
+		})
+	}
+}
+
+func cidFromURLs(urls []string) (string, bool) {
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil || u.Scheme != urlScheme {
+			continue
+		}
+		if cid := u.Host; validateCID(cid) == nil {
+			return cid, true
+		}
+	}
+	return "", false
+}
+
+// validateCID checks that the CID is a single multibase-encoded string so it
+// can be safely passed to the API.
+func validateCID(cid string) error {
+	if cid == "" {
+		return fmt.Errorf("CID must not be empty")
+	}
+	if strings.IndexFunc(cid, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9')
+	}) >= 0 {
+		return fmt.Errorf("invalid CID %q", cid)
+	}
+	return nil
+}
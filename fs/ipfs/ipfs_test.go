@@ -0,0 +1,153 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ipfs
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const testCID = "bafybeigdyrzt5sfp7udm7hu76uh7y26nf3efuylqabf3oclgtqy55fbzdi"
+
+func TestSources(t *testing.T) {
+	getSources, err := Sources(Config{APIEndpoint: "http://127.0.0.1:5001"}, http.DefaultTransport)
+	if err != nil {
+		t.Fatalf("failed to get sources: %v", err)
+	}
+	labels := map[string]string{
+		"containerd.io/snapshot/remote/stargz.reference": "registry.test/library/test:latest",
+		"containerd.io/snapshot/remote/stargz.digest":    digest.FromString("test").String(),
+	}
+	if _, err := getSources(labels); err == nil {
+		t.Errorf("layer without %q label must be rejected", CIDLabel)
+	}
+	labels[CIDLabel] = "../" + testCID
+	if _, err := getSources(labels); err == nil {
+		t.Errorf("invalid CID must be rejected")
+	}
+	labels[CIDLabel] = testCID
+	if srcs, err := getSources(labels); err != nil || len(srcs) != 1 {
+		t.Errorf("failed to get the source: %v, %v", srcs, err)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	contents := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "405 - Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		switch r.URL.Path {
+		case "/api/v0/files/stat":
+			if q.Get("arg") != "/ipfs/"+testCID {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"Message": "not found", "Type": "error"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"Size": len(contents), "Type": "file"})
+		case "/api/v0/cat":
+			offset, _ := strconv.Atoi(q.Get("offset"))
+			length, _ := strconv.Atoi(q.Get("length"))
+			if q.Get("arg") != testCID || offset+length > len(contents) {
+				http.Error(w, "invalid request", http.StatusBadRequest)
+				return
+			}
+			w.Write(contents[offset : offset+length])
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	endpoint, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &transport{inner: http.DefaultTransport, endpoint: endpoint, cid: testCID}
+	blobURL := "http://registry.test/v2/test/blobs/" + digest.FromBytes(contents).String()
+	for _, tt := range []struct {
+		method       string
+		ranges       string
+		wantStatus   int
+		wantRange    string
+		wantContents string
+	}{
+		{method: "HEAD", wantStatus: http.StatusOK},
+		{method: "GET", wantStatus: http.StatusOK, wantContents: string(contents)},
+		{method: "GET", ranges: "bytes=10-14", wantStatus: http.StatusPartialContent, wantRange: "bytes 10-14/36", wantContents: "abcde"},
+		{method: "GET", ranges: "bytes=30-39,0-1", wantStatus: http.StatusPartialContent, wantRange: "bytes 0-35/36", wantContents: string(contents)},
+		{method: "GET", ranges: "bytes=40-49", wantStatus: http.StatusRequestedRangeNotSatisfiable, wantRange: "bytes */36"},
+	} {
+		req, err := http.NewRequest(tt.method, blobURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.ranges != "" {
+			req.Header.Set("Range", tt.ranges)
+		}
+		res, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatalf("%s %q: %v", tt.method, tt.ranges, err)
+		}
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatalf("%s %q: failed to read: %v", tt.method, tt.ranges, err)
+		}
+		if res.StatusCode != tt.wantStatus || res.Header.Get("Content-Range") != tt.wantRange || string(data) != tt.wantContents {
+			t.Errorf("%s %q: got (%v, %q, %q); want (%v, %q, %q)", tt.method, tt.ranges,
+				res.StatusCode, res.Header.Get("Content-Range"), string(data), tt.wantStatus, tt.wantRange, tt.wantContents)
+		}
+		if tt.method == "HEAD" && res.Header.Get("Content-Length") != strconv.Itoa(len(contents)) {
+			t.Errorf("HEAD: Content-Length = %q; want %d", res.Header.Get("Content-Length"), len(contents))
+		}
+	}
+}
+
+func TestAppendCIDLabelsHandlerWrapper(t *testing.T) {
+	layers := []ocispec.Descriptor{
+		{MediaType: ocispec.MediaTypeImageLayerGzip, URLs: []string{"https://example.com/blob", "ipfs://" + testCID}},
+		{MediaType: ocispec.MediaTypeImageLayerGzip, URLs: []string{"https://example.com/blob"}},
+		{MediaType: ocispec.MediaTypeImageLayerGzip},
+	}
+	h := AppendCIDLabelsHandlerWrapper()(images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+		return layers, nil
+	}))
+	children, err := h.Handle(context.Background(), ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest})
+	if err != nil {
+		t.Fatalf("failed to handle: %v", err)
+	}
+	if got := children[0].Annotations[CIDLabel]; got != testCID {
+		t.Errorf("CID = %q; want %q", got, testCID)
+	}
+	for _, c := range children[1:] {
+		if IsIPFSLayer(c.Annotations) {
+			t.Errorf("layer without IPFS URL must not be labeled: %+v", c)
+		}
+	}
+}
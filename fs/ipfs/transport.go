@@ -0,0 +1,164 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ipfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/util/byterange"
+	"github.com/pkg/errors"
+)
+
+// transport serves the requests for the blob on the registry (i.e.
+// ".../blobs/<digest>") with the contents of the CID read through the HTTP API
+// of the IPFS node. HEAD requests are answered with the size from "files/stat"
+// and range requests are translated to "cat" with offset and length.
+type transport struct {
+	inner    http.RoundTripper
+	endpoint *url.URL
+	cid      string
+
+	size   int64
+	sizeMu sync.Mutex
+}
+
+func (tr *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if blobs, _ := path.Split(req.URL.Path); path.Base(blobs) != "blobs" {
+		return nil, fmt.Errorf("unexpected request to %q", req.URL)
+	}
+	size, err := tr.getSize(req)
+	if err != nil {
+		return nil, err
+	}
+	header := make(http.Header)
+	// Contents of the CID never change so the CID is the strong validator.
+	header.Set("ETag", strconv.Quote(tr.cid))
+	if req.Method == "HEAD" {
+		header.Set("Content-Length", fmt.Sprintf("%d", size))
+		return response(req, http.StatusOK, header), nil
+	}
+
+	begin, end := int64(0), size-1
+	status := http.StatusOK
+	if r := req.Header.Get("Range"); r != "" {
+		// The API doesn't support multiple ranges. The blob handles the
+		// response of the range covering all requested ranges.
+		rs, err := byterange.Parse(r)
+		if err != nil {
+			return nil, err
+		}
+		cover := byterange.Coalesce(rs, -1)[0]
+		begin, end = cover.Begin, cover.End
+		if begin >= size {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			return response(req, http.StatusRequestedRangeNotSatisfiable, header), nil
+		}
+		if end >= size {
+			end = size - 1
+		}
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", begin, end, size))
+		status = http.StatusPartialContent
+	}
+	res, err := tr.call(req, "cat", url.Values{
+		"arg":    {tr.cid},
+		"offset": {fmt.Sprintf("%d", begin)},
+		"length": {fmt.Sprintf("%d", end-begin+1)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Content-Length", fmt.Sprintf("%d", end-begin+1))
+	r := response(req, status, header)
+	r.Body, r.ContentLength = res.Body, end-begin+1
+	return r, nil
+}
+
+// getSize returns the size of the contents of the CID. The size is queried only
+// once.
+func (tr *transport) getSize(req *http.Request) (int64, error) {
+	tr.sizeMu.Lock()
+	defer tr.sizeMu.Unlock()
+	if tr.size > 0 {
+		return tr.size, nil
+	}
+	res, err := tr.call(req, "files/stat", url.Values{"arg": {"/ipfs/" + tr.cid}})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	var stat struct {
+		Size int64
+		Type string
+	}
+	if err := json.NewDecoder(res.Body).Decode(&stat); err != nil {
+		return 0, errors.Wrapf(err, "failed to decode stat of %q", tr.cid)
+	}
+	if stat.Type != "file" {
+		return 0, fmt.Errorf("%q isn't a file but %q", tr.cid, stat.Type)
+	}
+	tr.size = stat.Size
+	return tr.size, nil
+}
+
+// call calls the API command. The API accepts only POST requests.
+func (tr *transport) call(req *http.Request, cmd string, args url.Values) (*http.Response, error) {
+	u := *tr.endpoint
+	u.Path = path.Join("/", u.Path, "api/v0", cmd)
+	u.RawPath = ""
+	u.RawQuery = args.Encode()
+	apiReq, err := http.NewRequestWithContext(req.Context(), "POST", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := tr.inner.RoundTrip(apiReq)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to call %q", cmd)
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		var apiErr struct{ Message string }
+		body, _ := ioutil.ReadAll(res.Body)
+		if json.Unmarshal(body, &apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(body))
+		}
+		return nil, fmt.Errorf("failed to call %q for %q with code %v: %s",
+			cmd, tr.cid, res.StatusCode, apiErr.Message)
+	}
+	return res, nil
+}
+
+func response(req *http.Request, status int, header http.Header) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
@@ -0,0 +1,198 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+	"unsafe"
+
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const fscryptMasterKeySize = 64
+
+// prepareCacheRoot prepares the directory where directory caches are stored
+// following the configured backend and returns the path to the directory.
+func prepareCacheRoot(root string, dcc config.DirectoryCacheConfig) (string, error) {
+	switch dcc.Backend {
+	case "", config.CacheBackendDisk:
+		return root, nil
+	case config.CacheBackendTmpfs:
+		dir := filepath.Join(root, "tmpfs")
+		if err := mountTmpfs(dir, dcc.TmpfsSize); err != nil {
+			return "", errors.Wrapf(err, "failed to prepare tmpfs cache on %q", dir)
+		}
+		return dir, nil
+	case config.CacheBackendFscrypt:
+		dir := filepath.Join(root, "fscrypt")
+		if err := unlockFscrypt(dir, dcc.FscryptKeyFile); err != nil {
+			return "", errors.Wrapf(err, "failed to prepare fscrypt cache on %q", dir)
+		}
+		return dir, nil
+	}
+	return "", fmt.Errorf("unknown cache backend %q", dcc.Backend)
+}
+
+// newEvictionPolicy returns the eviction policy of directory caches. nil is
+// returned if eviction is disabled.
+func newEvictionPolicy(dcc config.DirectoryCacheConfig) (cache.EvictionPolicy, error) {
+	if dcc.CacheMaxSizeBytes > 0 {
+		// cache_max_size_bytes is a shorthand of "size" policy.
+		switch dcc.EvictionPolicy {
+		case "":
+			dcc.EvictionPolicy, dcc.EvictionMaxBytes = config.EvictionPolicySize, dcc.CacheMaxSizeBytes
+		case config.EvictionPolicySize:
+			if dcc.EvictionMaxBytes <= 0 || dcc.CacheMaxSizeBytes < dcc.EvictionMaxBytes {
+				dcc.EvictionMaxBytes = dcc.CacheMaxSizeBytes
+			}
+		default:
+			return nil, fmt.Errorf("cache_max_size_bytes can't be used with %q eviction policy", dcc.EvictionPolicy)
+		}
+	}
+	switch dcc.EvictionPolicy {
+	case "":
+		return nil, nil
+	case config.EvictionPolicySize:
+		if dcc.EvictionMaxBytes <= 0 {
+			return nil, fmt.Errorf("eviction_max_bytes must be positive for %q eviction policy", dcc.EvictionPolicy)
+		}
+		return cache.NewSizeEvictionPolicy(dcc.EvictionMaxBytes), nil
+	case config.EvictionPolicyLFU:
+		if dcc.EvictionMaxEntries <= 0 {
+			return nil, fmt.Errorf("eviction_max_entries must be positive for %q eviction policy", dcc.EvictionPolicy)
+		}
+		return cache.NewLFUEvictionPolicy(dcc.EvictionMaxEntries), nil
+	case config.EvictionPolicyTTL:
+		if dcc.EvictionTTLSec <= 0 {
+			return nil, fmt.Errorf("eviction_ttl_sec must be positive for %q eviction policy", dcc.EvictionPolicy)
+		}
+		return cache.NewTTLEvictionPolicy(time.Duration(dcc.EvictionTTLSec) * time.Second), nil
+	}
+	return nil, fmt.Errorf("unknown eviction policy %q", dcc.EvictionPolicy)
+}
+
+// mountTmpfs mounts tmpfs on the directory. If tmpfs is already mounted there
+// (e.g. by the previous run of the snapshotter), it is reused.
+func mountTmpfs(dir string, size string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return err
+	}
+	if st.Type == unix.TMPFS_MAGIC {
+		return nil
+	}
+	data := "mode=0700"
+	if size != "" {
+		data += ",size=" + size
+	}
+	return unix.Mount("tmpfs", dir, "tmpfs", unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, data)
+}
+
+// unlockFscrypt adds the fscrypt master key to the filesystem and makes sure
+// the directory is protected by the key. The directory is encrypted with the
+// key if it's newly created.
+func unlockFscrypt(dir string, keyFile string) error {
+	if keyFile == "" {
+		return fmt.Errorf("fscrypt key file must be specified")
+	}
+	key, err := readHexKey(keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to read fscrypt key")
+	}
+	if len(key) != fscryptMasterKeySize {
+		return fmt.Errorf("fscrypt key must be %d bytes but got %d bytes", fscryptMasterKeySize, len(key))
+	}
+	parent := filepath.Dir(dir)
+	if err := os.MkdirAll(parent, 0700); err != nil {
+		return err
+	}
+	identifier, err := addFscryptKey(parent, key)
+	if err != nil {
+		return errors.Wrap(err, "failed to add fscrypt key")
+	}
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	arg := unix.FscryptGetPolicyExArg{Size: uint64(unsafe.Sizeof(unix.FscryptPolicyV2{}))}
+	if err := ioctl(f.Fd(), unix.FS_IOC_GET_ENCRYPTION_POLICY_EX, unsafe.Pointer(&arg)); err == nil {
+		p := (*unix.FscryptPolicyV2)(unsafe.Pointer(&arg.Policy[0]))
+		if p.Version != unix.FSCRYPT_POLICY_V2 || !bytes.Equal(p.Master_key_identifier[:], identifier) {
+			return fmt.Errorf("directory is protected by another key")
+		}
+		return nil
+	} else if err != unix.ENODATA {
+		return errors.Wrap(err, "failed to get encryption policy")
+	}
+
+	// The directory isn't encrypted yet. Encrypt it with the key.
+	p := unix.FscryptPolicyV2{
+		Version:                   unix.FSCRYPT_POLICY_V2,
+		Contents_encryption_mode:  unix.FSCRYPT_MODE_AES_256_XTS,
+		Filenames_encryption_mode: unix.FSCRYPT_MODE_AES_256_CTS,
+		Flags:                     unix.FSCRYPT_POLICY_FLAGS_PAD_32,
+	}
+	copy(p.Master_key_identifier[:], identifier)
+	if err := ioctl(f.Fd(), unix.FS_IOC_SET_ENCRYPTION_POLICY, unsafe.Pointer(&p)); err != nil {
+		return errors.Wrap(err, "failed to set encryption policy (the directory must be empty)")
+	}
+	return nil
+}
+
+// addFscryptKey adds the master key to the filesystem where the path exists and
+// returns the identifier of the key.
+func addFscryptKey(path string, key []byte) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// struct fscrypt_add_key_arg is followed by the raw key.
+	argSize := int(unsafe.Sizeof(unix.FscryptAddKeyArg{}))
+	buf := make([]byte, argSize+len(key))
+	arg := (*unix.FscryptAddKeyArg)(unsafe.Pointer(&buf[0]))
+	arg.Key_spec.Type = unix.FSCRYPT_KEY_SPEC_TYPE_IDENTIFIER
+	arg.Raw_size = uint32(len(key))
+	copy(buf[argSize:], key)
+	if err := ioctl(f.Fd(), unix.FS_IOC_ADD_ENCRYPTION_KEY, unsafe.Pointer(&buf[0])); err != nil {
+		return nil, err
+	}
+	return append([]byte{}, arg.Key_spec.U[:unix.FSCRYPT_KEY_IDENTIFIER_SIZE]...), nil
+}
+
+func ioctl(fd uintptr, req uint, arg unsafe.Pointer) error {
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, fd, uintptr(req), uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
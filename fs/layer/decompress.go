@@ -0,0 +1,77 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	kgzip "github.com/klauspost/compress/gzip"
+	"golang.org/x/sync/semaphore"
+)
+
+// newDecompressor returns the decompressor of gzip streams in layers using the
+// backend specified in the config. If MaxDecompressionWorkers is specified, the
+// number of streams decompressed at once is limited among all layers.
+func newDecompressor(cfg config.Config) (estargz.Decompressor, error) {
+	var d estargz.Decompressor
+	switch cfg.DecompressionBackend {
+	case "", config.DecompressionBackendStdlib:
+		d = func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+	case config.DecompressionBackendKlauspost:
+		d = func(r io.Reader) (io.ReadCloser, error) { return kgzip.NewReader(r) }
+	default:
+		return nil, fmt.Errorf("unknown decompression backend %q", cfg.DecompressionBackend)
+	}
+	if cfg.MaxDecompressionWorkers > 0 {
+		d = limitDecompressor(d, semaphore.NewWeighted(cfg.MaxDecompressionWorkers))
+	}
+	return d, nil
+}
+
+// limitDecompressor makes the decompressor hold a slot of sem until the returned
+// reader is closed.
+func limitDecompressor(d estargz.Decompressor, sem *semaphore.Weighted) estargz.Decompressor {
+	return func(r io.Reader) (io.ReadCloser, error) {
+		if err := sem.Acquire(context.Background(), 1); err != nil {
+			return nil, err
+		}
+		rc, err := d(r)
+		if err != nil {
+			sem.Release(1)
+			return nil, err
+		}
+		var once sync.Once
+		return &readCloser{rc, func() error {
+			err := rc.Close()
+			once.Do(func() { sem.Release(1) })
+			return err
+		}}, nil
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	closeFunc func() error
+}
+
+func (rc *readCloser) Close() error { return rc.closeFunc() }
@@ -0,0 +1,57 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// newCacheCipher returns AES-GCM keyed by the hex-encoded key stored in the
+// specified file. nil is returned if no file is specified.
+func newCacheCipher(keyFile string) (cipher.AEAD, error) {
+	if keyFile == "" {
+		return nil, nil
+	}
+	key, err := readHexKey(keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read cache encryption key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid cache encryption key")
+	}
+	return cipher.NewGCM(block)
+}
+
+// readHexKey reads the hex-encoded key stored in the file.
+func readHexKey(keyFile string) ([]byte, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "key in %q must be hex-encoded", keyFile)
+	}
+	return key, nil
+}
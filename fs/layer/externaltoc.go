@@ -0,0 +1,162 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// maxExternalTOCSize is the maximum size of the TOC blob of a layer, which is
+// read into memory.
+const maxExternalTOCSize = 64 << 20
+
+// externalTOC returns the TOC blob of the layer if the layer stores the TOC in
+// a separate blob (see estargz.ExternalTOCAnnotation). nil is returned if the
+// layer contains the TOC. The TOC blob is fetched from the repository of the
+// layer and cached on the filesystem so that it isn't fetched again when the
+// layer is resolved again (e.g. after the snapshotter restarts).
+func (r *Resolver) externalTOC(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) ([]byte, error) {
+	v, ok := desc.Annotations[estargz.ExternalTOCAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	dgst, err := digest.Parse(v)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid digest of TOC blob %q", v)
+	}
+	cachePath := filepath.Join(r.cacheRoot(ctx), "toc", dgst.Algorithm().String(), dgst.Encoded())
+	if b, err := r.readTOCCache(cachePath, dgst); err == nil {
+		log.G(ctx).WithField("digest", dgst).Debug("hit TOC cache")
+		return b, nil
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		log.G(ctx).WithError(err).WithField("digest", dgst).Warn("ignoring invalid TOC cache")
+	}
+
+	b, err := r.fetchTOC(ctx, hosts, refspec, dgst)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch TOC blob %q", dgst)
+	}
+	if err := r.writeTOCCache(cachePath, dgst, b); err != nil {
+		log.G(ctx).WithError(err).WithField("digest", dgst).Warn("failed to cache TOC blob")
+	}
+	return b, nil
+}
+
+func (r *Resolver) fetchTOC(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, dgst digest.Digest) ([]byte, error) {
+	blob, err := r.resolver.Resolve(ctx, hosts, refspec, ocispec.Descriptor{Digest: dgst}, cache.NewMemoryCache())
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	if size := blob.Size(); size > maxExternalTOCSize {
+		return nil, fmt.Errorf("TOC blob is too large (%d bytes)", size)
+	}
+	b := make([]byte, blob.Size())
+	if _, err := blob.ReadAt(b, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if d := dgst.Algorithm().FromBytes(b); d != dgst {
+		return nil, fmt.Errorf("fetched TOC blob has digest %q; want %q", d, dgst)
+	}
+	return b, nil
+}
+
+// readTOCCache reads the cached TOC blob. The blob is decrypted if the caches
+// are encrypted.
+func (r *Resolver) readTOCCache(cachePath string, dgst digest.Digest) ([]byte, error) {
+	b, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	if aead := r.cacheCipher; aead != nil {
+		if len(b) < aead.NonceSize() {
+			return nil, fmt.Errorf("encrypted TOC cache is too short")
+		}
+		b, err = aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(dgst))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decrypt TOC cache")
+		}
+	}
+	if d := dgst.Algorithm().FromBytes(b); d != dgst {
+		return nil, fmt.Errorf("cached TOC blob has digest %q; want %q", d, dgst)
+	}
+	return b, nil
+}
+
+// writeTOCCache atomically writes the TOC blob to the cache. The blob is
+// encrypted if the caches are encrypted.
+func (r *Resolver) writeTOCCache(cachePath string, dgst digest.Digest, b []byte) error {
+	if aead := r.cacheCipher; aead != nil {
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return errors.Wrap(err, "failed to generate nonce")
+		}
+		b = aead.Seal(nonce, nonce, b, []byte(dgst))
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(cachePath), "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), cachePath)
+}
+
+// footerVerifier returns the verifier of the identity of a blob whose TOC is
+// stored separately. The footer of eStargz, which points to the end of the
+// contents of the files, must be the same as the one of sr.
+func footerVerifier(sr *io.SectionReader) (remote.IdentityVerifier, error) {
+	tocOffset, _, err := estargz.OpenFooter(sr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse footer of the layer")
+	}
+	return func(ra io.ReaderAt, size int64) error {
+		off, _, err := estargz.OpenFooter(io.NewSectionReader(ra, 0, size))
+		if err != nil {
+			return errors.Wrap(err, "failed to parse footer of the layer")
+		}
+		if off != tocOffset {
+			return fmt.Errorf("footer points to %d; want %d", off, tocOffset)
+		}
+		return nil
+	}, nil
+}
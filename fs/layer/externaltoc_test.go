@@ -0,0 +1,110 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/task"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestExternalTOC(t *testing.T) {
+	reg := testutil.NewRegistry()
+	defer reg.Close()
+	l, err := testutil.BuildEStargzLayer([]testutil.TarEntry{testutil.File("foo.txt", sampleData1)},
+		testutil.WithEStargzOptions(estargz.WithExternalTOC()))
+	if err != nil {
+		t.Fatalf("failed to build layer: %v", err)
+	}
+	img, err := reg.PushImage("test", "latest", l)
+	if err != nil {
+		t.Fatalf("failed to push image: %v", err)
+	}
+	refspec, err := reference.Parse(img.Ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tocDgst := digest.FromBytes(l.ExternalTOC)
+	root, err := ioutil.TempDir("", "externaltoc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	resolve := func(desc ocispec.Descriptor) (*layerRef, error) {
+		r, err := NewResolver(root, task.NewBackgroundTaskManager(1, time.Second), config.Config{
+			HTTPCacheType: config.CacheTypeMemory,
+			FSCacheType:   config.CacheTypeMemory,
+		})
+		if err != nil {
+			t.Fatalf("failed to make resolver: %v", err)
+		}
+		lr, err := r.Resolve(context.Background(), reg.Hosts(), refspec, desc)
+		if err != nil {
+			return nil, err
+		}
+		return lr.(*layerRef), nil
+	}
+
+	lr, err := resolve(l.Desc)
+	if err != nil {
+		t.Fatalf("failed to resolve: %v", err)
+	}
+	defer lr.Done()
+	if err := lr.Verify(digest.Digest(l.Desc.Annotations[estargz.TOCJSONDigestAnnotation])); err != nil {
+		t.Fatalf("failed to verify: %v", err)
+	}
+	ra, err := lr.r.OpenFile("foo.txt")
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	b := make([]byte, len(sampleData1))
+	if _, err := ra.ReadAt(b, 0); err != nil || string(b) != sampleData1 {
+		t.Errorf("read %q (%v); want %q", string(b), err, sampleData1)
+	}
+	if n := reg.BlobRequests(tocDgst); n == 0 {
+		t.Fatalf("TOC blob must be fetched")
+	}
+
+	// The TOC blob is cached.
+	n := reg.BlobRequests(tocDgst)
+	lr2, err := resolve(l.Desc)
+	if err != nil {
+		t.Fatalf("failed to resolve again: %v", err)
+	}
+	defer lr2.Done()
+	if got := reg.BlobRequests(tocDgst); got != n {
+		t.Errorf("TOC blob must be read from the cache (%d requests; want %d)", got, n)
+	}
+
+	// The layer can't be opened without the TOC blob.
+	desc := l.Desc
+	desc.Annotations = map[string]string{}
+	if lr3, err := resolve(desc); err == nil {
+		lr3.Done()
+		t.Errorf("layer must not be resolved without the TOC blob")
+	}
+}
@@ -25,12 +25,14 @@ package layer
 import (
 	"bytes"
 	"context"
+	"crypto/cipher"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/containerd/containerd/log"
@@ -42,6 +44,7 @@ import (
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	"github.com/containerd/stargz-snapshotter/task"
+	"github.com/containerd/stargz-snapshotter/util/faultinject"
 	"github.com/containerd/stargz-snapshotter/util/lrucache"
 	"github.com/containerd/stargz-snapshotter/util/namedmutex"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
@@ -56,7 +59,6 @@ const (
 	defaultMaxLRUCacheEntry   = 10
 	defaultMaxCacheFds        = 10
 	defaultPrefetchTimeoutSec = 10
-	memoryCacheType           = "memory"
 )
 
 // Layer represents a layer.
@@ -65,7 +67,7 @@ type Layer interface {
 	Info() Info
 
 	// RootNode returns the root node of this layer.
-	RootNode() (fusefs.InodeEmbedder, error)
+	RootNode(opts ...NodeOption) (fusefs.InodeEmbedder, error)
 
 	// Check checks if the layer is still connectable.
 	Check() error
@@ -76,13 +78,25 @@ type Layer interface {
 	// Verify verifies this layer using the passed TOC Digest.
 	Verify(tocDigest digest.Digest) (err error)
 
+	// TOCDigest returns the digest of the TOC JSON of this layer, which
+	// identifies the contents of this layer. This is available even if the
+	// layer isn't verified.
+	TOCDigest() digest.Digest
+
 	// SkipVerify skips verification for this layer.
 	SkipVerify()
 
 	// Prefetch prefetches the specified size. If the layer is eStargz and contains landmark files,
 	// the range indicated by these files is respected.
 	// Calling this function before calling Verify or SkipVerify will fail.
-	Prefetch(prefetchSize int64) error
+	// Layers are shared among mounts so prefetch is done only once per layer.
+	// Prefetch is cancelled if the contexts of all callers (see WithContext)
+	// are done before completion and restarted by the next call.
+	Prefetch(prefetchSize int64, opts ...PrefetchOption) error
+
+	// Shadow returns the paths which this layer hides from its lower layers in
+	// the merged rootfs. This is available even if the layer isn't verified.
+	Shadow() (*Shadow, error)
 
 	// ReadAt reads this layer.
 	ReadAt([]byte, int64, ...remote.Option) (int, error)
@@ -93,7 +107,17 @@ type Layer interface {
 	// BackgroundFetch fetches the entire layer contents to the cache.
 	// Fetching contents is done as a background task.
 	// Calling this function before calling Verify or SkipVerify will fail.
-	BackgroundFetch() error
+	// If files are skipped by WithShadow, ErrPartiallyFetched is returned
+	// after the other files are fetched. In this case, the next call fetches
+	// the layer again with its shadow (cached contents aren't fetched twice) so
+	// that layers shared among images are fully fetched unless all images hide
+	// the files. This is cancelled and restarted in the same manner as Prefetch.
+	BackgroundFetch(opts ...PrefetchOption) error
+
+	// Pin makes this layer and its cached contents exempt from eviction from the
+	// resolver's cache and from the eviction policy of the caches on the disk.
+	// Unpinned layers can be evicted as usual.
+	Pin(pinned bool)
 
 	// Done releases the reference to this layer. The resources related to this layer will be
 	// discarded sooner or later. Queries after calling this function won't be serviced.
@@ -105,6 +129,71 @@ type Info struct {
 	Digest      digest.Digest
 	Size        int64
 	FetchedSize int64
+
+	// OnDemandFetchedSize is the size fetched from the registry by on-demand
+	// reads of files (i.e. excluding prefetch and background fetch).
+	OnDemandFetchedSize int64
+
+	// ReadRequestedSize is the size requested by reads of files which missed
+	// the cache. Compared with this, OnDemandFetchedSize and ReadDecompressedSize
+	// show the amplification of on-demand reads (e.g. because of the chunk size
+	// of the layer and the blob).
+	ReadRequestedSize int64
+
+	// ReadDecompressedSize is the size of the chunks decompressed for reads of
+	// files which missed the cache.
+	ReadDecompressedSize int64
+
+	// ReadCachedSize is the size read from files which hit the cache.
+	ReadCachedSize int64
+
+	// OnDemandFetchDuration is the time on-demand reads of files waited for the
+	// registry.
+	OnDemandFetchDuration time.Duration
+
+	// FetchDuration is the time spent on fetching the layer from the registry,
+	// including prefetch and background fetch.
+	FetchDuration time.Duration
+
+	// Degraded lists the reasons why the layer is served in a degraded mode
+	// (i.e. contents are fetched only on demand). Empty if not degraded.
+	Degraded []string
+}
+
+type tenantKey struct{}
+
+// tenantValue is the tenant specified in the context.
+type tenantValue struct {
+	name    string
+	private bool
+}
+
+// WithTenant returns a context which specifies the tenant of the layer to resolve.
+// Layers of different tenants never share caches and connections to registries.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantValue{name: tenant})
+}
+
+// WithPrivateTenant is the same as WithTenant but the layer is partitioned by
+// the tenant even if the tenant isolation is disabled. This is used for layers
+// resolved with the credentials private to the tenant (e.g. passed through the
+// labels) so that other tenants can't read them without the credentials.
+func WithPrivateTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenantValue{name: tenant, private: true})
+}
+
+// WithTenantOf returns a context which specifies the same tenant as parent.
+func WithTenantOf(ctx, parent context.Context) context.Context {
+	if v, ok := parent.Value(tenantKey{}).(tenantValue); ok {
+		return context.WithValue(ctx, tenantKey{}, v)
+	}
+	return ctx
+}
+
+// TenantFromContext returns the tenant specified by WithTenant.
+func TenantFromContext(ctx context.Context) string {
+	v, _ := ctx.Value(tenantKey{}).(tenantValue)
+	return v.name
 }
 
 // Resolver resolves the layer location and provieds the handler of that layer.
@@ -112,13 +201,21 @@ type Resolver struct {
 	rootDir               string
 	resolver              *remote.Resolver
 	prefetchTimeout       time.Duration
-	layerCache            *lrucache.Cache
-	layerCacheMu          sync.Mutex
-	blobCache             *lrucache.Cache
-	blobCacheMu           sync.Mutex
+	layerCache            *lrucache.Cache // synchronized by itself
+	layers                *layerManager
+	blobCache             *lrucache.Cache // synchronized by itself
 	backgroundTaskManager *task.BackgroundTaskManager
 	resolveLock           *namedmutex.NamedMutex
 	config                config.Config
+	decompressor          estargz.Decompressor
+	cacheCipher           cipher.AEAD
+	cacheFaults           *faultinject.Injector
+	cachefiles            *cache.CullingCachefilesCache // nil unless "cachefiles-culling" cache type is used
+	cacheEviction         cache.EvictionPolicy
+
+	// tenantLayers is the number of layers held per tenant.
+	tenantLayers   map[string]int
+	tenantLayersMu *sync.Mutex
 }
 
 // NewResolver returns a new layer resolver.
@@ -131,12 +228,34 @@ func NewResolver(root string, backgroundTaskManager *task.BackgroundTaskManager,
 	if prefetchTimeout == 0 {
 		prefetchTimeout = defaultPrefetchTimeoutSec * time.Second
 	}
+	decompressor, err := newDecompressor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	cacheCipher, err := newCacheCipher(cfg.DirectoryCacheConfig.EncryptionKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	cacheRootDir, err := prepareCacheRoot(root, cfg.DirectoryCacheConfig)
+	if err != nil {
+		return nil, err
+	}
+	cachefiles, err := newCachefilesCulling(cacheRootDir, &cfg, cacheCipher)
+	if err != nil {
+		return nil, err
+	}
+	cacheEviction, err := newEvictionPolicy(cfg.DirectoryCacheConfig)
+	if err != nil {
+		return nil, err
+	}
 
 	// layerCache caches resolved layers for future use. This is useful in a use-case where
 	// the filesystem resolves and caches all layers in an image (not only queried one) in parallel,
 	// before they are actually queried.
 	layerCache := lrucache.New(resolveResultEntry)
+	tenantLayers, tenantLayersMu := make(map[string]int), new(sync.Mutex)
 	layerCache.OnEvicted = func(key string, value interface{}) {
+		releaseTenantLayer(tenantLayers, tenantLayersMu, value.(*layer).tenant)
 		if err := value.(*layer).close(); err != nil {
 			logrus.WithField("key", key).WithError(err).Warnf("failed to clean up layer")
 			return
@@ -156,19 +275,103 @@ func NewResolver(root string, backgroundTaskManager *task.BackgroundTaskManager,
 	}
 
 	return &Resolver{
-		rootDir:               root,
+		rootDir:               cacheRootDir,
 		resolver:              remote.NewResolver(cfg.BlobConfig),
 		layerCache:            layerCache,
+		layers:                newLayerManager(),
 		blobCache:             blobCache,
 		prefetchTimeout:       prefetchTimeout,
 		backgroundTaskManager: backgroundTaskManager,
 		config:                cfg,
+		decompressor:          decompressor,
+		cacheCipher:           cacheCipher,
+		cacheFaults:           faultinject.New(faultinject.Config(cfg.DirectoryCacheConfig.Faults)),
+		cachefiles:            cachefiles,
+		cacheEviction:         cacheEviction,
 		resolveLock:           new(namedmutex.NamedMutex),
+		tenantLayers:          tenantLayers,
+		tenantLayersMu:        tenantLayersMu,
 	}, nil
 }
 
-func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache, error) {
-	if cacheType == memoryCacheType {
+// reserveTenantLayer counts a layer of the tenant to be added to the layer
+// cache. This fails if the tenant reaches the quota. The check and the count are
+// done atomically so that concurrent resolutions can't exceed the quota.
+func (r *Resolver) reserveTenantLayer(tenant string) error {
+	r.tenantLayersMu.Lock()
+	defer r.tenantLayersMu.Unlock()
+	if max := r.config.MaxLayersPerTenant; r.config.IsolateTenants && tenant != "" && max > 0 && r.tenantLayers[tenant] >= max {
+		return fmt.Errorf("tenant %q exceeds the quota of layers (%d)", tenant, max)
+	}
+	r.tenantLayers[tenant]++
+	return nil
+}
+
+// releaseTenantLayer uncounts a layer of the tenant.
+func releaseTenantLayer(tenantLayers map[string]int, mu *sync.Mutex, tenant string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if tenantLayers[tenant] > 1 {
+		tenantLayers[tenant]--
+	} else {
+		delete(tenantLayers, tenant)
+	}
+}
+
+// tenant returns the tenant of the layer to resolve. Empty string is returned if
+// tenant isolation is disabled and the tenant isn't specified by
+// WithPrivateTenant.
+func (r *Resolver) tenant(ctx context.Context) string {
+	if v, _ := ctx.Value(tenantKey{}).(tenantValue); r.config.IsolateTenants || v.private {
+		return v.name
+	}
+	return ""
+}
+
+// cacheKey returns the key of the layer (or blob) in the resolver's caches.
+func (r *Resolver) cacheKey(ctx context.Context, refspec reference.Spec, desc ocispec.Descriptor) string {
+	name := refspec.String() + "/" + desc.Digest.String()
+	if tenant := r.tenant(ctx); tenant != "" {
+		name = tenant + "@" + name
+	}
+	return name
+}
+
+// layerKey returns the key of the layer in use. Layers are shared among images
+// by the digest.
+func (r *Resolver) layerKey(ctx context.Context, desc ocispec.Descriptor) string {
+	key := desc.Digest.String()
+	if tenant := r.tenant(ctx); tenant != "" {
+		key = tenant + "@" + key
+	}
+	return key
+}
+
+// cacheRoot returns the root directory of the caches of the tenant.
+func (r *Resolver) cacheRoot(ctx context.Context) string {
+	if tenant := r.tenant(ctx); tenant != "" {
+		// Use the digest of the tenant name so that the name can't escape the root directory.
+		return filepath.Join(r.rootDir, "tenants", digest.FromString(tenant).Encoded())
+	}
+	return r.rootDir
+}
+
+func (r *Resolver) newCache(root string, cacheType string) (cache.BlobCache, error) {
+	var c cache.BlobCache
+	var err error
+	if cacheType == config.CacheTypeCachefilesCulling {
+		c, err = r.cachefiles.NewCache()
+	} else {
+		c, err = newCache(root, cacheType, r.config, r.cacheCipher, r.cacheEviction)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cache.WithFaults(c, r.cacheFaults), nil
+}
+
+func newCache(root string, cacheType string, cfg config.Config, aead cipher.AEAD, eviction cache.EvictionPolicy) (cache.BlobCache, error) {
+	if cacheType == config.CacheTypeMemory {
 		return cache.NewMemoryCache(), nil
 	}
 
@@ -210,39 +413,95 @@ func newCache(root string, cacheType string, cfg config.Config) (cache.BlobCache
 			FdCache:   fCache,
 			BufPool:   bufPool,
 			Direct:    dcc.Direct,
+			Cipher:    aead,
+
+			CompactionInterval: time.Duration(dcc.CompactionIntervalSec) * time.Second,
+			CompactColdAfter:   time.Duration(dcc.CompactColdAfterSec) * time.Second,
+			MaxPackSize:        dcc.MaxPackSize,
+			DisableIOUring:     dcc.DisableIOUring,
+			EvictionPolicy:     eviction,
 		},
 	)
 }
 
+// newCachefilesCulling binds the directory for the "cachefiles-culling" cache
+// type to cachefiles if either of the cache types is "cachefiles-culling". If
+// cachefiles is unavailable and the fallback is enabled, the cache types in cfg
+// are changed to the directory cache.
+func newCachefilesCulling(root string, cfg *config.Config, aead cipher.AEAD) (*cache.CullingCachefilesCache, error) {
+	if cfg.HTTPCacheType != config.CacheTypeCachefilesCulling && cfg.FSCacheType != config.CacheTypeCachefilesCulling {
+		return nil, nil
+	}
+	if aead != nil {
+		return nil, fmt.Errorf("%q cache type doesn't support encryption", config.CacheTypeCachefilesCulling)
+	}
+	fc, err := cache.NewCullingCachefilesCache(filepath.Join(root, "cachefiles"), cache.CullingCachefilesConfig{
+		Tag: cfg.CachefilesCullingConfig.Tag,
+	})
+	if err == nil {
+		return fc, nil
+	}
+	if !cfg.CachefilesCullingConfig.FallbackToDirectory {
+		return nil, errors.Wrapf(err, "failed to prepare cachefiles culling cache")
+	}
+	logrus.WithError(err).Warn("cachefiles is unavailable; falling back to directory cache")
+	if cfg.HTTPCacheType == config.CacheTypeCachefilesCulling {
+		cfg.HTTPCacheType = ""
+	}
+	if cfg.FSCacheType == config.CacheTypeCachefilesCulling {
+		cfg.FSCacheType = ""
+	}
+	return nil, nil
+}
+
 // Resolve resolves a layer based on the passed layer blob information.
 func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (_ Layer, retErr error) {
-	name := refspec.String() + "/" + desc.Digest.String()
+	name, key := r.cacheKey(ctx, refspec, desc), r.layerKey(ctx, desc)
 
 	// Wait if resolving this layer is already running. The result
-	// can hopefully get from the LRU cache.
-	r.resolveLock.Lock(name)
-	defer r.resolveLock.Unlock(name)
+	// can hopefully get from the layers in use or the LRU cache.
+	r.resolveLock.Lock(key)
+	defer r.resolveLock.Unlock(key)
 
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("src", name))
 
-	// First, try to retrieve this layer from the underlying LRU cache.
-	r.layerCacheMu.Lock()
+	// First, try to share the layer in use (e.g. mounted for another snapshot
+	// or image).
+	if l, done, ok := r.layers.get(key); ok {
+		if l.Check() == nil {
+			log.G(ctx).Debugf("share layer %q", key)
+			return &layerRef{l, done}, nil
+		}
+		done()
+	}
+
+	// Next, try to retrieve this layer from the underlying LRU cache.
 	c, done, ok := r.layerCache.Get(name)
-	r.layerCacheMu.Unlock()
 	if ok {
 		if l := c.(*layer); l.Check() == nil {
 			log.G(ctx).Debugf("hit layer cache %q", name)
-			return &layerRef{l, done}, nil
+			return &layerRef{l, r.layers.add(key, l, done)}, nil
 		}
 		// Cached layer is invalid
 		done()
-		r.layerCacheMu.Lock()
 		r.layerCache.Remove(name)
-		r.layerCacheMu.Unlock()
 	}
 
 	log.G(ctx).Debugf("resolving")
 
+	// The layer is counted in advance because it can be evicted (and
+	// uncounted) as soon as it's added.
+	tenant := r.tenant(ctx)
+	if err := r.reserveTenantLayer(tenant); err != nil {
+		return nil, err
+	}
+	reserved := true
+	defer func() {
+		if reserved {
+			releaseTenantLayer(r.tenantLayers, r.tenantLayersMu, tenant)
+		}
+	}()
+
 	// Resolve the blob.
 	blobR, err := r.resolveBlob(ctx, hosts, refspec, desc)
 	if err != nil {
@@ -254,7 +513,7 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		}
 	}()
 
-	fsCache, err := newCache(filepath.Join(r.rootDir, "fscache"), r.config.FSCacheType, r.config)
+	fsCache, err := r.newCache(filepath.Join(r.cacheRoot(ctx), "fscache"), r.config.FSCacheType)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create fs cache")
 	}
@@ -271,46 +530,75 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	sr := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (n int, err error) {
 		r.backgroundTaskManager.DoPrioritizedTask()
 		defer r.backgroundTaskManager.DonePrioritizedTask()
-		return blobR.ReadAt(p, offset)
+		return blobR.ReadAt(p, offset, remote.WithOnDemand())
 	}), 0, blobR.Size())
-	vr, err := reader.NewReader(sr, fsCache)
+	rOpts := []reader.Option{reader.WithDecompressor(r.decompressor)}
+	if ib, ok := blobR.Blob.(remote.InvalidatableBlob); ok {
+		rOpts = append(rOpts, reader.WithInvalidateFunc(ib.Invalidate))
+	}
+	tocBlob, err := r.externalTOC(ctx, hosts, refspec, desc)
+	if err != nil {
+		return nil, err
+	}
+	if tocBlob != nil {
+		rOpts = append(rOpts, reader.WithExternalTOC(tocBlob))
+	}
+	vr, err := reader.NewReader(sr, fsCache, rOpts...)
 	if err != nil {
+		if tocBlob == nil {
+			if ok, ferr := hasEStargzFooter(sr); ferr == nil && !ok {
+				return nil, errors.Wrapf(ErrNotEStargz, "failed to read layer: %v", err)
+			}
+		}
 		return nil, errors.Wrap(err, "failed to read layer")
 	}
 
+	// Make sure that the blob is kept served with the same contents even after
+	// it's re-resolved.
+	if b, ok := blobR.Blob.(remote.IdentityVerifiableBlob); ok {
+		if tocBlob != nil {
+			v, err := footerVerifier(sr)
+			if err != nil {
+				return nil, err
+			}
+			b.SetIdentityVerifier(v)
+		} else {
+			b.SetIdentityVerifier(tocVerifier(vr.TOCDigest()))
+		}
+	}
+
 	// Combine layer information together and cache it.
 	l := newLayer(r, desc, blobR, vr)
-	r.layerCacheMu.Lock()
+	l.fsCache = fsCache
+	l.tenant = tenant
+	l.name = name
 	cachedL, done2, added := r.layerCache.Add(name, l)
-	r.layerCacheMu.Unlock()
-	if !added {
+	if added {
+		reserved = false // uncounted on eviction
+	} else {
 		l.close() // layer already exists in the cache. discrad this.
 	}
 
 	log.G(ctx).Debugf("resolved")
-	return &layerRef{cachedL.(*layer), done2}, nil
+	return &layerRef{cachedL.(*layer), r.layers.add(key, cachedL.(*layer), done2)}, nil
 }
 
 // resolveBlob resolves a blob based on the passed layer blob information.
 func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (_ *blobRef, retErr error) {
-	name := refspec.String() + "/" + desc.Digest.String()
+	name := r.cacheKey(ctx, refspec, desc)
 
 	// Try to retrieve the blob from the underlying LRU cache.
-	r.blobCacheMu.Lock()
 	c, done, ok := r.blobCache.Get(name)
-	r.blobCacheMu.Unlock()
 	if ok {
 		if blob := c.(remote.Blob); blob.Check() == nil {
 			return &blobRef{blob, done}, nil
 		}
 		// invalid blob. discard this.
 		done()
-		r.blobCacheMu.Lock()
 		r.blobCache.Remove(name)
-		r.blobCacheMu.Unlock()
 	}
 
-	httpCache, err := newCache(filepath.Join(r.rootDir, "httpcache"), r.config.HTTPCacheType, r.config)
+	httpCache, err := r.newCache(filepath.Join(r.cacheRoot(ctx), "httpcache"), r.config.HTTPCacheType)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to create http cache")
 	}
@@ -325,9 +613,7 @@ func (r *Resolver) resolveBlob(ctx context.Context, hosts source.RegistryHosts,
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to resolve the source")
 	}
-	r.blobCacheMu.Lock()
 	cachedB, done, added := r.blobCache.Add(name, b)
-	r.blobCacheMu.Unlock()
 	if !added {
 		b.Close() // blob already exists in the cache. discard this.
 	}
@@ -346,6 +632,43 @@ func (r *Resolver) Cache(ctx context.Context, hosts source.RegistryHosts, refspe
 	return nil
 }
 
+// CacheStats is the statistics of the in-memory caches of the resolver.
+type CacheStats struct {
+	// Layers and Blobs are the numbers of resolved layers and blobs kept for
+	// reuse (including ones in use).
+	Layers int
+	Blobs  int
+
+	// LayersInUse is the number of layers referred by mounts.
+	LayersInUse int
+}
+
+// InvalidateTransports makes the resolved blobs re-resolve their transports to
+// registries on their next fetch. This is used when the credentials of
+// registries are changed.
+func (r *Resolver) InvalidateTransports() {
+	r.resolver.InvalidateTransports()
+}
+
+// EvictCaches evicts the resolved layers and blobs which aren't used by mounts
+// from the in-memory caches. The contents cached for them on the node are
+// removed. The returned stats reports the numbers of evicted layers and blobs.
+func (r *Resolver) EvictCaches() CacheStats {
+	// Layers refer to their blobs so they are evicted first.
+	layers := r.layerCache.RemoveUnused()
+	blobs := r.blobCache.RemoveUnused()
+	return CacheStats{Layers: len(layers), Blobs: len(blobs)}
+}
+
+// CacheStats returns the statistics of the in-memory caches of the resolver.
+func (r *Resolver) CacheStats() CacheStats {
+	return CacheStats{
+		Layers:      r.layerCache.Len(),
+		Blobs:       r.blobCache.Len(),
+		LayersInUse: r.layers.len(),
+	}
+}
+
 func newLayer(
 	resolver *Resolver,
 	desc ocispec.Descriptor,
@@ -363,23 +686,71 @@ func newLayer(
 
 type layer struct {
 	resolver         *Resolver
+	tenant           string
+	name             string // the key in the resolver's cache
 	desc             ocispec.Descriptor
 	blob             *blobRef
 	verifiableReader *reader.VerifiableReader
+	fsCache          cache.BlobCache // cache of the decompressed contents
 	prefetchWaiter   *waiter
 
 	r reader.Reader
 
+	// speculated is the set of files whose remaining chunks have been fetched
+	// speculatively.
+	speculated sync.Map
+
+	// prefetchErr is the error of the prefetch. The layer is served in a
+	// degraded mode (i.e. on demand only) if non-nil.
+	prefetchErr   error
+	prefetchErrMu sync.Mutex
+	prefetchTask  sharedTask
+
+	backgroundFetchTask sharedTask
+
+	// verifiedTOC is the TOC digest the layer has been verified with. Empty if
+	// the layer isn't verified yet or verification has been skipped.
+	verifiedTOC digest.Digest
+	verifyMu    sync.Mutex
+
 	closed   bool
 	closedMu sync.Mutex
 }
 
 func (l *layer) Info() Info {
-	return Info{
+	info := Info{
 		Digest:      l.desc.Digest,
 		Size:        l.blob.Size(),
 		FetchedSize: l.blob.FetchedSize(),
+		Degraded:    l.degradation(),
+	}
+	if b, ok := l.blob.Blob.(remote.ReadStatsBlob); ok {
+		info.OnDemandFetchedSize = b.OnDemandFetchedSize()
+		info.OnDemandFetchDuration = b.OnDemandFetchDuration()
+		info.FetchDuration = b.FetchDuration()
+	}
+	if r, ok := l.r.(reader.StatsReader); ok {
+		stats := r.ReadStats()
+		info.ReadRequestedSize = stats.RequestedSize
+		info.ReadDecompressedSize = stats.DecompressedSize
+		info.ReadCachedSize = stats.CachedSize
+	}
+	return info
+}
+
+// degradation returns the reasons why the layer is served in a degraded mode.
+func (l *layer) degradation() (reasons []string) {
+	if b, ok := l.blob.Blob.(remote.DegradableBlob); ok {
+		if err := b.Degraded(); err != nil {
+			reasons = append(reasons, err.Error())
+		}
 	}
+	l.prefetchErrMu.Lock()
+	if l.prefetchErr != nil {
+		reasons = append(reasons, l.prefetchErr.Error())
+	}
+	l.prefetchErrMu.Unlock()
+	return
 }
 
 func (l *layer) Check() error {
@@ -396,21 +767,104 @@ func (l *layer) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec
 	return l.blob.Refresh(ctx, hosts, refspec, desc)
 }
 
-func (l *layer) Verify(tocDigest digest.Digest) (err error) {
+// Verify verifies the layer. The layer is shared among mounts so this is no-op
+// if the layer has already been verified with the same TOC digest.
+func (l *layer) Verify(tocDigest digest.Digest) error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
 	}
-	l.r, err = l.verifiableReader.VerifyTOC(tocDigest)
-	return
+	l.verifyMu.Lock()
+	defer l.verifyMu.Unlock()
+	if l.r != nil && l.verifiedTOC == tocDigest {
+		return nil
+	}
+	r, err := l.verifiableReader.VerifyTOC(tocDigest)
+	if err != nil {
+		return err
+	}
+	l.r, l.verifiedTOC = r, tocDigest
+	return nil
 }
 
+func (l *layer) TOCDigest() digest.Digest {
+	return l.verifiableReader.TOCDigest()
+}
+
+// tocVerifier returns the verifier of the identity of a blob, which checks the
+// digest of the TOC JSON of the blob.
+func tocVerifier(tocDigest digest.Digest) remote.IdentityVerifier {
+	return func(ra io.ReaderAt, size int64) error {
+		r, err := estargz.Open(io.NewSectionReader(ra, 0, size))
+		if err != nil {
+			return errors.Wrap(err, "failed to parse layer")
+		}
+		if d := r.TOCDigest(); d != tocDigest {
+			return fmt.Errorf("TOC digest %q doesn't match to %q", d, tocDigest)
+		}
+		return nil
+	}
+}
+
+// SkipVerify skips verification of the layer. This doesn't disable verification
+// if the layer has already been verified by another mount. Chunks are still
+// checked with their digests in the TOC to detect corruption.
 func (l *layer) SkipVerify() {
-	l.r = l.verifiableReader.SkipVerify()
+	l.verifyMu.Lock()
+	defer l.verifyMu.Unlock()
+	if l.r == nil {
+		l.r = l.verifiableReader.SkipVerify()
+	}
+}
+
+// Prefetch prefetches the layer. The layer is shared among mounts so this is
+// done only once and the following calls return the result of the first one.
+// PrefetchOption is an option of Prefetch and BackgroundFetch.
+type PrefetchOption func(*prefetchOptions)
+
+type prefetchOptions struct {
+	ctx    context.Context
+	shadow *Shadow
+}
+
+// WithContext ties the fetch to the context (e.g. the one of the mount). The
+// fetch shared among mounts is cancelled when the contexts of all of them are
+// done.
+func WithContext(ctx context.Context) PrefetchOption {
+	return func(opts *prefetchOptions) {
+		opts.ctx = ctx
+	}
 }
 
-func (l *layer) Prefetch(prefetchSize int64) error {
-	defer l.prefetchWaiter.done() // Notify the completion
+// WithShadow skips fetching files hidden by the shadow (i.e. by the upper
+// layers of the image).
+func WithShadow(shadow *Shadow) PrefetchOption {
+	return func(opts *prefetchOptions) {
+		opts.shadow = shadow
+	}
+}
 
+func (l *layer) Prefetch(prefetchSize int64, opts ...PrefetchOption) error {
+	var prefetchOpts prefetchOptions
+	for _, o := range opts {
+		o(&prefetchOpts)
+	}
+	return l.prefetchTask.do(prefetchOpts.ctx, func(ctx context.Context) error {
+		err := l.prefetch(ctx, prefetchSize, prefetchOpts.shadow)
+		if ctx.Err() != nil {
+			return ctx.Err() // restarted by the next call
+		}
+		defer l.prefetchWaiter.done() // Notify the completion
+		if err != nil {
+			// Keep serving the layer on demand.
+			l.prefetchErrMu.Lock()
+			l.prefetchErr = err
+			l.prefetchErrMu.Unlock()
+		}
+		return err
+	})
+}
+
+func (l *layer) prefetch(ctx context.Context, prefetchSize int64, shadow *Shadow) error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
 	}
@@ -430,13 +884,35 @@ func (l *layer) Prefetch(prefetchSize int64) error {
 	}
 
 	// Fetch the target range
-	if err := l.blob.Cache(0, prefetchSize); err != nil {
-		return errors.Wrap(err, "failed to prefetch layer")
+	if shadow == nil {
+		if err := l.blob.Cache(0, prefetchSize, remote.WithContext(ctx)); err != nil {
+			return errors.Wrap(err, "failed to prefetch layer")
+		}
+	} else {
+		// Files hidden by the upper layers are never exposed. Fetch only the
+		// ranges of the files visible in the merged rootfs.
+		root, ok := lr.Lookup("")
+		if !ok {
+			return fmt.Errorf("failed to get a TOCEntry of the root")
+		}
+		regions, skipped, err := prefetchRegions(root, prefetchSize, shadow)
+		if err != nil {
+			return errors.Wrap(err, "failed to plan prefetch")
+		}
+		for _, reg := range regions {
+			if err := l.blob.Cache(reg.begin, reg.end-reg.begin, remote.WithContext(ctx)); err != nil {
+				return errors.Wrap(err, "failed to prefetch layer")
+			}
+		}
+		if skipped > 0 {
+			logrus.WithField("digest", l.desc.Digest).Debugf("skipped prefetching %d files hidden by upper layers", skipped)
+		}
 	}
 
 	// Cache uncompressed contents of the prefetched range
-	if err := lr.Cache(reader.WithFilter(func(e *estargz.TOCEntry) bool {
-		return e.Offset < prefetchSize // Cache only prefetch target
+	if err := lr.Cache(reader.WithContext(ctx), reader.WithFilter(func(e *estargz.TOCEntry) bool {
+		// Cache only prefetch target
+		return e.Offset < prefetchSize && (shadow == nil || !shadow.Shadowed(e.Name))
 	})); err != nil {
 		return errors.Wrap(err, "failed to cache prefetched layer")
 	}
@@ -444,6 +920,21 @@ func (l *layer) Prefetch(prefetchSize int64) error {
 	return nil
 }
 
+func (l *layer) Shadow() (*Shadow, error) {
+	if l.isClosed() {
+		return nil, fmt.Errorf("layer is already closed")
+	}
+	root, ok := l.verifiableReader.LookupUnverified("")
+	if !ok {
+		return nil, fmt.Errorf("failed to get a TOCEntry of the root")
+	}
+	s := NewShadow()
+	if err := s.add(root, "/", 0); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
 func (l *layer) WaitForPrefetchCompletion() error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
@@ -451,7 +942,43 @@ func (l *layer) WaitForPrefetchCompletion() error {
 	return l.prefetchWaiter.wait(l.resolver.prefetchTimeout)
 }
 
-func (l *layer) BackgroundFetch() error {
+// ErrNotEStargz is returned by Resolve when the layer doesn't have the footer of
+// eStargz (e.g. a plain gzip layer). Other failures (e.g. network errors) don't
+// return this.
+var ErrNotEStargz = errors.New("layer isn't eStargz")
+
+// hasEStargzFooter returns true if the blob ends with the footer of eStargz. An
+// error is returned only if the footer can't be read.
+func hasEStargzFooter(sr *io.SectionReader) (bool, error) {
+	if sr.Size() < estargz.FooterSize {
+		return false, nil
+	}
+	footer := make([]byte, estargz.FooterSize)
+	if _, err := sr.ReadAt(footer, sr.Size()-estargz.FooterSize); err != nil && err != io.EOF {
+		return false, err
+	}
+	_, _, err := estargz.OpenFooter(io.NewSectionReader(bytes.NewReader(footer), 0, estargz.FooterSize))
+	return err == nil, nil
+}
+
+// ErrPartiallyFetched is returned by BackgroundFetch when files hidden by the
+// upper layers are skipped. The layer isn't fully cached in this case.
+var ErrPartiallyFetched = errors.New("files hidden by upper layers aren't fetched")
+
+// BackgroundFetch fetches the whole layer. The layer is shared among mounts so
+// this is done only once and the following calls wait for and return the result
+// of the first one, unless it's partially fetched.
+func (l *layer) BackgroundFetch(opts ...PrefetchOption) error {
+	var fetchOpts prefetchOptions
+	for _, o := range opts {
+		o(&fetchOpts)
+	}
+	return l.backgroundFetchTask.do(fetchOpts.ctx, func(ctx context.Context) error {
+		return l.backgroundFetch(ctx, fetchOpts.shadow)
+	})
+}
+
+func (l *layer) backgroundFetch(ctx context.Context, shadow *Shadow) error {
 	if l.isClosed() {
 		return fmt.Errorf("layer is already closed")
 	}
@@ -460,34 +987,117 @@ func (l *layer) BackgroundFetch() error {
 	}
 	lr := l.r
 	br := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (retN int, retErr error) {
-		l.resolver.backgroundTaskManager.InvokeBackgroundTask(func(ctx context.Context) {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		l.resolver.backgroundTaskManager.InvokeBackgroundTask(func(taskCtx context.Context) {
+			// The read is cancelled by prioritized tasks or by the fetch.
+			taskCtx, cancel := context.WithCancel(taskCtx)
+			defer cancel()
+			go func() {
+				select {
+				case <-ctx.Done():
+					cancel()
+				case <-taskCtx.Done():
+				}
+			}()
 			retN, retErr = l.blob.ReadAt(
 				p,
 				offset,
-				remote.WithContext(ctx),              // Make cancellable
+				remote.WithContext(taskCtx),          // Make cancellable
 				remote.WithCacheOpts(cache.Direct()), // Do not pollute mem cache
 			)
 		}, 120*time.Second)
+		if err := l.resolver.backgroundTaskManager.WaitBandwidth(ctx, retN); err != nil && retErr == nil {
+			retErr = err
+		}
 		return
 	}), 0, l.blob.Size())
-	return lr.Cache(
+	var skipped int64
+	if err := lr.Cache(
+		reader.WithContext(ctx),
 		reader.WithReader(br),                // Read contents in background
 		reader.WithCacheOpts(cache.Direct()), // Do not pollute mem cache
-	)
+		reader.WithWorkers(l.resolver.config.BackgroundFetchWorkers),
+		reader.WithFilter(func(e *estargz.TOCEntry) bool {
+			if shadow != nil && shadow.Shadowed(e.Name) {
+				atomic.AddInt64(&skipped, 1) // never exposed in the merged rootfs
+				return false
+			}
+			return true
+		}),
+	); err != nil {
+		return err
+	}
+	if skipped > 0 {
+		logrus.WithField("digest", l.desc.Digest).Debugf("skipped fetching %d files hidden by upper layers in background", skipped)
+		return ErrPartiallyFetched
+	}
+	return nil
+}
+
+func (l *layer) Pin(pinned bool) {
+	if !pinned {
+		l.resolver.layerCache.Unpin(l.name)
+	} else if !l.resolver.layerCache.Pin(l.name) {
+		log.L.WithField("key", l.name).Debug("layer to pin isn't cached")
+	}
+	// Cached contents must not be evicted from the disk as well.
+	if pc, ok := l.fsCache.(cache.PinnableCache); ok {
+		pc.Pin(pinned)
+	}
+	if pb, ok := l.blob.Blob.(remote.PinnableBlob); ok {
+		pb.Pin(pinned)
+	}
 }
 
 func (l *layerRef) Done() {
 	l.done()
 }
 
-func (l *layer) RootNode() (fusefs.InodeEmbedder, error) {
+func (l *layer) RootNode(opts ...NodeOption) (fusefs.InodeEmbedder, error) {
 	if l.isClosed() {
 		return nil, fmt.Errorf("layer is already closed")
 	}
 	if l.r == nil {
 		return nil, fmt.Errorf("layer hasn't been verified yet")
 	}
-	return newNode(l.desc.Digest, l.r, l.blob)
+	if l.resolver.config.SpeculativeFetchSize > 0 {
+		opts = append(opts, withFirstChunkHook(l.speculate))
+	}
+	opts = append(opts, withDegradation(l.degradation))
+	return newNode(l.desc.Digest, l.r, l.blob, opts...)
+}
+
+// speculate fetches the remaining chunks of the file in background. This is
+// called when the first chunk of the file is read.
+func (l *layer) speculate(e *estargz.TOCEntry) {
+	if e.Size <= e.ChunkSize || e.Size > l.resolver.config.SpeculativeFetchSize {
+		return
+	}
+	if _, loaded := l.speculated.LoadOrStore(e, struct{}{}); loaded {
+		return
+	}
+	go func() {
+		ra, err := l.r.OpenFile(e.Name)
+		if err != nil {
+			log.L.WithError(err).Debugf("failed to open %q for speculative fetch", e.Name)
+			return
+		}
+		buf := make([]byte, e.ChunkSize)
+		for off := e.ChunkSize; off < e.Size; off += e.ChunkSize {
+			if l.isClosed() {
+				return
+			}
+			// Wait until no prioritized task is running. The read isn't done inside
+			// the background task because it can't be cancelled and restarted.
+			l.resolver.backgroundTaskManager.InvokeBackgroundTask(func(context.Context) {}, 120*time.Second)
+			if _, err := ra.ReadAt(buf, off); err != nil && err != io.EOF {
+				log.L.WithError(err).Debugf("failed to speculatively fetch %q", e.Name)
+				return
+			}
+		}
+	}()
 }
 
 func (l *layer) ReadAt(p []byte, offset int64, opts ...remote.Option) (int, error) {
@@ -580,6 +1190,78 @@ func (w *waiter) wait(timeout time.Duration) error {
 	}
 }
 
+// sharedTask is a task of the layer (e.g. prefetch) shared among the mounts.
+// The task is done only once. If the contexts of all callers waiting for the
+// task are done (e.g. the layer is unmounted quickly), the task is cancelled
+// and restarted by the next call. The zero value is ready to use.
+type sharedTask struct {
+	mu       sync.Mutex
+	run      *taskRun
+	finished bool
+	err      error // the result of the task after finished
+}
+
+type taskRun struct {
+	cancel  context.CancelFunc
+	waiters int
+	done    chan struct{}
+	err     error
+}
+
+// do runs f if it isn't running and waits for its completion. The context of f
+// is cancelled when the contexts of all callers waiting for it are done. nil
+// ctx is never done.
+func (t *sharedTask) do(ctx context.Context, f func(ctx context.Context) error) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	t.mu.Lock()
+	if t.finished {
+		t.mu.Unlock()
+		return t.err
+	}
+	r := t.run
+	if r == nil {
+		runCtx, cancel := context.WithCancel(context.Background())
+		r = &taskRun{cancel: cancel, done: make(chan struct{})}
+		t.run = r
+		go func() {
+			err := f(runCtx)
+			t.mu.Lock()
+			if runCtx.Err() == nil && !errors.Is(err, ErrPartiallyFetched) {
+				// Partially fetched layers are fetched again by the next
+				// call, which may be of another image hiding other files.
+				t.finished, t.err = true, err
+			}
+			if t.run == r {
+				t.run = nil
+			}
+			r.err = err
+			t.mu.Unlock()
+			cancel()
+			close(r.done)
+		}()
+	}
+	r.waiters++
+	t.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		t.mu.Lock()
+		if r.waiters--; r.waiters == 0 {
+			// Nobody needs the result anymore.
+			r.cancel()
+			if t.run == r {
+				t.run = nil
+			}
+		}
+		t.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
 type readerAtFunc func([]byte, int64) (int, error)
 
 func (f readerAtFunc) ReadAt(p []byte, offset int64) (int, error) { return f(p, offset) }
@@ -23,22 +23,34 @@
 package layer
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/config"
 	"github.com/containerd/stargz-snapshotter/fs/reader"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/task"
+	"github.com/containerd/stargz-snapshotter/util/lrucache"
 	"github.com/containerd/stargz-snapshotter/util/testutil"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -178,6 +190,175 @@ func TestPrefetch(t *testing.T) {
 	}
 }
 
+func TestPrefetchFailure(t *testing.T) {
+	sr, dgst, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.File("foo.txt", sampleData1),
+	}, testutil.WithEStargzOptions(
+		estargz.WithChunkSize(sampleChunkSize),
+		estargz.WithPrioritizedFiles([]string{"foo.txt"}),
+	))
+	if err != nil {
+		t.Fatalf("failed to build eStargz: %v", err)
+	}
+	vr, err := reader.NewReader(sr, cache.NewMemoryCache())
+	if err != nil {
+		t.Fatalf("failed to make stargz reader: %v", err)
+	}
+	l := newLayer(
+		&Resolver{prefetchTimeout: time.Second},
+		ocispec.Descriptor{Digest: testStateLayerDigest},
+		&blobRef{&failingCacheBlob{newBlob(sr)}, func() {}},
+		vr,
+	)
+	if err := l.Verify(dgst); err != nil {
+		t.Fatalf("failed to verify reader: %v", err)
+	}
+	if d := l.Info().Degraded; len(d) != 0 {
+		t.Fatalf("layer must not be degraded before prefetch: %v", d)
+	}
+	if err := l.Prefetch(sr.Size()); err == nil {
+		t.Fatalf("prefetch must fail")
+	}
+	if d := l.Info().Degraded; len(d) != 1 {
+		t.Errorf("layer must be degraded after failed prefetch: %v", d)
+	}
+
+	// The layer is still served on demand.
+	ra, err := l.r.OpenFile("foo.txt")
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	data := make([]byte, len(sampleData1))
+	if _, err := ra.ReadAt(data, 0); err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if string(data) != sampleData1 {
+		t.Errorf("unexpected contents %q; want %q", string(data), sampleData1)
+	}
+}
+
+// Tests layers are refused unless their TOC matches the digest in the manifest.
+// Layers are shared among mounts so each mount verifies it with its own digest.
+func TestVerify(t *testing.T) {
+	sr, dgst, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.File("foo.txt", sampleData1),
+	}, testutil.WithEStargzOptions(estargz.WithChunkSize(sampleChunkSize)))
+	if err != nil {
+		t.Fatalf("failed to build eStargz: %v", err)
+	}
+	vr, err := reader.NewReader(sr, cache.NewMemoryCache())
+	if err != nil {
+		t.Fatalf("failed to make stargz reader: %v", err)
+	}
+	l := newLayer(
+		&Resolver{prefetchTimeout: time.Second},
+		ocispec.Descriptor{Digest: testStateLayerDigest},
+		&blobRef{newBlob(sr), func() {}},
+		vr,
+	)
+	if _, err := l.RootNode(); err == nil {
+		t.Fatalf("layer must not be served before verification")
+	}
+	wrong := digest.FromString("wrong")
+	if err := l.Verify(wrong); err == nil {
+		t.Fatalf("layer with mismatching TOC digest must be refused")
+	}
+	if _, err := l.RootNode(); err == nil {
+		t.Fatalf("layer must not be served after failed verification")
+	}
+	if err := l.Verify(dgst); err != nil {
+		t.Fatalf("failed to verify layer: %v", err)
+	}
+	if _, err := l.RootNode(); err != nil {
+		t.Fatalf("failed to get root node of verified layer: %v", err)
+	}
+	if err := l.Verify(wrong); err == nil {
+		t.Errorf("verified layer must be refused with mismatching TOC digest")
+	}
+}
+
+// failingCacheBlob fails to cache (i.e. prefetch) the contents.
+type failingCacheBlob struct {
+	*sampleBlob
+}
+
+func (fb *failingCacheBlob) Cache(offset int64, size int64, option ...remote.Option) error {
+	return fmt.Errorf("failed to fetch")
+}
+
+func TestSpeculativeFetch(t *testing.T) {
+	sr, dgst, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.File("foo.txt", sampleData1),
+	}, testutil.WithEStargzOptions(
+		estargz.WithChunkSize(sampleChunkSize),
+		estargz.WithPrioritizedFiles([]string{"foo.txt"}),
+	))
+	if err != nil {
+		t.Fatalf("failed to build eStargz: %v", err)
+	}
+	blob := newBlob(sr)
+	ccache := &countingCache{BlobCache: cache.NewMemoryCache()}
+	vr, err := reader.NewReader(sr, ccache)
+	if err != nil {
+		t.Fatalf("failed to make stargz reader: %v", err)
+	}
+	l := newLayer(
+		&Resolver{
+			backgroundTaskManager: task.NewBackgroundTaskManager(1, time.Millisecond),
+			config:                config.Config{SpeculativeFetchSize: int64(len(sampleData1))},
+		},
+		ocispec.Descriptor{Digest: testStateLayerDigest},
+		&blobRef{blob, func() {}},
+		vr,
+	)
+	if err := l.Verify(dgst); err != nil {
+		t.Fatalf("failed to verify reader: %v", err)
+	}
+	e, ok := l.r.Lookup("foo.txt")
+	if !ok {
+		t.Fatalf("failed to lookup foo.txt")
+	}
+
+	// Remaining chunks are fetched in background.
+	l.speculate(e)
+	l.speculate(e) // only once
+	want := int64(chunkNum(sampleData1) - 1)
+	for i := 0; atomic.LoadInt64(&ccache.committed) < want; i++ {
+		if i > 100 {
+			t.Fatalf("remaining chunks aren't fetched: %d; want %d", atomic.LoadInt64(&ccache.committed), want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt64(&ccache.committed); n != want {
+		t.Errorf("number of fetched chunks %d; want %d", n, want)
+	}
+}
+
+// countingCache counts the committed contents.
+type countingCache struct {
+	cache.BlobCache
+	committed int64
+}
+
+func (c *countingCache) Add(key string, opts ...cache.Option) (cache.Writer, error) {
+	w, err := c.BlobCache.Add(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &countingWriter{w, &c.committed}, nil
+}
+
+type countingWriter struct {
+	cache.Writer
+	committed *int64
+}
+
+func (w *countingWriter) Commit() error {
+	atomic.AddInt64(w.committed, 1)
+	return w.Writer.Commit()
+}
+
 func chunkNum(data string) int {
 	return (len(data)-1)/sampleChunkSize + 1
 }
@@ -239,3 +420,481 @@ func TestWaiter(t *testing.T) {
 		t.Errorf("wait time is too short: %v; want %v", doneTime.Sub(startTime), waitTime)
 	}
 }
+
+func TestSharedTask(t *testing.T) {
+	var (
+		task    sharedTask
+		runs    int32
+		started = make(chan struct{}, 10)
+		finish  = make(chan struct{})
+	)
+	f := func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		started <- struct{}{}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-finish:
+			return fmt.Errorf("result")
+		}
+	}
+	do := func(ctx context.Context) <-chan error {
+		errCh := make(chan error, 1)
+		go func() { errCh <- task.do(ctx, f) }()
+		return errCh
+	}
+
+	// The task keeps running while a caller is waiting for it.
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	errCh1 := do(ctx1)
+	<-started
+	errCh2 := do(ctx2)
+	for waiting := 0; waiting < 2; time.Sleep(time.Millisecond) {
+		task.mu.Lock()
+		waiting = task.run.waiters
+		task.mu.Unlock()
+	}
+	cancel1()
+	if err := <-errCh1; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled caller got %v; want %v", err, context.Canceled)
+	}
+	select {
+	case err := <-errCh2:
+		t.Fatalf("task must not be cancelled while a caller is waiting: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// The task is cancelled when all callers are gone and restarted by the next.
+	cancel2()
+	<-errCh2
+	errCh3 := do(context.Background())
+	<-started
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Errorf("task ran %d times; want 2", n)
+	}
+	close(finish)
+	if err := <-errCh3; err == nil || err.Error() != "result" {
+		t.Errorf("got %v; want the result of the task", err)
+	}
+
+	// The task isn't run again after completion.
+	if err := <-do(context.Background()); err == nil || err.Error() != "result" {
+		t.Errorf("got %v; want the result of the task", err)
+	}
+	if n := atomic.LoadInt32(&runs); n != 2 {
+		t.Errorf("task ran %d times; want 2", n)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	refspec, err := reference.Parse("example.com/test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{Digest: testStateLayerDigest}
+	ctxA := WithTenant(context.Background(), "tenant-a")
+	ctxB := WithTenant(context.Background(), "../tenant-b")
+
+	for _, isolate := range []bool{true, false} {
+		var cfg config.Config
+		cfg.IsolateTenants = isolate
+		r := &Resolver{rootDir: "/root", config: cfg}
+		keyA, keyB := r.cacheKey(ctxA, refspec, desc), r.cacheKey(ctxB, refspec, desc)
+		rootA, rootB := r.cacheRoot(ctxA), r.cacheRoot(ctxB)
+		if isolate {
+			if keyA == keyB || rootA == rootB {
+				t.Errorf("caches must be isolated: keys (%q, %q), roots (%q, %q)", keyA, keyB, rootA, rootB)
+			}
+			for _, root := range []string{rootA, rootB} {
+				if filepath.Dir(root) != "/root/tenants" {
+					t.Errorf("cache root %q must be under the tenants directory", root)
+				}
+			}
+		} else if keyA != keyB || rootA != rootB {
+			t.Errorf("caches must be shared: keys (%q, %q), roots (%q, %q)", keyA, keyB, rootA, rootB)
+		}
+	}
+}
+
+func TestPrivateTenant(t *testing.T) {
+	refspec, err := reference.Parse("example.com/test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{Digest: testStateLayerDigest}
+
+	// Layers resolved with private credentials are isolated even if the tenant
+	// isolation is disabled.
+	r := &Resolver{rootDir: "/root"}
+	shared := WithTenant(context.Background(), "tenant-a")
+	private := WithPrivateTenant(context.Background(), "tenant-a")
+	other := WithPrivateTenant(context.Background(), "tenant-b")
+	keys := map[string]bool{}
+	for _, ctx := range []context.Context{shared, private, other} {
+		keys[r.layerKey(ctx, desc)] = true
+		keys[r.cacheKey(ctx, refspec, desc)] = true
+	}
+	if len(keys) != 6 {
+		t.Errorf("layers of private tenants must not be shared: %v", keys)
+	}
+	if r.cacheRoot(private) == r.cacheRoot(shared) {
+		t.Errorf("caches of private tenants must not be shared")
+	}
+
+	// The tenant is inherited by the detached context.
+	if got := r.cacheKey(WithTenantOf(context.Background(), private), refspec, desc); got != r.cacheKey(private, refspec, desc) {
+		t.Errorf("private tenant isn't inherited: %q", got)
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	var cfg config.Config
+	cfg.IsolateTenants = true
+	cfg.MaxLayersPerTenant = 3
+	r := &Resolver{config: cfg, tenantLayers: make(map[string]int), tenantLayersMu: new(sync.Mutex)}
+
+	// Concurrent reservations never exceed the quota.
+	var (
+		reserved int32
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r.reserveTenantLayer("tenant-a") == nil {
+				atomic.AddInt32(&reserved, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if reserved != 3 {
+		t.Errorf("reserved %d layers; want 3", reserved)
+	}
+	if err := r.reserveTenantLayer("tenant-b"); err != nil {
+		t.Errorf("quota must be per tenant: %v", err)
+	}
+
+	// Released layers are available again.
+	releaseTenantLayer(r.tenantLayers, r.tenantLayersMu, "tenant-a")
+	if err := r.reserveTenantLayer("tenant-a"); err != nil {
+		t.Errorf("failed to reserve released layer: %v", err)
+	}
+}
+
+func TestDecompressor(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(sampleData1)); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to compress: %v", err)
+	}
+	for _, backend := range []string{"", config.DecompressionBackendStdlib, config.DecompressionBackendKlauspost} {
+		d, err := newDecompressor(config.Config{DecompressionBackend: backend})
+		if err != nil {
+			t.Fatalf("failed to get decompressor %q: %v", backend, err)
+		}
+		zr, err := d(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("failed to decompress with %q: %v", backend, err)
+		}
+		data, err := ioutil.ReadAll(zr)
+		zr.Close()
+		if err != nil || string(data) != sampleData1 {
+			t.Errorf("unexpected data decompressed by %q: %q (%v); want %q", backend, string(data), err, sampleData1)
+		}
+	}
+	if _, err := newDecompressor(config.Config{DecompressionBackend: "unknown"}); err == nil {
+		t.Errorf("unknown backend must be rejected")
+	}
+
+	// Only one stream can be decompressed at once.
+	d, err := newDecompressor(config.Config{MaxDecompressionWorkers: 1})
+	if err != nil {
+		t.Fatalf("failed to get decompressor: %v", err)
+	}
+	zr1, err := d(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to decompress: %v", err)
+	}
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		zr2, err := d(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Errorf("failed to decompress: %v", err)
+			return
+		}
+		zr2.Close()
+	}()
+	select {
+	case <-doneCh:
+		t.Fatalf("decompression must wait for the slot")
+	case <-time.After(100 * time.Millisecond):
+	}
+	zr1.Close()
+	select {
+	case <-doneCh:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("decompression must start after the slot is released")
+	}
+}
+
+func TestCachefilesCullingFallback(t *testing.T) {
+	if _, err := os.Stat(cache.DefaultCachefilesDevice); err == nil {
+		t.Skip("cachefiles is available on this host")
+	}
+	root, err := ioutil.TempDir("", "fscache")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	cfg := config.Config{FSCacheType: config.CacheTypeCachefilesCulling, HTTPCacheType: config.CacheTypeMemory}
+	if _, err := newCachefilesCulling(root, &cfg, nil); err == nil {
+		t.Errorf("cachefiles culling cache must fail without cachefiles")
+	}
+	cfg.CachefilesCullingConfig.FallbackToDirectory = true
+	if fc, err := newCachefilesCulling(root, &cfg, nil); err != nil || fc != nil {
+		t.Fatalf("cachefiles culling cache must fall back to directory cache: %v", err)
+	}
+	if cfg.FSCacheType != "" || cfg.HTTPCacheType != config.CacheTypeMemory {
+		t.Errorf("only cachefiles culling cache must be replaced with directory cache: %+v", cfg)
+	}
+}
+
+func TestNewEvictionPolicy(t *testing.T) {
+	if p, err := newEvictionPolicy(config.DirectoryCacheConfig{}); err != nil || p != nil {
+		t.Errorf("eviction must be disabled by default: %v, %v", p, err)
+	}
+	// cache_max_size_bytes is one budget of all caches.
+	p, err := newEvictionPolicy(config.DirectoryCacheConfig{CacheMaxSizeBytes: 10})
+	if err != nil || p == nil {
+		t.Fatalf("max size must enable size policy: %v", err)
+	}
+	p.Add("a", 6)
+	p.Add("b", 6)
+	if evicted := p.Evict(nil); len(evicted) != 1 || evicted[0] != "a" {
+		t.Errorf("evicted %v; want [a]", evicted)
+	}
+	if _, err := newEvictionPolicy(config.DirectoryCacheConfig{
+		CacheMaxSizeBytes:  10,
+		EvictionPolicy:     config.EvictionPolicyLFU,
+		EvictionMaxEntries: 1,
+	}); err == nil {
+		t.Errorf("max size must not be used with lfu policy")
+	}
+}
+
+func TestPrepareCacheRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "cacheroot")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	if dir, err := prepareCacheRoot(root, config.DirectoryCacheConfig{}); err != nil || dir != root {
+		t.Errorf("disk backend must use the root directory: %q, %v", dir, err)
+	}
+	if _, err := prepareCacheRoot(root, config.DirectoryCacheConfig{Backend: "unknown"}); err == nil {
+		t.Errorf("unknown backend must be rejected")
+	}
+	if _, err := prepareCacheRoot(root, config.DirectoryCacheConfig{Backend: config.CacheBackendFscrypt}); err == nil {
+		t.Errorf("fscrypt backend without key must be rejected")
+	}
+
+	if os.Geteuid() != 0 {
+		t.Skip("tmpfs backend test requires root")
+	}
+	dcc := config.DirectoryCacheConfig{Backend: config.CacheBackendTmpfs, TmpfsSize: "1m"}
+	dir, err := prepareCacheRoot(root, dcc)
+	if err != nil {
+		t.Fatalf("failed to prepare tmpfs: %v", err)
+	}
+	defer unix.Unmount(dir, 0)
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		t.Fatalf("failed to statfs: %v", err)
+	}
+	if st.Type != unix.TMPFS_MAGIC {
+		t.Errorf("tmpfs isn't mounted on %q", dir)
+	}
+	// tmpfs is reused on restart
+	if dir2, err := prepareCacheRoot(root, dcc); err != nil || dir2 != dir {
+		t.Errorf("failed to reuse tmpfs: %q, %v", dir2, err)
+	}
+	if err := unix.Unmount(dir, 0); err != nil {
+		t.Errorf("tmpfs must be mounted only once: %v", err)
+	}
+}
+
+func TestLayerSharing(t *testing.T) {
+	reg := testutil.NewRegistry()
+	defer reg.Close()
+	var layers []testutil.Layer
+	for _, data := range []string{sampleData1, sampleData2} {
+		l, err := testutil.BuildEStargzLayer([]testutil.TarEntry{testutil.File("foo.txt", data)})
+		if err != nil {
+			t.Fatalf("failed to build layer: %v", err)
+		}
+		layers = append(layers, l)
+	}
+	imgA, err := reg.PushImage("a", "latest", layers[0])
+	if err != nil {
+		t.Fatalf("failed to push image: %v", err)
+	}
+	imgB, err := reg.PushImage("b", "latest", layers...)
+	if err != nil {
+		t.Fatalf("failed to push image: %v", err)
+	}
+	root, err := ioutil.TempDir("", "sharing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	r, err := NewResolver(root, task.NewBackgroundTaskManager(1, time.Second), config.Config{
+		ResolveResultEntry: 1,
+		HTTPCacheType:      config.CacheTypeMemory,
+		FSCacheType:        config.CacheTypeMemory,
+	})
+	if err != nil {
+		t.Fatalf("failed to make resolver: %v", err)
+	}
+	resolve := func(ref string, desc ocispec.Descriptor) *layerRef {
+		refspec, err := reference.Parse(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := r.Resolve(context.Background(), reg.Hosts(), refspec, desc)
+		if err != nil {
+			t.Fatalf("failed to resolve %q: %v", desc.Digest, err)
+		}
+		return l.(*layerRef)
+	}
+
+	// The layer is shared between images.
+	la := resolve(imgA.Ref, layers[0].Desc)
+	lb := resolve(imgB.Ref, layers[0].Desc)
+	if la.layer != lb.layer {
+		t.Errorf("layer must be shared between images")
+	}
+
+	// The layer is still shared after it's evicted from the LRU cache.
+	other := resolve(imgB.Ref, layers[1].Desc)
+	defer other.Done()
+	la.Done()
+	lb2 := resolve(imgB.Ref, layers[0].Desc)
+	if lb2.layer != lb.layer {
+		t.Errorf("layer in use must be shared after eviction")
+	}
+	if lb.isClosed() {
+		t.Errorf("layer in use must not be closed")
+	}
+
+	// The layer is released when nobody refers to it.
+	lb.Done()
+	lb2.Done()
+	if n := r.layers.len(); n != 1 {
+		t.Errorf("%d layers are in use; want 1", n)
+	}
+	if !lb.isClosed() {
+		t.Errorf("released layer must be closed after eviction")
+	}
+}
+
+func TestResolveNotEStargz(t *testing.T) {
+	reg := testutil.NewRegistry()
+	defer reg.Close()
+	var gzData bytes.Buffer
+	zw := gzip.NewWriter(&gzData)
+	if _, err := io.Copy(zw, testutil.BuildTar([]testutil.TarEntry{testutil.File("foo.txt", sampleData1)})); err != nil {
+		t.Fatalf("failed to build layer: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to build layer: %v", err)
+	}
+	gzLayer := testutil.Layer{
+		Data: gzData.Bytes(),
+		Desc: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    digest.FromBytes(gzData.Bytes()),
+			Size:      int64(gzData.Len()),
+		},
+	}
+	img, err := reg.PushImage("gzip", "latest", gzLayer)
+	if err != nil {
+		t.Fatalf("failed to push image: %v", err)
+	}
+	refspec, err := reference.Parse(img.Ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewResolver(t.TempDir(), task.NewBackgroundTaskManager(1, time.Second), config.Config{
+		HTTPCacheType: config.CacheTypeMemory,
+		FSCacheType:   config.CacheTypeMemory,
+	})
+	if err != nil {
+		t.Fatalf("failed to make resolver: %v", err)
+	}
+	if _, err := r.Resolve(context.Background(), reg.Hosts(), refspec, gzLayer.Desc); errors.Cause(err) != ErrNotEStargz {
+		t.Errorf("resolving gzip layer: %v; want %v", err, ErrNotEStargz)
+	}
+
+	// Other failures aren't reported as non-eStargz.
+	missing := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    digest.FromString("missing"),
+		Size:      100,
+	}
+	if _, err := r.Resolve(context.Background(), reg.Hosts(), refspec, missing); err == nil || errors.Cause(err) == ErrNotEStargz {
+		t.Errorf("resolving missing layer: %v; want an error other than %v", err, ErrNotEStargz)
+	}
+}
+
+type pinnableCache struct {
+	cache.BlobCache
+	pinned bool
+}
+
+func (c *pinnableCache) Pin(pinned bool) { c.pinned = pinned }
+
+type pinnableBlob struct {
+	remote.Blob
+	pinned bool
+}
+
+func (b *pinnableBlob) Pin(pinned bool) { b.pinned = pinned }
+
+func TestPin(t *testing.T) {
+	r := &Resolver{layerCache: lrucache.New(1)}
+	fsCache, blob := &pinnableCache{BlobCache: cache.NewMemoryCache()}, &pinnableBlob{}
+	l := &layer{resolver: r, name: "pinned", fsCache: fsCache, blob: &blobRef{blob, func() {}}}
+	_, done, _ := r.layerCache.Add(l.name, l)
+	done()
+
+	l.Pin(true)
+	if !fsCache.pinned || !blob.pinned {
+		t.Errorf("caches of pinned layer must be pinned")
+	}
+	_, done, _ = r.layerCache.Add("other1", &layer{resolver: r, name: "other1"})
+	done()
+	if _, done, ok := r.layerCache.Get(l.name); !ok {
+		t.Fatalf("pinned layer must not be evicted")
+	} else {
+		done()
+	}
+
+	l.Pin(false)
+	if fsCache.pinned || blob.pinned {
+		t.Errorf("caches of unpinned layer must be unpinned")
+	}
+	_, done, _ = r.layerCache.Add("other2", &layer{resolver: r, name: "other2"})
+	done()
+	if _, _, ok := r.layerCache.Get(l.name); ok {
+		t.Errorf("unpinned layer must be evicted")
+	}
+}
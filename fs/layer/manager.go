@@ -0,0 +1,94 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"sync"
+)
+
+// layerManager owns the layers in use (e.g. mounted) keyed by the digest of the
+// layer. Layers are reference counted so mounts of the same layer from several
+// snapshots and images share the reader, the caches and the verification state
+// even after the layer is evicted from the resolver's LRU cache.
+type layerManager struct {
+	layers map[string]*managedLayer
+	mu     sync.Mutex
+}
+
+type managedLayer struct {
+	l    *layer
+	refs int
+
+	// release releases the reference to the resolver's cache. This is called
+	// when nobody refers to the layer.
+	release func()
+}
+
+func newLayerManager() *layerManager {
+	return &layerManager{layers: make(map[string]*managedLayer)}
+}
+
+// get returns the layer managed with the key with incrementing the reference
+// count. The caller must call done when the layer will no longer be used.
+func (m *layerManager) get(key string) (l *layer, done func(), ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ml, ok := m.layers[key]
+	if !ok {
+		return nil, nil, false
+	}
+	ml.refs++
+	return ml.l, m.doneFunc(key, ml), true
+}
+
+// add starts managing the layer with the key and returns the reference to the
+// layer. release is called when nobody refers to the layer. If another layer is
+// managed with the same key, that is replaced but kept alive until its
+// references are released.
+func (m *layerManager) add(key string, l *layer, release func()) (done func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ml := &managedLayer{l: l, refs: 1, release: release}
+	m.layers[key] = ml
+	return m.doneFunc(key, ml)
+}
+
+// len returns the number of the managed layers.
+func (m *layerManager) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.layers)
+}
+
+func (m *layerManager) doneFunc(key string, ml *managedLayer) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			ml.refs--
+			if ml.refs > 0 {
+				m.mu.Unlock()
+				return
+			}
+			if m.layers[key] == ml {
+				delete(m.layers, key)
+			}
+			m.mu.Unlock()
+			ml.release()
+		})
+	}
+}
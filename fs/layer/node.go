@@ -40,34 +40,158 @@ import (
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	"github.com/containerd/stargz-snapshotter/fs/reader"
 	"github.com/containerd/stargz-snapshotter/fs/remote"
+	"github.com/containerd/stargz-snapshotter/version"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	digest "github.com/opencontainers/go-digest"
-	"golang.org/x/sys/unix"
+	"github.com/pkg/errors"
 )
 
 const (
-	blockSize         = 4096
+	defaultBlockSize  = 4096
+	statBlockSize     = 512 // unit of st_blocks
 	whiteoutPrefix    = ".wh."
 	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
 	opaqueXattrValue  = "y"
 	stateDirName      = ".stargz-snapshotter"
 	statFileMode      = syscall.S_IFREG | 0400 // -r--------
 	stateDirMode      = syscall.S_IFDIR | 0500 // dr-x------
+	relatimeInterval  = 24 * time.Hour
+
+	// maxXattrSize is the maximum size of an xattr value and of an xattr list
+	// (XATTR_SIZE_MAX and XATTR_LIST_MAX in Linux).
+	maxXattrSize = 64 * 1024
 )
 
 var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
 
-func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob) (fusefs.InodeEmbedder, error) {
+// NodeOption is an option for the root node of the layer.
+type NodeOption func(*nodeOptions)
+
+type nodeOptions struct {
+	timestamp *time.Time
+	atimes    *atimeTracker // non-nil if relatime is enabled
+	owner     *fuse.Owner
+	umask     uint32
+
+	// onFirstChunk is called when the first chunk of a regular file is read.
+	onFirstChunk func(e *estargz.TOCEntry)
+
+	// upper stores modifications to the layer. nil if the layer is read-only.
+	upper *writableUpper
+
+	// features is reported in the state file.
+	features []string
+
+	// degradation returns the reasons why the layer is served in a degraded
+	// mode. These are reported in the state file.
+	degradation func() []string
+
+	// directIO makes reads of files bypass the page cache.
+	directIO bool
+
+	// blockSize is the block size reported in st_blksize and statfs. Zero
+	// means defaultBlockSize.
+	blockSize uint32
+}
+
+// WithTimestamp presents the specified timestamp as mtime, atime and ctime of all
+// files in the layer instead of the modification times recorded in the layer.
+func WithTimestamp(t time.Time) NodeOption {
+	return func(opts *nodeOptions) {
+		opts.timestamp = &t
+	}
+}
+
+// WithRelatime updates access times of files in the layer following the semantics
+// of relatime mount option. Access times are kept in memory. By default, access
+// times aren't updated (i.e. noatime) and are the same as modification times.
+func WithRelatime() NodeOption {
+	return func(opts *nodeOptions) {
+		opts.atimes = &atimeTracker{atimes: make(map[*estargz.TOCEntry]time.Time)}
+	}
+}
+
+// WithOwner presents the specified owner for all files in the layer instead of the
+// owners recorded in the layer. This is useful for user-namespaced workloads and
+// workloads running with arbitrary UIDs.
+func WithOwner(uid, gid uint32) NodeOption {
+	return func(opts *nodeOptions) {
+		opts.owner = &fuse.Owner{Uid: uid, Gid: gid}
+	}
+}
+
+// WithUmask masks the permission bits of all files in the layer with the
+// specified umask.
+func WithUmask(umask uint32) NodeOption {
+	return func(opts *nodeOptions) {
+		opts.umask = umask
+	}
+}
+
+// WithFeatures reports the specified names of features enabled on the
+// filesystem in the state file of the layer.
+func WithFeatures(features []string) NodeOption {
+	return func(opts *nodeOptions) {
+		opts.features = features
+	}
+}
+
+// WithDirectIO opens files in the layer with direct I/O so that reads bypass
+// the page cache of the kernel.
+func WithDirectIO() NodeOption {
+	return func(opts *nodeOptions) {
+		opts.directIO = true
+	}
+}
+
+// WithBlockSize reports the specified block size as st_blksize of files and as
+// the block size of the filesystem. This is the preferred I/O size for clients
+// (e.g. the buffer size of cp). Defaults to 4096.
+func WithBlockSize(size uint32) NodeOption {
+	return func(opts *nodeOptions) {
+		opts.blockSize = size
+	}
+}
+
+func (opts *nodeOptions) blksize() uint32 {
+	if opts == nil || opts.blockSize == 0 {
+		return defaultBlockSize
+	}
+	return opts.blockSize
+}
+
+func withDegradation(fn func() []string) NodeOption {
+	return func(opts *nodeOptions) {
+		opts.degradation = fn
+	}
+}
+
+func withFirstChunkHook(fn func(e *estargz.TOCEntry)) NodeOption {
+	return func(opts *nodeOptions) {
+		opts.onFirstChunk = fn
+	}
+}
+
+func newNode(layerDgst digest.Digest, r reader.Reader, blob remote.Blob, opts ...NodeOption) (fusefs.InodeEmbedder, error) {
+	var nodeOpts nodeOptions
+	for _, o := range opts {
+		o(&nodeOpts)
+	}
 	root, ok := r.Lookup("")
 	if !ok {
 		return nil, fmt.Errorf("failed to get a TOCEntry of the root")
 	}
+	stateTime := time.Now()
+	if nodeOpts.timestamp != nil {
+		stateTime = *nodeOpts.timestamp
+	}
 	return &node{
 		r:        r,
 		e:        root,
-		s:        newState(layerDgst, blob),
+		s:        newState(layerDgst, blob, stateTime, &nodeOpts),
 		layerSha: layerDgst,
+		opts:     &nodeOpts,
 	}, nil
 }
 
@@ -79,6 +203,11 @@ type node struct {
 	s        *state
 	layerSha digest.Digest
 	opaque   bool // true if this node is an overlayfs opaque directory
+	opts     *nodeOptions
+
+	// path is the path of this node in the layer. This can be updated by rename
+	// when the layer is writable.
+	path string
 }
 
 var _ = (fusefs.InodeEmbedder)((*node)(nil))
@@ -93,7 +222,7 @@ func (n *node) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
 	var ents []fuse.DirEntry
 	whiteouts := map[string]*estargz.TOCEntry{}
 	normalEnts := map[string]bool{}
-	n.e.ForeachChild(func(baseName string, ent *estargz.TOCEntry) bool {
+	n.foreachLowerChild(func(baseName string, ent *estargz.TOCEntry) bool {
 
 		// We don't want to show prefetch landmarks in "/".
 		if n.e.Name == "" && (baseName == estargz.PrefetchLandmark || baseName == estargz.NoPrefetchLandmark) {
@@ -132,11 +261,19 @@ func (n *node) Readdir(ctx context.Context) (fusefs.DirStream, syscall.Errno) {
 		}
 	}
 
+	if n.opts.upper != nil {
+		ents = n.readdirUpper(ents)
+	}
+
 	// Avoid undeterministic order of entries on each call
 	sort.Slice(ents, func(i, j int) bool {
 		return ents[i].Name < ents[j].Name
 	})
 
+	if n.e != nil {
+		n.opts.touch(n.e)
+	}
+
 	return fusefs.NewListDirStream(ents), 0
 }
 
@@ -144,7 +281,7 @@ var _ = (fusefs.NodeLookuper)((*node)(nil))
 
 func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
 	// We don't want to show prefetch landmarks in "/".
-	if n.e.Name == "" && (name == estargz.PrefetchLandmark || name == estargz.NoPrefetchLandmark) {
+	if n.e != nil && n.e.Name == "" && (name == estargz.PrefetchLandmark || name == estargz.NoPrefetchLandmark) {
 		return nil, syscall.ENOENT
 	}
 
@@ -154,55 +291,94 @@ func (n *node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fu
 	}
 
 	// state directory
-	if n.e.Name == "" && name == stateDirName {
+	if n.e != nil && n.e.Name == "" && name == stateDirName {
 		return n.NewInode(ctx, n.s, stateToAttr(n.s, &out.Attr)), 0
 	}
 
+	// modifications to the layer
+	if n.opts.upper != nil {
+		if ch := n.lookupUpper(ctx, name, out); ch != nil {
+			return ch, 0
+		}
+	}
+
 	// lookup stargz TOCEntry
-	ce, ok := n.e.LookupChild(name)
+	ce, ok := n.lowerChild(name)
 	if !ok {
 		// If the entry exists as a whiteout, show an overlayfs-styled whiteout node.
-		if wh, ok := n.e.LookupChild(fmt.Sprintf("%s%s", whiteoutPrefix, name)); ok {
+		if wh, ok := n.lowerChild(fmt.Sprintf("%s%s", whiteoutPrefix, name)); ok && !n.opts.upper.isRemoved(n.childPath(name)) {
 			return n.NewInode(ctx, &whiteout{
-				e: wh,
-			}, entryToWhAttr(wh, &out.Attr)), 0
+				e:    wh,
+				opts: n.opts,
+			}, entryToWhAttr(wh, &out.Attr, n.opts)), 0
 		}
 		return nil, syscall.ENOENT
 	}
-	var opaque bool
-	if _, ok := ce.LookupChild(whiteoutOpaqueDir); ok {
-		// This entry is an opaque directory so make it recognizable for overlayfs.
-		opaque = true
-	}
 
-	return n.NewInode(ctx, &node{
-		r:        n.r,
-		e:        ce,
-		s:        n.s,
-		layerSha: n.layerSha,
-		opaque:   opaque,
-	}, entryToAttr(ce, &out.Attr)), 0
+	return n.NewInode(ctx, n.newChild(name, ce), entryToAttr(ce, &out.Attr, n.opts)), 0
 }
 
 var _ = (fusefs.NodeOpener)((*node)(nil))
 
 func (n *node) Open(ctx context.Context, flags uint32) (fh fusefs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
-	ra, err := n.r.OpenFile(n.e.Name)
+	if u := n.opts.upper; u != nil {
+		if isWriteOpen(flags) {
+			if err := n.copyUp(); err != nil {
+				return nil, 0, fusefs.ToErrno(err)
+			}
+		}
+		if de, ok := u.dataEntry(n.getPath()); ok {
+			// Only metadata are copied up. Read the contents from the layer.
+			fh, fuseFlags, errno := n.openLower(de)
+			if errno != 0 {
+				return nil, 0, errno
+			}
+			return &metacopyFile{fh.(*file)}, fuseFlags, 0
+		}
+		if _, ok := u.lstat(n.getPath()); ok {
+			return n.openUpper(flags)
+		}
+	} else if isWriteOpen(flags) {
+		return nil, 0, syscall.EROFS
+	}
+	if n.e == nil {
+		return nil, 0, syscall.ENOENT
+	}
+	return n.openLower(n.e)
+}
+
+// openLower opens the file of the entry in the layer.
+func (n *node) openLower(e *estargz.TOCEntry) (fh fusefs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	ra, err := n.r.OpenFile(e.Name)
 	if err != nil {
 		n.s.report(fmt.Errorf("failed to open node: %v", err))
 		return nil, 0, syscall.EIO
 	}
+	if n.opts.directIO {
+		fuseFlags |= fuse.FOPEN_DIRECT_IO
+	}
 	return &file{
 		n:  n,
-		e:  n.e,
+		e:  e,
 		ra: ra,
-	}, 0, 0
+	}, fuseFlags, 0
 }
 
 var _ = (fusefs.NodeGetattrer)((*node)(nil))
 
 func (n *node) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	entryToAttr(n.e, &out.Attr)
+	// The root of the layer is the upper directory itself so its stat isn't
+	// the one of the root.
+	if p := n.getPath(); p != "" {
+		if st, ok := n.opts.upper.lstat(p); ok {
+			n.opts.upper.upperAttr(p, st, &out.Attr)
+			return 0
+		}
+	}
+	if n.e == nil {
+		return syscall.ENOENT
+	}
+	entryToAttr(n.e, &out.Attr, n.opts)
 	return 0
 }
 
@@ -212,17 +388,16 @@ func (n *node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 	for _, opaqueXattr := range opaqueXattrs {
 		if attr == opaqueXattr && n.opaque {
 			// This node is an opaque directory so give overlayfs-compliant indicator.
-			if len(dest) < len(opaqueXattrValue) {
-				return uint32(len(opaqueXattrValue)), syscall.ERANGE
-			}
-			return uint32(copy(dest, opaqueXattrValue)), 0
+			return copyXattr(dest, []byte(opaqueXattrValue))
 		}
 	}
+	if n.e == nil {
+		return 0, syscall.ENODATA
+	}
+	// NOTE: This includes capability xattrs (security.capability) so the kernel
+	// can apply file capabilities of executables in the layer.
 	if v, ok := n.e.Xattrs[attr]; ok {
-		if len(dest) < len(v) {
-			return uint32(len(v)), syscall.ERANGE
-		}
-		return uint32(copy(dest, v)), 0
+		return copyXattr(dest, v)
 	}
 	return 0, syscall.ENODATA
 }
@@ -237,25 +412,56 @@ func (n *node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 			attrs = append(attrs, []byte(opaqueXattr+"\x00")...)
 		}
 	}
-	for k := range n.e.Xattrs {
+	// Avoid undeterministic order of xattrs on each call
+	var keys []string
+	if n.e != nil {
+		for k := range n.e.Xattrs {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
 		attrs = append(attrs, []byte(k+"\x00")...)
 	}
-	if len(dest) < len(attrs) {
-		return uint32(len(attrs)), syscall.ERANGE
+	return copyXattr(dest, attrs)
+}
+
+// copyXattr copies the xattr value (or list) to dest. If dest is empty, this
+// returns only the size of the value without error, following the size query
+// semantics of getxattr(2) and listxattr(2).
+func copyXattr(dest, v []byte) (uint32, syscall.Errno) {
+	if len(v) > maxXattrSize {
+		return 0, syscall.E2BIG
+	}
+	if len(dest) == 0 {
+		return uint32(len(v)), 0
+	}
+	if len(dest) < len(v) {
+		return uint32(len(v)), syscall.ERANGE
 	}
-	return uint32(copy(dest, attrs)), 0
+	return uint32(copy(dest, v)), 0
 }
 
 var _ = (fusefs.NodeReadlinker)((*node)(nil))
 
 func (n *node) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	if _, ok := n.opts.upper.lstat(n.getPath()); ok {
+		target, err := os.Readlink(n.opts.upper.path(n.getPath()))
+		if err != nil {
+			return nil, fusefs.ToErrno(err)
+		}
+		return []byte(target), 0
+	}
+	if n.e == nil {
+		return nil, syscall.ENOENT
+	}
 	return []byte(n.e.LinkName), 0
 }
 
 var _ = (fusefs.NodeStatfser)((*node)(nil))
 
 func (n *node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
-	defaultStatfs(out)
+	defaultStatfs(out, n.opts.blksize())
 	return 0
 }
 
@@ -272,50 +478,80 @@ func (f *file) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResul
 	n, err := f.ra.ReadAt(dest, off)
 	if err != nil && err != io.EOF {
 		f.n.s.report(fmt.Errorf("failed to read node: %v", err))
+		if errors.Is(err, remote.ErrRateLimited) {
+			// The contents are available later. Let the client try again.
+			return nil, syscall.EAGAIN
+		}
 		return nil, syscall.EIO
 	}
+	f.n.opts.touch(f.e)
+	if off < f.e.ChunkSize && f.n.opts.onFirstChunk != nil {
+		f.n.opts.onFirstChunk(f.e)
+	}
 	return fuse.ReadResultData(dest[:n]), 0
 }
 
 var _ = (fusefs.FileGetattrer)((*file)(nil))
 
 func (f *file) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
-	entryToAttr(f.e, &out.Attr)
+	entryToAttr(f.e, &out.Attr, f.n.opts)
 	return 0
 }
 
+// metacopyFile is the file whose only metadata are copied up to the upper
+// directory. The contents are read from the layer and the attributes are the
+// ones in the upper directory.
+type metacopyFile struct {
+	*file
+}
+
+var _ = (fusefs.FileGetattrer)((*metacopyFile)(nil))
+
+func (f *metacopyFile) Getattr(ctx context.Context, out *fuse.AttrOut) syscall.Errno {
+	return f.n.Getattr(ctx, nil, out)
+}
+
 // whiteout is a whiteout abstraction compliant to overlayfs.
 type whiteout struct {
 	fusefs.Inode
-	e *estargz.TOCEntry
+	e    *estargz.TOCEntry
+	opts *nodeOptions
 }
 
 var _ = (fusefs.NodeGetattrer)((*whiteout)(nil))
 
 func (w *whiteout) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	entryToWhAttr(w.e, &out.Attr)
+	entryToWhAttr(w.e, &out.Attr, w.opts)
 	return 0
 }
 
 var _ = (fusefs.NodeStatfser)((*whiteout)(nil))
 
 func (w *whiteout) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
-	defaultStatfs(out)
+	defaultStatfs(out, w.opts.blksize())
 	return 0
 }
 
 // newState provides new state directory node.
 // It creates statFile at the same time to give it stable inode number.
-func newState(layerDigest digest.Digest, blob remote.Blob) *state {
+func newState(layerDigest digest.Digest, blob remote.Blob, modTime time.Time, opts *nodeOptions) *state {
 	return &state{
 		statFile: &statFile{
 			name: layerDigest.String() + ".json",
 			statJSON: statJSON{
-				Digest: layerDigest.String(),
-				Size:   blob.Size(),
+				Digest:   layerDigest.String(),
+				Size:     blob.Size(),
+				Version:  version.Version,
+				Revision: version.Revision,
+				Features: opts.features,
 			},
-			blob: blob,
+			blob:        blob,
+			degradation: opts.degradation,
+			modTime:     modTime,
+			blockSize:   opts.blksize(),
 		},
+		modTime:   modTime,
+		blockSize: opts.blksize(),
 	}
 }
 
@@ -325,7 +561,9 @@ func newState(layerDigest digest.Digest, blob remote.Blob) *state {
 // This directory has mode "dr-x------ root root".
 type state struct {
 	fusefs.Inode
-	statFile *statFile
+	statFile  *statFile
+	modTime   time.Time
+	blockSize uint32
 }
 
 var _ = (fusefs.NodeReaddirer)((*state)(nil))
@@ -363,7 +601,7 @@ func (s *state) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.Attr
 var _ = (fusefs.NodeStatfser)((*state)(nil))
 
 func (s *state) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
-	defaultStatfs(out)
+	defaultStatfs(out, s.blockSize)
 	return 0
 }
 
@@ -371,6 +609,9 @@ func (s *state) report(err error) {
 	s.statFile.report(err)
 }
 
+// maxRecentErrors is the max number of distinct errors kept in the state file.
+const maxRecentErrors = 10
+
 type statJSON struct {
 	Error  string `json:"error,omitempty"`
 	Digest string `json:"digest"`
@@ -378,6 +619,27 @@ type statJSON struct {
 	Size           int64   `json:"size"`
 	FetchedSize    int64   `json:"fetchedSize"`
 	FetchedPercent float64 `json:"fetchedPercent"` // Fetched / Size * 100.0
+
+	// Version, Revision and Features describe the filesystem serving this layer.
+	Version  string   `json:"version"`
+	Revision string   `json:"revision"`
+	Features []string `json:"features,omitempty"`
+
+	// Degraded lists the reasons why the layer is served in a degraded mode
+	// (e.g. prefetch failed so contents are fetched only on demand).
+	Degraded []string `json:"degraded,omitempty"`
+
+	// RecentErrors is the recently reported distinct errors, ordered from the
+	// least recently seen. Error is the last one of these.
+	RecentErrors []errorRecord `json:"recentErrors,omitempty"`
+}
+
+// errorRecord is an error reported from the layer.
+type errorRecord struct {
+	Message   string    `json:"message"`
+	Count     int64     `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
 }
 
 // statFile is a file which contain something to be reported from this layer.
@@ -389,7 +651,12 @@ type statFile struct {
 	name     string
 	blob     remote.Blob
 	statJSON statJSON
+	modTime  time.Time
 	mu       sync.Mutex
+
+	degradation func() []string // nil if the layer can't be degraded
+
+	blockSize uint32
 }
 
 var _ = (fusefs.NodeOpener)((*statFile)(nil))
@@ -424,14 +691,37 @@ func (sf *statFile) Getattr(ctx context.Context, f fusefs.FileHandle, out *fuse.
 var _ = (fusefs.NodeStatfser)((*statFile)(nil))
 
 func (sf *statFile) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
-	defaultStatfs(out)
+	defaultStatfs(out, sf.blockSize)
 	return 0
 }
 
 func (sf *statFile) report(err error) {
 	sf.mu.Lock()
 	defer sf.mu.Unlock()
-	sf.statJSON.Error = err.Error()
+	var (
+		now  = time.Now()
+		msg  = err.Error()
+		errs = sf.statJSON.RecentErrors
+	)
+	sf.statJSON.Error = msg
+	for i, e := range errs {
+		if e.Message == msg {
+			// Seen again. Move it to the tail as the most recent one.
+			e.Count++
+			e.LastSeen = now
+			sf.statJSON.RecentErrors = append(append(errs[:i:i], errs[i+1:]...), e)
+			return
+		}
+	}
+	if len(errs) >= maxRecentErrors {
+		errs = errs[len(errs)-maxRecentErrors+1:] // evict the least recently seen
+	}
+	sf.statJSON.RecentErrors = append(errs, errorRecord{
+		Message:   msg,
+		Count:     1,
+		FirstSeen: now,
+		LastSeen:  now,
+	})
 }
 
 func (sf *statFile) attr(out *fuse.Attr) (fusefs.StableAttr, syscall.Errno) {
@@ -449,6 +739,9 @@ func (sf *statFile) attr(out *fuse.Attr) (fusefs.StableAttr, syscall.Errno) {
 func (sf *statFile) updateStatUnlocked() ([]byte, error) {
 	sf.statJSON.FetchedSize = sf.blob.FetchedSize()
 	sf.statJSON.FetchedPercent = float64(sf.statJSON.FetchedSize) / float64(sf.statJSON.Size) * 100.0
+	if sf.degradation != nil {
+		sf.statJSON.Degraded = sf.degradation()
+	}
 	j, err := json.Marshal(&sf.statJSON)
 	if err != nil {
 		return nil, err
@@ -464,24 +757,26 @@ func inodeOfEnt(e *estargz.TOCEntry) uint64 {
 }
 
 // entryToAttr converts stargz's TOCEntry to go-fuse's Attr.
-func entryToAttr(e *estargz.TOCEntry, out *fuse.Attr) fusefs.StableAttr {
+func entryToAttr(e *estargz.TOCEntry, out *fuse.Attr, opts *nodeOptions) fusefs.StableAttr {
 	out.Ino = inodeOfEnt(e)
 	out.Size = uint64(e.Size)
-	out.Blksize = blockSize
-	out.Blocks = out.Size / uint64(out.Blksize)
-	if out.Size%uint64(out.Blksize) > 0 {
-		out.Blocks++
-	}
-	mtime := e.ModTime()
-	out.SetTimes(nil, &mtime, nil)
+	out.Blksize = opts.blksize()
+	out.Blocks = blocksOf(out.Size)
+	setTimes(e, out, opts)
 	out.Mode = modeOfEntry(e)
 	out.Owner = fuse.Owner{Uid: uint32(e.UID), Gid: uint32(e.GID)}
-	out.Rdev = uint32(unix.Mkdev(uint32(e.DevMajor), uint32(e.DevMinor)))
+	out.Rdev = encodeDev(e.DevMajor, e.DevMinor)
 	out.Nlink = uint32(e.NumLink)
 	if out.Nlink == 0 {
 		out.Nlink = 1 // zero "NumLink" means one.
 	}
-	out.Padding = 0 // TODO
+	out.Padding = 0
+	if opts != nil {
+		if opts.owner != nil {
+			out.Owner = *opts.owner
+		}
+		out.Mode &^= opts.umask & uint32(os.ModePerm)
+	}
 
 	return fusefs.StableAttr{
 		Mode: out.Mode,
@@ -493,19 +788,17 @@ func entryToAttr(e *estargz.TOCEntry, out *fuse.Attr) fusefs.StableAttr {
 }
 
 // entryToWhAttr converts stargz's TOCEntry to go-fuse's Attr of whiteouts.
-func entryToWhAttr(e *estargz.TOCEntry, out *fuse.Attr) fusefs.StableAttr {
-	fi := e.Stat()
+func entryToWhAttr(e *estargz.TOCEntry, out *fuse.Attr, opts *nodeOptions) fusefs.StableAttr {
 	out.Ino = inodeOfEnt(e)
 	out.Size = 0
-	out.Blksize = blockSize
+	out.Blksize = opts.blksize()
 	out.Blocks = 0
-	mtime := fi.ModTime()
-	out.SetTimes(nil, &mtime, nil)
+	setTimes(e, out, opts)
 	out.Mode = syscall.S_IFCHR
 	out.Owner = fuse.Owner{Uid: 0, Gid: 0}
-	out.Rdev = uint32(unix.Mkdev(0, 0))
+	out.Rdev = encodeDev(0, 0)
 	out.Nlink = 1
-	out.Padding = 0 // TODO
+	out.Padding = 0
 
 	return fusefs.StableAttr{
 		Mode: out.Mode,
@@ -526,7 +819,7 @@ func inodeOfState(s *state) uint64 {
 func stateToAttr(s *state, out *fuse.Attr) fusefs.StableAttr {
 	out.Ino = inodeOfState(s)
 	out.Size = 0
-	out.Blksize = blockSize
+	out.Blksize = s.blockSize
 	out.Blocks = 0
 	out.Nlink = 1
 
@@ -534,9 +827,7 @@ func stateToAttr(s *state, out *fuse.Attr) fusefs.StableAttr {
 	out.Mode = stateDirMode
 	out.Owner = fuse.Owner{Uid: 0, Gid: 0}
 
-	// dummy
-	out.Mtime = 0
-	out.Mtimensec = 0
+	out.SetTimes(&s.modTime, &s.modTime, &s.modTime)
 	out.Rdev = 0
 	out.Padding = 0
 
@@ -559,17 +850,15 @@ func inodeOfStatFile(s *statFile) uint64 {
 func statFileToAttr(sf *statFile, size uint64, out *fuse.Attr) fusefs.StableAttr {
 	out.Ino = inodeOfStatFile(sf)
 	out.Size = size
-	out.Blksize = blockSize
-	out.Blocks = out.Size / uint64(out.Blksize)
+	out.Blksize = sf.blockSize
+	out.Blocks = blocksOf(out.Size)
 	out.Nlink = 1
 
 	// Root can read it ("-r-------- root root").
 	out.Mode = statFileMode
 	out.Owner = fuse.Owner{Uid: 0, Gid: 0}
 
-	// dummy
-	out.Mtime = 0
-	out.Mtimensec = 0
+	out.SetTimes(&sf.modTime, &sf.modTime, &sf.modTime)
 	out.Rdev = 0
 	out.Padding = 0
 
@@ -582,6 +871,69 @@ func statFileToAttr(sf *statFile, size uint64, out *fuse.Attr) fusefs.StableAttr
 	}
 }
 
+// setTimes sets timestamps of the entry. If the timestamp is overridden by the
+// option, it is used for all of them. The layer doesn't record atime of entries so
+// it is the same as mtime unless relatime is enabled. ctime is also the same as
+// mtime if the layer doesn't record it.
+func setTimes(e *estargz.TOCEntry, out *fuse.Attr, opts *nodeOptions) {
+	if opts != nil && opts.timestamp != nil {
+		out.SetTimes(opts.timestamp, opts.timestamp, opts.timestamp)
+		return
+	}
+	mtime, ctime := entryTimes(e)
+	atime := mtime
+	if opts != nil && opts.atimes != nil {
+		atime = opts.atimes.get(e, mtime)
+	}
+	out.SetTimes(&atime, &mtime, &ctime)
+}
+
+// entryTimes returns mtime and ctime of the entry.
+func entryTimes(e *estargz.TOCEntry) (mtime, ctime time.Time) {
+	mtime, ctime = e.ModTime(), e.ChangeTime()
+	if ctime.IsZero() {
+		ctime = mtime
+	}
+	return
+}
+
+// touch records the access to the entry if relatime is enabled.
+func (opts *nodeOptions) touch(e *estargz.TOCEntry) {
+	if opts == nil || opts.atimes == nil || opts.timestamp != nil {
+		return
+	}
+	opts.atimes.touch(e, time.Now())
+}
+
+// atimeTracker emulates relatime. The access time is updated only if it is earlier
+// than mtime or ctime, or older than relatimeInterval.
+type atimeTracker struct {
+	atimes map[*estargz.TOCEntry]time.Time
+	mu     sync.Mutex
+}
+
+func (t *atimeTracker) get(e *estargz.TOCEntry, mtime time.Time) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if atime, ok := t.atimes[e]; ok {
+		return atime
+	}
+	return mtime
+}
+
+func (t *atimeTracker) touch(e *estargz.TOCEntry, now time.Time) {
+	mtime, ctime := entryTimes(e)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	atime, ok := t.atimes[e]
+	if !ok {
+		atime = mtime
+	}
+	if !atime.After(mtime) || !atime.After(ctime) || now.Sub(atime) >= relatimeInterval {
+		t.atimes[e] = now
+	}
+}
+
 // modeOfEntry gets system's mode bits from TOCEntry
 func modeOfEntry(e *estargz.TOCEntry) uint32 {
 	m := e.Stat().Mode()
@@ -621,7 +973,22 @@ func modeOfEntry(e *estargz.TOCEntry) uint32 {
 	return res
 }
 
-func defaultStatfs(stat *fuse.StatfsOut) {
+// blocksOf returns st_blocks of the file of the size, which is counted in
+// 512-byte units regardless of the block size.
+func blocksOf(size uint64) uint64 {
+	return (size + statBlockSize - 1) / statBlockSize
+}
+
+// encodeDev encodes the device number in the 32-bit format of FUSE (the
+// kernel's new_encode_dev), which holds 12-bit major and 20-bit minor numbers.
+// Bits beyond these widths can't be represented by the kernel so they are
+// dropped.
+func encodeDev(major, minor int) uint32 {
+	ma, mi := uint32(major)&0xfff, uint32(minor)&0xfffff
+	return (mi & 0xff) | (ma << 8) | ((mi &^ 0xff) << 12)
+}
+
+func defaultStatfs(stat *fuse.StatfsOut, bsize uint32) {
 
 	// http://man7.org/linux/man-pages/man2/statfs.2.html
 	stat.Blocks = 0 // dummy
@@ -629,9 +996,9 @@ func defaultStatfs(stat *fuse.StatfsOut) {
 	stat.Bavail = 0
 	stat.Files = 0 // dummy
 	stat.Ffree = 0
-	stat.Bsize = blockSize
+	stat.Bsize = bsize
 	stat.NameLen = 1<<32 - 1
-	stat.Frsize = blockSize
+	stat.Frsize = bsize
 	stat.Padding = 0
 	stat.Spare = [6]uint32{}
 }
@@ -29,6 +29,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -43,6 +44,7 @@ import (
 	"github.com/containerd/stargz-snapshotter/fs/remote"
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	"github.com/containerd/stargz-snapshotter/util/testutil"
+	"github.com/containerd/stargz-snapshotter/version"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -226,6 +228,28 @@ func TestExistence(t *testing.T) {
 				fileNotExist("foo/.wh..wh..opq"),
 			},
 		},
+		{
+			name: "file_capability",
+			in: []testutil.TarEntry{
+				testutil.File("ping", "test", testutil.WithFileXattrs(map[string]string{
+					"security.capability": "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00",
+				})),
+			},
+			want: []check{
+				hasNodeXattrs("ping", "security.capability", "\x01\x00\x00\x02\x00\x20\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"),
+			},
+		},
+		{
+			name: "large_xattr",
+			in: []testutil.TarEntry{
+				testutil.File("foo", "test", testutil.WithFileXattrs(map[string]string{
+					"user.large": strings.Repeat("a", 32*1024),
+				})),
+			},
+			want: []check{
+				hasNodeXattrs("foo", "user.large", strings.Repeat("a", 32*1024)),
+			},
+		},
 		{
 			name: "prefetch_landmark",
 			in: []testutil.TarEntry{
@@ -307,8 +331,554 @@ func TestExistence(t *testing.T) {
 	}
 }
 
-func getRootNode(t *testing.T, r *estargz.Reader) *node {
-	rootNode, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5})
+// Tests timestamps presented by nodes.
+func TestTimestamp(t *testing.T) {
+	fixed := time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		opts []NodeOption
+		want func(e *estargz.TOCEntry) time.Time
+	}{
+		{
+			name: "modtime",
+			want: func(e *estargz.TOCEntry) time.Time { return e.ModTime() },
+		},
+		{
+			name: "fixed",
+			opts: []NodeOption{WithTimestamp(fixed)},
+			want: func(e *estargz.TOCEntry) time.Time { return fixed },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sgz, _, err := testutil.BuildEStargz([]testutil.TarEntry{
+				testutil.Dir("foo/"),
+				testutil.File("foo/bar", "test"),
+			})
+			if err != nil {
+				t.Fatalf("failed to build sample eStargz: %v", err)
+			}
+			r, err := estargz.Open(sgz)
+			if err != nil {
+				t.Fatalf("stargz.Open: %v", err)
+			}
+			rootNode := getRootNode(t, r, tt.opts...)
+			for _, name := range []string{"foo", "foo/bar"} {
+				_, n, err := getDirentAndNode(t, rootNode, name)
+				if err != nil {
+					t.Fatalf("failed to get node %q: %v", name, err)
+				}
+				var ao fuse.AttrOut
+				if errno := n.Operations().(fusefs.NodeGetattrer).Getattr(context.Background(), nil, &ao); errno != 0 {
+					t.Fatalf("failed to get attributes of node %q: %v", name, errno)
+				}
+				want := tt.want(n.Operations().(*node).e)
+				for _, tm := range []struct {
+					name string
+					got  time.Time
+				}{
+					{"mtime", ao.ModTime()},
+					{"atime", ao.AccessTime()},
+					{"ctime", ao.ChangeTime()},
+				} {
+					if !tm.got.Equal(want) {
+						t.Errorf("%s of %q = %v; want %v", tm.name, name, tm.got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+// Tests access times are updated following relatime semantics.
+func TestRelatime(t *testing.T) {
+	sgz, _, err := testutil.BuildEStargz([]testutil.TarEntry{testutil.File("test", "test")})
+	if err != nil {
+		t.Fatalf("failed to build sample eStargz: %v", err)
+	}
+	r, err := estargz.Open(sgz)
+	if err != nil {
+		t.Fatalf("stargz.Open: %v", err)
+	}
+	for _, relatime := range []bool{false, true} {
+		var opts []NodeOption
+		if relatime {
+			opts = append(opts, WithRelatime())
+		}
+		rootNode := getRootNode(t, r, opts...)
+		var eo fuse.EntryOut
+		inode, errno := rootNode.Lookup(context.Background(), "test", &eo)
+		if errno != 0 {
+			t.Fatalf("failed to lookup test node; errno: %v", errno)
+		}
+		f, _, errno := inode.Operations().(fusefs.NodeOpener).Open(context.Background(), 0)
+		if errno != 0 {
+			t.Fatalf("failed to open test file; errno: %v", errno)
+		}
+		if _, errno := f.(*file).Read(context.Background(), make([]byte, 4), 0); errno != 0 {
+			t.Fatalf("failed to read test file; errno: %v", errno)
+		}
+		var ao fuse.AttrOut
+		if errno := f.(*file).Getattr(context.Background(), &ao); errno != 0 {
+			t.Fatalf("failed to get attributes; errno: %v", errno)
+		}
+		if updated := ao.AccessTime().After(ao.ModTime()); updated != relatime {
+			t.Errorf("relatime=%v: atime %v, mtime %v", relatime, ao.AccessTime(), ao.ModTime())
+		}
+		if !ao.ChangeTime().Equal(ao.ModTime()) {
+			t.Errorf("ctime %v must be mtime %v if the layer doesn't record it", ao.ChangeTime(), ao.ModTime())
+		}
+	}
+}
+
+// Tests overriding owners and permissions of files.
+func TestOwnerAndUmask(t *testing.T) {
+	sgz, _, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.Dir("foo/", testutil.WithDirMode(0755)),
+		testutil.File("foo/bar", "test", testutil.WithFileOwner(1, 1), testutil.WithFileMode(0644|os.ModeSetuid)),
+	})
+	if err != nil {
+		t.Fatalf("failed to build sample eStargz: %v", err)
+	}
+	r, err := estargz.Open(sgz)
+	if err != nil {
+		t.Fatalf("stargz.Open: %v", err)
+	}
+	rootNode := getRootNode(t, r, WithOwner(1000, 2000), WithUmask(0027))
+	for name, wantMode := range map[string]uint32{
+		"foo":     syscall.S_IFDIR | 0750,
+		"foo/bar": syscall.S_IFREG | syscall.S_ISUID | 0640,
+	} {
+		_, n, err := getDirentAndNode(t, rootNode, name)
+		if err != nil {
+			t.Fatalf("failed to get node %q: %v", name, err)
+		}
+		var ao fuse.AttrOut
+		if errno := n.Operations().(fusefs.NodeGetattrer).Getattr(context.Background(), nil, &ao); errno != 0 {
+			t.Fatalf("failed to get attributes of node %q: %v", name, errno)
+		}
+		if ao.Uid != 1000 || ao.Gid != 2000 {
+			t.Errorf("owner of %q = %d:%d; want 1000:2000", name, ao.Uid, ao.Gid)
+		}
+		if ao.Mode != wantMode {
+			t.Errorf("mode of %q = %o; want %o", name, ao.Mode, wantMode)
+		}
+	}
+}
+
+// Tests files are opened with direct I/O only if it's enabled.
+func TestDirectIO(t *testing.T) {
+	sgz, _, err := testutil.BuildEStargz([]testutil.TarEntry{testutil.File("test", "test")})
+	if err != nil {
+		t.Fatalf("failed to build sample eStargz: %v", err)
+	}
+	r, err := estargz.Open(sgz)
+	if err != nil {
+		t.Fatalf("stargz.Open: %v", err)
+	}
+	for _, directIO := range []bool{false, true} {
+		var opts []NodeOption
+		if directIO {
+			opts = append(opts, WithDirectIO())
+		}
+		rootNode := getRootNode(t, r, opts...)
+		var eo fuse.EntryOut
+		inode, errno := rootNode.Lookup(context.Background(), "test", &eo)
+		if errno != 0 {
+			t.Fatalf("failed to lookup test node; errno: %v", errno)
+		}
+		_, flags, errno := inode.Operations().(fusefs.NodeOpener).Open(context.Background(), 0)
+		if errno != 0 {
+			t.Fatalf("failed to open test file; errno: %v", errno)
+		}
+		if got := flags&fuse.FOPEN_DIRECT_IO != 0; got != directIO {
+			t.Errorf("direct I/O = %v; want %v", got, directIO)
+		}
+	}
+}
+
+// Tests attributes of files larger than 4GiB and device files, and the
+// configurable block size.
+func TestLargeFileAttr(t *testing.T) {
+	const size = 5<<30 + 1 // exceeds 32-bit offsets
+	for _, tt := range []struct {
+		name        string
+		opts        []NodeOption
+		wantBlksize uint32
+	}{
+		{name: "default", wantBlksize: 4096},
+		{name: "blocksize", opts: []NodeOption{WithBlockSize(1 << 20)}, wantBlksize: 1 << 20},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := &nodeOptions{}
+			for _, o := range tt.opts {
+				o(opts)
+			}
+			var attr fuse.Attr
+			entryToAttr(&estargz.TOCEntry{Name: "large", Type: "reg", Size: size, Mode: 0644}, &attr, opts)
+			if attr.Size != size {
+				t.Errorf("size = %d; want %d", attr.Size, uint64(size))
+			}
+			if want := uint64(size/512 + 1); attr.Blocks != want {
+				t.Errorf("blocks = %d; want %d", attr.Blocks, want)
+			}
+			if attr.Blksize != tt.wantBlksize {
+				t.Errorf("blksize = %d; want %d", attr.Blksize, tt.wantBlksize)
+			}
+			var st fuse.StatfsOut
+			defaultStatfs(&st, opts.blksize())
+			if st.Bsize != tt.wantBlksize || st.Frsize != tt.wantBlksize {
+				t.Errorf("statfs block size = %d/%d; want %d", st.Bsize, st.Frsize, tt.wantBlksize)
+			}
+		})
+	}
+	for _, dev := range [][2]int{{0, 0}, {1, 3}, {8, 17}, {259, 65536}, {4095, 1<<20 - 1}} {
+		var attr fuse.Attr
+		entryToAttr(&estargz.TOCEntry{Name: "dev", Type: "block", DevMajor: dev[0], DevMinor: dev[1]}, &attr, nil)
+		if ma, mi := unix.Major(uint64(attr.Rdev)), unix.Minor(uint64(attr.Rdev)); int(ma) != dev[0] || int(mi) != dev[1] {
+			t.Errorf("device %d:%d is presented as %d:%d", dev[0], dev[1], ma, mi)
+		}
+	}
+}
+
+// Tests the layer rejects modifications unless it's writable.
+func TestReadOnly(t *testing.T) {
+	sgz, _, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.Dir("foo/"),
+		testutil.File("foo/bar", "test"),
+	})
+	if err != nil {
+		t.Fatalf("failed to build sample eStargz: %v", err)
+	}
+	r, err := estargz.Open(sgz)
+	if err != nil {
+		t.Fatalf("stargz.Open: %v", err)
+	}
+	rootNode := getRootNode(t, r)
+	ctx := context.Background()
+	_, foo, err := getDirentAndNode(t, rootNode, "foo")
+	if err != nil {
+		t.Fatalf("failed to get foo: %v", err)
+	}
+	_, bar, err := getDirentAndNode(t, rootNode, "foo/bar")
+	if err != nil {
+		t.Fatalf("failed to get foo/bar: %v", err)
+	}
+	dir, file := foo.Operations().(*node), bar.Operations().(*node)
+	for _, flags := range []int{syscall.O_WRONLY, syscall.O_RDWR, syscall.O_RDONLY | syscall.O_TRUNC} {
+		if _, _, errno := file.Open(ctx, uint32(flags)); errno != syscall.EROFS {
+			t.Errorf("open with flags %x: errno = %v; want EROFS", flags, errno)
+		}
+	}
+	if _, _, errno := file.Open(ctx, syscall.O_RDONLY); errno != 0 {
+		t.Errorf("failed to open read-only: %v", errno)
+	}
+	var eo fuse.EntryOut
+	if _, _, _, errno := dir.Create(ctx, "new", syscall.O_WRONLY, 0644, &eo); errno != syscall.EROFS {
+		t.Errorf("create: errno = %v; want EROFS", errno)
+	}
+	if _, errno := dir.Mkdir(ctx, "new", 0755, &eo); errno != syscall.EROFS {
+		t.Errorf("mkdir: errno = %v; want EROFS", errno)
+	}
+	if errno := dir.Unlink(ctx, "bar"); errno != syscall.EROFS {
+		t.Errorf("unlink: errno = %v; want EROFS", errno)
+	}
+	if errno := rootNode.Rmdir(ctx, "foo"); errno != syscall.EROFS {
+		t.Errorf("rmdir: errno = %v; want EROFS", errno)
+	}
+	if errno := dir.Rename(ctx, "bar", dir, "baz", 0); errno != syscall.EROFS {
+		t.Errorf("rename: errno = %v; want EROFS", errno)
+	}
+	var ao fuse.AttrOut
+	if errno := file.Setattr(ctx, nil, &fuse.SetAttrIn{}, &ao); errno != syscall.EROFS {
+		t.Errorf("setattr: errno = %v; want EROFS", errno)
+	}
+}
+
+// Tests modifications to the writable layer.
+func TestWritableUpper(t *testing.T) {
+	sgz, _, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.Dir("foo/", testutil.WithDirMode(0750)),
+		testutil.File("foo/bar", "test"),
+		testutil.File("foo/baz", "baz"),
+		testutil.Dir("dir/"),
+		testutil.File("dir/a", "a"),
+	})
+	if err != nil {
+		t.Fatalf("failed to build sample eStargz: %v", err)
+	}
+	r, err := estargz.Open(sgz)
+	if err != nil {
+		t.Fatalf("stargz.Open: %v", err)
+	}
+	upper, err := ioutil.TempDir("", "upper")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(upper)
+	rootNode := getRootNode(t, r, WithWritableUpper(upper))
+	ctx := context.Background()
+	lookup := func(name string) *node {
+		_, n, err := getDirentAndNode(t, rootNode, name)
+		if err != nil {
+			t.Fatalf("failed to get %q: %v", name, err)
+		}
+		return n.Operations().(*node)
+	}
+	readAll := func(n *node) string {
+		fh, _, errno := n.Open(ctx, syscall.O_RDONLY)
+		if errno != 0 {
+			t.Fatalf("failed to open: %v", errno)
+		}
+		buf := make([]byte, 100)
+		res, errno := fh.(fusefs.FileReader).Read(ctx, buf, 0)
+		if errno != 0 {
+			t.Fatalf("failed to read: %v", errno)
+		}
+		b, _ := res.Bytes(buf)
+		if rl, ok := fh.(fusefs.FileReleaser); ok {
+			rl.Release(ctx)
+		}
+		return string(b)
+	}
+	exists := func(name string) bool {
+		_, _, err := getDirentAndNode(t, rootNode, name)
+		return err == nil
+	}
+
+	// modify a file in the layer
+	fh, _, errno := lookup("foo/bar").Open(ctx, syscall.O_RDWR)
+	if errno != 0 {
+		t.Fatalf("failed to open foo/bar for writing: %v", errno)
+	}
+	if _, errno := fh.(fusefs.FileWriter).Write(ctx, []byte("TEST"), 0); errno != 0 {
+		t.Fatalf("failed to write foo/bar: %v", errno)
+	}
+	fh.(fusefs.FileReleaser).Release(ctx)
+	if got := readAll(lookup("foo/bar")); got != "TEST" {
+		t.Errorf("foo/bar = %q; want %q", got, "TEST")
+	}
+	if fi, err := os.Stat(filepath.Join(upper, "foo")); err != nil || fi.Mode().Perm() != 0750 {
+		t.Errorf("parent directory must be copied up with the mode: %v, %v", fi, err)
+	}
+
+	// truncate the file
+	var ao fuse.AttrOut
+	in := &fuse.SetAttrIn{}
+	in.Valid, in.Size = fuse.FATTR_SIZE, 2
+	if errno := lookup("foo/bar").Setattr(ctx, nil, in, &ao); errno != 0 || ao.Size != 2 {
+		t.Errorf("failed to truncate foo/bar: %v (size %d)", errno, ao.Size)
+	}
+
+	// create a file
+	var eo fuse.EntryOut
+	_, fh, _, errno = lookup("foo").Create(ctx, "new", syscall.O_WRONLY, 0644, &eo)
+	if errno != 0 {
+		t.Fatalf("failed to create foo/new: %v", errno)
+	}
+	fh.(fusefs.FileWriter).Write(ctx, []byte("new"), 0)
+	fh.(fusefs.FileReleaser).Release(ctx)
+	if got := readAll(lookup("foo/new")); got != "new" {
+		t.Errorf("foo/new = %q; want %q", got, "new")
+	}
+
+	// remove a file in the layer
+	if errno := lookup("foo").Unlink(ctx, "baz"); errno != 0 {
+		t.Fatalf("failed to unlink foo/baz: %v", errno)
+	}
+	if exists("foo/baz") {
+		t.Errorf("foo/baz must be removed")
+	}
+
+	// rename a file
+	if errno := lookup("foo").Rename(ctx, "new", rootNode, "renamed", 0); errno != 0 {
+		t.Fatalf("failed to rename foo/new: %v", errno)
+	}
+	if exists("foo/new") || !exists("renamed") {
+		t.Errorf("foo/new must be renamed")
+	}
+	if errno := rootNode.Rename(ctx, "foo", rootNode, "foo2", 0); errno != syscall.EXDEV {
+		t.Errorf("rename of directory: errno = %v; want EXDEV", errno)
+	}
+
+	// remove a directory in the layer and recreate it
+	if errno := rootNode.Rmdir(ctx, "dir"); errno != syscall.ENOTEMPTY {
+		t.Errorf("rmdir of non-empty directory: errno = %v; want ENOTEMPTY", errno)
+	}
+	if errno := lookup("dir").Unlink(ctx, "a"); errno != 0 {
+		t.Fatalf("failed to unlink dir/a: %v", errno)
+	}
+	if errno := rootNode.Rmdir(ctx, "dir"); errno != 0 {
+		t.Fatalf("failed to remove dir: %v", errno)
+	}
+	if exists("dir") {
+		t.Errorf("dir must be removed")
+	}
+	if _, errno := rootNode.Mkdir(ctx, "dir", 0755, &eo); errno != 0 {
+		t.Fatalf("failed to recreate dir: %v", errno)
+	}
+	if !exists("dir") || exists("dir/a") {
+		t.Errorf("recreated dir must be empty")
+	}
+
+	// the layer itself isn't modified
+	ra, err := r.OpenFile("foo/bar")
+	if err != nil {
+		t.Fatalf("failed to open foo/bar in the layer: %v", err)
+	}
+	b := make([]byte, 4)
+	if _, err := ra.ReadAt(b, 0); (err != nil && err != io.EOF) || string(b) != "test" {
+		t.Errorf("layer is modified: %q, %v", string(b), err)
+	}
+}
+
+// Tests the root of the writable layer reports the attributes of the layer, not
+// the ones of the upper directory.
+func TestWritableUpperRootAttr(t *testing.T) {
+	sgz, _, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.File("foo", "test"),
+	})
+	if err != nil {
+		t.Fatalf("failed to build sample eStargz: %v", err)
+	}
+	r, err := estargz.Open(sgz)
+	if err != nil {
+		t.Fatalf("stargz.Open: %v", err)
+	}
+	upper, err := ioutil.TempDir("", "upper")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(upper)
+	if err := os.Chmod(upper, 0700); err != nil {
+		t.Fatalf("failed to chmod upper directory: %v", err)
+	}
+	past := time.Unix(1000, 0)
+	if err := os.Chtimes(upper, past, past); err != nil {
+		t.Fatalf("failed to chtimes upper directory: %v", err)
+	}
+	rootEntry, ok := r.Lookup("")
+	if !ok {
+		t.Fatalf("root entry not found")
+	}
+	var want fuse.Attr
+	rootNode := getRootNode(t, r, WithWritableUpper(upper))
+	entryToAttr(rootEntry, &want, rootNode.opts)
+
+	var ao fuse.AttrOut
+	if errno := rootNode.Getattr(context.Background(), nil, &ao); errno != 0 {
+		t.Fatalf("failed to get attributes of the root: %v", errno)
+	}
+	if ao.Mode != want.Mode || ao.Mtime != want.Mtime || ao.Ino != want.Ino {
+		t.Errorf("root attributes (mode=%o, mtime=%d, ino=%d); want (mode=%o, mtime=%d, ino=%d)",
+			ao.Mode, ao.Mtime, ao.Ino, want.Mode, want.Mtime, want.Ino)
+	}
+}
+
+// Tests changes of only metadata of files don't copy up their contents.
+func TestWritableUpperMetacopy(t *testing.T) {
+	sgz, _, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.Dir("foo/"),
+		testutil.File("foo/bar", "test", testutil.WithFileMode(0644)),
+	})
+	if err != nil {
+		t.Fatalf("failed to build sample eStargz: %v", err)
+	}
+	r, err := estargz.Open(sgz)
+	if err != nil {
+		t.Fatalf("stargz.Open: %v", err)
+	}
+	upper, err := ioutil.TempDir("", "upper")
+	if err != nil {
+		t.Fatalf("failed to make tempdir: %v", err)
+	}
+	defer os.RemoveAll(upper)
+	tr := &openCountingReader{testReader: testReader{r}}
+	root, err := newNode(testStateLayerDigest, tr, &testBlobState{10, 5}, WithWritableUpper(upper))
+	if err != nil {
+		t.Fatalf("failed to get root node: %v", err)
+	}
+	fusefs.NewNodeFS(root, &fusefs.Options{})
+	rootNode := root.(*node)
+	ctx := context.Background()
+	lookup := func(name string) *node {
+		_, n, err := getDirentAndNode(t, rootNode, name)
+		if err != nil {
+			t.Fatalf("failed to get %q: %v", name, err)
+		}
+		return n.Operations().(*node)
+	}
+	read := func(n *node) string {
+		fh, _, errno := n.Open(ctx, syscall.O_RDONLY)
+		if errno != 0 {
+			t.Fatalf("failed to open: %v", errno)
+		}
+		buf := make([]byte, 100)
+		res, errno := fh.(fusefs.FileReader).Read(ctx, buf, 0)
+		if errno != 0 {
+			t.Fatalf("failed to read: %v", errno)
+		}
+		b, _ := res.Bytes(buf)
+		return string(b)
+	}
+
+	// chown and chmod copy up only the metadata
+	in := &fuse.SetAttrIn{}
+	in.Valid, in.Uid, in.Gid, in.Mode = fuse.FATTR_UID|fuse.FATTR_GID|fuse.FATTR_MODE, 1000, 2000, 0600
+	var ao fuse.AttrOut
+	if errno := lookup("foo/bar").Setattr(ctx, nil, in, &ao); errno != 0 {
+		t.Fatalf("failed to chown foo/bar: %v", errno)
+	}
+	if tr.opened != 0 {
+		t.Errorf("contents are read %d times on chown", tr.opened)
+	}
+	if ao.Uid != 1000 || ao.Gid != 2000 || ao.Mode&07777 != 0600 || ao.Size != 4 || ao.Blocks != 1 {
+		t.Errorf("unexpected attributes after chown: %+v", ao.Attr)
+	}
+	if fi, err := os.Stat(filepath.Join(upper, "foo", "bar")); err != nil || fi.Size() != 4 {
+		t.Errorf("metadata must be copied up: %v, %v", fi, err)
+	}
+	if got := read(lookup("foo/bar")); got != "test" {
+		t.Errorf("foo/bar = %q; want %q", got, "test")
+	}
+
+	// the contents follow the renamed file
+	if errno := lookup("foo").Rename(ctx, "bar", rootNode, "baz", 0); errno != 0 {
+		t.Fatalf("failed to rename foo/bar: %v", errno)
+	}
+	if got := read(lookup("baz")); got != "test" {
+		t.Errorf("baz = %q; want %q", got, "test")
+	}
+
+	// opening for writing copies up the contents
+	fh, _, errno := lookup("baz").Open(ctx, syscall.O_WRONLY)
+	if errno != 0 {
+		t.Fatalf("failed to open baz for writing: %v", errno)
+	}
+	if _, errno := fh.(fusefs.FileWriter).Write(ctx, []byte("T"), 0); errno != 0 {
+		t.Fatalf("failed to write baz: %v", errno)
+	}
+	fh.(fusefs.FileReleaser).Release(ctx)
+	if got := read(lookup("baz")); got != "Test" {
+		t.Errorf("baz = %q; want %q", got, "Test")
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(upper, "baz")); err != nil || string(b) != "Test" {
+		t.Errorf("contents must be copied up: %q, %v", string(b), err)
+	}
+}
+
+type openCountingReader struct {
+	testReader
+	opened int
+}
+
+func (tr *openCountingReader) OpenFile(name string) (io.ReaderAt, error) {
+	tr.opened++
+	return tr.testReader.OpenFile(name)
+}
+
+func getRootNode(t *testing.T, r *estargz.Reader, opts ...NodeOption) *node {
+	rootNode, err := newNode(testStateLayerDigest, &testReader{r}, &testBlobState{10, 5}, opts...)
 	if err != nil {
 		t.Fatalf("failed to get root node: %v", err)
 	}
@@ -426,11 +996,18 @@ func hasNodeXattrs(entry, name, value string) check {
 			t.Fatalf("failed to get node %q: %v", entry, err)
 		}
 
-		// check xattr exists in the xattrs list.
-		buf := make([]byte, 1000)
-		nb, errno := n.Operations().(fusefs.NodeListxattrer).Listxattr(context.Background(), buf)
+		// check the size of xattrs list can be queried.
+		nb, errno := n.Operations().(fusefs.NodeListxattrer).Listxattr(context.Background(), nil)
 		if errno != 0 {
-			t.Fatalf("failed to get xattrs list of node %q: %v", entry, err)
+			t.Fatalf("failed to get size of xattrs list of node %q: %v", entry, errno)
+		}
+
+		// check xattr exists in the xattrs list.
+		buf := make([]byte, nb)
+		if nl, errno := n.Operations().(fusefs.NodeListxattrer).Listxattr(context.Background(), buf); errno != 0 {
+			t.Fatalf("failed to get xattrs list of node %q: %v", entry, errno)
+		} else if nl != nb {
+			t.Fatalf("size of xattrs list of node %q = %d; want %d", entry, nl, nb)
 		}
 		attrs := strings.Split(string(buf[:nb]), "\x00")
 		var found bool
@@ -444,6 +1021,13 @@ func hasNodeXattrs(entry, name, value string) check {
 			return
 		}
 
+		// check the size of the xattr can be queried.
+		if ns, errno := n.Operations().(fusefs.NodeGetxattrer).Getxattr(context.Background(), name, nil); errno != 0 {
+			t.Fatalf("failed to get size of xattr %q of node %q: %v", name, entry, errno)
+		} else if int(ns) != len(value) {
+			t.Fatalf("size of xattr %q of node %q = %d; want %d", name, entry, ns, len(value))
+		}
+
 		// check the xattr has valid value.
 		v := make([]byte, len(value))
 		nv, errno := n.Operations().(fusefs.NodeGetxattrer).Getxattr(context.Background(), name, v)
@@ -564,6 +1148,38 @@ func hasStateFile(t *testing.T, id string) check {
 			t.Errorf("expected error %q, got %q", wantErr.Error(), j.Error)
 			return
 		}
+		if len(j.RecentErrors) != 1 || j.RecentErrors[0].Message != wantErr.Error() || j.RecentErrors[0].Count != 1 {
+			t.Errorf("unexpected recent errors %+v", j.RecentErrors)
+			return
+		}
+		if j.Version != version.Version || j.Revision != version.Revision {
+			t.Errorf("unexpected version %q (revision %q)", j.Version, j.Revision)
+			return
+		}
+	}
+}
+
+func TestStateRecentErrors(t *testing.T) {
+	sf := &statFile{}
+	for i := 0; i < maxRecentErrors+2; i++ {
+		sf.report(fmt.Errorf("error-%d", i))
+	}
+	sf.report(fmt.Errorf("error-5"))
+	sf.report(fmt.Errorf("error-5"))
+
+	errs := sf.statJSON.RecentErrors
+	if len(errs) != maxRecentErrors {
+		t.Fatalf("number of recent errors = %d; want %d", len(errs), maxRecentErrors)
+	}
+	if errs[0].Message != "error-2" {
+		t.Errorf("least recent error = %q; want error-2", errs[0].Message)
+	}
+	last := errs[len(errs)-1]
+	if last.Message != "error-5" || last.Count != 3 || last.LastSeen.Before(last.FirstSeen) {
+		t.Errorf("unexpected most recent error %+v", last)
+	}
+	if sf.statJSON.Error != "error-5" {
+		t.Errorf("error = %q; want error-5", sf.statJSON.Error)
 	}
 }
 
@@ -0,0 +1,175 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+)
+
+// maxShadowWalkDepth is the maximum depth of directories walked for getting
+// the shadow of a layer.
+const maxShadowWalkDepth = 10000
+
+// Shadow is the set of paths which layers hide from their lower layers in the
+// merged rootfs (overlayfs) of an image. Files of lower layers hidden by upper
+// layers are never exposed to containers so they don't need to be prefetched.
+type Shadow struct {
+	// entries is the paths of the entries and the targets of whiteouts of the
+	// layers. The value is true if the entry is a directory, which hides the
+	// path but not its children.
+	entries map[string]bool
+
+	// opaque is the directories made opaque, which hide all children.
+	opaque map[string]struct{}
+}
+
+// NewShadow returns an empty shadow which hides nothing.
+func NewShadow() *Shadow {
+	return &Shadow{
+		entries: make(map[string]bool),
+		opaque:  make(map[string]struct{}),
+	}
+}
+
+// Merge adds the paths hidden by other to the shadow.
+func (s *Shadow) Merge(other *Shadow) {
+	for p, isDir := range other.entries {
+		s.addEntry(p, isDir)
+	}
+	for p := range other.opaque {
+		s.opaque[p] = struct{}{}
+	}
+}
+
+// Shadowed returns true if the file of the name in a lower layer is hidden.
+func (s *Shadow) Shadowed(name string) bool {
+	p := cleanEntryName(name)
+	if _, ok := s.entries[p]; ok {
+		return true
+	}
+	for p != "/" {
+		p = path.Dir(p)
+		if _, ok := s.opaque[p]; ok {
+			return true
+		}
+		if isDir, ok := s.entries[p]; ok && !isDir {
+			return true // replaced by a non-directory or removed by a whiteout
+		}
+	}
+	return false
+}
+
+func (s *Shadow) addEntry(p string, isDir bool) {
+	if cur, ok := s.entries[p]; ok && !cur {
+		return // non-directories hide the children as well
+	}
+	s.entries[p] = isDir
+}
+
+func (s *Shadow) add(dir *estargz.TOCEntry, dirPath string, depth int) (rErr error) {
+	if depth > maxShadowWalkDepth {
+		return fmt.Errorf("TOCEntry tree is too deep (depth:%d)", depth)
+	}
+	dir.ForeachChild(func(baseName string, e *estargz.TOCEntry) bool {
+		if baseName == "" || baseName == "." {
+			return true
+		}
+		p := path.Join(dirPath, baseName)
+		switch {
+		case baseName == whiteoutOpaqueDir:
+			s.opaque[dirPath] = struct{}{}
+		case strings.HasPrefix(baseName, whiteoutPrefix):
+			s.addEntry(path.Join(dirPath, baseName[len(whiteoutPrefix):]), false)
+		case e.Type == "dir":
+			s.addEntry(p, true)
+			if err := s.add(e, p, depth+1); err != nil {
+				rErr = err
+				return false
+			}
+		default:
+			s.addEntry(p, false)
+		}
+		return true
+	})
+	return
+}
+
+func cleanEntryName(name string) string {
+	return path.Clean("/" + name)
+}
+
+// prefetchRegions returns the regions of the blob in [0, prefetchSize) which
+// contain the regular files not hidden by the shadow. Each file spans until the
+// offset of the next file. skipped is the number of the hidden files.
+func prefetchRegions(root *estargz.TOCEntry, prefetchSize int64, shadow *Shadow) (regions []region, skipped int, _ error) {
+	type file struct {
+		offset   int64
+		shadowed bool
+	}
+	var files []file
+	var walk func(dir *estargz.TOCEntry, depth int) error
+	walk = func(dir *estargz.TOCEntry, depth int) (rErr error) {
+		if depth > maxShadowWalkDepth {
+			return fmt.Errorf("TOCEntry tree is too deep (depth:%d)", depth)
+		}
+		dir.ForeachChild(func(baseName string, e *estargz.TOCEntry) bool {
+			if e.Type == "dir" {
+				if baseName == "" || baseName == "." {
+					return true
+				}
+				if err := walk(e, depth+1); err != nil {
+					rErr = err
+					return false
+				}
+			} else if e.Type == "reg" && e.Size > 0 && e.Offset < prefetchSize && e.Name != estargz.TOCTarName {
+				files = append(files, file{e.Offset, shadow.Shadowed(e.Name)})
+			}
+			return true
+		})
+		return
+	}
+	if err := walk(root, 0); err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].offset < files[j].offset })
+	for i, f := range files {
+		if f.shadowed {
+			skipped++
+			continue
+		}
+		end := prefetchSize
+		if i+1 < len(files) {
+			end = files[i+1].offset
+		}
+		if n := len(regions); n > 0 && regions[n-1].end == f.offset {
+			regions[n-1].end = end
+		} else {
+			regions = append(regions, region{f.offset, end})
+		}
+	}
+	return regions, skipped, nil
+}
+
+// region is a range [begin, end) of the blob.
+type region struct {
+	begin, end int64
+}
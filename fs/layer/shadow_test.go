@@ -0,0 +1,182 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	"github.com/containerd/stargz-snapshotter/task"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func makeTestLayer(t *testing.T, in []testutil.TarEntry, prioritizedFiles []string) (*layer, *sampleBlob, cache.BlobCache, digest.Digest) {
+	sr, dgst, err := testutil.BuildEStargz(in,
+		testutil.WithEStargzOptions(
+			estargz.WithChunkSize(sampleChunkSize),
+			estargz.WithPrioritizedFiles(prioritizedFiles),
+		))
+	if err != nil {
+		t.Fatalf("failed to build eStargz: %v", err)
+	}
+	blob := newBlob(sr)
+	mcache := cache.NewMemoryCache()
+	vr, err := reader.NewReader(sr, mcache)
+	if err != nil {
+		t.Fatalf("failed to make stargz reader: %v", err)
+	}
+	l := newLayer(
+		&Resolver{prefetchTimeout: time.Second},
+		ocispec.Descriptor{Digest: testStateLayerDigest},
+		&blobRef{blob, func() {}},
+		vr,
+	)
+	return l, blob, mcache, dgst
+}
+
+func TestShadow(t *testing.T) {
+	upper, _, _, _ := makeTestLayer(t, []testutil.TarEntry{
+		testutil.File("a.txt", sampleData1),
+		testutil.Dir("d/"),
+		testutil.File("d/.wh.x", ""),
+		testutil.Dir("o/"),
+		testutil.File("o/.wh..wh..opq", ""),
+		testutil.File("o/new.txt", sampleData1),
+		testutil.File("f", sampleData2),
+	}, nil)
+
+	// The shadow is available without verification.
+	s, err := upper.Shadow()
+	if err != nil {
+		t.Fatalf("failed to get shadow: %v", err)
+	}
+	for name, want := range map[string]bool{
+		"a.txt":     true,  // overwritten
+		"./a.txt":   true,  // same path
+		"b.txt":     false, // not in the upper layer
+		"d":         true,  // a file replaced by the directory
+		"d/y":       false, // children of directories are merged
+		"d/x":       true,  // removed by the whiteout
+		"d/x/z":     true,  // removed with the parent directory
+		"o/old.txt": true,  // hidden by the opaque directory
+		"f/g":       true,  // a directory replaced by the file
+	} {
+		if got := s.Shadowed(name); got != want {
+			t.Errorf("Shadowed(%q) = %v; want %v", name, got, want)
+		}
+	}
+
+	// Non-directories of any upper layer hide the children regardless of the
+	// order of merging.
+	dir, removed := NewShadow(), NewShadow()
+	dir.addEntry("/d/x", true)
+	removed.addEntry("/d/x", false)
+	for _, ss := range [][]*Shadow{{dir, removed}, {removed, dir}} {
+		merged := NewShadow()
+		for _, s := range ss {
+			merged.Merge(s)
+		}
+		if !merged.Shadowed("d/x/z") {
+			t.Errorf("merged shadow must hide children of the removed directory")
+		}
+	}
+}
+
+func TestPrefetchWithShadow(t *testing.T) {
+	l, blob, mcache, dgst := makeTestLayer(t, []testutil.TarEntry{
+		testutil.File("foo.txt", sampleData1),
+		testutil.File("bar.txt", sampleData2),
+		testutil.File("baz.txt", sampleData1),
+	}, []string{"foo.txt", "bar.txt"})
+	if err := l.Verify(dgst); err != nil {
+		t.Fatalf("failed to verify reader: %v", err)
+	}
+	bar, ok := l.r.Lookup("bar.txt")
+	if !ok {
+		t.Fatalf("failed to lookup bar.txt")
+	}
+	landmark, ok := l.r.Lookup(estargz.PrefetchLandmark)
+	if !ok {
+		t.Fatalf("failed to lookup prefetch landmark")
+	}
+
+	// foo.txt is overwritten by an upper layer.
+	shadow := NewShadow()
+	shadow.addEntry("/foo.txt", false)
+	if err := l.Prefetch(10000, WithShadow(shadow)); err != nil {
+		t.Fatalf("failed to prefetch: %v", err)
+	}
+	if blob.calledPrefetchOffset != bar.Offset || blob.calledPrefetchSize != landmark.Offset-bar.Offset {
+		t.Errorf("prefetched offset=%d,size=%d; want offset=%d,size=%d",
+			blob.calledPrefetchOffset, blob.calledPrefetchSize, bar.Offset, landmark.Offset-bar.Offset)
+	}
+	if got, want := len(mcache.(*cache.MemoryCache).Membuf), chunkNum(sampleData2); got != want {
+		t.Errorf("number of chunks in the cache %d; want %d (only bar.txt)", got, want)
+	}
+}
+
+func TestBackgroundFetchWithShadow(t *testing.T) {
+	l, _, mcache, dgst := makeTestLayer(t, []testutil.TarEntry{
+		testutil.File("foo.txt", sampleData1),
+		testutil.File("bar.txt", sampleData2),
+	}, nil)
+	l.resolver.backgroundTaskManager = task.NewBackgroundTaskManager(1, time.Millisecond)
+	if err := l.Verify(dgst); err != nil {
+		t.Fatalf("failed to verify reader: %v", err)
+	}
+
+	// foo.txt is removed by an upper layer.
+	shadow := NewShadow()
+	shadow.addEntry("/foo.txt", false)
+	if err := l.BackgroundFetch(WithShadow(shadow)); !errors.Is(err, ErrPartiallyFetched) {
+		t.Fatalf("background fetch must report skipped files but got %v", err)
+	}
+	// The landmark file indicating no prefetch is fetched as well.
+	if got, want := len(mcache.(*cache.MemoryCache).Membuf), chunkNum(sampleData2)+1; got != want {
+		t.Errorf("number of chunks in the cache %d; want %d (only bar.txt and the landmark)", got, want)
+	}
+}
+
+func TestBackgroundFetchAfterPartiallyFetched(t *testing.T) {
+	l, _, mcache, dgst := makeTestLayer(t, []testutil.TarEntry{
+		testutil.File("foo.txt", sampleData1),
+		testutil.File("bar.txt", sampleData2),
+	}, nil)
+	l.resolver.backgroundTaskManager = task.NewBackgroundTaskManager(1, time.Millisecond)
+	if err := l.Verify(dgst); err != nil {
+		t.Fatalf("failed to verify reader: %v", err)
+	}
+
+	// The first image removes foo.txt but the second one doesn't.
+	shadow := NewShadow()
+	shadow.addEntry("/foo.txt", false)
+	if err := l.BackgroundFetch(WithShadow(shadow)); !errors.Is(err, ErrPartiallyFetched) {
+		t.Fatalf("background fetch must report skipped files but got %v", err)
+	}
+	if err := l.BackgroundFetch(); err != nil {
+		t.Fatalf("background fetch without shadow must fetch the whole layer: %v", err)
+	}
+	if got, want := len(mcache.(*cache.MemoryCache).Membuf), chunkNum(sampleData1)+chunkNum(sampleData2)+1; got != want {
+		t.Errorf("number of chunks in the cache %d; want %d (whole layer)", got, want)
+	}
+}
@@ -0,0 +1,652 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package layer
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/reader"
+	fusefs "github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+)
+
+// WithWritableUpper makes the layer writable. Modifications are stored in the
+// specified directory and the layer is presented as the merged view of the
+// directory and the layer, in the same manner as overlayfs. Files in the layer
+// are copied up to the directory when they are modified. Removals of files in
+// the layer are kept in memory. This is useful for mounting a single layer
+// without overlayfs while allowing scratch writes.
+//
+// Changes of only metadata (owner, mode and timestamps) of regular files copy
+// up only the metadata, like the "metacopy" feature of overlayfs, so a chown
+// never fetches the contents of the file. The contents are copied up when the
+// file is opened for writing or truncated.
+func WithWritableUpper(dir string) NodeOption {
+	return func(opts *nodeOptions) {
+		opts.upper = &writableUpper{
+			dir:      dir,
+			removed:  make(map[string]bool),
+			metacopy: make(map[string]*estargz.TOCEntry),
+		}
+	}
+}
+
+// writableUpper is the directory where modifications to the layer are stored.
+// Methods are safe to be called on nil, which means the layer is read-only.
+type writableUpper struct {
+	dir string
+
+	// removed is the set of paths whose entries in the layer are hidden.
+	removed map[string]bool
+
+	// metacopy maps the paths of files whose only metadata are copied up to
+	// the entries in the layer storing their contents. The files in the
+	// upper directory are sparse files of the same size.
+	metacopy map[string]*estargz.TOCEntry
+
+	// mu guards removed, metacopy and paths of nodes.
+	mu sync.Mutex
+}
+
+func (u *writableUpper) path(p string) string {
+	return filepath.Join(u.dir, p)
+}
+
+// lstat returns the stat of the entry in the upper directory.
+func (u *writableUpper) lstat(p string) (*syscall.Stat_t, bool) {
+	if u == nil {
+		return nil, false
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(u.path(p), &st); err != nil {
+		return nil, false
+	}
+	return &st, true
+}
+
+func (u *writableUpper) isRemoved(p string) bool {
+	if u == nil {
+		return false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.removed[p]
+}
+
+func (u *writableUpper) remove(p string) {
+	u.mu.Lock()
+	u.removed[p] = true
+	u.mu.Unlock()
+}
+
+// dataEntry returns the entry in the layer storing the contents of the file
+// whose only metadata are copied up.
+func (u *writableUpper) dataEntry(p string) (*estargz.TOCEntry, bool) {
+	if u == nil {
+		return nil, false
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	e, ok := u.metacopy[p]
+	return e, ok
+}
+
+// upperAttr fills the attributes of the entry in the upper directory. The
+// blocks of the file whose only metadata are copied up are the ones of the
+// contents in the layer, as overlayfs reports for metacopy files.
+func (u *writableUpper) upperAttr(p string, st *syscall.Stat_t, out *fuse.Attr) {
+	out.FromStat(st)
+	if de, ok := u.dataEntry(p); ok {
+		out.Blocks = blocksOf(uint64(de.Size))
+	}
+}
+
+// isWriteOpen returns true if the open flags require the write access.
+func isWriteOpen(flags uint32) bool {
+	return flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0
+}
+
+// getPath returns the path of the node in the layer.
+func (n *node) getPath() string {
+	if u := n.opts.upper; u != nil {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+	}
+	return n.path
+}
+
+func (n *node) childPath(name string) string {
+	return path.Join(n.getPath(), name)
+}
+
+// newChild returns a child node of this node. e is nil if the child exists
+// only in the upper directory.
+func (n *node) newChild(name string, e *estargz.TOCEntry) *node {
+	var opaque bool
+	if e != nil {
+		if _, ok := e.LookupChild(whiteoutOpaqueDir); ok {
+			// This entry is an opaque directory so make it recognizable for overlayfs.
+			opaque = true
+		}
+	}
+	return &node{
+		r:        n.r,
+		e:        e,
+		s:        n.s,
+		layerSha: n.layerSha,
+		opaque:   opaque,
+		opts:     n.opts,
+		path:     n.childPath(name),
+	}
+}
+
+// lowerChild looks up the child entry in the layer which isn't hidden by removal.
+func (n *node) lowerChild(name string) (*estargz.TOCEntry, bool) {
+	if n.e == nil || n.opts.upper.isRemoved(n.childPath(name)) {
+		return nil, false
+	}
+	return n.e.LookupChild(name)
+}
+
+func (n *node) foreachLowerChild(f func(baseName string, ent *estargz.TOCEntry) bool) {
+	if n.e != nil {
+		n.e.ForeachChild(f)
+	}
+}
+
+// lookupUpper looks up the child in the upper directory. nil is returned if the
+// child doesn't exist in the upper directory.
+func (n *node) lookupUpper(ctx context.Context, name string, out *fuse.EntryOut) *fusefs.Inode {
+	st, ok := n.opts.upper.lstat(n.childPath(name))
+	if !ok {
+		return nil
+	}
+	var ino uint64
+	ce, ok := n.lowerChild(name)
+	if ok {
+		ino = inodeOfEnt(ce) // copied up from the layer
+	}
+	n.opts.upper.upperAttr(n.childPath(name), st, &out.Attr)
+	return n.NewInode(ctx, n.newChild(name, ce), fusefs.StableAttr{Mode: st.Mode, Ino: ino})
+}
+
+// readdirUpper merges entries in the upper directory to the entries of the layer.
+func (n *node) readdirUpper(ents []fuse.DirEntry) []fuse.DirEntry {
+	u := n.opts.upper
+	p := n.getPath()
+	var merged []fuse.DirEntry
+	for _, ent := range ents {
+		if !u.isRemoved(path.Join(p, ent.Name)) {
+			merged = append(merged, ent)
+		}
+	}
+	upperEnts, err := os.ReadDir(u.path(p))
+	if err != nil {
+		return merged
+	}
+	for _, ue := range upperEnts {
+		st, ok := u.lstat(path.Join(p, ue.Name()))
+		if !ok {
+			continue
+		}
+		ent := fuse.DirEntry{Mode: st.Mode, Name: ue.Name()}
+		replaced := false
+		for i := range merged {
+			if merged[i].Name == ent.Name {
+				ent.Ino = merged[i].Ino
+				merged[i] = ent
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			merged = append(merged, ent)
+		}
+	}
+	return merged
+}
+
+// copyUp copies the node and its parents in the layer to the upper directory.
+// The contents of the file whose only metadata are copied up are copied as well.
+func (n *node) copyUp() error {
+	p := n.getPath()
+	if _, ok := n.opts.upper.lstat(p); ok {
+		return n.opts.upper.copyUpData(n.r, p)
+	}
+	if n.e == nil {
+		return syscall.ENOENT // removed from the upper directory
+	}
+	return n.opts.upper.copyUp(n.r, p, n.e, n.opts, false)
+}
+
+// copyUpMeta is similar to copyUp but copies up only the metadata of the
+// regular file. The contents are read from the layer until copyUp is called.
+func (n *node) copyUpMeta() error {
+	p := n.getPath()
+	if _, ok := n.opts.upper.lstat(p); ok {
+		return nil
+	}
+	if n.e == nil {
+		return syscall.ENOENT // removed from the upper directory
+	}
+	return n.opts.upper.copyUp(n.r, p, n.e, n.opts, true)
+}
+
+func (u *writableUpper) copyUp(r reader.Reader, p string, e *estargz.TOCEntry, opts *nodeOptions, metaOnly bool) error {
+	if _, ok := u.lstat(p); ok {
+		return nil
+	}
+	if p != "" {
+		parent := path.Dir(p)
+		if parent == "." {
+			parent = ""
+		}
+		pe, ok := r.Lookup(parent)
+		if !ok {
+			return syscall.ENOENT
+		}
+		if err := u.copyUp(r, parent, pe, opts, false); err != nil {
+			return err
+		}
+	}
+
+	var attr fuse.Attr
+	entryToAttr(e, &attr, opts)
+	dst := u.path(p)
+	switch attr.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		if err := os.Mkdir(dst, 0700); err != nil {
+			return err
+		}
+	case syscall.S_IFLNK:
+		if err := os.Symlink(e.LinkName, dst); err != nil {
+			return err
+		}
+	case syscall.S_IFREG:
+		if metaOnly {
+			if err := createSparseFile(dst, e.Size); err != nil {
+				os.Remove(dst)
+				return err
+			}
+			u.mu.Lock()
+			u.metacopy[p] = e
+			u.mu.Unlock()
+			break
+		}
+		if err := copyUpFile(r, e, dst); err != nil {
+			os.Remove(dst)
+			return err
+		}
+	default:
+		if err := unix.Mknod(dst, attr.Mode, int(attr.Rdev)); err != nil {
+			return err
+		}
+	}
+	if err := os.Lchown(dst, int(attr.Uid), int(attr.Gid)); err != nil {
+		return err
+	}
+	if attr.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		return nil
+	}
+	if err := syscall.Chmod(dst, attr.Mode&07777); err != nil {
+		return err
+	}
+	ts := []unix.Timespec{
+		unix.NsecToTimespec(int64(attr.Atime)*1e9 + int64(attr.Atimensec)),
+		unix.NsecToTimespec(int64(attr.Mtime)*1e9 + int64(attr.Mtimensec)),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, dst, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func copyUpFile(r reader.Reader, e *estargz.TOCEntry, dst string) error {
+	ra, err := r.OpenFile(e.Name)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, io.NewSectionReader(ra, 0, e.Size)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func createSparseFile(dst string, size int64) error {
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// copyUpData copies the contents of the file whose only metadata are copied up.
+// The timestamps of the file are kept.
+func (u *writableUpper) copyUpData(r reader.Reader, p string) error {
+	de, ok := u.dataEntry(p)
+	if !ok {
+		return nil
+	}
+	dst := u.path(p)
+	var st syscall.Stat_t
+	if err := syscall.Stat(dst, &st); err != nil {
+		return err
+	}
+	ra, err := r.OpenFile(de.Name)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, io.NewSectionReader(ra, 0, de.Size)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	ts := []unix.Timespec{unix.Timespec(st.Atim), unix.Timespec(st.Mtim)}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, dst, ts, 0); err != nil {
+		return err
+	}
+	u.mu.Lock()
+	delete(u.metacopy, p)
+	u.mu.Unlock()
+	return nil
+}
+
+// openUpper opens the file in the upper directory.
+func (n *node) openUpper(flags uint32) (fusefs.FileHandle, uint32, syscall.Errno) {
+	fd, err := syscall.Open(n.opts.upper.path(n.getPath()), int(flags&^syscall.O_CREAT), 0)
+	if err != nil {
+		return nil, 0, fusefs.ToErrno(err)
+	}
+	return fusefs.NewLoopbackFile(fd), 0, 0
+}
+
+// prepareCreate checks that the child can be created and copies up this directory.
+func (n *node) prepareCreate(name string) syscall.Errno {
+	if n.opts.upper == nil {
+		return syscall.EROFS
+	}
+	if n.e != nil && n.e.Name == "" && name == stateDirName {
+		return syscall.EPERM
+	}
+	if _, ok := n.lowerChild(name); ok {
+		return syscall.EEXIST
+	}
+	if err := n.copyUp(); err != nil {
+		return fusefs.ToErrno(err)
+	}
+	return 0
+}
+
+// newUpperInode makes an inode for the child created in the upper directory.
+func (n *node) newUpperInode(ctx context.Context, name string, out *fuse.Attr) (*fusefs.Inode, syscall.Errno) {
+	p := n.opts.upper.path(n.childPath(name))
+	if c, ok := fuse.FromContext(ctx); ok {
+		os.Lchown(p, int(c.Uid), int(c.Gid))
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(p, &st); err != nil {
+		return nil, fusefs.ToErrno(err)
+	}
+	out.FromStat(&st)
+	return n.NewInode(ctx, n.newChild(name, nil), fusefs.StableAttr{Mode: st.Mode}), 0
+}
+
+var _ = (fusefs.NodeCreater)((*node)(nil))
+
+func (n *node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, fusefs.FileHandle, uint32, syscall.Errno) {
+	if errno := n.prepareCreate(name); errno != 0 {
+		return nil, nil, 0, errno
+	}
+	fd, err := syscall.Open(n.opts.upper.path(n.childPath(name)), int(flags)|syscall.O_CREAT, mode)
+	if err != nil {
+		return nil, nil, 0, fusefs.ToErrno(err)
+	}
+	ch, errno := n.newUpperInode(ctx, name, &out.Attr)
+	if errno != 0 {
+		syscall.Close(fd)
+		return nil, nil, 0, errno
+	}
+	return ch, fusefs.NewLoopbackFile(fd), 0, 0
+}
+
+var _ = (fusefs.NodeMkdirer)((*node)(nil))
+
+func (n *node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	if errno := n.prepareCreate(name); errno != 0 {
+		return nil, errno
+	}
+	if err := syscall.Mkdir(n.opts.upper.path(n.childPath(name)), mode); err != nil {
+		return nil, fusefs.ToErrno(err)
+	}
+	return n.newUpperInode(ctx, name, &out.Attr)
+}
+
+var _ = (fusefs.NodeSymlinker)((*node)(nil))
+
+func (n *node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (*fusefs.Inode, syscall.Errno) {
+	if errno := n.prepareCreate(name); errno != 0 {
+		return nil, errno
+	}
+	if err := syscall.Symlink(target, n.opts.upper.path(n.childPath(name))); err != nil {
+		return nil, fusefs.ToErrno(err)
+	}
+	return n.newUpperInode(ctx, name, &out.Attr)
+}
+
+var _ = (fusefs.NodeUnlinker)((*node)(nil))
+
+func (n *node) Unlink(ctx context.Context, name string) syscall.Errno {
+	return n.removeChild(name, false)
+}
+
+var _ = (fusefs.NodeRmdirer)((*node)(nil))
+
+func (n *node) Rmdir(ctx context.Context, name string) syscall.Errno {
+	return n.removeChild(name, true)
+}
+
+func (n *node) removeChild(name string, dir bool) syscall.Errno {
+	u := n.opts.upper
+	if u == nil {
+		return syscall.EROFS
+	}
+	p := n.childPath(name)
+	ce, lowerOK := n.lowerChild(name)
+	_, upperOK := u.lstat(p)
+	if !lowerOK && !upperOK {
+		return syscall.ENOENT
+	}
+	if dir && lowerOK {
+		// The directory must be empty in the merged view.
+		empty := true
+		ce.ForeachChild(func(baseName string, _ *estargz.TOCEntry) bool {
+			if !strings.HasPrefix(baseName, whiteoutPrefix) && !u.isRemoved(path.Join(p, baseName)) {
+				empty = false
+			}
+			return empty
+		})
+		if !empty {
+			return syscall.ENOTEMPTY
+		}
+	}
+	if upperOK {
+		rm := syscall.Unlink
+		if dir {
+			rm = syscall.Rmdir
+		}
+		if err := rm(u.path(p)); err != nil {
+			return fusefs.ToErrno(err)
+		}
+		u.mu.Lock()
+		delete(u.metacopy, p)
+		u.mu.Unlock()
+	}
+	if lowerOK {
+		u.remove(p)
+	}
+	return 0
+}
+
+var _ = (fusefs.NodeRenamer)((*node)(nil))
+
+func (n *node) Rename(ctx context.Context, name string, newParent fusefs.InodeEmbedder, newName string, flags uint32) syscall.Errno {
+	u := n.opts.upper
+	if u == nil {
+		return syscall.EROFS
+	}
+	if flags != 0 {
+		return syscall.ENOTSUP
+	}
+	np, ok := newParent.(*node)
+	if !ok {
+		return syscall.EXDEV
+	}
+	if np.e != nil && np.e.Name == "" && newName == stateDirName {
+		return syscall.EPERM
+	}
+	oldPath, newPath := n.childPath(name), np.childPath(newName)
+	ce, lowerOK := n.lowerChild(name)
+	st, upperOK := u.lstat(oldPath)
+	var mode uint32
+	switch {
+	case upperOK:
+		mode = st.Mode
+	case lowerOK:
+		mode = modeOfEntry(ce)
+	default:
+		return syscall.ENOENT
+	}
+	if mode&syscall.S_IFMT == syscall.S_IFDIR {
+		// Let the client fallback to copying the directory, as overlayfs does.
+		return syscall.EXDEV
+	}
+	if err := n.copyUp(); err != nil {
+		return fusefs.ToErrno(err)
+	}
+	if err := np.copyUp(); err != nil {
+		return fusefs.ToErrno(err)
+	}
+	if !upperOK {
+		if err := n.newChild(name, ce).copyUp(); err != nil {
+			return fusefs.ToErrno(err)
+		}
+	}
+	if err := syscall.Rename(u.path(oldPath), u.path(newPath)); err != nil {
+		return fusefs.ToErrno(err)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if lowerOK {
+		u.removed[oldPath] = true
+	}
+	u.removed[newPath] = true // the new entry hides the entry in the layer
+	delete(u.metacopy, newPath)
+	if de, ok := u.metacopy[oldPath]; ok {
+		// The contents are still read from the original entry in the layer.
+		u.metacopy[newPath] = de
+		delete(u.metacopy, oldPath)
+	}
+	if ch := n.GetChild(name); ch != nil {
+		if src, ok := ch.Operations().(*node); ok {
+			src.path = newPath
+		}
+	}
+	return 0
+}
+
+var _ = (fusefs.NodeSetattrer)((*node)(nil))
+
+func (n *node) Setattr(ctx context.Context, f fusefs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	u := n.opts.upper
+	if u == nil {
+		return syscall.EROFS
+	}
+	copyUp := n.copyUp
+	if _, ok := in.GetSize(); !ok {
+		copyUp = n.copyUpMeta // contents aren't modified
+	}
+	if err := copyUp(); err != nil {
+		return fusefs.ToErrno(err)
+	}
+	p := u.path(n.getPath())
+	if m, ok := in.GetMode(); ok {
+		if err := syscall.Chmod(p, m); err != nil {
+			return fusefs.ToErrno(err)
+		}
+	}
+	uid, uok := in.GetUID()
+	gid, gok := in.GetGID()
+	if uok || gok {
+		suid, sgid := -1, -1
+		if uok {
+			suid = int(uid)
+		}
+		if gok {
+			sgid = int(gid)
+		}
+		if err := os.Lchown(p, suid, sgid); err != nil {
+			return fusefs.ToErrno(err)
+		}
+	}
+	mtime, mok := in.GetMTime()
+	atime, aok := in.GetATime()
+	if mok || aok {
+		ap, mp := &atime, &mtime
+		if !aok {
+			ap = nil
+		}
+		if !mok {
+			mp = nil
+		}
+		ts := []syscall.Timespec{fuse.UtimeToTimespec(ap), fuse.UtimeToTimespec(mp)}
+		if err := syscall.UtimesNano(p, ts); err != nil {
+			return fusefs.ToErrno(err)
+		}
+	}
+	if sz, ok := in.GetSize(); ok {
+		if err := syscall.Truncate(p, int64(sz)); err != nil {
+			return fusefs.ToErrno(err)
+		}
+	}
+	var st syscall.Stat_t
+	if err := syscall.Lstat(p, &st); err != nil {
+		return fusefs.ToErrno(err)
+	}
+	u.upperAttr(n.getPath(), &st, &out.Attr)
+	return 0
+}
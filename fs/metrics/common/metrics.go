@@ -56,6 +56,39 @@ var (
 		},
 		[]string{"operation_type", "layer"},
 	)
+
+	// rateLimitedCount counts requests rejected by registries with 429 (Too Many Requests).
+	rateLimitedCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rate_limited_total",
+			Help:      "Number of requests to the registry rejected by rate limiting. Broken down by layer.",
+		},
+		[]string{"layer"},
+	)
+
+	// startupSize is the size of the prioritized files recorded by the converter.
+	startupSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "startup_size_bytes",
+			Help:      "Uncompressed size of the files needed at the startup of the container (i.e. prioritized files). Broken down by layer.",
+		},
+		[]string{"layer"},
+	)
+
+	// startupFiles is the number of the prioritized files recorded by the converter.
+	startupFiles = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "startup_files",
+			Help:      "Number of the files needed at the startup of the container (i.e. prioritized files). Broken down by layer.",
+		},
+		[]string{"layer"},
+	)
 )
 
 var register sync.Once
@@ -71,6 +104,9 @@ func sinceInMilliseconds(start time.Time) float64 {
 func Register() {
 	register.Do(func() {
 		prometheus.MustRegister(operationLatency)
+		prometheus.MustRegister(rateLimitedCount)
+		prometheus.MustRegister(startupSize)
+		prometheus.MustRegister(startupFiles)
 	})
 }
 
@@ -80,3 +116,15 @@ func Register() {
 func MeasureLatency(operation string, layer digest.Digest, start time.Time) {
 	operationLatency.WithLabelValues(operation, layer.String()).Observe(sinceInMilliseconds(start))
 }
+
+// IncRateLimited increments the number of requests rejected by rate limiting.
+func IncRateLimited(layer digest.Digest) {
+	rateLimitedCount.WithLabelValues(layer.String()).Inc()
+}
+
+// SetStartupSet records the size and the number of the files needed at the
+// startup of the container.
+func SetStartupSet(layer digest.Digest, size int64, files int64) {
+	startupSize.WithLabelValues(layer.String()).Set(float64(size))
+	startupFiles.WithLabelValues(layer.String()).Set(float64(files))
+}
@@ -36,6 +36,45 @@ var layerMetrics = []*metric{
 			}
 		},
 	},
+	{
+		name: "layer_on_demand_fetched_size",
+		help: "Total size fetched from the registry by on-demand reads of files in the layer",
+		unit: metrics.Bytes,
+		vt:   prometheus.CounterValue,
+		getValues: func(l layer.Layer) []value {
+			return []value{
+				{
+					v: float64(l.Info().OnDemandFetchedSize),
+				},
+			}
+		},
+	},
+	{
+		name: "layer_read_requested_size",
+		help: "Total size requested by reads of files in the layer which missed the cache",
+		unit: metrics.Bytes,
+		vt:   prometheus.CounterValue,
+		getValues: func(l layer.Layer) []value {
+			return []value{
+				{
+					v: float64(l.Info().ReadRequestedSize),
+				},
+			}
+		},
+	},
+	{
+		name: "layer_read_decompressed_size",
+		help: "Total size of chunks decompressed for reads of files in the layer which missed the cache",
+		unit: metrics.Bytes,
+		vt:   prometheus.CounterValue,
+		getValues: func(l layer.Layer) []value {
+			return []value{
+				{
+					v: float64(l.Info().ReadDecompressedSize),
+				},
+			}
+		},
+	},
 	{
 		name: "layer_size",
 		help: "Total size of the layer",
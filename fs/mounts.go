@@ -0,0 +1,128 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"hash/fnv"
+	"sync"
+
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+)
+
+// mountShards is the number of shards of mountTable.
+const mountShards = 64
+
+// mountState is the state of the layer mounted on a mountpoint.
+type mountState struct {
+	// layer is the layer mounted on the mountpoint. nil until the layer is
+	// registered (e.g. while the writable upper directory is prepared).
+	layer layer.Layer
+
+	// source is the source of the layer.
+	source source.Source
+
+	// immutable is non-nil if the contents of the layer are immutable so
+	// checks can be less frequent.
+	immutable *immutableMount
+
+	// upper is the writable upper directory of the layer. Empty if the layer
+	// isn't writable.
+	upper string
+
+	// cancel cancels the background tasks of the mount (e.g. prefetch).
+	cancel context.CancelFunc
+}
+
+func (m *mountState) empty() bool {
+	return m.layer == nil && m.upper == ""
+}
+
+// mountTable holds the states of the mountpoints. The table is sharded by the
+// mountpoint so that operations on different mountpoints (e.g. hundreds of
+// Mount and Check on node boot) don't serialize on a single lock. The zero
+// value is ready to use.
+type mountTable struct {
+	shards [mountShards]mountShard
+}
+
+type mountShard struct {
+	mu     sync.Mutex
+	states map[string]*mountState
+}
+
+func (t *mountTable) shard(mountpoint string) *mountShard {
+	h := fnv.New32a()
+	h.Write([]byte(mountpoint))
+	return &t.shards[h.Sum32()%mountShards]
+}
+
+// update calls f with the state of the mountpoint under the lock of its shard.
+// The state is created if it doesn't exist and removed if f empties it.
+func (t *mountTable) update(mountpoint string, f func(m *mountState)) {
+	s := t.shard(mountpoint)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.states[mountpoint]
+	if !ok {
+		m = &mountState{}
+	}
+	f(m)
+	if m.empty() {
+		delete(s.states, mountpoint)
+		return
+	}
+	if s.states == nil {
+		s.states = make(map[string]*mountState)
+	}
+	s.states[mountpoint] = m
+}
+
+// get returns the copy of the state of the mountpoint where the layer is
+// registered.
+func (t *mountTable) get(mountpoint string) (mountState, bool) {
+	s := t.shard(mountpoint)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.states[mountpoint]
+	if !ok || m.layer == nil {
+		return mountState{}, false
+	}
+	return *m, true
+}
+
+// layer returns the layer registered on the mountpoint. nil if not registered.
+func (t *mountTable) layer(mountpoint string) layer.Layer {
+	m, _ := t.get(mountpoint)
+	return m.layer
+}
+
+// unregister removes the layer registered on the mountpoint and returns it.
+// The background tasks of the mount are cancelled. The writable upper directory
+// is kept until it's cleaned up.
+func (t *mountTable) unregister(mountpoint string) (l layer.Layer) {
+	var cancel context.CancelFunc
+	t.update(mountpoint, func(m *mountState) {
+		l, cancel = m.layer, m.cancel
+		m.layer, m.source, m.immutable, m.cancel = nil, source.Source{}, nil, nil
+	})
+	if cancel != nil {
+		cancel()
+	}
+	return
+}
@@ -0,0 +1,168 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/moby/sys/mountinfo"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// mountRecord is the persisted record of a layer mounted by Mount.
+type mountRecord struct {
+	Mountpoint string            `json:"mountpoint"`
+	Namespace  string            `json:"namespace,omitempty"`
+	Labels     map[string]string `json:"labels"`
+}
+
+// mountStateStore persists the layers mounted on the filesystem so that they
+// can be mounted again after the filesystem restarts. Each mount is stored as
+// a JSON file named after the digest of the mountpoint. nil store records
+// nothing.
+type mountStateStore struct {
+	dir string
+}
+
+func newMountStateStore(dir string) (*mountStateStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &mountStateStore{dir: dir}, nil
+}
+
+func (s *mountStateStore) path(mountpoint string) string {
+	return filepath.Join(s.dir, digest.FromString(mountpoint).Encoded()+".json")
+}
+
+// add records the mount. The file is replaced atomically so that a crash never
+// leaves a partially written state. Credentials in the labels aren't recorded.
+func (s *mountStateStore) add(ctx context.Context, mountpoint string, labels map[string]string) error {
+	if s == nil {
+		return nil
+	}
+	ns, _ := namespaces.Namespace(ctx)
+	if _, ok := labels[config.TargetAuthLabel]; ok {
+		filtered := make(map[string]string, len(labels))
+		for k, v := range labels {
+			if k != config.TargetAuthLabel {
+				filtered[k] = v
+			}
+		}
+		labels = filtered
+	}
+	b, err := json.Marshal(mountRecord{
+		Mountpoint: mountpoint,
+		Namespace:  ns,
+		Labels:     labels,
+	})
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dir, "tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path(mountpoint))
+}
+
+func (s *mountStateStore) remove(mountpoint string) error {
+	if s == nil {
+		return nil
+	}
+	if err := os.Remove(s.path(mountpoint)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// list returns the recorded mounts sorted by their mountpoints.
+func (s *mountStateStore) list() (records []mountRecord, _ error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".json") {
+			continue // temporary files of the previous run
+		}
+		b, err := ioutil.ReadFile(filepath.Join(s.dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var st mountRecord
+		if err := json.Unmarshal(b, &st); err != nil {
+			return nil, errors.Wrapf(err, "invalid mount state %q", f.Name())
+		}
+		records = append(records, st)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Mountpoint < records[j].Mountpoint })
+	return records, nil
+}
+
+// restoreMounts mounts the layers recorded in the mount state store again. Mounts
+// left by the previous process are unmounted in advance because their FUSE
+// servers are gone (operations fail with ENOTCONN). Layers which can't be
+// mounted again are forgotten.
+func (fs *filesystem) restoreMounts(ctx context.Context) error {
+	records, err := fs.mountStates.list()
+	if err != nil {
+		return err
+	}
+	for _, st := range records {
+		lCtx := log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", st.Mountpoint))
+		if st.Namespace != "" {
+			lCtx = namespaces.WithNamespace(lCtx, st.Namespace)
+		}
+		if mounted, err := mountinfo.Mounted(st.Mountpoint); err == nil && mounted {
+			if err := syscall.Unmount(st.Mountpoint, syscall.MNT_FORCE); err != nil {
+				if err := syscall.Unmount(st.Mountpoint, syscall.MNT_DETACH); err != nil {
+					log.G(lCtx).WithError(err).Warn("failed to unmount stale mount; skipping restore")
+					continue
+				}
+			}
+		}
+		if err := fs.Mount(lCtx, st.Mountpoint, st.Labels); err != nil {
+			log.G(lCtx).WithError(err).Warn("failed to restore mount")
+			if err := fs.mountStates.remove(st.Mountpoint); err != nil {
+				log.G(lCtx).WithError(err).Warn("failed to remove mount state")
+			}
+			continue
+		}
+		log.G(lCtx).Info("restored mount")
+	}
+	return nil
+}
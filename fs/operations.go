@@ -0,0 +1,120 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+)
+
+// Operation is a privileged operation performed by the filesystem. This is
+// used for auditing and writing seccomp/AppArmor profiles for hardened hosts.
+type Operation struct {
+	// Name is the name of the operation.
+	Name string `json:"name"`
+
+	// Syscalls is the system calls used by the operation.
+	Syscalls []string `json:"syscalls,omitempty"`
+
+	// Exec is the external commands executed by the operation.
+	Exec []string `json:"exec,omitempty"`
+
+	// Paths is the paths accessed by the operation.
+	Paths []string `json:"paths,omitempty"`
+
+	// Description describes when the operation is performed.
+	Description string `json:"description"`
+}
+
+// Operations enumerates the privileged operations which the filesystem
+// configured with cfg can perform. Operations which aren't enabled by the
+// configuration aren't listed. Regular file I/O and networking are omitted.
+func Operations(cfg config.Config) (ops []Operation) {
+	if _, err := exec.LookPath(fusermountBin); err == nil {
+		ops = append(ops, Operation{
+			Name:        "fuse-mount",
+			Exec:        []string{fusermountBin},
+			Syscalls:    []string{"socketpair", "recvmsg"},
+			Paths:       []string{"/dev/fuse"},
+			Description: "mounts each layer as FUSE on the pre-created mountpoint via fusermount",
+		})
+	} else if !cfg.RestrictedOperations {
+		ops = append(ops, Operation{
+			Name:        "fuse-mount",
+			Syscalls:    []string{"mount"},
+			Paths:       []string{"/dev/fuse"},
+			Description: fmt.Sprintf("mounts each layer as FUSE on the pre-created mountpoint (%s isn't installed)", fusermountBin),
+		})
+	}
+	ops = append(ops, Operation{
+		Name:        "fuse-unmount",
+		Syscalls:    []string{"umount2"},
+		Description: "unmounts layers on removal of snapshots",
+	})
+	if !cfg.RestrictedOperations {
+		ops = append(ops, Operation{
+			Name:        "mount-in-namespace",
+			Syscalls:    []string{"unshare", "setns", "mount"},
+			Description: "mounts layers in the mount namespace of the mount helper (MountInNamespace)",
+		}, Operation{
+			Name:        "writable-upper-tmpfs",
+			Syscalls:    []string{"mount", "umount2"},
+			Description: fmt.Sprintf("mounts tmpfs for layers labeled %q with %q", config.TargetWritableLabel, config.WritableModeMemory),
+		})
+	}
+	switch cfg.DirectoryCacheConfig.Backend {
+	case config.CacheBackendTmpfs: // unavailable in restricted mode
+		ops = append(ops, Operation{
+			Name:        "cache-tmpfs",
+			Syscalls:    []string{"statfs", "mount"},
+			Description: "mounts tmpfs for the directory cache unless it's already mounted",
+		})
+	case config.CacheBackendFscrypt:
+		ops = append(ops, Operation{
+			Name:        "cache-fscrypt",
+			Syscalls:    []string{"ioctl"},
+			Description: "adds the fscrypt key and sets the encryption policy of the directory cache",
+		})
+	}
+	if cfg.HTTPCacheType == config.CacheTypeCachefilesCulling || cfg.FSCacheType == config.CacheTypeCachefilesCulling {
+		ops = append(ops, Operation{
+			Name:        "cache-cachefiles-culling",
+			Paths:       []string{cache.DefaultCachefilesDevice},
+			Description: "binds the cache directory to the kernel's cachefiles module",
+		})
+	}
+	if !cfg.DirectoryCacheConfig.DisableIOUring {
+		ops = append(ops, Operation{
+			Name:        "cache-io-uring",
+			Syscalls:    []string{"io_uring_setup", "io_uring_enter", "mmap"},
+			Description: "reads and writes cache files using io_uring if the kernel supports it",
+		})
+	}
+	return ops
+}
+
+// checkRestricted returns an error if the operation isn't allowed in the
+// restricted mode.
+func (fs *filesystem) checkRestricted(op string) error {
+	if fs.restrictedOperations {
+		return fmt.Errorf("%s is unavailable because restricted_operations is enabled", op)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package policy provides the policy evaluation point invoked before mounting
+// remote layers. This allows enforcing rules like "only lazy-pull from approved
+// registries". A policy can be an external webhook or any implementation of
+// Policy (e.g. an embedded OPA/rego engine) passed to the filesystem.
+package policy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+
+	// maxResponseSize is the max size of the response of the webhook.
+	maxResponseSize = 1024 * 1024
+)
+
+// Input is the information of the layer evaluated by the policy.
+type Input struct {
+	// Ref is the reference of the image containing the layer.
+	Ref string `json:"ref"`
+
+	// Digest is the digest of the layer.
+	Digest string `json:"digest"`
+
+	// Registry is the hostname of the registry serving the layer.
+	Registry string `json:"registry"`
+
+	// Annotations is the annotations of the layer.
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// InputFromSource returns the input of the policy about the source.
+func InputFromSource(s source.Source) Input {
+	return Input{
+		Ref:         s.Name.String(),
+		Digest:      s.Target.Digest.String(),
+		Registry:    s.Name.Hostname(),
+		Annotations: s.Target.Annotations,
+	}
+}
+
+// Decision is the result of the evaluation of the policy.
+type Decision struct {
+	// Allowed is true if the layer can be mounted.
+	Allowed bool `json:"allowed"`
+
+	// Reason is the human-readable reason of the decision.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Policy decides whether the layer can be mounted.
+type Policy interface {
+	Evaluate(ctx context.Context, in Input) (Decision, error)
+}
+
+// ErrDenied is returned by Check when the policy denies the layer.
+var ErrDenied = errors.New("denied by policy")
+
+// Check evaluates the policy and returns an error if the layer isn't allowed.
+// If the policy fails to be evaluated, the layer is allowed only when failOpen
+// is true.
+func Check(ctx context.Context, p Policy, in Input, failOpen bool) error {
+	d, err := p.Evaluate(ctx, in)
+	if err != nil {
+		if failOpen {
+			log.G(ctx).WithError(err).Warnf("failed to evaluate policy for %q; allowing", in.Digest)
+			return nil
+		}
+		return errors.Wrapf(err, "failed to evaluate policy for %q", in.Digest)
+	}
+	if !d.Allowed {
+		return errors.Wrapf(ErrDenied, "layer %q of %q: %s", in.Digest, in.Ref, d.Reason)
+	}
+	return nil
+}
+
+// Webhook is the policy evaluated by an external HTTP endpoint. Input is POSTed
+// to the endpoint as JSON and the endpoint responds with Decision as JSON.
+type Webhook struct {
+	url    string
+	client *http.Client
+}
+
+// NewWebhook returns the policy evaluated by the webhook specified in the config.
+func NewWebhook(cfg config.MountPolicyConfig) *Webhook {
+	timeout := time.Duration(cfg.TimeoutSec) * time.Second
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	return &Webhook{
+		url:    cfg.WebhookURL,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Evaluate queries the decision to the webhook.
+func (w *Webhook) Evaluate(ctx context.Context, in Input) (Decision, error) {
+	data, err := json.Marshal(in)
+	if err != nil {
+		return Decision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(data))
+	if err != nil {
+		return Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return Decision{}, fmt.Errorf("unexpected status code from webhook: %v", resp.Status)
+	}
+	var d Decision
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(&d); err != nil {
+		return Decision{}, errors.Wrapf(err, "failed to decode the response of webhook")
+	}
+	return d, nil
+}
+
+var _ = (Policy)((*Webhook)(nil))
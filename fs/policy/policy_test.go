@@ -0,0 +1,100 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package policy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/pkg/errors"
+)
+
+func TestWebhook(t *testing.T) {
+	// Allows only layers from "approved.example.com".
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in Input
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if in.Annotations["broken"] == "true" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		d := Decision{Allowed: in.Registry == "approved.example.com"}
+		if !d.Allowed {
+			d.Reason = "unapproved registry"
+		}
+		json.NewEncoder(w).Encode(&d)
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		in       Input
+		failOpen bool
+		wantErr  bool
+		denied   bool
+	}{
+		{
+			name: "allowed",
+			in:   Input{Ref: "approved.example.com/foo:latest", Registry: "approved.example.com"},
+		},
+		{
+			name:    "denied",
+			in:      Input{Ref: "other.example.com/foo:latest", Registry: "other.example.com"},
+			wantErr: true,
+			denied:  true,
+		},
+		{
+			name: "denied even if fail open",
+			in:   Input{Ref: "other.example.com/foo:latest", Registry: "other.example.com"},
+
+			failOpen: true,
+			wantErr:  true,
+			denied:   true,
+		},
+		{
+			name: "error fail close",
+			in: Input{Ref: "approved.example.com/foo:latest", Registry: "approved.example.com",
+				Annotations: map[string]string{"broken": "true"}},
+			wantErr: true,
+		},
+		{
+			name: "error fail open",
+			in: Input{Ref: "approved.example.com/foo:latest", Registry: "approved.example.com",
+				Annotations: map[string]string{"broken": "true"}},
+			failOpen: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewWebhook(config.MountPolicyConfig{WebhookURL: srv.URL})
+			err := Check(context.Background(), p, tt.in, tt.failOpen)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected result: %v; wantErr=%v", err, tt.wantErr)
+			}
+			if denied := errors.Cause(err) == ErrDenied; denied != tt.denied {
+				t.Errorf("denied = %v; want %v (err: %v)", denied, tt.denied, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/fs/layer"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// chainSettleTime is the time the coordinator waits for the next layer of an
+// image to be mounted before starting the prefetch of the layers mounted so
+// far. containerd mounts the layers one by one from the lowest, so the prefetch
+// starts from the uppermost layer once the whole chain is mounted.
+const chainSettleTime = 2 * time.Second
+
+// prefetchCoordinator prefetches the layers of each image one by one, from the
+// upper layers, instead of letting each layer prefetch independently. The
+// coordinator waits for the whole chain of the image (i.e. all layers in the
+// manifest) to be mounted, or for no more layer to be mounted in
+// chainSettleTime, then prefetches the mounted layers. Files of a layer hidden
+// by the upper layers of the image (e.g. overwritten or removed by whiteouts)
+// aren't prefetched nor fetched in background because the merged rootfs never
+// exposes them. The shadow is specific to the image; a layer shared with other
+// images is fetched in background again by them (see layer.ErrPartiallyFetched)
+// and hidden files of it are served on demand.
+type prefetchCoordinator struct {
+	resolver   *layer.Resolver
+	images     map[string]*imagePrefetch
+	settleTime time.Duration
+	mu         sync.Mutex
+
+	// layerShadow returns the shadow of the layer of the image. nil means the
+	// layer hides nothing.
+	layerShadow func(ctx context.Context, src source.Source, desc ocispec.Descriptor) *layer.Shadow
+}
+
+func newPrefetchCoordinator(r *layer.Resolver) *prefetchCoordinator {
+	c := &prefetchCoordinator{
+		resolver:   r,
+		images:     make(map[string]*imagePrefetch),
+		settleTime: chainSettleTime,
+	}
+	c.layerShadow = c.resolveShadow
+	return c
+}
+
+// imagePrefetch is the prefetch tasks of the layers of an image.
+type imagePrefetch struct {
+	pending []layerPrefetch
+
+	// mounted is the indexes of the layers mounted so far. added is notified
+	// when a layer is added.
+	mounted map[int]struct{}
+	added   chan struct{}
+
+	// shadows caches the shadow of each layer of the image. nil if the layer
+	// can't be resolved (e.g. it isn't eStargz).
+	shadows map[digest.Digest]*layer.Shadow
+}
+
+type layerPrefetch struct {
+	index int
+	fetch func(shadow *layer.Shadow)
+}
+
+// add schedules the fetch of the layer at the index of the image specified by
+// src. fetch is called with the shadow of the upper layers and must return
+// when the prefetch completes.
+func (c *prefetchCoordinator) add(ctx context.Context, src source.Source, index int, fetch func(shadow *layer.Shadow)) {
+	key := imageKey(layer.TenantFromContext(ctx), src.Manifest)
+	c.mu.Lock()
+	img, ok := c.images[key]
+	if !ok {
+		img = &imagePrefetch{
+			mounted: make(map[int]struct{}),
+			added:   make(chan struct{}, 1),
+			shadows: make(map[digest.Digest]*layer.Shadow),
+		}
+		c.images[key] = img
+	}
+	img.pending = append(img.pending, layerPrefetch{index, fetch})
+	img.mounted[index] = struct{}{}
+	c.mu.Unlock()
+	select {
+	case img.added <- struct{}{}:
+	default:
+	}
+	if !ok {
+		// Avoids to get canceled by client.
+		ctx := log.WithLogger(layer.WithTenantOf(context.Background(), ctx), log.G(ctx))
+		go c.run(ctx, key, img, src)
+	}
+}
+
+// run waits for the chain of the image to be mounted and prefetches the pending
+// layers of the image, the uppermost one first, until no layer is pending.
+func (c *prefetchCoordinator) run(ctx context.Context, key string, img *imagePrefetch, src source.Source) {
+	c.waitForChain(img, len(src.Manifest.Layers))
+	for {
+		c.mu.Lock()
+		if len(img.pending) == 0 {
+			delete(c.images, key)
+			c.mu.Unlock()
+			return
+		}
+		next := 0
+		for i, p := range img.pending {
+			if p.index > img.pending[next].index {
+				next = i
+			}
+		}
+		p := img.pending[next]
+		img.pending = append(img.pending[:next], img.pending[next+1:]...)
+		c.mu.Unlock()
+
+		p.fetch(c.shadowOf(ctx, img, src, p.index))
+	}
+}
+
+// waitForChain waits until all layers of the image are mounted or no layer is
+// mounted in the settle time. Upper layers don't wait for the prefetch of the
+// lower layers on mount so this never blocks the chain from being mounted.
+func (c *prefetchCoordinator) waitForChain(img *imagePrefetch, layers int) {
+	timer := time.NewTimer(c.settleTime)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		mounted := len(img.mounted)
+		c.mu.Unlock()
+		if mounted >= layers {
+			return
+		}
+		select {
+		case <-img.added:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(c.settleTime)
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// shadowOf returns the paths hidden by the layers upper than the index. Upper
+// layers which can't be resolved as eStargz hide nothing, so their lower files
+// may be fetched needlessly but never missed. The TOCs of upper layers may not
+// be verified yet; they are used only for skipping fetches.
+func (c *prefetchCoordinator) shadowOf(ctx context.Context, img *imagePrefetch, src source.Source, index int) *layer.Shadow {
+	shadow := layer.NewShadow()
+	for _, desc := range src.Manifest.Layers[index+1:] {
+		s, ok := img.shadows[desc.Digest]
+		if !ok {
+			s = c.layerShadow(ctx, src, desc)
+			img.shadows[desc.Digest] = s
+		}
+		if s != nil {
+			shadow.Merge(s)
+		}
+	}
+	return shadow
+}
+
+func (c *prefetchCoordinator) resolveShadow(ctx context.Context, src source.Source, desc ocispec.Descriptor) *layer.Shadow {
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("upper", desc.Digest))
+	l, err := c.resolver.Resolve(ctx, src.Hosts, src.Name, desc)
+	if err != nil {
+		log.G(ctx).WithError(err).Debug("failed to resolve upper layer; assuming it hides nothing")
+		return nil
+	}
+	defer l.Done()
+	s, err := l.Shadow()
+	if err != nil {
+		log.G(ctx).WithError(err).Debug("failed to get shadow of upper layer; assuming it hides nothing")
+		return nil
+	}
+	return s
+}
+
+// layerIndex returns the index of the layer in the manifest. -1 is returned if
+// the manifest doesn't contain the layer.
+func layerIndex(manifest ocispec.Manifest, target ocispec.Descriptor) int {
+	for i, desc := range manifest.Layers {
+		if desc.Digest == target.Digest {
+			return i
+		}
+	}
+	return -1
+}
+
+// imageKey identifies the image by the layers. Images of different tenants are
+// coordinated separately.
+func imageKey(tenant string, manifest ocispec.Manifest) string {
+	var layers []string
+	for _, desc := range manifest.Layers {
+		layers = append(layers, desc.Digest.String())
+	}
+	return tenant + "@" + digest.FromString(strings.Join(layers, ",")).String()
+}
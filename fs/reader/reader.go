@@ -25,6 +25,7 @@ package reader
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/sha256"
 	"fmt"
@@ -32,6 +33,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"sync"
+	"sync/atomic"
 
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/estargz"
@@ -50,13 +52,38 @@ type Reader interface {
 	Close() error
 }
 
+// ReadStats is the statistics of reads of files.
+type ReadStats struct {
+	// RequestedSize is the size requested by the reads which missed the cache.
+	RequestedSize int64
+
+	// DecompressedSize is the size of the chunks decompressed for the reads
+	// which missed the cache. This is larger than RequestedSize when reads
+	// don't cover whole chunks.
+	DecompressedSize int64
+
+	// CachedSize is the size served from the cache.
+	CachedSize int64
+}
+
+// StatsReader is a Reader which reports the statistics of reads. The Reader
+// produced by VerifiableReader implements this interface.
+type StatsReader interface {
+	Reader
+	ReadStats() ReadStats
+}
+
+var _ = (StatsReader)((*reader)(nil))
+
 // VerifiableReader produces a Reader with a given verifier.
 type VerifiableReader struct {
 	r *reader
 }
 
+// SkipVerify skips the verification of the TOC. Chunks are still verified with
+// the digests in the TOC (see chunkDigestVerifier).
 func (vr *VerifiableReader) SkipVerify() Reader {
-	vr.r.verifier = nopTOCEntryVerifier{}
+	vr.r.verifier = chunkDigestVerifier{}
 	return vr.r
 }
 
@@ -69,14 +96,38 @@ func (vr *VerifiableReader) VerifyTOC(tocDigest digest.Digest) (Reader, error) {
 	return vr.r, nil
 }
 
+// TOCDigest returns the digest of the TOC JSON of the layer. This identifies the
+// layer contents even if the layer isn't verified.
+func (vr *VerifiableReader) TOCDigest() digest.Digest {
+	return vr.r.r.TOCDigest()
+}
+
+// LookupUnverified looks up the TOC entry of the file. This is available even if
+// the layer isn't verified so the entry must be used only for optimizations
+// (e.g. planning prefetch) and never for serving the contents.
+func (vr *VerifiableReader) LookupUnverified(name string) (*estargz.TOCEntry, bool) {
+	return vr.r.r.Lookup(name)
+}
+
 func (vr *VerifiableReader) Close() error {
 	return vr.r.Close()
 }
 
-type nopTOCEntryVerifier struct{}
+// chunkDigestVerifier verifies chunks with the digests in the TOC which isn't
+// verified. This doesn't protect against tampering because the TOC can be
+// tampered as well but detects the chunks corrupted by misbehaving registries or
+// CDNs. Chunks without digests (e.g. legacy stargz) aren't verified.
+type chunkDigestVerifier struct{}
 
-func (nev nopTOCEntryVerifier) Verifier(ce *estargz.TOCEntry) (digest.Verifier, error) {
-	return nopVerifier{}, nil
+func (cv chunkDigestVerifier) Verifier(ce *estargz.TOCEntry) (digest.Verifier, error) {
+	if ce.ChunkDigest == "" {
+		return nopVerifier{}, nil
+	}
+	d, err := digest.Parse(ce.ChunkDigest)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse digest %q", ce.ChunkDigest)
+	}
+	return d.Verifier(), nil
 }
 
 type nopVerifier struct{}
@@ -89,19 +140,68 @@ func (nv nopVerifier) Verified() bool {
 	return true
 }
 
+// Option is an option of Reader.
+type Option func(*options)
+
+type options struct {
+	decompressor estargz.Decompressor
+	tocBlob      []byte
+	invalidate   func(offset, size int64) error
+}
+
+// WithDecompressor specifies the decompressor of the gzip streams in the blob.
+// By default, compress/gzip of the standard library is used.
+func WithDecompressor(d estargz.Decompressor) Option {
+	return func(opts *options) {
+		opts.decompressor = d
+	}
+}
+
+// WithExternalTOC specifies the blob of the TOC of the layer whose TOC is
+// stored separately from the layer blob (see estargz.WithExternalTOC).
+func WithExternalTOC(tocBlob []byte) Option {
+	return func(opts *options) {
+		opts.tocBlob = tocBlob
+	}
+}
+
+// WithInvalidateFunc specifies the function to invalidate the cached region of
+// the blob. This is called when a chunk read from the region is corrupted so
+// that the chunk is fetched again from the registry instead of the cache.
+func WithInvalidateFunc(f func(offset, size int64) error) Option {
+	return func(opts *options) {
+		opts.invalidate = f
+	}
+}
+
 // NewReader creates a Reader based on the given stargz blob and cache implementation.
 // It returns VerifiableReader so the caller must provide a estargz.TOCEntryVerifier
 // to use for verifying file or chunk contained in this stargz blob.
-func NewReader(sr *io.SectionReader, cache cache.BlobCache) (*VerifiableReader, error) {
-	r, err := estargz.Open(sr)
+func NewReader(sr *io.SectionReader, cache cache.BlobCache, opts ...Option) (*VerifiableReader, error) {
+	rOpts := options{
+		decompressor: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	}
+	for _, o := range opts {
+		o(&rOpts)
+	}
+	openOpts := []estargz.OpenOption{estargz.WithDecompressor(rOpts.decompressor)}
+	if rOpts.tocBlob != nil {
+		openOpts = append(openOpts, estargz.WithExternalTOCBlob(rOpts.tocBlob))
+	}
+	r, err := estargz.Open(sr, openOpts...)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to parse stargz")
 	}
 
 	vr := &reader{
-		r:     r,
-		sr:    sr,
-		cache: cache,
+		r:            r,
+		sr:           sr,
+		cache:        cache,
+		decompressor: rOpts.decompressor,
+		invalidate:   rOpts.invalidate,
+		openOpts:     openOpts,
 		bufPool: sync.Pool{
 			New: func() interface{} {
 				return new(bytes.Buffer)
@@ -119,6 +219,14 @@ type reader struct {
 	bufPool  sync.Pool
 	verifier estargz.TOCEntryVerifier
 
+	decompressor estargz.Decompressor
+	invalidate   func(offset, size int64) error
+	openOpts     []estargz.OpenOption
+
+	requestedSize    int64 // accessed atomically
+	decompressedSize int64 // accessed atomically
+	cachedSize       int64 // accessed atomically
+
 	closed   bool
 	closedMu sync.Mutex
 }
@@ -146,6 +254,14 @@ func (gr *reader) OpenFile(name string) (io.ReaderAt, error) {
 	}, nil
 }
 
+func (gr *reader) ReadStats() ReadStats {
+	return ReadStats{
+		RequestedSize:    atomic.LoadInt64(&gr.requestedSize),
+		DecompressedSize: atomic.LoadInt64(&gr.decompressedSize),
+		CachedSize:       atomic.LoadInt64(&gr.cachedSize),
+	}
+}
+
 func (gr *reader) Lookup(name string) (*estargz.TOCEntry, bool) {
 	return gr.r.Lookup(name)
 }
@@ -160,11 +276,12 @@ func (gr *reader) Cache(opts ...CacheOption) (err error) {
 		o(&cacheOpts)
 	}
 
-	r := gr.r
+	r, sr := gr.r, gr.sr
 	if cacheOpts.reader != nil {
-		if r, err = estargz.Open(cacheOpts.reader); err != nil {
+		if r, err = estargz.Open(cacheOpts.reader, gr.openOpts...); err != nil {
 			return errors.Wrap(err, "failed to parse stargz")
 		}
+		sr = cacheOpts.reader
 	}
 	root, ok := r.Lookup("")
 	if !ok {
@@ -178,11 +295,20 @@ func (gr *reader) Cache(opts ...CacheOption) (err error) {
 		filter = cacheOpts.filter
 	}
 
-	eg, egCtx := errgroup.WithContext(context.Background())
+	workers := cacheOpts.workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	ctx := context.Background()
+	if cacheOpts.ctx != nil {
+		ctx = cacheOpts.ctx
+	}
+	eg, egCtx := errgroup.WithContext(ctx)
 	eg.Go(func() error {
 		return gr.cacheWithReader(egCtx,
-			0, eg, semaphore.NewWeighted(int64(runtime.GOMAXPROCS(0))),
-			root, r, filter, cacheOpts.cacheOpts...)
+			0, eg, semaphore.NewWeighted(int64(workers)),
+			root, r, sr, filter, cacheOpts.cacheOpts...)
 	})
 	return eg.Wait()
 }
@@ -204,7 +330,11 @@ func (gr *reader) isClosed() bool {
 	return closed
 }
 
-func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *errgroup.Group, sem *semaphore.Weighted, dir *estargz.TOCEntry, r *estargz.Reader, filter func(*estargz.TOCEntry) bool, opts ...cache.Option) (rErr error) {
+// cacheWithReader caches the chunks of all files under the directory. Each chunk
+// is stored as an independent gzip stream in the blob so it is decompressed
+// directly from its own stream on sr. This allows chunks to be decompressed by
+// parallel workers without reading the rest of the file.
+func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *errgroup.Group, sem *semaphore.Weighted, dir *estargz.TOCEntry, r *estargz.Reader, sr *io.SectionReader, filter func(*estargz.TOCEntry) bool, opts ...cache.Option) (rErr error) {
 	if currentDepth > maxWalkDepth {
 		return fmt.Errorf("TOCEntry tree is too deep (depth:%d)", currentDepth)
 	}
@@ -224,7 +354,7 @@ func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *err
 					e.Name, dir.Name)
 				return false
 			}
-			if err := gr.cacheWithReader(ctx, currentDepth+1, eg, sem, e, r, filter, opts...); err != nil {
+			if err := gr.cacheWithReader(ctx, currentDepth+1, eg, sem, e, r, sr, filter, opts...); err != nil {
 				rErr = err
 				return false
 			}
@@ -240,12 +370,6 @@ func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *err
 			return true
 		}
 
-		sr, err := r.OpenFile(e.Name)
-		if err != nil {
-			rErr = err
-			return false
-		}
-
 		var nr int64
 		for nr < e.Size {
 			ce, ok := r.ChunkEntryForOffset(e.Name, nr)
@@ -269,7 +393,12 @@ func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *err
 				}
 
 				// missed cache, needs to fetch and add it to the cache
-				cr := io.NewSectionReader(sr, ce.ChunkOffset, ce.ChunkSize)
+				cr, err := gr.chunkReader(sr, ce)
+				if err != nil {
+					return errors.Wrapf(err, "failed to read chunk %q(off:%d,size:%d)",
+						e.Name, ce.ChunkOffset, ce.ChunkSize)
+				}
+				defer cr.Close()
 				v, err := gr.verifier.Verifier(ce)
 				if err != nil {
 					return errors.Wrapf(err, "verifier not found %q(off:%d,size:%d)",
@@ -292,6 +421,8 @@ func (gr *reader) cacheWithReader(ctx context.Context, currentDepth int, eg *err
 				}
 				if !v.Verified() {
 					w.Abort()
+					// Following reads fetch the chunk again.
+					gr.invalidateChunk(ce)
 					return fmt.Errorf("invalid chunk %q (offset:%d,size:%d)",
 						e.Name, ce.ChunkOffset, ce.ChunkSize)
 				}
@@ -336,6 +467,7 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 			n, err := r.ReadAt(p[nr:int64(nr)+expectedSize], lowerDiscard)
 			if (err == nil || err == io.EOF) && int64(n) == expectedSize {
 				nr += n
+				atomic.AddInt64(&sf.gr.cachedSize, expectedSize)
 				r.Close()
 				continue
 			}
@@ -345,17 +477,14 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 		// We missed cache. Take it from underlying reader.
 		// We read the whole chunk here and add it to the cache so that following
 		// reads against neighboring chunks can take the data without decmpression.
+		atomic.AddInt64(&sf.gr.requestedSize, expectedSize)
+		atomic.AddInt64(&sf.gr.decompressedSize, ce.ChunkSize)
 		if lowerDiscard == 0 && upperDiscard == 0 {
 			// We can directly store the result to the given buffer
 			ip := p[nr : int64(nr)+ce.ChunkSize]
-			n, err := sf.ra.ReadAt(ip, ce.ChunkOffset)
-			if err != nil && err != io.EOF {
-				return 0, errors.Wrap(err, "failed to read data")
-			}
-
-			// Verify this chunk
-			if err := sf.verify(ip, ce); err != nil {
-				return 0, errors.Wrap(err, "invalid chunk")
+			n, err := sf.readChunk(ip, ce)
+			if err != nil {
+				return 0, err
 			}
 
 			// Cache this chunk
@@ -376,15 +505,9 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 		b.Reset()
 		b.Grow(int(ce.ChunkSize))
 		ip := b.Bytes()[:ce.ChunkSize]
-		if _, err := sf.ra.ReadAt(ip, ce.ChunkOffset); err != nil && err != io.EOF {
-			sf.gr.bufPool.Put(b)
-			return 0, errors.Wrap(err, "failed to read data")
-		}
-
-		// Verify this chunk
-		if err := sf.verify(ip, ce); err != nil {
+		if _, err := sf.readChunk(ip, ce); err != nil {
 			sf.gr.bufPool.Put(b)
-			return 0, errors.Wrap(err, "invalid chunk")
+			return 0, err
 		}
 
 		// Cache this chunk
@@ -407,6 +530,25 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	return nr, nil
 }
 
+// readChunk reads the whole chunk to p and verifies it. If the chunk is
+// corrupted, it's read again once after invalidating its cached region of the
+// blob so that the corrupted data isn't served or cached.
+func (sf *file) readChunk(p []byte, ce *estargz.TOCEntry) (n int, err error) {
+	for retry := true; ; retry = false {
+		n, err = sf.ra.ReadAt(p, ce.ChunkOffset)
+		if err != nil && err != io.EOF {
+			return 0, errors.Wrap(err, "failed to read data")
+		}
+		verr := sf.verify(p, ce)
+		if verr == nil {
+			return n, nil
+		}
+		if !retry || !sf.gr.invalidateChunk(ce) {
+			return 0, errors.Wrap(verr, "invalid chunk")
+		}
+	}
+}
+
 func (sf *file) verify(p []byte, ce *estargz.TOCEntry) error {
 	v, err := sf.gr.verifier.Verifier(ce)
 	if err != nil {
@@ -437,12 +579,57 @@ func positive(n int64) int64 {
 	return n
 }
 
+// invalidateChunk invalidates the cached region of the blob holding the gzip
+// stream of the chunk. false is returned if it can't be invalidated.
+func (gr *reader) invalidateChunk(ce *estargz.TOCEntry) bool {
+	if gr.invalidate == nil {
+		return false
+	}
+	return gr.invalidate(ce.Offset, ce.NextOffset()-ce.Offset) == nil
+}
+
+// chunkReader returns the decompressed contents of the chunk. This reads only the
+// gzip stream of the chunk, which spans until the offset of the next entry.
+func (gr *reader) chunkReader(sr *io.SectionReader, ce *estargz.TOCEntry) (io.ReadCloser, error) {
+	gzSize := ce.NextOffset() - ce.Offset
+	if gzSize <= 0 {
+		return nil, fmt.Errorf("invalid gzip stream size %d of the chunk", gzSize)
+	}
+	// Fetch the whole gzip stream at once rather than by small reads of gzip reader.
+	br := bufio.NewReaderSize(io.NewSectionReader(sr, ce.Offset, gzSize), int(gzSize))
+	if _, err := br.Peek(int(gzSize)); err != nil {
+		return nil, errors.Wrap(err, "failed to fetch gzip stream")
+	}
+	zr, err := gr.decompressor(br)
+	if err != nil {
+		return nil, err
+	}
+	return &readCloser{io.LimitReader(zr, ce.ChunkSize), zr.Close}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	closeFunc func() error
+}
+
+func (rc *readCloser) Close() error { return rc.closeFunc() }
+
 type CacheOption func(*cacheOptions)
 
 type cacheOptions struct {
+	ctx       context.Context
 	cacheOpts []cache.Option
 	filter    func(*estargz.TOCEntry) bool
 	reader    *io.SectionReader
+	workers   int
+}
+
+// WithContext specifies the context of caching. Caching stops when the context
+// is done.
+func WithContext(ctx context.Context) CacheOption {
+	return func(opts *cacheOptions) {
+		opts.ctx = ctx
+	}
 }
 
 func WithCacheOpts(cacheOpts ...cache.Option) CacheOption {
@@ -462,3 +649,11 @@ func WithReader(sr *io.SectionReader) CacheOption {
 		opts.reader = sr
 	}
 }
+
+// WithWorkers specifies the number of chunks fetched and decompressed in
+// parallel. Defaults to GOMAXPROCS.
+func WithWorkers(n int) CacheOption {
+	return func(opts *cacheOptions) {
+		opts.workers = n
+	}
+}
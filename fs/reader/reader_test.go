@@ -24,9 +24,11 @@ package reader
 
 import (
 	"bytes"
+	"compress/gzip"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/containerd/stargz-snapshotter/cache"
@@ -111,6 +113,193 @@ func TestFailReader(t *testing.T) {
 	}
 }
 
+// Tests Cache decompresses each chunk from its own gzip stream.
+func TestCacheChunks(t *testing.T) {
+	chunkSize := 4
+	files := map[string]string{
+		"a":     "0123456789abcd",
+		"dir/b": "abcdefgh",
+		"c":     "xy",
+	}
+	stargzFile, dgst, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.File("a", files["a"]),
+		testutil.Dir("dir/"),
+		testutil.File("dir/b", files["dir/b"]),
+		testutil.File("c", files["c"]),
+	}, testutil.WithEStargzOptions(estargz.WithChunkSize(chunkSize)))
+	if err != nil {
+		t.Fatalf("failed to build sample estargz: %v", err)
+	}
+	sgz, err := estargz.Open(stargzFile)
+	if err != nil {
+		t.Fatalf("failed to parse converted stargz: %v", err)
+	}
+	ev, err := sgz.VerifyTOC(dgst)
+	if err != nil {
+		t.Fatalf("failed to verify stargz: %v", err)
+	}
+	for _, workers := range []int{1, 4} {
+		mcache := cache.NewMemoryCache()
+		rr := &recordReaderAt{ReaderAt: stargzFile}
+		gr, _, err := newReader(io.NewSectionReader(rr, 0, stargzFile.Size()), mcache, ev)
+		if err != nil {
+			t.Fatalf("failed to open stargz file: %v", err)
+		}
+		rr.reset()
+		if err := gr.Cache(WithWorkers(workers)); err != nil {
+			t.Fatalf("failed to cache reader (workers=%d): %v", workers, err)
+		}
+		var streams []region
+		for name, contents := range files {
+			e, ok := gr.Lookup(name)
+			if !ok {
+				t.Fatalf("failed to lookup %q", name)
+			}
+			for off := int64(0); off < e.Size; {
+				ce, ok := gr.r.ChunkEntryForOffset(name, off)
+				if !ok {
+					t.Fatalf("failed to get chunk of %q at %d", name, off)
+				}
+				streams = append(streams, region{ce.Offset, ce.NextOffset() - 1})
+				r, err := mcache.Get(genID(e.Digest, ce.ChunkOffset, ce.ChunkSize))
+				if err != nil {
+					t.Fatalf("chunk of %q at %d isn't cached (workers=%d)", name, off, workers)
+				}
+				p := make([]byte, ce.ChunkSize)
+				if _, err := r.ReadAt(p, 0); err != nil && err != io.EOF {
+					t.Fatalf("failed to read cached chunk: %v", err)
+				}
+				r.Close()
+				if want := contents[ce.ChunkOffset : ce.ChunkOffset+ce.ChunkSize]; string(p) != want {
+					t.Errorf("unexpected chunk of %q at %d: %q; want %q", name, off, string(p), want)
+				}
+				off += ce.ChunkSize
+			}
+		}
+		for _, name := range []string{estargz.PrefetchLandmark, estargz.NoPrefetchLandmark} {
+			if ce, ok := gr.r.ChunkEntryForOffset(name, 0); ok {
+				streams = append(streams, region{ce.Offset, ce.NextOffset() - 1})
+			}
+		}
+		// Each read must be the gzip stream of a chunk.
+		for _, reg := range rr.regions() {
+			found := false
+			for _, s := range streams {
+				if s == reg {
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Errorf("read region (%d, %d) isn't a gzip stream of a chunk (workers=%d)", reg.b, reg.e, workers)
+			}
+		}
+	}
+}
+
+// Tests corrupted chunks are fetched again after invalidating their region of
+// the blob even if the TOC isn't verified.
+func TestCorruptedChunk(t *testing.T) {
+	testFileName := "test"
+	sr, _, err := testutil.BuildEStargz([]testutil.TarEntry{
+		testutil.File(testFileName, sampleData1),
+	}, testutil.WithEStargzOptions(
+		estargz.WithChunkSize(sampleChunkSize),
+		estargz.WithCompressionLevel(gzip.NoCompression), // contents are stored as is
+	))
+	if err != nil {
+		t.Fatalf("failed to build sample estargz: %v", err)
+	}
+	blob := make([]byte, sr.Size())
+	if _, err := sr.ReadAt(blob, 0); err != nil {
+		t.Fatalf("failed to read blob: %v", err)
+	}
+	// The chunk includes non-octal digits so it doesn't match to tar headers.
+	corruptOffset := int64(bytes.Index(blob, []byte(sampleData1[6:6+sampleChunkSize])))
+	if corruptOffset < 0 {
+		t.Fatalf("chunk isn't stored as is")
+	}
+
+	for _, invalidatable := range []bool{true, false} {
+		t.Run(fmt.Sprintf("invalidatable=%v", invalidatable), func(t *testing.T) {
+			cr := &corruptReaderAt{ReaderAt: sr, offset: corruptOffset, corrupt: true}
+			var invalidated []region
+			var opts []Option
+			if invalidatable {
+				opts = append(opts, WithInvalidateFunc(func(offset, size int64) error {
+					invalidated = append(invalidated, region{offset, offset + size - 1})
+					cr.corrupt = false
+					return nil
+				}))
+			}
+			vr, err := NewReader(io.NewSectionReader(cr, 0, sr.Size()), cache.NewMemoryCache(), opts...)
+			if err != nil {
+				t.Fatalf("failed to open stargz: %v", err)
+			}
+			fr, err := vr.SkipVerify().OpenFile(testFileName)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+			p := make([]byte, len(sampleData1))
+			n, err := fr.ReadAt(p, 0)
+			if !invalidatable {
+				if err == nil {
+					t.Fatalf("corrupted chunk must not be served: %q", string(p[:n]))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to read file: %v", err)
+			}
+			if !bytes.Equal(p[:n], []byte(sampleData1)) {
+				t.Errorf("read %q; want %q", string(p[:n]), sampleData1)
+			}
+			if len(invalidated) != 1 || corruptOffset < invalidated[0].b || invalidated[0].e < corruptOffset {
+				t.Errorf("invalidated %v; want the region including %d", invalidated, corruptOffset)
+			}
+		})
+	}
+}
+
+type corruptReaderAt struct {
+	io.ReaderAt
+	offset  int64
+	corrupt bool
+}
+
+func (cr *corruptReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := cr.ReaderAt.ReadAt(p, off)
+	if i := cr.offset - off; cr.corrupt && 0 <= i && i < int64(n) {
+		p[i]++
+	}
+	return n, err
+}
+
+type recordReaderAt struct {
+	io.ReaderAt
+	regs []region
+	mu   sync.Mutex
+}
+
+func (rr *recordReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	rr.mu.Lock()
+	rr.regs = append(rr.regs, region{off, off + int64(len(p)) - 1})
+	rr.mu.Unlock()
+	return rr.ReaderAt.ReadAt(p, off)
+}
+
+func (rr *recordReaderAt) reset() {
+	rr.mu.Lock()
+	rr.regs = nil
+	rr.mu.Unlock()
+}
+
+func (rr *recordReaderAt) regions() []region {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	return append([]region{}, rr.regs...)
+}
+
 type breakReaderAt struct {
 	io.ReaderAt
 	success bool
@@ -275,6 +464,29 @@ type exceptSectionReader struct {
 	t      *testing.T
 }
 
+func TestReadStats(t *testing.T) {
+	f := makeFile(t, []byte(sampleData1), sampleChunkSize)
+
+	// 1 byte requested but the whole chunk is decompressed.
+	p := make([]byte, 1)
+	if _, err := f.ReadAt(p, sampleMiddleOffset); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	want := ReadStats{RequestedSize: 1, DecompressedSize: sampleChunkSize}
+	if got := f.gr.ReadStats(); got != want {
+		t.Errorf("stats = %+v; want %+v", got, want)
+	}
+
+	// Cache hits are counted separately.
+	if _, err := f.ReadAt(p, 0); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	want.CachedSize = 1
+	if got := f.gr.ReadStats(); got != want {
+		t.Errorf("stats = %+v; want %+v", got, want)
+	}
+}
+
 func newExceptSectionReader(t *testing.T, ra io.ReaderAt, except ...region) io.ReaderAt {
 	er := exceptSectionReader{ra: ra, t: t}
 	er.except = map[region]bool{}
@@ -0,0 +1,81 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"sync"
+	"time"
+)
+
+// fetchSizeWeight is the weight of the latest observation in the moving averages
+// of latency and bandwidth.
+const fetchSizeWeight = 0.3
+
+// fetchSizer adapts the size of each fetch to the bandwidth-delay product observed
+// on the connection to the registry. On a high-latency and high-bandwidth link,
+// fetching larger ranges per request amortizes the round trips. On a low-latency
+// local mirror, fetching only the required chunks avoids wasting the bandwidth.
+// The size is bounded by min and max.
+type fetchSizer struct {
+	min, max int64
+
+	latency   float64 // seconds until the response header arrives
+	bandwidth float64 // bytes per second
+	observed  bool
+	mu        sync.Mutex
+}
+
+func newFetchSizer(min, max int64) *fetchSizer {
+	if max < min {
+		max = min
+	}
+	return &fetchSizer{min: min, max: max}
+}
+
+// observe records a fetch of the specified size which took total, including
+// latency until the response header arrived.
+func (s *fetchSizer) observe(size int64, latency, total time.Duration) {
+	transfer := total - latency
+	if size <= 0 || transfer <= 0 {
+		return
+	}
+	bw := float64(size) / transfer.Seconds()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.observed {
+		s.latency, s.bandwidth, s.observed = latency.Seconds(), bw, true
+		return
+	}
+	s.latency = fetchSizeWeight*latency.Seconds() + (1-fetchSizeWeight)*s.latency
+	s.bandwidth = fetchSizeWeight*bw + (1-fetchSizeWeight)*s.bandwidth
+}
+
+// size returns the size to fetch per request.
+func (s *fetchSizer) size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.observed {
+		return s.min
+	}
+	bdp := int64(s.bandwidth * s.latency)
+	if bdp < s.min {
+		return s.min
+	} else if bdp > s.max {
+		return s.max
+	}
+	return bdp
+}
@@ -29,8 +29,10 @@ import (
 	"io/ioutil"
 	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/fs/source"
@@ -50,10 +52,91 @@ type Blob interface {
 	Close() error
 }
 
+// DegradableBlob is a Blob which can be served in a degraded mode. The blob
+// returned by Resolver implements this interface.
+type DegradableBlob interface {
+	Blob
+
+	// Degraded returns the reason why the blob is served in a degraded mode
+	// (e.g. the registry didn't report the size of the blob so the size in the
+	// descriptor is used). nil if the blob isn't degraded.
+	Degraded() error
+}
+
+var _ = (DegradableBlob)((*blob)(nil))
+
+// IdentityVerifier verifies that the blob served by a newly resolved source is
+// identical to the one served so far. This protects against URLs reused for
+// different contents. ra reads the blob from the new source bypassing caches.
+type IdentityVerifier func(ra io.ReaderAt, size int64) error
+
+// IdentityVerifiableBlob is a Blob which verifies its identity when it's
+// re-resolved (i.e. refreshed or failed over to another host). The blob
+// returned by Resolver implements this interface.
+type IdentityVerifiableBlob interface {
+	Blob
+
+	// SetIdentityVerifier sets the verifier. Sources which fail the verification
+	// aren't used.
+	SetIdentityVerifier(v IdentityVerifier)
+}
+
+var _ = (IdentityVerifiableBlob)((*blob)(nil))
+
+// ReadStatsBlob is a Blob which reports the size fetched from the registry by
+// on-demand reads (see WithOnDemand). Compared with the size requested by the
+// reads, this shows the amplification of on-demand reads. The blob returned by
+// Resolver implements this interface.
+type ReadStatsBlob interface {
+	Blob
+
+	// OnDemandFetchedSize returns the total size fetched by on-demand reads.
+	OnDemandFetchedSize() int64
+
+	// OnDemandFetchDuration returns the total time on-demand reads waited for
+	// the registry.
+	OnDemandFetchDuration() time.Duration
+
+	// FetchDuration returns the total time spent on fetching the blob from the
+	// registry, including prefetch and background fetch. Durations of
+	// concurrent fetches are summed.
+	FetchDuration() time.Duration
+}
+
+var _ = (ReadStatsBlob)((*blob)(nil))
+
+// InvalidatableBlob is a Blob whose cached contents can be invalidated. This is
+// used when the contents turn out to be corrupted (e.g. a chunk doesn't match to
+// its digest) so that the following reads fetch them again from the registry.
+// The blob returned by Resolver implements this interface.
+type InvalidatableBlob interface {
+	Blob
+
+	// Invalidate removes the cached contents of the region of the blob.
+	Invalidate(offset int64, size int64) error
+}
+
+var _ = (InvalidatableBlob)((*blob)(nil))
+
+// PinnableBlob is a Blob whose cached contents can be exempted from eviction of
+// the cache. The blob returned by Resolver implements this interface.
+type PinnableBlob interface {
+	Blob
+
+	// Pin makes the cached contents exempt from eviction.
+	Pin(pinned bool)
+}
+
+var _ = (PinnableBlob)((*blob)(nil))
+
 type blob struct {
 	fetcher   *fetcher
 	fetcherMu sync.Mutex
 
+	// generation is the generation of the resolver's transports which the
+	// fetcher is resolved with. Accessed atomically.
+	generation int64
+
 	size          int64
 	chunkSize     int64
 	cache         cache.BlobCache
@@ -65,8 +148,31 @@ type blob struct {
 	fetchedRegionSet   regionSet
 	fetchedRegionSetMu sync.Mutex
 
+	onDemandFetchedSize   int64 // accessed atomically
+	onDemandFetchDuration int64 // accessed atomically
+	fetchDuration         int64 // accessed atomically
+
 	resolver *Resolver
 
+	// sizer adapts the size to fetch on cache misses. nil if disabled.
+	sizer *fetchSizer
+
+	// Source of the blob. These are used for failing over to another host.
+	hosts      source.RegistryHosts
+	refspec    reference.Spec
+	desc       ocispec.Descriptor
+	verifier   IdentityVerifier
+	sourceMu   sync.Mutex
+	failures   int
+	failuresMu sync.Mutex
+
+	// reauthMu serializes re-resolutions of the blob on 401.
+	reauthMu sync.Mutex
+
+	// driftErr is the content drift detected on the registry. Protected by
+	// fetcherMu.
+	driftErr error
+
 	closed   bool
 	closedMu sync.Mutex
 }
@@ -94,17 +200,36 @@ func (b *blob) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec
 	}
 
 	// refresh the fetcher
-	new, newSize, err := newFetcher(ctx, hosts, refspec, desc)
+	var (
+		new     *fetcher
+		newSize int64
+		err     error
+	)
+	if b.resolver != nil {
+		new, newSize, err = b.resolver.resolveFetcher(ctx, hosts, refspec, desc)
+	} else {
+		new, newSize, err = newFetcher(ctx, hosts, refspec, desc)
+	}
 	if err != nil {
 		return err
 	} else if newSize != b.size {
 		return fmt.Errorf("Invalid size of new blob %d; want %d", newSize, b.size)
 	}
+	if b.resolver != nil {
+		new.limiter = b.resolver.rateLimiterOf(new)
+		new.faults = b.resolver.faults
+	}
+	if err := b.verifyIdentity(ctx, new); err != nil {
+		return err
+	}
 
 	// update the blob's fetcher with new one
 	b.fetcherMu.Lock()
 	b.fetcher = new
 	b.fetcherMu.Unlock()
+	b.sourceMu.Lock()
+	b.hosts, b.refspec, b.desc = hosts, refspec, desc
+	b.sourceMu.Unlock()
 	b.lastCheckMu.Lock()
 	b.lastCheck = time.Now()
 	b.lastCheckMu.Unlock()
@@ -144,6 +269,59 @@ func (b *blob) Size() int64 {
 	return b.size
 }
 
+func (b *blob) SetIdentityVerifier(v IdentityVerifier) {
+	b.sourceMu.Lock()
+	b.verifier = v
+	b.sourceMu.Unlock()
+}
+
+// verifyIdentity verifies that the fetcher serves the same blob as before.
+func (b *blob) verifyIdentity(ctx context.Context, f *fetcher) error {
+	b.sourceMu.Lock()
+	v := b.verifier
+	b.sourceMu.Unlock()
+	b.fetcherMu.Lock()
+	cur := b.fetcher
+	b.fetcherMu.Unlock()
+	replaced := cur != nil && cur.validator.ifRange() != "" && f.validator.ifRange() != "" &&
+		cur.validator != f.validator
+	if v == nil {
+		if replaced {
+			log.G(ctx).WithField("digest", f.digest).
+				Warnf("blob has been replaced on %q but its identity can't be verified", f.host)
+		}
+		return nil
+	}
+	if replaced {
+		log.G(ctx).WithField("digest", f.digest).Infof("blob has been replaced on %q; verifying identity", f.host)
+	}
+	ra := readerAtFunc(func(p []byte, offset int64) (int, error) {
+		rc, err := f.FetchRange(ctx, ocispec.Descriptor{}, offset, int64(len(p)))
+		if err != nil {
+			return 0, err
+		}
+		defer rc.Close()
+		return io.ReadFull(rc, p)
+	})
+	if err := v(ra, b.size); err != nil {
+		return errors.Wrapf(err, "host %q serves different contents", f.host)
+	}
+	return nil
+}
+
+type readerAtFunc func([]byte, int64) (int, error)
+
+func (f readerAtFunc) ReadAt(p []byte, offset int64) (int, error) { return f(p, offset) }
+
+func (b *blob) Degraded() error {
+	b.fetcherMu.Lock()
+	defer b.fetcherMu.Unlock()
+	if b.driftErr != nil {
+		return b.driftErr
+	}
+	return b.fetcher.sizeErr
+}
+
 func (b *blob) FetchedSize() int64 {
 	b.fetchedRegionSetMu.Lock()
 	sz := b.fetchedRegionSet.totalSize()
@@ -151,6 +329,18 @@ func (b *blob) FetchedSize() int64 {
 	return sz
 }
 
+func (b *blob) OnDemandFetchedSize() int64 {
+	return atomic.LoadInt64(&b.onDemandFetchedSize)
+}
+
+func (b *blob) OnDemandFetchDuration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&b.onDemandFetchDuration))
+}
+
+func (b *blob) FetchDuration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&b.fetchDuration))
+}
+
 func (b *blob) Cache(offset int64, size int64, opts ...Option) error {
 	if b.isClosed() {
 		return fmt.Errorf("blob is already closed")
@@ -233,10 +423,30 @@ func (b *blob) ReadAt(p []byte, offset int64, opts ...Option) (int, error) {
 		return nil
 	})
 
+	// Fetch following chunks together if it's worth it.
+	if b.sizer != nil && len(allData) > 0 {
+		if end := floor(allRegion.b+b.sizer.size(), b.chunkSize) - 1; end > allRegion.e {
+			b.walkChunks(region{allRegion.e + 1, end}, func(chunk region) error {
+				if r, err := b.cache.Get(fr.genID(chunk), readAtOpts.cacheOpts...); err == nil {
+					return r.Close() // nop if the cache hits
+				}
+				allData[chunk] = ioutil.Discard
+				return nil
+			})
+		}
+	}
+
 	// Read required data
 	if err := b.fetchRange(allData, &readAtOpts); err != nil {
 		return 0, err
 	}
+	if readAtOpts.onDemand {
+		var fetched int64
+		for reg := range allData {
+			fetched += reg.size()
+		}
+		atomic.AddInt64(&b.onDemandFetchedSize, fetched)
+	}
 
 	// Adjust the buffer size according to the blob size
 	if remain := b.size - offset; int64(len(p)) >= remain {
@@ -249,11 +459,99 @@ func (b *blob) ReadAt(p []byte, offset int64, opts ...Option) (int, error) {
 	return len(p), nil
 }
 
+func (b *blob) Pin(pinned bool) {
+	if pc, ok := b.cache.(cache.PinnableCache); ok {
+		pc.Pin(pinned)
+	}
+}
+
+func (b *blob) Invalidate(offset int64, size int64) error {
+	if b.isClosed() {
+		return fmt.Errorf("blob is already closed")
+	}
+	rc, ok := b.cache.(cache.RemovableCache)
+	if !ok {
+		return fmt.Errorf("cache of the blob isn't removable")
+	}
+	if size <= 0 || offset >= b.size {
+		return nil
+	}
+	b.fetcherMu.Lock()
+	fr := b.fetcher
+	b.fetcherMu.Unlock()
+	allRegion := region{floor(offset, b.chunkSize), ceil(offset+size-1, b.chunkSize) - 1}
+	return b.walkChunks(allRegion, func(chunk region) error {
+		return rc.Remove(fr.genID(chunk))
+	})
+}
+
 // fetchRange fetches all specified chunks from local cache and remote blob.
+// If the content of the blob drifted on the registry, the blob is re-resolved
+// and the chunks are fetched again.
 func (b *blob) fetchRange(allData map[region]io.Writer, opts *options) error {
 	if len(allData) == 0 {
 		return nil
 	}
+	start := time.Now()
+	defer func() {
+		d := int64(time.Since(start))
+		atomic.AddInt64(&b.fetchDuration, d)
+		if opts.onDemand {
+			atomic.AddInt64(&b.onDemandFetchDuration, d)
+		}
+	}()
+	err := b.fetchChunks(allData, opts)
+	if !errors.Is(err, ErrContentDrift) {
+		return err
+	}
+	if rerr := b.recoverDrift(allData, err); rerr != nil {
+		return rerr
+	}
+	for _, w := range allData {
+		if bw, ok := w.(*bytesWriter); ok {
+			bw.reset() // discard the contents written by the failed attempt
+		}
+	}
+	return b.fetchChunks(allData, opts)
+}
+
+// recoverDrift handles the content drift detected on fetching the chunks. The
+// chunks are removed from the cache because the cached contents can be
+// corrupted and the blob is marked as degraded. Then the blob is re-resolved.
+// An error is returned if the blob can't be served as before (e.g. the size
+// of the blob changed).
+func (b *blob) recoverDrift(allData map[region]io.Writer, driftErr error) error {
+	b.fetcherMu.Lock()
+	fr := b.fetcher
+	b.driftErr = driftErr
+	b.fetcherMu.Unlock()
+	b.sourceMu.Lock()
+	hosts, refspec, desc := b.hosts, b.refspec, b.desc
+	b.sourceMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), b.fetchTimeout)
+	defer cancel()
+	log.G(ctx).WithError(driftErr).WithField("digest", fr.digest).
+		Warn("content of the blob drifted; re-resolving the blob")
+
+	if rc, ok := b.cache.(cache.RemovableCache); ok {
+		for reg := range allData {
+			if err := rc.Remove(fr.genID(reg)); err != nil {
+				log.G(ctx).WithError(err).Debugf("failed to invalidate cache of region %v", reg)
+			}
+		}
+	}
+	if hosts == nil {
+		return errors.Wrap(driftErr, "source of the blob is unknown")
+	}
+	if err := b.Refresh(ctx, hosts, refspec, desc); err != nil {
+		return errors.Wrapf(driftErr, "failed to re-resolve the blob: %v", err)
+	}
+	return nil
+}
+
+// fetchChunks fetches the specified chunks from the remote blob.
+func (b *blob) fetchChunks(allData map[region]io.Writer, opts *options) error {
+	b.refreshTransport()
 
 	// Fetcher can be suddenly updated so we take and use the snapshot of it for
 	// consistency.
@@ -268,13 +566,41 @@ func (b *blob) fetchRange(allData map[region]io.Writer, opts *options) error {
 		req = append(req, reg)
 		fetched[reg] = false
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), b.fetchTimeout)
+	// The request is aborted on timeout or when the caller's context is done
+	// (e.g. the layer being prefetched is unmounted). The cancellation isn't
+	// the failure of the host.
+	parent := context.Background()
+	if opts.ctx != nil {
+		parent = opts.ctx
+	}
+	ctx, cancel := context.WithTimeout(parent, b.fetchTimeout)
 	defer cancel()
+	start := time.Now()
 	mr, err := fr.fetch(ctx, req, true, opts)
+	if errors.Is(err, ErrUnauthorized) {
+		if newFr, rerr := b.reauthorize(ctx, fr); rerr == nil {
+			fr = newFr
+			start = time.Now()
+			mr, err = fr.fetch(ctx, req, true, opts)
+		}
+	}
 	if err != nil {
-		return err
+		newFr, ferr := b.failover(ctx, fr, err)
+		if ferr != nil {
+			return err
+		}
+		// Continue reading from the new host.
+		fr = newFr
+		start = time.Now()
+		if mr, err = fr.fetch(ctx, req, true, opts); err != nil {
+			return err
+		}
 	}
+	b.failuresMu.Lock()
+	b.failures = 0
+	b.failuresMu.Unlock()
 	defer mr.Close()
+	latency := time.Since(start)
 
 	// Update the check timer because we succeeded to access the blob
 	b.lastCheckMu.Lock()
@@ -337,9 +663,125 @@ func (b *blob) fetchRange(allData map[region]io.Writer, opts *options) error {
 		return fmt.Errorf("failed to fetch region %v", unfetched)
 	}
 
+	if b.sizer != nil {
+		var size int64
+		for reg := range allData {
+			size += reg.size()
+		}
+		b.sizer.observe(size, latency, time.Since(start))
+	}
+
 	return nil
 }
 
+// refreshTransport re-resolves the fetcher if the transports of the resolver
+// are invalidated after the fetcher is resolved. Only one goroutine refreshes
+// the fetcher and the current fetcher is kept if it fails.
+func (b *blob) refreshTransport() {
+	if b.resolver == nil {
+		return
+	}
+	cur, gen := atomic.LoadInt64(&b.generation), atomic.LoadInt64(&b.resolver.transportGeneration)
+	if cur == gen || !atomic.CompareAndSwapInt64(&b.generation, cur, gen) {
+		return
+	}
+	b.sourceMu.Lock()
+	hosts, refspec, desc := b.hosts, b.refspec, b.desc
+	b.sourceMu.Unlock()
+	if hosts == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), b.fetchTimeout)
+	defer cancel()
+	if err := b.Refresh(ctx, hosts, refspec, desc); err != nil {
+		log.G(ctx).WithError(err).WithField("digest", desc.Digest).
+			Warn("failed to refresh transport; keep using the current one")
+		return
+	}
+	log.G(ctx).WithField("digest", desc.Digest).Debug("refreshed transport")
+}
+
+// reauthorize re-resolves the blob with a new authorizer and returns the new
+// fetcher. This recovers the blob from the token which is rejected by the
+// registry but still cached in the authorizer (e.g. the registry doesn't tell
+// the token is invalid). Only one goroutine re-resolves the blob per fetcher.
+func (b *blob) reauthorize(ctx context.Context, fr *fetcher) (*fetcher, error) {
+	b.reauthMu.Lock()
+	defer b.reauthMu.Unlock()
+	b.fetcherMu.Lock()
+	cur := b.fetcher
+	b.fetcherMu.Unlock()
+	if cur != fr {
+		// Another goroutine has already switched the fetcher.
+		return cur, nil
+	}
+	b.sourceMu.Lock()
+	hosts, refspec, desc := b.hosts, b.refspec, b.desc
+	b.sourceMu.Unlock()
+	if hosts == nil {
+		return nil, fmt.Errorf("source of the blob is unknown")
+	}
+	if err := b.Refresh(ctx, hosts, refspec, desc); err != nil {
+		log.G(ctx).WithError(err).WithField("digest", desc.Digest).
+			Warn("failed to re-authorize the blob")
+		return nil, err
+	}
+	log.G(ctx).WithField("digest", desc.Digest).Info("re-authorized the blob")
+	b.fetcherMu.Lock()
+	defer b.fetcherMu.Unlock()
+	return b.fetcher, nil
+}
+
+// failover records the failure of the fetcher. If the fetcher fails persistently
+// (failoverThreshold times in a row), the blob is re-resolved on the next
+// configured host and the new fetcher is returned.
+func (b *blob) failover(ctx context.Context, fr *fetcher, fetchErr error) (*fetcher, error) {
+	if errors.Is(fetchErr, ErrRateLimited) || errors.Is(fetchErr, ErrContentDrift) || ctx.Err() != nil {
+		return nil, fetchErr // the host is alive
+	}
+	b.failuresMu.Lock()
+	b.failures++
+	failures := b.failures
+	b.failuresMu.Unlock()
+	if failures < failoverThreshold {
+		return nil, fetchErr
+	}
+
+	b.sourceMu.Lock()
+	hosts, refspec, desc := b.hosts, b.refspec, b.desc
+	b.sourceMu.Unlock()
+	if hosts == nil {
+		return nil, fmt.Errorf("source of the blob is unknown")
+	}
+	new, newSize, err := newFetcherAfter(ctx, hosts, refspec, desc, fr.host)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to re-resolve the blob")
+	} else if newSize != b.size {
+		return nil, fmt.Errorf("invalid size of new blob %d; want %d", newSize, b.size)
+	}
+	if b.resolver != nil {
+		new.limiter = b.resolver.rateLimiterOf(new)
+	}
+	new.faults = fr.faults
+	if err := b.verifyIdentity(ctx, new); err != nil {
+		return nil, errors.Wrap(err, "failed to re-resolve the blob")
+	}
+	b.fetcherMu.Lock()
+	if b.fetcher != fr {
+		// Another goroutine has already switched the fetcher.
+		new = b.fetcher
+	} else {
+		b.fetcher = new
+		log.G(ctx).WithField("digest", desc.Digest).Infof("switched host from %q to %q after %d failures: %v",
+			fr.host, new.host, failures, fetchErr)
+	}
+	b.fetcherMu.Unlock()
+	b.failuresMu.Lock()
+	b.failures = 0
+	b.failuresMu.Unlock()
+	return new, nil
+}
+
 type walkFunc func(reg region) error
 
 // walkChunks walks chunks from begin to end in order in the specified region.
@@ -375,6 +817,10 @@ type bytesWriter struct {
 	current int64
 }
 
+func (bw *bytesWriter) reset() {
+	bw.current = 0
+}
+
 func (bw *bytesWriter) Write(p []byte) (int, error) {
 	defer func() { bw.current = bw.current + int64(len(p)) }()
 
@@ -24,6 +24,7 @@ package remote
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -31,13 +32,22 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
+	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/containerd/containerd/reference"
 	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/util/faultinject"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -570,3 +580,342 @@ func parseRangeString(t *testing.T, rangeString string) (int64, int64) {
 	}
 	return begin, end
 }
+
+func TestRateLimit(t *testing.T) {
+	var (
+		limited = 2
+		inner   = multiRoundTripper(t, []byte(sampleData1))
+		b       = makeBlob(t, int64(len(sampleData1)), sampleChunkSize, func(req *http.Request) *http.Response {
+			if limited > 0 {
+				limited--
+				header := make(http.Header)
+				header.Add("Retry-After", "0")
+				return &http.Response{
+					StatusCode: http.StatusTooManyRequests,
+					Header:     header,
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
+				}
+			}
+			return inner(req)
+		})
+	)
+	b.fetcher.limiter = &rateLimiter{}
+	checkRead(t, []byte(sampleData1), b, 0, int64(len(sampleData1)))
+	if limited != 0 {
+		t.Errorf("%d rate limited responses aren't consumed", limited)
+	}
+
+	// Retries are bounded.
+	var requests int
+	b = makeBlob(t, int64(len(sampleData1)), sampleChunkSize, func(req *http.Request) *http.Response {
+		requests++
+		header := make(http.Header)
+		header.Add("Retry-After", "0")
+		return &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
+		}
+	})
+	b.fetcher.limiter = &rateLimiter{}
+	if _, err := b.ReadAt(make([]byte, len(sampleData1)), 0); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("must be failed with rate limit error but got %v", err)
+	}
+	if requests != maxRateLimitRetries+1 {
+		t.Errorf("requested %d times; want %d", requests, maxRateLimitRetries+1)
+	}
+
+	// Keeps rate limited until timeout.
+	b = makeBlob(t, int64(len(sampleData1)), sampleChunkSize, func(req *http.Request) *http.Response {
+		header := make(http.Header)
+		header.Add("Retry-After", "1")
+		return &http.Response{
+			StatusCode: http.StatusTooManyRequests,
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewReader([]byte{})),
+		}
+	})
+	b.fetcher.limiter = &rateLimiter{}
+	b.fetchTimeout = 100 * time.Millisecond
+	if _, err := b.ReadAt(make([]byte, len(sampleData1)), 0); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("must be failed with rate limit error but got %v", err)
+	}
+}
+
+func TestFaultInjection(t *testing.T) {
+	// Short reads from the registry are tolerated.
+	b := makeBlob(t, int64(len(sampleData1)), sampleChunkSize, multiRoundTripper(t, []byte(sampleData1)))
+	b.fetcher.faults = faultinject.New(faultinject.Config{ShortReadRate: 1.0})
+	checkRead(t, []byte(sampleData1), b, 0, int64(len(sampleData1)))
+
+	// Injected errors are surfaced to the reader.
+	b = makeBlob(t, int64(len(sampleData1)), sampleChunkSize, multiRoundTripper(t, []byte(sampleData1)))
+	b.fetcher.faults = faultinject.New(faultinject.Config{ErrorRate: 1.0})
+	if _, err := b.ReadAt(make([]byte, len(sampleData1)), 0); !errors.Is(err, faultinject.ErrInjected) {
+		t.Errorf("must be failed with injected fault but got %v", err)
+	}
+
+	// Reads succeed after faults are disabled.
+	b.fetcher.faults.Set(faultinject.Config{})
+	checkRead(t, []byte(sampleData1), b, 0, int64(len(sampleData1)))
+}
+
+func TestFetcher(t *testing.T) {
+	f := &fetcher{url: testURL, tr: multiRoundTripper(t, []byte(sampleData1))}
+	for _, tt := range []struct{ offset, size int64 }{
+		{0, 1}, {2, 5}, {0, int64(len(sampleData1))}, {int64(len(sampleData1)) - 1, 1},
+	} {
+		rc, err := f.FetchRange(context.Background(), ocispec.Descriptor{}, tt.offset, tt.size)
+		if err != nil {
+			t.Fatalf("failed to fetch range (offset=%d,size=%d): %v", tt.offset, tt.size, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("failed to read range (offset=%d,size=%d): %v", tt.offset, tt.size, err)
+		}
+		if want := sampleData1[tt.offset : tt.offset+tt.size]; string(data) != want {
+			t.Errorf("fetched %q; want %q", string(data), want)
+		}
+	}
+}
+
+func TestInFlightRequests(t *testing.T) {
+	dgst := digest.FromString(sampleData1)
+	f := &fetcher{url: testURL, digest: dgst, host: "registry.test", tr: multiRoundTripper(t, []byte(sampleData1))}
+	rc, err := f.FetchRange(context.Background(), ocispec.Descriptor{}, 2, 5)
+	if err != nil {
+		t.Fatalf("failed to fetch range: %v", err)
+	}
+	reqs := InFlightRequests()
+	if len(reqs) != 1 {
+		t.Fatalf("in-flight requests = %+v; want 1 request", reqs)
+	}
+	if r := reqs[0]; r.Host != "registry.test" || r.Digest != dgst || r.Ranges != "2-6" {
+		t.Errorf("in-flight request = %+v; want host=registry.test, digest=%v, ranges=2-6", r, dgst)
+	}
+	rc.Close()
+	if reqs := InFlightRequests(); len(reqs) != 0 {
+		t.Errorf("in-flight requests after close = %+v; want none", reqs)
+	}
+
+	// Failed requests are no longer in flight.
+	f = &fetcher{url: testURL, digest: dgst, tr: RoundTripFunc(func(req *http.Request) *http.Response {
+		return &http.Response{StatusCode: http.StatusNotFound, Status: "404 Not Found", Header: make(http.Header), Body: ioutil.NopCloser(bytes.NewReader(nil))}
+	})}
+	if _, err := f.FetchRange(context.Background(), ocispec.Descriptor{}, 0, 1); err == nil {
+		t.Fatalf("fetch must fail on 404")
+	}
+	if reqs := InFlightRequests(); len(reqs) != 0 {
+		t.Errorf("in-flight requests after failure = %+v; want none", reqs)
+	}
+}
+
+func TestFetchSizer(t *testing.T) {
+	s := newFetchSizer(100, 1000)
+	if sz := s.size(); sz != 100 {
+		t.Errorf("size before observation = %d; want 100", sz)
+	}
+	// 500 bytes/s * 1s latency = 500 bytes
+	s.observe(500, time.Second, 2*time.Second)
+	if sz := s.size(); sz != 500 {
+		t.Errorf("size = %d; want 500", sz)
+	}
+	// Bandwidth-delay product grows
+	for i := 0; i < 100; i++ {
+		s.observe(5000, time.Second, 2*time.Second)
+	}
+	if sz := s.size(); sz != 1000 {
+		t.Errorf("size must be bounded by max but got %d", sz)
+	}
+	// Low-latency mirror
+	for i := 0; i < 100; i++ {
+		s.observe(5000, time.Microsecond, time.Second)
+	}
+	if sz := s.size(); sz != 100 {
+		t.Errorf("size must be bounded by min but got %d", sz)
+	}
+}
+
+func TestAdaptiveFetchSize(t *testing.T) {
+	var (
+		requests int
+		data     = []byte(strings.Repeat(sampleData1, 10))
+		inner    = multiRoundTripper(t, data)
+		b        = makeBlob(t, int64(len(data)), sampleChunkSize, func(req *http.Request) *http.Response {
+			requests++
+			return inner(req)
+		})
+	)
+	b.sizer = newFetchSizer(sampleChunkSize, sampleChunkSize*4)
+	b.sizer.observe(sampleChunkSize*4, time.Second, 2*time.Second) // large bandwidth-delay product
+
+	// Following chunks are fetched together.
+	checkRead(t, data[0:1], b, 0, 1)
+	checkRead(t, data[sampleChunkSize*3:sampleChunkSize*4], b, sampleChunkSize*3, sampleChunkSize)
+	if requests != 1 {
+		t.Errorf("following chunks must be fetched together but requested %d times", requests)
+	}
+	checkRead(t, data[sampleChunkSize*4:sampleChunkSize*4+1], b, sampleChunkSize*4, 1)
+	if requests != 2 {
+		t.Errorf("chunks over the fetch size must be fetched but requested %d times", requests)
+	}
+}
+
+func TestOnDemandFetchedSize(t *testing.T) {
+	data := []byte(strings.Repeat(sampleData1, 10))
+	b := makeBlob(t, int64(len(data)), sampleChunkSize, multiRoundTripper(t, data))
+
+	// Not counted if the read isn't on-demand.
+	checkRead(t, data[0:1], b, 0, 1)
+	if sz := b.OnDemandFetchedSize(); sz != 0 {
+		t.Errorf("fetched size = %d; want 0", sz)
+	}
+
+	// The whole chunk is fetched even if 1 byte is requested.
+	p := make([]byte, 1)
+	if _, err := b.ReadAt(p, sampleChunkSize*2, WithOnDemand()); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if sz := b.OnDemandFetchedSize(); sz != sampleChunkSize {
+		t.Errorf("fetched size = %d; want %d", sz, sampleChunkSize)
+	}
+	if d := b.OnDemandFetchDuration(); d <= 0 || d > b.FetchDuration() {
+		t.Errorf("on-demand fetch duration = %v; want positive and up to the total %v", d, b.FetchDuration())
+	}
+
+	// Cached chunks aren't counted.
+	if _, err := b.ReadAt(p, sampleChunkSize*2+1, WithOnDemand()); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if sz := b.OnDemandFetchedSize(); sz != sampleChunkSize {
+		t.Errorf("fetched size = %d; want %d", sz, sampleChunkSize)
+	}
+}
+
+func TestCancelFetch(t *testing.T) {
+	started := make(chan struct{}, failoverThreshold)
+	b := makeBlob(t, int64(len(sampleData1)), sampleChunkSize, nil)
+	b.fetcher.tr = &blockingRoundTripper{started}
+	for i := 0; i < failoverThreshold; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		errCh := make(chan error)
+		go func() { errCh <- b.Cache(0, int64(len(sampleData1)), WithContext(ctx)) }()
+		<-started
+		cancel()
+		select {
+		case err := <-errCh:
+			if err == nil {
+				t.Fatalf("cancelled fetch must fail")
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("in-flight request isn't cancelled")
+		}
+	}
+
+	// Cancellations aren't failures of the host.
+	b.failuresMu.Lock()
+	failures := b.failures
+	b.failuresMu.Unlock()
+	if failures != 0 {
+		t.Errorf("failures = %d; want 0", failures)
+	}
+}
+
+// blockingRoundTripper doesn't respond until the request is cancelled.
+type blockingRoundTripper struct {
+	started chan struct{}
+}
+
+func (tr *blockingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr.started <- struct{}{}
+	<-req.Context().Done()
+	return nil, req.Context().Err()
+}
+
+func TestInvalidate(t *testing.T) {
+	data := []byte(sampleData1)
+	b := makeBlob(t, int64(len(data)), sampleChunkSize, multiRoundTripper(t, data))
+	checkRead(t, data, b, 0, int64(len(data)))
+
+	// Only the chunks overlapping with the region are invalidated.
+	if err := b.Invalidate(sampleChunkSize+1, sampleChunkSize); err != nil {
+		t.Fatalf("failed to invalidate: %v", err)
+	}
+	if err := b.walkChunks(region{0, int64(len(data)) - 1}, func(reg region) error {
+		r, err := b.cache.Get(b.fetcher.genID(reg))
+		if err == nil {
+			r.Close()
+		}
+		if wantHit := reg.b != sampleChunkSize && reg.b != sampleChunkSize*2; (err == nil) != wantHit {
+			t.Errorf("cache hit of region %v = %v; want %v", reg, err == nil, wantHit)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to walk chunks: %v", err)
+	}
+
+	// Invalidated chunks are fetched again.
+	checkRead(t, data, b, 0, int64(len(data)))
+}
+
+func TestLocalContentStore(t *testing.T) {
+	l, err := testutil.BuildEStargzLayer([]testutil.TarEntry{testutil.File("foo", "foo")})
+	if err != nil {
+		t.Fatalf("failed to build layer: %v", err)
+	}
+	reg := testutil.NewRegistry()
+	defer reg.Close()
+	img, err := reg.PushImage("test", "latest", l)
+	if err != nil {
+		t.Fatalf("failed to push image: %v", err)
+	}
+	refspec, err := reference.Parse(img.Ref)
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	root := t.TempDir()
+	blobPath := filepath.Join(root, "blobs", l.Desc.Digest.Algorithm().String(), l.Desc.Digest.Encoded())
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(blobPath, l.Data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewResolver(config.BlobConfig{ContentStorePath: root}).Resolve(context.Background(),
+		reg.Hosts(), refspec, l.Desc, cache.NewMemoryCache())
+	if err != nil {
+		t.Fatalf("failed to resolve blob: %v", err)
+	}
+	defer b.Close()
+	read := func() {
+		data := make([]byte, b.Size())
+		if _, err := b.ReadAt(data, 0); err != nil {
+			t.Fatalf("failed to read blob: %v", err)
+		}
+		if !bytes.Equal(data, l.Data) {
+			t.Fatalf("unexpected contents of blob")
+		}
+	}
+
+	// Contents are read from the content store without accessing the registry.
+	read()
+	if err := b.Check(); err != nil {
+		t.Errorf("failed to check blob: %v", err)
+	}
+	if n := reg.BlobRequests(l.Desc.Digest); n != 0 {
+		t.Errorf("registry is accessed %d times; want 0", n)
+	}
+
+	// The registry is used after the local content is removed.
+	if err := os.Remove(blobPath); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Check(); err != nil {
+		t.Errorf("failed to check blob after falling back to the registry: %v", err)
+	}
+	read()
+	if n := reg.BlobRequests(l.Desc.Digest); n == 0 {
+		t.Errorf("registry must be accessed after the local content is removed")
+	}
+}
@@ -0,0 +1,163 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// Fetcher is containerd's remotes.Fetcher which additionally supports fetching
+// a range of the blob. Fetcher uses the hosts configuration, authorizers and
+// transports passed through source.RegistryHosts in the same manner as
+// containerd's docker resolver so library users can inject them.
+type Fetcher interface {
+	remotes.Fetcher
+
+	// FetchRange fetches the specified range of the blob.
+	FetchRange(ctx context.Context, desc ocispec.Descriptor, offset, size int64) (io.ReadCloser, error)
+}
+
+var (
+	_ = (Fetcher)((*fetcher)(nil))
+	_ = (Fetcher)((*failoverFetcher)(nil))
+)
+
+// NewFetcher resolves the blob on the hosts and returns the Fetcher of the blob
+// with its size. Use Resolver.Fetcher for sharing the rate limiters of the hosts
+// among fetchers.
+func NewFetcher(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (Fetcher, int64, error) {
+	return NewResolver(config.BlobConfig{}).Fetcher(ctx, hosts, refspec, desc)
+}
+
+// Fetcher resolves the blob on the hosts and returns the Fetcher of the blob
+// with its size. Requests are throttled by the rate limiters of the resolver.
+// If a request fails, the blob is resolved again on the next host and the
+// request is retried there once.
+func (r *Resolver) Fetcher(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (Fetcher, int64, error) {
+	f, size, err := r.resolveFetcher(ctx, hosts, refspec, desc)
+	if err != nil {
+		return nil, 0, err
+	}
+	r.prepareFetcher(f)
+	return &failoverFetcher{r: r, hosts: hosts, refspec: refspec, desc: desc, f: f}, size, nil
+}
+
+// failoverFetcher is a Fetcher which fails over to the next host on failures.
+type failoverFetcher struct {
+	r       *Resolver
+	hosts   source.RegistryHosts
+	refspec reference.Spec
+	desc    ocispec.Descriptor
+
+	f   *fetcher
+	fMu sync.Mutex
+}
+
+// Fetch fetches the entire blob.
+func (ff *failoverFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	return ff.do(ctx, func(f *fetcher) (io.ReadCloser, error) { return f.Fetch(ctx, desc) })
+}
+
+// FetchRange fetches the specified range of the blob.
+func (ff *failoverFetcher) FetchRange(ctx context.Context, desc ocispec.Descriptor, offset, size int64) (io.ReadCloser, error) {
+	return ff.do(ctx, func(f *fetcher) (io.ReadCloser, error) { return f.FetchRange(ctx, desc, offset, size) })
+}
+
+func (ff *failoverFetcher) do(ctx context.Context, fn func(*fetcher) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	ff.fMu.Lock()
+	f := ff.f
+	ff.fMu.Unlock()
+	rc, err := fn(f)
+	if err == nil || ctx.Err() != nil {
+		return rc, err
+	}
+	newF, _, rErr := newFetcherAfter(ctx, ff.hosts, ff.refspec, ff.desc, f.host)
+	if rErr != nil {
+		log.G(ctx).WithError(rErr).Debug("failed to fail over to another host")
+		return nil, err
+	}
+	ff.r.prepareFetcher(newF)
+	log.G(ctx).WithError(err).Infof("failing over from host %q to %q", f.host, newF.host)
+	ff.fMu.Lock()
+	if ff.f == f {
+		ff.f = newF
+	}
+	ff.fMu.Unlock()
+	return fn(newF)
+}
+
+// Fetch fetches the entire blob. This is the same as fetching the range of the
+// entire blob so the request is throttled by the rate limiter.
+func (f *fetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	return f.FetchRange(ctx, desc, 0, f.size)
+}
+
+// FetchRange fetches the specified range of the blob.
+func (f *fetcher) FetchRange(ctx context.Context, desc ocispec.Descriptor, offset, size int64) (io.ReadCloser, error) {
+	if err := f.checkDesc(desc); err != nil {
+		return nil, err
+	}
+	if size <= 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	mr, err := f.fetch(ctx, []region{{offset, offset + size - 1}}, true, &options{})
+	if err != nil {
+		return nil, err
+	}
+	reg, r, err := mr.Next()
+	if err != nil {
+		mr.Close()
+		return nil, errors.Wrap(err, "failed to read response")
+	}
+	if reg.b > offset || reg.e < offset+size-1 {
+		mr.Close()
+		return nil, fmt.Errorf("unexpected range %d-%d; want %d-%d", reg.b, reg.e, offset, offset+size-1)
+	}
+	// The registry possibly returns larger range (e.g. the entire blob).
+	if _, err := io.CopyN(ioutil.Discard, r, offset-reg.b); err != nil {
+		mr.Close()
+		return nil, errors.Wrap(err, "failed to skip response")
+	}
+	return &readCloser{io.LimitReader(r, size), mr.Close}, nil
+}
+
+func (f *fetcher) checkDesc(desc ocispec.Descriptor) error {
+	if desc.Digest != "" && f.digest != "" && desc.Digest != f.digest {
+		return fmt.Errorf("fetcher of %q can't fetch %q", f.digest, desc.Digest)
+	}
+	return nil
+}
+
+type readCloser struct {
+	io.Reader
+	closeFunc func() error
+}
+
+func (rc *readCloser) Close() error { return rc.closeFunc() }
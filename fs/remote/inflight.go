@@ -0,0 +1,83 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	digest "github.com/opencontainers/go-digest"
+)
+
+// InFlightRequest is a range request to a registry which hasn't completed
+// yet. The request is in flight until the response body is closed.
+type InFlightRequest struct {
+	Host   string        `json:"host"`
+	Digest digest.Digest `json:"digest"`
+	Ranges string        `json:"ranges"`
+	Start  time.Time     `json:"start"`
+}
+
+var inFlight = struct {
+	requests map[uint64]InFlightRequest
+	next     uint64
+	mu       sync.Mutex
+}{requests: make(map[uint64]InFlightRequest)}
+
+// InFlightRequests returns the range requests to registries in flight in this
+// process, oldest first.
+func InFlightRequests() []InFlightRequest {
+	inFlight.mu.Lock()
+	res := make([]InFlightRequest, 0, len(inFlight.requests))
+	for _, r := range inFlight.requests {
+		res = append(res, r)
+	}
+	inFlight.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Start.Before(res[j].Start) })
+	return res
+}
+
+// trackRequest records the request as in flight. The caller must call done
+// when the request completes.
+func trackRequest(r InFlightRequest) (done func()) {
+	inFlight.mu.Lock()
+	id := inFlight.next
+	inFlight.next++
+	inFlight.requests[id] = r
+	inFlight.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			inFlight.mu.Lock()
+			delete(inFlight.requests, id)
+			inFlight.mu.Unlock()
+		})
+	}
+}
+
+// trackedReadCloser completes the tracked request when the body is closed.
+type trackedReadCloser struct {
+	io.ReadCloser
+	done func()
+}
+
+func (rc *trackedReadCloser) Close() error {
+	rc.done()
+	return rc.ReadCloser.Close()
+}
@@ -0,0 +1,299 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// localBlob is a blob served from containerd's content store. The blob is
+// resolved on the registry only when the local content becomes unavailable
+// (e.g. garbage collected) so no network traffic occurs for layers already
+// downloaded on the node.
+type localBlob struct {
+	resolver  *Resolver
+	path      string
+	size      int64
+	blobCache cache.BlobCache // used by the blob resolved on the registry
+
+	mu       sync.Mutex
+	f        *os.File // nil after falling back to the registry
+	remote   Blob     // non-nil after falling back to the registry
+	hosts    source.RegistryHosts
+	refspec  reference.Spec
+	desc     ocispec.Descriptor
+	verifier IdentityVerifier
+	closed   bool
+}
+
+var _ = (IdentityVerifiableBlob)((*localBlob)(nil))
+
+var _ = (DegradableBlob)((*localBlob)(nil))
+
+var _ = (ReadStatsBlob)((*localBlob)(nil))
+
+var _ = (InvalidatableBlob)((*localBlob)(nil))
+
+// resolveLocal returns the blob served from the content store.
+func (r *Resolver) resolveLocal(hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, blobCache cache.BlobCache) (*localBlob, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	p := filepath.Join(r.blobConfig.ContentStorePath, "blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if desc.Size > 0 && fi.Size() != desc.Size {
+		f.Close()
+		return nil, fmt.Errorf("invalid size of local content %d; want %d", fi.Size(), desc.Size)
+	}
+	return &localBlob{
+		resolver:  r,
+		path:      p,
+		size:      fi.Size(),
+		blobCache: blobCache,
+		f:         f,
+		hosts:     hosts,
+		refspec:   refspec,
+		desc:      desc,
+	}, nil
+}
+
+// remoteBlob returns the blob resolved on the registry. The blob is resolved
+// and the local content is released on the first call.
+func (lb *localBlob) remoteBlob(ctx context.Context) (Blob, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.closed {
+		return nil, fmt.Errorf("blob is already closed")
+	}
+	if lb.remote != nil {
+		return lb.remote, nil
+	}
+	b, err := lb.resolver.resolveRemote(ctx, lb.hosts, lb.refspec, lb.desc, lb.blobCache)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fall back to the registry")
+	}
+	if b.Size() != lb.size {
+		return nil, fmt.Errorf("invalid size of blob on the registry %d; want %d", b.Size(), lb.size)
+	}
+	if rb, ok := b.(*blob); ok && lb.verifier != nil {
+		if err := rb.verifyIdentity(ctx, rb.fetcher); err != nil {
+			return nil, errors.Wrap(err, "failed to fall back to the registry")
+		}
+		rb.SetIdentityVerifier(lb.verifier)
+	}
+	log.G(ctx).WithField("digest", lb.desc.Digest).Info("local content is unavailable; fell back to the registry")
+	lb.remote = b
+	if lb.f != nil {
+		lb.f.Close()
+		lb.f = nil
+	}
+	return b, nil
+}
+
+// local returns the local content. nil is returned after falling back to the
+// registry.
+func (lb *localBlob) local() *os.File {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.f
+}
+
+func (lb *localBlob) Check() error {
+	if lb.local() != nil {
+		if _, err := os.Stat(lb.path); err == nil {
+			return nil
+		}
+	}
+	b, err := lb.remoteBlob(context.Background())
+	if err != nil {
+		return err
+	}
+	return b.Check()
+}
+
+func (lb *localBlob) Size() int64 {
+	return lb.size
+}
+
+func (lb *localBlob) FetchedSize() int64 {
+	lb.mu.Lock()
+	b := lb.remote
+	lb.mu.Unlock()
+	if b != nil {
+		return b.FetchedSize()
+	}
+	return lb.size
+}
+
+// OnDemandFetchedSize returns the size fetched from the registry by on-demand
+// reads after falling back to the registry. Reads of the local content are free.
+func (lb *localBlob) OnDemandFetchedSize() int64 {
+	lb.mu.Lock()
+	b := lb.remote
+	lb.mu.Unlock()
+	if rb, ok := b.(ReadStatsBlob); ok {
+		return rb.OnDemandFetchedSize()
+	}
+	return 0
+}
+
+// OnDemandFetchDuration returns the time on-demand reads waited for the registry
+// after falling back to the registry.
+func (lb *localBlob) OnDemandFetchDuration() time.Duration {
+	lb.mu.Lock()
+	b := lb.remote
+	lb.mu.Unlock()
+	if rb, ok := b.(ReadStatsBlob); ok {
+		return rb.OnDemandFetchDuration()
+	}
+	return 0
+}
+
+// FetchDuration returns the time spent on fetching the blob from the registry
+// after falling back to the registry.
+func (lb *localBlob) FetchDuration() time.Duration {
+	lb.mu.Lock()
+	b := lb.remote
+	lb.mu.Unlock()
+	if rb, ok := b.(ReadStatsBlob); ok {
+		return rb.FetchDuration()
+	}
+	return 0
+}
+
+func (lb *localBlob) ReadAt(p []byte, offset int64, opts ...Option) (int, error) {
+	if f := lb.local(); f != nil {
+		if offset >= lb.size {
+			return 0, nil
+		}
+		if remain := lb.size - offset; int64(len(p)) > remain {
+			p = p[:remain]
+		}
+		n, err := f.ReadAt(p, offset)
+		if err == nil {
+			return n, nil
+		}
+		log.L.WithError(err).Warnf("failed to read local content of %q", lb.desc.Digest)
+	}
+	var readAtOpts options
+	for _, o := range opts {
+		o(&readAtOpts)
+	}
+	ctx := readAtOpts.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	b, err := lb.remoteBlob(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return b.ReadAt(p, offset, opts...)
+}
+
+func (lb *localBlob) Cache(offset int64, size int64, opts ...Option) error {
+	if lb.local() != nil {
+		return nil // all contents are available locally
+	}
+	b, err := lb.remoteBlob(context.Background())
+	if err != nil {
+		return err
+	}
+	return b.Cache(offset, size, opts...)
+}
+
+func (lb *localBlob) Refresh(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) error {
+	lb.mu.Lock()
+	lb.hosts, lb.refspec, lb.desc = hosts, refspec, desc
+	b := lb.remote
+	lb.mu.Unlock()
+	if b != nil {
+		return b.Refresh(ctx, hosts, refspec, desc)
+	}
+	if _, err := os.Stat(lb.path); err == nil {
+		return nil
+	}
+	_, err := lb.remoteBlob(ctx)
+	return err
+}
+
+func (lb *localBlob) SetIdentityVerifier(v IdentityVerifier) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	lb.verifier = v
+	if b, ok := lb.remote.(IdentityVerifiableBlob); ok {
+		b.SetIdentityVerifier(v)
+	}
+}
+
+func (lb *localBlob) Degraded() error {
+	lb.mu.Lock()
+	b := lb.remote
+	lb.mu.Unlock()
+	if d, ok := b.(DegradableBlob); ok {
+		return d.Degraded()
+	}
+	return nil
+}
+
+// Invalidate invalidates the cache of the blob resolved on the registry. The
+// local content isn't cached so nothing is done until falling back to the
+// registry.
+func (lb *localBlob) Invalidate(offset int64, size int64) error {
+	lb.mu.Lock()
+	b := lb.remote
+	lb.mu.Unlock()
+	if ib, ok := b.(InvalidatableBlob); ok {
+		return ib.Invalidate(offset, size)
+	}
+	return nil
+}
+
+func (lb *localBlob) Close() error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	if lb.closed {
+		return nil
+	}
+	lb.closed = true
+	if lb.f != nil {
+		lb.f.Close()
+	}
+	if lb.remote != nil {
+		return lb.remote.Close() // closes the cache as well
+	}
+	return lb.blobCache.Close()
+}
@@ -0,0 +1,114 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	minRateLimitBackoff = time.Second
+	maxRateLimitBackoff = time.Minute
+
+	// maxRateLimitRetries is the max number of retries of a chunk request
+	// rejected with 429.
+	maxRateLimitRetries = 5
+)
+
+// ErrRateLimited is returned when the registry keeps rejecting requests with
+// 429 (Too Many Requests) until the fetching timeout or the max retries.
+var ErrRateLimited = errors.New("rate limited by the registry")
+
+// rateLimiter throttles requests to a host which rate limits us. Once the host
+// responds with 429, requests to the host are held until the time specified by
+// Retry-After (or RateLimit-Reset) header. If the host doesn't specify the time,
+// exponential backoff is applied until the host accepts a request.
+type rateLimiter struct {
+	blockedUntil time.Time
+	backoff      time.Duration
+	mu           sync.Mutex
+}
+
+// wait waits until requests to the host are allowed.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	d := time.Until(l.blockedUntil)
+	l.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrapf(ErrRateLimited, "%v", ctx.Err())
+	}
+}
+
+// limited records that the host rejected a request with 429.
+func (l *rateLimiter) limited(h http.Header) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d, ok := parseRateLimitWait(h)
+	if !ok {
+		if l.backoff == 0 {
+			l.backoff = minRateLimitBackoff
+		} else if l.backoff *= 2; l.backoff > maxRateLimitBackoff {
+			l.backoff = maxRateLimitBackoff
+		}
+		d = l.backoff
+	}
+	if until := time.Now().Add(d); until.After(l.blockedUntil) {
+		l.blockedUntil = until
+	}
+}
+
+// succeeded records that the host accepted a request.
+func (l *rateLimiter) succeeded() {
+	l.mu.Lock()
+	l.backoff = 0
+	l.mu.Unlock()
+}
+
+// parseRateLimitWait parses the duration to wait from Retry-After header (seconds
+// or HTTP date) or RateLimit-Reset header (seconds).
+func parseRateLimitWait(h http.Header) (time.Duration, bool) {
+	if v := h.Get("Retry-After"); v != "" {
+		if sec, err := strconv.ParseInt(v, 10, 64); err == nil && sec >= 0 {
+			return time.Duration(sec) * time.Second, true
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return time.Until(t), true
+		}
+	}
+	if v := h.Get("RateLimit-Reset"); v != "" {
+		// e.g. "60" or "60;w=21600"
+		if sec, err := strconv.ParseInt(strings.SplitN(v, ";", 2)[0], 10, 64); err == nil && sec >= 0 {
+			return time.Duration(sec) * time.Second, true
+		}
+	}
+	return 0, false
+}
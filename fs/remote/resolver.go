@@ -36,15 +36,18 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/containerd/stargz-snapshotter/cache"
 	"github.com/containerd/stargz-snapshotter/fs/config"
 	commonmetrics "github.com/containerd/stargz-snapshotter/fs/metrics/common"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/util/faultinject"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
@@ -54,6 +57,14 @@ const (
 	defaultChunkSize        = 50000
 	defaultValidIntervalSec = 60
 	defaultFetchTimeoutSec  = 300
+
+	// failoverThreshold is the number of consecutive fetch failures after which
+	// the blob is re-resolved on another host.
+	failoverThreshold = 3
+
+	// maxAuthRetries is the number of times a request rejected with 401 is
+	// retried after re-running the auth flow.
+	maxAuthRetries = 2
 )
 
 func NewResolver(cfg config.BlobConfig) *Resolver {
@@ -72,23 +83,78 @@ func NewResolver(cfg config.BlobConfig) *Resolver {
 
 	return &Resolver{
 		blobConfig: cfg,
+		limiters:   make(map[string]*rateLimiter),
+		faults:     faultinject.New(faultinject.Config(cfg.Faults)),
 	}
 }
 
 type Resolver struct {
 	blobConfig config.BlobConfig
+
+	// faults injects faults into requests to registries (nil if disabled).
+	faults *faultinject.Injector
+
+	// limiters throttles requests per host which rate limits us.
+	limiters   map[string]*rateLimiter
+	limitersMu sync.Mutex
+
+	// transportGeneration is incremented when the transports to registries
+	// are invalidated. Accessed atomically.
+	transportGeneration int64
+}
+
+// InvalidateTransports makes all blobs resolved by this resolver re-resolve
+// their transports (e.g. with new credentials) on their next fetch. Blobs keep
+// using the current transports if the re-resolution fails.
+func (r *Resolver) InvalidateTransports() {
+	atomic.AddInt64(&r.transportGeneration, 1)
+}
+
+// rateLimiterOf returns the rate limiter of the host which serves the fetcher's blob.
+func (r *Resolver) rateLimiterOf(f *fetcher) *rateLimiter {
+	host := f.blobURL
+	if u, err := url.Parse(f.blobURL); err == nil {
+		host = u.Host
+	}
+	r.limitersMu.Lock()
+	defer r.limitersMu.Unlock()
+	l, ok := r.limiters[host]
+	if !ok {
+		l = &rateLimiter{}
+		r.limiters[host] = l
+	}
+	return l
 }
 
 func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, blobCache cache.BlobCache) (Blob, error) {
-	fetcher, size, err := newFetcher(ctx, hosts, refspec, desc)
+	if r.blobConfig.ContentStorePath != "" {
+		b, err := r.resolveLocal(hosts, refspec, desc, blobCache)
+		if err == nil {
+			log.G(ctx).Debugf("serving blob from the local content store")
+			return b, nil
+		}
+		log.G(ctx).WithError(err).Debug("blob isn't available in the local content store")
+	}
+	return r.resolveRemote(ctx, hosts, refspec, desc, blobCache)
+}
+
+// resolveRemote resolves the blob on the registry.
+func (r *Resolver) resolveRemote(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, blobCache cache.BlobCache) (Blob, error) {
+	fetcher, size, err := r.resolveFetcher(ctx, hosts, refspec, desc)
 	if err != nil {
 		return nil, err
 	}
-
-	if r.blobConfig.ForceSingleRangeMode {
-		fetcher.singleRangeMode()
+	r.prepareFetcher(fetcher)
+	var sizer *fetchSizer
+	if r.blobConfig.MaxFetchSize > r.blobConfig.ChunkSize {
+		min := r.blobConfig.MinFetchSize
+		if min < r.blobConfig.ChunkSize {
+			min = r.blobConfig.ChunkSize
+		}
+		sizer = newFetchSizer(min, r.blobConfig.MaxFetchSize)
 	}
 	return &blob{
+		generation:    atomic.LoadInt64(&r.transportGeneration),
 		fetcher:       fetcher,
 		size:          size,
 		chunkSize:     r.blobConfig.ChunkSize,
@@ -97,10 +163,40 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 		checkInterval: time.Duration(r.blobConfig.ValidInterval) * time.Second,
 		resolver:      r,
 		fetchTimeout:  time.Duration(r.blobConfig.FetchTimeoutSec) * time.Second,
+		hosts:         hosts,
+		refspec:       refspec,
+		desc:          desc,
+		sizer:         sizer,
 	}, nil
 }
 
+// prepareFetcher configures the fetcher resolved by this resolver.
+func (r *Resolver) prepareFetcher(f *fetcher) {
+	f.limiter = r.rateLimiterOf(f)
+	f.faults = r.faults
+	if r.blobConfig.ForceSingleRangeMode {
+		f.singleRangeMode()
+	}
+}
+
+// resolveFetcher returns the fetcher of the blob. If RaceMirrors is enabled, the
+// blob is resolved on all hosts simultaneously.
+func (r *Resolver) resolveFetcher(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (*fetcher, int64, error) {
+	if r.blobConfig.RaceMirrors {
+		return newFetcherRacing(ctx, hosts, refspec, desc)
+	}
+	return newFetcher(ctx, hosts, refspec, desc)
+}
+
 func newFetcher(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (*fetcher, int64, error) {
+	return newFetcherAfter(ctx, hosts, refspec, desc, "")
+}
+
+// newFetcherRacing is similar to newFetcher but sends the first requests to all
+// hosts simultaneously and returns the fetcher of the host which responds first.
+// Requests to other hosts are canceled. This improves the tail latency when
+// mirrors have uneven performance. The returned fetcher sticks with the host.
+func newFetcherRacing(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor) (*fetcher, int64, error) {
 	reghosts, err := hosts(refspec)
 	if err != nil {
 		return nil, 0, err
@@ -108,68 +204,152 @@ func newFetcher(ctx context.Context, hosts source.RegistryHosts, refspec referen
 	if desc.Digest.String() == "" {
 		return nil, 0, fmt.Errorf("Digest is mandatory in layer descriptor")
 	}
-	digest := desc.Digest
 	pullScope, err := repositoryScope(refspec, false)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	// Try to create fetcher until succeeded
-	rErr := fmt.Errorf("failed to resolve")
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // cancel requests to slower hosts
+	type result struct {
+		f    *fetcher
+		size int64
+		err  error
+	}
+	resultCh := make(chan result, len(reghosts))
 	for _, host := range reghosts {
-		if host.Host == "" || strings.Contains(host.Host, "/") {
-			rErr = errors.Wrapf(rErr, "invalid destination (host %q, ref:%q, digest:%q)",
-				host.Host, refspec, digest)
-			continue // Try another
-
+		host := host
+		go func() {
+			f, size, err := newFetcherOn(ctx, host, refspec, desc, pullScope)
+			resultCh <- result{f, size, err}
+		}()
+	}
+	rErr := fmt.Errorf("failed to resolve")
+	for range reghosts {
+		res := <-resultCh
+		if res.err == nil {
+			return res.f, res.size, nil
 		}
+		rErr = errors.Wrapf(rErr, "%v", res.err)
+	}
+	return nil, 0, errors.Wrapf(rErr, "cannot resolve layer")
+}
 
-		// Prepare transport with authorization functionality
-		tr := host.Client.Transport
-		timeout := host.Client.Timeout
-		if host.Authorizer != nil {
-			tr = &transport{
-				inner: tr,
-				auth:  host.Authorizer,
-				scope: pullScope,
+// newFetcherAfter is similar to newFetcher but tries the hosts configured after
+// the specified one first. The specified host is tried at last.
+func newFetcherAfter(ctx context.Context, hosts source.RegistryHosts, refspec reference.Spec, desc ocispec.Descriptor, after string) (*fetcher, int64, error) {
+	reghosts, err := hosts(refspec)
+	if err != nil {
+		return nil, 0, err
+	}
+	if after != "" {
+		for i, h := range reghosts {
+			if h.Host == after {
+				reghosts = append(append([]docker.RegistryHost{}, reghosts[i+1:]...), reghosts[:i+1]...)
+				break
 			}
 		}
+	}
+	if desc.Digest.String() == "" {
+		return nil, 0, fmt.Errorf("Digest is mandatory in layer descriptor")
+	}
+	pullScope, err := repositoryScope(refspec, false)
+	if err != nil {
+		return nil, 0, err
+	}
 
-		// Resolve redirection and get blob URL
-		blobURL := fmt.Sprintf("%s://%s/%s/blobs/%s",
-			host.Scheme,
-			path.Join(host.Host, host.Path),
-			strings.TrimPrefix(refspec.Locator, refspec.Hostname()+"/"),
-			digest)
-		url, err := redirect(ctx, blobURL, tr, timeout)
-		if err != nil {
-			rErr = errors.Wrapf(rErr, "failed to redirect (host %q, ref:%q, digest:%q): %v",
-				host.Host, refspec, digest, err)
-			continue // Try another
-		}
-
-		// Get size information
-		// TODO: we should try to use the Size field in the descriptor here.
-		size, err := getSize(ctx, url, tr, timeout)
+	// Try to create fetcher until succeeded
+	rErr := fmt.Errorf("failed to resolve")
+	for _, host := range reghosts {
+		f, size, err := newFetcherOn(ctx, host, refspec, desc, pullScope)
 		if err != nil {
-			rErr = errors.Wrapf(rErr, "failed to get size (host %q, ref:%q, digest:%q): %v",
-				host.Host, refspec, digest, err)
+			rErr = errors.Wrapf(rErr, "%v", err)
 			continue // Try another
 		}
 
 		// Hit one destination
-		return &fetcher{
-			url:     url,
-			tr:      tr,
-			blobURL: blobURL,
-			digest:  digest,
-			timeout: timeout,
-		}, size, nil
+		return f, size, nil
 	}
 
 	return nil, 0, errors.Wrapf(rErr, "cannot resolve layer")
 }
 
+// newFetcherOn creates the fetcher of the blob on the specified host. If the
+// registry doesn't report the size of the blob, the size in the descriptor is
+// used (if any) and the fetcher is marked as degraded.
+func newFetcherOn(ctx context.Context, host docker.RegistryHost, refspec reference.Spec, desc ocispec.Descriptor, pullScope string) (*fetcher, int64, error) {
+	digest := desc.Digest
+	if host.Host == "" || strings.Contains(host.Host, "/") {
+		return nil, 0, fmt.Errorf("invalid destination (host %q, ref:%q, digest:%q)",
+			host.Host, refspec, digest)
+	}
+
+	// Prepare transport with authorization functionality
+	tr := host.Client.Transport
+	timeout := host.Client.Timeout
+	if len(host.Header) > 0 {
+		tr = &headerTransport{inner: tr, header: host.Header}
+	}
+	if host.Authorizer != nil {
+		tr = &transport{
+			inner: tr,
+			auth:  host.Authorizer,
+			scope: pullScope,
+		}
+	}
+
+	// Resolve redirection and get blob URL
+	blobURL := fmt.Sprintf("%s://%s/%s/blobs/%s",
+		host.Scheme,
+		path.Join(host.Host, host.Path),
+		strings.TrimPrefix(refspec.Locator, refspec.Hostname()+"/"),
+		digest)
+	url, err := redirect(ctx, blobURL, tr, timeout)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to redirect (host %q, ref:%q, digest:%q): %v",
+			host.Host, refspec, digest, err)
+	}
+
+	// Get size and validator information
+	size, v, sizeErr := getSize(ctx, url, tr, timeout)
+	if sizeErr != nil {
+		sizeErr = fmt.Errorf("failed to get size (host %q, ref:%q, digest:%q): %v",
+			host.Host, refspec, digest, sizeErr)
+		if desc.Size <= 0 {
+			return nil, 0, sizeErr
+		}
+		log.G(ctx).WithError(sizeErr).Warnf("using size %d in the descriptor", desc.Size)
+		size = desc.Size
+	}
+
+	return &fetcher{
+		url:       url,
+		tr:        tr,
+		blobURL:   blobURL,
+		digest:    digest,
+		timeout:   timeout,
+		host:      host.Host,
+		sizeErr:   sizeErr,
+		size:      size,
+		validator: v,
+	}, size, nil
+}
+
+// headerTransport sets the headers configured for the host (e.g. in hosts.toml)
+// to all requests.
+type headerTransport struct {
+	inner  http.RoundTripper
+	header http.Header
+}
+
+func (tr *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for k, v := range tr.header {
+		req.Header[k] = v
+	}
+	return tr.inner.RoundTrip(req)
+}
+
 type transport struct {
 	inner http.RoundTripper
 	auth  docker.Authorizer
@@ -193,19 +373,37 @@ func (tr *transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		return nil, err
 	}
 
+	// The token can be rejected even after the authorization (e.g. the token
+	// expired while the container runs). Re-run the auth flow and retry the
+	// request until the retry budget runs out.
 	// TODO: support more status codes and retries
-	if resp.StatusCode == http.StatusUnauthorized {
+	var responses []*http.Response
+	for i := 0; resp.StatusCode == http.StatusUnauthorized && i < maxAuthRetries; i++ {
+		responses = append(responses, resp)
 
 		// prepare authorization for the target host using docker.Authorizer
-		if err := tr.auth.AddResponses(ctx, []*http.Response{resp}); err != nil {
+		if err := tr.auth.AddResponses(ctx, responses); err != nil {
 			if errdefs.IsNotImplemented(err) {
 				return resp, nil
 			}
-			return nil, err
+			if !errors.Is(err, docker.ErrInvalidAuthorization) {
+				return nil, err
+			}
+			// The token of the host is rejected and the authorizer has
+			// forgotten it. Start the auth flow over from the challenge.
+			responses = []*http.Response{resp}
+			if err := tr.auth.AddResponses(ctx, responses); err != nil {
+				return nil, err
+			}
+			log.G(ctx).WithField("host", req.URL.Host).Debug("token rejected; re-authorizing")
 		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
 
 		// re-authorize and send the request
-		return roundTrip(req.Clone(ctx))
+		if resp, err = roundTrip(req.Clone(ctx)); err != nil {
+			return nil, err
+		}
 	}
 
 	return resp, nil
@@ -247,7 +445,9 @@ func redirect(ctx context.Context, blobURL string, tr http.RoundTripper, timeout
 	return
 }
 
-func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time.Duration) (int64, error) {
+// getSize returns the size of the blob with its validator (if the registry
+// reports it).
+func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time.Duration) (int64, validator, error) {
 	if timeout > 0 {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, timeout)
@@ -255,16 +455,17 @@ func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time
 	}
 	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
 	if err != nil {
-		return 0, err
+		return 0, validator{}, err
 	}
 	req.Close = false
 	res, err := tr.RoundTrip(req)
 	if err != nil {
-		return 0, err
+		return 0, validator{}, err
 	}
 	defer res.Body.Close()
 	if res.StatusCode == http.StatusOK {
-		return strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		return size, validatorOf(res.Header), err
 	}
 	headStatusCode := res.StatusCode
 
@@ -273,13 +474,13 @@ func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time
 	// HEAD request (2020).
 	req, err = http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		return 0, errors.Wrapf(err, "failed to make request to the registry")
+		return 0, validator{}, errors.Wrapf(err, "failed to make request to the registry")
 	}
 	req.Close = false
 	req.Header.Set("Range", "bytes=0-1")
 	res, err = tr.RoundTrip(req)
 	if err != nil {
-		return 0, errors.Wrapf(err, "failed to request")
+		return 0, validator{}, errors.Wrapf(err, "failed to request")
 	}
 	defer func() {
 		io.Copy(ioutil.Discard, res.Body)
@@ -287,16 +488,61 @@ func getSize(ctx context.Context, url string, tr http.RoundTripper, timeout time
 	}()
 
 	if res.StatusCode == http.StatusOK {
-		return strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		return size, validatorOf(res.Header), err
 	} else if res.StatusCode == http.StatusPartialContent {
 		_, size, err := parseRange(res.Header.Get("Content-Range"))
-		return size, err
+		return size, validatorOf(res.Header), err
 	}
 
-	return 0, fmt.Errorf("failed to get size with code (HEAD=%v, GET=%v)",
+	return 0, validator{}, fmt.Errorf("failed to get size with code (HEAD=%v, GET=%v)",
 		headStatusCode, res.StatusCode)
 }
 
+// validator is the validator of the representation of the blob reported by the
+// registry (or the storage behind the redirect). This is sent as If-Range on
+// chunk requests so that the replacement of the object (e.g. on CDN) is
+// detected immediately even if the size doesn't change.
+type validator struct {
+	// etag is the strong ETag. Weak ones aren't usable for If-Range.
+	etag string
+
+	// lastModified is the Last-Modified date used if ETag isn't available.
+	lastModified string
+}
+
+func validatorOf(h http.Header) validator {
+	v := validator{lastModified: h.Get("Last-Modified")}
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		v.etag = etag
+	}
+	return v
+}
+
+// ifRange returns the value of If-Range header. Empty if the validator is
+// unknown.
+func (v validator) ifRange() string {
+	if v.etag != "" {
+		return v.etag
+	}
+	return v.lastModified
+}
+
+// check returns ErrContentDrift if the response is of another representation
+// of the blob. Responses without validators pass the check.
+func (v validator) check(h http.Header) error {
+	if v.etag != "" {
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") && etag != v.etag {
+			return errors.Wrapf(ErrContentDrift, "registry reports ETag %s; want %s", etag, v.etag)
+		}
+		return nil
+	}
+	if lm := h.Get("Last-Modified"); v.lastModified != "" && lm != "" && lm != v.lastModified {
+		return errors.Wrapf(ErrContentDrift, "registry reports Last-Modified %q; want %q", lm, v.lastModified)
+	}
+	return nil
+}
+
 type fetcher struct {
 	url           string
 	urlMu         sync.Mutex
@@ -306,6 +552,39 @@ type fetcher struct {
 	singleRange   bool
 	singleRangeMu sync.Mutex
 	timeout       time.Duration
+	limiter       *rateLimiter
+	host          string
+	faults        *faultinject.Injector
+
+	// sizeErr is the error of getting the size of the blob from the registry.
+	// non-nil if the size in the descriptor is used instead.
+	sizeErr error
+
+	// size is the size of the blob when it's resolved. Responses reporting
+	// another size are regarded as content drift. 0 means unknown.
+	size int64
+
+	// validator is the validator of the blob when it's resolved. Responses
+	// reporting another one are regarded as content drift.
+	validator validator
+}
+
+// ErrContentDrift is returned when the registry serves the blob differently
+// from when it's resolved (i.e. the range isn't satisfiable or the size of the
+// blob changed).
+var ErrContentDrift = errors.New("content of the blob drifted on the registry")
+
+// ErrUnauthorized is returned when the registry keeps rejecting the token
+// even after the auth flow is re-run.
+var ErrUnauthorized = errors.New("unauthorized by the registry")
+
+// checkSize returns ErrContentDrift if the size reported by the registry
+// differs from the resolved one.
+func (f *fetcher) checkSize(size int64) error {
+	if f.size > 0 && size != f.size {
+		return errors.Wrapf(ErrContentDrift, "registry reports size %d; want %d", size, f.size)
+	}
+	return nil
 }
 
 type multipartReadCloser interface {
@@ -313,7 +592,30 @@ type multipartReadCloser interface {
 	Close() error
 }
 
+// fetch fetches the regions. Requests rejected with 429 (Too Many Requests) are
+// retried up to maxRateLimitRetries times while the rate limiter holds them.
+// This is the only layer retrying them; the transports of the hosts don't.
 func (f *fetcher) fetch(ctx context.Context, rs []region, retry bool, opts *options) (multipartReadCloser, error) {
+	if f.limiter == nil {
+		return f.fetchOnce(ctx, rs, retry, opts)
+	}
+	ctx = source.WithRateLimitHandled(ctx)
+	for i := 0; ; i++ {
+		mr, err := f.fetchOnce(ctx, rs, retry, opts)
+		if !errors.Is(err, errRateLimitedRetry) {
+			return mr, err
+		}
+		if i >= maxRateLimitRetries {
+			return nil, errors.Wrapf(ErrRateLimited, "rejected %d times", i+1)
+		}
+	}
+}
+
+// errRateLimitedRetry is returned by fetchOnce when the request should be
+// retried after the rate limit is lifted.
+var errRateLimitedRetry = errors.Wrap(ErrRateLimited, "retry")
+
+func (f *fetcher) fetchOnce(ctx context.Context, rs []region, retry bool, opts *options) (multipartReadCloser, error) {
 	if len(rs) == 0 {
 		return nil, fmt.Errorf("no request queried")
 	}
@@ -323,9 +625,6 @@ func (f *fetcher) fetch(ctx context.Context, rs []region, retry bool, opts *opti
 		singleRangeMode = f.isSingleRangeMode()
 	)
 
-	if opts.ctx != nil {
-		ctx = opts.ctx
-	}
 	if opts.tr != nil {
 		tr = opts.tr
 	}
@@ -358,49 +657,107 @@ func (f *fetcher) fetch(ctx context.Context, rs []region, retry bool, opts *opti
 	}
 	req.Header.Add("Range", fmt.Sprintf("bytes=%s", ranges[:len(ranges)-1]))
 	req.Header.Add("Accept-Encoding", "identity")
+	if ifRange := f.validator.ifRange(); ifRange != "" {
+		// The registry returns the entire blob instead of the ranges if the
+		// blob has been replaced. That response fails the validator check.
+		req.Header.Set("If-Range", ifRange)
+	}
 	req.Close = false
 
+	// Hold the request while the host rate limits us.
+	if f.limiter != nil {
+		if err := f.limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
 	// Recording the roundtrip latency for remote registry GET operation.
 	start := time.Now()
+	if err := f.faults.Fault(); err != nil {
+		return nil, err
+	}
+	done := trackRequest(InFlightRequest{Host: f.host, Digest: f.digest, Ranges: ranges[:len(ranges)-1], Start: start})
 	res, err := tr.RoundTrip(req) // NOT DefaultClient; don't want redirects
 	commonmetrics.MeasureLatency(commonmetrics.RemoteRegistryGet, f.digest, start)
 	if err != nil {
+		done()
 		return nil, err
 	}
+	res.Body = &trackedReadCloser{f.faults.ReadCloser(res.Body), done}
+	if res.StatusCode == http.StatusTooManyRequests {
+		commonmetrics.IncRateLimited(f.digest)
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		if f.limiter == nil {
+			return nil, errors.Wrapf(ErrRateLimited, "unexpected status code: %v", res.Status)
+		}
+		// Wait for the rate limit to be lifted and retry.
+		f.limiter.limited(res.Header)
+		return nil, errRateLimitedRetry
+	}
+	if f.limiter != nil && res.StatusCode/100 == 2 {
+		f.limiter.succeeded()
+	}
+	if res.StatusCode/100 == 2 {
+		if err := f.validator.check(res.Header); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+	}
 	if res.StatusCode == http.StatusOK {
 		// We are getting the whole blob in one part (= status 200)
 		size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
 		if err != nil {
+			res.Body.Close()
 			return nil, errors.Wrapf(err, "failed to parse Content-Length")
 		}
+		if err := f.checkSize(size); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
 		return singlePartReader(region{0, size - 1}, res.Body), nil
 	} else if res.StatusCode == http.StatusPartialContent {
 		mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
 		if err != nil {
+			res.Body.Close()
 			return nil, errors.Wrapf(err, "invalid media type %q", mediaType)
 		}
 		if strings.HasPrefix(mediaType, "multipart/") {
 			// We are getting a set of chunks as a multipart body.
-			return multiPartReader(res.Body, params["boundary"]), nil
+			return multiPartReader(res.Body, params["boundary"], f), nil
 		}
 
 		// We are getting single range
-		reg, _, err := parseRange(res.Header.Get("Content-Range"))
+		reg, size, err := parseRange(res.Header.Get("Content-Range"))
 		if err != nil {
+			res.Body.Close()
 			return nil, errors.Wrapf(err, "failed to parse Content-Range")
 		}
+		if err := f.checkSize(size); err != nil {
+			res.Body.Close()
+			return nil, err
+		}
 		return singlePartReader(reg, res.Body), nil
+	} else if res.StatusCode == http.StatusUnauthorized {
+		res.Body.Close()
+		return nil, errors.Wrapf(ErrUnauthorized, "unexpected status code: %v", res.Status)
 	} else if retry && res.StatusCode == http.StatusForbidden {
+		res.Body.Close()
 		// re-redirect and retry this once.
 		if err := f.refreshURL(ctx); err != nil {
 			return nil, errors.Wrapf(err, "failed to refresh URL on %v", res.Status)
 		}
-		return f.fetch(ctx, rs, false, opts)
+		return f.fetchOnce(ctx, rs, false, opts)
 	} else if retry && res.StatusCode == http.StatusBadRequest && !singleRangeMode {
 		// gcr.io (https://storage.googleapis.com) returns 400 on multi-range request (2020 #81)
-		f.singleRangeMode()                  // fallbacks to singe range request mode
-		return f.fetch(ctx, rs, false, opts) // retries with the single range mode
+		res.Body.Close()
+		f.singleRangeMode()                      // fallbacks to singe range request mode
+		return f.fetchOnce(ctx, rs, false, opts) // retries with the single range mode
+	} else if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		res.Body.Close()
+		return nil, errors.Wrapf(ErrContentDrift, "unexpected status code: %v", res.Status)
 	}
+	res.Body.Close()
 
 	return nil, fmt.Errorf("unexpected status code: %v", res.Status)
 }
@@ -430,7 +787,7 @@ func (f *fetcher) check() error {
 		res.Body.Close()
 	}()
 	if res.StatusCode == http.StatusOK || res.StatusCode == http.StatusPartialContent {
-		return nil
+		return errors.Wrap(f.validator.check(res.Header), "check failed")
 	} else if res.StatusCode == http.StatusForbidden {
 		// Try to re-redirect this blob
 		rCtx := context.Background()
@@ -460,7 +817,13 @@ func (f *fetcher) refreshURL(ctx context.Context) error {
 }
 
 func (f *fetcher) genID(reg region) string {
-	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", f.blobURL, reg.b, reg.e)))
+	// Contents are identified by the digest so that the cache can be reused even
+	// after the blob is re-resolved on another host.
+	src := f.blobURL
+	if f.digest != "" {
+		src = f.digest.String()
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", src, reg.b, reg.e)))
 	return fmt.Sprintf("%x", sum)
 }
 
@@ -500,16 +863,18 @@ func (sr *singlepartReader) Next() (region, io.Reader, error) {
 	return region{}, nil, io.EOF
 }
 
-func multiPartReader(rc io.ReadCloser, boundary string) multipartReadCloser {
+func multiPartReader(rc io.ReadCloser, boundary string, f *fetcher) multipartReadCloser {
 	return &multipartReader{
 		m:      multipart.NewReader(rc, boundary),
 		Closer: rc,
+		f:      f,
 	}
 }
 
 type multipartReader struct {
 	io.Closer
 	m *multipart.Reader
+	f *fetcher // checks the size of the blob reported by the parts
 }
 
 func (sr *multipartReader) Next() (region, io.Reader, error) {
@@ -517,10 +882,13 @@ func (sr *multipartReader) Next() (region, io.Reader, error) {
 	if err != nil {
 		return region{}, nil, err
 	}
-	reg, _, err := parseRange(p.Header.Get("Content-Range"))
+	reg, size, err := parseRange(p.Header.Get("Content-Range"))
 	if err != nil {
 		return region{}, nil, errors.Wrapf(err, "failed to parse Content-Range")
 	}
+	if err := sr.f.checkSize(size); err != nil {
+		return region{}, nil, err
+	}
 	return reg, p, nil
 }
 
@@ -551,6 +919,7 @@ type options struct {
 	ctx       context.Context
 	tr        http.RoundTripper
 	cacheOpts []cache.Option
+	onDemand  bool
 }
 
 func WithContext(ctx context.Context) Option {
@@ -571,6 +940,15 @@ func WithCacheOpts(cacheOpts ...cache.Option) Option {
 	}
 }
 
+// WithOnDemand marks the read as an on-demand read of files (i.e. not prefetch
+// nor background fetch). Sizes fetched by on-demand reads are reported by
+// ReadStatsBlob.
+func WithOnDemand() Option {
+	return func(opts *options) {
+		opts.onDemand = true
+	}
+}
+
 // NOTE: ported from https://github.com/containerd/containerd/blob/v1.5.2/remotes/docker/scope.go#L29-L42
 // TODO: import this from containerd package once we drop support to continerd v1.4.x
 //
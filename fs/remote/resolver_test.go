@@ -26,17 +26,26 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/cache"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
 )
 
 func TestMirror(t *testing.T) {
@@ -268,3 +277,753 @@ func (b *breakRoundTripper) RoundTrip(req *http.Request) (res *http.Response, er
 	}
 	return
 }
+
+func TestFailover(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	var (
+		blobDigest = digest.FromString("dummy")
+		mirrors    = []string{"mirrorexample1.com", "mirrorexample2.com"}
+		refHost    = refspec.Hostname()
+		tr         = &sampleRoundTripper{okURLs: []string{`.*`}}
+	)
+	hosts := func(refspec reference.Spec) (reghosts []docker.RegistryHost, _ error) {
+		for _, m := range append(mirrors, refHost) {
+			reghosts = append(reghosts, docker.RegistryHost{
+				Client:       &http.Client{Transport: tr},
+				Host:         m,
+				Scheme:       "https",
+				Path:         "/v2",
+				Capabilities: docker.HostCapabilityPull,
+			})
+		}
+		return
+	}
+	desc := ocispec.Descriptor{Digest: blobDigest}
+
+	// Hosts are tried in the configured order after the specified one.
+	for after, want := range map[string]string{
+		"":                   "mirrorexample1.com",
+		"mirrorexample1.com": "mirrorexample2.com",
+		"mirrorexample2.com": refHost,
+		refHost:              "mirrorexample1.com",
+	} {
+		f, _, err := newFetcherAfter(context.Background(), hosts, refspec, desc, after)
+		if err != nil {
+			t.Fatalf("failed to resolve reference: %v", err)
+		}
+		if f.host != want {
+			t.Errorf("resolved on %q after %q; want %q", f.host, after, want)
+		}
+	}
+
+	// Blob switches to the next host on persistent failures.
+	b := &blob{
+		fetcher: &fetcher{
+			url:     "https://mirrorexample1.com/v2/library/test/blobs/" + blobDigest.String(),
+			tr:      &breakRoundTripper{},
+			digest:  blobDigest,
+			host:    "mirrorexample1.com",
+			timeout: time.Second,
+		},
+		size:         1,
+		chunkSize:    1,
+		cache:        cache.NewMemoryCache(),
+		resolver:     &Resolver{limiters: make(map[string]*rateLimiter)},
+		fetchTimeout: time.Duration(defaultFetchTimeoutSec) * time.Second,
+		hosts:        hosts,
+		refspec:      refspec,
+		desc:         desc,
+	}
+	for i := 0; i < failoverThreshold-1; i++ {
+		if _, err := b.ReadAt(make([]byte, 1), 0); err == nil {
+			t.Fatalf("read must fail before failover")
+		}
+	}
+	if _, err := b.ReadAt(make([]byte, 1), 0); err != nil {
+		t.Fatalf("read must succeed after failover: %v", err)
+	}
+	if b.fetcher.host != "mirrorexample2.com" {
+		t.Errorf("failed over to %q; want %q", b.fetcher.host, "mirrorexample2.com")
+	}
+}
+
+func TestFetcherFailover(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	var (
+		blobDigest = digest.FromString(sampleData1)
+		mirror     = "mirrorexample.com"
+		limited    = 1
+	)
+	respond := func(code int, header http.Header, body string) *http.Response {
+		if header == nil {
+			header = make(http.Header)
+		}
+		return &http.Response{StatusCode: code, Header: header, Body: ioutil.NopCloser(strings.NewReader(body))}
+	}
+	transportOf := func(host string) http.RoundTripper {
+		return RoundTripFunc(func(req *http.Request) *http.Response {
+			size := http.Header{"Content-Length": {fmt.Sprintf("%d", len(sampleData1))}}
+			switch {
+			case req.Method == "HEAD":
+				return respond(http.StatusOK, size, "")
+			case req.Header.Get("Range") == "bytes=0-1":
+				return respond(http.StatusPartialContent, nil, sampleData1[:2])
+			case host == mirror:
+				return respond(http.StatusInternalServerError, nil, "")
+			case limited > 0:
+				limited--
+				return respond(http.StatusTooManyRequests, http.Header{"Retry-After": {"0"}}, "")
+			}
+			return respond(http.StatusOK, size, sampleData1)
+		})
+	}
+	hosts := func(refspec reference.Spec) (reghosts []docker.RegistryHost, _ error) {
+		for _, m := range []string{mirror, refspec.Hostname()} {
+			reghosts = append(reghosts, docker.RegistryHost{
+				Client:       &http.Client{Transport: transportOf(m)},
+				Host:         m,
+				Scheme:       "https",
+				Path:         "/v2",
+				Capabilities: docker.HostCapabilityPull,
+			})
+		}
+		return
+	}
+	desc := ocispec.Descriptor{Digest: blobDigest}
+	f, size, err := NewFetcher(context.Background(), hosts, refspec, desc)
+	if err != nil {
+		t.Fatalf("failed to resolve reference: %v", err)
+	}
+	if size != int64(len(sampleData1)) {
+		t.Errorf("size = %d; want %d", size, len(sampleData1))
+	}
+
+	// Fetch fails over to the next host and is throttled by the rate limiter.
+	rc, err := f.Fetch(context.Background(), desc)
+	if err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(data) != sampleData1 {
+		t.Errorf("fetched %q; want %q", string(data), sampleData1)
+	}
+	if limited != 0 {
+		t.Errorf("rate limited response isn't retried")
+	}
+	if host := f.(*failoverFetcher).f.host; host != refspec.Hostname() {
+		t.Errorf("failed over to %q; want %q", host, refspec.Hostname())
+	}
+}
+
+func TestSizeFromDescriptor(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	// The registry redirects to the storage which reports neither HEAD nor GET.
+	tr := &sampleRoundTripper{redirectURL: map[string]string{
+		refspec.Hostname(): "https://storage.example.com/blob",
+	}}
+	hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{
+			Client:       &http.Client{Transport: tr},
+			Host:         refspec.Hostname(),
+			Scheme:       "https",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull,
+		}}, nil
+	}
+	desc := ocispec.Descriptor{Digest: digest.FromString("dummy")}
+	if _, _, err := newFetcher(context.Background(), hosts, refspec, desc); err == nil {
+		t.Fatalf("resolving must fail without the size in the descriptor")
+	}
+
+	desc.Size = 10
+	b, err := NewResolver(config.BlobConfig{}).Resolve(context.Background(), hosts, refspec, desc, cache.NewMemoryCache())
+	if err != nil {
+		t.Fatalf("failed to resolve with the size in the descriptor: %v", err)
+	}
+	if b.Size() != desc.Size {
+		t.Errorf("size = %d; want %d", b.Size(), desc.Size)
+	}
+	if err := b.(DegradableBlob).Degraded(); err == nil {
+		t.Errorf("blob must be degraded")
+	}
+}
+
+func TestRaceMirrors(t *testing.T) {
+	var (
+		refspec    = reference.Spec{Locator: "example.com/library/test"}
+		blobDigest = digest.FromString("dummy")
+		slowHost   = "slowmirror.example.com"
+		fastHost   = "fastmirror.example.com"
+		failHost   = "failmirror.example.com"
+	)
+	tr := &sampleRoundTripper{
+		withCode: map[string]int{failHost: 500},
+		okURLs:   []string{`.*`},
+	}
+	for _, order := range [][]string{
+		{slowHost, fastHost},
+		{fastHost, slowHost},
+		{failHost, slowHost, fastHost},
+	} {
+		order := order
+		hosts := func(refspec reference.Spec) (reghosts []docker.RegistryHost, _ error) {
+			for _, h := range order {
+				rt := http.RoundTripper(tr)
+				if h == slowHost {
+					rt = &delayRoundTripper{tr, 10 * time.Second}
+				}
+				reghosts = append(reghosts, docker.RegistryHost{
+					Client:       &http.Client{Transport: rt},
+					Host:         h,
+					Scheme:       "https",
+					Path:         "/v2",
+					Capabilities: docker.HostCapabilityPull,
+				})
+			}
+			return
+		}
+		start := time.Now()
+		f, _, err := newFetcherRacing(context.Background(), hosts, refspec, ocispec.Descriptor{Digest: blobDigest})
+		if err != nil {
+			t.Fatalf("failed to resolve reference: %v", err)
+		}
+		if f.host != fastHost {
+			t.Errorf("resolved on %q among %v; want %q", f.host, order, fastHost)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("racing waited for the slow host (%v)", d)
+		}
+	}
+}
+
+// delayRoundTripper delays responses. Requests can be canceled during the delay.
+type delayRoundTripper struct {
+	inner http.RoundTripper
+	delay time.Duration
+}
+
+func (tr *delayRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case <-time.After(tr.delay):
+		return tr.inner.RoundTrip(req)
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	contents := strings.Repeat("0123456789", 1000)
+	l, err := testutil.BuildEStargzLayer([]testutil.TarEntry{testutil.File("foo", contents)})
+	if err != nil {
+		t.Fatalf("failed to build layer: %v", err)
+	}
+	reg := testutil.NewRegistry()
+	img, err := reg.PushImage("test", "latest", l)
+	if err != nil {
+		t.Fatalf("failed to push image: %v", err)
+	}
+	refspec, err := reference.Parse(img.Ref)
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	readBlob := func(hosts source.RegistryHosts) []byte {
+		b, err := NewResolver(config.BlobConfig{ChunkSize: 1000}).Resolve(context.Background(),
+			hosts, refspec, l.Desc, cache.NewMemoryCache())
+		if err != nil {
+			t.Fatalf("failed to resolve blob: %v", err)
+		}
+		data := make([]byte, b.Size())
+		if _, err := b.ReadAt(data, 0); err != nil {
+			t.Fatalf("failed to read blob: %v", err)
+		}
+		return data
+	}
+
+	// Record interactions with the registry.
+	rec := testutil.NewRecorder(nil)
+	if data := readBlob(testutil.WrapHosts(reg.Hosts(), func(http.RoundTripper) http.RoundTripper {
+		return rec
+	})); !bytes.Equal(data, l.Data) {
+		t.Fatalf("unexpected blob recorded")
+	}
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+	if err := rec.Save(cassette); err != nil {
+		t.Fatalf("failed to save cassette: %v", err)
+	}
+	reg.Close()
+
+	// Replay without the registry.
+	c, err := testutil.LoadCassette(cassette)
+	if err != nil {
+		t.Fatalf("failed to load cassette: %v", err)
+	}
+	if data := readBlob(testutil.WrapHosts(reg.Hosts(), func(http.RoundTripper) http.RoundTripper {
+		return testutil.NewReplayer(c)
+	})); !bytes.Equal(data, l.Data) {
+		t.Errorf("unexpected blob replayed")
+	}
+}
+
+func TestIdentityVerification(t *testing.T) {
+	l, err := testutil.BuildEStargzLayer([]testutil.TarEntry{testutil.File("foo", "foo")})
+	if err != nil {
+		t.Fatalf("failed to build layer: %v", err)
+	}
+	reg := testutil.NewRegistry()
+	defer reg.Close()
+	img, err := reg.PushImage("test", "latest", l)
+	if err != nil {
+		t.Fatalf("failed to push image: %v", err)
+	}
+	refspec, err := reference.Parse(img.Ref)
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	b, err := NewResolver(config.BlobConfig{}).Resolve(context.Background(),
+		reg.Hosts(), refspec, l.Desc, cache.NewMemoryCache())
+	if err != nil {
+		t.Fatalf("failed to resolve blob: %v", err)
+	}
+	tail := l.Data[len(l.Data)-10:]
+	b.(IdentityVerifiableBlob).SetIdentityVerifier(func(ra io.ReaderAt, size int64) error {
+		p := make([]byte, len(tail))
+		if _, err := ra.ReadAt(p, size-int64(len(p))); err != nil {
+			return err
+		}
+		if !bytes.Equal(p, tail) {
+			return fmt.Errorf("unexpected tail %x; want %x", p, tail)
+		}
+		return nil
+	})
+	if err := b.Refresh(context.Background(), reg.Hosts(), refspec, l.Desc); err != nil {
+		t.Fatalf("failed to refresh blob serving the same contents: %v", err)
+	}
+
+	// The URL is reused for different contents.
+	tampered := append([]byte{}, l.Data...)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := reg.PushImage("test", "latest", testutil.Layer{Data: tampered, Desc: l.Desc, DiffID: l.DiffID}); err != nil {
+		t.Fatalf("failed to push tampered image: %v", err)
+	}
+	if err := b.Refresh(context.Background(), reg.Hosts(), refspec, l.Desc); err == nil {
+		t.Fatalf("refreshing blob serving different contents must fail")
+	}
+}
+
+func TestInvalidateTransports(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	var (
+		blobDigest = digest.FromString("dummy")
+		oldTr      = &trackingRoundTripper{}
+		newTr      = &trackingRoundTripper{}
+		curTr      = oldTr
+	)
+	hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{
+			Client:       &http.Client{Transport: curTr},
+			Host:         refspec.Hostname(),
+			Scheme:       "https",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull,
+		}}, nil
+	}
+	desc := ocispec.Descriptor{Digest: blobDigest}
+	r := &Resolver{limiters: make(map[string]*rateLimiter)}
+	f, size, err := r.resolveFetcher(context.Background(), hosts, refspec, desc)
+	if err != nil {
+		t.Fatalf("failed to resolve fetcher: %v", err)
+	}
+	b := &blob{
+		fetcher:      f,
+		size:         size,
+		chunkSize:    1,
+		resolver:     r,
+		fetchTimeout: time.Duration(defaultFetchTimeoutSec) * time.Second,
+		hosts:        hosts,
+		refspec:      refspec,
+		desc:         desc,
+	}
+	read := func() {
+		b.cache = cache.NewMemoryCache() // always fetch from the registry
+		oldTr.called, newTr.called = false, false
+		if _, err := b.ReadAt(make([]byte, 1), 0); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+	}
+
+	// The current transport is used until the transports are invalidated.
+	curTr = newTr
+	read()
+	if !oldTr.called || newTr.called {
+		t.Errorf("must be read with the current transport")
+	}
+
+	// The transport is re-resolved on the next fetch after invalidation.
+	r.InvalidateTransports()
+	read()
+	if oldTr.called || !newTr.called {
+		t.Errorf("must be read with the refreshed transport")
+	}
+	read()
+	if oldTr.called || !newTr.called {
+		t.Errorf("must keep using the refreshed transport")
+	}
+}
+
+// Tests headers configured for the host (e.g. in hosts.toml) are set to requests.
+func TestHostHeader(t *testing.T) {
+	refspec, err := reference.Parse("dummyexample.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	var got []string
+	tr := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		got = append(got, req.Header.Get("X-Test"))
+		return (&sampleRoundTripper{okURLs: []string{`.*`}}).RoundTrip(req)
+	})
+	hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{
+			Client:       &http.Client{Transport: tr},
+			Host:         refspec.Hostname(),
+			Scheme:       "https",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull,
+			Header:       http.Header{"X-Test": []string{"value"}},
+		}}, nil
+	}
+	desc := ocispec.Descriptor{Digest: digest.FromString("dummy")}
+	if _, _, err := newFetcher(context.Background(), hosts, refspec, desc); err != nil {
+		t.Fatalf("failed to resolve fetcher: %v", err)
+	}
+	if len(got) == 0 {
+		t.Fatalf("no request is sent")
+	}
+	for _, v := range got {
+		if v != "value" {
+			t.Errorf("header = %q; want %q", v, "value")
+		}
+	}
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+type trackingRoundTripper struct {
+	called bool
+}
+
+func (tr *trackingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr.called = true
+	return (&sampleRoundTripper{okURLs: []string{`.*`}}).RoundTrip(req)
+}
+
+func TestContentDrift(t *testing.T) {
+	blobSize := int64(len(sampleData1))
+
+	// The blob is re-resolved and served if the range is transiently unsatisfiable.
+	var unsatisfiable bool
+	inner := multiRoundTripper(t, []byte(sampleData1), allowMultiRange(false))
+	b := newDriftBlob(t, RoundTripFunc(func(req *http.Request) *http.Response {
+		if unsatisfiable {
+			unsatisfiable = false
+			return &http.Response{
+				StatusCode: http.StatusRequestedRangeNotSatisfiable,
+				Status:     "416 Requested Range Not Satisfiable",
+				Header:     make(http.Header),
+				Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+			}
+		}
+		return inner(req)
+	}))
+	rc := &removeRecordingCache{cache.NewMemoryCache(), make(map[string]bool)}
+	b.cache = rc
+	unsatisfiable = true
+	checkRead(t, []byte(sampleData1), b, 0, blobSize)
+	if err := b.Degraded(); !errors.Is(err, ErrContentDrift) {
+		t.Errorf("blob must be degraded by content drift but got %v", err)
+	}
+	b.walkChunks(region{0, blobSize - 1}, func(chunk region) error {
+		if !rc.removed[b.fetcher.genID(chunk)] {
+			t.Errorf("cache of drifted chunk %v must be invalidated", chunk)
+		}
+		return nil
+	})
+
+	// Changed contents must not be served nor cached.
+	var changed bool
+	b = newDriftBlob(t, RoundTripFunc(func(req *http.Request) *http.Response {
+		if changed {
+			return multiRoundTripper(t, []byte(sampleData1+"drift"), allowMultiRange(false))(req)
+		}
+		return inner(req)
+	}))
+	changed = true
+	if _, err := b.ReadAt(make([]byte, sampleChunkSize), 0); !errors.Is(err, ErrContentDrift) {
+		t.Errorf("read must fail with content drift but got %v", err)
+	}
+	if err := b.Degraded(); !errors.Is(err, ErrContentDrift) {
+		t.Errorf("blob must be degraded by content drift but got %v", err)
+	}
+	if r, err := b.cache.Get(b.fetcher.genID(region{0, sampleChunkSize - 1})); err == nil {
+		r.Close()
+		t.Errorf("drifted contents must not be cached")
+	}
+}
+
+func TestIfRange(t *testing.T) {
+	var (
+		etag     = `"v1"`
+		ifRanges []string
+		inner    = multiRoundTripper(t, []byte(sampleData1), allowMultiRange(false))
+	)
+	b := newDriftBlob(t, RoundTripFunc(func(req *http.Request) *http.Response {
+		ifRanges = append(ifRanges, req.Header.Get("If-Range"))
+		res := inner(req)
+		res.Header.Set("ETag", etag)
+		return res
+	}))
+	checkRead(t, []byte(sampleData1[:sampleChunkSize]), b, 0, sampleChunkSize)
+	if got := ifRanges[len(ifRanges)-1]; got != `"v1"` {
+		t.Errorf("If-Range %q; want %q", got, `"v1"`)
+	}
+	if err := b.Degraded(); err != nil {
+		t.Errorf("blob must not be degraded but got %v", err)
+	}
+
+	// The object is replaced on the registry. The blob is re-resolved and served
+	// with the new validator.
+	etag = `"v2"`
+	checkRead(t, []byte(sampleData1[sampleChunkSize:2*sampleChunkSize]), b, sampleChunkSize, sampleChunkSize)
+	if got := ifRanges[len(ifRanges)-1]; got != `"v2"` {
+		t.Errorf("If-Range %q; want %q", got, `"v2"`)
+	}
+	if err := b.Degraded(); !errors.Is(err, ErrContentDrift) {
+		t.Errorf("blob must be degraded by content drift but got %v", err)
+	}
+
+	// Weak ETags aren't used for If-Range.
+	etag = `W/"v3"`
+	b = newDriftBlob(t, RoundTripFunc(func(req *http.Request) *http.Response {
+		ifRanges = append(ifRanges, req.Header.Get("If-Range"))
+		res := inner(req)
+		res.Header.Set("ETag", etag)
+		return res
+	}))
+	checkRead(t, []byte(sampleData1[:sampleChunkSize]), b, 0, sampleChunkSize)
+	if got := ifRanges[len(ifRanges)-1]; got != "" {
+		t.Errorf("If-Range must not be sent with weak ETag but got %q", got)
+	}
+}
+
+// newDriftBlob resolves sampleData1 on a dummy registry served by tr.
+func newDriftBlob(t *testing.T, tr http.RoundTripper) *blob {
+	refspec, err := reference.Parse("testdummy.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	desc := ocispec.Descriptor{Digest: digest.Digest("sha256:deadbeaf")}
+	hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{
+			Client:       &http.Client{Transport: tr},
+			Host:         "testdummy.com",
+			Scheme:       "http",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull,
+		}}, nil
+	}
+	f, size, err := newFetcher(context.Background(), hosts, refspec, desc)
+	if err != nil {
+		t.Fatalf("failed to resolve fetcher: %v", err)
+	}
+	if blobSize := int64(len(sampleData1)); size != blobSize {
+		t.Fatalf("resolved size %d; want %d", size, blobSize)
+	}
+	return &blob{
+		fetcher:      f,
+		size:         size,
+		chunkSize:    sampleChunkSize,
+		cache:        cache.NewMemoryCache(),
+		fetchTimeout: time.Duration(defaultFetchTimeoutSec) * time.Second,
+		hosts:        hosts,
+		refspec:      refspec,
+		desc:         desc,
+	}
+}
+
+// removeRecordingCache records the entries removed from the cache.
+type removeRecordingCache struct {
+	cache.BlobCache
+	removed map[string]bool
+}
+
+func (c *removeRecordingCache) Remove(key string) error {
+	c.removed[key] = true
+	return c.BlobCache.(cache.RemovableCache).Remove(key)
+}
+
+// tokenRegistry is a dummy registry which serves sampleData1 only with the
+// latest token issued by its token server.
+type tokenRegistry struct {
+	t *testing.T
+
+	// invalidTokenError makes the registry tell the rejected token is invalid
+	// in the challenge.
+	invalidTokenError bool
+
+	// rejectAll makes the registry reject all tokens.
+	rejectAll bool
+
+	issued int
+	valid  string
+	mu     sync.Mutex
+}
+
+func (r *tokenRegistry) RoundTrip(req *http.Request) (*http.Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.URL.Host == "auth.testdummy.com" {
+		r.issued++
+		r.valid = fmt.Sprintf("token-%d", r.issued)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+			Body:       ioutil.NopCloser(strings.NewReader(fmt.Sprintf(`{"token":%q}`, r.valid))),
+			Request:    req,
+		}, nil
+	}
+	authz := req.Header.Get("Authorization")
+	if r.rejectAll || r.valid == "" || authz != "Bearer "+r.valid {
+		challenge := `Bearer realm="https://auth.testdummy.com/token",service="testdummy.com"`
+		if authz != "" && r.invalidTokenError {
+			challenge += `,error="invalid_token"`
+		}
+		header := make(http.Header)
+		header.Set("WWW-Authenticate", challenge)
+		return &http.Response{
+			StatusCode: http.StatusUnauthorized,
+			Status:     "401 Unauthorized",
+			Header:     header,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+			Request:    req,
+		}, nil
+	}
+	return multiRoundTripper(r.t, []byte(sampleData1), allowMultiRange(false))(req), nil
+}
+
+// expire expires the issued token.
+func (r *tokenRegistry) expire() {
+	r.mu.Lock()
+	r.valid = ""
+	r.mu.Unlock()
+}
+
+func (r *tokenRegistry) issuedTokens() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.issued
+}
+
+func TestTokenExpiry(t *testing.T) {
+	tests := []struct {
+		name              string
+		invalidTokenError bool
+		sharedAuthorizer  bool
+	}{
+		{
+			// The authorizer forgets the invalid token and the auth flow is
+			// re-run on the transport.
+			name:              "invalid-token-error",
+			invalidTokenError: true,
+			sharedAuthorizer:  true,
+		},
+		{
+			// The authorizer keeps the rejected token. The blob is re-resolved
+			// with a new authorizer.
+			name: "no-error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := &tokenRegistry{t: t, invalidTokenError: tt.invalidTokenError}
+			b := newAuthBlob(t, reg, tt.sharedAuthorizer)
+			checkRead(t, []byte(sampleData1[:sampleChunkSize]), b, 0, sampleChunkSize)
+			issued := reg.issuedTokens()
+
+			// The token expires while the blob is read.
+			reg.expire()
+			checkRead(t, []byte(sampleData1[sampleChunkSize:2*sampleChunkSize]), b, sampleChunkSize, sampleChunkSize)
+			if got := reg.issuedTokens(); got != issued+1 {
+				t.Errorf("issued %d tokens after expiry; want 1", got-issued)
+			}
+		})
+	}
+
+	// Retries are bounded if the registry keeps rejecting tokens.
+	reg := &tokenRegistry{t: t, invalidTokenError: true}
+	b := newAuthBlob(t, reg, true)
+	reg.rejectAll = true
+	issued := reg.issuedTokens()
+	if _, err := b.ReadAt(make([]byte, sampleChunkSize), 0); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("read must fail with unauthorized but got %v", err)
+	}
+	if got := reg.issuedTokens() - issued; got == 0 || got > 3*maxAuthRetries {
+		t.Errorf("issued %d tokens on rejection; want 1-%d", got, 3*maxAuthRetries)
+	}
+}
+
+// newAuthBlob resolves sampleData1 on a dummy registry which requires tokens.
+// If shared is true, all hosts share the same authorizer.
+func newAuthBlob(t *testing.T, tr http.RoundTripper, shared bool) *blob {
+	refspec, err := reference.Parse("testdummy.com/library/test")
+	if err != nil {
+		t.Fatalf("failed to prepare dummy reference: %v", err)
+	}
+	desc := ocispec.Descriptor{Digest: digest.Digest("sha256:deadbeaf")}
+	client := &http.Client{Transport: tr}
+	sharedAuth := docker.NewDockerAuthorizer(docker.WithAuthClient(client))
+	hosts := func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+		auth := sharedAuth
+		if !shared {
+			auth = docker.NewDockerAuthorizer(docker.WithAuthClient(client))
+		}
+		return []docker.RegistryHost{{
+			Client:       client,
+			Authorizer:   auth,
+			Host:         "testdummy.com",
+			Scheme:       "http",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull,
+		}}, nil
+	}
+	f, size, err := newFetcher(context.Background(), hosts, refspec, desc)
+	if err != nil {
+		t.Fatalf("failed to resolve fetcher: %v", err)
+	}
+	return &blob{
+		fetcher:      f,
+		size:         size,
+		chunkSize:    sampleChunkSize,
+		cache:        cache.NewMemoryCache(),
+		fetchTimeout: time.Duration(defaultFetchTimeoutSec) * time.Second,
+		hosts:        hosts,
+		refspec:      refspec,
+		desc:         desc,
+	}
+}
@@ -19,13 +19,16 @@ package source
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/labels"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/estargz"
 	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/snapshot"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
@@ -40,6 +43,23 @@ type GetSources func(labels map[string]string) (source []Source, err error)
 // RegistryHosts returns a list of registries that provides the specified image.
 type RegistryHosts func(reference.Spec) ([]docker.RegistryHost, error)
 
+type rateLimitHandledKey struct{}
+
+// WithRateLimitHandled returns the context of the requests which handle 429
+// (Too Many Requests) by themselves (e.g. chunk requests throttled per host).
+// The transports of RegistryHosts must not retry these requests so that retries
+// aren't stacked.
+func WithRateLimitHandled(ctx context.Context) context.Context {
+	return context.WithValue(ctx, rateLimitHandledKey{}, true)
+}
+
+// IsRateLimitHandled returns true if the requests with the context handle 429
+// by themselves.
+func IsRateLimitHandled(ctx context.Context) bool {
+	ok, _ := ctx.Value(rateLimitHandledKey{}).(bool)
+	return ok
+}
+
 // Source is a typed blob source information. This contains information about
 // a blob stored in registries and some contexts of the blob.
 type Source struct {
@@ -58,6 +78,12 @@ type Source struct {
 	// the manifest.
 	// Currently, only layer digests (Manifest.Layers.Digest) will be used.
 	Manifest ocispec.Manifest
+
+	// PrivateCredentials is true if Hosts authorizes the requests with the
+	// credentials private to the tenant (e.g. passed through the labels). The
+	// layer isn't shared with other tenants even if the tenant isolation is
+	// disabled.
+	PrivateCredentials bool
 }
 
 const (
@@ -70,6 +96,10 @@ const (
 	// targetImageLayersLabel is a label which contains layer digests contained in
 	// the target image.
 	targetImageLayersLabel = "containerd.io/snapshot/remote/stargz.layers"
+
+	// targetSizeLabel is a label which contains the size of the layer. This is
+	// used when the registry doesn't report the size of the layer.
+	targetSizeLabel = "containerd.io/snapshot/remote/stargz.size"
 )
 
 // FromDefaultLabels returns a function for converting snapshot labels to
@@ -94,6 +124,13 @@ func FromDefaultLabels(hosts RegistryHosts) GetSources {
 			return nil, err
 		}
 
+		var size int64
+		if sizeStr, ok := labels[targetSizeLabel]; ok {
+			if size, err = strconv.ParseInt(sizeStr, 10, 64); err != nil {
+				return nil, err
+			}
+		}
+
 		var layersDgst []digest.Digest
 		if l, ok := labels[targetImageLayersLabel]; ok {
 			layersStr := strings.Split(l, ",")
@@ -113,11 +150,17 @@ func FromDefaultLabels(hosts RegistryHosts) GetSources {
 			layers = append(layers, ocispec.Descriptor{Digest: dgst})
 		}
 
+		targetDesc := ocispec.Descriptor{Digest: target, Size: size}
+		if toc, ok := labels[estargz.ExternalTOCAnnotation]; ok {
+			// The TOC of the layer is stored in a separate blob.
+			targetDesc.Annotations = map[string]string{estargz.ExternalTOCAnnotation: toc}
+		}
+
 		return []Source{
 			{
 				Hosts:    hosts,
 				Name:     refspec,
-				Target:   ocispec.Descriptor{Digest: target},
+				Target:   targetDesc,
 				Manifest: ocispec.Manifest{Layers: layers},
 			},
 		}, nil
@@ -145,6 +188,7 @@ func AppendDefaultLabelsHandlerWrapper(ref string, prefetchSize int64) func(f im
 						}
 						c.Annotations[targetRefLabel] = ref
 						c.Annotations[targetDigestLabel] = c.Digest.String()
+						c.Annotations[targetSizeLabel] = fmt.Sprintf("%d", c.Size)
 						var layers string
 						for _, l := range children[i:] {
 							if images.IsLayerType(l.MediaType) {
@@ -158,7 +202,11 @@ func AppendDefaultLabelsHandlerWrapper(ref string, prefetchSize int64) func(f im
 							}
 						}
 						c.Annotations[targetImageLayersLabel] = strings.TrimSuffix(layers, ",")
+						c.Annotations[snapshot.TargetMediaTypeLabel] = c.MediaType
 						c.Annotations[config.TargetPrefetchSizeLabel] = fmt.Sprintf("%d", prefetchSize)
+						if created, ok := c.Annotations[ocispec.AnnotationCreated]; ok {
+							c.Annotations[config.TargetCreatedLabel] = created
+						}
 					}
 				}
 			}
@@ -0,0 +1,184 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// DefaultArtifactType is the config media type of artifacts used when no type is
+// specified. This follows the convention of ORAS.
+const DefaultArtifactType = "application/vnd.unknown.config.v1+json"
+
+// ArtifactConvert builds an eStargz blob from the specified directory or tarball
+// (gzip, zstd or plain tar) and stores it to the content store as an OCI artifact.
+// The artifact is an OCI image manifest whose config media type is artifactType
+// and which contains the eStargz blob as the only layer. Prioritized files (and
+// landmarks) can be specified through opts. The descriptor of the manifest is
+// returned. The caller can push it using the standard tooling for images.
+func ArtifactConvert(ctx context.Context, cs content.Store, src string, artifactType string, opts ...estargz.Option) (ocispec.Descriptor, error) {
+	if artifactType == "" {
+		artifactType = DefaultArtifactType
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	var tarFile *os.File
+	if fi.IsDir() {
+		tarFile, err = ioutil.TempFile("", "artifact-tar")
+		if err != nil {
+			return ocispec.Descriptor{}, err
+		}
+		defer os.Remove(tarFile.Name())
+		if err := writeTar(tarFile, src); err != nil {
+			tarFile.Close()
+			return ocispec.Descriptor{}, errors.Wrapf(err, "failed to archive %q", src)
+		}
+	} else if tarFile, err = os.Open(src); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer tarFile.Close()
+	tarInfo, err := tarFile.Stat()
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	blob, err := estargz.Build(io.NewSectionReader(tarFile, 0, tarInfo.Size()), opts...)
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to build eStargz")
+	}
+	defer blob.Close()
+	ref := fmt.Sprintf("artifact-estargz-from-%s", filepath.Base(src))
+	w, err := content.OpenWriter(ctx, cs, content.WithRef(ref))
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	defer w.Close()
+	if err := w.Truncate(0); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	n, err := io.Copy(w, blob)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := blob.Close(); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := w.Commit(ctx, n, ""); err != nil && !errdefs.IsAlreadyExists(err) {
+		return ocispec.Descriptor{}, err
+	}
+	layer := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayerGzip,
+		Digest:    w.Digest(),
+		Size:      n,
+		Annotations: map[string]string{
+			estargz.TOCJSONDigestAnnotation: blob.TOCDigest().String(),
+			ocispec.AnnotationTitle:         filepath.Base(src),
+		},
+	}
+
+	config, err := writeJSON(ctx, cs, artifactType, struct{}{})
+	if err != nil {
+		return ocispec.Descriptor{}, errors.Wrap(err, "failed to write config")
+	}
+	return writeJSON(ctx, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+}
+
+func writeJSON(ctx context.Context, cs content.Store, mediaType string, v interface{}, opts ...content.Opt) (ocispec.Descriptor, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	ref := fmt.Sprintf("artifact-%s", desc.Digest)
+	if err := content.WriteBlob(ctx, cs, ref, bytes.NewReader(b), desc, opts...); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// writeTar archives the contents of the directory into a tar stream.
+func writeTar(w io.Writer, root string) error {
+	tw := tar.NewWriter(w)
+	if err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		h, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		h.Name = filepath.ToSlash(name)
+		if fi.IsDir() {
+			h.Name += "/"
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,104 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestArtifactConvert tests packing a directory as an eStargz artifact.
+func TestArtifactConvert(t *testing.T) {
+	ctx := context.Background()
+	tmp, err := ioutil.TempDir("", "testartifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	cs, err := local.NewStore(filepath.Join(tmp, "content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(tmp, "model")
+	if err := os.MkdirAll(filepath.Join(src, "weights"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"index.json":     "{}",
+		"weights/data.0": "0123456789",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(src, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	desc, err := ArtifactConvert(ctx, cs, src, "", estargz.WithPrioritizedFiles([]string{"index.json"}))
+	if err != nil {
+		t.Fatalf("failed to convert artifact: %v", err)
+	}
+	b, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Config.MediaType != DefaultArtifactType {
+		t.Errorf("config media type = %q; want %q", manifest.Config.MediaType, DefaultArtifactType)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("artifact must contain 1 layer but got %d", len(manifest.Layers))
+	}
+	layer := manifest.Layers[0]
+	if _, ok := layer.Annotations[estargz.TOCJSONDigestAnnotation]; !ok {
+		t.Errorf("TOC digest annotation must be specified")
+	}
+
+	ra, err := cs.ReaderAt(ctx, layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ra.Close()
+	r, err := estargz.Open(io.NewSectionReader(ra, 0, layer.Size))
+	if err != nil {
+		t.Fatalf("artifact layer must be eStargz: %v", err)
+	}
+	for name, data := range files {
+		e, ok := r.Lookup(name)
+		if !ok {
+			t.Fatalf("file %q not found in the artifact", name)
+		}
+		if e.Size != int64(len(data)) {
+			t.Errorf("size of %q = %d; want %d", name, e.Size, len(data))
+		}
+	}
+	if _, ok := r.Lookup(estargz.PrefetchLandmark); !ok {
+		t.Errorf("prefetch landmark must be contained")
+	}
+}
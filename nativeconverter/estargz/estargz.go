@@ -17,9 +17,13 @@
 package estargz
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/containerd/containerd/archive/compression"
@@ -29,9 +33,31 @@ import (
 	"github.com/containerd/containerd/images/converter"
 	"github.com/containerd/containerd/images/converter/uncompress"
 	"github.com/containerd/containerd/labels"
+	"github.com/containerd/containerd/log"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/recorder"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ChunkSizeAnnotation is an annotation of a layer in the source image which
+	// specifies the chunk size (in bytes) used for converting the layer.
+	ChunkSizeAnnotation = "containerd.io/snapshot/stargz/convert.chunk-size"
+
+	// CompressionLevelAnnotation is an annotation of a layer in the source image
+	// which specifies the gzip compression level used for converting the layer.
+	CompressionLevelAnnotation = "containerd.io/snapshot/stargz/convert.compression-level"
+
+	// PrioritizedFilesConvertAnnotation is an annotation of a layer in the source
+	// image which specifies the prioritized files of the layer as a JSON array
+	// of paths.
+	PrioritizedFilesConvertAnnotation = "containerd.io/snapshot/stargz/convert.prioritized-files"
+
+	// convertAnnotationPrefix is the prefix of the annotations which configure
+	// the conversion. These are removed from the converted layers.
+	convertAnnotationPrefix = "containerd.io/snapshot/stargz/convert."
 )
 
 // LayerConvertWithLayerOptsFunc converts legacy tar.gz layers into eStargz tar.gz layers.
@@ -45,7 +71,7 @@ func LayerConvertWithLayerAndCommonOptsFunc(opts map[digest.Digest][]estargz.Opt
 	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
 		// TODO: enable to speciy option per layer "index" because it's possible that there are
 		//       two layers having same digest in an image (but this should be rare case)
-		return LayerConvertFunc(append(commonOpts, opts[desc.Digest]...)...)(ctx, cs, desc)
+		return layerConvertFunc(commonOpts, opts[desc.Digest])(ctx, cs, desc)
 	}
 }
 
@@ -56,12 +82,32 @@ func LayerConvertWithLayerAndCommonOptsFunc(opts map[digest.Digest][]estargz.Opt
 //
 // Otherwise "containerd.io/snapshot/stargz/toc.digest" annotation will be lost,
 // because the Docker media type does not support layer annotations.
+//
+// Options of each layer can be specified by the annotations of the layer in the
+// source image (ChunkSizeAnnotation, CompressionLevelAnnotation and
+// PrioritizedFilesConvertAnnotation), e.g. set by the build system. These take
+// precedence over opts.
+//
+// If the layer is labeled with a record of accessed files (recorder.RecordLabel,
+// e.g. by the analyzer), the files are prioritized unless opts or annotations
+// specify the prioritized files.
 func LayerConvertFunc(opts ...estargz.Option) converter.ConvertFunc {
+	return layerConvertFunc(opts, nil)
+}
+
+// layerConvertFunc converts the layer with options in the order of the record
+// of the layer (recorder.RecordLabel), commonOpts, the annotations of the layer
+// and layerOpts. Later options take precedence.
+func layerConvertFunc(commonOpts, layerOpts []estargz.Option) converter.ConvertFunc {
 	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
 		if !images.IsLayerType(desc.MediaType) {
 			// No conversion. No need to return an error here.
 			return nil, nil
 		}
+		annotationOpts, err := optionsFromAnnotations(desc.Annotations)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid annotation of layer %q", desc.Digest)
+		}
 		info, err := cs.Info(ctx, desc.Digest)
 		if err != nil {
 			return nil, err
@@ -70,6 +116,17 @@ func LayerConvertFunc(opts ...estargz.Option) converter.ConvertFunc {
 		if labelz == nil {
 			labelz = make(map[string]string)
 		}
+		var recordOpts []estargz.Option
+		if record, ok := labelz[recorder.RecordLabel]; ok {
+			recordOpts, err = optionsFromRecord(ctx, cs, desc, record)
+			if err != nil {
+				log.G(ctx).WithError(err).Warnf("failed to read record of layer %q; ignoring", desc.Digest)
+			}
+			// The record is about the original layer.
+			delete(labelz, recorder.RecordLabel)
+			delete(labelz, recorder.RecordGCLabel)
+		}
+		opts := append(append(append(append([]estargz.Option{}, recordOpts...), commonOpts...), annotationOpts...), layerOpts...)
 
 		ra, err := cs.ReaderAt(ctx, desc)
 		if err != nil {
@@ -144,15 +201,113 @@ func LayerConvertFunc(opts ...estargz.Option) converter.ConvertFunc {
 		}
 		newDesc.Digest = w.Digest()
 		newDesc.Size = n
-		if newDesc.Annotations == nil {
-			newDesc.Annotations = make(map[string]string, 1)
+		annotations := make(map[string]string, len(desc.Annotations)+4)
+		for k, v := range desc.Annotations {
+			if !strings.HasPrefix(k, convertAnnotationPrefix) {
+				annotations[k] = v
+			}
 		}
+		newDesc.Annotations = annotations
 		newDesc.Annotations[estargz.TOCJSONDigestAnnotation] = blob.TOCDigest().String()
 		newDesc.Annotations[estargz.StoreUncompressedSizeAnnotation] = fmt.Sprintf("%d", c.size())
+		newDesc.Annotations[estargz.PrioritizedSizeAnnotation] = fmt.Sprintf("%d", blob.PrioritizedSize())
+		newDesc.Annotations[estargz.PrioritizedFilesAnnotation] = fmt.Sprintf("%d", blob.PrioritizedFiles())
 		return &newDesc, nil
 	}
 }
 
+// optionsFromAnnotations returns the options specified by the annotations of
+// a layer.
+func optionsFromAnnotations(annotations map[string]string) (opts []estargz.Option, _ error) {
+	if v, ok := annotations[ChunkSizeAnnotation]; ok {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid chunk size %q", v)
+		}
+		opts = append(opts, estargz.WithChunkSize(size))
+	}
+	if v, ok := annotations[CompressionLevelAnnotation]; ok {
+		level, err := strconv.Atoi(v)
+		if err != nil || level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, fmt.Errorf("invalid compression level %q", v)
+		}
+		opts = append(opts, estargz.WithCompressionLevel(level))
+	}
+	if v, ok := annotations[PrioritizedFilesConvertAnnotation]; ok {
+		var files []string
+		if err := json.Unmarshal([]byte(v), &files); err != nil {
+			return nil, errors.Wrap(err, "prioritized files must be a JSON array of paths")
+		}
+		opts = append(opts, estargz.WithPrioritizedFiles(files))
+	}
+	return opts, nil
+}
+
+// optionsFromRecord returns the options prioritizing the files of the layer in
+// the record.
+func optionsFromRecord(ctx context.Context, cs content.Store, desc ocispec.Descriptor, record string) ([]estargz.Option, error) {
+	dgst, err := digest.Parse(record)
+	if err != nil {
+		return nil, err
+	}
+	ra, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: dgst})
+	if err != nil {
+		return nil, err
+	}
+	defer ra.Close()
+	var (
+		dec    = json.NewDecoder(io.NewSectionReader(ra, 0, ra.Size()))
+		layers = make(map[string][]ocispec.Descriptor) // layers of each manifest
+		files  []string
+		added  = make(map[string]struct{})
+	)
+	for dec.More() {
+		var e recorder.Entry
+		if err := dec.Decode(&e); err != nil {
+			return nil, err
+		}
+		if e.LayerIndex == nil || e.ManifestDigest == "" {
+			continue
+		}
+		l, ok := layers[e.ManifestDigest]
+		if !ok {
+			l, err = manifestLayers(ctx, cs, e.ManifestDigest)
+			if err != nil {
+				return nil, err
+			}
+			layers[e.ManifestDigest] = l
+		}
+		if i := *e.LayerIndex; i < 0 || i >= len(l) || l[i].Digest != desc.Digest {
+			continue
+		}
+		if _, ok := added[e.Path]; !ok {
+			added[e.Path] = struct{}{}
+			files = append(files, e.Path)
+		}
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	return []estargz.Option{estargz.WithPrioritizedFiles(files)}, nil
+}
+
+func manifestLayers(ctx context.Context, cs content.Store, manifestDigest string) ([]ocispec.Descriptor, error) {
+	dgst, err := digest.Parse(manifestDigest)
+	if err != nil {
+		return nil, err
+	}
+	ra, err := cs.ReaderAt(ctx, ocispec.Descriptor{Digest: dgst})
+	if err != nil {
+		return nil, err
+	}
+	defer ra.Close()
+	var manifest ocispec.Manifest
+	if err := json.NewDecoder(io.NewSectionReader(ra, 0, ra.Size())).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	return manifest.Layers, nil
+}
+
 type counter struct {
 	n  int64
 	mu sync.Mutex
@@ -17,14 +17,23 @@
 package estargz
 
 import (
+	"bytes"
 	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/images/converter"
 	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/recorder"
 	"github.com/containerd/stargz-snapshotter/util/testutil"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -68,3 +77,136 @@ func TestLayerConvertFunc(t *testing.T) {
 		t.Fatal("no eStargz layer was created")
 	}
 }
+
+// TestLayerConvertFuncAnnotations tests options specified by the annotations of
+// the source layer.
+func TestLayerConvertFuncAnnotations(t *testing.T) {
+	ctx := context.Background()
+	tmp, err := ioutil.TempDir("", "testannotations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	cs, err := local.NewStore(filepath.Join(tmp, "content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, gzData := buildTestLayer(t, map[string]string{
+		"a": "0123456789",
+		"b": "0123456789",
+	})
+	layer := writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageLayerGzip, gzData)
+	layer.Annotations = map[string]string{
+		ChunkSizeAnnotation:               "4",
+		CompressionLevelAnnotation:        "1",
+		PrioritizedFilesConvertAnnotation: `["b"]`,
+		"foo":                             "bar",
+	}
+
+	// Annotations take precedence over the common options.
+	newDesc, err := LayerConvertFunc(estargz.WithChunkSize(0))(ctx, cs, layer)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	if v := newDesc.Annotations[estargz.PrioritizedFilesAnnotation]; v != "1" {
+		t.Errorf("number of prioritized files = %q; want 1", v)
+	}
+	for _, k := range []string{ChunkSizeAnnotation, CompressionLevelAnnotation, PrioritizedFilesConvertAnnotation} {
+		if _, ok := newDesc.Annotations[k]; ok {
+			t.Errorf("annotation %q must be removed from the converted layer", k)
+		}
+	}
+	if newDesc.Annotations["foo"] != "bar" {
+		t.Errorf("other annotations must be kept")
+	}
+	ra, err := cs.ReaderAt(ctx, *newDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ra.Close()
+	r, err := estargz.Open(io.NewSectionReader(ra, 0, newDesc.Size))
+	if err != nil {
+		t.Fatalf("converted layer must be eStargz: %v", err)
+	}
+	e, ok := r.Lookup("a")
+	if !ok {
+		t.Fatal("file a not found")
+	}
+	if e.ChunkSize != 4 {
+		t.Errorf("chunk size = %d; want 4", e.ChunkSize)
+	}
+
+	layer.Annotations = map[string]string{PrioritizedFilesConvertAnnotation: "b"}
+	if _, err := LayerConvertFunc()(ctx, cs, layer); err == nil {
+		t.Errorf("invalid annotation must be rejected")
+	}
+}
+
+// labeledStore serves content labels on top of a store which doesn't support
+// them.
+type labeledStore struct {
+	content.Store
+	labels map[digest.Digest]map[string]string
+}
+
+func (s *labeledStore) Info(ctx context.Context, dgst digest.Digest) (content.Info, error) {
+	info, err := s.Store.Info(ctx, dgst)
+	if err != nil {
+		return content.Info{}, err
+	}
+	info.Labels = s.labels[dgst]
+	return info, nil
+}
+
+// TestLayerConvertFuncRecord tests prioritizing files recorded for the layer.
+func TestLayerConvertFuncRecord(t *testing.T) {
+	ctx := context.Background()
+	tmp, err := ioutil.TempDir("", "testrecord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	local, err := local.NewStore(filepath.Join(tmp, "content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &labeledStore{local, make(map[digest.Digest]map[string]string)}
+	_, gzData := buildTestLayer(t, map[string]string{"a": "a", "b": "b", "c": "c"})
+	layer := writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageLayerGzip, gzData)
+	manifest := writeTestJSON(ctx, t, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Layers: []ocispec.Descriptor{layer},
+	})
+	var record bytes.Buffer
+	rec := recorder.New(&record)
+	for _, e := range []struct {
+		path  string
+		index int
+	}{{"b", 0}, {"c", 0}, {"b", 0}, {"a", 1}} {
+		index := e.index
+		if err := rec.Record(&recorder.Entry{Path: e.path, ManifestDigest: manifest.Digest.String(), LayerIndex: &index}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recordDesc := writeTestBlob(ctx, t, cs, "application/octet-stream", record.Bytes())
+	cs.labels[layer.Digest] = map[string]string{
+		recorder.RecordLabel:   recordDesc.Digest.String(),
+		recorder.RecordGCLabel: recordDesc.Digest.String(),
+	}
+
+	newDesc, err := LayerConvertFunc()(ctx, cs, layer)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	if v := newDesc.Annotations[estargz.PrioritizedFilesAnnotation]; v != "2" {
+		t.Errorf("number of prioritized files = %q; want 2 (b and c)", v)
+	}
+
+	// Explicitly specified prioritized files take precedence.
+	newDesc, err = LayerConvertFunc(estargz.WithPrioritizedFiles([]string{"a"}))(ctx, cs, layer)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	if v := newDesc.Annotations[estargz.PrioritizedFilesAnnotation]; v != "1" {
+		t.Errorf("number of prioritized files = %q; want 1", v)
+	}
+}
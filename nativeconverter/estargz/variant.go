@@ -0,0 +1,194 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// EStargzOSFeature is the OS feature in the platform of manifests of eStargz
+// variants in an image index made by DualVariantIndexConvertFunc. Runtimes
+// ignore OS features when they select a manifest for Linux, so they pull the
+// original variant listed earlier. PreferEStargz selects eStargz variants.
+const EStargzOSFeature = "estargz"
+
+// DualVariantIndexConvertFunc returns converter.ConvertFunc which converts the
+// image into an OCI image index carrying both the original manifest and the
+// eStargz manifest (converted with layerConvertFunc) of each platform. This
+// allows publishing a single tag usable by both runtimes unaware of eStargz and
+// the nodes lazily pulling eStargz. Use with converter.WithIndexConvertFunc.
+func DualVariantIndexConvertFunc(layerConvertFunc converter.ConvertFunc, docker2oci bool, platformMC platforms.MatchComparer) converter.ConvertFunc {
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		orig, err := convertVariant(ctx, cs, desc, converter.DefaultIndexConvertFunc(nil, docker2oci, platformMC))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to convert original variant")
+		}
+		esgz, err := convertVariant(ctx, cs, desc, converter.DefaultIndexConvertFunc(layerConvertFunc, docker2oci, platformMC))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to convert eStargz variant")
+		}
+		origManifests, err := platformManifests(ctx, cs, orig)
+		if err != nil {
+			return nil, err
+		}
+		esgzManifests, err := platformManifests(ctx, cs, esgz)
+		if err != nil {
+			return nil, err
+		}
+
+		// Original variants come first so that runtimes unaware of eStargz pull them.
+		manifests := append([]ocispec.Descriptor{}, origManifests...)
+		added := make(map[digest.Digest]struct{})
+		for _, m := range origManifests {
+			added[m.Digest] = struct{}{}
+		}
+		for _, m := range esgzManifests {
+			if _, ok := added[m.Digest]; ok {
+				continue // not converted (e.g. already eStargz)
+			}
+			p := *m.Platform
+			p.OSFeatures = append(append([]string{}, p.OSFeatures...), EStargzOSFeature)
+			m.Platform = &p
+			manifests = append(manifests, m)
+		}
+		labels := make(map[string]string)
+		for i, m := range manifests {
+			labels[fmt.Sprintf("containerd.io/gc.ref.content.m.%d", i)] = m.Digest.String()
+		}
+		index, err := writeJSON(ctx, cs, ocispec.MediaTypeImageIndex, ocispec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			Manifests: manifests,
+		}, content.WithLabels(labels))
+		if err != nil {
+			return nil, err
+		}
+		return &index, nil
+	}
+}
+
+func convertVariant(ctx context.Context, cs content.Store, desc ocispec.Descriptor, f converter.ConvertFunc) (ocispec.Descriptor, error) {
+	newDesc, err := f(ctx, cs, desc)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if newDesc == nil {
+		return desc, nil
+	}
+	return *newDesc, nil
+}
+
+// platformManifests returns the manifests of the image with their platforms.
+func platformManifests(ctx context.Context, cs content.Store, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+	switch {
+	case images.IsIndexType(desc.MediaType):
+		b, err := content.ReadBlob(ctx, cs, desc)
+		if err != nil {
+			return nil, err
+		}
+		var index ocispec.Index
+		if err := json.Unmarshal(b, &index); err != nil {
+			return nil, err
+		}
+		var res []ocispec.Descriptor
+		for _, m := range index.Manifests {
+			if m.Platform == nil {
+				p, err := manifestPlatform(ctx, cs, m)
+				if err != nil {
+					return nil, err
+				}
+				m.Platform = &p
+			}
+			res = append(res, m)
+		}
+		return res, nil
+	case images.IsManifestType(desc.MediaType):
+		p, err := manifestPlatform(ctx, cs, desc)
+		if err != nil {
+			return nil, err
+		}
+		desc.Platform = &p
+		return []ocispec.Descriptor{desc}, nil
+	}
+	return nil, fmt.Errorf("unsupported media type %q", desc.MediaType)
+}
+
+// manifestPlatform returns the platform of the image manifest recorded in the
+// config.
+func manifestPlatform(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (ocispec.Platform, error) {
+	b, err := content.ReadBlob(ctx, cs, desc)
+	if err != nil {
+		return ocispec.Platform{}, err
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(b, &manifest); err != nil {
+		return ocispec.Platform{}, err
+	}
+	b, err = content.ReadBlob(ctx, cs, manifest.Config)
+	if err != nil {
+		return ocispec.Platform{}, err
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(b, &config); err != nil {
+		return ocispec.Platform{}, err
+	}
+	return platforms.Normalize(ocispec.Platform{
+		OS:           config.OS,
+		Architecture: config.Architecture,
+	}), nil
+}
+
+// PreferEStargz returns platforms.MatchComparer which prefers eStargz variants
+// made by DualVariantIndexConvertFunc over the original variants of the same
+// platform. Use this for pulling images with the snapshotter (e.g. with
+// containerd.WithPlatformMatcher).
+func PreferEStargz(m platforms.MatchComparer) platforms.MatchComparer {
+	return &preferEStargz{m}
+}
+
+type preferEStargz struct {
+	platforms.MatchComparer
+}
+
+func (p *preferEStargz) Less(p1, p2 ocispec.Platform) bool {
+	if p.MatchComparer.Less(p1, p2) {
+		return true
+	}
+	if p.MatchComparer.Less(p2, p1) {
+		return false
+	}
+	return isEStargzVariant(p1) && !isEStargzVariant(p2)
+}
+
+func isEStargzVariant(p ocispec.Platform) bool {
+	for _, f := range p.OSFeatures {
+		if f == EStargzOSFeature {
+			return true
+		}
+	}
+	return false
+}
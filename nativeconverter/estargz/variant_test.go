@@ -0,0 +1,163 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package estargz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TestDualVariantIndexConvertFunc tests converting an image into an index of
+// the original and eStargz variants.
+func TestDualVariantIndexConvertFunc(t *testing.T) {
+	ctx := context.Background()
+	tmp, err := ioutil.TempDir("", "testvariant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+	cs, err := local.NewStore(filepath.Join(tmp, "content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make an image with a gzip layer.
+	tarData, gzData := buildTestLayer(t, map[string]string{"hello": "hello"})
+	layer := writeTestBlob(ctx, t, cs, ocispec.MediaTypeImageLayerGzip, gzData)
+	config := writeTestJSON(ctx, t, cs, ocispec.MediaTypeImageConfig, ocispec.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS:       ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(tarData)}},
+	})
+	manifest := writeTestJSON(ctx, t, cs, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+
+	cf := DualVariantIndexConvertFunc(LayerConvertFunc(), true, platforms.All)
+	newDesc, err := cf(ctx, cs, manifest)
+	if err != nil {
+		t.Fatalf("failed to convert: %v", err)
+	}
+	if newDesc.MediaType != ocispec.MediaTypeImageIndex {
+		t.Fatalf("media type = %q; want index", newDesc.MediaType)
+	}
+	b, err := content.ReadBlob(ctx, cs, *newDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(b, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 2 {
+		t.Fatalf("index must contain 2 manifests but got %d", len(index.Manifests))
+	}
+	if orig := index.Manifests[0]; orig.Digest != manifest.Digest || isEStargzVariant(*orig.Platform) {
+		t.Errorf("the first manifest must be the original one but got %+v", orig)
+	}
+	if !isEStargzVariant(*index.Manifests[1].Platform) {
+		t.Errorf("the second manifest must be the eStargz one but got %+v", index.Manifests[1])
+	}
+
+	// Runtimes unaware of eStargz select the original variant.
+	p := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	m, err := images.Manifest(ctx, cs, *newDesc, platforms.Only(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Layers[0].Digest != layer.Digest {
+		t.Errorf("original variant must be selected by default")
+	}
+	m, err = images.Manifest(ctx, cs, *newDesc, PreferEStargz(platforms.Only(p)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Layers[0].Annotations[estargz.TOCJSONDigestAnnotation]; !ok {
+		t.Errorf("eStargz variant must be preferred")
+	}
+}
+
+// buildTestLayer returns the tar and the gzip-compressed tar of the files.
+func buildTestLayer(t *testing.T, files map[string]string) (tarData, gzData []byte) {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	for _, name := range names {
+		data := []byte(files[name])
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var gzBuf bytes.Buffer
+	gw := gzip.NewWriter(&gzBuf)
+	if _, err := gw.Write(tarBuf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tarBuf.Bytes(), gzBuf.Bytes()
+}
+
+func writeTestJSON(ctx context.Context, t *testing.T, cs content.Store, mediaType string, v interface{}) ocispec.Descriptor {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeTestBlob(ctx, t, cs, mediaType, b)
+}
+
+func writeTestBlob(ctx context.Context, t *testing.T, cs content.Store, mediaType string, b []byte) ocispec.Descriptor {
+	desc := ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(b),
+		Size:      int64(len(b)),
+	}
+	if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(b), desc); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
@@ -23,6 +23,17 @@ import (
 	"sync"
 )
 
+const (
+	// RecordLabel is a content label of an image layer which points to the record
+	// of the files accessed in the layer (e.g. recorded by the analyzer). The
+	// converter uses these files as the prioritized files of the layer.
+	RecordLabel = "containerd.io/snapshot/stargz/record"
+
+	// RecordGCLabel is a content label of an image layer which keeps the record
+	// pointed by RecordLabel from being garbage collected.
+	RecordGCLabel = "containerd.io/gc.ref.content.stargz.record"
+)
+
 type Entry struct {
 	Path           string `json:"path"`
 	ManifestDigest string `json:"manifestDigest,omitempty"`
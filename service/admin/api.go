@@ -0,0 +1,762 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package admin provides the gRPC API for operating the running stargz
+// snapshotter. The API is defined in admin.proto. Messages are plain structs
+// with protobuf struct tags corresponding to the definition so that they can
+// be encoded by the default codec of gRPC.
+package admin
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+)
+
+// WatchProgressRequest is the request of WatchProgress.
+type WatchProgressRequest struct {
+	// Ref is the reference of the image.
+	Ref string `protobuf:"bytes,1,opt,name=ref,proto3" json:"ref,omitempty"`
+
+	// IntervalMsec is the interval of updates in milliseconds (default: 1000).
+	IntervalMsec int64 `protobuf:"varint,2,opt,name=interval_msec,json=intervalMsec,proto3" json:"interval_msec,omitempty"`
+}
+
+func (m *WatchProgressRequest) Reset()         { *m = WatchProgressRequest{} }
+func (m *WatchProgressRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*WatchProgressRequest) ProtoMessage()    {}
+
+// Progress is the fetch progress of an image.
+type Progress struct {
+	Ref            string           `protobuf:"bytes,1,opt,name=ref,proto3" json:"ref,omitempty"`
+	Size           int64            `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	FetchedSize    int64            `protobuf:"varint,3,opt,name=fetched_size,json=fetchedSize,proto3" json:"fetched_size,omitempty"`
+	FetchedPercent float64          `protobuf:"fixed64,4,opt,name=fetched_percent,json=fetchedPercent,proto3" json:"fetched_percent,omitempty"`
+	Layers         []*LayerProgress `protobuf:"bytes,5,rep,name=layers,proto3" json:"layers,omitempty"`
+}
+
+func (m *Progress) Reset()         { *m = Progress{} }
+func (m *Progress) String() string { return fmt.Sprintf("%+v", *m) }
+func (*Progress) ProtoMessage()    {}
+
+// LayerProgress is the fetch progress of a layer.
+type LayerProgress struct {
+	Digest         string   `protobuf:"bytes,1,opt,name=digest,proto3" json:"digest,omitempty"`
+	Size           int64    `protobuf:"varint,2,opt,name=size,proto3" json:"size,omitempty"`
+	FetchedSize    int64    `protobuf:"varint,3,opt,name=fetched_size,json=fetchedSize,proto3" json:"fetched_size,omitempty"`
+	FetchedPercent float64  `protobuf:"fixed64,4,opt,name=fetched_percent,json=fetchedPercent,proto3" json:"fetched_percent,omitempty"`
+	Degraded       []string `protobuf:"bytes,5,rep,name=degraded,proto3" json:"degraded,omitempty"`
+}
+
+func (m *LayerProgress) Reset()         { *m = LayerProgress{} }
+func (m *LayerProgress) String() string { return fmt.Sprintf("%+v", *m) }
+func (*LayerProgress) ProtoMessage()    {}
+
+// ExportStateRequest is the request of ExportState.
+type ExportStateRequest struct{}
+
+func (m *ExportStateRequest) Reset()         { *m = ExportStateRequest{} }
+func (m *ExportStateRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*ExportStateRequest) ProtoMessage()    {}
+
+// ExportStateResponse is the response of ExportState.
+type ExportStateResponse struct {
+	// State is the exported metadata encoded as JSON.
+	State []byte `protobuf:"bytes,1,opt,name=state,proto3" json:"state,omitempty"`
+}
+
+func (m *ExportStateResponse) Reset()         { *m = ExportStateResponse{} }
+func (m *ExportStateResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*ExportStateResponse) ProtoMessage()    {}
+
+// ImportStateRequest is the request of ImportState.
+type ImportStateRequest struct {
+	// State is the metadata returned by ExportState.
+	State []byte `protobuf:"bytes,1,opt,name=state,proto3" json:"state,omitempty"`
+}
+
+func (m *ImportStateRequest) Reset()         { *m = ImportStateRequest{} }
+func (m *ImportStateRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*ImportStateRequest) ProtoMessage()    {}
+
+// ImportStateResponse is the response of ImportState.
+type ImportStateResponse struct {
+	// Imported is the names of the imported snapshots. Existing snapshots
+	// aren't included.
+	Imported []string `protobuf:"bytes,1,rep,name=imported,proto3" json:"imported,omitempty"`
+}
+
+func (m *ImportStateResponse) Reset()         { *m = ImportStateResponse{} }
+func (m *ImportStateResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*ImportStateResponse) ProtoMessage()    {}
+
+// DumpDiagnosticsRequest is the request of DumpDiagnostics.
+type DumpDiagnosticsRequest struct{}
+
+func (m *DumpDiagnosticsRequest) Reset()         { *m = DumpDiagnosticsRequest{} }
+func (m *DumpDiagnosticsRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*DumpDiagnosticsRequest) ProtoMessage()    {}
+
+// DumpDiagnosticsResponse is the response of DumpDiagnostics.
+type DumpDiagnosticsResponse struct {
+	// Diagnostics is the dumped diagnostics encoded as JSON.
+	Diagnostics []byte `protobuf:"bytes,1,opt,name=diagnostics,proto3" json:"diagnostics,omitempty"`
+}
+
+func (m *DumpDiagnosticsResponse) Reset()         { *m = DumpDiagnosticsResponse{} }
+func (m *DumpDiagnosticsResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*DumpDiagnosticsResponse) ProtoMessage()    {}
+
+// ListLayersRequest is the request of ListLayers.
+type ListLayersRequest struct{}
+
+func (m *ListLayersRequest) Reset()         { *m = ListLayersRequest{} }
+func (m *ListLayersRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*ListLayersRequest) ProtoMessage()    {}
+
+// ListLayersResponse is the response of ListLayers.
+type ListLayersResponse struct {
+	Layers []*Layer `protobuf:"bytes,1,rep,name=layers,proto3" json:"layers,omitempty"`
+}
+
+func (m *ListLayersResponse) Reset()         { *m = ListLayersResponse{} }
+func (m *ListLayersResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*ListLayersResponse) ProtoMessage()    {}
+
+// Layer is a layer mounted as a remote snapshot.
+type Layer struct {
+	// Key is the key of the remote snapshot.
+	Key            string   `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+	Ref            string   `protobuf:"bytes,2,opt,name=ref,proto3" json:"ref,omitempty"`
+	Digest         string   `protobuf:"bytes,3,opt,name=digest,proto3" json:"digest,omitempty"`
+	Size           int64    `protobuf:"varint,4,opt,name=size,proto3" json:"size,omitempty"`
+	FetchedSize    int64    `protobuf:"varint,5,opt,name=fetched_size,json=fetchedSize,proto3" json:"fetched_size,omitempty"`
+	FetchedPercent float64  `protobuf:"fixed64,6,opt,name=fetched_percent,json=fetchedPercent,proto3" json:"fetched_percent,omitempty"`
+	Degraded       []string `protobuf:"bytes,7,rep,name=degraded,proto3" json:"degraded,omitempty"`
+}
+
+func (m *Layer) Reset()         { *m = Layer{} }
+func (m *Layer) String() string { return fmt.Sprintf("%+v", *m) }
+func (*Layer) ProtoMessage()    {}
+
+// RefreshLayerRequest is the request of RefreshLayer.
+type RefreshLayerRequest struct {
+	// Key is the key of the committed remote snapshot.
+	Key string `protobuf:"bytes,1,opt,name=key,proto3" json:"key,omitempty"`
+}
+
+func (m *RefreshLayerRequest) Reset()         { *m = RefreshLayerRequest{} }
+func (m *RefreshLayerRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*RefreshLayerRequest) ProtoMessage()    {}
+
+// RefreshLayerResponse is the response of RefreshLayer.
+type RefreshLayerResponse struct{}
+
+func (m *RefreshLayerResponse) Reset()         { *m = RefreshLayerResponse{} }
+func (m *RefreshLayerResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*RefreshLayerResponse) ProtoMessage()    {}
+
+// ReauthenticateRequest is the request of Reauthenticate.
+type ReauthenticateRequest struct{}
+
+func (m *ReauthenticateRequest) Reset()         { *m = ReauthenticateRequest{} }
+func (m *ReauthenticateRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*ReauthenticateRequest) ProtoMessage()    {}
+
+// ReauthenticateResponse is the response of Reauthenticate.
+type ReauthenticateResponse struct{}
+
+func (m *ReauthenticateResponse) Reset()         { *m = ReauthenticateResponse{} }
+func (m *ReauthenticateResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*ReauthenticateResponse) ProtoMessage()    {}
+
+// EvictCachesRequest is the request of EvictCaches.
+type EvictCachesRequest struct{}
+
+func (m *EvictCachesRequest) Reset()         { *m = EvictCachesRequest{} }
+func (m *EvictCachesRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*EvictCachesRequest) ProtoMessage()    {}
+
+// EvictCachesResponse is the response of EvictCaches.
+type EvictCachesResponse struct {
+	Evicted []*EvictedCaches `protobuf:"bytes,1,rep,name=evicted,proto3" json:"evicted,omitempty"`
+}
+
+func (m *EvictCachesResponse) Reset()         { *m = EvictCachesResponse{} }
+func (m *EvictCachesResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*EvictCachesResponse) ProtoMessage()    {}
+
+// EvictedCaches is the numbers of the layers and blobs evicted from the caches
+// of a filesystem.
+type EvictedCaches struct {
+	// Filesystem is the ID of the filesystem.
+	Filesystem string `protobuf:"bytes,1,opt,name=filesystem,proto3" json:"filesystem,omitempty"`
+	Layers     int64  `protobuf:"varint,2,opt,name=layers,proto3" json:"layers,omitempty"`
+	Blobs      int64  `protobuf:"varint,3,opt,name=blobs,proto3" json:"blobs,omitempty"`
+}
+
+func (m *EvictedCaches) Reset()         { *m = EvictedCaches{} }
+func (m *EvictedCaches) String() string { return fmt.Sprintf("%+v", *m) }
+func (*EvictedCaches) ProtoMessage()    {}
+
+// SetBackgroundFetchRequest is the request of SetBackgroundFetch.
+type SetBackgroundFetchRequest struct {
+	// Paused pauses background fetch. False resumes it.
+	Paused bool `protobuf:"varint,1,opt,name=paused,proto3" json:"paused,omitempty"`
+
+	// Bandwidth is the bandwidth limit in bytes per second. Zero means no limit.
+	Bandwidth int64 `protobuf:"varint,2,opt,name=bandwidth,proto3" json:"bandwidth,omitempty"`
+}
+
+func (m *SetBackgroundFetchRequest) Reset()         { *m = SetBackgroundFetchRequest{} }
+func (m *SetBackgroundFetchRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*SetBackgroundFetchRequest) ProtoMessage()    {}
+
+// GetBackgroundFetchRequest is the request of GetBackgroundFetch.
+type GetBackgroundFetchRequest struct{}
+
+func (m *GetBackgroundFetchRequest) Reset()         { *m = GetBackgroundFetchRequest{} }
+func (m *GetBackgroundFetchRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*GetBackgroundFetchRequest) ProtoMessage()    {}
+
+// BackgroundFetchResponse is the response of SetBackgroundFetch and
+// GetBackgroundFetch.
+type BackgroundFetchResponse struct {
+	States []*BackgroundFetchState `protobuf:"bytes,1,rep,name=states,proto3" json:"states,omitempty"`
+}
+
+func (m *BackgroundFetchResponse) Reset()         { *m = BackgroundFetchResponse{} }
+func (m *BackgroundFetchResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*BackgroundFetchResponse) ProtoMessage()    {}
+
+// BackgroundFetchState is the state of background fetch of a filesystem.
+type BackgroundFetchState struct {
+	// Filesystem is the ID of the filesystem.
+	Filesystem string `protobuf:"bytes,1,opt,name=filesystem,proto3" json:"filesystem,omitempty"`
+	Paused     bool   `protobuf:"varint,2,opt,name=paused,proto3" json:"paused,omitempty"`
+	Bandwidth  int64  `protobuf:"varint,3,opt,name=bandwidth,proto3" json:"bandwidth,omitempty"`
+}
+
+func (m *BackgroundFetchState) Reset()         { *m = BackgroundFetchState{} }
+func (m *BackgroundFetchState) String() string { return fmt.Sprintf("%+v", *m) }
+func (*BackgroundFetchState) ProtoMessage()    {}
+
+// GetInfoRequest is the request of GetInfo.
+type GetInfoRequest struct{}
+
+func (m *GetInfoRequest) Reset()         { *m = GetInfoRequest{} }
+func (m *GetInfoRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*GetInfoRequest) ProtoMessage()    {}
+
+// GetInfoResponse is the response of GetInfo.
+type GetInfoResponse struct {
+	Version      string            `protobuf:"bytes,1,opt,name=version,proto3" json:"version,omitempty"`
+	Revision     string            `protobuf:"bytes,2,opt,name=revision,proto3" json:"revision,omitempty"`
+	Filesystems  []*FilesystemInfo `protobuf:"bytes,3,rep,name=filesystems,proto3" json:"filesystems,omitempty"`
+	Compressions []string          `protobuf:"bytes,4,rep,name=compressions,proto3" json:"compressions,omitempty"`
+}
+
+func (m *GetInfoResponse) Reset()         { *m = GetInfoResponse{} }
+func (m *GetInfoResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*GetInfoResponse) ProtoMessage()    {}
+
+// FilesystemInfo is the capabilities of a filesystem.
+type FilesystemInfo struct {
+	MediaTypes   []string `protobuf:"bytes,1,rep,name=media_types,json=mediaTypes,proto3" json:"media_types,omitempty"`
+	Verification bool     `protobuf:"varint,2,opt,name=verification,proto3" json:"verification,omitempty"`
+	Offline      bool     `protobuf:"varint,3,opt,name=offline,proto3" json:"offline,omitempty"`
+	Features     []string `protobuf:"bytes,4,rep,name=features,proto3" json:"features,omitempty"`
+	Compressions []string `protobuf:"bytes,5,rep,name=compressions,proto3" json:"compressions,omitempty"`
+}
+
+func (m *FilesystemInfo) Reset()         { *m = FilesystemInfo{} }
+func (m *FilesystemInfo) String() string { return fmt.Sprintf("%+v", *m) }
+func (*FilesystemInfo) ProtoMessage()    {}
+
+// AdminServer is the server API of Admin service.
+type AdminServer interface {
+	// WatchProgress streams the fetch progress of the layers of an image
+	// periodically until all layers are fully fetched.
+	WatchProgress(*WatchProgressRequest, Admin_WatchProgressServer) error
+
+	// ExportState exports the metadata (not the contents) of remote snapshots.
+	ExportState(context.Context, *ExportStateRequest) (*ExportStateResponse, error)
+
+	// ImportState imports the metadata exported by ExportState. The layers are
+	// resolved and mounted again.
+	ImportState(context.Context, *ImportStateRequest) (*ImportStateResponse, error)
+
+	// DumpDiagnostics dumps what the snapshotter is doing right now to the log
+	// of the snapshotter and returns it.
+	DumpDiagnostics(context.Context, *DumpDiagnosticsRequest) (*DumpDiagnosticsResponse, error)
+
+	// ListLayers lists the layers mounted as remote snapshots with their
+	// fetch progress.
+	ListLayers(context.Context, *ListLayersRequest) (*ListLayersResponse, error)
+
+	// RefreshLayer re-resolves the layer of a remote snapshot even if the
+	// current connection is alive.
+	RefreshLayer(context.Context, *RefreshLayerRequest) (*RefreshLayerResponse, error)
+
+	// Reauthenticate makes all layers re-establish their connections to
+	// registries with fresh credentials on their next fetch.
+	Reauthenticate(context.Context, *ReauthenticateRequest) (*ReauthenticateResponse, error)
+
+	// EvictCaches evicts the resolved layers which aren't mounted from the
+	// caches.
+	EvictCaches(context.Context, *EvictCachesRequest) (*EvictCachesResponse, error)
+
+	// SetBackgroundFetch pauses or resumes background fetch of layers and
+	// limits its bandwidth.
+	SetBackgroundFetch(context.Context, *SetBackgroundFetchRequest) (*BackgroundFetchResponse, error)
+
+	// GetBackgroundFetch returns the state of background fetch of layers.
+	GetBackgroundFetch(context.Context, *GetBackgroundFetchRequest) (*BackgroundFetchResponse, error)
+
+	// GetInfo returns the build information and the capabilities of the
+	// snapshotter.
+	GetInfo(context.Context, *GetInfoRequest) (*GetInfoResponse, error)
+}
+
+// Admin_WatchProgressServer is the server stream of WatchProgress.
+type Admin_WatchProgressServer interface {
+	Send(*Progress) error
+	grpc.ServerStream
+}
+
+// RegisterAdminServer registers the Admin service to the gRPC server.
+func RegisterAdminServer(s *grpc.Server, srv AdminServer) {
+	s.RegisterService(&adminServiceDesc, srv)
+}
+
+var adminServiceDesc = grpc.ServiceDesc{
+	ServiceName: "stargz.admin.v1.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ExportState",
+			Handler:    exportStateHandler,
+		},
+		{
+			MethodName: "ImportState",
+			Handler:    importStateHandler,
+		},
+		{
+			MethodName: "DumpDiagnostics",
+			Handler:    dumpDiagnosticsHandler,
+		},
+		{
+			MethodName: "ListLayers",
+			Handler:    listLayersHandler,
+		},
+		{
+			MethodName: "RefreshLayer",
+			Handler:    refreshLayerHandler,
+		},
+		{
+			MethodName: "Reauthenticate",
+			Handler:    reauthenticateHandler,
+		},
+		{
+			MethodName: "EvictCaches",
+			Handler:    evictCachesHandler,
+		},
+		{
+			MethodName: "SetBackgroundFetch",
+			Handler:    setBackgroundFetchHandler,
+		},
+		{
+			MethodName: "GetBackgroundFetch",
+			Handler:    getBackgroundFetchHandler,
+		},
+		{
+			MethodName: "GetInfo",
+			Handler:    getInfoHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchProgress",
+			Handler:       watchProgressHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "admin.proto",
+}
+
+func exportStateHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ExportStateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ExportState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.admin.v1.Admin/ExportState",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ExportState(ctx, req.(*ExportStateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func importStateHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ImportStateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ImportState(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.admin.v1.Admin/ImportState",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ImportState(ctx, req.(*ImportStateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func dumpDiagnosticsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DumpDiagnosticsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).DumpDiagnostics(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.admin.v1.Admin/DumpDiagnostics",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).DumpDiagnostics(ctx, req.(*DumpDiagnosticsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func listLayersHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListLayersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ListLayers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.admin.v1.Admin/ListLayers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ListLayers(ctx, req.(*ListLayersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func refreshLayerHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RefreshLayerRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).RefreshLayer(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.admin.v1.Admin/RefreshLayer",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).RefreshLayer(ctx, req.(*RefreshLayerRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func reauthenticateHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReauthenticateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).Reauthenticate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.admin.v1.Admin/Reauthenticate",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).Reauthenticate(ctx, req.(*ReauthenticateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func evictCachesHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EvictCachesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).EvictCaches(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.admin.v1.Admin/EvictCaches",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).EvictCaches(ctx, req.(*EvictCachesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func setBackgroundFetchHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetBackgroundFetchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).SetBackgroundFetch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.admin.v1.Admin/SetBackgroundFetch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).SetBackgroundFetch(ctx, req.(*SetBackgroundFetchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func getBackgroundFetchHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBackgroundFetchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetBackgroundFetch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.admin.v1.Admin/GetBackgroundFetch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetBackgroundFetch(ctx, req.(*GetBackgroundFetchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func getInfoHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetInfoRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetInfo(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.admin.v1.Admin/GetInfo",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetInfo(ctx, req.(*GetInfoRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func watchProgressHandler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchProgressRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AdminServer).WatchProgress(m, &watchProgressServer{stream})
+}
+
+type watchProgressServer struct {
+	grpc.ServerStream
+}
+
+func (x *watchProgressServer) Send(m *Progress) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// AdminClient is the client API of Admin service.
+type AdminClient interface {
+	// WatchProgress streams the fetch progress of the layers of an image
+	// periodically until all layers are fully fetched.
+	WatchProgress(ctx context.Context, in *WatchProgressRequest, opts ...grpc.CallOption) (Admin_WatchProgressClient, error)
+
+	// ExportState exports the metadata (not the contents) of remote snapshots.
+	ExportState(ctx context.Context, in *ExportStateRequest, opts ...grpc.CallOption) (*ExportStateResponse, error)
+
+	// ImportState imports the metadata exported by ExportState. The layers are
+	// resolved and mounted again.
+	ImportState(ctx context.Context, in *ImportStateRequest, opts ...grpc.CallOption) (*ImportStateResponse, error)
+
+	// DumpDiagnostics dumps what the snapshotter is doing right now to the log
+	// of the snapshotter and returns it.
+	DumpDiagnostics(ctx context.Context, in *DumpDiagnosticsRequest, opts ...grpc.CallOption) (*DumpDiagnosticsResponse, error)
+
+	// ListLayers lists the layers mounted as remote snapshots with their
+	// fetch progress.
+	ListLayers(ctx context.Context, in *ListLayersRequest, opts ...grpc.CallOption) (*ListLayersResponse, error)
+
+	// RefreshLayer re-resolves the layer of a remote snapshot even if the
+	// current connection is alive.
+	RefreshLayer(ctx context.Context, in *RefreshLayerRequest, opts ...grpc.CallOption) (*RefreshLayerResponse, error)
+
+	// Reauthenticate makes all layers re-establish their connections to
+	// registries with fresh credentials on their next fetch.
+	Reauthenticate(ctx context.Context, in *ReauthenticateRequest, opts ...grpc.CallOption) (*ReauthenticateResponse, error)
+
+	// EvictCaches evicts the resolved layers which aren't mounted from the
+	// caches.
+	EvictCaches(ctx context.Context, in *EvictCachesRequest, opts ...grpc.CallOption) (*EvictCachesResponse, error)
+
+	// SetBackgroundFetch pauses or resumes background fetch of layers and
+	// limits its bandwidth.
+	SetBackgroundFetch(ctx context.Context, in *SetBackgroundFetchRequest, opts ...grpc.CallOption) (*BackgroundFetchResponse, error)
+
+	// GetBackgroundFetch returns the state of background fetch of layers.
+	GetBackgroundFetch(ctx context.Context, in *GetBackgroundFetchRequest, opts ...grpc.CallOption) (*BackgroundFetchResponse, error)
+
+	// GetInfo returns the build information and the capabilities of the
+	// snapshotter.
+	GetInfo(ctx context.Context, in *GetInfoRequest, opts ...grpc.CallOption) (*GetInfoResponse, error)
+}
+
+// Admin_WatchProgressClient is the client stream of WatchProgress.
+type Admin_WatchProgressClient interface {
+	Recv() (*Progress, error)
+	grpc.ClientStream
+}
+
+// NewAdminClient returns the client of Admin service.
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func (c *adminClient) WatchProgress(ctx context.Context, in *WatchProgressRequest, opts ...grpc.CallOption) (Admin_WatchProgressClient, error) {
+	stream, err := c.cc.NewStream(ctx, &adminServiceDesc.Streams[0], "/stargz.admin.v1.Admin/WatchProgress", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &watchProgressClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (c *adminClient) ExportState(ctx context.Context, in *ExportStateRequest, opts ...grpc.CallOption) (*ExportStateResponse, error) {
+	out := new(ExportStateResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.admin.v1.Admin/ExportState", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ImportState(ctx context.Context, in *ImportStateRequest, opts ...grpc.CallOption) (*ImportStateResponse, error) {
+	out := new(ImportStateResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.admin.v1.Admin/ImportState", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) DumpDiagnostics(ctx context.Context, in *DumpDiagnosticsRequest, opts ...grpc.CallOption) (*DumpDiagnosticsResponse, error) {
+	out := new(DumpDiagnosticsResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.admin.v1.Admin/DumpDiagnostics", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ListLayers(ctx context.Context, in *ListLayersRequest, opts ...grpc.CallOption) (*ListLayersResponse, error) {
+	out := new(ListLayersResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.admin.v1.Admin/ListLayers", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) RefreshLayer(ctx context.Context, in *RefreshLayerRequest, opts ...grpc.CallOption) (*RefreshLayerResponse, error) {
+	out := new(RefreshLayerResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.admin.v1.Admin/RefreshLayer", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) Reauthenticate(ctx context.Context, in *ReauthenticateRequest, opts ...grpc.CallOption) (*ReauthenticateResponse, error) {
+	out := new(ReauthenticateResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.admin.v1.Admin/Reauthenticate", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) EvictCaches(ctx context.Context, in *EvictCachesRequest, opts ...grpc.CallOption) (*EvictCachesResponse, error) {
+	out := new(EvictCachesResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.admin.v1.Admin/EvictCaches", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) SetBackgroundFetch(ctx context.Context, in *SetBackgroundFetchRequest, opts ...grpc.CallOption) (*BackgroundFetchResponse, error) {
+	out := new(BackgroundFetchResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.admin.v1.Admin/SetBackgroundFetch", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetBackgroundFetch(ctx context.Context, in *GetBackgroundFetchRequest, opts ...grpc.CallOption) (*BackgroundFetchResponse, error) {
+	out := new(BackgroundFetchResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.admin.v1.Admin/GetBackgroundFetch", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetInfo(ctx context.Context, in *GetInfoRequest, opts ...grpc.CallOption) (*GetInfoResponse, error) {
+	out := new(GetInfoResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.admin.v1.Admin/GetInfo", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+type watchProgressClient struct {
+	grpc.ClientStream
+}
+
+func (x *watchProgressClient) Recv() (*Progress, error) {
+	m := new(Progress)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,295 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/stargz-snapshotter/service"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultWatchInterval = time.Second
+
+	// stateVersion is the version of the format of the exported state.
+	stateVersion = 1
+)
+
+// state is the format of the state exported by ExportState.
+type state struct {
+	Version   int                          `json:"version"`
+	Snapshots []snbase.RemoteSnapshotState `json:"snapshots"`
+}
+
+// NewServer returns the server of Admin service operating the snapshotter.
+func NewServer(sn snapshots.Snapshotter) AdminServer {
+	return &server{sn}
+}
+
+type server struct {
+	sn snapshots.Snapshotter
+}
+
+// WatchProgress streams the fetch progress of the image. The progress is
+// sent periodically until all layers of the image are fully fetched or the
+// client cancels the stream. The image may have no layer at the beginning
+// (e.g. the image is being pulled) and layers appear as they are mounted.
+func (s *server) WatchProgress(req *WatchProgressRequest, stream Admin_WatchProgressServer) error {
+	if req.Ref == "" {
+		return status.Errorf(codes.InvalidArgument, "image reference must be specified")
+	}
+	interval := defaultWatchInterval
+	if req.IntervalMsec > 0 {
+		interval = time.Duration(req.IntervalMsec) * time.Millisecond
+	}
+	ctx := stream.Context()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		p, err := s.progress(ctx, req.Ref)
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to get progress of %q: %v", req.Ref, err)
+		}
+		if err := stream.Send(p); err != nil {
+			return err
+		}
+		if len(p.Layers) > 0 && p.FetchedSize >= p.Size {
+			return nil // fully fetched
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+}
+
+func (s *server) progress(ctx context.Context, ref string) (*Progress, error) {
+	images, err := service.ImageLocalities(ctx, s.sn)
+	if err != nil {
+		return nil, err
+	}
+	p := &Progress{Ref: ref}
+	for _, img := range images {
+		if img.Ref != ref {
+			continue
+		}
+		p.Size, p.FetchedSize, p.FetchedPercent = img.Size, img.FetchedSize, img.Percentage
+		for _, l := range img.Layers {
+			p.Layers = append(p.Layers, &LayerProgress{
+				Digest:         l.Digest,
+				Size:           l.Size,
+				FetchedSize:    l.FetchedSize,
+				FetchedPercent: l.Percentage,
+				Degraded:       l.Degraded,
+			})
+		}
+	}
+	return p, nil
+}
+
+// ExportState exports the metadata of remote snapshots as JSON. See also
+// snapshot.StateExporter.
+func (s *server) ExportState(ctx context.Context, req *ExportStateRequest) (*ExportStateResponse, error) {
+	e, ok := s.sn.(snbase.StateExporter)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "snapshotter doesn't support exporting state")
+	}
+	states, err := e.ExportRemoteSnapshots(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to export state: %v", err)
+	}
+	data, err := json.Marshal(state{Version: stateVersion, Snapshots: states})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to encode state: %v", err)
+	}
+	return &ExportStateResponse{State: data}, nil
+}
+
+// ImportState imports the metadata of remote snapshots exported by ExportState.
+func (s *server) ImportState(ctx context.Context, req *ImportStateRequest) (*ImportStateResponse, error) {
+	e, ok := s.sn.(snbase.StateExporter)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "snapshotter doesn't support importing state")
+	}
+	var st state
+	if err := json.Unmarshal(req.State, &st); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "failed to decode state: %v", err)
+	}
+	if st.Version != stateVersion {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported state version %d", st.Version)
+	}
+	imported, err := e.ImportRemoteSnapshots(ctx, st.Snapshots)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to import state (imported %d snapshots): %v", len(imported), err)
+	}
+	return &ImportStateResponse{Imported: imported}, nil
+}
+
+// DumpDiagnostics dumps what the snapshotter is doing right now to the log and
+// returns it as JSON. See also service.LogDiagnostics.
+func (s *server) DumpDiagnostics(ctx context.Context, req *DumpDiagnosticsRequest) (*DumpDiagnosticsResponse, error) {
+	d, err := service.LogDiagnostics(ctx, s.sn)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to dump diagnostics: %v", err)
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to encode diagnostics: %v", err)
+	}
+	return &DumpDiagnosticsResponse{Diagnostics: data}, nil
+}
+
+// ListLayers lists the layers mounted as remote snapshots with their fetch
+// progress. See also snapshot.RemoteStatsWalker.
+func (s *server) ListLayers(ctx context.Context, req *ListLayersRequest) (*ListLayersResponse, error) {
+	if _, ok := s.sn.(snbase.RemoteStatsWalker); !ok {
+		return nil, status.Errorf(codes.Unimplemented, "snapshotter doesn't support listing layers")
+	}
+	mounts, err := service.RemoteMounts(ctx, s.sn)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list layers: %v", err)
+	}
+	resp := &ListLayersResponse{}
+	for _, m := range mounts {
+		resp.Layers = append(resp.Layers, &Layer{
+			Key:            m.Key,
+			Ref:            m.Ref,
+			Digest:         m.Digest,
+			Size:           m.Size,
+			FetchedSize:    m.FetchedSize,
+			FetchedPercent: m.Percentage,
+			Degraded:       m.Degraded,
+		})
+	}
+	return resp, nil
+}
+
+// RefreshLayer re-resolves the layer of the remote snapshot. See also
+// snapshot.RemoteSnapshotRefresher.
+func (s *server) RefreshLayer(ctx context.Context, req *RefreshLayerRequest) (*RefreshLayerResponse, error) {
+	if req.Key == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "snapshot key must be specified")
+	}
+	r, ok := s.sn.(snbase.RemoteSnapshotRefresher)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "snapshotter doesn't support refreshing layers")
+	}
+	if err := r.RefreshRemoteSnapshot(ctx, req.Key); err != nil {
+		return nil, errdefs.ToGRPCf(err, "failed to refresh layer of %q", req.Key)
+	}
+	return &RefreshLayerResponse{}, nil
+}
+
+// Reauthenticate makes all layers re-establish their connections to registries
+// on their next fetch. Credentials are got from the sources again then.
+func (s *server) Reauthenticate(ctx context.Context, req *ReauthenticateRequest) (*ReauthenticateResponse, error) {
+	r, ok := s.sn.(snbase.RemoteSnapshotRefresher)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "snapshotter doesn't support re-authentication")
+	}
+	r.InvalidateTransports(ctx)
+	return &ReauthenticateResponse{}, nil
+}
+
+// EvictCaches evicts the resolved layers which aren't mounted from the caches
+// of the filesystems. See also snapshot.CacheEvictor.
+func (s *server) EvictCaches(ctx context.Context, req *EvictCachesRequest) (*EvictCachesResponse, error) {
+	e, ok := s.sn.(snbase.CacheEvictor)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "snapshotter doesn't support evicting caches")
+	}
+	resp := &EvictCachesResponse{}
+	for _, st := range e.EvictCaches(ctx) {
+		resp.Evicted = append(resp.Evicted, &EvictedCaches{
+			Filesystem: st.FileSystem,
+			Layers:     int64(st.Layers),
+			Blobs:      int64(st.Blobs),
+		})
+	}
+	return resp, nil
+}
+
+// SetBackgroundFetch pauses or resumes background fetch of all filesystems and
+// limits its bandwidth. See also snapshot.BackgroundFetchController.
+func (s *server) SetBackgroundFetch(ctx context.Context, req *SetBackgroundFetchRequest) (*BackgroundFetchResponse, error) {
+	c, ok := s.sn.(snbase.BackgroundFetchController)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "snapshotter doesn't support controlling background fetch")
+	}
+	if req.Bandwidth < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "bandwidth must not be negative")
+	}
+	c.SetBackgroundFetch(ctx, snbase.BackgroundFetchConfig{
+		Paused:    req.Paused,
+		Bandwidth: req.Bandwidth,
+	})
+	return backgroundFetchResponse(c.BackgroundFetch(ctx)), nil
+}
+
+// GetBackgroundFetch returns the state of background fetch of all filesystems.
+func (s *server) GetBackgroundFetch(ctx context.Context, req *GetBackgroundFetchRequest) (*BackgroundFetchResponse, error) {
+	c, ok := s.sn.(snbase.BackgroundFetchController)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "snapshotter doesn't support controlling background fetch")
+	}
+	return backgroundFetchResponse(c.BackgroundFetch(ctx)), nil
+}
+
+func backgroundFetchResponse(states map[string]snbase.BackgroundFetchConfig) *BackgroundFetchResponse {
+	resp := &BackgroundFetchResponse{}
+	for id, st := range states {
+		resp.States = append(resp.States, &BackgroundFetchState{
+			Filesystem: id,
+			Paused:     st.Paused,
+			Bandwidth:  st.Bandwidth,
+		})
+	}
+	sort.Slice(resp.States, func(i, j int) bool {
+		return resp.States[i].Filesystem < resp.States[j].Filesystem
+	})
+	return resp
+}
+
+// GetInfo returns the build information and the capabilities of the
+// snapshotter. See also service.GetInfo.
+func (s *server) GetInfo(ctx context.Context, req *GetInfoRequest) (*GetInfoResponse, error) {
+	info := service.GetInfo(ctx, s.sn)
+	resp := &GetInfoResponse{
+		Version:      info.Version,
+		Revision:     info.Revision,
+		Compressions: info.Compressions,
+	}
+	for _, f := range info.FileSystems {
+		resp.Filesystems = append(resp.Filesystems, &FilesystemInfo{
+			MediaTypes:   f.MediaTypes,
+			Verification: f.Verification,
+			Offline:      f.Offline,
+			Features:     f.Features,
+			Compressions: f.Compressions,
+		})
+	}
+	return resp, nil
+}
@@ -0,0 +1,467 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/stargz-snapshotter/service"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+	"github.com/containerd/stargz-snapshotter/version"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	testRef       = "registry.test/library/test:latest"
+	refLabel      = "containerd.io/snapshot/remote/stargz.reference"
+	digestLabel   = "containerd.io/snapshot/remote/stargz.digest"
+	testLayerKey  = "layer"
+	testLayerDgst = "sha256:0000000000000000000000000000000000000000000000000000000000000000"
+)
+
+func TestServer(t *testing.T) {
+	validState, err := json.Marshal(state{Version: stateVersion, Snapshots: []snbase.RemoteSnapshotState{{Name: "a"}, {Name: "b", Parent: "a"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		sn       snapshots.Snapshotter
+		call     func(ctx context.Context, s AdminServer) (interface{}, error)
+		wantCode codes.Code
+		want     interface{}
+		check    func(t *testing.T, sn snapshots.Snapshotter, resp interface{})
+	}{
+		{
+			name: "ExportState",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.ExportState(ctx, &ExportStateRequest{})
+			},
+			want: &ExportStateResponse{State: []byte(`{"version":1,"snapshots":[{"name":"a"}]}`)},
+		},
+		{
+			name: "ExportState unimplemented",
+			sn:   &plainSnapshotter{},
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.ExportState(ctx, &ExportStateRequest{})
+			},
+			wantCode: codes.Unimplemented,
+		},
+		{
+			name: "ImportState",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.ImportState(ctx, &ImportStateRequest{State: validState})
+			},
+			want: &ImportStateResponse{Imported: []string{"a", "b"}},
+		},
+		{
+			name: "ImportState invalid state",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.ImportState(ctx, &ImportStateRequest{State: []byte("invalid")})
+			},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "ImportState unsupported version",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.ImportState(ctx, &ImportStateRequest{State: []byte(`{"version":2}`)})
+			},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "ImportState unimplemented",
+			sn:   &plainSnapshotter{},
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.ImportState(ctx, &ImportStateRequest{State: validState})
+			},
+			wantCode: codes.Unimplemented,
+		},
+		{
+			name: "DumpDiagnostics",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.DumpDiagnostics(ctx, &DumpDiagnosticsRequest{})
+			},
+			check: func(t *testing.T, sn snapshots.Snapshotter, resp interface{}) {
+				var d service.Diagnostics
+				if err := json.Unmarshal(resp.(*DumpDiagnosticsResponse).Diagnostics, &d); err != nil {
+					t.Fatalf("failed to decode diagnostics: %v", err)
+				}
+				if len(d.Mounts) != 1 || d.Mounts[0].Key != testLayerKey || d.Goroutines == "" {
+					t.Errorf("unexpected diagnostics: mounts=%+v, goroutines=%d bytes", d.Mounts, len(d.Goroutines))
+				}
+			},
+		},
+		{
+			name: "ListLayers",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.ListLayers(ctx, &ListLayersRequest{})
+			},
+			want: &ListLayersResponse{Layers: []*Layer{{
+				Key:            testLayerKey,
+				Ref:            testRef,
+				Digest:         testLayerDgst,
+				Size:           100,
+				FetchedSize:    25,
+				FetchedPercent: 25,
+				Degraded:       []string{"prefetch failed"},
+			}}},
+		},
+		{
+			name: "ListLayers unimplemented",
+			sn:   &plainSnapshotter{},
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.ListLayers(ctx, &ListLayersRequest{})
+			},
+			wantCode: codes.Unimplemented,
+		},
+		{
+			name: "RefreshLayer",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.RefreshLayer(ctx, &RefreshLayerRequest{Key: testLayerKey})
+			},
+			want: &RefreshLayerResponse{},
+			check: func(t *testing.T, sn snapshots.Snapshotter, resp interface{}) {
+				if r := sn.(*fakeSnapshotter).refreshed; !reflect.DeepEqual(r, []string{testLayerKey}) {
+					t.Errorf("refreshed %v; want %q", r, testLayerKey)
+				}
+			},
+		},
+		{
+			name: "RefreshLayer without key",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.RefreshLayer(ctx, &RefreshLayerRequest{})
+			},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "RefreshLayer not found",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.RefreshLayer(ctx, &RefreshLayerRequest{Key: "unknown"})
+			},
+			wantCode: codes.NotFound,
+		},
+		{
+			name: "RefreshLayer unimplemented",
+			sn:   &plainSnapshotter{},
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.RefreshLayer(ctx, &RefreshLayerRequest{Key: testLayerKey})
+			},
+			wantCode: codes.Unimplemented,
+		},
+		{
+			name: "Reauthenticate",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.Reauthenticate(ctx, &ReauthenticateRequest{})
+			},
+			want: &ReauthenticateResponse{},
+			check: func(t *testing.T, sn snapshots.Snapshotter, resp interface{}) {
+				if n := sn.(*fakeSnapshotter).invalidated; n != 1 {
+					t.Errorf("transports are invalidated %d times; want 1", n)
+				}
+			},
+		},
+		{
+			name: "Reauthenticate unimplemented",
+			sn:   &plainSnapshotter{},
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.Reauthenticate(ctx, &ReauthenticateRequest{})
+			},
+			wantCode: codes.Unimplemented,
+		},
+		{
+			name: "EvictCaches",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.EvictCaches(ctx, &EvictCachesRequest{})
+			},
+			want: &EvictCachesResponse{Evicted: []*EvictedCaches{{Filesystem: "stargz", Layers: 2, Blobs: 3}}},
+		},
+		{
+			name: "EvictCaches unimplemented",
+			sn:   &plainSnapshotter{},
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.EvictCaches(ctx, &EvictCachesRequest{})
+			},
+			wantCode: codes.Unimplemented,
+		},
+		{
+			name: "SetBackgroundFetch",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.SetBackgroundFetch(ctx, &SetBackgroundFetchRequest{Paused: true, Bandwidth: 1024})
+			},
+			want: &BackgroundFetchResponse{States: []*BackgroundFetchState{
+				{Filesystem: "ipfs", Paused: true, Bandwidth: 1024},
+				{Filesystem: "stargz", Paused: true, Bandwidth: 1024},
+			}},
+		},
+		{
+			name: "SetBackgroundFetch negative bandwidth",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.SetBackgroundFetch(ctx, &SetBackgroundFetchRequest{Bandwidth: -1})
+			},
+			wantCode: codes.InvalidArgument,
+			check: func(t *testing.T, sn snapshots.Snapshotter, resp interface{}) {
+				if st := sn.(*fakeSnapshotter).bgFetch["stargz"]; st != (snbase.BackgroundFetchConfig{}) {
+					t.Errorf("invalid request is applied: %+v", st)
+				}
+			},
+		},
+		{
+			name: "SetBackgroundFetch unimplemented",
+			sn:   &plainSnapshotter{},
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.SetBackgroundFetch(ctx, &SetBackgroundFetchRequest{Paused: true})
+			},
+			wantCode: codes.Unimplemented,
+		},
+		{
+			name: "GetBackgroundFetch",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.GetBackgroundFetch(ctx, &GetBackgroundFetchRequest{})
+			},
+			want: &BackgroundFetchResponse{States: []*BackgroundFetchState{
+				{Filesystem: "ipfs"},
+				{Filesystem: "stargz"},
+			}},
+		},
+		{
+			name: "GetInfo",
+			sn:   newFakeSnapshotter(),
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.GetInfo(ctx, &GetInfoRequest{})
+			},
+			want: &GetInfoResponse{
+				Version:  version.Version,
+				Revision: version.Revision,
+				Filesystems: []*FilesystemInfo{
+					{MediaTypes: []string{"application/vnd.oci.image.layer.v1.tar+gzip"}, Verification: true, Features: []string{"prefetch"}, Compressions: []string{"gzip"}},
+					{Offline: true, Compressions: []string{"gzip", "zstd"}},
+				},
+				Compressions: []string{"gzip", "zstd"},
+			},
+		},
+		{
+			name: "GetInfo without capabilities",
+			sn:   &plainSnapshotter{},
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.GetInfo(ctx, &GetInfoRequest{})
+			},
+			want: &GetInfoResponse{Version: version.Version, Revision: version.Revision, Compressions: []string{}},
+		},
+		{
+			name: "GetBackgroundFetch unimplemented",
+			sn:   &plainSnapshotter{},
+			call: func(ctx context.Context, s AdminServer) (interface{}, error) {
+				return s.GetBackgroundFetch(ctx, &GetBackgroundFetchRequest{})
+			},
+			wantCode: codes.Unimplemented,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := tt.call(context.Background(), NewServer(tt.sn))
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("code = %v (%v); want %v", code, err, tt.wantCode)
+			}
+			if tt.want != nil && !reflect.DeepEqual(resp, tt.want) {
+				t.Errorf("response = %+v; want %+v", resp, tt.want)
+			}
+			if tt.check != nil {
+				tt.check(t, tt.sn, resp)
+			}
+		})
+	}
+}
+
+func TestWatchProgress(t *testing.T) {
+	tests := []struct {
+		name      string
+		req       *WatchProgressRequest
+		sn        snapshots.Snapshotter
+		cancel    bool
+		wantCode  codes.Code
+		wantSends int
+	}{
+		{
+			name:      "fully fetched",
+			req:       &WatchProgressRequest{Ref: testRef},
+			sn:        &fakeSnapshotter{stats: snbase.Stats{Size: 100, FetchedSize: 100}},
+			wantSends: 1,
+		},
+		{
+			name:      "canceled",
+			req:       &WatchProgressRequest{Ref: testRef, IntervalMsec: 1},
+			sn:        newFakeSnapshotter(),
+			cancel:    true,
+			wantCode:  codes.Canceled,
+			wantSends: 1,
+		},
+		{
+			name:     "without reference",
+			req:      &WatchProgressRequest{},
+			sn:       newFakeSnapshotter(),
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name:     "unsupported",
+			req:      &WatchProgressRequest{Ref: testRef},
+			sn:       &plainSnapshotter{},
+			wantCode: codes.Internal,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stream := &fakeProgressStream{ctx: ctx}
+			if tt.cancel {
+				stream.onSend = cancel
+			}
+			err := NewServer(tt.sn).WatchProgress(tt.req, stream)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("code = %v (%v); want %v", code, err, tt.wantCode)
+			}
+			if len(stream.sent) != tt.wantSends {
+				t.Fatalf("sent %d progresses; want %d", len(stream.sent), tt.wantSends)
+			}
+			for _, p := range stream.sent {
+				if p.Ref != testRef || len(p.Layers) != 1 || p.Layers[0].Digest != testLayerDgst {
+					t.Errorf("unexpected progress %+v", p)
+				}
+			}
+		})
+	}
+}
+
+// plainSnapshotter is a snapshotter which doesn't support any admin operation.
+type plainSnapshotter struct {
+	snapshots.Snapshotter
+}
+
+// fakeSnapshotter is a snapshotter with a remote snapshot of a layer.
+type fakeSnapshotter struct {
+	snapshots.Snapshotter
+	stats       snbase.Stats
+	refreshed   []string
+	invalidated int
+	bgFetch     map[string]snbase.BackgroundFetchConfig
+}
+
+func newFakeSnapshotter() *fakeSnapshotter {
+	return &fakeSnapshotter{
+		stats: snbase.Stats{Size: 100, FetchedSize: 25, Degraded: []string{"prefetch failed"}},
+		bgFetch: map[string]snbase.BackgroundFetchConfig{
+			"stargz": {},
+			"ipfs":   {},
+		},
+	}
+}
+
+func (sn *fakeSnapshotter) WalkRemoteStats(ctx context.Context, fn func(ctx context.Context, info snapshots.Info, st snbase.Stats) error) error {
+	return fn(ctx, snapshots.Info{
+		Name:   testLayerKey,
+		Kind:   snapshots.KindCommitted,
+		Labels: map[string]string{refLabel: testRef, digestLabel: testLayerDgst},
+	}, sn.stats)
+}
+
+func (sn *fakeSnapshotter) Capabilities(ctx context.Context) []snbase.Capabilities {
+	return []snbase.Capabilities{
+		{Name: "stargz", MediaTypes: []string{"application/vnd.oci.image.layer.v1.tar+gzip"}, Verification: true, Features: []string{"prefetch"}, Compressions: []string{"gzip"}},
+		{Name: "ipfs", Offline: true, Compressions: []string{"gzip", "zstd"}},
+	}
+}
+
+func (sn *fakeSnapshotter) ExportRemoteSnapshots(ctx context.Context) ([]snbase.RemoteSnapshotState, error) {
+	return []snbase.RemoteSnapshotState{{Name: "a"}}, nil
+}
+
+func (sn *fakeSnapshotter) ImportRemoteSnapshots(ctx context.Context, states []snbase.RemoteSnapshotState) (imported []string, _ error) {
+	for _, st := range states {
+		imported = append(imported, st.Name)
+	}
+	return imported, nil
+}
+
+func (sn *fakeSnapshotter) RefreshRemoteSnapshot(ctx context.Context, key string) error {
+	if key != testLayerKey {
+		return errors.Wrapf(errdefs.ErrNotFound, "snapshot %q", key)
+	}
+	sn.refreshed = append(sn.refreshed, key)
+	return nil
+}
+
+func (sn *fakeSnapshotter) InvalidateTransports(ctx context.Context) {
+	sn.invalidated++
+}
+
+func (sn *fakeSnapshotter) EvictCaches(ctx context.Context) []snbase.CacheStats {
+	return []snbase.CacheStats{{FileSystem: "stargz", Layers: 2, Blobs: 3}}
+}
+
+func (sn *fakeSnapshotter) SetBackgroundFetch(ctx context.Context, cfg snbase.BackgroundFetchConfig) {
+	for id := range sn.bgFetch {
+		sn.bgFetch[id] = cfg
+	}
+}
+
+func (sn *fakeSnapshotter) BackgroundFetch(ctx context.Context) map[string]snbase.BackgroundFetchConfig {
+	states := make(map[string]snbase.BackgroundFetchConfig, len(sn.bgFetch))
+	for id, st := range sn.bgFetch {
+		states[id] = st
+	}
+	return states
+}
+
+// fakeProgressStream records the progresses sent by WatchProgress.
+type fakeProgressStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	sent   []*Progress
+	onSend func()
+}
+
+func (s *fakeProgressStream) Context() context.Context { return s.ctx }
+
+func (s *fakeProgressStream) Send(p *Progress) error {
+	s.sent = append(s.sent, p)
+	if s.onSend != nil {
+		s.onSend()
+	}
+	return nil
+}
@@ -17,7 +17,9 @@
 package service
 
 import (
+	"github.com/containerd/stargz-snapshotter/filesystems/s3"
 	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/ipfs"
 	"github.com/containerd/stargz-snapshotter/service/resolver"
 )
 
@@ -30,8 +32,117 @@ type Config struct {
 	// CRIKeychainConfig is config for CRI-based keychain.
 	CRIKeychainConfig `toml:"cri_keychain"`
 
+	// LabelKeychainConfig is config for the keychain of the credentials passed
+	// through the snapshot labels.
+	LabelKeychainConfig `toml:"label_keychain"`
+
+	// CredentialSources is the ordered list of the sources of registry
+	// credentials. Sources are consulted in this order and the first
+	// credentials found are used. If empty, docker config is consulted first,
+	// then the kubeconfig-based and the CRI-based keychains if enabled.
+	CredentialSources []CredentialSourceConfig `toml:"credential_source"`
+
 	// ResolverConfig is config for resolving registries.
 	ResolverConfig `toml:"resolver"`
+
+	// SnapshotterConfig is config for the snapshotter.
+	SnapshotterConfig `toml:"snapshotter"`
+
+	// S3Config is config for mounting layers from S3-compatible object storages.
+	S3Config `toml:"s3"`
+
+	// IPFSConfig is config for mounting layers distributed over IPFS.
+	IPFSConfig `toml:"ipfs"`
+
+	// FuseManagerConfig is config for the fuse manager.
+	FuseManagerConfig `toml:"fuse_manager"`
+}
+
+// FuseManagerConfig is config for the fuse manager.
+type FuseManagerConfig struct {
+	// Enable makes the fuse manager process serve the FUSE mounts of the stargz
+	// filesystem so that they survive restarts (e.g. upgrades) of the snapshotter.
+	Enable bool `toml:"enable"`
+
+	// Path is the path to the fuse manager binary (default: "stargz-fuse-manager"
+	// in PATH).
+	Path string `toml:"path"`
+
+	// Address is the path to the unix socket of the fuse manager
+	// (default: <root>/fuse-manager.sock).
+	Address string `toml:"address"`
+
+	// LogPath is the file where the output of the fuse manager started by the
+	// snapshotter is appended (default: <root>/fuse-manager.log).
+	LogPath string `toml:"log_path"`
+}
+
+// SnapshotterConfig is config for the snapshotter.
+type SnapshotterConfig struct {
+	// RetryRemotePrepareIntervalSec is the interval of retrying the preparation of
+	// remote snapshots which failed to be prepared. Zero disables the retry.
+	RetryRemotePrepareIntervalSec int64 `toml:"retry_remote_prepare_interval_sec"`
+
+	// RetryRemotePrepareMaxAttempts is the maximum number of retries of each remote
+	// snapshot (default: 5).
+	RetryRemotePrepareMaxAttempts int `toml:"retry_remote_prepare_max_attempts"`
+
+	// AsyncUsage makes Commit skip the disk usage calculation and calculates it
+	// in background instead.
+	AsyncUsage bool `toml:"async_usage"`
+
+	// CleanupWorkers is the maximum number of snapshot directories removed in
+	// parallel during Cleanup (default: 4).
+	CleanupWorkers int `toml:"cleanup_workers"`
+
+	// Durability is the trade-off between crash-safety and throughput of
+	// Prepare, Commit and Remove. "sync" also syncs renames of snapshot
+	// directories and "nosync" doesn't sync the metadata on each transaction.
+	// Empty syncs only the metadata.
+	Durability string `toml:"durability"`
+
+	// FullyCachedHook is the path to the command executed when all contents of a
+	// remote snapshot are cached on the node. The name of the snapshot is passed
+	// as the argument.
+	FullyCachedHook string `toml:"fully_cached_hook"`
+
+	// MountHelper is the name of the mount helper binary (e.g. "stargz-mount-helper").
+	// If specified, the snapshotter returns mounts of type "fuse.<MountHelper>" so that
+	// remote snapshots are mounted lazily in the mount namespace of the container
+	// instead of being kept mounted in the host namespace.
+	MountHelper string `toml:"mount_helper"`
+
+	// MountHelperSocket is the path to the unix socket where the mount helper
+	// requests mounting remote snapshots (default: <root>/mount-helper.sock).
+	MountHelperSocket string `toml:"mount_helper_socket"`
+
+	// SourceLabels records the image reference, the layer digest and the name of
+	// the filesystem of each remote snapshot as labels of the snapshot.
+	SourceLabels bool `toml:"source_labels"`
+
+	// UpperDriver is the driver of the directories of active snapshots which
+	// contain the upperdirs: "overlay" (plain directories; default), "btrfs"
+	// (btrfs subvolumes) or "zfs" (ZFS datasets).
+	UpperDriver string `toml:"upper_driver"`
+
+	// UpperQuota is the quota of each active snapshot (e.g. "10G"). Empty means
+	// no quota. With the "overlay" upper driver, this is enforced with XFS
+	// project quota so the root must be on XFS mounted with "pquota".
+	UpperQuota string `toml:"upper_quota"`
+
+	// ZFSDataset is the parent dataset of the datasets of active snapshots used by
+	// the "zfs" upper driver.
+	ZFSDataset string `toml:"zfs_dataset"`
+
+	// PrefetchWaitTimeoutSec makes task start (Mounts) of all containers wait
+	// for the prefetch of the layers of the image up to this duration. Zero
+	// disables the wait unless "containerd.io/snapshot/remote/prefetch-wait"
+	// label is specified on the snapshot of the container.
+	PrefetchWaitTimeoutSec int64 `toml:"prefetch_wait_timeout_sec"`
+
+	// Metacopy mounts overlayfs with the "metacopy=on" option so that chown and
+	// chmod of files in layers don't copy up (and fetch) their contents.
+	Metacopy bool `toml:"metacopy"`
 }
 
 // KubeconfigKeychainConfig is config for kubeconfig-based keychain.
@@ -53,5 +164,66 @@ type CRIKeychainConfig struct {
 	ImageServicePath string `toml:"image_service_path"`
 }
 
+// LabelKeychainConfig is config for the keychain of the credentials passed
+// through the snapshot labels.
+type LabelKeychainConfig struct {
+	// EnableKeychain enables the keychain which uses the credentials passed
+	// through "containerd.io/snapshot/remote/stargz.auth" label.
+	EnableKeychain bool `toml:"enable_keychain"`
+
+	// CredentialsTTLSec is the duration the credentials passed through the
+	// label are kept. Mounts after this duration use the credentials from the
+	// other sources unless the label is passed again. Defaults to 1h.
+	CredentialsTTLSec int64 `toml:"credentials_ttl_sec"`
+}
+
+// CredentialSourceConfig is config for a source of registry credentials.
+type CredentialSourceConfig struct {
+	// Type is the type of the source: "dockerconfig", "kubeconfig", "cri"
+	// (requires cri_keychain.enable_keychain), "helper" (gRPC credential helper),
+	// "credhelper" (docker credential helper), "gcp" (access token of the GCP
+	// service account of the node), "azure" (ACR token exchanged with the Azure
+	// managed identity of the node) or "static".
+	Type string `toml:"type"`
+
+	// Hosts limits the source to these registry hosts. Empty means all hosts.
+	Hosts []string `toml:"hosts"`
+
+	// Pin makes Hosts use only the sources up to this one. If no credentials
+	// are found for the host, later sources aren't consulted and the host is
+	// accessed without credentials. Requires Hosts.
+	Pin bool `toml:"pin"`
+
+	// KubeconfigPath is the path to kubeconfig for "kubeconfig" source.
+	KubeconfigPath string `toml:"kubeconfig_path"`
+
+	// Address is the path to the unix socket of the credential helper for
+	// "helper" source. The helper serves CredentialHelper gRPC service.
+	Address string `toml:"address"`
+
+	// Helper is the name of the docker credential helper for "credhelper"
+	// source (e.g. "ecr-login" for docker-credential-ecr-login in PATH).
+	Helper string `toml:"helper"`
+
+	// CacheTTLSec is the duration the credentials returned by the docker
+	// credential helper are cached (default: 900).
+	CacheTTLSec int64 `toml:"cache_ttl_sec"`
+
+	// ClientID is the client ID of the user-assigned managed identity for
+	// "azure" source. The system-assigned identity is used if empty.
+	ClientID string `toml:"client_id"`
+
+	// Username and Secret are the credentials for "static" source. Empty
+	// Username means Secret is an identity token.
+	Username string `toml:"username"`
+	Secret   string `toml:"secret"`
+}
+
 // ResolverConfig is config for resolving registries.
 type ResolverConfig resolver.Config
+
+// S3Config is config for mounting layers from S3-compatible object storages.
+type S3Config s3.Config
+
+// IPFSConfig is config for mounting layers distributed over IPFS.
+type IPFSConfig ipfs.Config
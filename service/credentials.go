@@ -0,0 +1,172 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/service/keychain/credhelper"
+	"github.com/containerd/stargz-snapshotter/service/keychain/dockerconfig"
+	"github.com/containerd/stargz-snapshotter/service/keychain/helper"
+	"github.com/containerd/stargz-snapshotter/service/keychain/kubeconfig"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+	"github.com/pkg/errors"
+)
+
+const (
+	credentialSourceDockerconfig = "dockerconfig"
+	credentialSourceKubeconfig   = "kubeconfig"
+	credentialSourceCRI          = "cri"
+	credentialSourceHelper       = "helper"
+	credentialSourceStatic       = "static"
+	credentialSourceCredHelper   = "credhelper"
+	credentialSourceGCP          = "gcp"
+	credentialSourceAzure        = "azure"
+)
+
+// NewCredsFuncs returns the sources of registry credentials following the
+// config. criCreds is the CRI-based keychain, which is nil if it's disabled.
+// notifier (if non-nil) is notified when the credentials of the sources are
+// reloaded (e.g. docker config is updated).
+func NewCredsFuncs(ctx context.Context, cfg *Config, criCreds resolver.Credential, notifier *resolver.CredentialsNotifier) ([]resolver.Credential, error) {
+	var dcOpts []dockerconfig.Option
+	if notifier != nil {
+		dcOpts = append(dcOpts, dockerconfig.WithOnChange(notifier.Notify))
+	}
+	if len(cfg.CredentialSources) == 0 {
+		credsFuncs := []resolver.Credential{dockerconfig.NewDockerconfigKeychain(ctx, dcOpts...)}
+		if cfg.KubeconfigKeychainConfig.EnableKeychain {
+			credsFuncs = append(credsFuncs, newKubeconfigKeychain(ctx, cfg.KubeconfigKeychainConfig.KubeconfigPath))
+		}
+		if criCreds != nil {
+			credsFuncs = append(credsFuncs, criCreds)
+		}
+		return credsFuncs, nil
+	}
+	var sources []credentialSource
+	for i, sc := range cfg.CredentialSources {
+		if sc.Pin && len(sc.Hosts) == 0 {
+			return nil, fmt.Errorf("credential source #%d (%q) must specify hosts to pin", i, sc.Type)
+		}
+		f, err := newCredentialSource(ctx, sc, criCreds, dcOpts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to configure credential source #%d (%q)", i, sc.Type)
+		}
+		hosts := make(map[string]struct{})
+		for _, h := range sc.Hosts {
+			hosts[normalizeCredentialHost(h)] = struct{}{}
+		}
+		sources = append(sources, credentialSource{f, hosts, sc.Pin})
+	}
+	return []resolver.Credential{orderedCredsFuncs(sources)}, nil
+}
+
+func newCredentialSource(ctx context.Context, sc CredentialSourceConfig, criCreds resolver.Credential, dcOpts []dockerconfig.Option) (resolver.Credential, error) {
+	switch sc.Type {
+	case credentialSourceDockerconfig:
+		return dockerconfig.NewDockerconfigKeychain(ctx, dcOpts...), nil
+	case credentialSourceKubeconfig:
+		return newKubeconfigKeychain(ctx, sc.KubeconfigPath), nil
+	case credentialSourceCRI:
+		if criCreds == nil {
+			return nil, fmt.Errorf("CRI-based keychain isn't enabled")
+		}
+		return criCreds, nil
+	case credentialSourceHelper:
+		if sc.Address == "" {
+			return nil, fmt.Errorf("address of credential helper must be specified")
+		}
+		return helper.NewHelperKeychain(ctx, sc.Address)
+	case credentialSourceCredHelper:
+		if sc.Helper == "" {
+			return nil, fmt.Errorf("name of docker credential helper must be specified")
+		}
+		return credhelper.NewCredentialHelperKeychain(ctx, sc.Helper,
+			credhelper.WithCacheTTL(time.Duration(sc.CacheTTLSec)*time.Second))
+	case credentialSourceGCP:
+		return credhelper.NewGCPKeychain(ctx), nil
+	case credentialSourceAzure:
+		var opts []credhelper.Option
+		if sc.ClientID != "" {
+			opts = append(opts, credhelper.WithClientID(sc.ClientID))
+		}
+		return credhelper.NewAzureKeychain(ctx, opts...), nil
+	case credentialSourceStatic:
+		if sc.Secret == "" {
+			return nil, fmt.Errorf("secret must be specified")
+		}
+		username, secret := sc.Username, sc.Secret
+		return func(string, reference.Spec) (string, string, error) {
+			return username, secret, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown type of credential source")
+}
+
+func newKubeconfigKeychain(ctx context.Context, kubeconfigPath string) resolver.Credential {
+	var opts []kubeconfig.Option
+	if kubeconfigPath != "" {
+		opts = append(opts, kubeconfig.WithKubeconfigPath(kubeconfigPath))
+	}
+	return kubeconfig.NewKubeconfigKeychain(ctx, opts...)
+}
+
+// credentialSource is a source of credentials limited to the hosts.
+type credentialSource struct {
+	creds resolver.Credential
+	hosts map[string]struct{} // empty means all hosts
+	pin   bool
+}
+
+// orderedCredsFuncs returns credentials of the first source which has
+// credentials for the host. Sources pinning the host stop the lookup.
+func orderedCredsFuncs(sources []credentialSource) resolver.Credential {
+	return func(host string, refspec reference.Spec) (string, string, error) {
+		nh := normalizeCredentialHost(host)
+		for _, s := range sources {
+			if len(s.hosts) > 0 {
+				if _, ok := s.hosts[nh]; !ok {
+					continue
+				}
+			}
+			username, secret, err := s.creds(host, refspec)
+			if err != nil {
+				return "", "", err
+			}
+			if username != "" || secret != "" {
+				return username, secret, nil
+			}
+			if s.pin {
+				break
+			}
+		}
+		return "", "", nil
+	}
+}
+
+// normalizeCredentialHost returns the host name used for matching hosts of
+// credential sources. Hosts of Docker Hub are regarded as "docker.io".
+func normalizeCredentialHost(host string) string {
+	switch host {
+	case "registry-1.docker.io", "index.docker.io":
+		return "docker.io"
+	}
+	return host
+}
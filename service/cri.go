@@ -21,6 +21,7 @@ import (
 	"strings"
 
 	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/estargz"
 	"github.com/containerd/stargz-snapshotter/fs/source"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
@@ -76,11 +77,15 @@ func sourceFromCRILabels(hosts source.RegistryHosts) source.GetSources {
 		for _, dgst := range append([]digest.Digest{target}, layersDgst...) {
 			layers = append(layers, ocispec.Descriptor{Digest: dgst})
 		}
+		targetDesc := ocispec.Descriptor{Digest: target}
+		if toc, ok := labels[estargz.ExternalTOCAnnotation]; ok {
+			targetDesc.Annotations = map[string]string{estargz.ExternalTOCAnnotation: toc}
+		}
 		return []source.Source{
 			{
 				Hosts:    hosts,
 				Name:     refspec,
-				Target:   ocispec.Descriptor{Digest: target},
+				Target:   targetDesc,
 				Manifest: ocispec.Manifest{Layers: layers},
 			},
 		}, nil
@@ -0,0 +1,146 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"runtime/pprof"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/stargz-snapshotter/fs/remote"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+)
+
+// Diagnostics is what the snapshotter is doing at a point in time. This is
+// meant for debugging incidents in production.
+type Diagnostics struct {
+	Time time.Time `json:"time"`
+
+	// Mounts is the remote snapshots mounted by the snapshotter.
+	Mounts []MountDiagnostics `json:"mounts"`
+
+	// Caches is the statistics of the in-memory caches of the filesystems.
+	Caches []CacheDiagnostics `json:"caches"`
+
+	// InFlightRequests is the range requests to registries in flight.
+	InFlightRequests []remote.InFlightRequest `json:"inFlightRequests"`
+
+	// Goroutines is the stacks of all goroutines.
+	Goroutines string `json:"goroutines,omitempty"`
+}
+
+// MountDiagnostics is the fetch progress of a remote snapshot.
+type MountDiagnostics struct {
+	Key         string   `json:"key"`
+	Ref         string   `json:"ref,omitempty"`
+	Digest      string   `json:"digest,omitempty"`
+	Size        int64    `json:"size"`
+	FetchedSize int64    `json:"fetchedSize"`
+	Percentage  float64  `json:"percentage"`
+	Degraded    []string `json:"degraded,omitempty"`
+}
+
+// CacheDiagnostics is the statistics of the in-memory caches of a filesystem.
+type CacheDiagnostics struct {
+	FileSystem  string `json:"filesystem"`
+	Layers      int    `json:"layers"`
+	Blobs       int    `json:"blobs"`
+	LayersInUse int    `json:"layersInUse"`
+}
+
+// GetDiagnostics returns what the snapshotter is doing right now. Information
+// which the snapshotter doesn't report is left empty.
+func GetDiagnostics(ctx context.Context, sn snapshots.Snapshotter) (Diagnostics, error) {
+	mounts, err := RemoteMounts(ctx, sn)
+	if err != nil {
+		return Diagnostics{}, err
+	}
+	d := Diagnostics{
+		Time:             time.Now(),
+		Mounts:           mounts,
+		Caches:           []CacheDiagnostics{},
+		InFlightRequests: remote.InFlightRequests(),
+	}
+	if r, ok := sn.(snbase.CacheStatsReporter); ok {
+		for _, st := range r.CacheStats(ctx) {
+			d.Caches = append(d.Caches, CacheDiagnostics{
+				FileSystem:  st.FileSystem,
+				Layers:      st.Layers,
+				Blobs:       st.Blobs,
+				LayersInUse: st.LayersInUse,
+			})
+		}
+	}
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 2); err != nil {
+		return Diagnostics{}, err
+	}
+	d.Goroutines = buf.String()
+	return d, nil
+}
+
+// RemoteMounts returns the fetch progress of the remote snapshots. This is empty
+// if the snapshotter doesn't report it.
+func RemoteMounts(ctx context.Context, sn snapshots.Snapshotter) ([]MountDiagnostics, error) {
+	mounts := []MountDiagnostics{}
+	w, ok := sn.(snbase.RemoteStatsWalker)
+	if !ok {
+		return mounts, nil
+	}
+	if err := w.WalkRemoteStats(ctx, func(ctx context.Context, info snapshots.Info, st snbase.Stats) error {
+		ref, dgst := info.Labels[snbase.SourceRefLabel], info.Labels[snbase.SourceDigestLabel]
+		if ref == "" {
+			ref, dgst = layerRef(info.Labels)
+		}
+		mounts = append(mounts, MountDiagnostics{
+			Key:         info.Name,
+			Ref:         ref,
+			Digest:      dgst,
+			Size:        st.Size,
+			FetchedSize: st.FetchedSize,
+			Percentage:  percentage(st.FetchedSize, st.Size),
+			Degraded:    st.Degraded,
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return mounts, nil
+}
+
+// LogDiagnostics dumps the diagnostics of the snapshotter to the log. The
+// goroutine stacks are logged separately from the rest (encoded as JSON) to
+// keep them readable.
+func LogDiagnostics(ctx context.Context, sn snapshots.Snapshotter) (Diagnostics, error) {
+	d, err := GetDiagnostics(ctx, sn)
+	if err != nil {
+		return Diagnostics{}, err
+	}
+	summary := d
+	summary.Goroutines = ""
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return Diagnostics{}, err
+	}
+	log.G(ctx).Infof("diagnostics: %s", data)
+	log.G(ctx).Infof("diagnostics: goroutine stacks:\n%s", d.Goroutines)
+	return d, nil
+}
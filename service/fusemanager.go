@@ -0,0 +1,112 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+
+	"github.com/containerd/containerd/log"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/service/fusemanager"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+	"github.com/pelletier/go-toml"
+	"github.com/pkg/errors"
+)
+
+const defaultFuseManager = "stargz-fuse-manager"
+
+// StartFuseManager starts the fuse manager binary at executable listening on
+// the address unless it's already running. The fuse manager keeps running (and
+// serving the mounts) after the snapshotter exits. Its output is appended to
+// the file at logPath.
+func StartFuseManager(ctx context.Context, executable, address, logPath string) error {
+	return fusemanager.Start(ctx, executable, address, logPath)
+}
+
+// newFuseManagerFileSystem returns the stargz filesystem served by the fuse
+// manager. The fuse manager is started if it isn't running. The configuration
+// is passed to the fuse manager as TOML.
+func newFuseManagerFileSystem(ctx context.Context, root string, config *Config) (snbase.FileSystem, error) {
+	executable := config.FuseManagerConfig.Path
+	if executable == "" {
+		executable = defaultFuseManager
+	}
+	address := config.FuseManagerConfig.Address
+	if address == "" {
+		address = filepath.Join(root, "fuse-manager.sock")
+	}
+	logPath := config.FuseManagerConfig.LogPath
+	if logPath == "" {
+		logPath = filepath.Join(root, "fuse-manager.log")
+	}
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(config); err != nil {
+		return nil, errors.Wrap(err, "failed to encode config")
+	}
+	return fusemanager.NewFilesystem(ctx, address, fsRoot(root), buf.Bytes(), func(ctx context.Context) error {
+		return StartFuseManager(ctx, executable, address, logPath)
+	})
+}
+
+// FuseManagerFilesystem returns the factory of the stargz filesystem used by
+// the fuse manager. The configuration is passed by the snapshotter. The
+// CRI-based keychain is served by the snapshotter so it's unavailable in the
+// fuse manager. The filesystem mounts the layers again when the fuse manager
+// restarts.
+func FuseManagerFilesystem() fusemanager.FilesystemFactory {
+	return func(ctx context.Context, root string, b []byte) (snbase.FileSystem, error) {
+		var config Config
+		if err := toml.Unmarshal(b, &config); err != nil {
+			return nil, errors.Wrap(err, "invalid config")
+		}
+		var credSources []CredentialSourceConfig
+		for _, sc := range config.CredentialSources {
+			if sc.Type == credentialSourceCRI {
+				log.G(ctx).Warn("CRI-based keychain is unavailable in fuse manager; ignoring")
+				continue
+			}
+			credSources = append(credSources, sc)
+		}
+		config.CredentialSources = credSources
+		credsNotifier := new(resolver.CredentialsNotifier)
+		credsFuncs, err := NewCredsFuncs(ctx, &config, nil, credsNotifier)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to configure keychain")
+		}
+		newHosts := func() source.RegistryHosts {
+			return resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), credsFuncs...)
+		}
+		getSources, err := stargzSources(newHosts, &config)
+		if err != nil {
+			return nil, err
+		}
+		fs, err := stargzfs.NewFilesystem(root,
+			config.Config,
+			stargzfs.WithGetSources(getSources),
+			stargzfs.WithRestoreMounts(),
+		)
+		if err != nil {
+			return nil, err
+		}
+		subscribeCredentials(ctx, fs, credsNotifier)
+		return fs, nil
+	}
+}
@@ -0,0 +1,1054 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package fusemanager provides the fuse manager, which serves the FUSE mounts
+// of remote snapshots in a process detached from the snapshotter, and its gRPC
+// API. The API is defined in fusemanager.proto. Messages are plain structs with
+// protobuf struct tags corresponding to the definition so that they can be
+// encoded by the default codec of gRPC.
+package fusemanager
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+)
+
+// StatusRequest is the request of Status.
+type StatusRequest struct{}
+
+func (m *StatusRequest) Reset()         { *m = StatusRequest{} }
+func (m *StatusRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*StatusRequest) ProtoMessage()    {}
+
+// StatusResponse is the response of Status.
+type StatusResponse struct {
+	// Initialized is true if the filesystem is configured by Init.
+	Initialized bool `protobuf:"varint,1,opt,name=initialized,proto3" json:"initialized,omitempty"`
+
+	// Pid is the process ID of the fuse manager.
+	Pid int64 `protobuf:"varint,2,opt,name=pid,proto3" json:"pid,omitempty"`
+}
+
+func (m *StatusResponse) Reset()         { *m = StatusResponse{} }
+func (m *StatusResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*StatusResponse) ProtoMessage()    {}
+
+// InitRequest is the request of Init.
+type InitRequest struct {
+	// Root is the root directory of the filesystem.
+	Root string `protobuf:"bytes,1,opt,name=root,proto3" json:"root,omitempty"`
+
+	// Config is the configuration of the filesystem. The format is defined by
+	// the filesystem factory of the fuse manager.
+	Config []byte `protobuf:"bytes,2,opt,name=config,proto3" json:"config,omitempty"`
+}
+
+func (m *InitRequest) Reset()         { *m = InitRequest{} }
+func (m *InitRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*InitRequest) ProtoMessage()    {}
+
+// InitResponse is the response of Init.
+type InitResponse struct{}
+
+func (m *InitResponse) Reset()         { *m = InitResponse{} }
+func (m *InitResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*InitResponse) ProtoMessage()    {}
+
+// MountRequest is the request of Mount.
+type MountRequest struct {
+	Mountpoint string            `protobuf:"bytes,1,opt,name=mountpoint,proto3" json:"mountpoint,omitempty"`
+	Labels     map[string]string `protobuf:"bytes,2,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *MountRequest) Reset()         { *m = MountRequest{} }
+func (m *MountRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*MountRequest) ProtoMessage()    {}
+
+// MountResponse is the response of Mount.
+type MountResponse struct{}
+
+func (m *MountResponse) Reset()         { *m = MountResponse{} }
+func (m *MountResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*MountResponse) ProtoMessage()    {}
+
+// CheckRequest is the request of Check.
+type CheckRequest struct {
+	Mountpoint string            `protobuf:"bytes,1,opt,name=mountpoint,proto3" json:"mountpoint,omitempty"`
+	Labels     map[string]string `protobuf:"bytes,2,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *CheckRequest) Reset()         { *m = CheckRequest{} }
+func (m *CheckRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*CheckRequest) ProtoMessage()    {}
+
+// CheckResponse is the response of Check.
+type CheckResponse struct{}
+
+func (m *CheckResponse) Reset()         { *m = CheckResponse{} }
+func (m *CheckResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*CheckResponse) ProtoMessage()    {}
+
+// UnmountRequest is the request of Unmount.
+type UnmountRequest struct {
+	Mountpoint string `protobuf:"bytes,1,opt,name=mountpoint,proto3" json:"mountpoint,omitempty"`
+}
+
+func (m *UnmountRequest) Reset()         { *m = UnmountRequest{} }
+func (m *UnmountRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*UnmountRequest) ProtoMessage()    {}
+
+// UnmountResponse is the response of Unmount.
+type UnmountResponse struct{}
+
+func (m *UnmountResponse) Reset()         { *m = UnmountResponse{} }
+func (m *UnmountResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*UnmountResponse) ProtoMessage()    {}
+
+// StatsRequest is the request of Stats.
+type StatsRequest struct {
+	Mountpoint string `protobuf:"bytes,1,opt,name=mountpoint,proto3" json:"mountpoint,omitempty"`
+}
+
+func (m *StatsRequest) Reset()         { *m = StatsRequest{} }
+func (m *StatsRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*StatsRequest) ProtoMessage()    {}
+
+// StatsResponse is the response of Stats.
+type StatsResponse struct {
+	Size        int64    `protobuf:"varint,1,opt,name=size,proto3" json:"size,omitempty"`
+	FetchedSize int64    `protobuf:"varint,2,opt,name=fetched_size,json=fetchedSize,proto3" json:"fetched_size,omitempty"`
+	Degraded    []string `protobuf:"bytes,3,rep,name=degraded,proto3" json:"degraded,omitempty"`
+}
+
+func (m *StatsResponse) Reset()         { *m = StatsResponse{} }
+func (m *StatsResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*StatsResponse) ProtoMessage()    {}
+
+// RefreshRequest is the request of Refresh.
+type RefreshRequest struct {
+	Mountpoint string            `protobuf:"bytes,1,opt,name=mountpoint,proto3" json:"mountpoint,omitempty"`
+	Labels     map[string]string `protobuf:"bytes,2,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *RefreshRequest) Reset()         { *m = RefreshRequest{} }
+func (m *RefreshRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*RefreshRequest) ProtoMessage()    {}
+
+// RefreshResponse is the response of Refresh.
+type RefreshResponse struct{}
+
+func (m *RefreshResponse) Reset()         { *m = RefreshResponse{} }
+func (m *RefreshResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*RefreshResponse) ProtoMessage()    {}
+
+// InvalidateTransportsRequest is the request of InvalidateTransports.
+type InvalidateTransportsRequest struct{}
+
+func (m *InvalidateTransportsRequest) Reset()         { *m = InvalidateTransportsRequest{} }
+func (m *InvalidateTransportsRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*InvalidateTransportsRequest) ProtoMessage()    {}
+
+// InvalidateTransportsResponse is the response of InvalidateTransports.
+type InvalidateTransportsResponse struct{}
+
+func (m *InvalidateTransportsResponse) Reset()         { *m = InvalidateTransportsResponse{} }
+func (m *InvalidateTransportsResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*InvalidateTransportsResponse) ProtoMessage()    {}
+
+// CacheStatsRequest is the request of CacheStats and EvictCaches.
+type CacheStatsRequest struct{}
+
+func (m *CacheStatsRequest) Reset()         { *m = CacheStatsRequest{} }
+func (m *CacheStatsRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*CacheStatsRequest) ProtoMessage()    {}
+
+// CacheStatsResponse is the response of CacheStats and EvictCaches.
+type CacheStatsResponse struct {
+	Layers      int64 `protobuf:"varint,1,opt,name=layers,proto3" json:"layers,omitempty"`
+	Blobs       int64 `protobuf:"varint,2,opt,name=blobs,proto3" json:"blobs,omitempty"`
+	LayersInUse int64 `protobuf:"varint,3,opt,name=layers_in_use,json=layersInUse,proto3" json:"layers_in_use,omitempty"`
+}
+
+func (m *CacheStatsResponse) Reset()         { *m = CacheStatsResponse{} }
+func (m *CacheStatsResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*CacheStatsResponse) ProtoMessage()    {}
+
+// SetBackgroundFetchRequest is the request of SetBackgroundFetch.
+type SetBackgroundFetchRequest struct {
+	Paused    bool  `protobuf:"varint,1,opt,name=paused,proto3" json:"paused,omitempty"`
+	Bandwidth int64 `protobuf:"varint,2,opt,name=bandwidth,proto3" json:"bandwidth,omitempty"`
+}
+
+func (m *SetBackgroundFetchRequest) Reset()         { *m = SetBackgroundFetchRequest{} }
+func (m *SetBackgroundFetchRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*SetBackgroundFetchRequest) ProtoMessage()    {}
+
+// GetBackgroundFetchRequest is the request of GetBackgroundFetch.
+type GetBackgroundFetchRequest struct{}
+
+func (m *GetBackgroundFetchRequest) Reset()         { *m = GetBackgroundFetchRequest{} }
+func (m *GetBackgroundFetchRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*GetBackgroundFetchRequest) ProtoMessage()    {}
+
+// BackgroundFetchResponse is the state of background fetch returned by
+// SetBackgroundFetch and GetBackgroundFetch.
+type BackgroundFetchResponse struct {
+	Paused    bool  `protobuf:"varint,1,opt,name=paused,proto3" json:"paused,omitempty"`
+	Bandwidth int64 `protobuf:"varint,2,opt,name=bandwidth,proto3" json:"bandwidth,omitempty"`
+}
+
+func (m *BackgroundFetchResponse) Reset()         { *m = BackgroundFetchResponse{} }
+func (m *BackgroundFetchResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*BackgroundFetchResponse) ProtoMessage()    {}
+
+// UpdateLabelsRequest is the request of UpdateLabels.
+type UpdateLabelsRequest struct {
+	Mountpoint string            `protobuf:"bytes,1,opt,name=mountpoint,proto3" json:"mountpoint,omitempty"`
+	Labels     map[string]string `protobuf:"bytes,2,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+}
+
+func (m *UpdateLabelsRequest) Reset()         { *m = UpdateLabelsRequest{} }
+func (m *UpdateLabelsRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*UpdateLabelsRequest) ProtoMessage()    {}
+
+// UpdateLabelsResponse is the response of UpdateLabels.
+type UpdateLabelsResponse struct{}
+
+func (m *UpdateLabelsResponse) Reset()         { *m = UpdateLabelsResponse{} }
+func (m *UpdateLabelsResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*UpdateLabelsResponse) ProtoMessage()    {}
+
+// IdentityRequest is the request of Identity.
+type IdentityRequest struct {
+	Mountpoint string `protobuf:"bytes,1,opt,name=mountpoint,proto3" json:"mountpoint,omitempty"`
+}
+
+func (m *IdentityRequest) Reset()         { *m = IdentityRequest{} }
+func (m *IdentityRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*IdentityRequest) ProtoMessage()    {}
+
+// IdentityResponse is the response of Identity.
+type IdentityResponse struct {
+	Identity string `protobuf:"bytes,1,opt,name=identity,proto3" json:"identity,omitempty"`
+}
+
+func (m *IdentityResponse) Reset()         { *m = IdentityResponse{} }
+func (m *IdentityResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*IdentityResponse) ProtoMessage()    {}
+
+// SourceRequest is the request of Source.
+type SourceRequest struct {
+	Mountpoint string `protobuf:"bytes,1,opt,name=mountpoint,proto3" json:"mountpoint,omitempty"`
+}
+
+func (m *SourceRequest) Reset()         { *m = SourceRequest{} }
+func (m *SourceRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*SourceRequest) ProtoMessage()    {}
+
+// SourceResponse is the response of Source.
+type SourceResponse struct {
+	Ref    string `protobuf:"bytes,1,opt,name=ref,proto3" json:"ref,omitempty"`
+	Digest string `protobuf:"bytes,2,opt,name=digest,proto3" json:"digest,omitempty"`
+}
+
+func (m *SourceResponse) Reset()         { *m = SourceResponse{} }
+func (m *SourceResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*SourceResponse) ProtoMessage()    {}
+
+// CapabilitiesRequest is the request of Capabilities.
+type CapabilitiesRequest struct{}
+
+func (m *CapabilitiesRequest) Reset()         { *m = CapabilitiesRequest{} }
+func (m *CapabilitiesRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*CapabilitiesRequest) ProtoMessage()    {}
+
+// CapabilitiesResponse is the response of Capabilities.
+type CapabilitiesResponse struct {
+	Name         string   `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	MediaTypes   []string `protobuf:"bytes,2,rep,name=media_types,json=mediaTypes,proto3" json:"media_types,omitempty"`
+	Verification bool     `protobuf:"varint,3,opt,name=verification,proto3" json:"verification,omitempty"`
+	Offline      bool     `protobuf:"varint,4,opt,name=offline,proto3" json:"offline,omitempty"`
+	Features     []string `protobuf:"bytes,5,rep,name=features,proto3" json:"features,omitempty"`
+	Compressions []string `protobuf:"bytes,6,rep,name=compressions,proto3" json:"compressions,omitempty"`
+}
+
+func (m *CapabilitiesResponse) Reset()         { *m = CapabilitiesResponse{} }
+func (m *CapabilitiesResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*CapabilitiesResponse) ProtoMessage()    {}
+
+// HealthRequest is the request of Health.
+type HealthRequest struct{}
+
+func (m *HealthRequest) Reset()         { *m = HealthRequest{} }
+func (m *HealthRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*HealthRequest) ProtoMessage()    {}
+
+// HealthResponse is the response of Health.
+type HealthResponse struct {
+	// Error is the reason why the filesystem is unhealthy. Empty if healthy.
+	Error string `protobuf:"bytes,1,opt,name=error,proto3" json:"error,omitempty"`
+}
+
+func (m *HealthResponse) Reset()         { *m = HealthResponse{} }
+func (m *HealthResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*HealthResponse) ProtoMessage()    {}
+
+// WaitForPrefetchRequest is the request of WaitForPrefetch.
+type WaitForPrefetchRequest struct {
+	Mountpoint string `protobuf:"bytes,1,opt,name=mountpoint,proto3" json:"mountpoint,omitempty"`
+}
+
+func (m *WaitForPrefetchRequest) Reset()         { *m = WaitForPrefetchRequest{} }
+func (m *WaitForPrefetchRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*WaitForPrefetchRequest) ProtoMessage()    {}
+
+// WaitForPrefetchResponse is the response of WaitForPrefetch.
+type WaitForPrefetchResponse struct{}
+
+func (m *WaitForPrefetchResponse) Reset()         { *m = WaitForPrefetchResponse{} }
+func (m *WaitForPrefetchResponse) String() string { return fmt.Sprintf("%+v", *m) }
+func (*WaitForPrefetchResponse) ProtoMessage()    {}
+
+// WatchFullyCachedRequest is the request of WatchFullyCached.
+type WatchFullyCachedRequest struct{}
+
+func (m *WatchFullyCachedRequest) Reset()         { *m = WatchFullyCachedRequest{} }
+func (m *WatchFullyCachedRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*WatchFullyCachedRequest) ProtoMessage()    {}
+
+// FullyCachedEvent notifies that the layer mounted on the mountpoint is fully cached.
+type FullyCachedEvent struct {
+	Mountpoint string `protobuf:"bytes,1,opt,name=mountpoint,proto3" json:"mountpoint,omitempty"`
+}
+
+func (m *FullyCachedEvent) Reset()         { *m = FullyCachedEvent{} }
+func (m *FullyCachedEvent) String() string { return fmt.Sprintf("%+v", *m) }
+func (*FullyCachedEvent) ProtoMessage()    {}
+
+// FuseManagerServer is the server API for FuseManager service.
+type FuseManagerServer interface {
+	// Status returns the status of the fuse manager.
+	Status(context.Context, *StatusRequest) (*StatusResponse, error)
+
+	// Init configures the filesystem of the fuse manager. The filesystem is
+	// configured only once; later calls (e.g. from a restarted snapshotter)
+	// reuse it.
+	Init(context.Context, *InitRequest) (*InitResponse, error)
+
+	// Mount mounts the layer on the mountpoint.
+	Mount(context.Context, *MountRequest) (*MountResponse, error)
+
+	// Check checks the connection to the registry of the mounted layer.
+	Check(context.Context, *CheckRequest) (*CheckResponse, error)
+
+	// Unmount unmounts the layer from the mountpoint.
+	Unmount(context.Context, *UnmountRequest) (*UnmountResponse, error)
+
+	// Stats returns the statistics of the mounted layer.
+	Stats(context.Context, *StatsRequest) (*StatsResponse, error)
+
+	// Refresh re-resolves the layer mounted on the mountpoint.
+	Refresh(context.Context, *RefreshRequest) (*RefreshResponse, error)
+
+	// InvalidateTransports makes all layers re-establish their connections to
+	// registries on their next fetch.
+	InvalidateTransports(context.Context, *InvalidateTransportsRequest) (*InvalidateTransportsResponse, error)
+
+	// CacheStats returns the statistics of the caches of the filesystem.
+	CacheStats(context.Context, *CacheStatsRequest) (*CacheStatsResponse, error)
+
+	// EvictCaches evicts the layers which aren't mounted from the caches.
+	EvictCaches(context.Context, *CacheStatsRequest) (*CacheStatsResponse, error)
+
+	// SetBackgroundFetch pauses, resumes or throttles background fetch.
+	SetBackgroundFetch(context.Context, *SetBackgroundFetchRequest) (*BackgroundFetchResponse, error)
+
+	// GetBackgroundFetch returns the state of background fetch.
+	GetBackgroundFetch(context.Context, *GetBackgroundFetchRequest) (*BackgroundFetchResponse, error)
+
+	// UpdateLabels notifies the filesystem of the updated labels of the layer
+	// mounted on the mountpoint.
+	UpdateLabels(context.Context, *UpdateLabelsRequest) (*UpdateLabelsResponse, error)
+
+	// Identity returns the identity of the layer mounted on the mountpoint.
+	Identity(context.Context, *IdentityRequest) (*IdentityResponse, error)
+
+	// Source returns the source of the layer mounted on the mountpoint.
+	Source(context.Context, *SourceRequest) (*SourceResponse, error)
+
+	// Capabilities returns the capabilities of the filesystem.
+	Capabilities(context.Context, *CapabilitiesRequest) (*CapabilitiesResponse, error)
+
+	// Health returns an error if the filesystem can't serve new layers.
+	Health(context.Context, *HealthRequest) (*HealthResponse, error)
+
+	// WaitForPrefetch waits for the prefetch of the layer mounted on the
+	// mountpoint.
+	WaitForPrefetch(context.Context, *WaitForPrefetchRequest) (*WaitForPrefetchResponse, error)
+
+	// WatchFullyCached streams the mountpoints of the layers which are fully
+	// cached. The layers which are already fully cached are sent first.
+	WatchFullyCached(*WatchFullyCachedRequest, FuseManager_WatchFullyCachedServer) error
+}
+
+// FuseManager_WatchFullyCachedServer is the server stream of WatchFullyCached.
+type FuseManager_WatchFullyCachedServer interface {
+	Send(*FullyCachedEvent) error
+	grpc.ServerStream
+}
+
+// RegisterFuseManagerServer registers the FuseManager service to the gRPC server.
+func RegisterFuseManagerServer(s *grpc.Server, srv FuseManagerServer) {
+	s.RegisterService(&fuseManagerServiceDesc, srv)
+}
+
+var fuseManagerServiceDesc = grpc.ServiceDesc{
+	ServiceName: "stargz.fusemanager.v1.FuseManager",
+	HandlerType: (*FuseManagerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Status",
+			Handler:    statusHandler,
+		},
+		{
+			MethodName: "Init",
+			Handler:    initHandler,
+		},
+		{
+			MethodName: "Mount",
+			Handler:    mountHandler,
+		},
+		{
+			MethodName: "Check",
+			Handler:    checkHandler,
+		},
+		{
+			MethodName: "Unmount",
+			Handler:    unmountHandler,
+		},
+		{
+			MethodName: "Stats",
+			Handler:    statsHandler,
+		},
+		{
+			MethodName: "Refresh",
+			Handler:    refreshHandler,
+		},
+		{
+			MethodName: "InvalidateTransports",
+			Handler:    invalidateTransportsHandler,
+		},
+		{
+			MethodName: "CacheStats",
+			Handler:    cacheStatsHandler,
+		},
+		{
+			MethodName: "EvictCaches",
+			Handler:    evictCachesHandler,
+		},
+		{
+			MethodName: "SetBackgroundFetch",
+			Handler:    setBackgroundFetchHandler,
+		},
+		{
+			MethodName: "GetBackgroundFetch",
+			Handler:    getBackgroundFetchHandler,
+		},
+		{
+			MethodName: "UpdateLabels",
+			Handler:    updateLabelsHandler,
+		},
+		{
+			MethodName: "Identity",
+			Handler:    identityHandler,
+		},
+		{
+			MethodName: "Source",
+			Handler:    sourceHandler,
+		},
+		{
+			MethodName: "Capabilities",
+			Handler:    capabilitiesHandler,
+		},
+		{
+			MethodName: "Health",
+			Handler:    healthHandler,
+		},
+		{
+			MethodName: "WaitForPrefetch",
+			Handler:    waitForPrefetchHandler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchFullyCached",
+			Handler:       watchFullyCachedHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "fusemanager.proto",
+}
+
+func statusHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).Status(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/Status",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).Status(ctx, req.(*StatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func initHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InitRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).Init(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/Init",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).Init(ctx, req.(*InitRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func mountHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(MountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).Mount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/Mount",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).Mount(ctx, req.(*MountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func checkHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CheckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).Check(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/Check",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).Check(ctx, req.(*CheckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func unmountHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UnmountRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).Unmount(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/Unmount",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).Unmount(ctx, req.(*UnmountRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func statsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).Stats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/Stats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).Stats(ctx, req.(*StatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func refreshHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RefreshRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).Refresh(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/Refresh",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).Refresh(ctx, req.(*RefreshRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func invalidateTransportsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InvalidateTransportsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).InvalidateTransports(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/InvalidateTransports",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).InvalidateTransports(ctx, req.(*InvalidateTransportsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func cacheStatsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CacheStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).CacheStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/CacheStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).CacheStats(ctx, req.(*CacheStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func evictCachesHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CacheStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).EvictCaches(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/EvictCaches",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).EvictCaches(ctx, req.(*CacheStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func setBackgroundFetchHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetBackgroundFetchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).SetBackgroundFetch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/SetBackgroundFetch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).SetBackgroundFetch(ctx, req.(*SetBackgroundFetchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func getBackgroundFetchHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBackgroundFetchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).GetBackgroundFetch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/GetBackgroundFetch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).GetBackgroundFetch(ctx, req.(*GetBackgroundFetchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func updateLabelsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateLabelsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).UpdateLabels(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/UpdateLabels",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).UpdateLabels(ctx, req.(*UpdateLabelsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func identityHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IdentityRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).Identity(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/Identity",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).Identity(ctx, req.(*IdentityRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func sourceHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SourceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).Source(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/Source",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).Source(ctx, req.(*SourceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func capabilitiesHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CapabilitiesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).Capabilities(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/Capabilities",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).Capabilities(ctx, req.(*CapabilitiesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func healthHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(HealthRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).Health(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/Health",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).Health(ctx, req.(*HealthRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func waitForPrefetchHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WaitForPrefetchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FuseManagerServer).WaitForPrefetch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.fusemanager.v1.FuseManager/WaitForPrefetch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FuseManagerServer).WaitForPrefetch(ctx, req.(*WaitForPrefetchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func watchFullyCachedHandler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchFullyCachedRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FuseManagerServer).WatchFullyCached(m, &watchFullyCachedServer{stream})
+}
+
+type watchFullyCachedServer struct {
+	grpc.ServerStream
+}
+
+func (x *watchFullyCachedServer) Send(m *FullyCachedEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// FuseManagerClient is the client API for FuseManager service.
+type FuseManagerClient interface {
+	Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error)
+	Init(ctx context.Context, in *InitRequest, opts ...grpc.CallOption) (*InitResponse, error)
+	Mount(ctx context.Context, in *MountRequest, opts ...grpc.CallOption) (*MountResponse, error)
+	Check(ctx context.Context, in *CheckRequest, opts ...grpc.CallOption) (*CheckResponse, error)
+	Unmount(ctx context.Context, in *UnmountRequest, opts ...grpc.CallOption) (*UnmountResponse, error)
+	Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error)
+	Refresh(ctx context.Context, in *RefreshRequest, opts ...grpc.CallOption) (*RefreshResponse, error)
+	InvalidateTransports(ctx context.Context, in *InvalidateTransportsRequest, opts ...grpc.CallOption) (*InvalidateTransportsResponse, error)
+	CacheStats(ctx context.Context, in *CacheStatsRequest, opts ...grpc.CallOption) (*CacheStatsResponse, error)
+	EvictCaches(ctx context.Context, in *CacheStatsRequest, opts ...grpc.CallOption) (*CacheStatsResponse, error)
+	SetBackgroundFetch(ctx context.Context, in *SetBackgroundFetchRequest, opts ...grpc.CallOption) (*BackgroundFetchResponse, error)
+	GetBackgroundFetch(ctx context.Context, in *GetBackgroundFetchRequest, opts ...grpc.CallOption) (*BackgroundFetchResponse, error)
+	UpdateLabels(ctx context.Context, in *UpdateLabelsRequest, opts ...grpc.CallOption) (*UpdateLabelsResponse, error)
+	Identity(ctx context.Context, in *IdentityRequest, opts ...grpc.CallOption) (*IdentityResponse, error)
+	Source(ctx context.Context, in *SourceRequest, opts ...grpc.CallOption) (*SourceResponse, error)
+	Capabilities(ctx context.Context, in *CapabilitiesRequest, opts ...grpc.CallOption) (*CapabilitiesResponse, error)
+	Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*HealthResponse, error)
+	WaitForPrefetch(ctx context.Context, in *WaitForPrefetchRequest, opts ...grpc.CallOption) (*WaitForPrefetchResponse, error)
+	WatchFullyCached(ctx context.Context, in *WatchFullyCachedRequest, opts ...grpc.CallOption) (FuseManager_WatchFullyCachedClient, error)
+}
+
+// FuseManager_WatchFullyCachedClient is the client stream of WatchFullyCached.
+type FuseManager_WatchFullyCachedClient interface {
+	Recv() (*FullyCachedEvent, error)
+	grpc.ClientStream
+}
+
+// NewFuseManagerClient returns the client of FuseManager service.
+func NewFuseManagerClient(cc grpc.ClientConnInterface) FuseManagerClient {
+	return &fuseManagerClient{cc}
+}
+
+type fuseManagerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func (c *fuseManagerClient) Status(ctx context.Context, in *StatusRequest, opts ...grpc.CallOption) (*StatusResponse, error) {
+	out := new(StatusResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/Status", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) Init(ctx context.Context, in *InitRequest, opts ...grpc.CallOption) (*InitResponse, error) {
+	out := new(InitResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/Init", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) Mount(ctx context.Context, in *MountRequest, opts ...grpc.CallOption) (*MountResponse, error) {
+	out := new(MountResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/Mount", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) Check(ctx context.Context, in *CheckRequest, opts ...grpc.CallOption) (*CheckResponse, error) {
+	out := new(CheckResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/Check", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) Unmount(ctx context.Context, in *UnmountRequest, opts ...grpc.CallOption) (*UnmountResponse, error) {
+	out := new(UnmountResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/Unmount", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) Stats(ctx context.Context, in *StatsRequest, opts ...grpc.CallOption) (*StatsResponse, error) {
+	out := new(StatsResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/Stats", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) Refresh(ctx context.Context, in *RefreshRequest, opts ...grpc.CallOption) (*RefreshResponse, error) {
+	out := new(RefreshResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/Refresh", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) InvalidateTransports(ctx context.Context, in *InvalidateTransportsRequest, opts ...grpc.CallOption) (*InvalidateTransportsResponse, error) {
+	out := new(InvalidateTransportsResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/InvalidateTransports", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) CacheStats(ctx context.Context, in *CacheStatsRequest, opts ...grpc.CallOption) (*CacheStatsResponse, error) {
+	out := new(CacheStatsResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/CacheStats", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) EvictCaches(ctx context.Context, in *CacheStatsRequest, opts ...grpc.CallOption) (*CacheStatsResponse, error) {
+	out := new(CacheStatsResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/EvictCaches", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) SetBackgroundFetch(ctx context.Context, in *SetBackgroundFetchRequest, opts ...grpc.CallOption) (*BackgroundFetchResponse, error) {
+	out := new(BackgroundFetchResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/SetBackgroundFetch", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) GetBackgroundFetch(ctx context.Context, in *GetBackgroundFetchRequest, opts ...grpc.CallOption) (*BackgroundFetchResponse, error) {
+	out := new(BackgroundFetchResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/GetBackgroundFetch", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) UpdateLabels(ctx context.Context, in *UpdateLabelsRequest, opts ...grpc.CallOption) (*UpdateLabelsResponse, error) {
+	out := new(UpdateLabelsResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/UpdateLabels", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) Identity(ctx context.Context, in *IdentityRequest, opts ...grpc.CallOption) (*IdentityResponse, error) {
+	out := new(IdentityResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/Identity", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) Source(ctx context.Context, in *SourceRequest, opts ...grpc.CallOption) (*SourceResponse, error) {
+	out := new(SourceResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/Source", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) Capabilities(ctx context.Context, in *CapabilitiesRequest, opts ...grpc.CallOption) (*CapabilitiesResponse, error) {
+	out := new(CapabilitiesResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/Capabilities", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) Health(ctx context.Context, in *HealthRequest, opts ...grpc.CallOption) (*HealthResponse, error) {
+	out := new(HealthResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/Health", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) WaitForPrefetch(ctx context.Context, in *WaitForPrefetchRequest, opts ...grpc.CallOption) (*WaitForPrefetchResponse, error) {
+	out := new(WaitForPrefetchResponse)
+	if err := c.cc.Invoke(ctx, "/stargz.fusemanager.v1.FuseManager/WaitForPrefetch", in, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fuseManagerClient) WatchFullyCached(ctx context.Context, in *WatchFullyCachedRequest, opts ...grpc.CallOption) (FuseManager_WatchFullyCachedClient, error) {
+	stream, err := c.cc.NewStream(ctx, &fuseManagerServiceDesc.Streams[0], "/stargz.fusemanager.v1.FuseManager/WatchFullyCached", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &watchFullyCachedClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type watchFullyCachedClient struct {
+	grpc.ClientStream
+}
+
+func (x *watchFullyCachedClient) Recv() (*FullyCachedEvent, error) {
+	m := new(FullyCachedEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,472 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fusemanager
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/pkg/dialer"
+	"github.com/containerd/stargz-snapshotter/snapshot"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// startTimeout is the time to wait for the fuse manager to start serving.
+	startTimeout = 10 * time.Second
+
+	// statusTimeout is the timeout of checking if the fuse manager is running.
+	statusTimeout = time.Second
+
+	// watchRetryInterval is the interval of watching fully cached layers again
+	// after the stream is closed.
+	watchRetryInterval = time.Second
+)
+
+// Start starts the fuse manager binary at executable listening on the address
+// unless it's already running. The fuse manager runs in its own session so
+// that it isn't killed together with the caller (e.g. on restarts of the
+// snapshotter). Its output is appended to the file at logPath because it
+// outlives the stdout of the caller; empty logPath discards the output. args
+// are passed to the fuse manager in addition to "--address".
+func Start(ctx context.Context, executable, address, logPath string, args ...string) error {
+	if running(ctx, address) {
+		log.G(ctx).WithField("address", address).Debug("fuse manager is already running")
+		return nil
+	}
+	cmd := exec.Command(executable, append([]string{"--address", address}, args...)...)
+	if logPath != "" {
+		if err := os.MkdirAll(filepath.Dir(logPath), 0700); err != nil {
+			return errors.Wrapf(err, "failed to create directory for fuse manager log %q", logPath)
+		}
+		f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return errors.Wrapf(err, "failed to open fuse manager log %q", logPath)
+		}
+		// The child keeps its own descriptor.
+		defer f.Close()
+		cmd.Stdout, cmd.Stderr = f, f
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "failed to start fuse manager %q", executable)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	ctx, cancel := context.WithTimeout(ctx, startTimeout)
+	defer cancel()
+	for {
+		if running(ctx, address) {
+			log.G(ctx).WithField("pid", cmd.Process.Pid).Info("started fuse manager")
+			return nil
+		}
+		select {
+		case err := <-exited:
+			return errors.Errorf("fuse manager exited during startup: %v", err)
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "fuse manager didn't start serving on %q", address)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// running returns true if the fuse manager is serving on the address.
+func running(ctx context.Context, address string) bool {
+	ctx, cancel := context.WithTimeout(ctx, statusTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, dialer.DialAddress(address),
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(dialer.ContextDialer),
+	)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	_, err = NewFuseManagerClient(conn).Status(ctx, &StatusRequest{})
+	return err == nil
+}
+
+var (
+	_ = (snapshot.RefreshableFileSystem)((*Filesystem)(nil))
+	_ = (snapshot.TransportInvalidatingFileSystem)((*Filesystem)(nil))
+	_ = (snapshot.CacheStatsFileSystem)((*Filesystem)(nil))
+	_ = (snapshot.CacheEvictingFileSystem)((*Filesystem)(nil))
+	_ = (snapshot.BackgroundFetchControllingFileSystem)((*Filesystem)(nil))
+	_ = (snapshot.UpdatableFileSystem)((*Filesystem)(nil))
+	_ = (snapshot.IdentifyingFileSystem)((*Filesystem)(nil))
+	_ = (snapshot.SourceFileSystem)((*Filesystem)(nil))
+	_ = (snapshot.CapableFileSystem)((*Filesystem)(nil))
+	_ = (snapshot.NotifyingFileSystem)((*Filesystem)(nil))
+	_ = (snapshot.PrefetchWaitingFileSystem)((*Filesystem)(nil))
+)
+
+// Filesystem is a snapshot.FileSystem served by the fuse manager. The mounts
+// are kept by the fuse manager when the snapshotter exits. If the fuse manager
+// is unreachable or has lost the filesystem (e.g. it restarted), Filesystem
+// starts it again (if possible) and re-initializes the filesystem.
+//
+// The filesystem in the fuse manager can't mount layers in other mount
+// namespaces so Filesystem doesn't implement snapshot.NamespacedFileSystem.
+type Filesystem struct {
+	conn   *grpc.ClientConn
+	client FuseManagerClient
+	init   *InitRequest
+	start  func(ctx context.Context) error
+
+	// ctx is canceled on Close to stop watching fully cached layers.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu serializes reconnection.
+	mu sync.Mutex
+}
+
+// NewFilesystem connects to the fuse manager listening on the address and
+// initializes the filesystem on the root directory with the config. start is
+// called for starting the fuse manager when it isn't running. It can be nil if
+// the fuse manager is managed by others (e.g. systemd).
+func NewFilesystem(ctx context.Context, address, root string, config []byte, start func(ctx context.Context) error) (*Filesystem, error) {
+	backoffConfig := backoff.DefaultConfig
+	backoffConfig.MaxDelay = time.Second
+	conn, err := grpc.Dial(dialer.DialAddress(address),
+		grpc.WithInsecure(),
+		grpc.WithConnectParams(grpc.ConnectParams{Backoff: backoffConfig}),
+		grpc.WithContextDialer(dialer.ContextDialer),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to fuse manager %q", address)
+	}
+	wCtx, cancel := context.WithCancel(log.WithLogger(context.Background(), log.G(ctx)))
+	fs := &Filesystem{
+		conn:   conn,
+		client: NewFuseManagerClient(conn),
+		init:   &InitRequest{Root: root, Config: config},
+		start:  start,
+		ctx:    wCtx,
+		cancel: cancel,
+	}
+	if err := fs.reconnect(ctx); err != nil {
+		cancel()
+		conn.Close()
+		return nil, err
+	}
+	return fs, nil
+}
+
+// reconnect starts the fuse manager if needed and initializes the filesystem.
+func (fs *Filesystem) reconnect(ctx context.Context) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.start != nil {
+		if err := fs.start(ctx); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, startTimeout)
+	defer cancel()
+	if _, err := fs.client.Init(ctx, fs.init, grpc.WaitForReady(true)); err != nil {
+		return errors.Wrap(err, "failed to initialize filesystem of fuse manager")
+	}
+	return nil
+}
+
+// call calls f and retries it once after reconnecting if the fuse manager is
+// unreachable or uninitialized.
+func (fs *Filesystem) call(ctx context.Context, f func(ctx context.Context) error) error {
+	// Propagate the namespace to the fuse manager. The namespace may be only in
+	// the incoming metadata.
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		ctx = namespaces.WithNamespace(ctx, ns)
+	}
+	err := f(ctx)
+	if code := status.Code(err); code != codes.Unavailable && code != codes.FailedPrecondition {
+		return err
+	}
+	log.G(ctx).WithError(err).Warn("fuse manager is unavailable; reconnecting")
+	if err := fs.reconnect(ctx); err != nil {
+		return errors.Wrap(err, "failed to reconnect to fuse manager")
+	}
+	return f(ctx)
+}
+
+func (fs *Filesystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return fs.call(ctx, func(ctx context.Context) error {
+		_, err := fs.client.Mount(ctx, &MountRequest{Mountpoint: mountpoint, Labels: labels})
+		return err
+	})
+}
+
+func (fs *Filesystem) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return fs.call(ctx, func(ctx context.Context) error {
+		_, err := fs.client.Check(ctx, &CheckRequest{Mountpoint: mountpoint, Labels: labels})
+		return err
+	})
+}
+
+func (fs *Filesystem) Unmount(ctx context.Context, mountpoint string) error {
+	return fs.call(ctx, func(ctx context.Context) error {
+		_, err := fs.client.Unmount(ctx, &UnmountRequest{Mountpoint: mountpoint})
+		return err
+	})
+}
+
+func (fs *Filesystem) Stats(ctx context.Context, mountpoint string) (st snapshot.Stats, _ error) {
+	err := fs.call(ctx, func(ctx context.Context) error {
+		res, err := fs.client.Stats(ctx, &StatsRequest{Mountpoint: mountpoint})
+		if err != nil {
+			return err
+		}
+		st = snapshot.Stats{
+			Size:        res.Size,
+			FetchedSize: res.FetchedSize,
+			Degraded:    res.Degraded,
+		}
+		return nil
+	})
+	return st, err
+}
+
+// Refresh, InvalidateTransports, CacheStats, EvictCaches and the background
+// fetch APIs forward the admin operations of the snapshotter to the filesystem
+// in the fuse manager. Operations without an error return log the failures.
+
+func (fs *Filesystem) Refresh(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return fs.call(ctx, func(ctx context.Context) error {
+		_, err := fs.client.Refresh(ctx, &RefreshRequest{Mountpoint: mountpoint, Labels: labels})
+		return err
+	})
+}
+
+func (fs *Filesystem) InvalidateTransports() {
+	ctx := context.Background()
+	if err := fs.call(ctx, func(ctx context.Context) error {
+		_, err := fs.client.InvalidateTransports(ctx, &InvalidateTransportsRequest{})
+		return err
+	}); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to invalidate transports of fuse manager")
+	}
+}
+
+func (fs *Filesystem) CacheStats(ctx context.Context) (st snapshot.CacheStats) {
+	if err := fs.call(ctx, func(ctx context.Context) error {
+		res, err := fs.client.CacheStats(ctx, &CacheStatsRequest{})
+		if err != nil {
+			return err
+		}
+		st = cacheStats(res)
+		return nil
+	}); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to get cache statistics of fuse manager")
+	}
+	return st
+}
+
+func (fs *Filesystem) EvictCaches(ctx context.Context) (st snapshot.CacheStats) {
+	if err := fs.call(ctx, func(ctx context.Context) error {
+		res, err := fs.client.EvictCaches(ctx, &CacheStatsRequest{})
+		if err != nil {
+			return err
+		}
+		st = cacheStats(res)
+		return nil
+	}); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to evict caches of fuse manager")
+	}
+	return st
+}
+
+func (fs *Filesystem) SetBackgroundFetch(ctx context.Context, cfg snapshot.BackgroundFetchConfig) {
+	if err := fs.call(ctx, func(ctx context.Context) error {
+		_, err := fs.client.SetBackgroundFetch(ctx, &SetBackgroundFetchRequest{Paused: cfg.Paused, Bandwidth: cfg.Bandwidth})
+		return err
+	}); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to configure background fetch of fuse manager")
+	}
+}
+
+func (fs *Filesystem) BackgroundFetch(ctx context.Context) (cfg snapshot.BackgroundFetchConfig) {
+	if err := fs.call(ctx, func(ctx context.Context) error {
+		res, err := fs.client.GetBackgroundFetch(ctx, &GetBackgroundFetchRequest{})
+		if err != nil {
+			return err
+		}
+		cfg = snapshot.BackgroundFetchConfig{Paused: res.Paused, Bandwidth: res.Bandwidth}
+		return nil
+	}); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to get background fetch state of fuse manager")
+	}
+	return cfg
+}
+
+// UpdateLabels, Identity, Source, Capabilities, Health, WaitForPrefetch and
+// SetFullyCachedHandler forward the calls of the snapshotter to the filesystem
+// in the fuse manager. They behave as no-op if the filesystem doesn't support
+// the operation.
+
+func (fs *Filesystem) UpdateLabels(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return ignoreUnimplemented(fs.call(ctx, func(ctx context.Context) error {
+		_, err := fs.client.UpdateLabels(ctx, &UpdateLabelsRequest{Mountpoint: mountpoint, Labels: labels})
+		return err
+	}))
+}
+
+func (fs *Filesystem) Identity(ctx context.Context, mountpoint string) (ident string, _ error) {
+	err := fs.call(ctx, func(ctx context.Context) error {
+		res, err := fs.client.Identity(ctx, &IdentityRequest{Mountpoint: mountpoint})
+		if err != nil {
+			return err
+		}
+		ident = res.Identity
+		return nil
+	})
+	return ident, ignoreUnimplemented(err)
+}
+
+func (fs *Filesystem) Source(ctx context.Context, mountpoint string) (src snapshot.Source, _ error) {
+	err := fs.call(ctx, func(ctx context.Context) error {
+		res, err := fs.client.Source(ctx, &SourceRequest{Mountpoint: mountpoint})
+		if err != nil {
+			return err
+		}
+		src = snapshot.Source{Ref: res.Ref, Digest: res.Digest}
+		return nil
+	})
+	return src, ignoreUnimplemented(err)
+}
+
+func (fs *Filesystem) Capabilities(ctx context.Context) (caps snapshot.Capabilities) {
+	if err := ignoreUnimplemented(fs.call(ctx, func(ctx context.Context) error {
+		res, err := fs.client.Capabilities(ctx, &CapabilitiesRequest{})
+		if err != nil {
+			return err
+		}
+		caps = snapshot.Capabilities{
+			Name:         res.Name,
+			MediaTypes:   res.MediaTypes,
+			Verification: res.Verification,
+			Offline:      res.Offline,
+			Features:     res.Features,
+			Compressions: res.Compressions,
+		}
+		return nil
+	})); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to get capabilities of fuse manager")
+	}
+	return caps
+}
+
+// Health returns an error if the fuse manager is unreachable or its filesystem
+// is unhealthy.
+func (fs *Filesystem) Health(ctx context.Context) error {
+	var res *HealthResponse
+	if err := fs.call(ctx, func(ctx context.Context) (err error) {
+		res, err = fs.client.Health(ctx, &HealthRequest{})
+		return err
+	}); err != nil {
+		if status.Code(err) == codes.Unimplemented {
+			return nil
+		}
+		return errors.Wrap(err, "fuse manager is unavailable")
+	}
+	if res.Error != "" {
+		return errors.New(res.Error)
+	}
+	return nil
+}
+
+func (fs *Filesystem) WaitForPrefetch(ctx context.Context, mountpoint string) error {
+	return ignoreUnimplemented(fs.call(ctx, func(ctx context.Context) error {
+		_, err := fs.client.WaitForPrefetch(ctx, &WaitForPrefetchRequest{Mountpoint: mountpoint})
+		return err
+	}))
+}
+
+// SetFullyCachedHandler starts watching the layers fully cached in the fuse
+// manager until Close. The layers which got fully cached while the snapshotter
+// was down are notified when the watch starts.
+func (fs *Filesystem) SetFullyCachedHandler(h func(ctx context.Context, mountpoint string)) {
+	go fs.watchFullyCached(h)
+}
+
+func (fs *Filesystem) watchFullyCached(h func(ctx context.Context, mountpoint string)) {
+	ctx := fs.ctx
+	for {
+		err := fs.call(ctx, func(ctx context.Context) error {
+			stream, err := fs.client.WatchFullyCached(ctx, &WatchFullyCachedRequest{}, grpc.WaitForReady(true))
+			if err != nil {
+				return err
+			}
+			for {
+				ev, err := stream.Recv()
+				if err != nil {
+					return err
+				}
+				h(ctx, ev.Mountpoint)
+			}
+		})
+		if status.Code(err) == codes.Unimplemented {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryInterval):
+		}
+		log.G(ctx).WithError(err).Debug("watching fully cached layers again")
+	}
+}
+
+// ignoreUnimplemented returns nil if err reports that the filesystem in the
+// fuse manager doesn't support the operation.
+func ignoreUnimplemented(err error) error {
+	if status.Code(err) == codes.Unimplemented {
+		return nil
+	}
+	return err
+}
+
+func cacheStats(res *CacheStatsResponse) snapshot.CacheStats {
+	return snapshot.CacheStats{
+		Layers:      int(res.Layers),
+		Blobs:       int(res.Blobs),
+		LayersInUse: int(res.LayersInUse),
+	}
+}
+
+// Detached returns true because the FUSE servers run in the fuse manager.
+func (fs *Filesystem) Detached() bool {
+	return true
+}
+
+// Close closes the connection to the fuse manager. The fuse manager keeps
+// serving the mounts.
+func (fs *Filesystem) Close() error {
+	fs.cancel()
+	return fs.conn.Close()
+}
@@ -0,0 +1,835 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fusemanager
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containerd/stargz-snapshotter/snapshot"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	helperEnv     = "FUSEMANAGER_TEST_HELPER"
+	helperMessage = "fuse manager helper started"
+)
+
+// TestMain runs the test binary as a fuse manager when it's started by Start
+// in TestStart.
+func TestMain(m *testing.M) {
+	if os.Getenv(helperEnv) != "" {
+		os.Exit(runHelper())
+	}
+	os.Exit(m.Run())
+}
+
+func runHelper() int {
+	flags := flag.NewFlagSet("helper", flag.ContinueOnError)
+	address := flags.String("address", "", "")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	l, err := net.Listen("unix", *address)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	rpc := grpc.NewServer()
+	RegisterFuseManagerServer(rpc, NewServer(context.Background(), newTestFactory().newFs))
+	fmt.Println(helperMessage)
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-sigCh
+		rpc.Stop()
+	}()
+	if err := rpc.Serve(l); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func TestServerInit(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFactory()
+	srv := NewServer(ctx, f.newFs)
+
+	if _, err := srv.Mount(ctx, &MountRequest{Mountpoint: "/a"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("mount before init: got %v; want FailedPrecondition", err)
+	}
+	if _, err := srv.Init(ctx, &InitRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("init without root: got %v; want InvalidArgument", err)
+	}
+	st, err := srv.Status(ctx, &StatusRequest{})
+	if err != nil {
+		t.Fatalf("failed to get status: %v", err)
+	}
+	if st.Initialized || st.Pid != int64(os.Getpid()) {
+		t.Errorf("unexpected status before init: %+v", st)
+	}
+
+	if _, err := srv.Init(ctx, &InitRequest{Root: "/root1", Config: []byte("config")}); err != nil {
+		t.Fatalf("failed to init: %v", err)
+	}
+	if _, err := srv.Init(ctx, &InitRequest{Root: "/root1"}); err != nil {
+		t.Errorf("init again on the same root must succeed: %v", err)
+	}
+	if _, err := srv.Init(ctx, &InitRequest{Root: "/root2"}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("init on another root: got %v; want FailedPrecondition", err)
+	}
+	if n := f.count(); n != 1 {
+		t.Errorf("filesystem must be created once; created %d times", n)
+	}
+	fs := f.last()
+	if fs.root != "/root1" || string(fs.config) != "config" {
+		t.Errorf("unexpected filesystem config: root=%q, config=%q", fs.root, fs.config)
+	}
+	if st, err := srv.Status(ctx, &StatusRequest{}); err != nil || !st.Initialized {
+		t.Errorf("status must be initialized: %+v, %v", st, err)
+	}
+
+	if _, err := srv.Mount(ctx, &MountRequest{Mountpoint: "/a", Labels: map[string]string{"k": "v"}}); err != nil {
+		t.Fatalf("failed to mount: %v", err)
+	}
+	if labels, ok := fs.mounted("/a"); !ok || labels["k"] != "v" {
+		t.Errorf("layer isn't mounted with the labels: %v", labels)
+	}
+	if _, err := srv.Check(ctx, &CheckRequest{Mountpoint: "/a"}); err != nil {
+		t.Errorf("failed to check: %v", err)
+	}
+	stats, err := srv.Stats(ctx, &StatsRequest{Mountpoint: "/a"})
+	if err != nil || stats.Size != 10 || stats.FetchedSize != 5 {
+		t.Errorf("unexpected stats: %+v, %v", stats, err)
+	}
+	if _, err := srv.Unmount(ctx, &UnmountRequest{Mountpoint: "/a"}); err != nil {
+		t.Fatalf("failed to unmount: %v", err)
+	}
+	if _, ok := fs.mounted("/a"); ok {
+		t.Errorf("layer is still mounted after unmount")
+	}
+}
+
+func TestServerInitFailure(t *testing.T) {
+	ctx := context.Background()
+	f := newTestFactory()
+	f.err = fmt.Errorf("failure")
+	srv := NewServer(ctx, f.newFs)
+	if _, err := srv.Init(ctx, &InitRequest{Root: "/root"}); status.Code(err) != codes.Internal {
+		t.Fatalf("init with failing factory: got %v; want Internal", err)
+	}
+	f.setErr(nil)
+	if _, err := srv.Init(ctx, &InitRequest{Root: "/root"}); err != nil {
+		t.Fatalf("init must be retryable: %v", err)
+	}
+}
+
+func TestFilesystemReconnect(t *testing.T) {
+	ctx := context.Background()
+	address := testAddress(t)
+	f := newTestFactory()
+	ts := &testServers{t: t, address: address, newFs: f.newFs}
+	defer ts.stop()
+
+	var starts int
+	fs, err := NewFilesystem(ctx, address, "/root", []byte("config"), func(ctx context.Context) error {
+		starts++
+		ts.ensure()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+	defer fs.Close()
+	if starts != 1 || f.count() != 1 {
+		t.Fatalf("fuse manager must be started and initialized once: starts=%d, inits=%d", starts, f.count())
+	}
+	if err := fs.Mount(ctx, "/a", nil); err != nil {
+		t.Fatalf("failed to mount: %v", err)
+	}
+
+	// The fuse manager is down. The call is retried after starting it.
+	ts.stop()
+	if err := fs.Mount(ctx, "/b", nil); err != nil {
+		t.Fatalf("mount must succeed after restarting fuse manager: %v", err)
+	}
+	if starts != 2 || f.count() != 2 {
+		t.Errorf("fuse manager must be restarted and initialized again: starts=%d, inits=%d", starts, f.count())
+	}
+	if _, ok := f.last().mounted("/b"); !ok {
+		t.Errorf("layer isn't mounted on the restarted fuse manager")
+	}
+
+	// The fuse manager lost the filesystem (FailedPrecondition). The
+	// filesystem is initialized again without starting another one.
+	ts.stop()
+	ts.ensure()
+	if _, err := fs.Stats(ctx, "/c"); err != nil {
+		t.Fatalf("stats must succeed after initializing filesystem again: %v", err)
+	}
+	if starts != 3 || f.count() != 3 {
+		t.Errorf("filesystem must be initialized again: starts=%d, inits=%d", starts, f.count())
+	}
+
+	// Errors of the filesystem aren't retried.
+	f.last().setMountErr(fmt.Errorf("failure"))
+	if err := fs.Mount(ctx, "/d", nil); err == nil {
+		t.Errorf("mount must fail")
+	}
+	if starts != 3 || f.count() != 3 {
+		t.Errorf("failures of the filesystem must not reconnect: starts=%d, inits=%d", starts, f.count())
+	}
+}
+
+func TestFilesystemReconnectFailure(t *testing.T) {
+	ctx := context.Background()
+	address := testAddress(t)
+	f := newTestFactory()
+	ts := &testServers{t: t, address: address, newFs: f.newFs}
+	defer ts.stop()
+
+	startErr := error(nil)
+	fs, err := NewFilesystem(ctx, address, "/root", nil, func(ctx context.Context) error {
+		if startErr != nil {
+			return startErr
+		}
+		ts.ensure()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+	defer fs.Close()
+
+	ts.stop()
+	startErr = fmt.Errorf("failed to start")
+	if err := fs.Mount(ctx, "/a", nil); err == nil || !strings.Contains(err.Error(), "failed to start") {
+		t.Errorf("mount must fail with the start error: %v", err)
+	}
+}
+
+func TestFilesystemProxy(t *testing.T) {
+	ctx := context.Background()
+	address := testAddress(t)
+	f := newTestFactory()
+	ts := &testServers{t: t, address: address, newFs: f.newFs}
+	defer ts.stop()
+	ts.ensure()
+
+	fs, err := NewFilesystem(ctx, address, "/root", nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+	defer fs.Close()
+	tfs := f.last()
+
+	if err := fs.Refresh(ctx, "/a", map[string]string{"k": "v"}); err != nil {
+		t.Errorf("failed to refresh: %v", err)
+	}
+	if got := tfs.get(func(fs *testFs) interface{} { return fs.refreshed }); got != "/a" {
+		t.Errorf("refreshed %q; want %q", got, "/a")
+	}
+	tfs.setRefreshErr(fmt.Errorf("failure"))
+	if err := fs.Refresh(ctx, "/a", nil); err == nil {
+		t.Errorf("refresh must fail")
+	}
+
+	fs.InvalidateTransports()
+	if got := tfs.get(func(fs *testFs) interface{} { return fs.invalidated }); got != 1 {
+		t.Errorf("transports invalidated %v times; want 1", got)
+	}
+
+	want := snapshot.CacheStats{Layers: 3, Blobs: 2, LayersInUse: 1}
+	if got := fs.CacheStats(ctx); got != want {
+		t.Errorf("cache stats %+v; want %+v", got, want)
+	}
+	if got := fs.EvictCaches(ctx); got != (snapshot.CacheStats{Layers: 2, Blobs: 1}) {
+		t.Errorf("unexpected evicted caches %+v", got)
+	}
+
+	bcfg := snapshot.BackgroundFetchConfig{Paused: true, Bandwidth: 1024}
+	fs.SetBackgroundFetch(ctx, bcfg)
+	if got := fs.BackgroundFetch(ctx); got != bcfg {
+		t.Errorf("background fetch %+v; want %+v", got, bcfg)
+	}
+
+	if err := fs.UpdateLabels(ctx, "/a", map[string]string{"k": "v2"}); err != nil {
+		t.Errorf("failed to update labels: %v", err)
+	}
+	if got := tfs.get(func(fs *testFs) interface{} { return fs.updated["/a"]["k"] }); got != "v2" {
+		t.Errorf("updated label %v; want %q", got, "v2")
+	}
+	if ident, err := fs.Identity(ctx, "/a"); err != nil || ident != "ident-/a" {
+		t.Errorf("unexpected identity %q, %v", ident, err)
+	}
+	if src, err := fs.Source(ctx, "/a"); err != nil || src != (snapshot.Source{Ref: "ref", Digest: "digest"}) {
+		t.Errorf("unexpected source %+v, %v", src, err)
+	}
+	caps := fs.Capabilities(ctx)
+	if caps.Name != "test" || !caps.Offline || len(caps.MediaTypes) != 1 || len(caps.Compressions) != 1 {
+		t.Errorf("unexpected capabilities %+v", caps)
+	}
+	if err := fs.Health(ctx); err != nil {
+		t.Errorf("filesystem must be healthy: %v", err)
+	}
+	tfs.setHealthErr(fmt.Errorf("broken"))
+	if err := fs.Health(ctx); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("health must report the failure of the filesystem: %v", err)
+	}
+	if err := fs.WaitForPrefetch(ctx, "/a"); err != nil {
+		t.Errorf("failed to wait for prefetch: %v", err)
+	}
+	if got := tfs.get(func(fs *testFs) interface{} { return fs.waited }); got != "/a" {
+		t.Errorf("waited for prefetch of %q; want %q", got, "/a")
+	}
+}
+
+func TestFilesystemProxyUnimplemented(t *testing.T) {
+	ctx := context.Background()
+	address := testAddress(t)
+	ts := &testServers{t: t, address: address, newFs: func(ctx context.Context, root string, config []byte) (snapshot.FileSystem, error) {
+		return &basicFs{}, nil
+	}}
+	defer ts.stop()
+	ts.ensure()
+
+	fs, err := NewFilesystem(ctx, address, "/root", nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+	defer fs.Close()
+
+	// The operations which the filesystem doesn't support are no-op.
+	if err := fs.UpdateLabels(ctx, "/a", nil); err != nil {
+		t.Errorf("update labels: %v", err)
+	}
+	if ident, err := fs.Identity(ctx, "/a"); err != nil || ident != "" {
+		t.Errorf("identity: %q, %v", ident, err)
+	}
+	if src, err := fs.Source(ctx, "/a"); err != nil || src != (snapshot.Source{}) {
+		t.Errorf("source: %+v, %v", src, err)
+	}
+	if caps := fs.Capabilities(ctx); caps.Name != "" || len(caps.MediaTypes) != 0 {
+		t.Errorf("capabilities must be empty: %+v", caps)
+	}
+	if err := fs.Health(ctx); err != nil {
+		t.Errorf("health: %v", err)
+	}
+	if err := fs.WaitForPrefetch(ctx, "/a"); err != nil {
+		t.Errorf("wait for prefetch: %v", err)
+	}
+
+	// The fuse manager is unreachable.
+	ts.stop()
+	hctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := fs.Health(hctx); err == nil {
+		t.Errorf("health must fail when the fuse manager is unreachable")
+	}
+}
+
+func TestFilesystemFullyCached(t *testing.T) {
+	ctx := context.Background()
+	address := testAddress(t)
+	f := newTestFactory()
+	ts := &testServers{t: t, address: address, newFs: f.newFs}
+	defer ts.stop()
+	ts.ensure()
+
+	fs, err := NewFilesystem(ctx, address, "/root", nil, func(ctx context.Context) error {
+		ts.ensure()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to create filesystem: %v", err)
+	}
+	defer fs.Close()
+
+	// The layer fully cached before the watch starts is notified as well.
+	tfs := f.last()
+	tfs.notifyFullyCached("/a")
+
+	cached := make(chan string, 10)
+	fs.SetFullyCachedHandler(func(ctx context.Context, mountpoint string) {
+		cached <- mountpoint
+	})
+	wait := func(want string) {
+		select {
+		case got := <-cached:
+			if got != want {
+				t.Errorf("fully cached %q; want %q", got, want)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%q isn't notified", want)
+		}
+	}
+	wait("/a")
+	tfs.notifyFullyCached("/b")
+	wait("/b")
+
+	// The watch continues on the restarted fuse manager.
+	ts.stop()
+	if err := fs.Mount(ctx, "/c", nil); err != nil {
+		t.Fatalf("failed to mount: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for ts.watching() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("fully cached layers aren't watched on the restarted fuse manager")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	f.last().notifyFullyCached("/c")
+	wait("/c")
+}
+
+func TestServerProxyUnimplemented(t *testing.T) {
+	ctx := context.Background()
+	srv := NewServer(ctx, func(ctx context.Context, root string, config []byte) (snapshot.FileSystem, error) {
+		return &basicFs{}, nil
+	})
+	if _, err := srv.CacheStats(ctx, &CacheStatsRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("cache stats before init: got %v; want FailedPrecondition", err)
+	}
+	if _, err := srv.Init(ctx, &InitRequest{Root: "/root"}); err != nil {
+		t.Fatalf("failed to init: %v", err)
+	}
+	for name, f := range map[string]func() error{
+		"refresh": func() error {
+			_, err := srv.Refresh(ctx, &RefreshRequest{Mountpoint: "/a"})
+			return err
+		},
+		"invalidate": func() error {
+			_, err := srv.InvalidateTransports(ctx, &InvalidateTransportsRequest{})
+			return err
+		},
+		"cache stats": func() error {
+			_, err := srv.CacheStats(ctx, &CacheStatsRequest{})
+			return err
+		},
+		"evict": func() error {
+			_, err := srv.EvictCaches(ctx, &CacheStatsRequest{})
+			return err
+		},
+		"set background fetch": func() error {
+			_, err := srv.SetBackgroundFetch(ctx, &SetBackgroundFetchRequest{})
+			return err
+		},
+		"get background fetch": func() error {
+			_, err := srv.GetBackgroundFetch(ctx, &GetBackgroundFetchRequest{})
+			return err
+		},
+		"update labels": func() error {
+			_, err := srv.UpdateLabels(ctx, &UpdateLabelsRequest{Mountpoint: "/a"})
+			return err
+		},
+		"identity": func() error {
+			_, err := srv.Identity(ctx, &IdentityRequest{Mountpoint: "/a"})
+			return err
+		},
+		"source": func() error {
+			_, err := srv.Source(ctx, &SourceRequest{Mountpoint: "/a"})
+			return err
+		},
+		"capabilities": func() error {
+			_, err := srv.Capabilities(ctx, &CapabilitiesRequest{})
+			return err
+		},
+		"health": func() error {
+			_, err := srv.Health(ctx, &HealthRequest{})
+			return err
+		},
+		"wait for prefetch": func() error {
+			_, err := srv.WaitForPrefetch(ctx, &WaitForPrefetchRequest{Mountpoint: "/a"})
+			return err
+		},
+		"watch fully cached": func() error {
+			return srv.WatchFullyCached(&WatchFullyCachedRequest{}, nil)
+		},
+	} {
+		if err := f(); status.Code(err) != codes.Unimplemented {
+			t.Errorf("%s: got %v; want Unimplemented", name, err)
+		}
+	}
+}
+
+func TestStart(t *testing.T) {
+	ctx := context.Background()
+	address := testAddress(t)
+	logPath := filepath.Join(t.TempDir(), "log", "fuse-manager.log")
+	t.Setenv(helperEnv, "1")
+
+	if err := Start(ctx, os.Args[0], address, logPath); err != nil {
+		t.Fatalf("failed to start fuse manager: %v", err)
+	}
+	pid := statusPid(t, address)
+	defer syscall.Kill(pid, syscall.SIGTERM)
+	if pid == os.Getpid() {
+		t.Fatalf("fuse manager must run in another process")
+	}
+	if sid, err := unix.Getsid(pid); err != nil || sid != pid {
+		t.Errorf("fuse manager must run in its own session: sid=%d, %v", sid, err)
+	}
+
+	// The running fuse manager is reused.
+	if err := Start(ctx, os.Args[0], address, logPath); err != nil {
+		t.Fatalf("failed to start fuse manager again: %v", err)
+	}
+	if got := statusPid(t, address); got != pid {
+		t.Errorf("running fuse manager must be reused: pid %d; want %d", got, pid)
+	}
+
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("failed to read log: %v", err)
+	}
+	if !strings.Contains(string(data), helperMessage) {
+		t.Errorf("output of fuse manager isn't written to the log: %q", data)
+	}
+}
+
+func TestStartFailure(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	if err := Start(ctx, filepath.Join(dir, "nonexistent"), testAddress(t), ""); err == nil {
+		t.Errorf("starting nonexistent fuse manager must fail")
+	}
+
+	// The fuse manager exits without serving.
+	exe := filepath.Join(dir, "exit")
+	if err := os.WriteFile(exe, []byte("#!/bin/sh\necho failure\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(dir, "fuse-manager.log")
+	if err := Start(ctx, exe, testAddress(t), logPath); err == nil || !strings.Contains(err.Error(), "exited") {
+		t.Errorf("fuse manager exiting during startup must fail: %v", err)
+	}
+	if data, err := os.ReadFile(logPath); err != nil || !strings.Contains(string(data), "failure") {
+		t.Errorf("output of fuse manager isn't written to the log: %q, %v", data, err)
+	}
+}
+
+func statusPid(t *testing.T, address string) int {
+	fs, err := NewFilesystem(context.Background(), address, "/root", nil, nil)
+	if err != nil {
+		t.Fatalf("failed to connect to fuse manager: %v", err)
+	}
+	defer fs.Close()
+	st, err := fs.client.Status(context.Background(), &StatusRequest{})
+	if err != nil {
+		t.Fatalf("failed to get status: %v", err)
+	}
+	return int(st.Pid)
+}
+
+// testAddress returns the address of a unix socket. The directory isn't under
+// t.TempDir() because the path of the socket is limited in length.
+func testAddress(t *testing.T) string {
+	dir, err := os.MkdirTemp("", "fm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "sock")
+}
+
+// testServers serves the fuse manager on the address. It mimics restarts of
+// the fuse manager which lose the filesystem.
+type testServers struct {
+	t       *testing.T
+	address string
+	newFs   FilesystemFactory
+
+	mu  sync.Mutex
+	srv *grpc.Server
+	fm  *server
+}
+
+// ensure starts a new server unless it's running.
+func (ts *testServers) ensure() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.srv != nil {
+		return
+	}
+	os.Remove(ts.address)
+	l, err := net.Listen("unix", ts.address)
+	if err != nil {
+		ts.t.Fatalf("failed to listen: %v", err)
+	}
+	ts.srv = grpc.NewServer()
+	ts.fm = NewServer(context.Background(), ts.newFs).(*server)
+	RegisterFuseManagerServer(ts.srv, ts.fm)
+	go ts.srv.Serve(l)
+}
+
+// watching returns the number of the watchers of fully cached layers.
+func (ts *testServers) watching() int {
+	ts.mu.Lock()
+	fm := ts.fm
+	ts.mu.Unlock()
+	if fm == nil {
+		return 0
+	}
+	fm.cachedMu.Lock()
+	defer fm.cachedMu.Unlock()
+	return len(fm.watchers)
+}
+
+func (ts *testServers) stop() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.srv != nil {
+		ts.srv.Stop()
+		ts.srv, ts.fm = nil, nil
+	}
+}
+
+type testFactory struct {
+	mu  sync.Mutex
+	fss []*testFs
+	err error
+}
+
+func newTestFactory() *testFactory {
+	return &testFactory{}
+}
+
+func (f *testFactory) newFs(ctx context.Context, root string, config []byte) (snapshot.FileSystem, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	fs := &testFs{root: root, config: config, mounts: make(map[string]map[string]string)}
+	f.fss = append(f.fss, fs)
+	return fs, nil
+}
+
+func (f *testFactory) setErr(err error) {
+	f.mu.Lock()
+	f.err = err
+	f.mu.Unlock()
+}
+
+func (f *testFactory) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.fss)
+}
+
+func (f *testFactory) last() *testFs {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.fss) == 0 {
+		return nil
+	}
+	return f.fss[len(f.fss)-1]
+}
+
+// basicFs implements only snapshot.FileSystem.
+type basicFs struct{}
+
+func (*basicFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return nil
+}
+func (*basicFs) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return nil
+}
+func (*basicFs) Unmount(ctx context.Context, mountpoint string) error { return nil }
+func (*basicFs) Stats(ctx context.Context, mountpoint string) (snapshot.Stats, error) {
+	return snapshot.Stats{}, nil
+}
+
+// testFs implements snapshot.FileSystem and the interfaces of the admin
+// operations proxied by the fuse manager.
+type testFs struct {
+	root   string
+	config []byte
+
+	mu          sync.Mutex
+	mounts      map[string]map[string]string
+	mountErr    error
+	refreshed   string
+	refreshErr  error
+	invalidated int
+	bgFetch     snapshot.BackgroundFetchConfig
+	updated     map[string]map[string]string
+	healthErr   error
+	waited      string
+	cachedFn    func(ctx context.Context, mountpoint string)
+}
+
+func (fs *testFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.mountErr != nil {
+		return fs.mountErr
+	}
+	fs.mounts[mountpoint] = labels
+	return nil
+}
+
+func (fs *testFs) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return nil
+}
+
+func (fs *testFs) Unmount(ctx context.Context, mountpoint string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	delete(fs.mounts, mountpoint)
+	return nil
+}
+
+func (fs *testFs) Stats(ctx context.Context, mountpoint string) (snapshot.Stats, error) {
+	return snapshot.Stats{Size: 10, FetchedSize: 5}, nil
+}
+
+func (fs *testFs) Refresh(ctx context.Context, mountpoint string, labels map[string]string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.refreshErr != nil {
+		return fs.refreshErr
+	}
+	fs.refreshed = mountpoint
+	return nil
+}
+
+func (fs *testFs) InvalidateTransports() {
+	fs.mu.Lock()
+	fs.invalidated++
+	fs.mu.Unlock()
+}
+
+func (fs *testFs) CacheStats(ctx context.Context) snapshot.CacheStats {
+	return snapshot.CacheStats{Layers: 3, Blobs: 2, LayersInUse: 1}
+}
+
+func (fs *testFs) EvictCaches(ctx context.Context) snapshot.CacheStats {
+	return snapshot.CacheStats{Layers: 2, Blobs: 1}
+}
+
+func (fs *testFs) SetBackgroundFetch(ctx context.Context, cfg snapshot.BackgroundFetchConfig) {
+	fs.mu.Lock()
+	fs.bgFetch = cfg
+	fs.mu.Unlock()
+}
+
+func (fs *testFs) BackgroundFetch(ctx context.Context) snapshot.BackgroundFetchConfig {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.bgFetch
+}
+
+func (fs *testFs) UpdateLabels(ctx context.Context, mountpoint string, labels map[string]string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.updated == nil {
+		fs.updated = make(map[string]map[string]string)
+	}
+	fs.updated[mountpoint] = labels
+	return nil
+}
+
+func (fs *testFs) Identity(ctx context.Context, mountpoint string) (string, error) {
+	return "ident-" + mountpoint, nil
+}
+
+func (fs *testFs) Source(ctx context.Context, mountpoint string) (snapshot.Source, error) {
+	return snapshot.Source{Ref: "ref", Digest: "digest"}, nil
+}
+
+func (fs *testFs) Capabilities(ctx context.Context) snapshot.Capabilities {
+	return snapshot.Capabilities{
+		Name:         "test",
+		MediaTypes:   []string{"application/vnd.oci.image.layer.v1.tar+gzip"},
+		Offline:      true,
+		Compressions: []string{"gzip"},
+	}
+}
+
+func (fs *testFs) Health(ctx context.Context) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.healthErr
+}
+
+func (fs *testFs) WaitForPrefetch(ctx context.Context, mountpoint string) error {
+	fs.mu.Lock()
+	fs.waited = mountpoint
+	fs.mu.Unlock()
+	return nil
+}
+
+func (fs *testFs) SetFullyCachedHandler(h func(ctx context.Context, mountpoint string)) {
+	fs.mu.Lock()
+	fs.cachedFn = h
+	fs.mu.Unlock()
+}
+
+func (fs *testFs) notifyFullyCached(mountpoint string) {
+	fs.mu.Lock()
+	h := fs.cachedFn
+	fs.mu.Unlock()
+	h(context.Background(), mountpoint)
+}
+
+func (fs *testFs) setHealthErr(err error) {
+	fs.mu.Lock()
+	fs.healthErr = err
+	fs.mu.Unlock()
+}
+
+func (fs *testFs) mounted(mountpoint string) (map[string]string, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	labels, ok := fs.mounts[mountpoint]
+	return labels, ok
+}
+
+func (fs *testFs) setMountErr(err error) {
+	fs.mu.Lock()
+	fs.mountErr = err
+	fs.mu.Unlock()
+}
+
+func (fs *testFs) setRefreshErr(err error) {
+	fs.mu.Lock()
+	fs.refreshErr = err
+	fs.mu.Unlock()
+}
+
+func (fs *testFs) get(f func(fs *testFs) interface{}) interface{} {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return f(fs)
+}
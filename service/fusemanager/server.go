@@ -0,0 +1,418 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fusemanager
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/stargz-snapshotter/snapshot"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FilesystemFactory returns the filesystem on the root directory configured
+// with the config passed to Init. The format of the config is agreed between
+// the factory and the client.
+type FilesystemFactory func(ctx context.Context, root string, config []byte) (snapshot.FileSystem, error)
+
+// NewServer returns the server of FuseManager service. The filesystem is created
+// by newFs on the first Init. ctx is used during the lifetime of the filesystem.
+func NewServer(ctx context.Context, newFs FilesystemFactory) FuseManagerServer {
+	return &server{
+		ctx:      ctx,
+		newFs:    newFs,
+		cached:   make(map[string]struct{}),
+		watchers: make(map[chan string]struct{}),
+	}
+}
+
+type server struct {
+	ctx   context.Context
+	newFs FilesystemFactory
+
+	mu   sync.Mutex
+	fs   snapshot.FileSystem
+	root string
+
+	// cached is the set of the mountpoints of the fully cached layers and
+	// watchers receive them. They are protected by cachedMu.
+	cached   map[string]struct{}
+	watchers map[chan string]struct{}
+	cachedMu sync.Mutex
+}
+
+func (s *server) Status(ctx context.Context, req *StatusRequest) (*StatusResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return &StatusResponse{
+		Initialized: s.fs != nil,
+		Pid:         int64(os.Getpid()),
+	}, nil
+}
+
+// Init configures the filesystem. The filesystem keeps serving the mounts across
+// restarts of the snapshotter so the configuration passed by later calls is
+// ignored until the fuse manager restarts.
+func (s *server) Init(ctx context.Context, req *InitRequest) (*InitResponse, error) {
+	if req.Root == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "root directory must be specified")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fs != nil {
+		if s.root != req.Root {
+			return nil, status.Errorf(codes.FailedPrecondition, "filesystem is already initialized on %q", s.root)
+		}
+		log.G(ctx).Info("filesystem is already initialized; reusing it")
+		return &InitResponse{}, nil
+	}
+	fs, err := s.newFs(s.ctx, req.Root, req.Config)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to initialize filesystem: %v", err)
+	}
+	if nfs, ok := fs.(snapshot.NotifyingFileSystem); ok {
+		nfs.SetFullyCachedHandler(s.fullyCached)
+	}
+	s.fs, s.root = fs, req.Root
+	log.G(ctx).WithField("root", req.Root).Info("initialized filesystem")
+	return &InitResponse{}, nil
+}
+
+func (s *server) Mount(ctx context.Context, req *MountRequest) (*MountResponse, error) {
+	fs, err := s.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.Mount(ctx, req.Mountpoint, req.Labels); err != nil {
+		return nil, err
+	}
+	return &MountResponse{}, nil
+}
+
+func (s *server) Check(ctx context.Context, req *CheckRequest) (*CheckResponse, error) {
+	fs, err := s.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.Check(ctx, req.Mountpoint, req.Labels); err != nil {
+		return nil, err
+	}
+	return &CheckResponse{}, nil
+}
+
+func (s *server) Unmount(ctx context.Context, req *UnmountRequest) (*UnmountResponse, error) {
+	fs, err := s.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.Unmount(ctx, req.Mountpoint); err != nil {
+		return nil, err
+	}
+	s.cachedMu.Lock()
+	delete(s.cached, req.Mountpoint)
+	s.cachedMu.Unlock()
+	return &UnmountResponse{}, nil
+}
+
+func (s *server) Stats(ctx context.Context, req *StatsRequest) (*StatsResponse, error) {
+	fs, err := s.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	st, err := fs.Stats(ctx, req.Mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsResponse{
+		Size:        st.Size,
+		FetchedSize: st.FetchedSize,
+		Degraded:    st.Degraded,
+	}, nil
+}
+
+// Refresh, InvalidateTransports, CacheStats, EvictCaches and the background
+// fetch APIs proxy the admin operations of the snapshotter to the filesystem.
+// They return Unimplemented if the filesystem doesn't support the operation.
+
+func (s *server) Refresh(ctx context.Context, req *RefreshRequest) (*RefreshResponse, error) {
+	fs, err := s.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	rfs, ok := fs.(snapshot.RefreshableFileSystem)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "filesystem doesn't support refresh")
+	}
+	if err := rfs.Refresh(ctx, req.Mountpoint, req.Labels); err != nil {
+		return nil, err
+	}
+	return &RefreshResponse{}, nil
+}
+
+func (s *server) InvalidateTransports(ctx context.Context, req *InvalidateTransportsRequest) (*InvalidateTransportsResponse, error) {
+	fs, err := s.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	tfs, ok := fs.(snapshot.TransportInvalidatingFileSystem)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "filesystem doesn't support invalidating transports")
+	}
+	tfs.InvalidateTransports()
+	return &InvalidateTransportsResponse{}, nil
+}
+
+func (s *server) CacheStats(ctx context.Context, req *CacheStatsRequest) (*CacheStatsResponse, error) {
+	fs, err := s.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	cfs, ok := fs.(snapshot.CacheStatsFileSystem)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "filesystem doesn't report cache statistics")
+	}
+	return cacheStatsResponse(cfs.CacheStats(ctx)), nil
+}
+
+func (s *server) EvictCaches(ctx context.Context, req *CacheStatsRequest) (*CacheStatsResponse, error) {
+	fs, err := s.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	efs, ok := fs.(snapshot.CacheEvictingFileSystem)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "filesystem doesn't support evicting caches")
+	}
+	return cacheStatsResponse(efs.EvictCaches(ctx)), nil
+}
+
+func (s *server) SetBackgroundFetch(ctx context.Context, req *SetBackgroundFetchRequest) (*BackgroundFetchResponse, error) {
+	bfs, err := s.backgroundFetchFilesystem()
+	if err != nil {
+		return nil, err
+	}
+	bfs.SetBackgroundFetch(ctx, snapshot.BackgroundFetchConfig{Paused: req.Paused, Bandwidth: req.Bandwidth})
+	return backgroundFetchResponse(bfs.BackgroundFetch(ctx)), nil
+}
+
+func (s *server) GetBackgroundFetch(ctx context.Context, req *GetBackgroundFetchRequest) (*BackgroundFetchResponse, error) {
+	bfs, err := s.backgroundFetchFilesystem()
+	if err != nil {
+		return nil, err
+	}
+	return backgroundFetchResponse(bfs.BackgroundFetch(ctx)), nil
+}
+
+func (s *server) backgroundFetchFilesystem() (snapshot.BackgroundFetchControllingFileSystem, error) {
+	fs, err := s.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	bfs, ok := fs.(snapshot.BackgroundFetchControllingFileSystem)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "filesystem doesn't support controlling background fetch")
+	}
+	return bfs, nil
+}
+
+// UpdateLabels, Identity, Source, Capabilities, Health and WaitForPrefetch
+// proxy the optional interfaces of the filesystem used by the snapshotter.
+// They return Unimplemented if the filesystem doesn't implement the interface.
+
+func (s *server) UpdateLabels(ctx context.Context, req *UpdateLabelsRequest) (*UpdateLabelsResponse, error) {
+	fs, err := s.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	ufs, ok := fs.(snapshot.UpdatableFileSystem)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "filesystem doesn't support updating labels")
+	}
+	if err := ufs.UpdateLabels(ctx, req.Mountpoint, req.Labels); err != nil {
+		return nil, err
+	}
+	return &UpdateLabelsResponse{}, nil
+}
+
+func (s *server) Identity(ctx context.Context, req *IdentityRequest) (*IdentityResponse, error) {
+	fs, err := s.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	ifs, ok := fs.(snapshot.IdentifyingFileSystem)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "filesystem doesn't report identities of layers")
+	}
+	ident, err := ifs.Identity(ctx, req.Mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &IdentityResponse{Identity: ident}, nil
+}
+
+func (s *server) Source(ctx context.Context, req *SourceRequest) (*SourceResponse, error) {
+	fs, err := s.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	sfs, ok := fs.(snapshot.SourceFileSystem)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "filesystem doesn't report sources of layers")
+	}
+	src, err := sfs.Source(ctx, req.Mountpoint)
+	if err != nil {
+		return nil, err
+	}
+	return &SourceResponse{Ref: src.Ref, Digest: src.Digest}, nil
+}
+
+func (s *server) Capabilities(ctx context.Context, req *CapabilitiesRequest) (*CapabilitiesResponse, error) {
+	cfs, err := s.capableFilesystem()
+	if err != nil {
+		return nil, err
+	}
+	caps := cfs.Capabilities(ctx)
+	return &CapabilitiesResponse{
+		Name:         caps.Name,
+		MediaTypes:   caps.MediaTypes,
+		Verification: caps.Verification,
+		Offline:      caps.Offline,
+		Features:     caps.Features,
+		Compressions: caps.Compressions,
+	}, nil
+}
+
+func (s *server) Health(ctx context.Context, req *HealthRequest) (*HealthResponse, error) {
+	cfs, err := s.capableFilesystem()
+	if err != nil {
+		return nil, err
+	}
+	// The failure is reported in the response so that the client doesn't
+	// take it as the failure of the fuse manager.
+	res := &HealthResponse{}
+	if err := cfs.Health(ctx); err != nil {
+		res.Error = err.Error()
+	}
+	return res, nil
+}
+
+func (s *server) capableFilesystem() (snapshot.CapableFileSystem, error) {
+	fs, err := s.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	cfs, ok := fs.(snapshot.CapableFileSystem)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "filesystem doesn't declare capabilities")
+	}
+	return cfs, nil
+}
+
+func (s *server) WaitForPrefetch(ctx context.Context, req *WaitForPrefetchRequest) (*WaitForPrefetchResponse, error) {
+	fs, err := s.filesystem()
+	if err != nil {
+		return nil, err
+	}
+	pfs, ok := fs.(snapshot.PrefetchWaitingFileSystem)
+	if !ok {
+		return nil, status.Errorf(codes.Unimplemented, "filesystem doesn't support waiting for prefetch")
+	}
+	if err := pfs.WaitForPrefetch(ctx, req.Mountpoint); err != nil {
+		return nil, err
+	}
+	return &WaitForPrefetchResponse{}, nil
+}
+
+// WatchFullyCached sends the fully cached layers until the client goes away.
+// The layers fully cached while no client watches are sent to the next client.
+func (s *server) WatchFullyCached(req *WatchFullyCachedRequest, stream FuseManager_WatchFullyCachedServer) error {
+	fs, err := s.filesystem()
+	if err != nil {
+		return err
+	}
+	if _, ok := fs.(snapshot.NotifyingFileSystem); !ok {
+		return status.Errorf(codes.Unimplemented, "filesystem doesn't notify fully cached layers")
+	}
+	ch := make(chan string, 100)
+	s.cachedMu.Lock()
+	var cached []string
+	for mp := range s.cached {
+		cached = append(cached, mp)
+	}
+	s.watchers[ch] = struct{}{}
+	s.cachedMu.Unlock()
+	defer func() {
+		s.cachedMu.Lock()
+		delete(s.watchers, ch)
+		s.cachedMu.Unlock()
+	}()
+
+	for _, mp := range cached {
+		if err := stream.Send(&FullyCachedEvent{Mountpoint: mp}); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case mp := <-ch:
+			if err := stream.Send(&FullyCachedEvent{Mountpoint: mp}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
+
+// fullyCached is called by the filesystem when the layer mounted on the
+// mountpoint is fully cached.
+func (s *server) fullyCached(ctx context.Context, mountpoint string) {
+	s.cachedMu.Lock()
+	defer s.cachedMu.Unlock()
+	s.cached[mountpoint] = struct{}{}
+	for ch := range s.watchers {
+		select {
+		case ch <- mountpoint:
+		default:
+			log.G(ctx).WithField("mountpoint", mountpoint).Warn("watcher is too slow; dropping fully cached event")
+		}
+	}
+}
+
+func cacheStatsResponse(st snapshot.CacheStats) *CacheStatsResponse {
+	return &CacheStatsResponse{
+		Layers:      int64(st.Layers),
+		Blobs:       int64(st.Blobs),
+		LayersInUse: int64(st.LayersInUse),
+	}
+}
+
+func backgroundFetchResponse(cfg snapshot.BackgroundFetchConfig) *BackgroundFetchResponse {
+	return &BackgroundFetchResponse{Paused: cfg.Paused, Bandwidth: cfg.Bandwidth}
+}
+
+func (s *server) filesystem() (snapshot.FileSystem, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fs == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "filesystem isn't initialized")
+	}
+	return s.fs, nil
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+	"github.com/containerd/stargz-snapshotter/version"
+)
+
+// Info is the build information and the capabilities of the snapshotter. Fleet
+// tooling can use this for auditing which nodes support which lazy pulling
+// features.
+type Info struct {
+	// Version and Revision are the version and the VCS revision of the build.
+	Version  string `json:"version"`
+	Revision string `json:"revision"`
+
+	// FileSystems is the capabilities of the filesystems used by the
+	// snapshotter, in the order of preference.
+	FileSystems []FileSystemInfo `json:"filesystems"`
+
+	// Compressions is the compressions of layers (e.g. "gzip", "zstd") which
+	// can be lazily pulled by any of the filesystems.
+	Compressions []string `json:"compressions"`
+}
+
+// FileSystemInfo is the capabilities of a filesystem.
+type FileSystemInfo struct {
+	MediaTypes   []string `json:"mediaTypes"`
+	Verification bool     `json:"verification"`
+	Offline      bool     `json:"offline"`
+	Features     []string `json:"features"`
+	Compressions []string `json:"compressions"`
+}
+
+// GetInfo returns the build information and the capabilities of the snapshotter.
+// Capabilities are empty if the snapshotter doesn't report them.
+func GetInfo(ctx context.Context, sn snapshots.Snapshotter) Info {
+	info := Info{
+		Version:      version.Version,
+		Revision:     version.Revision,
+		FileSystems:  []FileSystemInfo{},
+		Compressions: []string{},
+	}
+	if r, ok := sn.(snbase.CapabilitiesReporter); ok {
+		compressions := make(map[string]bool)
+		for _, c := range r.Capabilities(ctx) {
+			info.FileSystems = append(info.FileSystems, FileSystemInfo{
+				MediaTypes:   c.MediaTypes,
+				Verification: c.Verification,
+				Offline:      c.Offline,
+				Features:     c.Features,
+				Compressions: c.Compressions,
+			})
+			for _, cmp := range c.Compressions {
+				if !compressions[cmp] {
+					compressions[cmp] = true
+					info.Compressions = append(info.Compressions, cmp)
+				}
+			}
+		}
+	}
+	return info
+}
+
+// InfoHandler returns the HTTP handler which responds the build information and
+// the capabilities of the snapshotter as JSON.
+func InfoHandler(sn snapshots.Snapshotter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(GetInfo(ctx, sn)); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to write info")
+		}
+	})
+}
@@ -0,0 +1,58 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+	"github.com/pkg/errors"
+)
+
+// NewInProcessSnapshotter returns the stargz snapshotter running entirely in the
+// calling process (no gRPC servers, no containerd plugins) for embedding in
+// tools and tests. It's wired up as same as the containerd plugin: credentials
+// are read from the sources in the config (the CRI-based keychain is
+// unavailable because it needs the CRI service) and the registry hosts are
+// configured by WithRegistryConfig. Credentials passed by WithCredsFuncs are
+// consulted first. The metadata is kept in memory so all snapshots are
+// forgotten when the snapshotter is closed.
+func NewInProcessSnapshotter(ctx context.Context, root string, config *Config, opts ...Option) (snapshots.Snapshotter, error) {
+	if config.FuseManagerConfig.Enable {
+		return nil, errors.New("fuse manager can't be used in process")
+	}
+	var sOpts options
+	for _, o := range opts {
+		o(&sOpts)
+	}
+	credsNotifier := sOpts.credsNotifier
+	if credsNotifier == nil {
+		credsNotifier = new(resolver.CredentialsNotifier)
+		opts = append(opts, WithCredentialsNotifier(credsNotifier))
+	}
+	credsFuncs, err := NewCredsFuncs(ctx, config, nil, credsNotifier)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to configure keychain")
+	}
+	opts = append(opts, WithCredsFuncs(credsFuncs...), WithInMemoryMetadata())
+	if sOpts.registryHosts == nil && sOpts.registryConfig != nil {
+		allCreds := append(append([]resolver.Credential{}, sOpts.credsFuncs...), credsFuncs...)
+		opts = append(opts, WithCustomRegistryHosts(resolver.RegistryHostsFromCRIConfig(ctx, *sOpts.registryConfig, allCreds...)))
+	}
+	return NewStargzSnapshotterService(ctx, root, config, opts...)
+}
@@ -0,0 +1,139 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package credhelper
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultAzureIMDSEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+	azureResource            = "https://management.azure.com/"
+
+	// azureUsername is the username of refresh tokens of ACR.
+	azureUsername = "00000000-0000-0000-0000-000000000000"
+)
+
+// azureRegistries is the registries of Azure Container Registry in the clouds.
+var azureRegistries = []string{"azurecr.io", "azurecr.cn", "azurecr.us"}
+
+// WithClientID specifies the client ID of the user-assigned managed identity
+// used by NewAzureKeychain. The system-assigned identity is used by default.
+func WithClientID(clientID string) Option {
+	return func(o *options) {
+		o.clientID = clientID
+	}
+}
+
+// NewAzureKeychain provides refresh tokens of ACR exchanged with the access
+// tokens of the managed identity of the node got from the Azure Instance
+// Metadata Service. The tokens are used only for ACR registries.
+func NewAzureKeychain(ctx context.Context, opts ...Option) resolver.Credential {
+	var aOpts options
+	for _, o := range opts {
+		o(&aOpts)
+	}
+	endpoint := aOpts.endpoint
+	if endpoint == "" {
+		endpoint = defaultAzureIMDSEndpoint
+	}
+	q := url.Values{"api-version": {"2018-02-01"}, "resource": {azureResource}}
+	if aOpts.clientID != "" {
+		q.Set("client_id", aOpts.clientID)
+	}
+	imdsURL := endpoint + "?" + q.Encode()
+	client := newHTTPClient(aOpts)
+	c := newTokenCache(func(ctx context.Context, host string) (token, error) {
+		var aad struct {
+			AccessToken string `json:"access_token"`
+			ExpiresOn   string `json:"expires_on"`
+		}
+		if err := getJSON(ctx, client, imdsURL, map[string]string{"Metadata": "true"}, &aad); err != nil {
+			return token{}, errors.Wrapf(err, "failed to get access token from Azure IMDS")
+		}
+		refreshToken, err := exchangeACRToken(ctx, client, host, aad.AccessToken)
+		if err != nil {
+			return token{}, errors.Wrapf(err, "failed to exchange access token for refresh token of %q", host)
+		}
+		expiry, ok := jwtExpiry(refreshToken)
+		if !ok {
+			sec, _ := strconv.ParseInt(aad.ExpiresOn, 10, 64)
+			expiry = time.Unix(sec, 0)
+		}
+		return token{username: azureUsername, secret: refreshToken, expiry: expiry}, nil
+	})
+	return func(host string, refspec reference.Spec) (string, string, error) {
+		if !matchHost(host, azureRegistries...) {
+			return "", "", nil
+		}
+		return c.get(ctx, host)
+	}
+}
+
+// exchangeACRToken exchanges the AAD access token for the refresh token of the
+// registry.
+func exchangeACRToken(ctx context.Context, client *http.Client, host, accessToken string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {host},
+		"access_token": {accessToken},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+host+"/oauth2/exchange",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var resp struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := doJSON(client, req, &resp); err != nil {
+		return "", err
+	}
+	return resp.RefreshToken, nil
+}
+
+// jwtExpiry returns the expiry ("exp" claim) of the JWT. The signature isn't
+// verified as this is used only for scheduling the refresh.
+func jwtExpiry(jwt string) (time.Time, bool) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(b, &claims); err != nil || claims.Exp == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(claims.Exp, 0), true
+}
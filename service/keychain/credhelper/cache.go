@@ -0,0 +1,97 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package credhelper
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/log"
+)
+
+// maxRefreshMargin is the max duration before the expiry that tokens are
+// refreshed. Tokens are refreshed after 3/4 of their lifetime if it's shorter.
+const maxRefreshMargin = 5 * time.Minute
+
+// token is the credentials valid until the expiry. Empty username and secret
+// mean that no credentials are available.
+type token struct {
+	username string
+	secret   string
+	expiry   time.Time
+}
+
+// tokenCache caches tokens per key (e.g. the host) and refreshes them before
+// they expire. Concurrent lookups of the same key fetch the token only once.
+type tokenCache struct {
+	fetch func(ctx context.Context, key string) (token, error)
+
+	entries map[string]*cacheEntry
+	mu      sync.Mutex
+
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	token     token
+	refreshAt time.Time
+	valid     bool
+	mu        sync.Mutex
+}
+
+func newTokenCache(fetch func(ctx context.Context, key string) (token, error)) *tokenCache {
+	return &tokenCache{
+		fetch:   fetch,
+		entries: make(map[string]*cacheEntry),
+		now:     time.Now,
+	}
+}
+
+// get returns the token of the key. The token is fetched if it isn't cached or
+// it's about to expire. If the refresh fails, the cached token is used until it
+// expires.
+func (c *tokenCache) get(ctx context.Context, key string) (string, string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if !ok {
+		e = &cacheEntry{}
+		c.entries[key] = e
+	}
+	c.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := c.now()
+	if e.valid && now.Before(e.refreshAt) {
+		return e.token.username, e.token.secret, nil
+	}
+	t, err := c.fetch(ctx, key)
+	if err != nil {
+		if e.valid && now.Before(e.token.expiry) {
+			log.G(ctx).WithError(err).Warnf("failed to refresh token of %q; using cached one until %v", key, e.token.expiry)
+			return e.token.username, e.token.secret, nil
+		}
+		return "", "", err
+	}
+	margin := t.expiry.Sub(now) / 4
+	if margin > maxRefreshMargin {
+		margin = maxRefreshMargin
+	}
+	e.token, e.refreshAt, e.valid = t, t.expiry.Add(-margin), true
+	return t.username, t.secret, nil
+}
@@ -0,0 +1,134 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package credhelper provides keychains of short-lived credentials of cloud
+// registries (e.g. ECR, GCR and ACR). Credentials are got from docker
+// credential helpers (e.g. docker-credential-ecr-login) or exchanged natively
+// with the identity of the node (GCP metadata server and Azure managed
+// identities). These are cached and refreshed before they expire.
+package credhelper
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+	"github.com/docker/docker-credential-helpers/client"
+	"github.com/docker/docker-credential-helpers/credentials"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultHelperCacheTTL = 15 * time.Minute
+	helperTimeout         = 30 * time.Second
+
+	// helperPrefix is the prefix of the binaries of docker credential helpers.
+	helperPrefix = "docker-credential-"
+)
+
+type options struct {
+	cacheTTL  time.Duration
+	clientID  string
+	endpoint  string
+	transport http.RoundTripper
+}
+
+type Option func(*options)
+
+// WithCacheTTL specifies the duration the credentials returned by the helper
+// are cached (default: 15m). Helpers don't report the expiry of credentials.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.cacheTTL = ttl
+	}
+}
+
+// NewCredentialHelperKeychain provides creds returned by the docker credential
+// helper (e.g. "ecr-login" for docker-credential-ecr-login in PATH). Creds are
+// cached per host following WithCacheTTL.
+func NewCredentialHelperKeychain(ctx context.Context, helper string, opts ...Option) (resolver.Credential, error) {
+	var hOpts options
+	for _, o := range opts {
+		o(&hOpts)
+	}
+	ttl := hOpts.cacheTTL
+	if ttl <= 0 {
+		ttl = defaultHelperCacheTTL
+	}
+	path, err := exec.LookPath(helperPrefix + helper)
+	if err != nil {
+		return nil, errors.Wrapf(err, "credential helper %q isn't found", helper)
+	}
+	c := newTokenCache(func(ctx context.Context, host string) (token, error) {
+		ctx, cancel := context.WithTimeout(ctx, helperTimeout)
+		defer cancel()
+		expiry := time.Now().Add(ttl)
+		creds, err := client.Get(helperProgram(ctx, path), serverURL(host))
+		if credentials.IsErrCredentialsNotFound(err) {
+			return token{expiry: expiry}, nil // other sources can be consulted
+		} else if err != nil {
+			return token{}, errors.Wrapf(err, "failed to get credentials of %q from helper %q", host, helper)
+		}
+		if creds.Username == "<token>" {
+			return token{secret: creds.Secret, expiry: expiry}, nil // identity token
+		}
+		return token{username: creds.Username, secret: creds.Secret, expiry: expiry}, nil
+	})
+	return func(host string, refspec reference.Spec) (string, string, error) {
+		return c.get(ctx, host)
+	}, nil
+}
+
+// serverURL returns the server URL passed to the helper for the host.
+func serverURL(host string) string {
+	if host == "docker.io" || host == "registry-1.docker.io" {
+		// Creds of docker.io is stored keyed by "https://index.docker.io/v1/".
+		return "https://index.docker.io/v1/"
+	}
+	return host
+}
+
+// helperProgram returns the ProgramFunc executing the helper binary, killed
+// when ctx is done.
+func helperProgram(ctx context.Context, path string) client.ProgramFunc {
+	return func(args ...string) client.Program {
+		return &helperCmd{exec.CommandContext(ctx, path, args...)}
+	}
+}
+
+type helperCmd struct {
+	*exec.Cmd
+}
+
+func (c *helperCmd) Input(in io.Reader) {
+	c.Stdin = in
+}
+
+// matchHost returns true if the host is one of the hosts or a subdomain of
+// them.
+func matchHost(host string, suffixes ...string) bool {
+	for _, s := range suffixes {
+		if host == s || strings.HasSuffix(host, "."+s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,354 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package credhelper
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+)
+
+const testHelper = `#!/bin/sh
+read url
+echo "$url" >> %[1]q
+case "$url" in
+  ok.example.com) echo '{"Username":"user","Secret":"pass"}' ;;
+  token.example.com) echo '{"Username":"<token>","Secret":"identity"}' ;;
+  https://index.docker.io/v1/) echo '{"Username":"docker","Secret":"hub"}' ;;
+  missing.example.com) echo "credentials not found in native keychain"; exit 1 ;;
+  *) echo "helper failure"; exit 1 ;;
+esac
+`
+
+func TestCredentialHelperKeychain(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	calls := filepath.Join(dir, "calls")
+	if err := os.WriteFile(filepath.Join(dir, helperPrefix+"test"), []byte(fmt.Sprintf(testHelper, calls)), 0700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	if _, err := NewCredentialHelperKeychain(ctx, "nonexistent"); err == nil {
+		t.Fatalf("keychain of nonexistent helper must fail")
+	}
+	cred, err := NewCredentialHelperKeychain(ctx, "test")
+	if err != nil {
+		t.Fatalf("failed to create keychain: %v", err)
+	}
+	tests := []struct {
+		host     string
+		username string
+		secret   string
+		wantErr  bool
+	}{
+		{host: "ok.example.com", username: "user", secret: "pass"},
+		{host: "token.example.com", secret: "identity"},
+		{host: "docker.io", username: "docker", secret: "hub"},
+		{host: "missing.example.com"},
+		{host: "fail.example.com", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			username, secret, err := cred(tt.host, reference.Spec{})
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "helper failure") {
+					t.Errorf("want helper error; got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to get creds: %v", err)
+			}
+			if username != tt.username || secret != tt.secret {
+				t.Errorf("got %q:%q; want %q:%q", username, secret, tt.username, tt.secret)
+			}
+		})
+	}
+
+	// Creds (including not found) are cached.
+	before := countLines(t, calls)
+	for _, host := range []string{"ok.example.com", "missing.example.com"} {
+		if _, _, err := cred(host, reference.Spec{}); err != nil {
+			t.Fatalf("failed to get creds of %q: %v", host, err)
+		}
+	}
+	if after := countLines(t, calls); after != before {
+		t.Errorf("cached creds must not invoke helper: %d calls; want %d", after, before)
+	}
+
+	// Creds are got again after the TTL.
+	cred, err = NewCredentialHelperKeychain(ctx, "test", WithCacheTTL(time.Nanosecond))
+	if err != nil {
+		t.Fatalf("failed to create keychain: %v", err)
+	}
+	before = countLines(t, calls)
+	for i := 0; i < 2; i++ {
+		if _, _, err := cred("ok.example.com", reference.Spec{}); err != nil {
+			t.Fatalf("failed to get creds: %v", err)
+		}
+	}
+	if after := countLines(t, calls); after != before+2 {
+		t.Errorf("expired creds must be got again: %d calls; want %d", after, before+2)
+	}
+}
+
+func countLines(t *testing.T, p string) int {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatalf("failed to read %q: %v", p, err)
+	}
+	return strings.Count(string(data), "\n")
+}
+
+func TestTokenCache(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(0, 0)
+	var (
+		fetched int
+		fetchFn func() (token, error)
+	)
+	c := newTokenCache(func(ctx context.Context, key string) (token, error) {
+		fetched++
+		return fetchFn()
+	})
+	c.now = func() time.Time { return now }
+	get := func(wantSecret string, wantErr bool, wantFetched int) {
+		t.Helper()
+		_, secret, err := c.get(ctx, "key")
+		if wantErr != (err != nil) {
+			t.Fatalf("unexpected error %v (want error: %v)", err, wantErr)
+		}
+		if secret != wantSecret {
+			t.Errorf("secret %q; want %q", secret, wantSecret)
+		}
+		if fetched != wantFetched {
+			t.Errorf("fetched %d times; want %d", fetched, wantFetched)
+		}
+	}
+
+	// Long-lived tokens are refreshed maxRefreshMargin before the expiry.
+	fetchFn = func() (token, error) { return token{secret: "a", expiry: now.Add(time.Hour)}, nil }
+	get("a", false, 1)
+	now = now.Add(time.Hour - maxRefreshMargin - time.Second)
+	get("a", false, 1)
+	now = now.Add(2 * time.Second)
+	fetchFn = func() (token, error) { return token{secret: "b", expiry: now.Add(8 * time.Minute)}, nil }
+	get("b", false, 2)
+
+	// Short-lived tokens are refreshed after 3/4 of their lifetime.
+	now = now.Add(6*time.Minute - time.Second)
+	get("b", false, 2)
+	now = now.Add(2 * time.Second)
+
+	// Failed refreshes fall back to the cached token until it expires.
+	fetchFn = func() (token, error) { return token{}, fmt.Errorf("failure") }
+	get("b", false, 3)
+	now = now.Add(2 * time.Minute)
+	get("", true, 4)
+
+	// Successful fetch recovers.
+	fetchFn = func() (token, error) { return token{secret: "c", expiry: now.Add(time.Hour)}, nil }
+	get("c", false, 5)
+}
+
+func TestTokenCacheConcurrent(t *testing.T) {
+	var fetched int32
+	c := newTokenCache(func(ctx context.Context, key string) (token, error) {
+		atomic.AddInt32(&fetched, 1)
+		time.Sleep(10 * time.Millisecond)
+		return token{secret: key, expiry: time.Now().Add(time.Hour)}, nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, secret, err := c.get(context.Background(), "key"); err != nil || secret != "key" {
+				t.Errorf("unexpected result %q, %v", secret, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetched); n != 1 {
+		t.Errorf("token must be fetched once; fetched %d times", n)
+	}
+}
+
+func TestGCPKeychain(t *testing.T) {
+	ctx := context.Background()
+	var (
+		requests int32
+		fail     int32
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing header", http.StatusForbidden)
+			return
+		}
+		if atomic.LoadInt32(&fail) != 0 {
+			http.Error(w, "failure", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "gcp-token",
+			"expires_in":   3600,
+			"token_type":   "Bearer",
+		})
+	}))
+	defer srv.Close()
+
+	cred := NewGCPKeychain(ctx, WithEndpoint(srv.URL))
+	if u, s, err := cred("example.com", reference.Spec{}); err != nil || u != "" || s != "" {
+		t.Errorf("creds must not be provided to non-GCP registries: %q:%q, %v", u, s, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("metadata server must not be accessed for non-GCP registries")
+	}
+	for _, host := range []string{"gcr.io", "asia.gcr.io", "us-docker.pkg.dev"} {
+		u, s, err := cred(host, reference.Spec{})
+		if err != nil {
+			t.Fatalf("failed to get creds of %q: %v", host, err)
+		}
+		if u != gcpUsername || s != "gcp-token" {
+			t.Errorf("unexpected creds of %q: %q:%q", host, u, s)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("token must be shared among registries; got %d requests", n)
+	}
+
+	atomic.StoreInt32(&fail, 1)
+	cred = NewGCPKeychain(ctx, WithEndpoint(srv.URL))
+	if _, _, err := cred("gcr.io", reference.Spec{}); err == nil {
+		t.Errorf("creds must fail when metadata server fails")
+	}
+}
+
+func TestAzureKeychain(t *testing.T) {
+	ctx := context.Background()
+	exp := time.Now().Add(3 * time.Hour).Truncate(time.Second)
+	refreshToken := testJWT(t, exp)
+	var exchangeFail int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/imds", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.Header.Get("Metadata") != "true" || q.Get("resource") != azureResource || q.Get("client_id") != "client" {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "aad-token",
+			"expires_on":   strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10),
+		})
+	})
+	mux.HandleFunc("/oauth2/exchange", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&exchangeFail) != 0 {
+			http.Error(w, "failure", http.StatusUnauthorized)
+			return
+		}
+		if err := r.ParseForm(); err != nil || r.Method != http.MethodPost ||
+			r.Form.Get("grant_type") != "access_token" || r.Form.Get("access_token") != "aad-token" ||
+			r.Form.Get("service") != r.Host {
+			http.Error(w, "invalid request", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"refresh_token": refreshToken})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	opts := []Option{
+		WithEndpoint(srv.URL + "/imds"),
+		WithClientID("client"),
+		withTestServer(t, srv.URL),
+	}
+
+	cred := NewAzureKeychain(ctx, opts...)
+	if u, s, err := cred("example.com", reference.Spec{}); err != nil || u != "" || s != "" {
+		t.Errorf("creds must not be provided to non-ACR registries: %q:%q, %v", u, s, err)
+	}
+	u, s, err := cred("test.azurecr.io", reference.Spec{})
+	if err != nil {
+		t.Fatalf("failed to get creds: %v", err)
+	}
+	if u != azureUsername || s != refreshToken {
+		t.Errorf("unexpected creds %q:%q", u, s)
+	}
+
+	atomic.StoreInt32(&exchangeFail, 1)
+	cred = NewAzureKeychain(ctx, opts...)
+	if _, _, err := cred("test.azurecr.io", reference.Spec{}); err == nil {
+		t.Errorf("creds must fail when token exchange fails")
+	}
+}
+
+func TestJWTExpiry(t *testing.T) {
+	exp := time.Unix(1700000000, 0)
+	if got, ok := jwtExpiry(testJWT(t, exp)); !ok || !got.Equal(exp) {
+		t.Errorf("expiry %v (%v); want %v", got, ok, exp)
+	}
+	for _, jwt := range []string{"", "a.b", "a.!!!.c", "a." + base64.RawURLEncoding.EncodeToString([]byte("{}")) + ".c"} {
+		if _, ok := jwtExpiry(jwt); ok {
+			t.Errorf("expiry of invalid JWT %q must not be found", jwt)
+		}
+	}
+}
+
+func testJWT(t *testing.T, exp time.Time) string {
+	claims, err := json.Marshal(map[string]int64{"exp": exp.Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"none"}`)) + "." + enc(claims) + ".sig"
+}
+
+// withTestServer sends all requests to the test server, keeping the Host of
+// the original request.
+func withTestServer(t *testing.T, serverURL string) Option {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func(o *options) {
+		o.transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			req = req.Clone(req.Context())
+			req.Host = req.URL.Host
+			req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+			return http.DefaultTransport.RoundTrip(req)
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
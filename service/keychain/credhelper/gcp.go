@@ -0,0 +1,122 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package credhelper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultGCPMetadataEndpoint = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+	// gcpUsername is the username of access tokens of GCP.
+	gcpUsername = "oauth2accesstoken"
+
+	requestTimeout  = 10 * time.Second
+	maxResponseSize = 1024 * 1024
+)
+
+// gcpRegistries is the registries of GCP (Container Registry and Artifact Registry).
+var gcpRegistries = []string{"gcr.io", "pkg.dev"}
+
+// WithEndpoint specifies the endpoint where tokens are got from (e.g. the
+// metadata server of GCP or Azure). This is for testing.
+func WithEndpoint(endpoint string) Option {
+	return func(o *options) {
+		o.endpoint = endpoint
+	}
+}
+
+// NewGCPKeychain provides access tokens of the default service account of the
+// node got from the metadata server of GCP. The tokens are used only for the
+// registries of GCP (gcr.io and pkg.dev).
+func NewGCPKeychain(ctx context.Context, opts ...Option) resolver.Credential {
+	var gOpts options
+	for _, o := range opts {
+		o(&gOpts)
+	}
+	endpoint := gOpts.endpoint
+	if endpoint == "" {
+		endpoint = defaultGCPMetadataEndpoint
+	}
+	client := newHTTPClient(gOpts)
+	c := newTokenCache(func(ctx context.Context, _ string) (token, error) {
+		var resp struct {
+			AccessToken string `json:"access_token"`
+			ExpiresIn   int64  `json:"expires_in"`
+		}
+		start := time.Now()
+		if err := getJSON(ctx, client, endpoint, map[string]string{"Metadata-Flavor": "Google"}, &resp); err != nil {
+			return token{}, errors.Wrapf(err, "failed to get access token from GCP metadata server")
+		}
+		return token{
+			username: gcpUsername,
+			secret:   resp.AccessToken,
+			expiry:   start.Add(time.Duration(resp.ExpiresIn) * time.Second),
+		}, nil
+	})
+	return func(host string, refspec reference.Spec) (string, string, error) {
+		if !matchHost(host, gcpRegistries...) {
+			return "", "", nil
+		}
+		return c.get(ctx, "") // the token is shared among registries
+	}
+}
+
+// newHTTPClient returns the client used for getting tokens. The transport can
+// be replaced by tests.
+func newHTTPClient(o options) *http.Client {
+	return &http.Client{Timeout: requestTimeout, Transport: o.transport}
+}
+
+// getJSON gets the JSON from the URL and decodes it into v.
+func getJSON(ctx context.Context, client *http.Client, url string, header map[string]string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	return doJSON(client, req, v)
+}
+
+// doJSON sends the request and decodes the JSON response into v.
+func doJSON(client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %v", resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(v)
+}
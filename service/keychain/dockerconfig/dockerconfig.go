@@ -18,33 +18,141 @@ package dockerconfig
 
 import (
 	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/stargz-snapshotter/service/resolver"
 	"github.com/docker/cli/cli/config"
+	"github.com/docker/cli/cli/config/configfile"
 )
 
-func NewDockerconfigKeychain(ctx context.Context) resolver.Credential {
-	cf, err := config.Load("")
+const defaultReloadInterval = 10 * time.Second
+
+type options struct {
+	onChange       func()
+	reloadInterval time.Duration
+}
+
+type Option func(*options)
+
+// WithOnChange specifies the function called when the docker config file is
+// reloaded.
+func WithOnChange(f func()) Option {
+	return func(o *options) {
+		o.onChange = f
+	}
+}
+
+// WithReloadInterval specifies the interval of checking the update of the
+// docker config file (default: 10s).
+func WithReloadInterval(interval time.Duration) Option {
+	return func(o *options) {
+		o.reloadInterval = interval
+	}
+}
+
+// NewDockerconfigKeychain provides creds in the docker config file
+// ($DOCKER_CONFIG/config.json or ~/.docker/config.json). The file is reloaded
+// when it's updated (e.g. credentials are rotated) until the context is done.
+func NewDockerconfigKeychain(ctx context.Context, opts ...Option) resolver.Credential {
+	var dcOpts options
+	for _, o := range opts {
+		o(&dcOpts)
+	}
+	interval := dcOpts.reloadInterval
+	if interval == 0 {
+		interval = defaultReloadInterval
+	}
+	kc := &keychain{path: filepath.Join(config.Dir(), config.ConfigFileName)}
+	kc.reload(ctx)
+	go kc.watch(ctx, interval, dcOpts.onChange)
+	return kc.credentials
+}
+
+type keychain struct {
+	path string
+
+	cf     *configfile.ConfigFile // nil if failed to load
+	stamp  fileStamp
+	loaded bool
+	mu     sync.RWMutex
+}
+
+// fileStamp identifies the version of the config file.
+type fileStamp struct {
+	exists  bool
+	modTime time.Time
+	size    int64
+}
+
+func statFile(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{true, fi.ModTime(), fi.Size()}
+}
+
+// reload loads the config file if it's updated since the last load and returns
+// true if it's reloaded.
+func (kc *keychain) reload(ctx context.Context) bool {
+	stamp := statFile(kc.path)
+	kc.mu.RLock()
+	loaded := kc.loaded && kc.stamp == stamp
+	kc.mu.RUnlock()
+	if loaded {
+		return false
+	}
+	cf, err := config.Load(filepath.Dir(kc.path))
 	if err != nil {
 		log.G(ctx).WithError(err).Warnf("failed to load docker config file")
-		return func(string, reference.Spec) (string, string, error) {
-			return "", "", nil
-		}
+		cf = nil
 	}
-	return func(host string, refspec reference.Spec) (string, string, error) {
-		if host == "docker.io" || host == "registry-1.docker.io" {
-			// Creds of docker.io is stored keyed by "https://index.docker.io/v1/".
-			host = "https://index.docker.io/v1/"
-		}
-		ac, err := cf.GetAuthConfig(host)
-		if err != nil {
-			return "", "", err
-		}
-		if ac.IdentityToken != "" {
-			return "", ac.IdentityToken, nil
+	kc.mu.Lock()
+	kc.cf, kc.stamp, kc.loaded = cf, stamp, true
+	kc.mu.Unlock()
+	return true
+}
+
+func (kc *keychain) watch(ctx context.Context, interval time.Duration, onChange func()) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if kc.reload(ctx) {
+				log.G(ctx).Infof("reloaded docker config file %q", kc.path)
+				if onChange != nil {
+					onChange()
+				}
+			}
+		case <-ctx.Done():
+			return
 		}
-		return ac.Username, ac.Password, nil
 	}
 }
+
+func (kc *keychain) credentials(host string, refspec reference.Spec) (string, string, error) {
+	kc.mu.RLock()
+	cf := kc.cf
+	kc.mu.RUnlock()
+	if cf == nil {
+		return "", "", nil
+	}
+	if host == "docker.io" || host == "registry-1.docker.io" {
+		// Creds of docker.io is stored keyed by "https://index.docker.io/v1/".
+		host = "https://index.docker.io/v1/"
+	}
+	ac, err := cf.GetAuthConfig(host)
+	if err != nil {
+		return "", "", err
+	}
+	if ac.IdentityToken != "" {
+		return "", ac.IdentityToken, nil
+	}
+	return ac.Username, ac.Password, nil
+}
@@ -0,0 +1,131 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package helper provides a keychain which gets credentials from an external
+// credential helper over gRPC. The API is defined in helper.proto. Messages
+// are plain structs with protobuf struct tags corresponding to the definition
+// so that they can be encoded by the default codec of gRPC.
+package helper
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/containerd/containerd/pkg/dialer"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+)
+
+const defaultRequestTimeout = 10 * time.Second
+
+// GetCredentialsRequest is the request of GetCredentials.
+type GetCredentialsRequest struct {
+	// Host is the hostname of the registry (or the mirror).
+	Host string `protobuf:"bytes,1,opt,name=host,proto3" json:"host,omitempty"`
+
+	// Ref is the reference of the image.
+	Ref string `protobuf:"bytes,2,opt,name=ref,proto3" json:"ref,omitempty"`
+}
+
+func (m *GetCredentialsRequest) Reset()         { *m = GetCredentialsRequest{} }
+func (m *GetCredentialsRequest) String() string { return fmt.Sprintf("%+v", *m) }
+func (*GetCredentialsRequest) ProtoMessage()    {}
+
+// GetCredentialsResponse is the response of GetCredentials.
+type GetCredentialsResponse struct {
+	// Username is the username. Empty with non-empty secret means the secret
+	// is an identity token.
+	Username string `protobuf:"bytes,1,opt,name=username,proto3" json:"username,omitempty"`
+
+	// Secret is the password or the identity token.
+	Secret string `protobuf:"bytes,2,opt,name=secret,proto3" json:"secret,omitempty"`
+}
+
+func (m *GetCredentialsResponse) Reset() { *m = GetCredentialsResponse{} }
+func (m *GetCredentialsResponse) String() string {
+	return "{Username:" + m.Username + " Secret:<redacted>}"
+}
+func (*GetCredentialsResponse) ProtoMessage() {}
+
+// CredentialHelperServer is the server API of CredentialHelper service.
+type CredentialHelperServer interface {
+	// GetCredentials returns the credentials of the registry host for the
+	// image. Empty username and secret mean the helper doesn't have credentials.
+	GetCredentials(context.Context, *GetCredentialsRequest) (*GetCredentialsResponse, error)
+}
+
+// RegisterCredentialHelperServer registers the CredentialHelper service to the
+// gRPC server. This is for implementing credential helpers in Go.
+func RegisterCredentialHelperServer(s *grpc.Server, srv CredentialHelperServer) {
+	s.RegisterService(&credentialHelperServiceDesc, srv)
+}
+
+var credentialHelperServiceDesc = grpc.ServiceDesc{
+	ServiceName: "stargz.credentialhelper.v1.CredentialHelper",
+	HandlerType: (*CredentialHelperServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetCredentials",
+			Handler:    getCredentialsHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "helper.proto",
+}
+
+func getCredentialsHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetCredentialsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CredentialHelperServer).GetCredentials(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/stargz.credentialhelper.v1.CredentialHelper/GetCredentials",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CredentialHelperServer).GetCredentials(ctx, req.(*GetCredentialsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// NewHelperKeychain provides creds returned by the credential helper listening
+// on the unix socket (e.g. "/run/credential-helper.sock"). The connection
+// is established lazily so the helper can start after the snapshotter.
+func NewHelperKeychain(ctx context.Context, address string) (resolver.Credential, error) {
+	conn, err := grpc.Dial(dialer.DialAddress(address),
+		grpc.WithInsecure(),
+		grpc.WithContextDialer(dialer.ContextDialer),
+	)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to credential helper %q", address)
+	}
+	return func(host string, refspec reference.Spec) (string, string, error) {
+		ctx, cancel := context.WithTimeout(ctx, defaultRequestTimeout)
+		defer cancel()
+		out := new(GetCredentialsResponse)
+		if err := conn.Invoke(ctx, "/stargz.credentialhelper.v1.CredentialHelper/GetCredentials",
+			&GetCredentialsRequest{Host: host, Ref: refspec.String()}, out); err != nil {
+			return "", "", errors.Wrapf(err, "failed to get credentials from helper %q", address)
+		}
+		return out.Username, out.Secret, nil
+	}, nil
+}
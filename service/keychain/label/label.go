@@ -0,0 +1,154 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package label
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/service/resolver"
+	"github.com/pkg/errors"
+	runtime "k8s.io/cri-api/pkg/apis/runtime/v1alpha2"
+)
+
+// defaultTTL is the default duration the credentials are kept after recorded.
+const defaultTTL = time.Hour
+
+// Keychain provides credentials passed through the snapshot label
+// (config.TargetAuthLabel) when layers of the image are mounted. This allows
+// the client (e.g. containerd forwarding the image pull secret of CRI) to pass
+// credentials of private registries without storing them on the node.
+// Credentials are kept in memory, keyed by the namespace and the image
+// reference, until they expire. They are used only for the mounts which carry
+// the label so that other namespaces (tenants) can't use them. The layers
+// fetched with them must be partitioned by the namespace (see
+// source.Source.PrivateCredentials) so that other namespaces can't read them
+// either.
+type Keychain struct {
+	auth map[authKey]*authEntry
+	ttl  time.Duration
+	mu   sync.Mutex
+}
+
+type authKey struct {
+	namespace string
+	ref       string
+}
+
+type authEntry struct {
+	auth    *runtime.AuthConfig
+	expires time.Time
+}
+
+// NewLabelKeychain returns an empty keychain. Recorded credentials expire after
+// ttl. Zero or negative ttl means the default (1h).
+func NewLabelKeychain(ttl time.Duration) *Keychain {
+	if ttl <= 0 {
+		ttl = defaultTTL
+	}
+	return &Keychain{auth: make(map[authKey]*authEntry), ttl: ttl}
+}
+
+// Record records the credentials in the labels for the image in the namespace.
+// The previous credentials of the image are replaced and expired ones are
+// removed. This returns false if the labels don't contain credentials.
+func (k *Keychain) Record(namespace string, refspec reference.Spec, labels map[string]string) (bool, error) {
+	v, ok := labels[config.TargetAuthLabel]
+	if !ok {
+		return false, nil
+	}
+	var a resolver.AuthConfig
+	if err := json.Unmarshal([]byte(v), &a); err != nil {
+		return false, errors.Wrapf(err, "invalid credentials in label %q", config.TargetAuthLabel)
+	}
+	now := time.Now()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for key, e := range k.auth {
+		if !now.Before(e.expires) {
+			delete(k.auth, key)
+		}
+	}
+	k.auth[authKey{namespace, refspec.String()}] = &authEntry{
+		auth: &runtime.AuthConfig{
+			Username:      a.Username,
+			Password:      a.Password,
+			Auth:          a.Auth,
+			IdentityToken: a.IdentityToken,
+		},
+		expires: now.Add(k.ttl),
+	}
+	return true, nil
+}
+
+func (k *Keychain) get(namespace string, refspec reference.Spec) (*runtime.AuthConfig, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key := authKey{namespace, refspec.String()}
+	e, ok := k.auth[key]
+	if !ok {
+		return nil, false
+	} else if !time.Now().Before(e.expires) {
+		delete(k.auth, key)
+		return nil, false
+	}
+	return e.auth, true
+}
+
+// RegistryHosts makes the hosts authorize requests of the images with the
+// credentials recorded for the namespace instead of the ones from other
+// sources. This must be used only for the mounts which passed the credentials
+// (i.e. Record returned true). The credentials are sent only to the registry of
+// the image, never to its mirrors. After they expire, the credentials from the
+// other sources are used.
+func (k *Keychain) RegistryHosts(namespace string, hosts source.RegistryHosts) source.RegistryHosts {
+	return func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+		regHosts, err := hosts(refspec)
+		if err != nil {
+			return nil, err
+		}
+		a, ok := k.get(namespace, refspec)
+		if !ok {
+			return regHosts, nil
+		}
+		for i, h := range regHosts {
+			if normalizeHost(h.Host) != normalizeHost(refspec.Hostname()) {
+				continue
+			}
+			regHosts[i].Authorizer = docker.NewDockerAuthorizer(
+				docker.WithAuthClient(h.Client),
+				docker.WithAuthCreds(func(host string) (string, string, error) {
+					return resolver.ParseAuth(a, host)
+				}))
+		}
+		return regHosts, nil
+	}
+}
+
+// normalizeHost regards hosts of Docker Hub as "docker.io".
+func normalizeHost(host string) string {
+	switch host {
+	case "registry-1.docker.io", "index.docker.io":
+		return "docker.io"
+	}
+	return host
+}
@@ -0,0 +1,146 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+)
+
+const (
+	// defaultTargetRefLabel and defaultTargetDigestLabel are the labels containing
+	// image reference and layer digest passed by the default labels handler of
+	// fs/source package.
+	defaultTargetRefLabel    = "containerd.io/snapshot/remote/stargz.reference"
+	defaultTargetDigestLabel = "containerd.io/snapshot/remote/stargz.digest"
+)
+
+// ImageLocality is the amount of contents of an image cached on the node.
+type ImageLocality struct {
+	// Ref is the reference of the image.
+	Ref string `json:"ref"`
+
+	// Size is the total size of the remote layers of the image.
+	Size int64 `json:"size"`
+
+	// FetchedSize is the size of the contents of the remote layers cached on the node.
+	FetchedSize int64 `json:"fetchedSize"`
+
+	// Percentage is the percentage of FetchedSize to Size.
+	Percentage float64 `json:"percentage"`
+
+	// Layers is the locality of each remote layer of the image.
+	Layers []LayerLocality `json:"layers"`
+}
+
+// LayerLocality is the amount of contents of a layer cached on the node.
+type LayerLocality struct {
+	Digest      string  `json:"digest"`
+	Size        int64   `json:"size"`
+	FetchedSize int64   `json:"fetchedSize"`
+	Percentage  float64 `json:"percentage"`
+
+	// Degraded lists the reasons why the layer is served in a degraded mode.
+	Degraded []string `json:"degraded,omitempty"`
+}
+
+// ImageLocalities returns the localities of images whose layers are mounted as
+// remote snapshots. Images are identified by the references passed through
+// snapshot labels. Layers shared among images are counted for the image which
+// pulled the layer first.
+func ImageLocalities(ctx context.Context, sn snapshots.Snapshotter) ([]ImageLocality, error) {
+	w, ok := sn.(snbase.RemoteStatsWalker)
+	if !ok {
+		return nil, fmt.Errorf("snapshotter doesn't support reporting statistics")
+	}
+	images := make(map[string]*ImageLocality)
+	if err := w.WalkRemoteStats(ctx, func(ctx context.Context, info snapshots.Info, st snbase.Stats) error {
+		ref, dgst := layerRef(info.Labels)
+		if ref == "" {
+			return nil
+		}
+		img, ok := images[ref]
+		if !ok {
+			img = &ImageLocality{Ref: ref}
+			images[ref] = img
+		}
+		img.Size += st.Size
+		img.FetchedSize += st.FetchedSize
+		img.Layers = append(img.Layers, LayerLocality{
+			Digest:      dgst,
+			Size:        st.Size,
+			FetchedSize: st.FetchedSize,
+			Percentage:  percentage(st.FetchedSize, st.Size),
+			Degraded:    st.Degraded,
+		})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	res := make([]ImageLocality, 0, len(images))
+	for _, img := range images {
+		img.Percentage = percentage(img.FetchedSize, img.Size)
+		sort.Slice(img.Layers, func(i, j int) bool { return img.Layers[i].Digest < img.Layers[j].Digest })
+		res = append(res, *img)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Ref < res[j].Ref })
+	return res, nil
+}
+
+// ImageLocalityHandler returns the HTTP handler which responds the localities
+// of images as JSON. Schedulers can use this for placing pods on nodes where
+// their images are cached.
+func ImageLocalityHandler(sn snapshots.Snapshotter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		images, err := ImageLocalities(ctx, sn)
+		if err != nil {
+			log.G(ctx).WithError(err).Warn("failed to get image localities")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(images); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to write image localities")
+		}
+	})
+}
+
+// layerRef returns the image reference and the layer digest passed through the
+// snapshot labels.
+func layerRef(labels map[string]string) (ref, dgst string) {
+	ref, dgst = labels[targetRefLabel], labels[targetDigestLabel]
+	if ref == "" {
+		ref, dgst = labels[defaultTargetRefLabel], labels[defaultTargetDigestLabel]
+	}
+	return ref, dgst
+}
+
+func percentage(fetched, size int64) float64 {
+	if size <= 0 {
+		return 100
+	}
+	return float64(fetched) * 100 / float64(size)
+}
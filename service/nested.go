@@ -0,0 +1,109 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	"context"
+	"os"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	snbase "github.com/containerd/stargz-snapshotter/snapshot"
+	"github.com/moby/sys/mountinfo"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const fuseDevice = "/dev/fuse"
+
+// checkFuse checks if FUSE is available in this environment. In nested
+// environments (e.g. DinD, kind), /dev/fuse can be missing or inaccessible
+// because of the device cgroup.
+func checkFuse() error {
+	f, err := os.OpenFile(fuseDevice, os.O_RDWR, 0)
+	if err != nil {
+		return errors.Wrapf(err, "%q is unavailable", fuseDevice)
+	}
+	return f.Close()
+}
+
+// ensureSharedMount makes sure the directory is on a shared mount so that FUSE
+// mounts under the directory are propagated to other mount namespaces (e.g. to
+// containerd running in another container sharing the directory). If the mount
+// containing the directory isn't shared, the directory is bind-mounted on itself
+// and made rshared.
+func ensureSharedMount(ctx context.Context, dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	info, err := mount.Lookup(dir)
+	if err != nil {
+		return err
+	}
+	if isShared(info) {
+		return nil
+	}
+	if info.Mountpoint != dir {
+		if err := unix.Mount(dir, dir, "", unix.MS_BIND|unix.MS_REC, ""); err != nil {
+			return errors.Wrapf(err, "failed to bind mount %q", dir)
+		}
+	}
+	if err := unix.Mount("", dir, "", unix.MS_SHARED|unix.MS_REC, ""); err != nil {
+		return errors.Wrapf(err, "failed to make %q rshared", dir)
+	}
+	log.G(ctx).Infof("made %q rshared for propagating mounts", dir)
+	return nil
+}
+
+func isShared(info mountinfo.Info) bool {
+	for _, o := range strings.Fields(info.Optional) {
+		if strings.HasPrefix(o, "shared:") {
+			return true
+		}
+	}
+	return false
+}
+
+// noFuseFileSystem is used instead of the stargz filesystem when FUSE is
+// unavailable. This makes the snapshotter fall back to pulling layers as
+// normal overlayfs snapshotter without trying to mount each layer.
+type noFuseFileSystem struct {
+	err error
+}
+
+var _ = (snbase.NamespacedFileSystem)(&noFuseFileSystem{})
+
+func (fs *noFuseFileSystem) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return fs.err
+}
+
+func (fs *noFuseFileSystem) MountInNamespace(ctx context.Context, mountpoint string, labels map[string]string, mntns *os.File) error {
+	return fs.err
+}
+
+func (fs *noFuseFileSystem) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return fs.err
+}
+
+func (fs *noFuseFileSystem) Unmount(ctx context.Context, mountpoint string) error {
+	return nil
+}
+
+func (fs *noFuseFileSystem) Stats(ctx context.Context, mountpoint string) (snbase.Stats, error) {
+	return snbase.Stats{}, fs.err
+}
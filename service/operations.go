@@ -0,0 +1,79 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package service
+
+import (
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+)
+
+// Operations enumerates the privileged operations which the snapshotter
+// configured with config can perform. See also stargzfs.Operations.
+func Operations(config *Config) []stargzfs.Operation {
+	ops := []stargzfs.Operation{{
+		Name:        "check-fuse",
+		Paths:       []string{fuseDevice},
+		Description: "checks if FUSE is available on startup",
+	}}
+	if !config.Config.RestrictedOperations {
+		ops = append(ops, stargzfs.Operation{
+			Name:        "shared-mount",
+			Syscalls:    []string{"mount"},
+			Description: "bind-mounts the root directory on itself and makes it rshared unless it's already shared",
+		})
+	}
+	ops = append(ops, stargzfs.Operations(config.Config)...)
+	ops = append(ops, stargzfs.Operation{
+		Name:        "snapshot-unmount",
+		Syscalls:    []string{"umount2"},
+		Description: "unmounts remote snapshots on cleanup and shutdown",
+	})
+	switch d := config.SnapshotterConfig.UpperDriver; d {
+	case "", "overlay":
+		if config.SnapshotterConfig.UpperQuota != "" {
+			ops = append(ops, stargzfs.Operation{
+				Name:        "upper-quota",
+				Syscalls:    []string{"mknod", "quotactl", "ioctl"},
+				Description: "creates the block device node of the backing XFS and sets the project quota of each active snapshot",
+			})
+		}
+	case "btrfs":
+		ops = append(ops, stargzfs.Operation{
+			Name:        "upper-btrfs",
+			Exec:        []string{"btrfs"},
+			Description: "creates and deletes a btrfs subvolume (and sets its qgroup limit) for each active snapshot",
+		})
+	case "zfs":
+		ops = append(ops, stargzfs.Operation{
+			Name:        "upper-zfs",
+			Exec:        []string{"zfs"},
+			Description: "creates, mounts and destroys a ZFS dataset for each active snapshot",
+		})
+	}
+	ops = append(ops, stargzfs.Operation{
+		Name:        "fsck-unmount",
+		Syscalls:    []string{"umount2"},
+		Description: "unmounts stale mounts under the snapshots directory when fsck repairs them",
+	})
+	if hook := config.SnapshotterConfig.FullyCachedHook; hook != "" {
+		ops = append(ops, stargzfs.Operation{
+			Name:        "fully-cached-hook",
+			Exec:        []string{hook},
+			Description: "executes the hook when all contents of a remote snapshot are cached",
+		})
+	}
+	return ops
+}
@@ -29,8 +29,6 @@ import (
 	ctdplugin "github.com/containerd/containerd/plugin"
 	"github.com/containerd/stargz-snapshotter/service"
 	"github.com/containerd/stargz-snapshotter/service/keychain/cri"
-	"github.com/containerd/stargz-snapshotter/service/keychain/dockerconfig"
-	"github.com/containerd/stargz-snapshotter/service/keychain/kubeconfig"
 	"github.com/containerd/stargz-snapshotter/service/resolver"
 	"github.com/pkg/errors"
 	grpc "google.golang.org/grpc"
@@ -73,14 +71,7 @@ func init() {
 			ic.Meta.Exports["root"] = root
 
 			// Configure keychain
-			credsFuncs := []resolver.Credential{dockerconfig.NewDockerconfigKeychain(ctx)}
-			if config.Config.KubeconfigKeychainConfig.EnableKeychain {
-				var opts []kubeconfig.Option
-				if kcp := config.Config.KubeconfigKeychainConfig.KubeconfigPath; kcp != "" {
-					opts = append(opts, kubeconfig.WithKubeconfigPath(kcp))
-				}
-				credsFuncs = append(credsFuncs, kubeconfig.NewKubeconfigKeychain(ctx, opts...))
-			}
+			var criCredsFunc resolver.Credential
 			if addr := config.CRIKeychainImageServicePath; config.Config.CRIKeychainConfig.EnableKeychain && addr != "" {
 				// connects to the backend CRI service (defaults to containerd socket)
 				criAddr := ic.Address
@@ -132,13 +123,19 @@ func init() {
 						log.G(ctx).WithError(err).Warnf("error on serving via socket %q", addr)
 					}
 				}()
-				credsFuncs = append(credsFuncs, criCreds)
+				criCredsFunc = criCreds
+			}
+			credsNotifier := new(resolver.CredentialsNotifier)
+			credsFuncs, err := service.NewCredsFuncs(ctx, &config.Config, criCredsFunc, credsNotifier)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to configure keychain")
 			}
 
 			// TODO(ktock): print warn if old configuration is specified.
 			// TODO(ktock): should we respect old configuration?
 			return service.NewStargzSnapshotterService(ctx, root, &config.Config,
-				service.WithCustomRegistryHosts(resolver.RegistryHostsFromCRIConfig(ctx, config.Registry, credsFuncs...)))
+				service.WithCustomRegistryHosts(resolver.RegistryHostsFromCRIConfig(ctx, config.Registry, credsFuncs...)),
+				service.WithCredentialsNotifier(credsNotifier))
 		},
 	})
 }
@@ -17,23 +17,60 @@
 package resolver
 
 import (
+	"context"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
+	dconfig "github.com/containerd/containerd/remotes/docker/config"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/pkg/errors"
 )
 
-const defaultRequestTimeoutSec = 30
+const (
+	defaultRequestTimeoutSec = 30
+
+	// rateLimitMaxRetries is the maximum number of retries of a request which is
+	// rejected with 429 (Too Many Requests).
+	rateLimitMaxRetries = 3
+
+	// rateLimitMaxWait is the maximum duration to wait for the rate limit to be
+	// lifted. If the registry asks to wait for longer, 429 is returned to the caller.
+	rateLimitMaxWait = 30 * time.Second
+
+	// rateLimitDefaultWait is used when the registry doesn't send Retry-After header.
+	rateLimitDefaultWait = time.Second
+)
 
 // Config is config for resolving registries.
 type Config struct {
 	Host map[string]HostConfig `toml:"host"`
+
+	// ConfigPath is the list of directories (separated by ":") containing
+	// containerd's hosts directories (e.g. "/etc/containerd/certs.d"). If a
+	// directory for the host (e.g. "<ConfigPath>/<host>/hosts.toml") exists,
+	// the host is configured by it and Mirrors of the host are ignored. The
+	// configured hosts are reused until hosts.toml is modified.
+	ConfigPath string `toml:"config_path"`
+
+	// UserAgent is the value of User-Agent header set to all requests to registries.
+	UserAgent string `toml:"user_agent"`
+
+	// Header is extra headers set to all requests to registries.
+	Header map[string]string `toml:"header"`
 }
 
 type HostConfig struct {
 	Mirrors []MirrorConfig `toml:"mirrors"`
+
+	// Anonymous is true means the host is accessed without credentials.
+	Anonymous bool `toml:"anonymous"`
 }
 
 type MirrorConfig struct {
@@ -48,34 +85,143 @@ type MirrorConfig struct {
 	// RequestTimeoutSec == 0 indicates the default timeout (defaultRequestTimeoutSec).
 	// RequestTimeoutSec < 0 indicates no timeout.
 	RequestTimeoutSec int `toml:"request_timeout_sec"`
+
+	// Header is extra headers set to requests to the host. These take precedence over
+	// the headers configured globally.
+	Header map[string]string `toml:"header"`
+
+	// Anonymous is true means the host is accessed without credentials. Anonymous
+	// bearer tokens are fetched from the token endpoint of the host and shared among
+	// all layers pulled from the host.
+	Anonymous bool `toml:"anonymous"`
 }
 
 type Credential func(string, reference.Spec) (string, string, error)
 
+// CredentialsNotifier notifies the subscribers that credentials of registries
+// are changed (e.g. a docker config file is updated).
+type CredentialsNotifier struct {
+	subscribers []func()
+	mu          sync.Mutex
+}
+
+// Subscribe registers the function called on changes of credentials.
+func (n *CredentialsNotifier) Subscribe(f func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.subscribers = append(n.subscribers, f)
+}
+
+// Notify calls the subscribers.
+func (n *CredentialsNotifier) Notify() {
+	n.mu.Lock()
+	subscribers := append([]func(){}, n.subscribers...)
+	n.mu.Unlock()
+	for _, f := range subscribers {
+		f()
+	}
+}
+
 // RegistryHostsFromConfig creates RegistryHosts (a set of registry configuration) from Config.
 func RegistryHostsFromConfig(cfg Config, credsFuncs ...Credential) source.RegistryHosts {
+	// Anonymous tokens don't depend on the image reference so the authorizer (and
+	// the tokens cached in it) is shared among all layers pulled from the host.
+	var (
+		anonymousAuth   = make(map[string]docker.Authorizer)
+		anonymousAuthMu sync.Mutex
+	)
+	authorizerFor := func(host string, anonymous bool, client *http.Client, ref reference.Spec) docker.Authorizer {
+		if !anonymous {
+			return docker.NewDockerAuthorizer(
+				docker.WithAuthClient(client),
+				docker.WithAuthCreds(multiCredsFuncs(ref, credsFuncs...)))
+		}
+		anonymousAuthMu.Lock()
+		defer anonymousAuthMu.Unlock()
+		if a, ok := anonymousAuth[host]; ok {
+			return a
+		}
+		a := docker.NewDockerAuthorizer(docker.WithAuthClient(client))
+		anonymousAuth[host] = a
+		return a
+	}
+	// Transports are shared among all layers pulled from the host so that
+	// connections are reused instead of being dialed by each layer. Only the
+	// lookup is done under the lock.
+	var (
+		transports   = make(map[string]*http.Transport)
+		transportsMu sync.Mutex
+	)
+	transportFor := func(host string) *http.Transport {
+		transportsMu.Lock()
+		defer transportsMu.Unlock()
+		if t, ok := transports[host]; ok {
+			return t
+		}
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		transports[host] = t
+		return t
+	}
+	// Hosts configured by hosts directories are cached per directory and host
+	// so that their transports (and connections) are reused instead of being
+	// created on each call. They are configured again when hosts.toml of the
+	// directory is modified.
+	var (
+		dirHosts   = make(map[string]dirHostsEntry)
+		dirHostsMu sync.Mutex
+	)
+	hostsFor := func(dir, host string) ([]docker.RegistryHost, error) {
+		var modTime time.Time
+		if fi, err := os.Stat(filepath.Join(dir, "hosts.toml")); err == nil {
+			modTime = fi.ModTime()
+		}
+		key := dir + "\x00" + host
+		dirHostsMu.Lock()
+		defer dirHostsMu.Unlock()
+		if e, ok := dirHosts[key]; !ok || !e.modTime.Equal(modTime) {
+			hosts, err := hostsFromDir(dir, host, cfg)
+			if err != nil {
+				return nil, err
+			}
+			dirHosts[key] = dirHostsEntry{hosts: hosts, modTime: modTime}
+		}
+		// Authorizers are set to the copy by the caller.
+		return append([]docker.RegistryHost{}, dirHosts[key].hosts...), nil
+	}
+	var hostDir func(string) (string, error)
+	if paths := filepath.SplitList(cfg.ConfigPath); len(paths) > 0 {
+		hostDir = hostDirFromRoots(paths)
+	}
 	return func(ref reference.Spec) (hosts []docker.RegistryHost, _ error) {
 		host := ref.Hostname()
+		if hostDir != nil {
+			dir, err := hostDir(host)
+			if err != nil && !errdefs.IsNotFound(err) {
+				return nil, err
+			}
+			if dir != "" {
+				hosts, err := hostsFor(dir, host)
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to configure hosts of %q from %q", host, dir)
+				}
+				for i, h := range hosts {
+					hosts[i].Authorizer = authorizerFor(h.Host, cfg.Host[host].Anonymous, h.Client, ref)
+				}
+				return hosts, nil
+			}
+		}
 		for _, h := range append(cfg.Host[host].Mirrors, MirrorConfig{
-			Host: host,
+			Host:      host,
+			Anonymous: cfg.Host[host].Anonymous,
 		}) {
-			tr := &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
-			if h.RequestTimeoutSec >= 0 {
-				if h.RequestTimeoutSec == 0 {
-					tr.Timeout = defaultRequestTimeoutSec * time.Second
-				} else {
-					tr.Timeout = time.Duration(h.RequestTimeoutSec) * time.Second
-				}
-			} // h.RequestTimeoutSec < 0 means "no timeout"
+			tr := newClient(transportFor(h.Host), requestHeader(cfg, h), h.RequestTimeoutSec)
 			config := docker.RegistryHost{
 				Client:       tr,
 				Host:         h.Host,
 				Scheme:       "https",
 				Path:         "/v2",
 				Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve,
-				Authorizer: docker.NewDockerAuthorizer(
-					docker.WithAuthClient(tr),
-					docker.WithAuthCreds(multiCredsFuncs(ref, credsFuncs...))),
+				Authorizer:   authorizerFor(h.Host, h.Anonymous, tr, ref),
 			}
 			if localhost, _ := docker.MatchLocalhost(config.Host); localhost || h.Insecure {
 				config.Scheme = "http"
@@ -89,6 +235,58 @@ func RegistryHostsFromConfig(cfg Config, credsFuncs ...Credential) source.Regist
 	}
 }
 
+// dirHostsEntry is the hosts configured by a hosts directory.
+type dirHostsEntry struct {
+	hosts   []docker.RegistryHost
+	modTime time.Time // of hosts.toml
+}
+
+// hostsFromDir returns the hosts configured in the containerd's hosts directory
+// (hosts.toml and certificate files). CA certificates, client certificates,
+// skip_verify and headers configured there are honored. Headers of hosts.toml
+// take precedence over the ones in Config. Authorizers of the returned hosts
+// aren't set.
+func hostsFromDir(dir string, host string, cfg Config) ([]docker.RegistryHost, error) {
+	hostOptions := dconfig.HostOptions{
+		HostDir: func(string) (string, error) { return dir, nil },
+	}
+	if localhost, _ := docker.MatchLocalhost(host); localhost {
+		hostOptions.DefaultScheme = "http"
+	}
+	hosts, err := dconfig.ConfigureHosts(context.Background(), hostOptions)(host)
+	if err != nil {
+		return nil, err
+	}
+	for i, h := range hosts {
+		header := requestHeader(cfg, MirrorConfig{})
+		for k, v := range h.Header {
+			header[http.CanonicalHeaderKey(k)] = v
+		}
+		hosts[i].Client = newClient(h.Client.Transport, header, 0)
+		hosts[i].Header = nil // set by the client
+	}
+	return hosts, nil
+}
+
+// newClient returns the client to the registry. Zero timeoutSec means the
+// default timeout (defaultRequestTimeoutSec) and negative means no timeout.
+func newClient(tr http.RoundTripper, header http.Header, timeoutSec int) *http.Client {
+	client := &http.Client{Transport: &rateLimitTransport{
+		inner: &headerTransport{
+			inner:  tr,
+			header: header,
+		},
+	}}
+	if timeoutSec >= 0 {
+		if timeoutSec == 0 {
+			client.Timeout = defaultRequestTimeoutSec * time.Second
+		} else {
+			client.Timeout = time.Duration(timeoutSec) * time.Second
+		}
+	}
+	return client
+}
+
 func multiCredsFuncs(ref reference.Spec, credsFuncs ...Credential) func(string) (string, string, error) {
 	return func(host string) (string, string, error) {
 		for _, f := range credsFuncs {
@@ -101,3 +299,97 @@ func multiCredsFuncs(ref reference.Spec, credsFuncs ...Credential) func(string)
 		return "", "", nil
 	}
 }
+
+// requestHeader returns headers to set to requests to the specified host.
+func requestHeader(cfg Config, h MirrorConfig) http.Header {
+	header := make(http.Header)
+	if cfg.UserAgent != "" {
+		header.Set("User-Agent", cfg.UserAgent)
+	}
+	for k, v := range cfg.Header {
+		header.Set(k, v)
+	}
+	for k, v := range h.Header {
+		header.Set(k, v)
+	}
+	return header
+}
+
+// headerTransport sets the configured headers to all requests.
+type headerTransport struct {
+	inner  http.RoundTripper
+	header http.Header
+}
+
+func (tr *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(tr.header) == 0 {
+		return tr.inner.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for k, v := range tr.header {
+		req.Header[k] = v
+	}
+	return tr.inner.RoundTrip(req)
+}
+
+// rateLimitTransport retries requests rejected with 429 (Too Many Requests)
+// respecting Retry-After header. Requests to the token endpoint are also
+// retried because this is used for the authorizer as well. Requests handling
+// 429 by themselves (i.e. chunk requests of the filesystem) aren't retried.
+type rateLimitTransport struct {
+	inner http.RoundTripper
+}
+
+func (tr *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if source.IsRateLimitHandled(req.Context()) {
+		return tr.inner.RoundTrip(req)
+	}
+	for i := 0; ; i++ {
+		resp, err := tr.inner.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || i >= rateLimitMaxRetries {
+			return resp, err
+		}
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil // the request can't be replayed
+		}
+		wait := retryAfter(resp.Header.Get("Retry-After"), rateLimitDefaultWait)
+		if wait > rateLimitMaxWait {
+			return resp, nil
+		}
+		resp.Body.Close()
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		select {
+		case <-time.After(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// retryAfter parses the value of Retry-After header which is either delay
+// seconds or an HTTP date.
+func retryAfter(v string, defaultWait time.Duration) time.Duration {
+	if v == "" {
+		return defaultWait
+	}
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		if sec < 0 {
+			return 0
+		}
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return defaultWait
+}
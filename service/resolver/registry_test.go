@@ -0,0 +1,336 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package resolver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+)
+
+func TestHostsFromDir(t *testing.T) {
+	ca := newTestCA(t)
+
+	// The registry requires the client certificate signed by the CA and the
+	// header configured in hosts.toml.
+	mtlsSrv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			http.Error(w, "no client certificate", http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-Host-Header") != "host" || r.Header.Get("X-Global-Header") != "global" {
+			http.Error(w, "missing headers", http.StatusBadRequest)
+			return
+		}
+		if r.Header.Get("X-Overridden") != "host" {
+			http.Error(w, "header of hosts.toml must take precedence", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	mtlsSrv.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "127.0.0.1")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+	mtlsSrv.StartTLS()
+	defer mtlsSrv.Close()
+
+	// The registry has the certificate not signed by the CA.
+	untrustedSrv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer untrustedSrv.Close()
+
+	root := t.TempDir()
+	mtlsHost := mtlsSrv.Listener.Addr().String()
+	mtlsDir := filepath.Join(root, mtlsHost)
+	writeFile(t, filepath.Join(mtlsDir, "ca.crt"), ca.certPEM)
+	clientCert, clientKey := ca.issuePEM(t, "client")
+	writeFile(t, filepath.Join(mtlsDir, "client.crt"), clientCert)
+	writeFile(t, filepath.Join(mtlsDir, "client.key"), clientKey)
+	writeFile(t, filepath.Join(mtlsDir, "hosts.toml"), []byte(fmt.Sprintf(`
+server = "https://%[1]s"
+
+[host."https://%[1]s"]
+  capabilities = ["pull", "resolve"]
+  ca = %[2]q
+  client = [[%[3]q, %[4]q]]
+  [host."https://%[1]s".header]
+    X-Host-Header = "host"
+    X-Overridden = "host"
+`, mtlsHost, filepath.Join(mtlsDir, "ca.crt"), filepath.Join(mtlsDir, "client.crt"), filepath.Join(mtlsDir, "client.key"))))
+
+	untrustedHost := untrustedSrv.Listener.Addr().String()
+	writeFile(t, filepath.Join(root, untrustedHost, "hosts.toml"), []byte(fmt.Sprintf(`
+server = "https://%[1]s"
+
+[host."https://%[1]s"]
+  capabilities = ["pull", "resolve"]
+  skip_verify = true
+`, untrustedHost)))
+
+	hosts := RegistryHostsFromConfig(Config{
+		ConfigPath: root,
+		Header:     map[string]string{"X-Global-Header": "global", "X-Overridden": "global"},
+	})
+	for _, tt := range []struct {
+		name string
+		host string
+	}{
+		{name: "ca, client certificate and headers", host: mtlsHost},
+		{name: "skip_verify", host: untrustedHost},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := registryHost(t, hosts, tt.host)
+			if h.Authorizer == nil {
+				t.Errorf("authorizer must be set")
+			}
+			res, err := h.Client.Get(h.Scheme + "://" + h.Host + h.Path + "/")
+			if err != nil {
+				t.Fatalf("failed to access registry: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("unexpected status %v", res.Status)
+			}
+		})
+	}
+
+	// Without the configuration, the certificates aren't trusted.
+	noConfig := RegistryHostsFromConfig(Config{})
+	for _, host := range []string{mtlsHost, untrustedHost} {
+		h := registryHost(t, noConfig, host)
+		if res, err := h.Client.Get("https://" + host + "/v2/"); err == nil {
+			res.Body.Close()
+			t.Errorf("access to %q must fail without hosts.toml", host)
+		}
+	}
+}
+
+func TestHostsFromDirCache(t *testing.T) {
+	root := t.TempDir()
+	const host = "registry.example.com"
+	hostsToml := filepath.Join(root, host, "hosts.toml")
+	writeFile(t, hostsToml, []byte(`
+server = "https://registry.example.com"
+
+[host."https://mirror.example.com"]
+  capabilities = ["pull", "resolve"]
+`))
+	hosts := RegistryHostsFromConfig(Config{ConfigPath: root})
+	transports := func() []http.RoundTripper {
+		refspec, err := reference.Parse(host + "/test:latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs, err := hosts(refspec)
+		if err != nil {
+			t.Fatalf("failed to get hosts: %v", err)
+		}
+		var trs []http.RoundTripper
+		for _, h := range hs {
+			trs = append(trs, h.Client.Transport.(*rateLimitTransport).inner.(*headerTransport).inner)
+		}
+		return trs
+	}
+
+	first := transports()
+	if len(first) != 2 {
+		t.Fatalf("unexpected number of hosts %d; want 2 (mirror and server)", len(first))
+	}
+	second := transports()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("transport %d must be reused", i)
+		}
+	}
+
+	// Modified hosts.toml is loaded again.
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(hostsToml, future, future); err != nil {
+		t.Fatal(err)
+	}
+	third := transports()
+	for i := range first {
+		if first[i] == third[i] {
+			t.Errorf("transport %d must be configured again after hosts.toml is modified", i)
+		}
+	}
+}
+
+func TestRateLimitTransport(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests++; requests%2 == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	tr := &rateLimitTransport{inner: http.DefaultTransport}
+	for _, tt := range []struct {
+		name         string
+		ctx          context.Context
+		wantStatus   int
+		wantRequests int
+	}{
+		{name: "retried", ctx: context.Background(), wantStatus: http.StatusOK, wantRequests: 2},
+		{name: "handled by the caller", ctx: source.WithRateLimitHandled(context.Background()), wantStatus: http.StatusTooManyRequests, wantRequests: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			requests = 0
+			req, err := http.NewRequestWithContext(tt.ctx, "GET", srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("failed to request: %v", err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.wantStatus || requests != tt.wantRequests {
+				t.Errorf("got status %d after %d requests; want %d after %d requests",
+					res.StatusCode, requests, tt.wantStatus, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func registryHost(t *testing.T, hosts func(reference.Spec) ([]docker.RegistryHost, error), host string) docker.RegistryHost {
+	t.Helper()
+	refspec, err := reference.Parse(host + "/test:latest")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+	hs, err := hosts(refspec)
+	if err != nil {
+		t.Fatalf("failed to get hosts: %v", err)
+	}
+	if len(hs) == 0 {
+		t.Fatalf("no host is configured")
+	}
+	return hs[0] // hosts in hosts.toml are tried first
+}
+
+func writeFile(t *testing.T, p string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testCA struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	pool    *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pool:    pool,
+	}
+}
+
+// issuePEM issues the certificate for the name (an IP address or a client
+// name) and returns the PEM-encoded certificate and key.
+func (ca *testCA) issuePEM(t *testing.T, name string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	certPEM, keyPEM := ca.issuePEM(t, name)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
@@ -18,23 +18,36 @@ package service
 
 import (
 	"context"
+	"net/http"
+	"os/exec"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/stargz-snapshotter/filesystems/s3"
 	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	fsconfig "github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/ipfs"
 	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/service/keychain/label"
 	"github.com/containerd/stargz-snapshotter/service/resolver"
 	snbase "github.com/containerd/stargz-snapshotter/snapshot"
 	"github.com/containerd/stargz-snapshotter/snapshot/overlayutils"
+	units "github.com/docker/go-units"
 	"github.com/hashicorp/go-multierror"
+	"github.com/pkg/errors"
 )
 
 type Option func(*options)
 
 type options struct {
-	credsFuncs    []resolver.Credential
-	registryHosts source.RegistryHosts
+	credsFuncs       []resolver.Credential
+	registryHosts    source.RegistryHosts
+	registryConfig   *resolver.Registry
+	credsNotifier    *resolver.CredentialsNotifier
+	inMemoryMetadata bool
 }
 
 // WithCredsFuncs specifies credsFuncs to be used for connecting to the registries.
@@ -44,6 +57,15 @@ func WithCredsFuncs(creds ...resolver.Credential) Option {
 	}
 }
 
+// WithCredentialsNotifier specifies the notifier of changes of the credentials.
+// On changes, the filesystem re-resolves the transports to registries so that
+// the new credentials are used without remounting layers.
+func WithCredentialsNotifier(n *resolver.CredentialsNotifier) Option {
+	return func(o *options) {
+		o.credsNotifier = n
+	}
+}
+
 // WithCustomRegistryHosts is registry hosts to use instead.
 func WithCustomRegistryHosts(hosts source.RegistryHosts) Option {
 	return func(o *options) {
@@ -51,6 +73,23 @@ func WithCustomRegistryHosts(hosts source.RegistryHosts) Option {
 	}
 }
 
+// WithRegistryConfig is the CRI-plugin-compatible registry configuration used by
+// NewInProcessSnapshotter as same as "registry" of the containerd plugin.
+// Ignored if WithCustomRegistryHosts is specified.
+func WithRegistryConfig(registry resolver.Registry) Option {
+	return func(o *options) {
+		o.registryConfig = &registry
+	}
+}
+
+// WithInMemoryMetadata keeps the metadata of the snapshotter in memory. See also
+// snapshot.InMemoryMetadata.
+func WithInMemoryMetadata() Option {
+	return func(o *options) {
+		o.inMemoryMetadata = true
+	}
+}
+
 // NewStargzSnapshotterService returns stargz snapshotter.
 func NewStargzSnapshotterService(ctx context.Context, root string, config *Config, opts ...Option) (snapshots.Snapshotter, error) {
 	var sOpts options
@@ -58,25 +97,154 @@ func NewStargzSnapshotterService(ctx context.Context, root string, config *Confi
 		o(&sOpts)
 	}
 
-	hosts := sOpts.registryHosts
-	if hosts == nil {
+	newHosts := func() source.RegistryHosts { return sOpts.registryHosts }
+	if sOpts.registryHosts == nil {
 		// Use RegistryHosts based on ResolverConfig and keychain
-		hosts = resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), sOpts.credsFuncs...)
+		newHosts = func() source.RegistryHosts {
+			return resolver.RegistryHostsFromConfig(resolver.Config(config.ResolverConfig), sOpts.credsFuncs...)
+		}
 	}
 
 	// Configure filesystem and snapshotter
-	fs, err := stargzfs.NewFilesystem(fsRoot(root),
-		config.Config,
-		stargzfs.WithGetSources(sources(
-			sourceFromCRILabels(hosts),      // provides source info based on CRI labels
-			source.FromDefaultLabels(hosts), // provides source info based on default labels
-		)),
+	var (
+		fs      snbase.FileSystem
+		extraFs []snbase.FileSystem
 	)
+	if err := checkFuse(); err != nil {
+		// e.g. nested containers (DinD, kind) without /dev/fuse. Layers are
+		// pulled as normal overlayfs snapshotter in this case.
+		log.G(ctx).WithError(err).Warn("FUSE is unavailable; lazy pulling is disabled")
+		fs = &noFuseFileSystem{err: errors.Wrap(err, "lazy pulling is disabled")}
+	} else {
+		if config.Config.RestrictedOperations {
+			// The root directory must be prepared as a shared mount in advance.
+			log.G(ctx).Debugf("restricted operations; skip making %q shared", root)
+		} else if err := ensureSharedMount(ctx, root); err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to make %q shared; mounts may not be propagated to other namespaces", root)
+		}
+		if config.IPFSConfig.APIEndpoint != "" {
+			ipfsfs, err := ipfs.NewFilesystem(filepath.Join(root, "ipfs"), config.Config, ipfs.Config(config.IPFSConfig))
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to configure IPFS filesystem")
+			}
+			extraFs = append(extraFs, ipfsfs)
+		}
+		if config.FuseManagerConfig.Enable {
+			if config.SnapshotterConfig.MountHelper != "" {
+				return nil, errors.Errorf("fuse manager can't be used with mount helper")
+			}
+			fs, err = newFuseManagerFileSystem(ctx, root, config)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to configure fuse manager")
+			}
+		} else {
+			getSources, err := stargzSources(newHosts, config)
+			if err != nil {
+				return nil, err
+			}
+			fs, err = stargzfs.NewFilesystem(fsRoot(root),
+				config.Config,
+				stargzfs.WithGetSources(getSources),
+			)
+			if err != nil {
+				log.G(ctx).WithError(err).Fatalf("failed to configure filesystem")
+			}
+			subscribeCredentials(ctx, fs, sOpts.credsNotifier)
+		}
+	}
+
+	// Credentials passed through the labels are never stored in the metadata.
+	snOpts := []snbase.Opt{snbase.AsynchronousRemove, snbase.TransientLabels(fsconfig.TargetAuthLabel)}
+	if sOpts.inMemoryMetadata {
+		snOpts = append(snOpts, snbase.InMemoryMetadata)
+	}
+	if len(extraFs) > 0 {
+		snOpts = append(snOpts, snbase.WithFileSystems(extraFs...))
+	}
+	if sec := config.SnapshotterConfig.RetryRemotePrepareIntervalSec; sec > 0 {
+		snOpts = append(snOpts, snbase.RetryRemotePrepare(time.Duration(sec)*time.Second,
+			config.SnapshotterConfig.RetryRemotePrepareMaxAttempts))
+	}
+	if config.SnapshotterConfig.AsyncUsage {
+		snOpts = append(snOpts, snbase.AsynchronousUsage)
+	}
+	if config.SnapshotterConfig.SourceLabels {
+		snOpts = append(snOpts, snbase.SourceLabels)
+	}
+	if sec := config.SnapshotterConfig.PrefetchWaitTimeoutSec; sec > 0 {
+		snOpts = append(snOpts, snbase.PrefetchWait(time.Duration(sec)*time.Second))
+	}
+	if config.SnapshotterConfig.Metacopy {
+		snOpts = append(snOpts, snbase.Metacopy)
+	}
+	if n := config.SnapshotterConfig.CleanupWorkers; n > 0 {
+		snOpts = append(snOpts, snbase.CleanupWorkers(n))
+	}
+	if d := config.SnapshotterConfig.Durability; d != "" {
+		snOpts = append(snOpts, snbase.WithDurability(snbase.Durability(d)))
+	}
+	if hook := config.SnapshotterConfig.FullyCachedHook; hook != "" {
+		snOpts = append(snOpts, snbase.FullyCachedHook(func(ctx context.Context, name string) {
+			if out, err := exec.CommandContext(ctx, hook, name).CombinedOutput(); err != nil {
+				log.G(ctx).WithError(err).WithField("key", name).
+					Warnf("failed to run fully cached hook: %s", string(out))
+			}
+		}))
+	}
+
+	uOpts, err := upperOpts(config)
 	if err != nil {
-		log.G(ctx).WithError(err).Fatalf("failed to configure filesystem")
+		return nil, err
+	}
+	snOpts = append(snOpts, uOpts...)
+
+	if helper := config.SnapshotterConfig.MountHelper; helper != "" {
+		sock := config.SnapshotterConfig.MountHelperSocket
+		if sock == "" {
+			sock = filepath.Join(root, "mount-helper.sock")
+		}
+		snOpts = append(snOpts, snbase.FuseMountHelper(helper, sock))
 	}
 
-	return snbase.NewSnapshotter(ctx, snapshotterRoot(root), fs, snbase.AsynchronousRemove)
+	return snbase.NewSnapshotter(ctx, snapshotterRoot(root), fs, snOpts...)
+}
+
+// Fsck validates the metadata of the snapshotter under root against the
+// snapshot directories and mounts, and repairs inconsistencies if repair is
+// true. The snapshotter must not be running. config must be the configuration
+// of the snapshotter. See also snapshot.Fsck.
+func Fsck(ctx context.Context, root string, config *Config, repair bool) ([]snbase.FsckAction, error) {
+	opts, err := upperOpts(config)
+	if err != nil {
+		return nil, err
+	}
+	return snbase.Fsck(ctx, snapshotterRoot(root), repair, opts...)
+}
+
+// upperOpts returns the options of the snapshotter for the directories of
+// active snapshots. Upper drivers and quota run privileged commands and
+// syscalls so they are unavailable in the restricted mode.
+func upperOpts(config *Config) ([]snbase.Opt, error) {
+	d, q := config.SnapshotterConfig.UpperDriver, config.SnapshotterConfig.UpperQuota
+	if config.Config.RestrictedOperations && ((d != "" && d != "overlay") || q != "") {
+		return nil, errors.Errorf("upper driver %q and upper quota are unavailable because restricted_operations is enabled", d)
+	}
+	switch d {
+	case "", "overlay":
+		if q == "" {
+			return nil, nil
+		}
+		size, err := units.RAMInBytes(q)
+		if err != nil || size <= 0 {
+			return nil, errors.Errorf("invalid upper quota %q", q)
+		}
+		return []snbase.Opt{snbase.UpperQuota(uint64(size))}, nil
+	case "btrfs":
+		return []snbase.Opt{snbase.WithUpperDriver(snbase.NewBtrfsUpperDriver(q))}, nil
+	case "zfs":
+		return []snbase.Opt{snbase.WithUpperDriver(snbase.NewZFSUpperDriver(config.SnapshotterConfig.ZFSDataset, q))}, nil
+	}
+	return nil, errors.Errorf("unknown upper driver %q", d)
 }
 
 func snapshotterRoot(root string) string {
@@ -87,6 +255,106 @@ func fsRoot(root string) string {
 	return filepath.Join(root, "stargz")
 }
 
+// stargzSources returns the sources of the layers mounted by the stargz
+// filesystem. Hosts are created by newHosts. If tenant isolation is enabled,
+// each tenant gets its own hosts and credentials passed through the labels so
+// that connections to registries and credentials are never shared among
+// tenants (custom registry hosts are shared, though). Layers stored in S3 are
+// read from there.
+func stargzSources(newHosts func() source.RegistryHosts, config *Config) (source.GetSources, error) {
+	getSources := registrySources(newHosts, config)
+	if config.S3Config.Endpoint != "" {
+		s3Sources, err := s3.Sources(s3.Config(config.S3Config), http.DefaultTransport)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to configure S3")
+		}
+		getSources = routeLayers(getSources, s3Sources, s3.IsS3Layer)
+	}
+	return getSources, nil
+}
+
+// registrySources returns the sources of the layers mounted from registries.
+func registrySources(newHosts func() source.RegistryHosts, config *Config) source.GetSources {
+	if !config.IsolateTenants {
+		return newStargzSources(newHosts(), config)
+	}
+	var (
+		tenants   = make(map[string]source.GetSources)
+		tenantsMu sync.Mutex
+	)
+	return func(labels map[string]string) ([]source.Source, error) {
+		// The label is set by the filesystem from the namespace.
+		tenant := labels[fsconfig.TargetTenantLabel]
+		tenantsMu.Lock()
+		getSources, ok := tenants[tenant]
+		if !ok {
+			getSources = newStargzSources(newHosts(), config)
+			tenants[tenant] = getSources
+		}
+		tenantsMu.Unlock()
+		return getSources(labels)
+	}
+}
+
+// newStargzSources returns the sources of the layers mounted from registries.
+// Layers stored in IPFS are mounted by the filesystem of IPFS only.
+func newStargzSources(hosts source.RegistryHosts, config *Config) source.GetSources {
+	var keychain *label.Keychain
+	if config.LabelKeychainConfig.EnableKeychain {
+		keychain = label.NewLabelKeychain(time.Duration(config.LabelKeychainConfig.CredentialsTTLSec) * time.Second)
+	}
+	getSources := sources(
+		sourceFromCRILabels(hosts),      // provides source info based on CRI labels
+		source.FromDefaultLabels(hosts), // provides source info based on default labels
+	)
+	if config.IPFSConfig.APIEndpoint != "" {
+		getSources = excludeLayers(getSources, "IPFS", ipfs.IsIPFSLayer)
+	}
+	if keychain != nil {
+		getSources = recordCredentials(getSources, keychain)
+	}
+	return getSources
+}
+
+// recordCredentials makes getSources record the credentials passed through the
+// labels so that the layers are fetched with them. The credentials are recorded
+// per tenant (namespace) and used only by the sources of the layers whose
+// labels carry them. Such sources are marked as PrivateCredentials so that the
+// layers aren't shared with other tenants.
+func recordCredentials(getSources source.GetSources, keychain *label.Keychain) source.GetSources {
+	return func(labels map[string]string) ([]source.Source, error) {
+		srcs, err := getSources(labels)
+		if err != nil {
+			return nil, err
+		}
+		namespace := labels[fsconfig.TargetTenantLabel] // set by the filesystem
+		for i, src := range srcs {
+			ok, err := keychain.Record(namespace, src.Name, labels)
+			if err != nil {
+				return nil, err
+			} else if ok {
+				srcs[i].Hosts = keychain.RegistryHosts(namespace, src.Hosts)
+				srcs[i].PrivateCredentials = true
+			}
+		}
+		return srcs, nil
+	}
+}
+
+// subscribeCredentials makes the filesystem refresh the transports to the
+// registries when the credentials are changed.
+func subscribeCredentials(ctx context.Context, fs snbase.FileSystem, n *resolver.CredentialsNotifier) {
+	if n == nil {
+		return
+	}
+	if ifs, ok := fs.(interface{ InvalidateTransports() }); ok {
+		n.Subscribe(func() {
+			log.G(ctx).Info("credentials are changed; refreshing transports to registries")
+			ifs.InvalidateTransports()
+		})
+	}
+}
+
 func sources(ps ...source.GetSources) source.GetSources {
 	return func(labels map[string]string) (source []source.Source, allErr error) {
 		for _, p := range ps {
@@ -100,6 +368,28 @@ func sources(ps ...source.GetSources) source.GetSources {
 	}
 }
 
+// routeLayers makes the layers stored in the storage (e.g. S3) use the sources
+// of the storage instead of getSources.
+func routeLayers(getSources, storageSources source.GetSources, isStored func(map[string]string) bool) source.GetSources {
+	return func(labels map[string]string) ([]source.Source, error) {
+		if isStored(labels) {
+			return storageSources(labels)
+		}
+		return getSources(labels)
+	}
+}
+
+// excludeLayers makes getSources reject the layers stored in the storage other
+// than registries (e.g. S3).
+func excludeLayers(getSources source.GetSources, storage string, isStored func(map[string]string) bool) source.GetSources {
+	return func(labels map[string]string) ([]source.Source, error) {
+		if isStored(labels) {
+			return nil, errors.Errorf("layer is stored in %s", storage)
+		}
+		return getSources(labels)
+	}
+}
+
 // Supported returns nil when the remote snapshotter is functional on the system with the root directory.
 // Supported is not called during plugin initialization, but exposed for downstream projects which uses
 // this snapshotter as a library.
@@ -0,0 +1,313 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/moby/sys/mountinfo"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// FsckStaleMount is a mount left under the snapshots directory. The
+	// snapshotter isn't running during Fsck so nothing serves the mount.
+	FsckStaleMount = "stale-mount"
+
+	// FsckOrphanDirectory is a snapshot directory without the record in the
+	// metadata.
+	FsckOrphanDirectory = "orphan-directory"
+
+	// FsckMissingDirectory is a record of a snapshot whose directory doesn't
+	// exist. Remote snapshots aren't reported because their directories are
+	// created when they are mounted again.
+	FsckMissingDirectory = "missing-directory"
+
+	// FsckBrokenParent is a record of a snapshot whose ancestor is missing its
+	// directory.
+	FsckBrokenParent = "broken-parent"
+)
+
+// FsckAction is an inconsistency found by Fsck and the result of its repair.
+type FsckAction struct {
+	// Kind is the kind of the inconsistency (e.g. FsckOrphanDirectory).
+	Kind string `json:"kind"`
+
+	// Key is the key of the snapshot. Empty if the snapshot isn't recorded.
+	Key string `json:"key,omitempty"`
+
+	// Path is the path of the directory or the mountpoint.
+	Path string `json:"path,omitempty"`
+
+	// Repaired is true if the inconsistency has been repaired.
+	Repaired bool `json:"repaired"`
+
+	// Error is the error occurred during the repair.
+	Error string `json:"error,omitempty"`
+}
+
+// Fsck validates the metadata of the snapshotter at root against the snapshot
+// directories and mounts. If repair is true, stale mounts are unmounted,
+// orphan directories are removed and records of snapshots whose contents are
+// lost (including their descendants) are removed. The snapshotter must not be
+// running; Fsck fails if the metadata is locked by another process. opts must
+// specify the upper driver (WithUpperDriver) used by the snapshotter so that
+// the volumes of the removed directories are removed as well.
+func Fsck(ctx context.Context, root string, repair bool, opts ...Opt) ([]FsckAction, error) {
+	var config SnapshotterConfig
+	for _, opt := range opts {
+		if err := opt(&config); err != nil {
+			return nil, err
+		}
+	}
+	dbfile := filepath.Join(root, "metadata.db")
+	if _, err := os.Stat(dbfile); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil // nothing recorded
+		}
+		return nil, err
+	}
+	if err := checkUnlocked(dbfile); err != nil {
+		return nil, err
+	}
+	ms, err := storage.NewMetaStore(dbfile)
+	if err != nil {
+		return nil, err
+	}
+	defer ms.Close()
+
+	snapshotDir := filepath.Join(root, "snapshots")
+	actions, err := fsckMounts(ctx, snapshotDir, repair)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, t, err := ms.TransactionContext(ctx, repair)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if t != nil {
+			t.Rollback()
+		}
+	}()
+	ids, err := storage.IDMap(ctx)
+	if err != nil && !errdefs.IsNotFound(err) {
+		return nil, err
+	}
+	var infos []snapshots.Info
+	if err := storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+		infos = append(infos, info)
+		return nil
+	}); err != nil && !errdefs.IsNotFound(err) {
+		return nil, err
+	}
+
+	a, err := fsckDirectories(ctx, snapshotDir, ids, config.upperDriver, repair)
+	if err != nil {
+		return nil, err
+	}
+	actions = append(actions, a...)
+
+	a, err = fsckRecords(ctx, snapshotDir, ids, infos, config.upperDriver, repair)
+	if err != nil {
+		return nil, err
+	}
+	actions = append(actions, a...)
+
+	if repair {
+		err = t.Commit()
+		t = nil
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to commit repaired metadata")
+		}
+	}
+	return actions, nil
+}
+
+// checkUnlocked returns an error if the metadata file is locked by a running
+// snapshotter. The lock is released before returning.
+func checkUnlocked(dbfile string) error {
+	f, err := os.Open(dbfile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err != nil {
+		if err == unix.EWOULDBLOCK {
+			return fmt.Errorf("metadata %q is locked; stop the snapshotter before fsck", dbfile)
+		}
+		return errors.Wrapf(err, "failed to lock %q", dbfile)
+	}
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
+
+// fsckMounts reports (and unmounts) mounts under the snapshots directory.
+func fsckMounts(ctx context.Context, snapshotDir string, repair bool) (actions []FsckAction, _ error) {
+	mounts, err := mountinfo.GetMounts(mountinfo.PrefixFilter(snapshotDir))
+	if err != nil {
+		return nil, err
+	}
+	// Unmount nested mounts first.
+	sort.Slice(mounts, func(i, j int) bool { return len(mounts[i].Mountpoint) > len(mounts[j].Mountpoint) })
+	for _, m := range mounts {
+		if m.Mountpoint == snapshotDir || filepath.Dir(m.Mountpoint) == snapshotDir {
+			continue // snapshot directories can be volumes (e.g. ZFS datasets)
+		}
+		a := FsckAction{Kind: FsckStaleMount, Path: m.Mountpoint}
+		if repair {
+			if err := forceUnmount(m.Mountpoint); err != nil {
+				a.Error = err.Error()
+			} else {
+				a.Repaired = true
+			}
+		}
+		log.G(ctx).WithField("repaired", a.Repaired).Infof("fsck: stale mount %q", m.Mountpoint)
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+// fsckDirectories reports (and removes) snapshot directories without records.
+func fsckDirectories(ctx context.Context, snapshotDir string, ids map[string]string, upperDriver UpperDriver, repair bool) (actions []FsckAction, _ error) {
+	fd, err := os.Open(snapshotDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fd.Close()
+	dirs, err := fd.Readdirnames(0)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(dirs)
+	for _, d := range dirs {
+		if _, ok := ids[d]; ok {
+			continue
+		}
+		dir := filepath.Join(snapshotDir, d)
+		a := FsckAction{Kind: FsckOrphanDirectory, Path: dir}
+		if repair {
+			if err := fsckRemoveDirectory(ctx, dir, upperDriver); err != nil {
+				a.Error = err.Error()
+			} else {
+				a.Repaired = true
+			}
+		}
+		log.G(ctx).WithField("repaired", a.Repaired).Infof("fsck: orphan directory %q", dir)
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+// fsckRecords reports (and removes) records of snapshots whose directories
+// don't exist. Descendants of these snapshots are also unusable so they are
+// removed as well, together with their directories.
+func fsckRecords(ctx context.Context, snapshotDir string, ids map[string]string, infos []snapshots.Info, upperDriver UpperDriver, repair bool) (actions []FsckAction, _ error) {
+	keyToID := make(map[string]string, len(ids))
+	for id, key := range ids {
+		keyToID[key] = id
+	}
+	children := make(map[string][]string)
+	parents := make(map[string]string)
+	var missing []string
+	for _, info := range infos {
+		children[info.Parent] = append(children[info.Parent], info.Name)
+		parents[info.Name] = info.Parent
+		if _, ok := info.Labels[remoteLabel]; ok {
+			continue // mounted again by the snapshotter
+		}
+		if _, err := os.Stat(filepath.Join(snapshotDir, keyToID[info.Name])); os.IsNotExist(err) {
+			missing = append(missing, info.Name)
+		}
+	}
+
+	kinds := make(map[string]string)
+	queue := missing
+	for _, key := range missing {
+		kinds[key] = FsckMissingDirectory
+	}
+	for len(queue) > 0 {
+		key := queue[0]
+		queue = queue[1:]
+		for _, c := range children[key] {
+			if _, ok := kinds[c]; !ok {
+				kinds[c] = FsckBrokenParent
+				queue = append(queue, c)
+			}
+		}
+	}
+
+	// Remove descendants before their parents.
+	depth := func(key string) (d int) {
+		for ; key != ""; key = parents[key] {
+			d++
+		}
+		return d
+	}
+	var broken []string
+	for key := range kinds {
+		broken = append(broken, key)
+	}
+	sort.Slice(broken, func(i, j int) bool {
+		if di, dj := depth(broken[i]), depth(broken[j]); di != dj {
+			return di > dj
+		}
+		return broken[i] < broken[j]
+	})
+	for _, key := range broken {
+		a := FsckAction{Kind: kinds[key], Key: key, Path: filepath.Join(snapshotDir, keyToID[key])}
+		if repair {
+			if _, _, err := storage.Remove(ctx, key); err != nil {
+				a.Error = err.Error()
+			} else if err := fsckRemoveDirectory(ctx, a.Path, upperDriver); err != nil {
+				a.Error = err.Error()
+			} else {
+				a.Repaired = true
+			}
+		}
+		log.G(ctx).WithField("repaired", a.Repaired).Infof("fsck: %s %q", a.Kind, key)
+		actions = append(actions, a)
+	}
+	return actions, nil
+}
+
+// fsckRemoveDirectory removes the snapshot directory together with its volumes
+// created by the upper driver (if any).
+func fsckRemoveDirectory(ctx context.Context, dir string, upperDriver UpperDriver) error {
+	// Never descend into a mount. Files there can be contents of layers.
+	if mounted, err := mountinfo.Mounted(filepath.Join(dir, "fs")); err == nil && mounted {
+		return fmt.Errorf("directory contains a mount")
+	}
+	if upperDriver != nil {
+		if err := upperDriver.Remove(ctx, dir); err != nil {
+			return errors.Wrapf(err, "failed to remove volume %q", dir)
+		}
+	}
+	return os.RemoveAll(dir)
+}
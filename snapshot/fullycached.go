@@ -0,0 +1,96 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"path/filepath"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+)
+
+const fullyCachedLabelVal = "true"
+
+// markFullyCached adds FullyCachedLabel to the snapshot mounted on the mountpoint.
+// This is called by filesystems when all contents of the layer are cached.
+func (o *snapshotter) markFullyCached(ctx context.Context, mountpoint string) {
+	id := filepath.Base(filepath.Dir(mountpoint))
+	if o.upperPath(id) != mountpoint {
+		log.G(ctx).WithField("mountpoint", mountpoint).Debug("not a mountpoint of snapshots")
+		return
+	}
+	name, err := o.setFullyCached(ctx, id)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("mountpoint", mountpoint).Warn("failed to mark snapshot as fully cached")
+		return
+	}
+	if name == "" {
+		return // the snapshot has been removed
+	}
+	log.G(ctx).WithField("key", name).Debug("snapshot is fully cached")
+	if o.fullyCachedHook != nil {
+		o.fullyCachedHook(ctx, name)
+	}
+}
+
+// setFullyCached adds FullyCachedLabel to the snapshot of the ID and returns its
+// name. Empty string is returned if the snapshot doesn't exist.
+func (o *snapshotter) setFullyCached(ctx context.Context, id string) (_ string, err error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, true)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			if rerr := t.Rollback(); rerr != nil {
+				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+			}
+		}
+	}()
+
+	ids, err := storage.IDMap(ctx)
+	if err != nil {
+		return "", err
+	}
+	name, ok := ids[id]
+	if !ok {
+		return "", t.Rollback()
+	}
+	_, info, _, err := storage.GetInfo(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	if err := withLabel(FullyCachedLabel, fullyCachedLabelVal)(&info); err != nil {
+		return "", err
+	}
+	if _, err := storage.UpdateInfo(ctx, info, "labels."+FullyCachedLabel); err != nil {
+		return "", err
+	}
+	return name, t.Commit()
+}
+
+func withLabel(key, value string) snapshots.Opt {
+	return func(info *snapshots.Info) error {
+		if info.Labels == nil {
+			info.Labels = make(map[string]string)
+		}
+		info.Labels[key] = value
+		return nil
+	}
+}
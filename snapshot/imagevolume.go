@@ -0,0 +1,116 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+)
+
+// ImageVolumeLabel is a snapshot label which marks a view as an image volume,
+// which mounts the read-only contents of an image into pods (e.g. Kubernetes
+// image volumes). The value is arbitrary (e.g. the ID of the pod). Image
+// volumes must be created by View.
+//
+// Unlike the rootfs of containers, image volumes are read by the workloads at
+// any time during their lifetime. So the remote snapshots used by image volumes
+// are passed to UpdatableFileSystem with this label (the value is "true") while
+// the image volumes exist, so that the filesystem can keep their caches (e.g.
+// by pinning them).
+const ImageVolumeLabel = "containerd.io/snapshot/remote/image-volume"
+
+// isImageVolume returns true if the labels mark the snapshot as an image volume.
+func isImageVolume(labels map[string]string) bool {
+	return labels[ImageVolumeLabel] != ""
+}
+
+// updateImageVolumes notifies the filesystems of the remote snapshots which
+// start or stop being used by image volumes.
+func (o *snapshotter) updateImageVolumes(ctx context.Context) error {
+	o.imageVolumeMu.Lock()
+	defer o.imageVolumeMu.Unlock()
+
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+	infos := make(map[string]snapshots.Info)
+	if err := storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+		infos[info.Name] = info
+		return nil
+	}); err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	used := make(map[string]struct{})
+	for _, info := range infos {
+		if info.Kind != snapshots.KindView || !isImageVolume(info.Labels) {
+			continue
+		}
+		for p := info.Parent; p != ""; p = infos[p].Parent {
+			if _, ok := infos[p].Labels[remoteLabel]; ok {
+				used[p] = struct{}{}
+			}
+		}
+	}
+
+	notify := func(key string, inUse bool) {
+		info := infos[key]
+		id, _, _, err := storage.GetInfo(ctx, key)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("key", key).Debug("failed to get remote snapshot")
+			return
+		}
+		fs, err := o.fsOf(info.Labels)
+		if err != nil {
+			return
+		}
+		ufs, ok := fs.(UpdatableFileSystem)
+		if !ok {
+			return
+		}
+		labels := make(map[string]string)
+		for k, v := range info.Labels {
+			labels[k] = v
+		}
+		if inUse {
+			labels[ImageVolumeLabel] = "true"
+		}
+		if err := ufs.UpdateLabels(ctx, o.upperPath(id), labels); err != nil {
+			log.G(ctx).WithError(err).WithField("key", key).
+				Debug("failed to notify filesystem of image volume")
+		}
+	}
+	for key := range used {
+		if _, ok := o.imageVolumeLayers[key]; !ok {
+			notify(key, true)
+		}
+	}
+	for key := range o.imageVolumeLayers {
+		if _, ok := used[key]; !ok {
+			if _, exists := infos[key]; exists {
+				notify(key, false)
+			}
+		}
+	}
+	o.imageVolumeLayers = used
+	return nil
+}
@@ -0,0 +1,101 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+)
+
+// linkDir is the directory under the root which contains short symlinks to the
+// "fs" directories of snapshots.
+const linkDir = "l"
+
+// lowerdirOption returns the "lowerdir" option of overlayfs for the parents.
+//
+// The kernel limits the mount options to a page. Lowerdirs of images with many
+// layers can exceed it so in that case, the option points to short symlinks
+// (e.g. "<root>/l/2n") to the parents instead. When the options exceed a page,
+// the mounter (containerd's mount package) mounts overlayfs from the common
+// directory of lowerdirs with the relative paths, so each layer takes only a
+// few bytes.
+func (o *snapshotter) lowerdirOption(ctx context.Context, parentIDs []string, options []string) (string, error) {
+	parentPaths := make([]string, len(parentIDs))
+	for i := range parentIDs {
+		parentPaths[i] = o.upperPath(parentIDs[i])
+	}
+	lowerdir := fmt.Sprintf("lowerdir=%s", strings.Join(parentPaths, ":"))
+	if len(strings.Join(options, ","))+len(",")+len(lowerdir) <= os.Getpagesize() {
+		return lowerdir, nil
+	}
+	for i, id := range parentIDs {
+		p, err := o.linkPath(id)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to link lowerdir of snapshot %q", id)
+		}
+		parentPaths[i] = p
+	}
+	log.G(ctx).Debugf("using links to %d lowerdirs", len(parentIDs))
+	return fmt.Sprintf("lowerdir=%s", strings.Join(parentPaths, ":")), nil
+}
+
+// linkPath creates (if not exist) the short symlink to the "fs" directory of the
+// snapshot and returns the path of the link. The link is relative so that it
+// keeps working even if the root is moved.
+func (o *snapshotter) linkPath(id string) (string, error) {
+	link := filepath.Join(o.root, linkDir, linkName(id))
+	target := filepath.Join("..", "snapshots", id, "fs")
+	if cur, err := os.Readlink(link); err == nil {
+		if cur == target {
+			return link, nil
+		}
+		if err := os.Remove(link); err != nil {
+			return "", err
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(o.root, linkDir), 0700); err != nil {
+		return "", err
+	}
+	if err := os.Symlink(target, link); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	return link, nil
+}
+
+// removeLink removes the symlink to the snapshot if exists.
+func (o *snapshotter) removeLink(id string) error {
+	if err := os.Remove(filepath.Join(o.root, linkDir, linkName(id))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// linkName returns the name of the link to the snapshot. Numeric IDs (which
+// the metadata store assigns) are shortened with base 36.
+func linkName(id string) string {
+	if n, err := strconv.ParseUint(id, 10, 64); err == nil {
+		return strconv.FormatUint(n, 36)
+	}
+	return id
+}
@@ -0,0 +1,220 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MountHelperSocketOption is the mount option passed to the mount helper,
+	// which specifies the socket of the snapshotter.
+	MountHelperSocketOption = "stargz.socket"
+
+	// MountHelperRemoteOption is the mount option passed to the mount helper,
+	// which specifies the paths (separated by ":") where remote snapshots need
+	// to be mounted before mounting the rootfs.
+	MountHelperRemoteOption = "stargz.remote"
+)
+
+type mountHelperRequest struct {
+	Mountpoint string `json:"mountpoint"`
+}
+
+type mountHelperResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// RequestMount asks the snapshotter listening on the socket to mount the remote
+// snapshot on the mountpoint in the mount namespace of the caller.
+func RequestMount(socket, mountpoint string) error {
+	mntns, err := os.Open("/proc/self/ns/mnt")
+	if err != nil {
+		return err
+	}
+	defer mntns.Close()
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to %q", socket)
+	}
+	defer conn.Close()
+	req, err := json.Marshal(&mountHelperRequest{Mountpoint: mountpoint})
+	if err != nil {
+		return err
+	}
+	if _, _, err := conn.WriteMsgUnix(req, syscall.UnixRights(int(mntns.Fd())), nil); err != nil {
+		return errors.Wrap(err, "failed to send request")
+	}
+	conn.CloseWrite()
+	var res mountHelperResponse
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return errors.Wrap(err, "failed to read response")
+	}
+	if res.Error != "" {
+		return fmt.Errorf("failed to mount %q: %s", mountpoint, res.Error)
+	}
+	return nil
+}
+
+// serveMountHelper starts serving requests from the mount helper.
+func (o *snapshotter) serveMountHelper(ctx context.Context) error {
+	if err := os.MkdirAll(filepath.Dir(o.mountHelperSock), 0700); err != nil {
+		return err
+	}
+	if err := os.Remove(o.mountHelperSock); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: o.mountHelperSock, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := l.AcceptUnix()
+			if err != nil {
+				log.G(ctx).WithError(err).Error("failed to accept mount helper connection")
+				return
+			}
+			go func() {
+				defer conn.Close()
+				res := mountHelperResponse{}
+				if err := o.handleMountRequest(ctx, conn); err != nil {
+					log.G(ctx).WithError(err).Warn("failed to handle mount helper request")
+					res.Error = err.Error()
+				}
+				if err := json.NewEncoder(conn).Encode(&res); err != nil {
+					log.G(ctx).WithError(err).Warn("failed to respond to mount helper")
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
+func (o *snapshotter) handleMountRequest(ctx context.Context, conn *net.UnixConn) error {
+	buf, oob := make([]byte, 4096), make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return errors.Wrap(err, "failed to read request")
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return fmt.Errorf("mount namespace must be passed")
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return fmt.Errorf("mount namespace must be passed")
+	}
+	mntns := os.NewFile(uintptr(fds[0]), "mntns")
+	defer mntns.Close()
+	var req mountHelperRequest
+	if err := json.Unmarshal(buf[:n], &req); err != nil {
+		return errors.Wrap(err, "invalid request")
+	}
+
+	// The mountpoint must be the directory of a committed remote snapshot.
+	dir, base := filepath.Split(filepath.Clean(req.Mountpoint))
+	id := filepath.Base(dir)
+	if base != "fs" || o.upperPath(id) != req.Mountpoint {
+		return fmt.Errorf("%q isn't a snapshot directory", req.Mountpoint)
+	}
+	info, err := o.infoOfID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if _, ok := info.Labels[remoteLabel]; !ok || info.Kind != snapshots.KindCommitted {
+		return fmt.Errorf("snapshot %q isn't a remote snapshot", info.Name)
+	}
+	fs, err := o.fsOf(info.Labels)
+	if err != nil {
+		return err
+	}
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("key", info.Name))
+	log.G(ctx).Debug("mounting remote snapshot for mount helper")
+	return fs.(NamespacedFileSystem).MountInNamespace(ctx, req.Mountpoint, info.Labels, mntns)
+}
+
+// infoOfID returns the info of the snapshot specified by the ID.
+func (o *snapshotter) infoOfID(ctx context.Context, id string) (snapshots.Info, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+	defer t.Rollback()
+	ids, err := storage.IDMap(ctx)
+	if err != nil {
+		return snapshots.Info{}, err
+	}
+	name, ok := ids[id]
+	if !ok {
+		return snapshots.Info{}, fmt.Errorf("snapshot %q not found", id)
+	}
+	_, info, _, err := storage.GetInfo(ctx, name)
+	return info, err
+}
+
+// helperMounts converts the mounts to be mounted by the mount helper if any
+// parent of the snapshot is a remote snapshot.
+func (o *snapshotter) helperMounts(ctx context.Context, s storage.Snapshot, mounts []mount.Mount) ([]mount.Mount, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Rollback()
+	ids, err := storage.IDMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var remotes []string
+	for _, id := range s.ParentIDs {
+		_, info, _, err := storage.GetInfo(ctx, ids[id])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := info.Labels[remoteLabel]; ok {
+			remotes = append(remotes, o.upperPath(id))
+		}
+	}
+	if len(remotes) == 0 {
+		return mounts, nil
+	}
+	var res []mount.Mount
+	for _, m := range mounts {
+		res = append(res, mount.Mount{
+			Type:   "fuse." + o.mountHelper,
+			Source: m.Source,
+			Options: append(append([]string{"type=" + m.Type}, m.Options...),
+				MountHelperSocketOption+"="+o.mountHelperSock,
+				MountHelperRemoteOption+"="+strings.Join(remotes, ":"),
+			),
+		})
+	}
+	return res, nil
+}
@@ -0,0 +1,39 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package overlayutils
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const metacopyParam = "/sys/module/overlay/parameters/metacopy"
+
+// SupportsMetacopy returns nil when the overlayfs of the system supports the
+// "metacopy" mount option (kernel >= 4.19). With the option, changes of only
+// metadata (e.g. chown) of files in lowerdirs copy up only the metadata to the
+// upperdir and the contents are kept being read from the lowerdirs.
+func SupportsMetacopy() error {
+	if _, err := os.Stat(metacopyParam); err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("overlayfs doesn't support metacopy")
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"time"
+
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots/storage"
+	"golang.org/x/sync/errgroup"
+)
+
+// PrefetchWaitLabel is a label of active snapshots which makes Mounts wait for
+// the completion of the prefetch of all remote snapshots under the snapshot,
+// up to the duration (e.g. "10s"). This gives latency-sensitive containers a
+// "warm start" which starts slightly later but without the jitter of fetching
+// the prioritized files on demand. "0" disables the wait specified by
+// PrefetchWait. Layers whose prefetch doesn't complete in time are used as is.
+const PrefetchWaitLabel = "containerd.io/snapshot/remote/prefetch-wait"
+
+// PrefetchWaitingFileSystem is a FileSystem which can wait for the prefetch of
+// the layer mounted on the mountpoint. WaitForPrefetch() must return when ctx
+// is done.
+type PrefetchWaitingFileSystem interface {
+	FileSystem
+	WaitForPrefetch(ctx context.Context, mountpoint string) error
+}
+
+// PrefetchWait makes Mounts of all active snapshots wait for the prefetch of
+// their remote snapshots up to the timeout. PrefetchWaitLabel overrides this.
+func PrefetchWait(timeout time.Duration) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.prefetchWait = timeout
+		return nil
+	}
+}
+
+// prefetchWaitTimeout returns the duration to wait for the prefetch of the
+// layers of the snapshot with the labels.
+func (o *snapshotter) prefetchWaitTimeout(ctx context.Context, labels map[string]string) time.Duration {
+	v, ok := labels[PrefetchWaitLabel]
+	if !ok {
+		return o.prefetchWait
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.G(ctx).WithError(err).Warnf("invalid %s label %q; using the default", PrefetchWaitLabel, v)
+		return o.prefetchWait
+	}
+	return d
+}
+
+// waitForPrefetch waits for the prefetch of the remote snapshots under the
+// snapshot up to the timeout specified by PrefetchWaitLabel or PrefetchWait.
+// Failures and timeouts are only logged because the layers are usable anyway.
+func (o *snapshotter) waitForPrefetch(ctx context.Context, key string) {
+	type layer struct {
+		fs         PrefetchWaitingFileSystem
+		mountpoint string
+	}
+	tCtx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		log.G(ctx).WithError(err).Warn("failed to get transaction")
+		return
+	}
+	_, info, _, err := storage.GetInfo(tCtx, key)
+	if err != nil {
+		t.Rollback()
+		log.G(ctx).WithError(err).Warnf("failed to get info of %q", key)
+		return
+	}
+	timeout := o.prefetchWaitTimeout(ctx, info.Labels)
+	if timeout <= 0 {
+		t.Rollback()
+		return
+	}
+	var layers []layer
+	for cKey := info.Parent; cKey != ""; {
+		id, pInfo, _, err := storage.GetInfo(tCtx, cKey)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to get info of %q", cKey)
+			break
+		}
+		if _, ok := pInfo.Labels[remoteLabel]; ok && o.mountHelper == "" {
+			if fs, err := o.fsOf(pInfo.Labels); err == nil {
+				if pfs, ok := fs.(PrefetchWaitingFileSystem); ok {
+					layers = append(layers, layer{pfs, o.upperPath(id)})
+				}
+			}
+		}
+		cKey = pInfo.Parent
+	}
+	t.Rollback() // don't block writers while waiting
+	if len(layers) == 0 {
+		return
+	}
+
+	start := time.Now()
+	wCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var eg errgroup.Group
+	for _, l := range layers {
+		l := l
+		eg.Go(func() error {
+			if err := l.fs.WaitForPrefetch(wCtx, l.mountpoint); err != nil {
+				log.G(ctx).WithError(err).WithField("mountpoint", l.mountpoint).
+					Warn("prefetch didn't complete; starting without waiting")
+			}
+			return nil
+		})
+	}
+	eg.Wait()
+	log.G(ctx).WithField("key", key).Debugf("waited for prefetch of %d layers for %v", len(layers), time.Since(start))
+}
@@ -0,0 +1,230 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// The following are from linux/fs.h and linux/dqblk_xfs.h.
+const (
+	fsIocFsGetXattr    = 0x801c581f // FS_IOC_FSGETXATTR
+	fsIocFsSetXattr    = 0x401c5820 // FS_IOC_FSSETXATTR
+	fsXflagProjInherit = 0x200      // FS_XFLAG_PROJINHERIT
+
+	qXSetQLim    = 0x5804 // Q_XSETQLIM
+	prjQuota     = 2      // PRJQUOTA
+	fsDquotVer   = 1      // FS_DQUOT_VERSION
+	fsProjQuota  = 2      // FS_PROJ_QUOTA
+	fsDqBSoft    = 1 << 2 // FS_DQ_BSOFT
+	fsDqBHard    = 1 << 3 // FS_DQ_BHARD
+	basicBlkSize = 512    // quota limits are in 512-byte basic blocks
+)
+
+// fsxattr is struct fsxattr.
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+// fsDiskQuota is struct fs_disk_quota.
+type fsDiskQuota struct {
+	version      int8
+	flags        int8
+	fieldmask    uint16
+	id           uint32
+	blkHardlimit uint64
+	blkSoftlimit uint64
+	inoHardlimit uint64
+	inoSoftlimit uint64
+	bcount       uint64
+	icount       uint64
+	itimer       int32
+	btimer       int32
+	iwarns       uint16
+	bwarns       uint16
+	padding2     int32
+	rtbHardlimit uint64
+	rtbSoftlimit uint64
+	rtbcount     uint64
+	rtbtimer     int32
+	rtbwarns     uint16
+	padding3     int16
+	padding4     [8]byte
+}
+
+// projectQuota limits the size of the directories of snapshots using XFS
+// project quota. Each directory gets its own project ID inherited by all files
+// created under it.
+type projectQuota struct {
+	// backingFsBlockDev is the block device node of the filesystem, passed to
+	// quotactl(2).
+	backingFsBlockDev string
+	size              uint64
+
+	// nextProjectID is the project ID assigned to the next directory.
+	nextProjectID uint32
+	mu            sync.Mutex
+}
+
+// newProjectQuota checks that the filesystem of snapshotDir supports project
+// quota and returns projectQuota which limits directories under snapshotDir to
+// the size in bytes. Project IDs larger than the one of snapshotDir are used.
+func newProjectQuota(root, snapshotDir string, size uint64) (*projectQuota, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(snapshotDir, &st); err != nil {
+		return nil, err
+	}
+	if st.Type != unix.XFS_SUPER_MAGIC {
+		return nil, fmt.Errorf("%q is not on XFS", snapshotDir)
+	}
+	dev, err := makeBackingFsDev(root)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to make block device node of the filesystem")
+	}
+	baseID, err := getProjectID(snapshotDir)
+	if err != nil {
+		return nil, err
+	}
+	q := &projectQuota{
+		backingFsBlockDev: dev,
+		size:              size,
+		nextProjectID:     baseID + 1,
+	}
+	dirs, err := ioutil.ReadDir(snapshotDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		id, err := getProjectID(filepath.Join(snapshotDir, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if id >= q.nextProjectID {
+			q.nextProjectID = id + 1
+		}
+	}
+	// Setting a limit fails if project quota isn't enabled (the filesystem
+	// needs to be mounted with "pquota" or "prjquota"). The project isn't used
+	// by any snapshot yet.
+	if err := q.setLimit(q.nextProjectID, 0); err != nil {
+		return nil, errors.Wrap(err, "project quota is unavailable")
+	}
+	return q, nil
+}
+
+// set assigns a new project ID to the empty directory and limits its size.
+// Files created under the directory are accounted to the project.
+func (q *projectQuota) set(dir string) error {
+	q.mu.Lock()
+	id := q.nextProjectID
+	q.nextProjectID++
+	q.mu.Unlock()
+	if err := setProjectID(dir, id); err != nil {
+		return errors.Wrapf(err, "failed to set project ID of %q", dir)
+	}
+	if err := q.setLimit(id, q.size); err != nil {
+		return errors.Wrapf(err, "failed to set quota of %q", dir)
+	}
+	return nil
+}
+
+func (q *projectQuota) setLimit(id uint32, size uint64) error {
+	d := fsDiskQuota{
+		version:      fsDquotVer,
+		flags:        fsProjQuota,
+		fieldmask:    fsDqBSoft | fsDqBHard,
+		id:           id,
+		blkHardlimit: size / basicBlkSize,
+		blkSoftlimit: size / basicBlkSize,
+	}
+	dev, err := unix.BytePtrFromString(q.backingFsBlockDev)
+	if err != nil {
+		return err
+	}
+	cmd := qXSetQLim<<8 | prjQuota&0xff
+	if _, _, errno := unix.Syscall6(unix.SYS_QUOTACTL, uintptr(cmd), uintptr(unsafe.Pointer(dev)),
+		uintptr(id), uintptr(unsafe.Pointer(&d)), 0, 0); errno != 0 {
+		return errors.Wrapf(errno, "failed to set limit of project %d", id)
+	}
+	return nil
+}
+
+func getProjectID(dir string) (uint32, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var fsx fsxattr
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFsGetXattr, uintptr(unsafe.Pointer(&fsx))); errno != 0 {
+		return 0, errors.Wrapf(errno, "failed to get project ID of %q", dir)
+	}
+	return fsx.projid, nil
+}
+
+func setProjectID(dir string, id uint32) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var fsx fsxattr
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFsGetXattr, uintptr(unsafe.Pointer(&fsx))); errno != 0 {
+		return errno
+	}
+	fsx.projid = id
+	fsx.xflags |= fsXflagProjInherit
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFsSetXattr, uintptr(unsafe.Pointer(&fsx))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// makeBackingFsDev creates the block device node of the filesystem of root
+// under root because the device isn't always visible in the mount namespace of
+// the snapshotter (e.g. in a container).
+func makeBackingFsDev(root string) (string, error) {
+	fi, err := os.Stat(root)
+	if err != nil {
+		return "", err
+	}
+	dev := filepath.Join(root, "backingFsBlockDev")
+	if err := os.Remove(dev); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := unix.Mknod(dev, unix.S_IFBLK|0600, int(fi.Sys().(*syscall.Stat_t).Dev)); err != nil {
+		return "", err
+	}
+	return dev, nil
+}
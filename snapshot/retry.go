@@ -0,0 +1,337 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/moby/sys/mountinfo"
+	"github.com/pkg/errors"
+)
+
+const defaultRetryMaxAttempts = 5
+
+// retryEntry is a remote snapshot which failed to be prepared and is waiting for
+// being retried.
+type retryEntry struct {
+	target   string
+	labels   map[string]string
+	attempts int
+}
+
+// retryQueue retries the preparation of remote snapshots in background.
+//
+// When the preparation of a remote snapshot fails, containerd falls back to
+// unpacking the layer as a normal snapshot and commits it with the target name.
+// The retry queue tries to mount the layer as a remote snapshot again and, on
+// success, replaces the contents of the committed snapshot with the remote
+// one. This is done only for view-only snapshots, which are committed and no
+// snapshot uses as its parent, so that the replacement doesn't affect running
+// overlayfs mounts. The check and the replacement are done while holding the
+// lock of the snapshot which is also taken by Prepare, View and Remove.
+type retryQueue struct {
+	o           *snapshotter
+	interval    time.Duration
+	maxAttempts int
+
+	entries   map[string]*retryEntry
+	entriesMu sync.Mutex
+
+	locks   map[string]*snapshotLock
+	locksMu sync.Mutex
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+func newRetryQueue(o *snapshotter, interval time.Duration, maxAttempts int) *retryQueue {
+	if maxAttempts <= 0 {
+		maxAttempts = defaultRetryMaxAttempts
+	}
+	return &retryQueue{
+		o:           o,
+		interval:    interval,
+		maxAttempts: maxAttempts,
+		entries:     make(map[string]*retryEntry),
+		locks:       make(map[string]*snapshotLock),
+		stopCh:      make(chan struct{}),
+	}
+}
+
+func (q *retryQueue) add(target string, labels map[string]string) {
+	l := make(map[string]string, len(labels))
+	for k, v := range labels {
+		l[k] = v
+	}
+	q.entriesMu.Lock()
+	q.entries[target] = &retryEntry{target: target, labels: l}
+	q.entriesMu.Unlock()
+}
+
+// snapshotLock is the lock of a snapshot shared among the users of the name.
+type snapshotLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks the snapshot specified by the key against the replacement by the
+// retry queue. The returned function unlocks it. This is no-op if the queue is
+// nil or the key is empty.
+func (q *retryQueue) lock(key string) func() {
+	if q == nil || key == "" {
+		return func() {}
+	}
+	q.locksMu.Lock()
+	l, ok := q.locks[key]
+	if !ok {
+		l = &snapshotLock{}
+		q.locks[key] = l
+	}
+	l.refs++
+	q.locksMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		q.locksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(q.locks, key)
+		}
+		q.locksMu.Unlock()
+	}
+}
+
+func (q *retryQueue) run(ctx context.Context) {
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			q.retryAll(ctx)
+		case <-q.stopCh:
+			return
+		}
+	}
+}
+
+func (q *retryQueue) stop() {
+	q.stopOnce.Do(func() { close(q.stopCh) })
+}
+
+func (q *retryQueue) retryAll(ctx context.Context) {
+	q.entriesMu.Lock()
+	var entries []*retryEntry
+	for _, e := range q.entries {
+		entries = append(entries, e)
+	}
+	q.entriesMu.Unlock()
+
+	for _, e := range entries {
+		lCtx := log.WithLogger(ctx, log.G(ctx).WithField("target", e.target))
+		done, err := q.o.retryRemoteSnapshot(lCtx, e.target, e.labels)
+		if !done {
+			// Every attempt counts even if the snapshot isn't ready for the
+			// replacement (e.g. used as a lower layer) so that the entry
+			// doesn't stay in the queue forever.
+			e.attempts++
+		}
+		if err != nil {
+			log.G(lCtx).WithError(err).Debugf("failed to retry remote snapshot (%d/%d)", e.attempts, q.maxAttempts)
+		}
+		if done || e.attempts >= q.maxAttempts {
+			q.entriesMu.Lock()
+			delete(q.entries, e.target)
+			q.entriesMu.Unlock()
+		}
+		if done && err == nil {
+			log.G(lCtx).Info("replaced the snapshot with the remote snapshot")
+		}
+	}
+}
+
+// retryRemoteSnapshot tries to replace the committed snapshot with the remote snapshot.
+// Returned boolean is true if the entry doesn't need to be retried anymore.
+// The layer is mounted outside of transactions of the metadata store so that
+// the store isn't locked during the access to the remote. Instead, the lock of
+// the target prevents the snapshot from being used or removed until the
+// replacement completes.
+func (o *snapshotter) retryRemoteSnapshot(ctx context.Context, target string, labels map[string]string) (bool, error) {
+	unlock := o.retryQueue.lock(target)
+	defer unlock()
+
+	id, done, err := o.retryTarget(ctx, target)
+	if err != nil || id == "" {
+		return done, err
+	}
+
+	// Move the local contents aside. It will be removed on the next Cleanup.
+	dir := filepath.Join(o.root, "snapshots", id)
+	if mounted, err := mountinfo.Mounted(dir); err == nil && mounted {
+		// The snapshot is on a volume mounted on the directory (e.g. a ZFS
+		// dataset) which can't be moved. Keep using the local contents.
+		return true, errors.New("local contents are on a mounted volume")
+	}
+	retired, err := ioutil.TempDir(filepath.Join(o.root, "snapshots"), "retired-")
+	if err != nil {
+		return false, errors.Wrap(err, "failed to create directory for the local contents")
+	}
+	if err := os.Rename(dir, filepath.Join(retired, id)); err != nil {
+		os.Remove(retired)
+		return false, errors.Wrap(err, "failed to move the local contents")
+	}
+	if o.durability == DurabilitySync {
+		if err := syncDir(filepath.Join(o.root, "snapshots")); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to sync snapshots directory")
+		}
+	}
+	restore := func() {
+		if err := os.RemoveAll(dir); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to remove snapshot directory")
+		}
+		if err := os.Rename(filepath.Join(retired, id), dir); err != nil {
+			log.G(ctx).WithError(err).Error("failed to restore the local contents")
+		}
+		os.Remove(retired)
+	}
+	if err := os.MkdirAll(o.upperPath(id), 0755); err != nil {
+		restore()
+		return false, err
+	}
+
+	fsID, err := o.mountOnCandidates(ctx, o.upperPath(id), labels)
+	if err != nil {
+		restore()
+		return false, err
+	}
+
+	if err := o.markRemote(ctx, target, id, fsID); err != nil {
+		if uerr := o.fsChain[fsID].Unmount(ctx, o.upperPath(id)); uerr != nil {
+			log.G(ctx).WithError(uerr).Warn("failed to unmount remote snapshot")
+		}
+		restore()
+		return false, err
+	}
+	return true, nil
+}
+
+// retryTarget returns the ID of the view-only snapshot which can be replaced
+// with the remote snapshot. Empty ID is returned if the snapshot can't be
+// replaced now. The returned boolean is true if the snapshot doesn't need the
+// replacement anymore.
+func (o *snapshotter) retryTarget(ctx context.Context, target string) (string, bool, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return "", false, err
+	}
+	defer t.Rollback()
+
+	id, info, _, err := storage.GetInfo(ctx, target)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			// The fallback snapshot hasn't been committed yet.
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	if info.Kind != snapshots.KindCommitted {
+		return "", false, nil
+	}
+	if _, ok := info.Labels[remoteLabel]; ok {
+		return "", true, nil // already remote
+	}
+	if hasChildren, err := hasChildren(ctx, target); err != nil {
+		return "", false, err
+	} else if hasChildren {
+		// The snapshot is used as a lower layer. Try it later.
+		return "", false, nil
+	}
+	return id, false, nil
+}
+
+// markRemote labels the snapshot as the remote snapshot mounted by the
+// filesystem. This fails if the snapshot has been changed (e.g. removed or used
+// as a lower layer) since it's checked by retryTarget.
+func (o *snapshotter) markRemote(ctx context.Context, target, id string, fsID int) error {
+	ctx, t, err := o.ms.TransactionContext(ctx, true)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			if rerr := t.Rollback(); rerr != nil {
+				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+			}
+		}
+	}()
+
+	curID, info, _, err := storage.GetInfo(ctx, target)
+	if err != nil {
+		return err
+	}
+	if curID != id || info.Kind != snapshots.KindCommitted {
+		return errors.Errorf("snapshot %q has been changed", target)
+	}
+	if hasChildren, err := hasChildren(ctx, target); err != nil {
+		return err
+	} else if hasChildren {
+		return errors.Errorf("snapshot %q has been used as a lower layer", target)
+	}
+
+	if info.Labels == nil {
+		info.Labels = make(map[string]string)
+	}
+	info.Labels[remoteLabel] = remoteLabelVal
+	info.Labels[filesystemIDLabel] = o.fsIDs[fsID]
+	fieldpaths := []string{"labels." + remoteLabel, "labels." + filesystemIDLabel}
+	if o.sourceLabels {
+		o.addSourceLabels(ctx, fsID, o.upperPath(id), info.Labels)
+		for _, k := range []string{SourceRefLabel, SourceDigestLabel, FileSystemNameLabel} {
+			if _, ok := info.Labels[k]; ok {
+				fieldpaths = append(fieldpaths, "labels."+k)
+			}
+		}
+	}
+	if _, err := storage.UpdateInfo(ctx, info, fieldpaths...); err != nil {
+		return errors.Wrap(err, "failed to update labels")
+	}
+	committed = true
+	return t.Commit()
+}
+
+// hasChildren returns true if a snapshot uses the specified one as its parent.
+func hasChildren(ctx context.Context, key string) (bool, error) {
+	var found bool
+	if err := storage.WalkInfo(ctx, func(ctx context.Context, i snapshots.Info) error {
+		if i.Parent == key {
+			found = true
+		}
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	return found, nil
+}
@@ -22,8 +22,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/log"
@@ -35,7 +39,9 @@ import (
 	"github.com/moby/sys/mountinfo"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -54,6 +60,61 @@ const (
 	remoteSnapshotLogKey = "remote-snapshot-prepared"
 	prepareSucceeded     = "true"
 	prepareFailed        = "false"
+
+	defaultCleanupWorkers   = 4
+	cleanupProgressInterval = 100
+
+	unmountRetries      = 5
+	unmountRetryBackoff = 10 * time.Millisecond
+
+	// filesystemIDLabel is a label which records the ID of the filesystem which
+	// mounts the remote snapshot. The ID is the name of the filesystem reported
+	// by CapableFileSystem, or the index in the filesystem chain if the name isn't
+	// reported. Older snapshotters always recorded the index.
+	filesystemIDLabel = "containerd.io/snapshot/remote/filesystem.id"
+
+	// TargetMediaTypeLabel is a snapshot label key which contains the media type of
+	// the layer. This is used for choosing the filesystem which mounts the layer.
+	TargetMediaTypeLabel = "containerd.io/snapshot/remote/mediatype"
+
+	// FullyCachedLabel is a snapshot label which is set to "true" when all contents
+	// of the remote snapshot are cached on the node. This is available only for
+	// filesystems implementing NotifyingFileSystem. Schedulers can use this label
+	// for preferring nodes where the image is fully cached.
+	FullyCachedLabel = "containerd.io/snapshot/remote/fully-cached"
+
+	// IdentityLabel is a snapshot label which records the identity of the layer
+	// of the remote snapshot reported by IdentifyingFileSystem. This is passed to
+	// the filesystem when the snapshot is mounted again (e.g. on restart) so that
+	// the filesystem can refuse a layer served with different contents.
+	IdentityLabel = "containerd.io/snapshot/remote/identity"
+
+	// UnavailableLabel is a snapshot label set to "true" on remote snapshots
+	// which couldn't be mounted again on startup (e.g. after a crash of the
+	// snapshotter). These can't be used by containers and should be removed.
+	// The label is removed when the snapshot is mounted on a later startup.
+	UnavailableLabel = "containerd.io/snapshot/remote/unavailable"
+
+	// SourceRefLabel, SourceDigestLabel and FileSystemNameLabel are snapshot
+	// labels which record the image reference, the layer digest and the name of
+	// the filesystem of the remote snapshot. These are recorded when SourceLabels
+	// is enabled so that auditors and GC tools can map snapshots on the disk back
+	// to the contents in registries.
+	SourceRefLabel      = "containerd.io/snapshot/remote/source.ref"
+	SourceDigestLabel   = "containerd.io/snapshot/remote/source.digest"
+	FileSystemNameLabel = "containerd.io/snapshot/remote/filesystem.name"
+
+	// RemoteSnapshotLabel is a label set on committed remote snapshots. Remote
+	// snapshots take little space on the disk as their contents are fetched
+	// lazily, so GC tools can prefer keeping them and deleting local ones.
+	RemoteSnapshotLabel = remoteLabel
+
+	// RemoteSnapshotFilter and LocalSnapshotFilter are filters passed to Walk
+	// for selecting remote snapshots and the others. These work also through
+	// containerd's snapshot API (e.g. `ctr snapshot ls`), which merges labels of
+	// the snapshotter.
+	RemoteSnapshotFilter = `labels."` + remoteLabel + `"`
+	LocalSnapshotFilter  = `labels."` + remoteLabel + `"!="` + remoteLabelVal + `"`
 )
 
 // FileSystem is a backing filesystem abstraction.
@@ -64,16 +125,282 @@ const (
 // Check() is called to check the connectibity of the existing layer snapshot
 // every time the layer is used by containerd.
 // Unmount() is called to unmount a remote snapshot from the specified mount point
-// directory.
+// directory. The filesystem should release all resources bound to the layer here.
+// Stats() is called to get the statistics (e.g. the size of the locally cached
+// contents) of the remote snapshot mounted on the specified mount point.
 type FileSystem interface {
 	Mount(ctx context.Context, mountpoint string, labels map[string]string) error
 	Check(ctx context.Context, mountpoint string, labels map[string]string) error
 	Unmount(ctx context.Context, mountpoint string) error
+	Stats(ctx context.Context, mountpoint string) (Stats, error)
+}
+
+// ErrLayerUnsupported is returned (possibly wrapped) by FileSystem.Mount when
+// the filesystem never mounts the layer regardless of the availability of the
+// remote (e.g. the layer isn't eStargz or is denied by the policy). The
+// snapshotter doesn't retry the preparation of such layers.
+var ErrLayerUnsupported = errors.New("layer is unsupported by the filesystem")
+
+// CapableFileSystem is a FileSystem which declares its capabilities and health.
+// The snapshotter uses these information for choosing the filesystem which
+// mounts each layer. Filesystems which don't implement this interface are
+// treated as healthy and capable to mount any layer.
+//
+// Capabilities() returns the set of features supported by the filesystem.
+// Health() returns non-nil error if the filesystem currently can't serve new
+// remote snapshots (e.g. the backing service is down).
+type CapableFileSystem interface {
+	FileSystem
+	Capabilities(ctx context.Context) Capabilities
+	Health(ctx context.Context) error
+}
+
+// NotifyingFileSystem is a FileSystem which notifies the snapshotter when all
+// contents of the remote snapshot mounted on the mountpoint are cached on the
+// node. The snapshotter registers the handler during its initialization.
+type NotifyingFileSystem interface {
+	FileSystem
+	SetFullyCachedHandler(h func(ctx context.Context, mountpoint string))
+}
+
+// UpdatableFileSystem is a FileSystem which is notified of the updates of labels
+// of remote snapshots. UpdateLabels() is called with the updated labels of the
+// remote snapshot mounted on the mountpoint.
+type UpdatableFileSystem interface {
+	FileSystem
+	UpdateLabels(ctx context.Context, mountpoint string, labels map[string]string) error
+}
+
+// NamespacedFileSystem is a FileSystem which can mount remote snapshots in other
+// mount namespaces. This is required for FuseMountHelper. MountInNamespace()
+// mounts the layer specified by the labels on the mountpoint in the mount
+// namespace specified by mntns. The filesystem releases the layer when the mount
+// is destroyed.
+type NamespacedFileSystem interface {
+	FileSystem
+	MountInNamespace(ctx context.Context, mountpoint string, labels map[string]string, mntns *os.File) error
+}
+
+// DetachedFileSystem is a FileSystem whose FUSE servers run outside of the
+// snapshotter process (e.g. in the fuse manager) if Detached() returns true.
+// Mounts of the filesystem survive restarts of the snapshotter so, on startup,
+// they are kept and checked instead of being mounted again.
+type DetachedFileSystem interface {
+	FileSystem
+	Detached() bool
+}
+
+// IdentifyingFileSystem is a FileSystem which reports the identity (e.g. the
+// digest of the TOC of eStargz) of the layer mounted on the mountpoint. The
+// snapshotter records it as IdentityLabel. The filesystem must fail to mount the
+// layer if IdentityLabel is passed but the layer has a different identity.
+type IdentifyingFileSystem interface {
+	FileSystem
+	Identity(ctx context.Context, mountpoint string) (string, error)
+}
+
+// SourceFileSystem is a FileSystem which reports the source of the layer mounted
+// on the mountpoint. The snapshotter records it as SourceRefLabel and
+// SourceDigestLabel if SourceLabels is enabled.
+type SourceFileSystem interface {
+	FileSystem
+	Source(ctx context.Context, mountpoint string) (Source, error)
+}
+
+// Source is the source of the layer of a remote snapshot.
+type Source struct {
+	// Ref is the reference of the image which the layer is fetched as a part of.
+	Ref string
+
+	// Digest is the digest of the layer in the registry.
+	Digest string
+}
+
+// CacheStatsFileSystem is a FileSystem which reports the statistics of its
+// in-memory caches. This is used for diagnosing the running snapshotter.
+type CacheStatsFileSystem interface {
+	FileSystem
+	CacheStats(ctx context.Context) CacheStats
+}
+
+// CacheStatsReporter reports the statistics of the caches of the filesystems
+// used by the snapshotter. Filesystems which don't implement
+// CacheStatsFileSystem are omitted. The snapshotter returned by NewSnapshotter
+// implements this interface.
+type CacheStatsReporter interface {
+	CacheStats(ctx context.Context) []CacheStats
+}
+
+// CacheStats is the statistics of the in-memory caches of a FileSystem.
+type CacheStats struct {
+	// FileSystem is the ID of the filesystem (i.e. the name reported by
+	// CapableFileSystem or the index of the filesystem).
+	FileSystem string
+
+	// Layers and Blobs are the numbers of resolved layers and blobs kept for
+	// reuse.
+	Layers int
+	Blobs  int
+
+	// LayersInUse is the number of layers referred by mounts.
+	LayersInUse int
+}
+
+// CacheEvictingFileSystem is a FileSystem which can evict the resolved layers
+// which aren't used by mounts from its in-memory caches. EvictCaches() returns
+// the numbers of the evicted layers and blobs.
+type CacheEvictingFileSystem interface {
+	FileSystem
+	EvictCaches(ctx context.Context) CacheStats
+}
+
+// CacheEvictor evicts the unused layers from the caches of the filesystems used
+// by the snapshotter. Filesystems which don't implement CacheEvictingFileSystem
+// are omitted. The snapshotter returned by NewSnapshotter implements this
+// interface.
+type CacheEvictor interface {
+	EvictCaches(ctx context.Context) []CacheStats
+}
+
+// RefreshableFileSystem is a FileSystem which can re-resolve the layer mounted
+// on the mountpoint on demand (i.e. re-establish the connection to the
+// registry). Labels are the ones of the remote snapshot, same as Check().
+type RefreshableFileSystem interface {
+	FileSystem
+	Refresh(ctx context.Context, mountpoint string, labels map[string]string) error
+}
+
+// TransportInvalidatingFileSystem is a FileSystem which can make all mounted
+// layers re-establish their connections to registries (e.g. re-authenticate
+// with rotated credentials) on their next fetch.
+type TransportInvalidatingFileSystem interface {
+	FileSystem
+	InvalidateTransports()
+}
+
+// RemoteSnapshotRefresher re-establishes the connections of remote snapshots
+// to registries. The snapshotter returned by NewSnapshotter implements this
+// interface.
+type RemoteSnapshotRefresher interface {
+	// RefreshRemoteSnapshot re-resolves the layer of the committed remote
+	// snapshot specified by the key.
+	RefreshRemoteSnapshot(ctx context.Context, key string) error
+
+	// InvalidateTransports makes all remote snapshots re-establish their
+	// connections on their next fetch. Filesystems which don't implement
+	// TransportInvalidatingFileSystem are omitted.
+	InvalidateTransports(ctx context.Context)
+}
+
+// BackgroundFetchConfig is the state of background fetch of a filesystem.
+type BackgroundFetchConfig struct {
+	// Paused is true if background fetch is paused.
+	Paused bool
+
+	// Bandwidth is the bandwidth limit of background fetch in bytes per second.
+	// Zero means no limit.
+	Bandwidth int64
+}
+
+// BackgroundFetchControllingFileSystem is a FileSystem whose background fetch
+// of layers can be paused, resumed and throttled at runtime (e.g. not to
+// saturate low-bandwidth links).
+type BackgroundFetchControllingFileSystem interface {
+	FileSystem
+	SetBackgroundFetch(ctx context.Context, cfg BackgroundFetchConfig)
+	BackgroundFetch(ctx context.Context) BackgroundFetchConfig
+}
+
+// BackgroundFetchController controls background fetch of the filesystems used
+// by the snapshotter. Filesystems which don't implement
+// BackgroundFetchControllingFileSystem are omitted. The snapshotter returned by
+// NewSnapshotter implements this interface.
+type BackgroundFetchController interface {
+	// SetBackgroundFetch applies cfg to all filesystems.
+	SetBackgroundFetch(ctx context.Context, cfg BackgroundFetchConfig)
+
+	// BackgroundFetch returns the state of background fetch of each filesystem
+	// keyed by the ID of the filesystem.
+	BackgroundFetch(ctx context.Context) map[string]BackgroundFetchConfig
+}
+
+// RemoteStatsWalker walks the statistics of all committed remote snapshots. The
+// snapshotter returned by NewSnapshotter implements this interface.
+type RemoteStatsWalker interface {
+	WalkRemoteStats(ctx context.Context, fn func(ctx context.Context, info snapshots.Info, st Stats) error) error
+}
+
+// CapabilitiesReporter reports the capabilities of the filesystems used by the
+// snapshotter, in the order of preference. Filesystems which don't implement
+// CapableFileSystem are omitted. The snapshotter returned by NewSnapshotter
+// implements this interface.
+type CapabilitiesReporter interface {
+	Capabilities(ctx context.Context) []Capabilities
+}
+
+// Capabilities is a set of features supported by a FileSystem.
+type Capabilities struct {
+	// Name is the name of the filesystem (e.g. "stargz"). This is used as the
+	// stable ID of the filesystem which doesn't depend on the order of the
+	// filesystems so it must be unique among the filesystems of the snapshotter
+	// and mustn't be a number. This is also recorded as FileSystemNameLabel if
+	// SourceLabels is enabled.
+	Name string
+
+	// MediaTypes is a list of layer media types that the filesystem can mount.
+	// Empty list means that the filesystem doesn't restrict media types.
+	MediaTypes []string
+
+	// Verification is true if the filesystem can verify the layer contents.
+	Verification bool
+
+	// Offline is true if the filesystem can keep serving mounted layers without
+	// the connection to the remote source.
+	Offline bool
+
+	// Features is a list of names of optional features enabled on the filesystem
+	// (e.g. "prefetch"). This is informational and used for auditing nodes.
+	Features []string
+
+	// Compressions is a list of compressions of layers (e.g. "gzip", "zstd")
+	// which the filesystem can mount. This is informational and used for
+	// auditing nodes.
+	Compressions []string
+}
+
+// Stats is the statistics of a remote snapshot reported by FileSystem.
+type Stats struct {
+	// Size is the total size of the layer.
+	Size int64
+
+	// FetchedSize is the size of the layer contents which are already cached
+	// on the node.
+	FetchedSize int64
+
+	// Degraded lists the reasons why the layer is served in a degraded mode
+	// (e.g. contents are fetched only on demand because prefetch failed).
+	Degraded []string
 }
 
 // SnapshotterConfig is used to configure the remote snapshotter instance
 type SnapshotterConfig struct {
-	asyncRemove bool
+	asyncRemove      bool
+	asyncUsage       bool
+	extraFs          []FileSystem
+	retryInterval    time.Duration
+	retryMaxAttempts int
+	cleanupWorkers   int
+	fullyCachedHook  func(ctx context.Context, name string)
+	mountHelper      string
+	mountHelperSock  string
+	sourceLabels     bool
+	upperDriver      UpperDriver
+	upperQuota       uint64
+	durability       Durability
+	inMemoryMetadata bool
+	metacopy         bool
+	transientLabels  []string
+	prefetchWait     time.Duration
 }
 
 // Opt is an option to configure the remote snapshotter
@@ -88,14 +415,255 @@ func AsynchronousRemove(config *SnapshotterConfig) error {
 	return nil
 }
 
+// AsynchronousUsage makes Commit skip the calculation of the disk usage of the
+// snapshot. The snapshot is committed with zero usage and the usage is
+// calculated in background then recorded by the snapshotter later. This
+// shortens Commit for snapshots with large upperdirs. The usages are recorded
+// in the metadata store. The ones not recorded before the snapshotter stopped
+// are calculated again in background on startup.
+func AsynchronousUsage(config *SnapshotterConfig) error {
+	config.asyncUsage = true
+	return nil
+}
+
+// Metacopy mounts overlayfs with the "metacopy=on" option so that changes of
+// only metadata (e.g. chown and chmod) of files in lower layers don't copy up
+// their contents to the upperdir. The contents of remote snapshots are then
+// never fetched just because their files are chowned in upper layers.
+// Upperdirs contain files whose contents are in the lowerdirs, so they must
+// be read only through overlayfs. This can't be used with "userxattr".
+func Metacopy(config *SnapshotterConfig) error {
+	config.metacopy = true
+	return nil
+}
+
+// TransientLabels specifies the keys of the labels which are passed to the
+// filesystems on Prepare but never stored in the metadata (e.g. credentials).
+func TransientLabels(keys ...string) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.transientLabels = append(config.transientLabels, keys...)
+		return nil
+	}
+}
+
+// RetryRemotePrepare enables retrying the preparation of remote snapshots which
+// failed to be prepared transiently (i.e. not with ErrLayerUnsupported). The
+// retry is done in background every interval up to maxAttempts times (zero
+// means the default). When the retry succeeds, the contents of the snapshot
+// (which was unpacked by the client as a fallback) is replaced with the remote
+// snapshot if the snapshot is view-only (i.e. committed and isn't used as a
+// parent of other snapshots).
+func RetryRemotePrepare(interval time.Duration, maxAttempts int) Opt {
+	return func(config *SnapshotterConfig) error {
+		if interval <= 0 {
+			return fmt.Errorf("retry interval must be positive")
+		}
+		config.retryInterval = interval
+		config.retryMaxAttempts = maxAttempts
+		return nil
+	}
+}
+
+// CleanupWorkers sets the maximum number of snapshot directories removed in
+// parallel during Cleanup (default: 4).
+func CleanupWorkers(n int) Opt {
+	return func(config *SnapshotterConfig) error {
+		if n <= 0 {
+			return fmt.Errorf("number of cleanup workers must be positive")
+		}
+		config.cleanupWorkers = n
+		return nil
+	}
+}
+
+// WithFileSystems appends filesystems which are tried after the primary one when
+// a remote snapshot is prepared. Each layer is mounted by the first healthy
+// filesystem which is capable to mount the layer.
+func WithFileSystems(fss ...FileSystem) Opt {
+	return func(config *SnapshotterConfig) error {
+		for _, f := range fss {
+			if f == nil {
+				return fmt.Errorf("filesystem must not be nil")
+			}
+		}
+		config.extraFs = append(config.extraFs, fss...)
+		return nil
+	}
+}
+
+// FullyCachedHook specifies the function called with the name of the snapshot
+// after FullyCachedLabel is added to the snapshot.
+func FullyCachedHook(f func(ctx context.Context, name string)) Opt {
+	return func(config *SnapshotterConfig) error {
+		config.fullyCachedHook = f
+		return nil
+	}
+}
+
+// FuseMountHelper makes the snapshotter return mounts of type "fuse.<helper>"
+// for snapshots on remote snapshots instead of mounting remote snapshots in the
+// snapshotter's mount namespace. The mount helper is invoked through mount.fuse
+// when the runtime mounts the rootfs (i.e. in the container's mount namespace)
+// and asks the snapshotter listening on the socket to mount the remote
+// snapshots there using RequestMount. The helper then mounts the rootfs
+// following the remaining options. All filesystems must implement
+// NamespacedFileSystem.
+func FuseMountHelper(helper, socket string) Opt {
+	return func(config *SnapshotterConfig) error {
+		if helper == "" || socket == "" {
+			return fmt.Errorf("mount helper and socket must be specified")
+		}
+		config.mountHelper = helper
+		config.mountHelperSock = socket
+		return nil
+	}
+}
+
+// InMemoryMetadata keeps the metadata of the snapshotter in memory instead of
+// "metadata.db" under the root. All snapshots are forgotten when the
+// snapshotter exits so this is for embedding the snapshotter in tools and
+// tests. Directories left by a previous process are removed by Cleanup.
+func InMemoryMetadata(config *SnapshotterConfig) error {
+	config.inMemoryMetadata = true
+	return nil
+}
+
+// SourceLabels makes the snapshotter record the source of each remote snapshot
+// (SourceRefLabel, SourceDigestLabel and FileSystemNameLabel) as labels. These
+// are available only for filesystems implementing SourceFileSystem and
+// CapableFileSystem respectively.
+func SourceLabels(config *SnapshotterConfig) error {
+	config.sourceLabels = true
+	return nil
+}
+
+// WithUpperDriver makes the snapshotter create the directory of each active
+// snapshot (including the upperdir) as a volume of the backing filesystem
+// (e.g. btrfs subvolume or ZFS dataset) using the driver. Snapshots are still
+// mounted with overlayfs so remote snapshots can be used as the lowerdirs.
+func WithUpperDriver(d UpperDriver) Opt {
+	return func(config *SnapshotterConfig) error {
+		if d == nil {
+			return fmt.Errorf("upper driver must not be nil")
+		}
+		config.upperDriver = d
+		return nil
+	}
+}
+
+// UpperQuota limits the size of the writable part (the upperdir and the
+// workdir) of each active snapshot to size bytes using XFS project quota. The
+// root of the snapshotter must be on XFS mounted with the "pquota" option.
+// This can't be used with WithUpperDriver; use the quota of the driver
+// instead.
+func UpperQuota(size uint64) Opt {
+	return func(config *SnapshotterConfig) error {
+		if size == 0 {
+			return fmt.Errorf("quota must be positive")
+		}
+		config.upperQuota = size
+		return nil
+	}
+}
+
+// Durability is the trade-off between the crash-safety of the snapshotter and
+// the throughput of Prepare, Commit and Remove.
+type Durability string
+
+const (
+	// DurabilityDefault syncs the metadata on each transaction but doesn't sync
+	// the renames of snapshot directories.
+	DurabilityDefault Durability = ""
+
+	// DurabilitySync additionally syncs the snapshot directories after they are
+	// renamed so that a crash of the host never leaves snapshots in the metadata
+	// without their directories.
+	DurabilitySync Durability = "sync"
+
+	// DurabilityNoSync doesn't sync the metadata on each transaction. The
+	// metadata is synced only when the snapshotter is closed. A crash of the
+	// host (not the snapshotter) may lose recent snapshots or corrupt the
+	// metadata so this is for disposable hosts (e.g. CI runners).
+	DurabilityNoSync Durability = "nosync"
+)
+
+// WithDurability specifies the durability of the metadata and the snapshot
+// directories (default: DurabilityDefault).
+func WithDurability(d Durability) Opt {
+	return func(config *SnapshotterConfig) error {
+		switch d {
+		case DurabilityDefault, DurabilitySync, DurabilityNoSync:
+		default:
+			return fmt.Errorf("unknown durability %q", d)
+		}
+		config.durability = d
+		return nil
+	}
+}
+
 type snapshotter struct {
 	root        string
 	ms          *storage.MetaStore
 	asyncRemove bool
+	asyncUsage  bool
 
-	// fs is a filesystem that this snapshotter recognizes.
-	fs        FileSystem
+	cleanupWorkers int
+
+	usageWg   sync.WaitGroup
+	usageDone chan struct{}
+	closeOnce sync.Once
+
+	// fsChain is a list of filesystems that this snapshotter recognizes.
+	fsChain   []FileSystem
 	userxattr bool // whether to enable "userxattr" mount option
+	metacopy  bool // whether to enable "metacopy" mount option
+
+	// fsIDs is the stable IDs of the filesystems in fsChain.
+	fsIDs []string
+
+	// retryQueue retries the preparation of remote snapshots. nil if disabled.
+	retryQueue *retryQueue
+
+	fullyCachedHook func(ctx context.Context, name string)
+
+	// mountHelper is the name of the mount helper. Remote snapshots aren't
+	// mounted in the snapshotter's namespace if specified.
+	mountHelper     string
+	mountHelperSock string
+
+	// sourceLabels records the sources of remote snapshots as labels if true.
+	sourceLabels bool
+
+	// transientLabels is the keys of the labels never stored in the metadata.
+	transientLabels []string
+
+	// prefetchWait is the default duration Mounts waits for the prefetch of
+	// remote snapshots. Zero disables the wait.
+	prefetchWait time.Duration
+
+	// upperDriver creates the directories of active snapshots as volumes. nil
+	// if they are plain directories.
+	upperDriver UpperDriver
+
+	// quota limits the size of the directories of active snapshots. nil if
+	// disabled.
+	quota *projectQuota
+
+	// durability is the trade-off between crash-safety and throughput.
+	durability Durability
+
+	// db is the database of the metadata whose writes aren't synced on each
+	// transaction. nil unless durability is DurabilityNoSync.
+	db *bolt.DB
+
+	// metadataFile is the in-memory file storing the metadata. nil unless
+	// InMemoryMetadata is enabled.
+	metadataFile *os.File
+
+	// imageVolumeLayers is the set of the keys of remote snapshots used by
+	// image volumes, which the filesystems have been notified of.
+	imageVolumeLayers map[string]struct{}
+	imageVolumeMu     sync.Mutex
 }
 
 // NewSnapshotter returns a Snapshotter which can use unpacked remote layers
@@ -124,8 +692,22 @@ func NewSnapshotter(ctx context.Context, root string, targetFs FileSystem, opts
 	if !supportsDType {
 		return nil, fmt.Errorf("%s does not support d_type. If the backing filesystem is xfs, please reformat with ftype=1 to enable d_type support", root)
 	}
-	ms, err := storage.NewMetaStore(filepath.Join(root, "metadata.db"))
+	dbfile := filepath.Join(root, "metadata.db")
+	var metadataFile *os.File
+	if config.inMemoryMetadata {
+		// bolt opens the anonymous file through procfs.
+		fd, err := unix.MemfdCreate("metadata.db", unix.MFD_CLOEXEC)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create in-memory metadata")
+		}
+		metadataFile = os.NewFile(uintptr(fd), "metadata.db")
+		dbfile = fmt.Sprintf("/proc/self/fd/%d", fd)
+	}
+	ms, err := storage.NewMetaStore(dbfile)
 	if err != nil {
+		if metadataFile != nil {
+			metadataFile.Close()
+		}
 		return nil, err
 	}
 
@@ -142,14 +724,95 @@ func NewSnapshotter(ctx context.Context, root string, targetFs FileSystem, opts
 		root:        root,
 		ms:          ms,
 		asyncRemove: config.asyncRemove,
-		fs:          targetFs,
+		asyncUsage:  config.asyncUsage,
+		usageDone:   make(chan struct{}),
+		fsChain:     append([]FileSystem{targetFs}, config.extraFs...),
 		userxattr:   userxattr,
+
+		metadataFile: metadataFile,
+	}
+	if o.fsIDs, err = fileSystemIDs(ctx, o.fsChain); err != nil {
+		return nil, err
+	}
+	o.durability = config.durability
+	if o.durability == DurabilityNoSync {
+		if o.db, err = metadataDB(ctx, ms); err != nil {
+			return nil, err
+		}
+		o.db.NoSync = true
+	}
+	if config.metacopy {
+		if o.userxattr {
+			return nil, fmt.Errorf("metacopy can't be used with userxattr")
+		}
+		if err := overlayutils.SupportsMetacopy(); err != nil {
+			return nil, err
+		}
+		o.metacopy = true
+	}
+	o.cleanupWorkers = config.cleanupWorkers
+	if o.cleanupWorkers == 0 {
+		o.cleanupWorkers = defaultCleanupWorkers
+	}
+	o.fullyCachedHook = config.fullyCachedHook
+	o.sourceLabels = config.sourceLabels
+	o.transientLabels = config.transientLabels
+	o.prefetchWait = config.prefetchWait
+	if config.upperDriver != nil {
+		if err := config.upperDriver.Init(ctx, filepath.Join(root, "snapshots")); err != nil {
+			return nil, errors.Wrap(err, "failed to initialize upper driver")
+		}
+		o.upperDriver = config.upperDriver
+	}
+	if config.upperQuota > 0 {
+		if o.upperDriver != nil {
+			return nil, fmt.Errorf("quota can't be used with upper driver")
+		}
+		if o.quota, err = newProjectQuota(root, filepath.Join(root, "snapshots"), config.upperQuota); err != nil {
+			return nil, errors.Wrap(err, "failed to enable quota")
+		}
+	}
+	for _, f := range o.fsChain {
+		if nf, ok := f.(NotifyingFileSystem); ok {
+			nf.SetFullyCachedHandler(o.markFullyCached)
+		}
+	}
+
+	if config.mountHelper != "" {
+		for i, f := range o.fsChain {
+			if _, ok := f.(NamespacedFileSystem); !ok {
+				return nil, fmt.Errorf("filesystem %d doesn't support mount helper", i)
+			}
+		}
+		o.mountHelper, o.mountHelperSock = config.mountHelper, config.mountHelperSock
+		if err := o.serveMountHelper(log.WithLogger(context.Background(), log.G(ctx))); err != nil {
+			return nil, errors.Wrap(err, "failed to serve mount helper")
+		}
+	}
+
+	if err := o.migrateFileSystemIDs(ctx); err != nil {
+		return nil, errors.Wrap(err, "failed to migrate filesystem IDs")
 	}
 
 	if err := o.restoreRemoteSnapshot(ctx); err != nil {
 		return nil, errors.Wrap(err, "failed to restore remote snapshot")
 	}
 
+	if err := o.updateImageVolumes(ctx); err != nil {
+		log.G(ctx).WithError(err).Warn("failed to check remote snapshots used by image volumes")
+	}
+
+	if o.asyncUsage {
+		if err := o.recalculateUsages(log.WithLogger(context.Background(), log.G(ctx))); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to calculate disk usages of snapshots")
+		}
+	}
+
+	if config.retryInterval > 0 {
+		o.retryQueue = newRetryQueue(o, config.retryInterval, config.retryMaxAttempts)
+		go o.retryQueue.run(log.WithLogger(context.Background(), log.G(ctx)))
+	}
+
 	return o, nil
 }
 
@@ -178,16 +841,33 @@ func (o *snapshotter) Update(ctx context.Context, info snapshots.Info, fieldpath
 		return snapshots.Info{}, err
 	}
 
+	info.Labels = o.withoutTransientLabels(info.Labels)
 	info, err = storage.UpdateInfo(ctx, info, fieldpaths...)
 	if err != nil {
 		t.Rollback()
 		return snapshots.Info{}, err
 	}
+	id, _, _, err := storage.GetInfo(ctx, info.Name)
+	if err != nil {
+		t.Rollback()
+		return snapshots.Info{}, err
+	}
 
 	if err := t.Commit(); err != nil {
 		return snapshots.Info{}, err
 	}
 
+	if _, ok := info.Labels[remoteLabel]; ok && info.Kind == snapshots.KindCommitted {
+		if fs, err := o.fsOf(info.Labels); err == nil {
+			if ufs, ok := fs.(UpdatableFileSystem); ok {
+				if err := ufs.UpdateLabels(ctx, o.upperPath(id), info.Labels); err != nil {
+					log.G(ctx).WithError(err).WithField("key", info.Name).
+						Warn("failed to notify filesystem of updated labels")
+				}
+			}
+		}
+	}
+
 	return info, nil
 }
 
@@ -195,10 +875,11 @@ func (o *snapshotter) Update(ctx context.Context, info snapshots.Info, fieldpath
 //
 // For active snapshots, this will scan the usage of the overlay "diff" (aka
 // "upper") directory and may take some time.
-// for remote snapshots, no scan will be held and recognise the number of inodes
-// and these sizes as "zero".
+// For remote snapshots, no scan will be held. The size of the contents cached
+// on the node is queried to the filesystem and the number of inodes is
+// recognised as "zero".
 //
-// For committed snapshots, the value is returned from the metadata database.
+// For other committed snapshots, the value is returned from the metadata database.
 func (o *snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, error) {
 	ctx, t, err := o.ms.TransactionContext(ctx, false)
 	if err != nil {
@@ -220,6 +901,24 @@ func (o *snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, e
 			return snapshots.Usage{}, err
 		}
 
+		usage = snapshots.Usage(du)
+	} else if _, ok := info.Labels[remoteLabel]; ok {
+		fs, err := o.fsOf(info.Labels)
+		if err != nil {
+			return snapshots.Usage{}, err
+		}
+		st, err := fs.Stats(ctx, upperPath)
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("key", key).Debug("failed to get stats of remote snapshot")
+			return usage, nil
+		}
+		usage = snapshots.Usage{Size: st.FetchedSize}
+	} else if o.asyncUsage && usage == (snapshots.Usage{}) {
+		// The usage hasn't been calculated yet.
+		du, err := fs.DiskUsage(ctx, upperPath)
+		if err != nil {
+			return snapshots.Usage{}, err
+		}
 		usage = snapshots.Usage(du)
 	}
 
@@ -227,31 +926,41 @@ func (o *snapshotter) Usage(ctx context.Context, key string) (snapshots.Usage, e
 }
 
 func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return nil, err
+		}
+	}
+	if isImageVolume(base.Labels) {
+		return nil, errors.Wrapf(errdefs.ErrInvalidArgument, "image volume %q must be created by View", key)
+	}
+
+	unlock := o.retryQueue.lock(parent)
 	s, err := o.createSnapshot(ctx, snapshots.KindActive, key, parent, opts)
+	unlock()
 	if err != nil {
 		return nil, err
 	}
 
 	// Try to prepare the remote snapshot. If succeeded, we commit the snapshot now
 	// and return ErrAlreadyExists.
-	var base snapshots.Info
-	for _, opt := range opts {
-		if err := opt(&base); err != nil {
-			return nil, err
-		}
-	}
 	if target, ok := base.Labels[targetSnapshotLabel]; ok {
 		// NOTE: If passed labels include a target of the remote snapshot, `Prepare`
 		//       must log whether this method succeeded to prepare that remote snapshot
 		//       or not, using the key `remoteSnapshotLogKey` defined in the above. This
 		//       log is used by tests in this project.
 		lCtx := log.WithLogger(ctx, log.G(ctx).WithField("key", key).WithField("parent", parent))
-		if err := o.prepareRemoteSnapshot(ctx, key, base.Labels); err != nil {
+		if fsID, id, err := o.prepareRemoteSnapshot(ctx, key, base.Labels); err != nil {
 			log.G(lCtx).WithField(remoteSnapshotLogKey, prepareFailed).
 				WithError(err).Debug("failed to prepare remote snapshot")
+			if o.retryQueue != nil && errors.Cause(err) != ErrLayerUnsupported {
+				// Retry only when the failure can be transient (e.g. the
+				// registry is temporarily unavailable).
+				o.retryQueue.add(target, base.Labels)
+			}
 		} else {
-			base.Labels[remoteLabel] = remoteLabelVal // Mark this snapshot as remote
-			err := o.Commit(ctx, target, key, append(opts, snapshots.WithLabels(base.Labels))...)
+			err := o.commitRemoteSnapshot(lCtx, target, key, fsID, id, base.Labels, opts)
 			if err == nil || errdefs.IsAlreadyExists(err) {
 				// count also AlreadyExists as "success"
 				log.G(lCtx).WithField(remoteSnapshotLogKey, prepareSucceeded).Debug("prepared remote snapshot")
@@ -268,12 +977,54 @@ func (o *snapshotter) Prepare(ctx context.Context, key, parent string, opts ...s
 	return o.mounts(ctx, s, parent)
 }
 
+// commitRemoteSnapshot records the labels of the remote snapshot mounted on the
+// active snapshot by the filesystem and commits it as the target.
+func (o *snapshotter) commitRemoteSnapshot(ctx context.Context, target, key string, fsID int, id string, labels map[string]string, opts []snapshots.Opt) error {
+	labels[remoteLabel] = remoteLabelVal // Mark this snapshot as remote
+	labels[filesystemIDLabel] = o.fsIDs[fsID]
+	if ifs, ok := o.fsChain[fsID].(IdentifyingFileSystem); ok {
+		if ident, err := ifs.Identity(ctx, o.upperPath(id)); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to get identity of remote snapshot")
+		} else if ident != "" {
+			labels[IdentityLabel] = ident
+		}
+	}
+	if o.sourceLabels {
+		o.addSourceLabels(ctx, fsID, o.upperPath(id), labels)
+	}
+	err := o.Commit(ctx, target, key, append(opts, snapshots.WithLabels(labels))...)
+	if o.mountHelper != "" {
+		// The mount helper mounts the layer where it's used.
+		if err := o.fsChain[fsID].Unmount(ctx, o.upperPath(id)); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to unmount remote snapshot from the snapshotter's namespace")
+		}
+	}
+	return err
+}
+
 func (o *snapshotter) View(ctx context.Context, key, parent string, opts ...snapshots.Opt) ([]mount.Mount, error) {
+	unlock := o.retryQueue.lock(parent)
 	s, err := o.createSnapshot(ctx, snapshots.KindView, key, parent, opts)
+	unlock()
 	if err != nil {
 		return nil, err
 	}
-	return o.mounts(ctx, s, parent)
+	mounts, err := o.mounts(ctx, s, parent)
+	if err != nil {
+		return nil, err
+	}
+	var base snapshots.Info
+	for _, opt := range opts {
+		if err := opt(&base); err != nil {
+			return nil, err
+		}
+	}
+	if isImageVolume(base.Labels) {
+		if err := o.updateImageVolumes(ctx); err != nil {
+			log.G(ctx).WithError(err).WithField("key", key).Warn("failed to update remote snapshots used by image volumes")
+		}
+	}
+	return mounts, nil
 }
 
 // Mounts returns the mounts for the transaction identified by key. Can be
@@ -290,7 +1041,12 @@ func (o *snapshotter) Mounts(ctx context.Context, key string) ([]mount.Mount, er
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get active mount")
 	}
-	return o.mounts(ctx, s, key)
+	mounts, err := o.mounts(ctx, s, key)
+	if err != nil {
+		return nil, err
+	}
+	o.waitForPrefetch(ctx, key)
+	return mounts, nil
 }
 
 func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snapshots.Opt) error {
@@ -308,27 +1064,46 @@ func (o *snapshotter) Commit(ctx context.Context, name, key string, opts ...snap
 	}()
 
 	// grab the existing id
-	id, _, _, err := storage.GetInfo(ctx, key)
+	id, info, _, err := storage.GetInfo(ctx, key)
 	if err != nil {
 		return err
 	}
 
-	usage, err := fs.DiskUsage(ctx, o.upperPath(id))
-	if err != nil {
-		return err
+	// The layer can be fully cached before the remote snapshot is committed.
+	if v, ok := info.Labels[FullyCachedLabel]; ok {
+		opts = append(opts, withLabel(FullyCachedLabel, v))
 	}
 
-	if _, err = storage.CommitActive(ctx, key, name, snapshots.Usage(usage), opts...); err != nil {
+	var usage fs.Usage
+	if !o.asyncUsage {
+		usage, err = fs.DiskUsage(ctx, o.upperPath(id))
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err = storage.CommitActive(ctx, key, name, snapshots.Usage(usage), o.persistentOpts(opts)...); err != nil {
 		return errors.Wrap(err, "failed to commit snapshot")
 	}
 
-	return t.Commit()
+	if err := t.Commit(); err != nil {
+		return err
+	}
+
+	if o.asyncUsage {
+		o.calculateUsage(log.WithLogger(context.Background(), log.G(ctx).WithField("key", name)), name, id)
+	}
+
+	return nil
 }
 
 // Remove abandons the snapshot identified by key. The snapshot will
 // immediately become unavailable and unrecoverable. Disk space will
 // be freed up on the next call to `Cleanup`.
 func (o *snapshotter) Remove(ctx context.Context, key string) (err error) {
+	unlock := o.retryQueue.lock(key)
+	defer unlock()
+
 	ctx, t, err := o.ms.TransactionContext(ctx, true)
 	if err != nil {
 		return err
@@ -341,11 +1116,44 @@ func (o *snapshotter) Remove(ctx context.Context, key string) (err error) {
 		}
 	}()
 
+	id, info, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return errors.Wrap(err, "failed to get info")
+	}
+	if isImageVolume(info.Labels) {
+		// Runs after the transaction is committed.
+		defer func() {
+			if err == nil {
+				if err := o.updateImageVolumes(ctx); err != nil {
+					log.G(ctx).WithError(err).WithField("key", key).Warn("failed to update remote snapshots used by image volumes")
+				}
+			}
+		}()
+	}
+
 	_, _, err = storage.Remove(ctx, key)
 	if err != nil {
 		return errors.Wrap(err, "failed to remove")
 	}
 
+	// Even if the removal of the directory is deferred until Cleanup, remote snapshots
+	// are unmounted immediately so that the filesystem can release resources (e.g. the
+	// connection to the registry) deterministically.
+	if _, ok := info.Labels[remoteLabel]; ok && o.asyncRemove {
+		defer func() {
+			if err == nil {
+				fs, fErr := o.fsOf(info.Labels)
+				if fErr != nil {
+					log.G(ctx).WithError(fErr).WithField("key", key).Debug("failed to get filesystem of remote snapshot")
+					return
+				}
+				if err := fs.Unmount(ctx, o.upperPath(id)); err != nil {
+					log.G(ctx).WithError(err).WithField("key", key).Debug("failed to unmount remote snapshot")
+				}
+			}
+		}()
+	}
+
 	if !o.asyncRemove {
 		var removals []string
 		const cleanupCommitted = false
@@ -395,11 +1203,40 @@ func (o *snapshotter) cleanup(ctx context.Context, cleanupCommitted bool) error
 	}
 
 	log.G(ctx).Debugf("cleanup: dirs=%v", cleanup)
-	for _, dir := range cleanup {
-		if err := o.cleanupSnapshotDirectory(ctx, dir); err != nil {
-			log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
-		}
+	if len(cleanup) == 0 {
+		return nil
+	}
+
+	var (
+		start    = time.Now()
+		total    = len(cleanup)
+		done     int
+		doneMu   sync.Mutex
+		wg       sync.WaitGroup
+		workerCh = make(chan struct{}, o.cleanupWorkers)
+	)
+	for _, dir := range cleanup {
+		dir := dir
+		workerCh <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				<-workerCh
+				wg.Done()
+			}()
+			if err := o.cleanupSnapshotDirectory(ctx, dir); err != nil {
+				log.G(ctx).WithError(err).WithField("path", dir).Warn("failed to remove directory")
+			}
+			doneMu.Lock()
+			done++
+			if done%cleanupProgressInterval == 0 && done < total {
+				log.G(ctx).Infof("cleanup: removed %d/%d directories", done, total)
+			}
+			doneMu.Unlock()
+		}()
 	}
+	wg.Wait()
+	log.G(ctx).Debugf("cleanup: removed %d directories in %v", total, time.Since(start))
 
 	return nil
 }
@@ -452,14 +1289,64 @@ func (o *snapshotter) cleanupSnapshotDirectory(ctx context.Context, dir string)
 
 	// On a remote snapshot, the layer is mounted on the "fs" directory.
 	// We use Filesystem's Unmount API so that it can do necessary finalization
-	// before/after the unmount.
+	// before/after the unmount. We don't know which filesystem mounted this
+	// directory so ask all of them.
 	mp := filepath.Join(dir, "fs")
-	if err := o.fs.Unmount(ctx, mp); err != nil {
-		log.G(ctx).WithError(err).WithField("dir", mp).Debug("failed to unmount")
+	for _, fs := range o.fsChain {
+		if err := fs.Unmount(ctx, mp); err != nil {
+			log.G(ctx).WithError(err).WithField("dir", mp).Debug("failed to unmount")
+			continue
+		}
+		break
+	}
+	// Never descend into the remote snapshot. Removing files there would make the
+	// filesystem fetch contents from the remote.
+	if mounted, err := mountinfo.Mounted(mp); err == nil && mounted {
+		if err := unmountWithRetry(ctx, mp); err != nil {
+			return errors.Wrapf(err, "failed to unmount %q; skip removal", mp)
+		}
 	}
-	if err := os.RemoveAll(dir); err != nil {
+	if o.upperDriver != nil {
+		if err := o.upperDriver.Remove(ctx, dir); err != nil {
+			return errors.Wrapf(err, "failed to remove volume %q", dir)
+		}
+	}
+	var err error
+	for i, backoff := 0, unmountRetryBackoff; i < unmountRetries; i, backoff = i+1, backoff*2 {
+		if err = os.RemoveAll(dir); err == nil || !errors.Is(err, syscall.EBUSY) {
+			break
+		}
+		time.Sleep(backoff)
+	}
+	if err != nil {
 		return errors.Wrapf(err, "failed to remove directory %q", dir)
 	}
+	if err := o.removeLink(filepath.Base(dir)); err != nil {
+		log.G(ctx).WithError(err).WithField("dir", dir).Warn("failed to remove link to the snapshot")
+	}
+	return nil
+}
+
+// unmountWithRetry unmounts the specified mountpoint. If the mountpoint is busy
+// (e.g. a container using it is exiting concurrently), this retries it with
+// backoff and finally falls back to the lazy unmount (MNT_DETACH).
+func unmountWithRetry(ctx context.Context, mp string) error {
+	for i, backoff := 0, unmountRetryBackoff; i < unmountRetries; i, backoff = i+1, backoff*2 {
+		err := syscall.Unmount(mp, 0)
+		switch err {
+		case nil, syscall.EINVAL, syscall.ENOENT:
+			return nil // unmounted or not a mountpoint anymore
+		case syscall.EBUSY, syscall.EAGAIN:
+			log.G(ctx).WithError(err).WithField("mountpoint", mp).Debugf("mountpoint is busy; retrying (%d/%d)", i+1, unmountRetries)
+			time.Sleep(backoff)
+		default:
+			return err
+		}
+	}
+	log.G(ctx).WithField("mountpoint", mp).Warn("mountpoint is still busy; detaching it lazily")
+	if err := syscall.Unmount(mp, syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+		return errors.Wrap(err, "failed to detach mountpoint")
+	}
 	return nil
 }
 
@@ -503,11 +1390,25 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 		}
 	}()
 
-	s, err := storage.CreateSnapshot(ctx, kind, key, parent, opts...)
+	s, err := storage.CreateSnapshot(ctx, kind, key, parent, o.persistentOpts(opts)...)
 	if err != nil {
 		return storage.Snapshot{}, errors.Wrap(err, "failed to create snapshot")
 	}
 
+	dir := td
+	if o.upperDriver != nil && kind == snapshots.KindActive {
+		// The snapshot is created on a volume at the snapshot directory. Contents
+		// can't be moved between volumes so the temporary directory isn't used.
+		path = filepath.Join(snapshotDir, s.ID)
+		if err = o.prepareVolume(ctx, s.ID, path); err != nil {
+			return storage.Snapshot{}, errors.Wrap(err, "failed to prepare volume")
+		}
+		if err = os.RemoveAll(td); err != nil {
+			return storage.Snapshot{}, errors.Wrap(err, "failed to remove temp dir")
+		}
+		td, dir = "", path
+	}
+
 	if len(s.ParentIDs) > 0 {
 		st, err := os.Stat(o.upperPath(s.ParentIDs[0]))
 		if err != nil {
@@ -516,7 +1417,7 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 
 		stat := st.Sys().(*syscall.Stat_t)
 
-		if err := os.Lchown(filepath.Join(td, "fs"), int(stat.Uid), int(stat.Gid)); err != nil {
+		if err := os.Lchown(filepath.Join(dir, "fs"), int(stat.Uid), int(stat.Gid)); err != nil {
 			if rerr := t.Rollback(); rerr != nil {
 				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
 			}
@@ -524,11 +1425,18 @@ func (o *snapshotter) createSnapshot(ctx context.Context, kind snapshots.Kind, k
 		}
 	}
 
-	path = filepath.Join(snapshotDir, s.ID)
-	if err = os.Rename(td, path); err != nil {
-		return storage.Snapshot{}, errors.Wrap(err, "failed to rename")
+	if td != "" {
+		path = filepath.Join(snapshotDir, s.ID)
+		if err = os.Rename(td, path); err != nil {
+			return storage.Snapshot{}, errors.Wrap(err, "failed to rename")
+		}
+		td = ""
+	}
+	if o.durability == DurabilitySync {
+		if err = syncDir(snapshotDir); err != nil {
+			return storage.Snapshot{}, errors.Wrap(err, "failed to sync snapshots directory")
+		}
 	}
-	td = ""
 
 	rollback = false
 	if err = t.Commit(); err != nil {
@@ -544,6 +1452,13 @@ func (o *snapshotter) prepareDirectory(ctx context.Context, snapshotDir string,
 		return "", errors.Wrap(err, "failed to create temp dir")
 	}
 
+	if o.quota != nil && kind == snapshots.KindActive {
+		// fs and work inherit the project of the directory.
+		if err := o.quota.set(td); err != nil {
+			return td, err
+		}
+	}
+
 	if err := os.Mkdir(filepath.Join(td, "fs"), 0755); err != nil {
 		return td, err
 	}
@@ -557,12 +1472,35 @@ func (o *snapshotter) prepareDirectory(ctx context.Context, snapshotDir string,
 	return td, nil
 }
 
+// prepareVolume creates the volume for the active snapshot at dir and the
+// directories used by overlayfs on it.
+func (o *snapshotter) prepareVolume(ctx context.Context, id, dir string) error {
+	if err := o.upperDriver.Create(ctx, id, dir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(filepath.Join(dir, "fs"), 0755); err != nil {
+		return err
+	}
+	return os.Mkdir(filepath.Join(dir, "work"), 0711)
+}
+
 func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey string) ([]mount.Mount, error) {
 	// Make sure that all layers lower than the target layer are available
 	if checkKey != "" && !o.checkAvailability(ctx, checkKey) {
 		return nil, errors.Wrapf(errdefs.ErrUnavailable, "layer %q unavailable", s.ID)
 	}
 
+	mounts, err := o.overlayMounts(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if o.mountHelper != "" {
+		return o.helperMounts(ctx, s, mounts)
+	}
+	return mounts, nil
+}
+
+func (o *snapshotter) overlayMounts(ctx context.Context, s storage.Snapshot) ([]mount.Mount, error) {
 	if len(s.ParentIDs) == 0 {
 		// if we only have one layer/no parents then just return a bind mount as overlay
 		// will not work
@@ -602,15 +1540,18 @@ func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey s
 		}, nil
 	}
 
-	parentPaths := make([]string, len(s.ParentIDs))
-	for i := range s.ParentIDs {
-		parentPaths[i] = o.upperPath(s.ParentIDs[i])
-	}
-
-	options = append(options, fmt.Sprintf("lowerdir=%s", strings.Join(parentPaths, ":")))
+	var tail []string
 	if o.userxattr {
-		options = append(options, "userxattr")
+		tail = append(tail, "userxattr")
+	}
+	if o.metacopy {
+		tail = append(tail, "metacopy=on")
 	}
+	lowerdir, err := o.lowerdirOption(ctx, s.ParentIDs, append(options, tail...))
+	if err != nil {
+		return nil, err
+	}
+	options = append(append(options, lowerdir), tail...)
 	return []mount.Mount{
 		{
 			Type:    "overlay",
@@ -618,7 +1559,40 @@ func (o *snapshotter) mounts(ctx context.Context, s storage.Snapshot, checkKey s
 			Options: options,
 		},
 	}, nil
+}
 
+// persistentOpts returns the options which drop the transient labels from the
+// snapshot stored in the metadata.
+func (o *snapshotter) persistentOpts(opts []snapshots.Opt) []snapshots.Opt {
+	if len(o.transientLabels) == 0 {
+		return opts
+	}
+	return append(opts[:len(opts):len(opts)], func(info *snapshots.Info) error {
+		info.Labels = o.withoutTransientLabels(info.Labels)
+		return nil
+	})
+}
+
+// withoutTransientLabels returns a copy of the labels without the transient
+// labels. The labels are returned as is if they have no transient labels.
+func (o *snapshotter) withoutTransientLabels(labels map[string]string) map[string]string {
+	var found bool
+	for _, k := range o.transientLabels {
+		if _, ok := labels[k]; ok {
+			found = true
+		}
+	}
+	if !found {
+		return labels
+	}
+	filtered := make(map[string]string, len(labels))
+	for k, v := range labels {
+		filtered[k] = v
+	}
+	for _, k := range o.transientLabels {
+		delete(filtered, k)
+	}
+	return filtered
 }
 
 func (o *snapshotter) upperPath(id string) string {
@@ -631,18 +1605,125 @@ func (o *snapshotter) workPath(id string) string {
 
 // Close closes the snapshotter
 func (o *snapshotter) Close() error {
+	if o.retryQueue != nil {
+		o.retryQueue.stop()
+	}
+	o.closeOnce.Do(func() { close(o.usageDone) })
+	o.usageWg.Wait()
+
 	// unmount all mounts including Committed
 	const cleanupCommitted = true
 	ctx := context.Background()
 	if err := o.cleanup(ctx, cleanupCommitted); err != nil {
 		log.G(ctx).WithError(err).Warn("failed to cleanup")
 	}
-	return o.ms.Close()
+	if o.db != nil {
+		if err := o.db.Sync(); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to sync metadata")
+		}
+	}
+	err := o.ms.Close()
+	if o.metadataFile != nil {
+		o.metadataFile.Close()
+	}
+	return err
+}
+
+// metadataDB returns the database of the metadata store. The store opens the
+// database on the first transaction and exposes it only through transactions.
+func metadataDB(ctx context.Context, ms *storage.MetaStore) (*bolt.DB, error) {
+	_, t, err := ms.TransactionContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Rollback()
+	tx, ok := t.(*bolt.Tx)
+	if !ok {
+		return nil, fmt.Errorf("unsupported metadata store")
+	}
+	return tx.DB(), nil
+}
+
+// syncDir flushes the entries (e.g. renames) of the directory to the disk.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
 }
 
 // prepareRemoteSnapshot tries to prepare the snapshot as a remote snapshot
-// using filesystems registered in this snapshotter.
-func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, key string, labels map[string]string) error {
+// using filesystems registered in this snapshotter. The index of the filesystem
+// which mounted the snapshot is returned.
+func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, key string, labels map[string]string) (int, string, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return -1, "", err
+	}
+	defer t.Rollback()
+	id, _, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return -1, "", err
+	}
+
+	fsID, err := o.mountOnCandidates(ctx, o.upperPath(id), labels)
+	return fsID, id, err
+}
+
+// addSourceLabels records the source of the remote snapshot mounted on the
+// mountpoint by the filesystem to the labels.
+func (o *snapshotter) addSourceLabels(ctx context.Context, fsID int, mountpoint string, labels map[string]string) {
+	if sfs, ok := o.fsChain[fsID].(SourceFileSystem); ok {
+		if src, err := sfs.Source(ctx, mountpoint); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to get source of remote snapshot")
+		} else {
+			if src.Ref != "" {
+				labels[SourceRefLabel] = src.Ref
+			}
+			if src.Digest != "" {
+				labels[SourceDigestLabel] = src.Digest
+			}
+		}
+	}
+	if cfs, ok := o.fsChain[fsID].(CapableFileSystem); ok {
+		if name := cfs.Capabilities(ctx).Name; name != "" {
+			labels[FileSystemNameLabel] = name
+		}
+	}
+}
+
+// mountOnCandidates mounts the layer specified by the labels on the mountpoint using
+// the first filesystem which succeeds to mount it. The index of the filesystem is
+// returned.
+func (o *snapshotter) mountOnCandidates(ctx context.Context, mountpoint string, labels map[string]string) (int, error) {
+	candidates := o.candidateFileSystems(ctx, labels)
+	if len(candidates) == 0 {
+		return -1, errors.Wrap(ErrLayerUnsupported, "no filesystem is available for the layer")
+	}
+	rErr := fmt.Errorf("failed to mount remote snapshot")
+	unsupported := true
+	for _, i := range candidates {
+		if err := o.fsChain[i].Mount(ctx, mountpoint, labels); err != nil {
+			rErr = errors.Wrapf(rErr, "filesystem %d: %v", i, err)
+			if errors.Cause(err) != ErrLayerUnsupported {
+				unsupported = false
+			}
+			continue
+		}
+		return i, nil
+	}
+	if unsupported {
+		// None of the filesystems will mount this layer.
+		return -1, errors.Wrapf(ErrLayerUnsupported, "%v", rErr)
+	}
+
+	return -1, rErr
+}
+
+// mountRemoteSnapshot mounts the existing remote snapshot using the specified filesystem.
+func (o *snapshotter) mountRemoteSnapshot(ctx context.Context, fs FileSystem, key string, labels map[string]string) error {
 	ctx, t, err := o.ms.TransactionContext(ctx, false)
 	if err != nil {
 		return err
@@ -652,14 +1733,273 @@ func (o *snapshotter) prepareRemoteSnapshot(ctx context.Context, key string, lab
 	if err != nil {
 		return err
 	}
+	return fs.Mount(ctx, o.upperPath(id), labels)
+}
+
+// candidateFileSystems returns indexes of filesystems which can mount the layer
+// specified by the labels. Unhealthy filesystems and filesystems which don't
+// support the media type of the layer are excluded.
+func (o *snapshotter) candidateFileSystems(ctx context.Context, labels map[string]string) (candidates []int) {
+	mediaType := labels[TargetMediaTypeLabel]
+	for i, fs := range o.fsChain {
+		cfs, ok := fs.(CapableFileSystem)
+		if !ok {
+			candidates = append(candidates, i)
+			continue
+		}
+		lCtx := log.WithLogger(ctx, log.G(ctx).WithField("filesystem", i))
+		if err := cfs.Health(ctx); err != nil {
+			log.G(lCtx).WithError(err).Debug("filesystem is unhealthy; skipping")
+			continue
+		}
+		if mediaType != "" && !supportsMediaType(cfs.Capabilities(ctx), mediaType) {
+			log.G(lCtx).Debugf("filesystem doesn't support media type %q; skipping", mediaType)
+			continue
+		}
+		candidates = append(candidates, i)
+	}
+	return
+}
+
+func supportsMediaType(caps Capabilities, mediaType string) bool {
+	if len(caps.MediaTypes) == 0 {
+		return true
+	}
+	for _, m := range caps.MediaTypes {
+		if m == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// Capabilities returns the capabilities of the filesystems of this snapshotter.
+func (o *snapshotter) Capabilities(ctx context.Context) (caps []Capabilities) {
+	for _, f := range o.fsChain {
+		if cfs, ok := f.(CapableFileSystem); ok {
+			caps = append(caps, cfs.Capabilities(ctx))
+		}
+	}
+	return caps
+}
+
+// CacheStats returns the statistics of the caches of the filesystems of this
+// snapshotter.
+func (o *snapshotter) CacheStats(ctx context.Context) (stats []CacheStats) {
+	for i, f := range o.fsChain {
+		if cfs, ok := f.(CacheStatsFileSystem); ok {
+			st := cfs.CacheStats(ctx)
+			st.FileSystem = o.fsIDs[i]
+			stats = append(stats, st)
+		}
+	}
+	return stats
+}
+
+// EvictCaches evicts the unused layers from the caches of the filesystems.
+func (o *snapshotter) EvictCaches(ctx context.Context) (stats []CacheStats) {
+	for i, f := range o.fsChain {
+		if efs, ok := f.(CacheEvictingFileSystem); ok {
+			st := efs.EvictCaches(ctx)
+			st.FileSystem = o.fsIDs[i]
+			stats = append(stats, st)
+		}
+	}
+	return stats
+}
+
+// RefreshRemoteSnapshot re-resolves the layer of the committed remote snapshot.
+func (o *snapshotter) RefreshRemoteSnapshot(ctx context.Context, key string) error {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	id, info, _, err := storage.GetInfo(ctx, key)
+	t.Rollback()
+	if err != nil {
+		return err
+	}
+	if _, ok := info.Labels[remoteLabel]; !ok || info.Kind != snapshots.KindCommitted {
+		return errors.Wrapf(errdefs.ErrInvalidArgument, "%q isn't a committed remote snapshot", key)
+	}
+	if o.mountHelper != "" {
+		return errors.Wrapf(errdefs.ErrNotImplemented, "%q is mounted by the mount helper", key)
+	}
+	fs, err := o.fsOf(info.Labels)
+	if err != nil {
+		return err
+	}
+	rfs, ok := fs.(RefreshableFileSystem)
+	if !ok {
+		return errors.Wrapf(errdefs.ErrNotImplemented, "filesystem of %q doesn't support refreshing", key)
+	}
+	return rfs.Refresh(ctx, o.upperPath(id), info.Labels)
+}
+
+// InvalidateTransports makes all remote snapshots re-establish their
+// connections to registries on their next fetch.
+func (o *snapshotter) InvalidateTransports(ctx context.Context) {
+	for _, f := range o.fsChain {
+		if ifs, ok := f.(TransportInvalidatingFileSystem); ok {
+			ifs.InvalidateTransports()
+		}
+	}
+}
+
+// SetBackgroundFetch pauses, resumes or throttles background fetch of all
+// filesystems.
+func (o *snapshotter) SetBackgroundFetch(ctx context.Context, cfg BackgroundFetchConfig) {
+	for _, f := range o.fsChain {
+		if bfs, ok := f.(BackgroundFetchControllingFileSystem); ok {
+			bfs.SetBackgroundFetch(ctx, cfg)
+		}
+	}
+}
+
+// BackgroundFetch returns the state of background fetch of the filesystems.
+func (o *snapshotter) BackgroundFetch(ctx context.Context) map[string]BackgroundFetchConfig {
+	states := make(map[string]BackgroundFetchConfig)
+	for i, f := range o.fsChain {
+		if bfs, ok := f.(BackgroundFetchControllingFileSystem); ok {
+			states[o.fsIDs[i]] = bfs.BackgroundFetch(ctx)
+		}
+	}
+	return states
+}
 
-	if err := o.fs.Mount(ctx, o.upperPath(id), labels); err != nil {
+// WalkRemoteStats calls fn with the statistics of each committed remote snapshot.
+// Snapshots whose statistics can't be got from the filesystem are skipped.
+func (o *snapshotter) WalkRemoteStats(ctx context.Context, fn func(ctx context.Context, info snapshots.Info, st Stats) error) error {
+	type remoteSnapshot struct {
+		id   string
+		info snapshots.Info
+	}
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
 		return err
 	}
+	var remotes []remoteSnapshot
+	if err := storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if _, ok := info.Labels[remoteLabel]; !ok || info.Kind != snapshots.KindCommitted {
+			return nil
+		}
+		id, _, _, err := storage.GetInfo(ctx, info.Name)
+		if err != nil {
+			return err
+		}
+		remotes = append(remotes, remoteSnapshot{id, info})
+		return nil
+	}); err != nil {
+		t.Rollback()
+		return err
+	}
+	t.Rollback() // transaction no longer needed at this point.
 
+	for _, r := range remotes {
+		fs, err := o.fsOf(r.info.Labels)
+		if err != nil {
+			return err
+		}
+		st, err := fs.Stats(ctx, o.upperPath(r.id))
+		if err != nil {
+			log.G(ctx).WithError(err).WithField("key", r.info.Name).Debug("failed to get stats of remote snapshot")
+			continue
+		}
+		if err := fn(ctx, r.info, st); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// fsOf returns the filesystem which mounted the remote snapshot specified by the labels.
+func (o *snapshotter) fsOf(labels map[string]string) (FileSystem, error) {
+	idStr, ok := labels[filesystemIDLabel]
+	if !ok {
+		// Snapshots created by older snapshotters are mounted by the primary filesystem.
+		return o.fsChain[0], nil
+	}
+	for i, id := range o.fsIDs {
+		if id == idStr {
+			return o.fsChain[i], nil
+		}
+	}
+	// Snapshots not migrated yet record the index of the filesystem.
+	if i, err := strconv.Atoi(idStr); err == nil && 0 <= i && i < len(o.fsChain) {
+		return o.fsChain[i], nil
+	}
+	return nil, fmt.Errorf("filesystem %q not found", idStr)
+}
+
+// fileSystemIDs returns the stable IDs of the filesystems. The name reported
+// by CapableFileSystem is used as the ID. Filesystems which don't report their
+// names are identified by the index in the chain.
+func fileSystemIDs(ctx context.Context, fsChain []FileSystem) ([]string, error) {
+	ids := make([]string, len(fsChain))
+	seen := make(map[string]struct{})
+	for i, f := range fsChain {
+		ids[i] = fmt.Sprintf("%d", i)
+		if cfs, ok := f.(CapableFileSystem); ok {
+			if name := cfs.Capabilities(ctx).Name; name != "" {
+				if _, err := strconv.Atoi(name); err == nil {
+					return nil, fmt.Errorf("name of filesystem %d mustn't be a number: %q", i, name)
+				}
+				ids[i] = name
+			}
+		}
+		if _, ok := seen[ids[i]]; ok {
+			return nil, fmt.Errorf("filesystem %d has duplicated name %q", i, ids[i])
+		}
+		seen[ids[i]] = struct{}{}
+	}
+	return ids, nil
+}
+
+// migrateFileSystemIDs replaces the indexes of filesystems recorded by older
+// snapshotters with the stable IDs of the filesystems. The indexes are assumed
+// to point to the same filesystems as before the migration, so the order of
+// the filesystems mustn't be changed at the same time as the upgrade.
+func (o *snapshotter) migrateFileSystemIDs(ctx context.Context) (err error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rerr := t.Rollback(); rerr != nil {
+				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+			}
+		}
+	}()
+
+	var migrate []snapshots.Info
+	if err := storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+		idStr, ok := info.Labels[filesystemIDLabel]
+		if !ok {
+			return nil
+		}
+		if i, err := strconv.Atoi(idStr); err == nil && 0 <= i && i < len(o.fsIDs) && o.fsIDs[i] != idStr {
+			migrate = append(migrate, info)
+		}
+		return nil
+	}); err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	if len(migrate) == 0 {
+		t.Rollback()
+		return nil
+	}
+	for _, info := range migrate {
+		i, _ := strconv.Atoi(info.Labels[filesystemIDLabel])
+		info.Labels[filesystemIDLabel] = o.fsIDs[i]
+		if _, err := storage.UpdateInfo(ctx, info, "labels."+filesystemIDLabel); err != nil {
+			return errors.Wrapf(err, "failed to update filesystem ID of %q", info.Name)
+		}
+		log.G(ctx).WithField("key", info.Name).Debugf("migrated filesystem ID to %q", o.fsIDs[i])
+	}
+	return t.Commit()
+}
+
 // checkAvailability checks avaiability of the specified layer and all lower
 // layers using filesystem's checking functionality.
 func (o *snapshotter) checkAvailability(ctx context.Context, key string) bool {
@@ -682,10 +2022,17 @@ func (o *snapshotter) checkAvailability(ctx context.Context, key string) bool {
 		}
 		mp := o.upperPath(id)
 		lCtx := log.WithLogger(ctx, log.G(ctx).WithField("mount-point", mp))
-		if _, ok := info.Labels[remoteLabel]; ok {
+		if _, ok := info.Labels[remoteLabel]; ok && o.mountHelper != "" {
+			log.G(lCtx).Debug("layer is mounted by the mount helper")
+		} else if ok {
+			fs, err := o.fsOf(info.Labels)
+			if err != nil {
+				log.G(lCtx).WithError(err).Warn("failed to get filesystem")
+				return false
+			}
 			eg.Go(func() error {
 				log.G(lCtx).Debug("checking mount point")
-				if err := o.fs.Check(egCtx, mp, info.Labels); err != nil {
+				if err := fs.Check(egCtx, mp, info.Labels); err != nil {
 					log.G(lCtx).WithError(err).Warn("layer is unavailable")
 					return err
 				}
@@ -703,18 +2050,6 @@ func (o *snapshotter) checkAvailability(ctx context.Context, key string) bool {
 }
 
 func (o *snapshotter) restoreRemoteSnapshot(ctx context.Context) error {
-	mounts, err := mountinfo.GetMounts(nil)
-	if err != nil {
-		return err
-	}
-	for _, m := range mounts {
-		if strings.HasPrefix(m.Mountpoint, filepath.Join(o.root, "snapshots")) {
-			if err := syscall.Unmount(m.Mountpoint, syscall.MNT_FORCE); err != nil {
-				return errors.Wrapf(err, "failed to unmount %s", m.Mountpoint)
-			}
-		}
-	}
-
 	var task []snapshots.Info
 	if err := o.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
 		if _, ok := info.Labels[remoteLabel]; ok {
@@ -724,11 +2059,175 @@ func (o *snapshotter) restoreRemoteSnapshot(ctx context.Context) error {
 	}); err != nil && !errdefs.IsNotFound(err) {
 		return err
 	}
+
+	// Mounts of detached filesystems may be still served.
+	keep := make(map[string]bool)
+	if o.mountHelper == "" {
+		for _, info := range task {
+			if fs, err := o.fsOf(info.Labels); err == nil && isDetached(fs) {
+				if mp, err := o.mountpointOf(ctx, info.Name); err == nil {
+					keep[mp] = true
+				}
+			}
+		}
+	}
+	if err := unmountStale(ctx, filepath.Join(o.root, "snapshots"), keep); err != nil {
+		return err
+	}
+
+	if o.mountHelper != "" {
+		return nil // remote snapshots are mounted by the mount helper
+	}
+
 	for _, info := range task {
-		if err := o.prepareRemoteSnapshot(ctx, info.Name, info.Labels); err != nil {
-			return errors.Wrapf(err, "failed to prepare remote snapshot: %s", info.Name)
+		err := func() error {
+			fs, err := o.fsOf(info.Labels)
+			if err != nil {
+				return errors.Wrap(err, "failed to get filesystem")
+			}
+			return o.restoreMount(ctx, fs, info.Name, info.Labels)
+		}()
+		_, wasUnavailable := info.Labels[UnavailableLabel]
+		if err != nil {
+			// Don't fail the startup. Containers using the snapshot fail with
+			// ErrUnavailable instead.
+			log.G(ctx).WithError(err).WithField("key", info.Name).Warn("failed to restore remote snapshot; marking it unavailable")
+		}
+		if available := err == nil; available == wasUnavailable {
+			if err := o.setUnavailable(ctx, info.Name, !available); err != nil {
+				return errors.Wrapf(err, "failed to update availability of remote snapshot: %s", info.Name)
+			}
 		}
 	}
 
 	return nil
 }
+
+// restoreMount mounts the remote snapshot again. If the filesystem is detached
+// from the snapshotter process and still serves the mount, the mount is kept.
+func (o *snapshotter) restoreMount(ctx context.Context, fs FileSystem, key string, labels map[string]string) error {
+	if isDetached(fs) {
+		mp, err := o.mountpointOf(ctx, key)
+		if err != nil {
+			return err
+		}
+		if mounted, err := mountinfo.Mounted(mp); err == nil && mounted {
+			lCtx := log.WithLogger(ctx, log.G(ctx).WithField("key", key))
+			if err := fs.Check(ctx, mp, labels); err == nil {
+				log.G(lCtx).Debug("keeping mount served by detached filesystem")
+				return nil
+			}
+			log.G(lCtx).WithError(err).Warn("mount of detached filesystem is broken; mounting again")
+			if err := fs.Unmount(ctx, mp); err != nil {
+				log.G(lCtx).WithError(err).Debug("failed to unmount; unmounting forcibly")
+				if err := forceUnmount(mp); err != nil {
+					return errors.Wrapf(err, "failed to unmount %s", mp)
+				}
+			}
+		}
+	}
+	return o.mountRemoteSnapshot(ctx, fs, key, labels)
+}
+
+func (o *snapshotter) mountpointOf(ctx context.Context, key string) (string, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return "", err
+	}
+	defer t.Rollback()
+	id, _, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return o.upperPath(id), nil
+}
+
+func isDetached(fs FileSystem) bool {
+	dfs, ok := fs.(DetachedFileSystem)
+	return ok && dfs.Detached()
+}
+
+// unmountStale unmounts the mounts of layers (i.e. "<id>/fs" and below) under
+// the snapshots directory left by the previous snapshotter process. Volumes of
+// the upper driver mounted on the snapshot directories (e.g. ZFS datasets) are
+// kept. FUSE mounts whose server has exited (e.g. on a crash) fail all
+// operations with ENOTCONN so they are forcibly unmounted. Mountpoints in keep
+// are kept if they still respond because they can be served by detached
+// filesystems.
+func unmountStale(ctx context.Context, snapshotDir string, keep map[string]bool) error {
+	mounts, err := mountinfo.GetMounts(mountinfo.PrefixFilter(snapshotDir))
+	if err != nil {
+		return err
+	}
+	// Unmount nested mounts first.
+	sort.Slice(mounts, func(i, j int) bool { return len(mounts[i].Mountpoint) > len(mounts[j].Mountpoint) })
+	for _, m := range mounts {
+		if !isLayerMountpoint(snapshotDir, m.Mountpoint) {
+			continue
+		}
+		_, err := os.Stat(m.Mountpoint)
+		if errors.Is(err, syscall.ENOTCONN) {
+			log.G(ctx).WithField("mountpoint", m.Mountpoint).Warn("unmounting stale FUSE mount (transport endpoint is not connected)")
+		} else if err == nil && keep[m.Mountpoint] {
+			continue
+		}
+		if err := forceUnmount(m.Mountpoint); err != nil {
+			return errors.Wrapf(err, "failed to unmount %s", m.Mountpoint)
+		}
+	}
+	return nil
+}
+
+// isLayerMountpoint returns true if the mountpoint is the "fs" directory of a
+// snapshot directory or is under it.
+func isLayerMountpoint(snapshotDir, mountpoint string) bool {
+	rel, err := filepath.Rel(snapshotDir, mountpoint)
+	if err != nil {
+		return false
+	}
+	elems := strings.Split(rel, string(filepath.Separator))
+	return len(elems) >= 2 && elems[0] != ".." && elems[1] == "fs"
+}
+
+// forceUnmount unmounts the mountpoint even if the filesystem doesn't respond.
+// The mountpoint is lazily detached if it can't be unmounted forcibly.
+func forceUnmount(mp string) error {
+	err := syscall.Unmount(mp, syscall.MNT_FORCE)
+	if err != nil && err != syscall.EINVAL {
+		err = syscall.Unmount(mp, syscall.MNT_DETACH)
+	}
+	if err == syscall.EINVAL {
+		return nil // not a mountpoint anymore
+	}
+	return err
+}
+
+// setUnavailable adds or removes UnavailableLabel of the snapshot.
+func (o *snapshotter) setUnavailable(ctx context.Context, key string, unavailable bool) (err error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			if rerr := t.Rollback(); rerr != nil {
+				log.G(ctx).WithError(rerr).Warn("failed to rollback transaction")
+			}
+		}
+	}()
+	_, info, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		return err
+	}
+	if unavailable {
+		if err := withLabel(UnavailableLabel, "true")(&info); err != nil {
+			return err
+		}
+	} else {
+		delete(info.Labels, UnavailableLabel)
+	}
+	if _, err := storage.UpdateInfo(ctx, info, "labels."+UnavailableLabel); err != nil {
+		return err
+	}
+	return t.Commit()
+}
@@ -23,8 +23,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 
 	"github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/mount"
@@ -32,6 +36,10 @@ import (
 	"github.com/containerd/containerd/snapshots"
 	"github.com/containerd/containerd/snapshots/storage"
 	"github.com/containerd/containerd/snapshots/testsuite"
+	"github.com/containerd/stargz-snapshotter/snapshot/overlayutils"
+	"github.com/moby/sys/mountinfo"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -232,224 +240,1995 @@ func TestRemoteCommit(t *testing.T) {
 	}
 }
 
-func TestFailureDetection(t *testing.T) {
+func TestRemoteUsage(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(context.TODO(), root, bindFileSystem(t))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+
+	// Prepare a remote snapshot.
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	defer sn.Remove(ctx, target)
+
+	// Usage of the remote snapshot must be reported by the filesystem.
+	usage, err := sn.Usage(ctx, target)
+	if err != nil {
+		t.Fatalf("failed to get usage of remote snapshot: %v", err)
+	}
+	if want := int64(len(remoteSampleFileContents)); usage.Size != want {
+		t.Errorf("usage size = %d; want %d", usage.Size, want)
+	}
+	if usage.Inodes != 0 {
+		t.Errorf("usage inodes = %d; want 0", usage.Inodes)
+	}
+}
+
+func TestWalkRemoteStats(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(context.TODO(), root, bindFileSystem(t))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+
+	// Prepare a remote snapshot and a local snapshot.
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	defer sn.Remove(ctx, target)
+	if _, err := sn.Prepare(ctx, "/tmp/local", target); err != nil {
+		t.Fatalf("failed to prepare local snapshot: %v", err)
+	}
+	defer sn.Remove(ctx, "/tmp/local")
+
+	// Only the remote snapshot must be walked.
+	var walked []string
+	if err := sn.(RemoteStatsWalker).WalkRemoteStats(ctx, func(ctx context.Context, info snapshots.Info, st Stats) error {
+		walked = append(walked, info.Name)
+		if want := int64(len(remoteSampleFileContents)); st.Size != want || st.FetchedSize != want {
+			t.Errorf("stats of %q = %+v; want size %d", info.Name, st, want)
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to walk stats: %v", err)
+	}
+	if len(walked) != 1 || walked[0] != target {
+		t.Errorf("walked snapshots = %v; want [%q]", walked, target)
+	}
+}
+
+func TestWalkFilters(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(context.TODO(), root, bindFileSystem(t))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+
+	// Prepare a remote snapshot and a local snapshot.
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	defer sn.Remove(ctx, target)
+	if _, err := sn.Prepare(ctx, "/tmp/local", target); err != nil {
+		t.Fatalf("failed to prepare local snapshot: %v", err)
+	}
+	defer sn.Remove(ctx, "/tmp/local")
+
+	for _, tt := range []struct {
+		filter string
+		want   string
+	}{
+		{filter: RemoteSnapshotFilter, want: target},
+		{filter: LocalSnapshotFilter, want: "/tmp/local"},
+	} {
+		var walked []string
+		if err := sn.Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+			walked = append(walked, info.Name)
+			return nil
+		}, tt.filter); err != nil {
+			t.Fatalf("failed to walk with filter %q: %v", tt.filter, err)
+		}
+		if len(walked) != 1 || walked[0] != tt.want {
+			t.Errorf("walked snapshots with filter %q = %v; want [%q]", tt.filter, walked, tt.want)
+		}
+	}
+}
+
+func TestRemoteFileSystemSelection(t *testing.T) {
 	testutil.RequiresRoot(t)
 	tests := []struct {
-		name    string
-		broken  []bool // top element is the lowest layer
-		overlay bool   // whether appending the topmost normal overlay snapshot or not
-		wantOK  bool
+		name      string
+		healthy   bool
+		mediaType string
+		wantID    string
 	}{
 		{
-			name:   "flat_ok",
-			broken: []bool{false},
-			wantOK: true,
+			name:      "use_primary",
+			healthy:   true,
+			mediaType: "application/supported",
+			wantID:    "0",
 		},
 		{
-			name:   "deep_ok",
-			broken: []bool{false, false, false},
-			wantOK: true,
+			name:      "unknown_mediatype",
+			healthy:   true,
+			mediaType: "",
+			wantID:    "0",
 		},
 		{
-			name:    "flat_overlay_ok",
-			broken:  []bool{false},
-			overlay: true,
-			wantOK:  true,
+			name:      "unhealthy_primary",
+			healthy:   false,
+			mediaType: "application/supported",
+			wantID:    "1",
 		},
 		{
-			name:    "deep_overlay_ok",
-			broken:  []bool{false, false, false},
-			overlay: true,
-			wantOK:  true,
+			name:      "unsupported_mediatype",
+			healthy:   true,
+			mediaType: "application/unsupported",
+			wantID:    "1",
 		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.TODO()
+			root, err := ioutil.TempDir("", "remote")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			primary := &capableFs{
+				FileSystem: bindFileSystem(t),
+				healthy:    tt.healthy,
+				caps:       Capabilities{MediaTypes: []string{"application/supported"}},
+			}
+			sn, err := NewSnapshotter(ctx, root, primary, WithFileSystems(bindFileSystem(t)))
+			if err != nil {
+				t.Fatalf("failed to make new remote snapshotter: %q", err)
+			}
+			labels := make(map[string]string)
+			if tt.mediaType != "" {
+				labels[TargetMediaTypeLabel] = tt.mediaType
+			}
+			target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", labels)
+			defer sn.Remove(ctx, target)
+			info, err := sn.Stat(ctx, target)
+			if err != nil {
+				t.Fatalf("failed to stat remote snapshot: %v", err)
+			}
+			if id := info.Labels[filesystemIDLabel]; id != tt.wantID {
+				t.Errorf("remote snapshot is mounted by filesystem %q; want %q", id, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestFileSystemIDMigration(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// Older snapshotters record the index of the filesystem.
+	sn, err := NewSnapshotter(ctx, root, bindFileSystem(t))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	defer sn.Remove(ctx, target)
+	if info, err := sn.Stat(ctx, target); err != nil {
+		t.Fatalf("failed to stat remote snapshot: %v", err)
+	} else if id := info.Labels[filesystemIDLabel]; id != "0" {
+		t.Fatalf("filesystem ID = %q; want %q", id, "0")
+	}
+
+	// The index is replaced with the name of the filesystem.
+	o := sn.(*snapshotter)
+	o.fsIDs = []string{"test"}
+	if err := o.migrateFileSystemIDs(ctx); err != nil {
+		t.Fatalf("failed to migrate filesystem IDs: %v", err)
+	}
+	info, err := sn.Stat(ctx, target)
+	if err != nil {
+		t.Fatalf("failed to stat remote snapshot: %v", err)
+	}
+	if id := info.Labels[filesystemIDLabel]; id != "test" {
+		t.Errorf("filesystem ID = %q; want %q", id, "test")
+	}
+	if _, err := o.fsOf(info.Labels); err != nil {
+		t.Errorf("failed to get filesystem of migrated snapshot: %v", err)
+	}
+}
+
+func TestRestoreRemoteSnapshot(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(ctx, root, bindFileSystem(t))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	info, err := sn.Stat(ctx, target)
+	if err != nil {
+		t.Fatalf("failed to stat remote snapshot: %v", err)
+	}
+	o := sn.(*snapshotter)
+	ctx2, tx, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, _, err := storage.GetInfo(ctx2, info.Name)
+	tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp := o.upperPath(id)
+
+	// Crash the snapshotter. The mount on the snapshot is left.
+	if err := o.ms.Close(); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(mp, syscall.MNT_DETACH)
+
+	// The snapshot which can't be mounted again is marked unavailable instead of
+	// failing the startup.
+	sn, err = NewSnapshotter(ctx, root, dummyFileSystem())
+	if err != nil {
+		t.Fatalf("failed to restart snapshotter: %v", err)
+	}
+	if mounted, err := mountinfo.Mounted(mp); err != nil || mounted {
+		t.Errorf("stale mount must be unmounted (mounted=%v, err=%v)", mounted, err)
+	}
+	if info, err := sn.Stat(ctx, target); err != nil {
+		t.Fatalf("failed to stat remote snapshot: %v", err)
+	} else if _, ok := info.Labels[UnavailableLabel]; !ok {
+		t.Errorf("remote snapshot failed to be restored must be labeled as unavailable")
+	}
+	if _, err := sn.Prepare(ctx, "/tmp/local", target); !errdefs.IsUnavailable(err) {
+		t.Errorf("unavailable snapshot must not be used; err = %v", err)
+	}
+	if err := sn.(*snapshotter).ms.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The label is removed once the snapshot is mounted.
+	sn, err = NewSnapshotter(ctx, root, bindFileSystem(t))
+	if err != nil {
+		t.Fatalf("failed to restart snapshotter: %v", err)
+	}
+	defer sn.Close()
+	if info, err := sn.Stat(ctx, target); err != nil {
+		t.Fatalf("failed to stat remote snapshot: %v", err)
+	} else if _, ok := info.Labels[UnavailableLabel]; ok {
+		t.Errorf("restored remote snapshot mustn't be labeled as unavailable")
+	}
+	sn.Remove(ctx, "/tmp/local")
+	if err := sn.Remove(ctx, target); err != nil {
+		t.Errorf("failed to remove remote snapshot: %v", err)
+	}
+}
+
+func TestRestoreDetachedMount(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(ctx, root, &detachedFs{FileSystem: bindFileSystem(t)})
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	o := sn.(*snapshotter)
+	mp, err := o.mountpointOf(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(mp, syscall.MNT_DETACH)
+
+	// The mount served by the detached filesystem is kept over the restart.
+	if err := o.ms.Close(); err != nil {
+		t.Fatal(err)
+	}
+	dfs := &detachedFs{FileSystem: bindFileSystem(t)}
+	sn, err = NewSnapshotter(ctx, root, dfs)
+	if err != nil {
+		t.Fatalf("failed to restart snapshotter: %v", err)
+	}
+	if dfs.mounts != 0 {
+		t.Errorf("live mount must be kept but mounted %d times", dfs.mounts)
+	}
+	if mounted, err := mountinfo.Mounted(mp); err != nil || !mounted {
+		t.Errorf("live mount must be kept (mounted=%v, err=%v)", mounted, err)
+	}
+
+	// The mount is mounted again if the filesystem doesn't serve it anymore.
+	if err := sn.(*snapshotter).ms.Close(); err != nil {
+		t.Fatal(err)
+	}
+	bfs := bindFileSystem(t).(*bindFs)
+	bfs.checkFailure = true
+	bfs.broken[mp] = true
+	dfs = &detachedFs{FileSystem: bfs}
+	sn, err = NewSnapshotter(ctx, root, dfs)
+	if err != nil {
+		t.Fatalf("failed to restart snapshotter: %v", err)
+	}
+	defer sn.Close()
+	if dfs.mounts != 1 {
+		t.Errorf("broken mount must be mounted again but mounted %d times", dfs.mounts)
+	}
+	if mounted, err := mountinfo.Mounted(mp); err != nil || !mounted {
+		t.Errorf("snapshot must be mounted (mounted=%v, err=%v)", mounted, err)
+	}
+	if err := sn.Remove(ctx, target); err != nil {
+		t.Errorf("failed to remove remote snapshot: %v", err)
+	}
+}
+
+func TestFileSystemIDs(t *testing.T) {
+	named := func(name string) FileSystem {
+		return &capableFs{FileSystem: &dummyFs{}, healthy: true, caps: Capabilities{Name: name}}
+	}
+	tests := []struct {
+		name    string
+		fss     []FileSystem
+		want    []string
+		wantErr bool
+	}{
 		{
-			name:   "flat_ng",
-			broken: []bool{true},
-			wantOK: false,
+			name: "named",
+			fss:  []FileSystem{named("a"), named("b")},
+			want: []string{"a", "b"},
 		},
 		{
-			name:   "deep_ng",
-			broken: []bool{false, true, false},
-			wantOK: false,
+			name: "unnamed",
+			fss:  []FileSystem{&dummyFs{}, named("b"), named("")},
+			want: []string{"0", "b", "2"},
 		},
 		{
-			name:    "flat_overlay_ng",
-			broken:  []bool{true},
-			overlay: true,
-			wantOK:  false,
+			name:    "duplicated",
+			fss:     []FileSystem{named("a"), named("a")},
+			wantErr: true,
 		},
 		{
-			name:    "deep_overlay_ng",
-			broken:  []bool{false, true, false},
-			overlay: true,
-			wantOK:  false,
+			name:    "number",
+			fss:     []FileSystem{&dummyFs{}, named("0")},
+			wantErr: true,
 		},
 	}
-
-	check := func(t *testing.T, ok bool, err error) bool {
-		if err == nil {
-			if !ok {
-				t.Error("check all passed but wanted to be failed")
-				return false
-			}
-		} else if errdefs.IsUnavailable(err) {
-			if ok {
-				t.Error("got Unavailable but wanted to be non-error")
-				return false
-			}
-		} else {
-			t.Errorf("got unexpected error %q", err)
-			return false
-		}
-		return true
-	}
-
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			ctx := context.TODO()
-			root, err := ioutil.TempDir("", "remote")
-			if err != nil {
-				t.Fatal(err)
+			ids, err := fileSystemIDs(context.TODO(), tt.fss)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got IDs %v; want error", ids)
+				}
+				return
 			}
-			defer os.RemoveAll(root)
-			fi := bindFileSystem(t)
-			sn, err := NewSnapshotter(context.TODO(), root, fi)
 			if err != nil {
-				t.Fatalf("failed to make new Snapshotter: %q", err)
+				t.Fatalf("failed to get IDs: %v", err)
 			}
-			fs, ok := fi.(*bindFs)
-			if !ok {
-				t.Fatalf("Invalid filesystem type(not *filesystem)")
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("IDs = %v; want %v", ids, tt.want)
 			}
+		})
+	}
+}
 
-			// Prepare snapshots
-			fs.checkFailure = false
-			pKey := ""
-			for i, broken := range tt.broken {
-				var (
-					targetName = fmt.Sprintf("/tmp/testTarget%d", i)
-					key        = fmt.Sprintf("/tmp/testKey%d", i)
-					labels     = make(map[string]string)
-				)
-				if broken {
-					labels[brokenLabel] = "true"
-				}
-				target := prepareWithTarget(t, sn, targetName, key, pKey, labels)
-				defer sn.Remove(ctx, target)
-				pKey = target
-			}
+func TestCapabilities(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	want := Capabilities{MediaTypes: []string{"application/supported"}, Features: []string{"prefetch"}}
+	primary := &capableFs{FileSystem: bindFileSystem(t), healthy: true, caps: want}
+	sn, err := NewSnapshotter(ctx, root, primary, WithFileSystems(bindFileSystem(t)))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+	r, ok := sn.(CapabilitiesReporter)
+	if !ok {
+		t.Fatalf("snapshotter doesn't report capabilities")
+	}
+	// The second filesystem doesn't implement CapableFileSystem so it's omitted.
+	if caps := r.Capabilities(ctx); !reflect.DeepEqual(caps, []Capabilities{want}) {
+		t.Errorf("unexpected capabilities %+v; want %+v", caps, []Capabilities{want})
+	}
+}
 
-			if tt.overlay {
-				key := "/tmp/test"
-				_, err := sn.Prepare(ctx, key, pKey)
-				if err != nil {
-					t.Fatal(err)
+func TestIdentityLabel(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(ctx, root, &identifyingFs{FileSystem: bindFileSystem(t), ident: "sha256:dummy"})
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	defer sn.Remove(ctx, target)
+	info, err := sn.Stat(ctx, target)
+	if err != nil {
+		t.Fatalf("failed to stat remote snapshot: %v", err)
+	}
+	if ident := info.Labels[IdentityLabel]; ident != "sha256:dummy" {
+		t.Errorf("identity of remote snapshot is %q; want %q", ident, "sha256:dummy")
+	}
+}
+
+// identifyingFs reports the fixed identity of layers.
+type identifyingFs struct {
+	FileSystem
+	ident string
+}
+
+func (fs *identifyingFs) Identity(ctx context.Context, mountpoint string) (string, error) {
+	return fs.ident, nil
+}
+
+func TestSourceLabels(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	src := Source{Ref: "registry.example/test:latest", Digest: "sha256:layer"}
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			root, err := ioutil.TempDir("", "remote")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			var opts []Opt
+			if enabled {
+				opts = append(opts, SourceLabels)
+			}
+			fs := &sourceFs{
+				capableFs: capableFs{FileSystem: bindFileSystem(t), healthy: true, caps: Capabilities{Name: "test"}},
+				src:       src,
+			}
+			sn, err := NewSnapshotter(ctx, root, fs, opts...)
+			if err != nil {
+				t.Fatalf("failed to make new remote snapshotter: %q", err)
+			}
+			defer sn.Close()
+			target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+			defer sn.Remove(ctx, target)
+			info, err := sn.Stat(ctx, target)
+			if err != nil {
+				t.Fatalf("failed to stat remote snapshot: %v", err)
+			}
+			want := map[string]string{
+				SourceRefLabel:      src.Ref,
+				SourceDigestLabel:   src.Digest,
+				FileSystemNameLabel: "test",
+			}
+			for k, v := range want {
+				if !enabled {
+					v = ""
 				}
-				cKey := "/tmp/layer"
-				if err := sn.Commit(ctx, cKey, key); err != nil {
-					t.Fatal(err)
+				if got := info.Labels[k]; got != v {
+					t.Errorf("label %q = %q; want %q", k, got, v)
 				}
-				defer sn.Remove(ctx, cKey)
-				pKey = cKey
 			}
+		})
+	}
+}
 
-			// Tests if we can detect layer unavailablity
-			key := "/tmp/snapshot.test"
-			fs.checkFailure = true
-			defer sn.Remove(ctx, key)
-			if _, err := sn.Prepare(ctx, key, pKey); !check(t, tt.wantOK, err) {
-				return
-			}
-			fs.checkFailure = false
-			key2 := "/tmp/test2"
-			if _, err = sn.Prepare(ctx, key2, pKey); err != nil {
+// sourceFs reports the fixed source of layers.
+type sourceFs struct {
+	capableFs
+	src Source
+}
+
+func (fs *sourceFs) Source(ctx context.Context, mountpoint string) (Source, error) {
+	return fs.src, nil
+}
+
+func TestTransientLabels(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	const transientLabel = "containerd.io/snapshot/remote/test.secret"
+	fs := &labelsFs{FileSystem: bindFileSystem(t)}
+	sn, err := NewSnapshotter(ctx, root, fs, TransientLabels(transientLabel))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+	labels := map[string]string{transientLabel: "secret", "other": "value"}
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", labels)
+	defer sn.Remove(ctx, target)
+	if got := fs.labels[transientLabel]; got != "secret" {
+		t.Errorf("transient label passed to the filesystem = %q; want %q", got, "secret")
+	}
+	if got := labels[transientLabel]; got != "secret" {
+		t.Errorf("labels of the client are modified: %q", got)
+	}
+	info, err := sn.Stat(ctx, target)
+	if err != nil {
+		t.Fatalf("failed to stat remote snapshot: %v", err)
+	}
+	if v, ok := info.Labels[transientLabel]; ok {
+		t.Errorf("transient label is stored: %q", v)
+	}
+	if got := info.Labels["other"]; got != "value" {
+		t.Errorf("label %q = %q; want %q", "other", got, "value")
+	}
+	info.Labels[transientLabel] = "secret"
+	info, err = sn.Update(ctx, info)
+	if err != nil {
+		t.Fatalf("failed to update remote snapshot: %v", err)
+	}
+	if v, ok := info.Labels[transientLabel]; ok {
+		t.Errorf("transient label is stored on update: %q", v)
+	}
+}
+
+// labelsFs records the labels of the last mounted layer.
+type labelsFs struct {
+	FileSystem
+	labels map[string]string
+}
+
+func (fs *labelsFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	fs.labels = labels
+	return fs.FileSystem.Mount(ctx, mountpoint, labels)
+}
+
+func TestPrefetchWait(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	tests := []struct {
+		name        string
+		opts        []Opt
+		labels      map[string]string
+		prefetched  bool
+		wantWait    bool
+		wantTimeout bool
+	}{
+		{name: "disabled"},
+		{name: "label", labels: map[string]string{PrefetchWaitLabel: "10s"}, prefetched: true, wantWait: true},
+		{name: "default", opts: []Opt{PrefetchWait(10 * time.Second)}, prefetched: true, wantWait: true},
+		{name: "timeout", labels: map[string]string{PrefetchWaitLabel: "100ms"}, wantWait: true, wantTimeout: true},
+		{name: "label overrides default", opts: []Opt{PrefetchWait(10 * time.Second)}, labels: map[string]string{PrefetchWaitLabel: "0"}},
+		{name: "invalid label", opts: []Opt{PrefetchWait(10 * time.Second)}, labels: map[string]string{PrefetchWaitLabel: "invalid"}, prefetched: true, wantWait: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "remote")
+			if err != nil {
 				t.Fatal(err)
 			}
-			defer sn.Remove(ctx, key2)
-			fs.checkFailure = true
-			if _, err := sn.Mounts(ctx, key2); !check(t, tt.wantOK, err) {
-				return
+			defer os.RemoveAll(root)
+			fs := &prefetchingFs{FileSystem: bindFileSystem(t), prefetched: make(chan struct{})}
+			if tt.prefetched {
+				close(fs.prefetched)
+			}
+			sn, err := NewSnapshotter(ctx, root, fs, tt.opts...)
+			if err != nil {
+				t.Fatalf("failed to make new remote snapshotter: %q", err)
+			}
+			defer sn.Close()
+			target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+			defer sn.Remove(ctx, target)
+			if _, err := sn.Prepare(ctx, "container", target, snapshots.WithLabels(tt.labels)); err != nil {
+				t.Fatalf("failed to prepare snapshot: %v", err)
+			}
+			defer sn.Remove(ctx, "container")
+			if _, err := sn.Mounts(ctx, "container"); err != nil {
+				t.Fatalf("failed to get mounts: %v", err)
+			}
+			if got := fs.waited > 0; got != tt.wantWait {
+				t.Errorf("waited = %v; want %v", got, tt.wantWait)
+			}
+			if got := fs.timedOut > 0; got != tt.wantTimeout {
+				t.Errorf("timed out = %v; want %v", got, tt.wantTimeout)
 			}
 		})
 	}
-}
+}
+
+// prefetchingFs completes the prefetch of layers when prefetched is closed.
+type prefetchingFs struct {
+	FileSystem
+	prefetched chan struct{}
+	waited     int
+	timedOut   int
+}
+
+func (fs *prefetchingFs) WaitForPrefetch(ctx context.Context, mountpoint string) error {
+	fs.waited++
+	select {
+	case <-fs.prefetched:
+		return nil
+	case <-ctx.Done():
+		fs.timedOut++
+		return ctx.Err()
+	}
+}
+
+func TestRetryRemotePrepare(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fi := &flakyFs{FileSystem: bindFileSystem(t), failures: 1}
+	sn, err := NewSnapshotter(ctx, root, fi, RetryRemotePrepare(10*time.Millisecond, 0))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+
+	// The first preparation fails so the client falls back to unpacking the layer.
+	target := "testTarget"
+	key := "/tmp/prepareTarget"
+	if _, err := sn.Prepare(ctx, key, "", snapshots.WithLabels(map[string]string{
+		targetSnapshotLabel: target,
+	})); err != nil {
+		t.Fatalf("failed to prepare fallback snapshot: %v", err)
+	}
+	if err := sn.Commit(ctx, target, key); err != nil {
+		t.Fatalf("failed to commit fallback snapshot: %v", err)
+	}
+	defer sn.Remove(ctx, target)
+
+	// The snapshot will be replaced with the remote snapshot in background.
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		info, err := sn.Stat(ctx, target)
+		if err != nil {
+			t.Fatalf("failed to stat snapshot: %v", err)
+		}
+		if _, ok := info.Labels[remoteLabel]; ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("snapshot hasn't been replaced with remote snapshot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	o := sn.(*snapshotter)
+	tctx, tx, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _, _, err := storage.GetInfo(tctx, target)
+	tx.Rollback()
+	if err != nil {
+		t.Fatalf("failed to get snapshot info: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(o.upperPath(id), remoteSampleFile))
+	if err != nil {
+		t.Fatalf("failed to read a file in the remote snapshot: %v", err)
+	}
+	if e := string(data); e != remoteSampleFileContents {
+		t.Fatalf("expected file contents %q but got %q", remoteSampleFileContents, e)
+	}
+}
+
+// Tests entries which can't be replaced (e.g. used as a lower layer) are dropped
+// after the retries run out.
+func TestRetryRemotePrepareWithChildren(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fi := &flakyFs{FileSystem: bindFileSystem(t), failures: 1}
+	sn, err := NewSnapshotter(ctx, root, fi, RetryRemotePrepare(10*time.Millisecond, 2))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+	o := sn.(*snapshotter)
+
+	target := "testTarget"
+	key := "/tmp/prepareTarget"
+	o.retryQueue.stop() // add the child before the retry starts
+	if _, err := sn.Prepare(ctx, key, "", snapshots.WithLabels(map[string]string{
+		targetSnapshotLabel: target,
+	})); err != nil {
+		t.Fatalf("failed to prepare fallback snapshot: %v", err)
+	}
+	if err := sn.Commit(ctx, target, key); err != nil {
+		t.Fatalf("failed to commit fallback snapshot: %v", err)
+	}
+	if _, err := sn.Prepare(ctx, "child", target); err != nil {
+		t.Fatalf("failed to prepare child snapshot: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		o.retryQueue.retryAll(ctx)
+	}
+	o.retryQueue.entriesMu.Lock()
+	n := len(o.retryQueue.entries)
+	o.retryQueue.entriesMu.Unlock()
+	if n != 0 {
+		t.Errorf("%d entries remain in the retry queue; want 0", n)
+	}
+	info, err := sn.Stat(ctx, target)
+	if err != nil {
+		t.Fatalf("failed to stat snapshot: %v", err)
+	}
+	if _, ok := info.Labels[remoteLabel]; ok {
+		t.Errorf("snapshot used as a lower layer must not be replaced")
+	}
+}
+
+// Tests layers which are never mounted by the filesystems aren't retried.
+func TestRetryRemotePrepareUnsupported(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root := t.TempDir()
+	fi := &flakyFs{FileSystem: bindFileSystem(t), failures: 1, err: ErrLayerUnsupported}
+	sn, err := NewSnapshotter(ctx, root, fi, RetryRemotePrepare(10*time.Millisecond, 0))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+	o := sn.(*snapshotter)
+	o.retryQueue.stop()
+
+	if _, err := sn.Prepare(ctx, "/tmp/prepareTarget", "", snapshots.WithLabels(map[string]string{
+		targetSnapshotLabel: "testTarget",
+	})); err != nil {
+		t.Fatalf("failed to prepare fallback snapshot: %v", err)
+	}
+	o.retryQueue.entriesMu.Lock()
+	n := len(o.retryQueue.entries)
+	o.retryQueue.entriesMu.Unlock()
+	if n != 0 {
+		t.Errorf("unsupported layer is added to the retry queue")
+	}
+}
+
+// Tests snapshots can't be used as a parent during the replacement.
+func TestRetryRemotePrepareLock(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root := t.TempDir()
+	fi := &blockingFs{
+		flakyFs: flakyFs{FileSystem: bindFileSystem(t), failures: 1},
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	sn, err := NewSnapshotter(ctx, root, fi, RetryRemotePrepare(10*time.Millisecond, 0))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+	o := sn.(*snapshotter)
+	o.retryQueue.stop()
+
+	target := "testTarget"
+	key := "/tmp/prepareTarget"
+	if _, err := sn.Prepare(ctx, key, "", snapshots.WithLabels(map[string]string{
+		targetSnapshotLabel: target,
+	})); err != nil {
+		t.Fatalf("failed to prepare fallback snapshot: %v", err)
+	}
+	if err := sn.Commit(ctx, target, key); err != nil {
+		t.Fatalf("failed to commit fallback snapshot: %v", err)
+	}
+
+	retryDone := make(chan struct{})
+	go func() {
+		o.retryQueue.retryAll(ctx)
+		close(retryDone)
+	}()
+	<-fi.started // the replacement is in progress
+	prepared := make(chan error)
+	go func() {
+		_, err := sn.Prepare(ctx, "child", target)
+		prepared <- err
+	}()
+	select {
+	case err := <-prepared:
+		t.Fatalf("child is prepared during the replacement: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(fi.release)
+	<-retryDone
+	if err := <-prepared; err != nil {
+		t.Fatalf("failed to prepare child snapshot: %v", err)
+	}
+	info, err := sn.Stat(ctx, target)
+	if err != nil {
+		t.Fatalf("failed to stat snapshot: %v", err)
+	}
+	if _, ok := info.Labels[remoteLabel]; !ok {
+		t.Errorf("snapshot hasn't been replaced with remote snapshot")
+	}
+}
+
+// blockingFs blocks mounting until released after the failures run out.
+type blockingFs struct {
+	flakyFs
+	started chan struct{}
+	release chan struct{}
+}
+
+func (fs *blockingFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	if fs.failures == 0 {
+		close(fs.started)
+		<-fs.release
+	}
+	return fs.flakyFs.Mount(ctx, mountpoint, labels)
+}
+
+// flakyFs fails to mount for the specified number of times.
+type flakyFs struct {
+	FileSystem
+	failures int
+	err      error // temporary failure by default
+}
+
+func (fs *flakyFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	if fs.failures > 0 {
+		fs.failures--
+		if fs.err != nil {
+			return fs.err
+		}
+		return fmt.Errorf("temporary failure")
+	}
+	return fs.FileSystem.Mount(ctx, mountpoint, labels)
+}
+
+type capableFs struct {
+	FileSystem
+	healthy bool
+	caps    Capabilities
+}
+
+func (fs *capableFs) Capabilities(ctx context.Context) Capabilities { return fs.caps }
+
+func (fs *capableFs) Health(ctx context.Context) error {
+	if !fs.healthy {
+		return fmt.Errorf("unhealthy")
+	}
+	return nil
+}
+
+func TestFailureDetection(t *testing.T) {
+	testutil.RequiresRoot(t)
+	tests := []struct {
+		name    string
+		broken  []bool // top element is the lowest layer
+		overlay bool   // whether appending the topmost normal overlay snapshot or not
+		wantOK  bool
+	}{
+		{
+			name:   "flat_ok",
+			broken: []bool{false},
+			wantOK: true,
+		},
+		{
+			name:   "deep_ok",
+			broken: []bool{false, false, false},
+			wantOK: true,
+		},
+		{
+			name:    "flat_overlay_ok",
+			broken:  []bool{false},
+			overlay: true,
+			wantOK:  true,
+		},
+		{
+			name:    "deep_overlay_ok",
+			broken:  []bool{false, false, false},
+			overlay: true,
+			wantOK:  true,
+		},
+		{
+			name:   "flat_ng",
+			broken: []bool{true},
+			wantOK: false,
+		},
+		{
+			name:   "deep_ng",
+			broken: []bool{false, true, false},
+			wantOK: false,
+		},
+		{
+			name:    "flat_overlay_ng",
+			broken:  []bool{true},
+			overlay: true,
+			wantOK:  false,
+		},
+		{
+			name:    "deep_overlay_ng",
+			broken:  []bool{false, true, false},
+			overlay: true,
+			wantOK:  false,
+		},
+	}
+
+	check := func(t *testing.T, ok bool, err error) bool {
+		if err == nil {
+			if !ok {
+				t.Error("check all passed but wanted to be failed")
+				return false
+			}
+		} else if errdefs.IsUnavailable(err) {
+			if ok {
+				t.Error("got Unavailable but wanted to be non-error")
+				return false
+			}
+		} else {
+			t.Errorf("got unexpected error %q", err)
+			return false
+		}
+		return true
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.TODO()
+			root, err := ioutil.TempDir("", "remote")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(root)
+			fi := bindFileSystem(t)
+			sn, err := NewSnapshotter(context.TODO(), root, fi)
+			if err != nil {
+				t.Fatalf("failed to make new Snapshotter: %q", err)
+			}
+			fs, ok := fi.(*bindFs)
+			if !ok {
+				t.Fatalf("Invalid filesystem type(not *filesystem)")
+			}
+
+			// Prepare snapshots
+			fs.checkFailure = false
+			pKey := ""
+			for i, broken := range tt.broken {
+				var (
+					targetName = fmt.Sprintf("/tmp/testTarget%d", i)
+					key        = fmt.Sprintf("/tmp/testKey%d", i)
+					labels     = make(map[string]string)
+				)
+				if broken {
+					labels[brokenLabel] = "true"
+				}
+				target := prepareWithTarget(t, sn, targetName, key, pKey, labels)
+				defer sn.Remove(ctx, target)
+				pKey = target
+			}
+
+			if tt.overlay {
+				key := "/tmp/test"
+				_, err := sn.Prepare(ctx, key, pKey)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cKey := "/tmp/layer"
+				if err := sn.Commit(ctx, cKey, key); err != nil {
+					t.Fatal(err)
+				}
+				defer sn.Remove(ctx, cKey)
+				pKey = cKey
+			}
+
+			// Tests if we can detect layer unavailablity
+			key := "/tmp/snapshot.test"
+			fs.checkFailure = true
+			defer sn.Remove(ctx, key)
+			if _, err := sn.Prepare(ctx, key, pKey); !check(t, tt.wantOK, err) {
+				return
+			}
+			fs.checkFailure = false
+			key2 := "/tmp/test2"
+			if _, err = sn.Prepare(ctx, key2, pKey); err != nil {
+				t.Fatal(err)
+			}
+			defer sn.Remove(ctx, key2)
+			fs.checkFailure = true
+			if _, err := sn.Mounts(ctx, key2); !check(t, tt.wantOK, err) {
+				return
+			}
+		})
+	}
+}
+
+func TestFullyCached(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs := &notifyingFs{FileSystem: bindFileSystem(t)}
+	var hooked []string
+	sn, err := NewSnapshotter(context.TODO(), root, fs, FullyCachedHook(func(ctx context.Context, name string) {
+		hooked = append(hooked, name)
+	}))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	if fs.handler == nil {
+		t.Fatalf("handler isn't registered")
+	}
+	checkFullyCached := func(name string, want bool) {
+		info, err := sn.Stat(ctx, name)
+		if err != nil {
+			t.Fatalf("failed to stat %q: %v", name, err)
+		}
+		if v, ok := info.Labels[FullyCachedLabel]; ok != want || (want && v != fullyCachedLabelVal) {
+			t.Errorf("unexpected fully cached label of %q: %q (exists: %v); want %v", name, v, ok, want)
+		}
+	}
+
+	// Remote snapshot is fully cached after committed.
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	defer sn.Remove(ctx, target)
+	checkFullyCached(target, false)
+	if len(fs.mountpoints) != 1 {
+		t.Fatalf("unexpected number of mounts %d; want 1", len(fs.mountpoints))
+	}
+	fs.handler(ctx, fs.mountpoints[0])
+	checkFullyCached(target, true)
+	if len(hooked) != 1 || hooked[0] != target {
+		t.Errorf("unexpected hooked snapshots %v; want [%q]", hooked, target)
+	}
+
+	// The label is kept over committing the snapshot.
+	key := "/tmp/active"
+	if _, err := sn.Prepare(ctx, key, ""); err != nil {
+		t.Fatalf("failed to prepare snapshot: %v", err)
+	}
+	fs.handler(ctx, sn.(*snapshotter).upperPath(snapshotID(t, ctx, sn, key)))
+	checkFullyCached(key, true)
+	committed := "committed"
+	if err := sn.Commit(ctx, committed, key); err != nil {
+		t.Fatalf("failed to commit snapshot: %v", err)
+	}
+	defer sn.Remove(ctx, committed)
+	checkFullyCached(committed, true)
+}
+
+func TestFuseMountHelper(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs := &namespacedFs{FileSystem: bindFileSystem(t)}
+	sock := filepath.Join(root, "helper.sock")
+	sn, err := NewSnapshotter(context.TODO(), root, fs, FuseMountHelper("test-helper", sock))
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+
+	// Remote snapshot isn't kept mounted in the snapshotter's namespace.
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	defer sn.Remove(ctx, target)
+	lower := sn.(*snapshotter).upperPath(snapshotID(t, ctx, sn, target))
+	if _, err := os.Stat(filepath.Join(lower, remoteSampleFile)); !os.IsNotExist(err) {
+		t.Fatalf("remote snapshot must not be mounted after prepared: %v", err)
+	}
+
+	// Snapshots on remote snapshots are returned as mounts for the helper.
+	pKey := "/tmp/test"
+	mounts, err := sn.Prepare(ctx, pKey, target)
+	if err != nil {
+		t.Fatalf("faild to prepare using lower remote layer: %v", err)
+	}
+	if len(mounts) != 1 {
+		t.Fatalf("should only have 1 mount but received %d", len(mounts))
+	}
+	m := mounts[0]
+	if m.Type != "fuse.test-helper" {
+		t.Errorf("mount type should be fuse.test-helper but received %q", m.Type)
+	}
+	var socketOpt, remoteOpt, typeOpt bool
+	for _, o := range m.Options {
+		switch o {
+		case "type=overlay":
+			typeOpt = true
+		case MountHelperSocketOption + "=" + sock:
+			socketOpt = true
+		case MountHelperRemoteOption + "=" + lower:
+			remoteOpt = true
+		}
+	}
+	if !typeOpt || !socketOpt || !remoteOpt {
+		t.Errorf("unexpected options %v", m.Options)
+	}
+
+	// The helper can ask to mount the remote snapshot.
+	if err := RequestMount(sock, lower); err != nil {
+		t.Fatalf("failed to request mount: %v", err)
+	}
+	defer syscall.Unmount(lower, 0)
+	if len(fs.mountpoints) != 1 || fs.mountpoints[0] != lower {
+		t.Fatalf("unexpected mountpoints %v; want [%q]", fs.mountpoints, lower)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(lower, remoteSampleFile))
+	if err != nil {
+		t.Fatalf("failed to read a file in the remote snapshot: %v", err)
+	}
+	if e := string(data); e != remoteSampleFileContents {
+		t.Fatalf("expected file contents %q but got %q", remoteSampleFileContents, e)
+	}
+
+	// Non-snapshot directories are rejected.
+	if err := RequestMount(sock, root); err == nil {
+		t.Errorf("mounting non-snapshot directory must fail")
+	}
+}
+
+type namespacedFs struct {
+	FileSystem
+	mountpoints []string
+}
+
+func (fs *namespacedFs) MountInNamespace(ctx context.Context, mountpoint string, labels map[string]string, mntns *os.File) error {
+	fs.mountpoints = append(fs.mountpoints, mountpoint)
+	return fs.FileSystem.Mount(ctx, mountpoint, labels)
+}
+
+func snapshotID(t *testing.T, ctx context.Context, sn snapshots.Snapshotter, key string) string {
+	ctx, tx, err := sn.(*snapshotter).ms.TransactionContext(ctx, false)
+	if err != nil {
+		t.Fatalf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+	id, _, _, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to get ID of %q: %v", key, err)
+	}
+	return id
+}
+
+type notifyingFs struct {
+	FileSystem
+	handler     func(ctx context.Context, mountpoint string)
+	mountpoints []string
+}
+
+func (fs *notifyingFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	fs.mountpoints = append(fs.mountpoints, mountpoint)
+	return fs.FileSystem.Mount(ctx, mountpoint, labels)
+}
+
+func (fs *notifyingFs) SetFullyCachedHandler(h func(ctx context.Context, mountpoint string)) {
+	fs.handler = h
+}
+
+// updatingFs records whether the layers are used by image volumes.
+type updatingFs struct {
+	FileSystem
+	imageVolume map[string]bool
+}
+
+func (fs *updatingFs) UpdateLabels(ctx context.Context, mountpoint string, labels map[string]string) error {
+	fs.imageVolume[mountpoint] = labels[ImageVolumeLabel] == "true"
+	return nil
+}
+
+func TestImageVolume(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs := &updatingFs{bindFileSystem(t), make(map[string]bool)}
+	sn, err := NewSnapshotter(context.TODO(), root, fs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	volumeLabels := snapshots.WithLabels(map[string]string{ImageVolumeLabel: "pod1"})
+
+	// Image volumes are read-only.
+	if _, err := sn.Prepare(ctx, "/tmp/volume-rw", target, volumeLabels); !errdefs.IsInvalidArgument(err) {
+		t.Errorf("image volume must not be prepared as active snapshot: %v", err)
+	}
+
+	// The layer is used by the image volume.
+	if _, err := sn.View(ctx, "/tmp/volume", target, volumeLabels); err != nil {
+		t.Fatalf("failed to create image volume: %v", err)
+	}
+	mp := getParents(ctx, sn, root, "/tmp/volume")[0]
+	if !fs.imageVolume[mp] {
+		t.Errorf("filesystem must be notified of the layer used by the image volume")
+	}
+
+	// Other views don't affect image volumes.
+	if _, err := sn.View(ctx, "/tmp/view", target); err != nil {
+		t.Fatal(err)
+	}
+	if err := sn.Remove(ctx, "/tmp/view"); err != nil {
+		t.Fatal(err)
+	}
+	if !fs.imageVolume[mp] {
+		t.Errorf("layer must be used by the image volume")
+	}
+
+	// The layer is released when the image volume is removed.
+	if err := sn.Remove(ctx, "/tmp/volume"); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := fs.imageVolume[mp]; !ok || v {
+		t.Errorf("filesystem must be notified of the layer released by the image volume")
+	}
+}
+
+type refreshingFs struct {
+	FileSystem
+	refreshed   []string
+	invalidated int
+	evicted     int
+}
+
+func (fs *refreshingFs) Refresh(ctx context.Context, mountpoint string, labels map[string]string) error {
+	fs.refreshed = append(fs.refreshed, mountpoint)
+	return nil
+}
+
+func (fs *refreshingFs) InvalidateTransports() { fs.invalidated++ }
+
+func (fs *refreshingFs) EvictCaches(ctx context.Context) CacheStats {
+	fs.evicted++
+	return CacheStats{Layers: 1, Blobs: 2}
+}
+
+func TestRefreshRemoteSnapshot(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs := &refreshingFs{FileSystem: bindFileSystem(t)}
+	sn, err := NewSnapshotter(context.TODO(), root, fs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	if _, err := sn.Prepare(ctx, "/tmp/local", target); err != nil {
+		t.Fatalf("failed to prepare local snapshot: %v", err)
+	}
+
+	// Only remote snapshots can be refreshed.
+	r := sn.(RemoteSnapshotRefresher)
+	if err := r.RefreshRemoteSnapshot(ctx, "/tmp/local"); !errdefs.IsInvalidArgument(err) {
+		t.Errorf("local snapshot must not be refreshed: %v", err)
+	}
+	if err := r.RefreshRemoteSnapshot(ctx, "notexist"); !errdefs.IsNotFound(err) {
+		t.Errorf("nonexistent snapshot must not be refreshed: %v", err)
+	}
+	if err := r.RefreshRemoteSnapshot(ctx, target); err != nil {
+		t.Fatalf("failed to refresh remote snapshot: %v", err)
+	}
+	if len(fs.refreshed) != 1 || fs.refreshed[0] != getParents(ctx, sn, root, "/tmp/local")[0] {
+		t.Errorf("refreshed mountpoints = %v; want the layer of %q", fs.refreshed, target)
+	}
+
+	r.InvalidateTransports(ctx)
+	if fs.invalidated != 1 {
+		t.Errorf("transports of the filesystem must be invalidated")
+	}
+	stats := sn.(CacheEvictor).EvictCaches(ctx)
+	if len(stats) != 1 || stats[0].FileSystem != "0" || stats[0].Layers != 1 || stats[0].Blobs != 2 || fs.evicted != 1 {
+		t.Errorf("evicted caches = %+v; want 1 layer and 2 blobs of filesystem 0", stats)
+	}
+}
+
+// Tests the active snapshot used for import is removed when the commit fails
+// because the snapshot is created concurrently.
+func TestImportRemoteSnapshotCommitFailure(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	fs := &concurrentCreateFs{FileSystem: bindFileSystem(t), t: t}
+	sn, err := NewSnapshotter(ctx, root, fs)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %q", err)
+	}
+	defer sn.Close()
+	fs.sn = sn
+
+	imported, err := sn.(StateExporter).ImportRemoteSnapshots(ctx, []RemoteSnapshotState{{Name: "a"}})
+	if err != nil {
+		t.Fatalf("snapshot created concurrently must be treated as imported: %v", err)
+	}
+	if !reflect.DeepEqual(imported, []string{"a"}) {
+		t.Errorf("imported %v; want [a]", imported)
+	}
+	if _, err := sn.Stat(ctx, importKeyPrefix+"a"); !errdefs.IsNotFound(err) {
+		t.Errorf("active snapshot used for import remains after commit failure: %v", err)
+	}
+	if info, err := sn.Stat(ctx, "a"); err != nil || info.Kind != snapshots.KindCommitted {
+		t.Errorf("snapshot created concurrently must remain: %+v, %v", info, err)
+	}
+}
+
+// concurrentCreateFs creates the snapshot "a" after the layer is mounted, before
+// the snapshot is committed.
+type concurrentCreateFs struct {
+	FileSystem
+	t  *testing.T
+	sn snapshots.Snapshotter
+}
+
+func (fs *concurrentCreateFs) Identity(ctx context.Context, mountpoint string) (string, error) {
+	if _, err := fs.sn.Prepare(ctx, "concurrent-a", ""); err != nil {
+		fs.t.Fatalf("failed to prepare: %v", err)
+	}
+	if err := fs.sn.Commit(ctx, "a", "concurrent-a"); err != nil {
+		fs.t.Fatalf("failed to commit: %v", err)
+	}
+	return "", nil
+}
+
+func bindFileSystem(t *testing.T) FileSystem {
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatalf("failed to prepare working-space for bind filesystem: %q", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, remoteSampleFile), []byte(remoteSampleFileContents), 0660); err != nil {
+		t.Fatalf("failed to write sample file of bind filesystem: %q", err)
+	}
+	return &bindFs{
+		root:   root,
+		t:      t,
+		broken: make(map[string]bool),
+	}
+}
+
+type bindFs struct {
+	t            *testing.T
+	root         string
+	checkFailure bool
+	broken       map[string]bool
+}
+
+func (fs *bindFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	if _, ok := labels[brokenLabel]; ok {
+		fs.broken[mountpoint] = true
+	}
+	if err := syscall.Mount(fs.root, mountpoint, "none", syscall.MS_BIND, ""); err != nil {
+		fs.t.Fatalf("failed to bind mount %q to %q: %v", fs.root, mountpoint, err)
+	}
+	return nil
+}
+
+func (fs *bindFs) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
+	if fs.checkFailure {
+		if broken, ok := fs.broken[mountpoint]; ok && broken {
+			return fmt.Errorf("broken")
+		}
+	}
+	return nil
+}
+
+func (fs *bindFs) Unmount(ctx context.Context, mountpoint string) error {
+	return syscall.Unmount(mountpoint, 0)
+}
+
+func (fs *bindFs) Stats(ctx context.Context, mountpoint string) (Stats, error) {
+	return Stats{Size: int64(len(remoteSampleFileContents)), FetchedSize: int64(len(remoteSampleFileContents))}, nil
+}
+
+type detachedFs struct {
+	FileSystem
+	mounts int
+}
+
+func (fs *detachedFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	fs.mounts++
+	return fs.FileSystem.Mount(ctx, mountpoint, labels)
+}
+
+func (fs *detachedFs) Detached() bool { return true }
+
+func dummyFileSystem() FileSystem { return &dummyFs{} }
+
+type dummyFs struct{}
+
+func (fs *dummyFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return fmt.Errorf("dummy")
+}
+
+func (fs *dummyFs) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
+	return fmt.Errorf("dummy")
+}
+
+func (fs *dummyFs) Unmount(ctx context.Context, mountpoint string) error {
+	return fmt.Errorf("dummy")
+}
+
+func (fs *dummyFs) Stats(ctx context.Context, mountpoint string) (Stats, error) {
+	return Stats{}, fmt.Errorf("dummy")
+}
+
+// =============================================================================
+// Tests backword-comaptibility of overlayfs snapshotter.
+
+func TestOverlayLowerdirLinks(t *testing.T) {
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	o, _, err := newSnapshotter(ctx, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make a chain of layers whose lowerdirs exceed a page.
+	parent := ""
+	for i := 0; i < os.Getpagesize()/len(filepath.Join(root, "snapshots/1/fs"))+1; i++ {
+		key, name := fmt.Sprintf("/tmp/layer%d", i), fmt.Sprintf("layer%d", i)
+		if _, err := o.Prepare(ctx, key, parent); err != nil {
+			t.Fatal(err)
+		}
+		if err := o.Commit(ctx, name, key); err != nil {
+			t.Fatal(err)
+		}
+		parent = name
+	}
+	mounts, err := o.View(ctx, "/tmp/view", parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opt := mounts[0].Options[0]
+	if !strings.HasPrefix(opt, "lowerdir=") {
+		t.Fatalf("unexpected option %q", opt)
+	}
+	lowers := getParents(ctx, o, root, "/tmp/view")
+	links := strings.Split(strings.TrimPrefix(opt, "lowerdir="), ":")
+	if len(links) != len(lowers) {
+		t.Fatalf("%d lowerdirs; want %d", len(links), len(lowers))
+	}
+	for i, l := range links {
+		if filepath.Dir(l) != filepath.Join(root, linkDir) {
+			t.Fatalf("lowerdir %q must be a link under %q", l, linkDir)
+		}
+		got, err := filepath.EvalSymlinks(l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, _ := filepath.EvalSymlinks(lowers[i]); got != want {
+			t.Errorf("link %q points to %q; want %q", l, got, want)
+		}
+	}
+
+	// The link is removed with the snapshot.
+	if err := o.Remove(ctx, "/tmp/view"); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Remove(ctx, parent); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(links[0]); !os.IsNotExist(err) {
+		t.Errorf("link of the removed snapshot must be removed: %v", err)
+	}
+	if _, err := os.Lstat(links[1]); err != nil {
+		t.Errorf("link of the remaining snapshot must be kept: %v", err)
+	}
+}
+
+func TestAsyncUsageRemoved(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	sn, err := NewSnapshotter(ctx, t.TempDir(), dummyFileSystem(), AsynchronousUsage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sn.Close()
+	o := sn.(*snapshotter)
+	if _, err := sn.Prepare(ctx, "a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := sn.Commit(ctx, "base", "a"); err != nil {
+		t.Fatal(err)
+	}
+	o.usageWg.Wait()
+	id := snapshotID(t, ctx, sn, "base")
+
+	// The calculation finished after the removal must be discarded.
+	if err := sn.Remove(ctx, "base"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(o.upperPath(id), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.storeUsage(ctx, "base", id); err != nil {
+		t.Fatalf("usage of the removed snapshot must be discarded: %v", err)
+	}
+
+	// The name can be reused by another snapshot.
+	if _, err := sn.Prepare(ctx, "base", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.storeUsage(ctx, "base", id); err != nil {
+		t.Fatal(err)
+	}
+	if usage := storedUsage(t, o, "base"); usage != (snapshots.Usage{}) {
+		t.Errorf("usage of the removed snapshot must not be recorded to another one: %+v", usage)
+	}
+}
+
+func storedUsage(t *testing.T, o *snapshotter, key string) snapshots.Usage {
+	ctx, tx, err := o.ms.TransactionContext(context.TODO(), false)
+	if err != nil {
+		t.Fatalf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback()
+	_, _, usage, err := storage.GetInfo(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to get usage of %q: %v", key, err)
+	}
+	return usage
+}
+
+func newSnapshotter(ctx context.Context, root string) (snapshots.Snapshotter, func() error, error) {
+	snapshotter, err := NewSnapshotter(context.TODO(), root, dummyFileSystem())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return snapshotter, func() error { return snapshotter.Close() }, nil
+}
+
+func TestOverlay(t *testing.T) {
+	testutil.RequiresRoot(t)
+	testsuite.SnapshotterSuite(t, "Overlay", newSnapshotter)
+}
+
+func TestOverlayAsyncUsage(t *testing.T) {
+	testutil.RequiresRoot(t)
+	testsuite.SnapshotterSuite(t, "OverlayAsyncUsage", func(ctx context.Context, root string) (snapshots.Snapshotter, func() error, error) {
+		snapshotter, err := NewSnapshotter(context.TODO(), root, dummyFileSystem(), AsynchronousUsage)
+		if err != nil {
+			return nil, nil, err
+		}
+		return snapshotter, func() error { return snapshotter.Close() }, nil
+	})
+}
+
+func TestAsyncUsageRestart(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root := t.TempDir()
+	sn, err := NewSnapshotter(ctx, root, dummyFileSystem(), AsynchronousUsage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounts, err := sn.Prepare(ctx, "a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mounts[0].Source, "foo"), []byte("hi"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	if err := sn.Commit(ctx, "base", "a"); err != nil {
+		t.Fatal(err)
+	}
+	o := sn.(*snapshotter)
+	o.usageWg.Wait()
+	if usage := storedUsage(t, o, "base"); usage.Inodes != 2 {
+		t.Fatalf("usage must be recorded in the metadata store; got %+v", usage)
+	}
+
+	// The usage not recorded before stopping is calculated again on startup.
+	_, tc, err := o.ms.TransactionContext(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := putUsage(tc.(*bolt.Tx), "base", snapshots.Usage{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tc.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// Close only the metadata store because Close removes the snapshot directories.
+	if err := o.ms.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sn, err = NewSnapshotter(ctx, root, dummyFileSystem(), AsynchronousUsage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sn.Close()
+	o = sn.(*snapshotter)
+	o.usageWg.Wait()
+	if usage := storedUsage(t, o, "base"); usage.Inodes != 2 {
+		t.Fatalf("usage must be calculated on startup; got %+v", usage)
+	}
+	usage, err := sn.Usage(ctx, "base")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Inodes != 2 {
+		t.Errorf("unexpected usage %+v", usage)
+	}
+}
+
+func TestDurability(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	if _, err := NewSnapshotter(ctx, "/nonexistent", bindFileSystem(t), WithDurability("unknown")); err == nil {
+		t.Errorf("unknown durability must be rejected")
+	}
+	for _, d := range []Durability{DurabilityDefault, DurabilitySync, DurabilityNoSync} {
+		root, err := ioutil.TempDir("", "remote")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(root)
+		sn, err := NewSnapshotter(ctx, root, bindFileSystem(t), WithDurability(d))
+		if err != nil {
+			t.Fatalf("failed to make new remote snapshotter with durability %q: %v", d, err)
+		}
+		if noSync := sn.(*snapshotter).db != nil && sn.(*snapshotter).db.NoSync; noSync != (d == DurabilityNoSync) {
+			t.Errorf("durability %q: NoSync = %v", d, noSync)
+		}
+		if _, err := sn.Prepare(ctx, "active", ""); err != nil {
+			t.Fatalf("durability %q: failed to prepare: %v", d, err)
+		}
+		if err := sn.Commit(ctx, "committed", "active"); err != nil {
+			t.Fatalf("durability %q: failed to commit: %v", d, err)
+		}
+		if err := sn.Close(); err != nil {
+			t.Fatalf("durability %q: failed to close: %v", d, err)
+		}
+
+		// The snapshot must be kept after the snapshotter is restarted.
+		sn, err = NewSnapshotter(ctx, root, bindFileSystem(t), WithDurability(d))
+		if err != nil {
+			t.Fatalf("failed to restart snapshotter with durability %q: %v", d, err)
+		}
+		if _, err := sn.Stat(ctx, "committed"); err != nil {
+			t.Errorf("durability %q: committed snapshot is lost: %v", d, err)
+		}
+		sn.Close()
+	}
+}
+
+func TestInMemoryMetadata(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(ctx, root, bindFileSystem(t), InMemoryMetadata)
+	if err != nil {
+		t.Fatalf("failed to make new remote snapshotter: %v", err)
+	}
+	target := prepareWithTarget(t, sn, "testTarget", "/tmp/prepareTarget", "", nil)
+	if _, err := sn.Prepare(ctx, "active", target); err != nil {
+		t.Fatalf("failed to prepare: %v", err)
+	}
+	if err := sn.Commit(ctx, "committed", "active"); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+	if info, err := sn.Stat(ctx, "committed"); err != nil || info.Parent != target {
+		t.Errorf("committed snapshot must be readable (info=%+v, err=%v)", info, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "metadata.db")); !os.IsNotExist(err) {
+		t.Errorf("metadata must not be stored under the root: %v", err)
+	}
+	if err := sn.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// The snapshots are forgotten after the snapshotter is restarted.
+	sn, err = NewSnapshotter(ctx, root, bindFileSystem(t), InMemoryMetadata)
+	if err != nil {
+		t.Fatalf("failed to restart snapshotter: %v", err)
+	}
+	defer sn.Close()
+	if _, err := sn.Stat(ctx, "committed"); !errdefs.IsNotFound(err) {
+		t.Errorf("snapshot must be forgotten; err = %v", err)
+	}
+}
+
+func TestParallelCleanup(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(ctx, root, dummyFileSystem(), AsynchronousRemove, CleanupWorkers(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sn.Close()
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("/tmp/test-%d", i)
+		if _, err := sn.Prepare(ctx, key, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := sn.Remove(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sn.(snapshots.Cleaner).Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	dirs, err := ioutil.ReadDir(filepath.Join(root, "snapshots"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) != 0 {
+		t.Fatalf("expected no directory after cleanup but got %d", len(dirs))
+	}
+}
+
+func TestCleanupBusyMount(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(ctx, root, dummyFileSystem())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sn.Close()
 
-func bindFileSystem(t *testing.T) FileSystem {
-	root, err := ioutil.TempDir("", "remote")
+	dir := filepath.Join(root, "snapshots", "busy")
+	mp := filepath.Join(dir, "fs")
+	if err := os.MkdirAll(mp, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mount("tmpfs", mp, "tmpfs", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(mp, syscall.MNT_DETACH)
+
+	// Keep the mountpoint busy.
+	f, err := os.Create(filepath.Join(mp, "file"))
 	if err != nil {
-		t.Fatalf("failed to prepare working-space for bind filesystem: %q", err)
+		t.Fatal(err)
 	}
-	if err := ioutil.WriteFile(filepath.Join(root, remoteSampleFile), []byte(remoteSampleFileContents), 0660); err != nil {
-		t.Fatalf("failed to write sample file of bind filesystem: %q", err)
+	defer f.Close()
+
+	if err := sn.(*snapshotter).cleanupSnapshotDirectory(ctx, dir); err != nil {
+		t.Fatalf("failed to cleanup busy snapshot directory: %v", err)
 	}
-	return &bindFs{
-		root:   root,
-		t:      t,
-		broken: make(map[string]bool),
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Fatalf("snapshot directory must be removed: %v", err)
 	}
 }
 
-type bindFs struct {
-	t            *testing.T
-	root         string
-	checkFailure bool
-	broken       map[string]bool
+// dirUpperDriver is an UpperDriver which creates plain directories as volumes
+// and records them.
+type dirUpperDriver struct {
+	created map[string]string // dir -> id
+	removed []string
 }
 
-func (fs *bindFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
-	if _, ok := labels[brokenLabel]; ok {
-		fs.broken[mountpoint] = true
-	}
-	if err := syscall.Mount(fs.root, mountpoint, "none", syscall.MS_BIND, ""); err != nil {
-		fs.t.Fatalf("failed to bind mount %q to %q: %v", fs.root, mountpoint, err)
-	}
-	return nil
+func (d *dirUpperDriver) Init(ctx context.Context, snapshotDir string) error { return nil }
+
+func (d *dirUpperDriver) Create(ctx context.Context, id, dir string) error {
+	d.created[dir] = id
+	return os.Mkdir(dir, 0700)
 }
 
-func (fs *bindFs) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
-	if fs.checkFailure {
-		if broken, ok := fs.broken[mountpoint]; ok && broken {
-			return fmt.Errorf("broken")
-		}
+func (d *dirUpperDriver) Remove(ctx context.Context, dir string) error {
+	if _, ok := d.created[dir]; ok {
+		d.removed = append(d.removed, dir)
 	}
 	return nil
 }
 
-func (fs *bindFs) Unmount(ctx context.Context, mountpoint string) error {
-	return syscall.Unmount(mountpoint, 0)
-}
-
-func dummyFileSystem() FileSystem { return &dummyFs{} }
+// tmpfsUpperDriver is an UpperDriver which mounts tmpfs on the snapshot
+// directories as volumes like ZFS datasets.
+type tmpfsUpperDriver struct{}
 
-type dummyFs struct{}
+func (d *tmpfsUpperDriver) Init(ctx context.Context, snapshotDir string) error { return nil }
 
-func (fs *dummyFs) Mount(ctx context.Context, mountpoint string, labels map[string]string) error {
-	return fmt.Errorf("dummy")
+func (d *tmpfsUpperDriver) Create(ctx context.Context, id, dir string) error {
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+	return syscall.Mount("tmpfs", dir, "tmpfs", 0, "")
 }
 
-func (fs *dummyFs) Check(ctx context.Context, mountpoint string, labels map[string]string) error {
-	return fmt.Errorf("dummy")
+func (d *tmpfsUpperDriver) Remove(ctx context.Context, dir string) error {
+	if mounted, err := mountinfo.Mounted(dir); err == nil && mounted {
+		return syscall.Unmount(dir, syscall.MNT_DETACH)
+	}
+	return nil
 }
 
-func (fs *dummyFs) Unmount(ctx context.Context, mountpoint string) error {
-	return fmt.Errorf("dummy")
+func TestUpperVolumeRestart(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root := t.TempDir()
+	d := &tmpfsUpperDriver{}
+	sn, err := NewSnapshotter(ctx, root, dummyFileSystem(), WithUpperDriver(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounts, err := sn.Prepare(ctx, "a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upper := mounts[0].Source
+	defer syscall.Unmount(filepath.Dir(upper), syscall.MNT_DETACH)
+	if err := ioutil.WriteFile(filepath.Join(upper, "foo"), []byte("hi"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Restart without Close because Close removes the snapshot directories.
+	if err := sn.(*snapshotter).ms.Close(); err != nil {
+		t.Fatal(err)
+	}
+	sn, err = NewSnapshotter(ctx, root, dummyFileSystem(), WithUpperDriver(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sn.Close()
+
+	// The volume isn't unmounted as a stale mount.
+	if mounted, err := mountinfo.Mounted(filepath.Dir(upper)); err != nil || !mounted {
+		t.Errorf("volume is unmounted on restart: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(upper, "foo")); err != nil || string(data) != "hi" {
+		t.Errorf("contents of the volume are lost on restart: %q, %v", string(data), err)
+	}
 }
 
-// =============================================================================
-// Tests backword-comaptibility of overlayfs snapshotter.
+func TestUpperDriver(t *testing.T) {
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	d := &dirUpperDriver{created: make(map[string]string)}
+	sn, err := NewSnapshotter(ctx, root, dummyFileSystem(), AsynchronousRemove, WithUpperDriver(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sn.Close()
 
-func newSnapshotter(ctx context.Context, root string) (snapshots.Snapshotter, func() error, error) {
-	snapshotter, err := NewSnapshotter(context.TODO(), root, dummyFileSystem())
+	if _, err := sn.Prepare(ctx, "active-a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := sn.Commit(ctx, "a", "active-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sn.Prepare(ctx, "b", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sn.View(ctx, "view", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only active snapshots are created on volumes.
+	o := sn.(*snapshotter)
+	ctx2, tx, err := o.ms.TransactionContext(ctx, false)
 	if err != nil {
-		return nil, nil, err
+		t.Fatal(err)
+	}
+	ids, err := storage.IDMap(ctx2)
+	tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string]string)
+	for id, key := range ids {
+		if key == "a" || key == "b" {
+			want[filepath.Join(root, "snapshots", id)] = id
+		}
+	}
+	if !reflect.DeepEqual(d.created, want) {
+		t.Fatalf("created volumes %v; want %v", d.created, want)
+	}
+	for dir := range d.created {
+		for _, p := range []string{"fs", "work"} {
+			if _, err := os.Stat(filepath.Join(dir, p)); err != nil {
+				t.Errorf("%q must be created on the volume: %v", p, err)
+			}
+		}
 	}
 
-	return snapshotter, func() error { return snapshotter.Close() }, nil
+	// Volumes are removed on cleanup.
+	if err := sn.Remove(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sn.(snapshots.Cleaner).Cleanup(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.removed) != 1 || d.created[d.removed[0]] == "" || ids[d.created[d.removed[0]]] != "b" {
+		t.Fatalf("volume of the removed snapshot must be removed but removed %v", d.removed)
+	}
+	if _, err := os.Stat(d.removed[0]); !os.IsNotExist(err) {
+		t.Fatalf("snapshot directory must be removed: %v", err)
+	}
 }
 
-func TestOverlay(t *testing.T) {
-	testutil.RequiresRoot(t)
-	testsuite.SnapshotterSuite(t, "Overlay", newSnapshotter)
+func TestUpperQuota(t *testing.T) {
+	// The layouts must match the structs of the kernel.
+	if size := unsafe.Sizeof(fsxattr{}); size != 28 {
+		t.Errorf("size of fsxattr is %d; want 28", size)
+	}
+	if size := unsafe.Sizeof(fsDiskQuota{}); size != 112 {
+		t.Errorf("size of fs_disk_quota is %d; want 112", size)
+	}
+
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	var st unix.Statfs_t
+	if err := unix.Statfs(root, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Type == unix.XFS_SUPER_MAGIC {
+		t.Skip("temporary directory is on XFS")
+	}
+	if sn, err := NewSnapshotter(ctx, root, dummyFileSystem(), UpperQuota(1<<20)); err == nil {
+		sn.Close()
+		t.Fatalf("quota must not be enabled on non-XFS filesystem")
+	}
 }
 
 func TestOverlayMounts(t *testing.T) {
@@ -638,6 +2417,65 @@ func TestOverlayOverlayRead(t *testing.T) {
 	}
 }
 
+func TestOverlayMetacopy(t *testing.T) {
+	testutil.RequiresRoot(t)
+	if err := overlayutils.SupportsMetacopy(); err != nil {
+		t.Skip(err)
+	}
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "overlay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	o, err := NewSnapshotter(ctx, root, dummyFileSystem(), Metacopy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	mounts, err := o.Prepare(ctx, "/tmp/test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(mounts[0].Source, "foo"), []byte("hi"), 0660); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Commit(ctx, "base", "/tmp/test"); err != nil {
+		t.Fatal(err)
+	}
+	if mounts, err = o.Prepare(ctx, "/tmp/layer2", "base"); err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	var upper string
+	for _, opt := range mounts[0].Options {
+		found = found || opt == "metacopy=on"
+		if strings.HasPrefix(opt, "upperdir=") {
+			upper = strings.TrimPrefix(opt, "upperdir=")
+		}
+	}
+	if !found || upper == "" {
+		t.Fatalf("metacopy option and upperdir must be specified: %v", mounts[0].Options)
+	}
+	dest := filepath.Join(root, "dest")
+	if err := os.Mkdir(dest, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := mount.All(mounts, dest); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unmount(dest, 0)
+	if err := os.Chown(filepath.Join(dest, "foo"), 1000, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dest, "foo")); err != nil || string(data) != "hi" {
+		t.Fatalf("contents must be kept after chown: %q, %v", string(data), err)
+	}
+	if _, err := unix.Lgetxattr(filepath.Join(upper, "foo"), "trusted.overlay.metacopy", nil); err != nil {
+		t.Errorf("only metadata must be copied up: %v", err)
+	}
+}
+
 func TestOverlayView(t *testing.T) {
 	ctx := context.TODO()
 	root, err := ioutil.TempDir("", "overlay")
@@ -719,3 +2557,187 @@ func TestOverlayView(t *testing.T) {
 		t.Errorf("expected option %q but received %q", expected, m.Options[0])
 	}
 }
+
+func TestFsck(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	root, err := ioutil.TempDir("", "fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	sn, err := NewSnapshotter(ctx, root, dummyFileSystem())
+	if err != nil {
+		t.Fatalf("failed to make new snapshotter: %q", err)
+	}
+	if _, err := sn.Prepare(ctx, "active-a", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := sn.Commit(ctx, "a", "active-a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sn.Prepare(ctx, "b", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sn.Prepare(ctx, "c", ""); err != nil {
+		t.Fatal(err)
+	}
+	o := sn.(*snapshotter)
+	ctx2, tx, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idA, _, _, err := storage.GetInfo(ctx2, "a")
+	tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Close only the metadata store; Close of the snapshotter removes directories.
+	if err := o.ms.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lose the contents of "a" and leave a directory without a record.
+	if err := os.RemoveAll(filepath.Join(root, "snapshots", idA)); err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(root, "snapshots", "orphan")
+	if err := os.MkdirAll(orphan, 0700); err != nil {
+		t.Fatal(err)
+	}
+	want := []FsckAction{
+		{Kind: FsckOrphanDirectory, Path: orphan},
+		{Kind: FsckBrokenParent, Key: "b"},
+		{Kind: FsckMissingDirectory, Key: "a"},
+	}
+	check := func(actions []FsckAction, repaired bool) {
+		if len(actions) != len(want) {
+			t.Fatalf("got actions %+v; want %+v", actions, want)
+		}
+		for i, a := range actions {
+			if a.Kind != want[i].Kind || a.Key != want[i].Key || a.Repaired != repaired || a.Error != "" {
+				t.Errorf("action %d = %+v; want %+v (repaired=%v)", i, a, want[i], repaired)
+			}
+			if want[i].Path != "" && a.Path != want[i].Path {
+				t.Errorf("path of action %d = %q; want %q", i, a.Path, want[i].Path)
+			}
+		}
+	}
+
+	actions, err := Fsck(ctx, root, false)
+	if err != nil {
+		t.Fatalf("failed to run fsck: %v", err)
+	}
+	check(actions, false)
+	if _, err := os.Stat(orphan); err != nil {
+		t.Errorf("dry run removed orphan directory: %v", err)
+	}
+
+	// The volume of the orphan directory is removed as well.
+	d := &dirUpperDriver{created: map[string]string{orphan: "orphan"}}
+	actions, err = Fsck(ctx, root, true, WithUpperDriver(d))
+	if err != nil {
+		t.Fatalf("failed to repair: %v", err)
+	}
+	check(actions, true)
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("orphan directory isn't removed: %v", err)
+	}
+	if len(d.removed) != 1 || d.removed[0] != orphan {
+		t.Errorf("removed volumes = %v; want %q", d.removed, orphan)
+	}
+
+	actions, err = Fsck(ctx, root, false)
+	if err != nil {
+		t.Fatalf("failed to run fsck after repair: %v", err)
+	}
+	if len(actions) != 0 {
+		t.Errorf("inconsistencies remain after repair: %+v", actions)
+	}
+
+	// "c" is kept.
+	ms, err := storage.NewMetaStore(filepath.Join(root, "metadata.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ms.Close()
+	ctx2, tx, err = ms.TransactionContext(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, _, _, err := storage.GetInfo(ctx2, "c"); err != nil {
+		t.Errorf("healthy snapshot is removed: %v", err)
+	}
+}
+
+func TestExportImportRemoteSnapshots(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+	newSn := func() snapshots.Snapshotter {
+		root, err := ioutil.TempDir("", "remote")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(root) })
+		sn, err := NewSnapshotter(ctx, root, bindFileSystem(t))
+		if err != nil {
+			t.Fatalf("failed to make new remote snapshotter: %q", err)
+		}
+		t.Cleanup(func() { sn.Close() })
+		return sn
+	}
+	src := newSn()
+	prepareWithTarget(t, src, "a", "/tmp/prepare-a", "", map[string]string{"test": "a"})
+	prepareWithTarget(t, src, "b", "/tmp/prepare-b", "a", map[string]string{"test": "b"})
+	// Snapshots on locally unpacked layers aren't exported.
+	if _, err := src.Prepare(ctx, "/tmp/prepare-c", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Commit(ctx, "c", "/tmp/prepare-c"); err != nil {
+		t.Fatal(err)
+	}
+	prepareWithTarget(t, src, "d", "/tmp/prepare-d", "c", nil)
+
+	states, err := src.(StateExporter).ExportRemoteSnapshots(ctx)
+	if err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+	if len(states) != 2 || states[0].Name != "a" || states[1].Name != "b" || states[1].Parent != "a" {
+		t.Fatalf("unexpected exported state %+v", states)
+	}
+	if _, ok := states[0].Labels[filesystemIDLabel]; ok {
+		t.Errorf("filesystem ID is exported: %+v", states[0])
+	}
+
+	dst := newSn()
+	imported, err := dst.(StateExporter).ImportRemoteSnapshots(ctx, states)
+	if err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	if !reflect.DeepEqual(imported, []string{"a", "b"}) {
+		t.Errorf("imported %v; want [a b]", imported)
+	}
+	for _, name := range []string{"a", "b"} {
+		info, err := dst.Stat(ctx, name)
+		if err != nil {
+			t.Fatalf("failed to stat imported snapshot %q: %v", name, err)
+		}
+		if _, ok := info.Labels[remoteLabel]; !ok || info.Kind != snapshots.KindCommitted {
+			t.Errorf("snapshot %q isn't imported as a remote snapshot: %+v", name, info)
+		}
+		if info.Labels["test"] != name {
+			t.Errorf("label of %q = %q; want %q", name, info.Labels["test"], name)
+		}
+	}
+	if _, err := dst.Stat(ctx, importKeyPrefix+"a"); !errdefs.IsNotFound(err) {
+		t.Errorf("active snapshot used for import remains: %v", err)
+	}
+
+	// Existing snapshots are skipped.
+	if imported, err = dst.(StateExporter).ImportRemoteSnapshots(ctx, states); err != nil {
+		t.Fatalf("failed to import again: %v", err)
+	} else if len(imported) != 0 {
+		t.Errorf("existing snapshots are imported again: %v", imported)
+	}
+}
@@ -0,0 +1,166 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"sort"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/pkg/errors"
+)
+
+// importKeyPrefix is the prefix of the keys of active snapshots used for
+// importing remote snapshots.
+const importKeyPrefix = "import-"
+
+// RemoteSnapshotState is the metadata of a committed remote snapshot. This
+// doesn't include the contents of the snapshot; the layer is resolved and
+// mounted again using the labels when it's imported.
+type RemoteSnapshotState struct {
+	// Name is the name of the committed snapshot.
+	Name string `json:"name"`
+
+	// Parent is the name of the parent snapshot. Empty for the bottom layer.
+	Parent string `json:"parent,omitempty"`
+
+	// Labels is the labels of the snapshot used for mounting the layer.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// StateExporter exports the metadata of remote snapshots and imports them to
+// another snapshotter (e.g. on a replacement node). The importing snapshotter
+// resolves and mounts the layers again so that the remote snapshots become
+// available without preparing them through containerd. The snapshotter
+// returned by NewSnapshotter implements this interface.
+type StateExporter interface {
+	ExportRemoteSnapshots(ctx context.Context) ([]RemoteSnapshotState, error)
+	ImportRemoteSnapshots(ctx context.Context, states []RemoteSnapshotState) (imported []string, err error)
+}
+
+// ExportRemoteSnapshots returns the metadata of committed remote snapshots
+// whose ancestors are all remote snapshots. Snapshots on top of locally
+// unpacked layers can't be restored without their contents so they are
+// omitted. Parents are listed before their children. Labels specific to this
+// node (e.g. the filesystem ID and FullyCachedLabel) are removed.
+func (o *snapshotter) ExportRemoteSnapshots(ctx context.Context) ([]RemoteSnapshotState, error) {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	defer t.Rollback()
+	infos := make(map[string]snapshots.Info)
+	if err := storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+		infos[info.Name] = info
+		return nil
+	}); err != nil && !errdefs.IsNotFound(err) {
+		return nil, err
+	}
+
+	isRemote := func(info snapshots.Info) bool {
+		_, ok := info.Labels[remoteLabel]
+		return ok && info.Kind == snapshots.KindCommitted
+	}
+	depths := make(map[string]int)
+	var states []RemoteSnapshotState
+	for name, info := range infos {
+		depth, exportable := 0, true
+		for cur := name; cur != ""; cur = infos[cur].Parent {
+			if !isRemote(infos[cur]) {
+				exportable = false
+				break
+			}
+			depth++
+		}
+		if !exportable {
+			continue
+		}
+		labels := make(map[string]string, len(info.Labels))
+		for k, v := range info.Labels {
+			switch k {
+			case filesystemIDLabel, FullyCachedLabel:
+				continue
+			}
+			labels[k] = v
+		}
+		depths[name] = depth
+		states = append(states, RemoteSnapshotState{Name: name, Parent: info.Parent, Labels: labels})
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if di, dj := depths[states[i].Name], depths[states[j].Name]; di != dj {
+			return di < dj
+		}
+		return states[i].Name < states[j].Name
+	})
+	return states, nil
+}
+
+// ImportRemoteSnapshots mounts the layers of the exported remote snapshots and
+// commits them with the same names. Parents must be listed before their
+// children. Snapshots which already exist are skipped. Import stops at the
+// first failure and the names of the snapshots imported so far are returned.
+func (o *snapshotter) ImportRemoteSnapshots(ctx context.Context, states []RemoteSnapshotState) (imported []string, _ error) {
+	for _, st := range states {
+		lCtx := log.WithLogger(ctx, log.G(ctx).WithField("key", st.Name).WithField("parent", st.Parent))
+		if _, err := o.Stat(ctx, st.Name); err == nil {
+			log.G(lCtx).Debug("snapshot already exists; skipping import")
+			continue
+		} else if !errdefs.IsNotFound(err) {
+			return imported, err
+		}
+		if err := o.importRemoteSnapshot(lCtx, st); err != nil {
+			return imported, errors.Wrapf(err, "failed to import %q", st.Name)
+		}
+		log.G(lCtx).Debug("imported remote snapshot")
+		imported = append(imported, st.Name)
+	}
+	return imported, nil
+}
+
+func (o *snapshotter) importRemoteSnapshot(ctx context.Context, st RemoteSnapshotState) error {
+	labels := make(map[string]string, len(st.Labels)+1)
+	for k, v := range st.Labels {
+		labels[k] = v
+	}
+	labels[targetSnapshotLabel] = st.Name
+	key := importKeyPrefix + st.Name
+	opts := []snapshots.Opt{snapshots.WithLabels(labels)}
+	if _, err := o.createSnapshot(ctx, snapshots.KindActive, key, st.Parent, opts); err != nil {
+		return err
+	}
+	fsID, id, err := o.prepareRemoteSnapshot(ctx, key, labels)
+	if err != nil {
+		if rerr := o.Remove(ctx, key); rerr != nil {
+			log.G(ctx).WithError(rerr).Warn("failed to remove snapshot used for import")
+		}
+		return err
+	}
+	if err := o.commitRemoteSnapshot(ctx, st.Name, key, fsID, id, labels, opts); err != nil {
+		// The active snapshot remains on failure (e.g. the snapshot is
+		// created concurrently).
+		if rerr := o.Remove(ctx, key); rerr != nil {
+			log.G(ctx).WithError(rerr).Warn("failed to remove snapshot used for import")
+		}
+		if !errdefs.IsAlreadyExists(err) {
+			return err
+		}
+	}
+	return nil
+}
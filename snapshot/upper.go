@@ -0,0 +1,176 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/containerd/containerd/log"
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// UpperDriver creates the directories of active snapshots (which contain the
+// upperdir and the workdir of overlayfs) as volumes of the backing filesystem
+// so that they can have quotas. Lowerdirs (including remote snapshots) are
+// still merged by overlayfs.
+type UpperDriver interface {
+	// Init checks that the driver can create volumes under the snapshots
+	// directory. This is called once when the snapshotter starts.
+	Init(ctx context.Context, snapshotDir string) error
+
+	// Create creates an empty volume at dir for the snapshot of the id. dir
+	// must not exist.
+	Create(ctx context.Context, id, dir string) error
+
+	// Remove removes the volumes under dir including dir itself. This must
+	// succeed when dir contains no volume.
+	Remove(ctx context.Context, dir string) error
+}
+
+// NewBtrfsUpperDriver returns an UpperDriver which creates btrfs subvolumes.
+// The root of the snapshotter must be on btrfs. If quota isn't empty (e.g.
+// "10G"), it's set as the limit of the qgroup of each subvolume; quota of the
+// filesystem must be enabled in advance ("btrfs quota enable").
+func NewBtrfsUpperDriver(quota string) UpperDriver {
+	return &btrfsUpperDriver{quota: quota}
+}
+
+type btrfsUpperDriver struct {
+	quota string
+}
+
+func (d *btrfsUpperDriver) Init(ctx context.Context, snapshotDir string) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(snapshotDir, &st); err != nil {
+		return err
+	}
+	if st.Type != unix.BTRFS_SUPER_MAGIC {
+		return fmt.Errorf("%q is not on btrfs", snapshotDir)
+	}
+	return nil
+}
+
+func (d *btrfsUpperDriver) Create(ctx context.Context, id, dir string) error {
+	if err := runVolumeCommand(ctx, "btrfs", "subvolume", "create", dir); err != nil {
+		return err
+	}
+	if d.quota != "" {
+		if err := runVolumeCommand(ctx, "btrfs", "qgroup", "limit", d.quota, dir); err != nil {
+			return errors.Wrap(err, "failed to set quota (is quota of the filesystem enabled?)")
+		}
+	}
+	return nil
+}
+
+func (d *btrfsUpperDriver) Remove(ctx context.Context, dir string) error {
+	// Subvolumes can be moved into another directory (e.g. when the snapshot is
+	// replaced with a remote snapshot) so look for them also in the children.
+	candidates := []string{dir}
+	if children, err := ioutil.ReadDir(dir); err == nil {
+		for _, c := range children {
+			if c.IsDir() {
+				candidates = append(candidates, filepath.Join(dir, c.Name()))
+			}
+		}
+	}
+	// Remove children first.
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if !isBtrfsSubvolume(candidates[i]) {
+			continue
+		}
+		if err := runVolumeCommand(ctx, "btrfs", "subvolume", "delete", candidates[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isBtrfsSubvolume returns true if the directory is the root of a subvolume.
+// The root directory of each subvolume has the fixed inode number (256).
+func isBtrfsSubvolume(dir string) bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil || st.Type != unix.BTRFS_SUPER_MAGIC {
+		return false
+	}
+	fi, err := os.Lstat(dir)
+	if err != nil || !fi.IsDir() {
+		return false
+	}
+	return fi.Sys().(*syscall.Stat_t).Ino == 256
+}
+
+// NewZFSUpperDriver returns an UpperDriver which creates ZFS datasets as the
+// children of the dataset. Each dataset is mounted on the snapshot directory.
+// If quota isn't empty (e.g. "10G"), it's set as the quota of each dataset.
+// ZFS must support overlayfs upperdir (OpenZFS 2.2 or later).
+func NewZFSUpperDriver(dataset, quota string) UpperDriver {
+	return &zfsUpperDriver{dataset: strings.TrimSuffix(dataset, "/"), quota: quota}
+}
+
+type zfsUpperDriver struct {
+	dataset string
+	quota   string
+}
+
+func (d *zfsUpperDriver) Init(ctx context.Context, snapshotDir string) error {
+	if d.dataset == "" {
+		return fmt.Errorf("ZFS dataset must be specified")
+	}
+	if err := runVolumeCommand(ctx, "zfs", "list", "-H", "-o", "name", d.dataset); err != nil {
+		return errors.Wrapf(err, "dataset %q is unavailable", d.dataset)
+	}
+	return nil
+}
+
+func (d *zfsUpperDriver) Create(ctx context.Context, id, dir string) error {
+	args := []string{"create", "-o", "mountpoint=" + dir}
+	if d.quota != "" {
+		args = append(args, "-o", "quota="+d.quota)
+	}
+	return runVolumeCommand(ctx, "zfs", append(args, d.datasetOf(id))...)
+}
+
+func (d *zfsUpperDriver) Remove(ctx context.Context, dir string) error {
+	// Mounted datasets can't be moved so they are always at the snapshot
+	// directory of the ID.
+	name := d.datasetOf(filepath.Base(dir))
+	if err := runVolumeCommand(ctx, "zfs", "list", "-H", "-o", "name", name); err != nil {
+		log.G(ctx).WithError(err).WithField("dataset", name).Debug("no dataset to remove")
+		return nil
+	}
+	return runVolumeCommand(ctx, "zfs", "destroy", "-r", name)
+}
+
+func (d *zfsUpperDriver) datasetOf(id string) string {
+	return d.dataset + "/" + id
+}
+
+func runVolumeCommand(ctx context.Context, name string, args ...string) error {
+	if out, err := exec.CommandContext(ctx, name, args...).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "failed to run %s %s: %s",
+			name, strings.Join(args, " "), strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package snapshot
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/containerd/snapshots/storage"
+	"github.com/containerd/continuity/fs"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// calculateUsage calculates the disk usage of the committed snapshot of the
+// name and the ID in background. The result is recorded in the metadata store.
+func (o *snapshotter) calculateUsage(ctx context.Context, name, id string) {
+	o.usageWg.Add(1)
+	go func() {
+		defer o.usageWg.Done()
+		if err := o.storeUsage(ctx, name, id); err != nil {
+			log.G(ctx).WithError(err).Warn("failed to record disk usage of the snapshot")
+		}
+	}()
+}
+
+func (o *snapshotter) storeUsage(ctx context.Context, name, id string) error {
+	du, err := fs.DiskUsage(ctx, o.upperPath(id))
+	if err != nil {
+		return errors.Wrap(err, "failed to calculate disk usage")
+	}
+
+	ctx, t, err := o.ms.TransactionContext(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+
+	// The snapshot can be removed (and the name can be reused by another
+	// snapshot) during the calculation.
+	if cur, _, _, err := storage.GetInfo(ctx, name); err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil
+		}
+		return err
+	} else if cur != id {
+		return nil
+	}
+	tx, ok := t.(*bolt.Tx)
+	if !ok {
+		return errors.New("unsupported metadata store")
+	}
+	if err := putUsage(tx, name, snapshots.Usage(du)); err != nil {
+		return err
+	}
+	return t.Commit()
+}
+
+// putUsage records the usage of the snapshot of the name. The storage package
+// records usages only on commit so this writes the "inodes" and "size" keys of
+// the snapshot's bucket (v1/snapshots/<name>) of the metadata store directly.
+func putUsage(tx *bolt.Tx, name string, usage snapshots.Usage) error {
+	vbkt := tx.Bucket([]byte("v1"))
+	if vbkt == nil {
+		return errors.Wrap(errdefs.ErrNotFound, "bucket does not exist")
+	}
+	sbkt := vbkt.Bucket([]byte("snapshots"))
+	if sbkt == nil {
+		return errors.Wrap(errdefs.ErrNotFound, "snapshots bucket does not exist")
+	}
+	bkt := sbkt.Bucket([]byte(name))
+	if bkt == nil {
+		return errors.Wrapf(errdefs.ErrNotFound, "snapshot %q does not exist", name)
+	}
+	for _, v := range []struct {
+		key   string
+		value int64
+	}{
+		{"inodes", usage.Inodes},
+		{"size", usage.Size},
+	} {
+		buf := make([]byte, binary.MaxVarintLen64)
+		if err := bkt.Put([]byte(v.key), buf[:binary.PutVarint(buf, v.value)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recalculateUsages calculates in background the disk usages of the committed
+// snapshots recorded with zero usage. These are the snapshots whose
+// calculation didn't finish before the snapshotter stopped.
+func (o *snapshotter) recalculateUsages(ctx context.Context) error {
+	ctx, t, err := o.ms.TransactionContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	defer t.Rollback()
+
+	var names, ids []string
+	if err := storage.WalkInfo(ctx, func(ctx context.Context, info snapshots.Info) error {
+		if _, ok := info.Labels[remoteLabel]; ok || info.Kind != snapshots.KindCommitted {
+			return nil
+		}
+		id, _, usage, err := storage.GetInfo(ctx, info.Name)
+		if err != nil {
+			return err
+		}
+		if usage == (snapshots.Usage{}) {
+			names, ids = append(names, info.Name), append(ids, id)
+		}
+		return nil
+	}); err != nil && !errdefs.IsNotFound(err) {
+		return err
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	o.usageWg.Add(1)
+	go func() {
+		defer o.usageWg.Done()
+		for i, id := range ids {
+			select {
+			case <-o.usageDone:
+				return
+			default:
+			}
+			if err := o.storeUsage(ctx, names[i], id); err != nil {
+				log.G(ctx).WithError(err).WithField("key", names[i]).Warn("failed to record disk usage of the snapshot")
+			}
+		}
+	}()
+	return nil
+}
@@ -23,6 +23,7 @@ import (
 	"time"
 
 	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 )
 
 // NewBackgroundTaskManager provides a task manager. You can specify the
@@ -35,6 +36,7 @@ func NewBackgroundTaskManager(concurrency int64, period time.Duration) *Backgrou
 		prioritizedTaskSilencePeriod: period,
 		prioritizedTaskStartNotify:   make(chan struct{}),
 		prioritizedTaskDoneCond:      sync.NewCond(&sync.Mutex{}),
+		bandwidth:                    rate.NewLimiter(rate.Inf, 0),
 	}
 }
 
@@ -59,6 +61,11 @@ func NewBackgroundTaskManager(concurrency int64, period time.Duration) *Backgrou
 // will be cancelled via context. These cancelled tasks will be executed again
 // later, same as other background tasks (when no prioritized task is running
 // for some period).
+//
+// Background tasks can be paused and resumed at runtime by Pause and Resume
+// methods. The bandwidth used by background tasks can also be limited by
+// SetBandwidth method. Tasks report the bytes they transferred through
+// WaitBandwidth method.
 type BackgroundTaskManager struct {
 	prioritizedTasks             int64
 	backgroundSem                *semaphore.Weighted
@@ -66,6 +73,74 @@ type BackgroundTaskManager struct {
 	prioritizedTaskStartNotify   chan struct{}
 	prioritizedTaskStartNotifyMu sync.Mutex
 	prioritizedTaskDoneCond      *sync.Cond
+	paused                       int32
+	bandwidth                    *rate.Limiter
+}
+
+// Pause stops the execution of all background tasks until Resume is called.
+// Background tasks running are cancelled and retried after resumed.
+func (ts *BackgroundTaskManager) Pause() {
+	ts.prioritizedTaskStartNotifyMu.Lock()
+	if atomic.CompareAndSwapInt32(&ts.paused, 0, 1) {
+		close(ts.prioritizedTaskStartNotify)
+		ts.prioritizedTaskStartNotify = make(chan struct{})
+	}
+	ts.prioritizedTaskStartNotifyMu.Unlock()
+}
+
+// Resume restarts the execution of background tasks paused by Pause.
+func (ts *BackgroundTaskManager) Resume() {
+	ts.prioritizedTaskDoneCond.L.Lock()
+	atomic.StoreInt32(&ts.paused, 0)
+	ts.prioritizedTaskDoneCond.L.Unlock()
+	ts.prioritizedTaskDoneCond.Broadcast()
+}
+
+// Paused returns true if background tasks are paused by Pause.
+func (ts *BackgroundTaskManager) Paused() bool {
+	return atomic.LoadInt32(&ts.paused) != 0
+}
+
+// SetBandwidth limits the bandwidth used by background tasks in bytes per
+// second. Zero or negative means no limit.
+func (ts *BackgroundTaskManager) SetBandwidth(bytesPerSec int64) {
+	if bytesPerSec <= 0 {
+		ts.bandwidth.SetLimit(rate.Inf)
+		return
+	}
+	ts.bandwidth.SetBurst(int(bytesPerSec))
+	ts.bandwidth.SetLimit(rate.Limit(bytesPerSec))
+}
+
+// Bandwidth returns the bandwidth limit set by SetBandwidth. Zero means no limit.
+func (ts *BackgroundTaskManager) Bandwidth() int64 {
+	if l := ts.bandwidth.Limit(); l != rate.Inf {
+		return int64(l)
+	}
+	return 0
+}
+
+// WaitBandwidth blocks until n bytes transferred by a background task are
+// allowed under the limit set by SetBandwidth.
+func (ts *BackgroundTaskManager) WaitBandwidth(ctx context.Context, n int) error {
+	for n > 0 {
+		c := n
+		if ts.bandwidth.Limit() != rate.Inf {
+			if b := ts.bandwidth.Burst(); c > b {
+				c = b
+			}
+		}
+		if err := ts.bandwidth.WaitN(ctx, c); err != nil {
+			return err
+		}
+		n -= c
+	}
+	return nil
+}
+
+// blocked returns true if background tasks must not run.
+func (ts *BackgroundTaskManager) blocked() bool {
+	return atomic.LoadInt64(&ts.prioritizedTasks) > 0 || ts.Paused()
 }
 
 // DoPrioritizedTask tells the manager that we are running a prioritized task
@@ -97,15 +172,16 @@ func (ts *BackgroundTaskManager) DonePrioritizedTask() {
 // cancelled via context.Context argument and be able to be restarted again.
 func (ts *BackgroundTaskManager) InvokeBackgroundTask(do func(context.Context), timeout time.Duration) {
 	for {
-		// Wait until all prioritized tasks are done
+		// Wait until all prioritized tasks are done and background tasks are
+		// resumed.
 		for {
-			if atomic.LoadInt64(&ts.prioritizedTasks) <= 0 {
+			if !ts.blocked() {
 				break
 			}
 
-			// waits until a prioritized task is done
+			// waits until a prioritized task is done or resumed
 			ts.prioritizedTaskDoneCond.L.Lock()
-			if atomic.LoadInt64(&ts.prioritizedTasks) > 0 {
+			if ts.blocked() {
 				ts.prioritizedTaskDoneCond.Wait()
 			}
 			ts.prioritizedTaskDoneCond.L.Unlock()
@@ -120,9 +196,9 @@ func (ts *BackgroundTaskManager) InvokeBackgroundTask(do func(context.Context),
 			// Get notify the prioritized tasks execution.
 			ts.prioritizedTaskStartNotifyMu.Lock()
 			ch := ts.prioritizedTaskStartNotify
-			tasks := atomic.LoadInt64(&ts.prioritizedTasks)
+			blocked := ts.blocked()
 			ts.prioritizedTaskStartNotifyMu.Unlock()
-			if tasks > 0 {
+			if blocked {
 				return false
 			}
 
@@ -140,7 +216,7 @@ func (ts *BackgroundTaskManager) InvokeBackgroundTask(do func(context.Context),
 
 			// Wait until the background task is done or canceled.
 			select {
-			case <-ch: // some prioritized tasks started; retry it later
+			case <-ch: // some prioritized tasks started or paused; retry it later
 				cancel()
 				return false
 			case <-done: // All tasks completed
@@ -132,6 +132,30 @@ func TestBackgroundTasks(t *testing.T) {
 					task2.assert(true, false, false))
 			},
 		},
+		{
+			name:          "pause",
+			concurrency:   2,
+			checkInterval: time.Duration(0), // We don't care prioritized tasks now
+			context: func(t *testing.T, pm *BackgroundTaskManager, task1, task2, task3, task4 *sampleTask) {
+				doGo(func() { pm.InvokeBackgroundTask(task1.do, 24*time.Hour) })
+				wait(t, "task1 started", task1.checkStarted())
+				pm.Pause()
+				wait(t, "task1 canceled", task1.checkCanceled())
+				task1.reset()
+				doGo(func() { pm.InvokeBackgroundTask(task2.do, 24*time.Hour) })
+				time.Sleep(300 * time.Millisecond) // wait for long time...
+				if task1.checkStarted()() || task2.checkStarted()() {
+					t.Errorf("tasks must not start while paused")
+				}
+				pm.Resume()
+				wait(t, "task1 resumed", task1.checkStarted())
+				wait(t, "task2 started", task2.checkStarted())
+			},
+			assert: func(task1, task2, task3, task4 *sampleTask) bool {
+				return (task1.assert(true, false, false) &&
+					task2.assert(true, false, false))
+			},
+		},
 		{
 			name:          "finish_partial",
 			concurrency:   1,
@@ -189,6 +213,34 @@ func TestBackgroundTasks(t *testing.T) {
 	}
 }
 
+// TestBandwidth tests the bandwidth limit of background tasks.
+func TestBandwidth(t *testing.T) {
+	pm := NewBackgroundTaskManager(1, 0)
+	if err := pm.WaitBandwidth(context.Background(), 1<<30); err != nil {
+		t.Fatalf("unlimited bandwidth must not block: %v", err)
+	}
+	pm.SetBandwidth(1000)
+	if bw := pm.Bandwidth(); bw != 1000 {
+		t.Errorf("bandwidth = %d; want 1000", bw)
+	}
+	start := time.Now()
+	if err := pm.WaitBandwidth(context.Background(), 500); err != nil {
+		t.Fatalf("failed to wait for bandwidth: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("500 bytes at 1000 bytes/sec took %v; want about 500ms", elapsed)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := pm.WaitBandwidth(ctx, 10000); err == nil {
+		t.Errorf("waiting for bandwidth must be cancellable")
+	}
+	pm.SetBandwidth(0)
+	if bw := pm.Bandwidth(); bw != 0 {
+		t.Errorf("bandwidth = %d; want no limit", bw)
+	}
+}
+
 type sampleTask struct {
 	started  bool
 	done     bool
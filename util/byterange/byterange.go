@@ -0,0 +1,95 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package byterange parses and coalesces the ranges in the Range header of HTTP
+// requests for the storages not supporting multi-range requests.
+package byterange
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Range is the range of bytes from Begin to End (inclusive).
+type Range struct {
+	Begin int64
+	End   int64
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("%d-%d", r.Begin, r.End)
+}
+
+// Parse parses the ranges in the Range header ("bytes=<begin>-<end>[, ...]").
+// Open-ended and suffix ranges aren't supported.
+func Parse(header string) ([]Range, error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, fmt.Errorf("invalid range %q", header)
+	}
+	var rs []Range
+	for _, r := range strings.Split(strings.TrimPrefix(header, "bytes="), ",") {
+		be := strings.SplitN(strings.TrimSpace(r), "-", 2)
+		if len(be) != 2 {
+			return nil, fmt.Errorf("invalid range %q", header)
+		}
+		b, err := strconv.ParseInt(be[0], 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid range %q", header)
+		}
+		e, err := strconv.ParseInt(be[1], 10, 64)
+		if err != nil || b < 0 || e < b {
+			return nil, fmt.Errorf("invalid range %q", header)
+		}
+		rs = append(rs, Range{b, e})
+	}
+	return rs, nil
+}
+
+// Coalesce sorts the ranges and merges the ones overlapping or separated by at
+// most maxGap bytes. All ranges are merged into the single range covering them
+// if maxGap is negative.
+func Coalesce(rs []Range, maxGap int64) []Range {
+	if len(rs) == 0 {
+		return nil
+	}
+	sorted := append([]Range(nil), rs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Begin < sorted[j].Begin })
+	res := []Range{sorted[0]}
+	for _, r := range sorted[1:] {
+		last := &res[len(res)-1]
+		if maxGap < 0 || r.Begin-last.End-1 <= maxGap {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		res = append(res, r)
+	}
+	return res
+}
+
+// Header returns the Range header requesting the ranges.
+func Header(rs ...Range) string {
+	s := make([]string, len(rs))
+	for i, r := range rs {
+		s[i] = r.String()
+	}
+	return "bytes=" + strings.Join(s, ",")
+}
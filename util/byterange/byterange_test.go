@@ -0,0 +1,55 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package byterange
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCoalesce(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		maxGap int64
+		want   string
+	}{
+		{header: "bytes=0-9", maxGap: 0, want: "bytes=0-9"},
+		{header: "bytes=10-19,0-4,30-39", maxGap: -1, want: "bytes=0-39"},
+		{header: "bytes=100-199, 200-299", maxGap: -1, want: "bytes=100-299"},
+		{header: "bytes=100-199, 200-299", maxGap: 0, want: "bytes=100-299"},
+		{header: "bytes=0-9,5-14,20-29", maxGap: 0, want: "bytes=0-14,20-29"},
+		{header: "bytes=20-29,0-9,12-14", maxGap: 2, want: "bytes=0-14,20-29"},
+		{header: "bytes=20-29,0-9,12-14", maxGap: 5, want: "bytes=0-29"},
+	} {
+		rs, err := Parse(tt.header)
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", tt.header, err)
+			continue
+		}
+		if got := Header(Coalesce(rs, tt.maxGap)...); got != tt.want {
+			t.Errorf("Coalesce(%q, %d) = %q; want %q", tt.header, tt.maxGap, got, tt.want)
+		}
+	}
+	if rs, err := Parse("bytes=3-4, 0-1"); err != nil || !reflect.DeepEqual(rs, []Range{{3, 4}, {0, 1}}) {
+		t.Errorf("ranges must be parsed in order: %v, %v", rs, err)
+	}
+	for _, header := range []string{"bytes=10-", "bytes=-10", "bytes=20-10", "0-10", "bytes=0-1,"} {
+		if _, err := Parse(header); err == nil {
+			t.Errorf("invalid range %q must be rejected", header)
+		}
+	}
+}
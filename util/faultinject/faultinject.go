@@ -0,0 +1,163 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package faultinject provides fault points (latency, errors and short reads)
+// which can be injected into the network and cache layers. This is for testing
+// the handling of errors (e.g. EIO) and retries. All methods of a nil Injector
+// are no-op so fault points can be placed without checking if injection is
+// enabled.
+package faultinject
+
+import (
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInjected is the error returned by fault points.
+var ErrInjected = errors.New("injected fault")
+
+// Config is the configuration of faults.
+type Config struct {
+	// LatencyMsec is the latency (in milliseconds) added to each fault point.
+	LatencyMsec int64 `toml:"latency_msec"`
+
+	// ErrorRate is the probability (0.0 to 1.0) that each fault point fails.
+	ErrorRate float64 `toml:"error_rate"`
+
+	// ShortReadRate is the probability (0.0 to 1.0) that each read returns less
+	// bytes than requested.
+	ShortReadRate float64 `toml:"short_read_rate"`
+}
+
+// Enabled returns true if any fault is configured.
+func (c Config) Enabled() bool {
+	return c.LatencyMsec > 0 || c.ErrorRate > 0 || c.ShortReadRate > 0
+}
+
+// Injector injects faults based on the configuration.
+type Injector struct {
+	cfg  Config
+	rand *rand.Rand
+	mu   sync.Mutex
+}
+
+// New returns a new Injector. nil is returned if no fault is configured.
+func New(cfg Config) *Injector {
+	if !cfg.Enabled() {
+		return nil
+	}
+	return &Injector{cfg: cfg, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// Set updates the configuration. This can be used by tests to toggle faults.
+func (i *Injector) Set(cfg Config) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.cfg = cfg
+	i.mu.Unlock()
+}
+
+// Seed makes the injected faults deterministic.
+func (i *Injector) Seed(seed int64) {
+	if i == nil {
+		return
+	}
+	i.mu.Lock()
+	i.rand.Seed(seed)
+	i.mu.Unlock()
+}
+
+// Fault is a fault point. This adds the latency and returns ErrInjected with
+// the configured probability.
+func (i *Injector) Fault() error {
+	if i == nil {
+		return nil
+	}
+	i.mu.Lock()
+	cfg, fail := i.cfg, i.rand.Float64() < i.cfg.ErrorRate
+	i.mu.Unlock()
+	if cfg.LatencyMsec > 0 {
+		time.Sleep(time.Duration(cfg.LatencyMsec) * time.Millisecond)
+	}
+	if fail {
+		return ErrInjected
+	}
+	return nil
+}
+
+// shortRead returns the shortened length of a read of n bytes.
+func (i *Injector) shortRead(n int) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if n <= 1 || i.rand.Float64() >= i.cfg.ShortReadRate {
+		return n
+	}
+	return 1 + i.rand.Intn(n-1)
+}
+
+// ReadCloser returns a ReadCloser whose reads are fault points and can be short.
+func (i *Injector) ReadCloser(rc io.ReadCloser) io.ReadCloser {
+	if i == nil {
+		return rc
+	}
+	return &readCloser{rc, i}
+}
+
+type readCloser struct {
+	io.ReadCloser
+	i *Injector
+}
+
+func (r *readCloser) Read(p []byte) (int, error) {
+	if err := r.i.Fault(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p[:r.i.shortRead(len(p))])
+}
+
+// ReaderAt returns a ReaderAt whose reads are fault points. Short reads return
+// io.ErrUnexpectedEOF as required by io.ReaderAt.
+func (i *Injector) ReaderAt(ra io.ReaderAt) io.ReaderAt {
+	if i == nil {
+		return ra
+	}
+	return &readerAt{ra, i}
+}
+
+type readerAt struct {
+	io.ReaderAt
+	i *Injector
+}
+
+func (r *readerAt) ReadAt(p []byte, off int64) (int, error) {
+	if err := r.i.Fault(); err != nil {
+		return 0, err
+	}
+	if n := r.i.shortRead(len(p)); n < len(p) {
+		n, err := r.ReaderAt.ReadAt(p[:n], off)
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	return r.ReaderAt.ReadAt(p, off)
+}
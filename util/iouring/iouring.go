@@ -0,0 +1,520 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package iouring provides file I/O using io_uring of Linux. This reduces the
+// overhead of syscalls under highly concurrent I/O (e.g. many FUSE requests
+// served from the cache at once).
+//
+// Submitting a request to the ring costs more than pread(2) when the data is
+// in the page cache (see BenchmarkReadAt). So I/O is first tried with
+// RWF_NOWAIT and only I/O which would block on the disk is submitted to the
+// ring.
+package iouring
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	opNop   = 0
+	opRead  = 22 // since Linux 5.6
+	opWrite = 23 // since Linux 5.6
+
+	enterGetEvents = 1 << 0
+
+	offSQRing = 0
+	offCQRing = 0x8000000
+	offSQEs   = 0x10000000
+
+	sqeSize = 64
+	cqeSize = 16
+
+	// maxIOSize is the max size of an I/O request submitted at once.
+	maxIOSize = 1 << 30
+
+	// closeUserData is the user data of the request which notifies the reaper of closing.
+	closeUserData = 0
+
+	defaultEntries = 256
+)
+
+var (
+	defaultRing    *Ring
+	defaultRingErr error
+	defaultOnce    sync.Once
+)
+
+// Default returns the ring shared in the process. This returns an error if
+// io_uring isn't available on this kernel so the caller can fall back to the
+// standard file I/O.
+func Default() (*Ring, error) {
+	defaultOnce.Do(func() {
+		defaultRing, defaultRingErr = New(defaultEntries)
+	})
+	return defaultRing, defaultRingErr
+}
+
+// params is struct io_uring_params.
+type params struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        sqringOffsets
+	cqOff        cqringOffsets
+}
+
+// sqringOffsets is struct io_sqring_offsets.
+type sqringOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	resv2                                                           uint64
+}
+
+// cqringOffsets is struct io_cqring_offsets.
+type cqringOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	resv2                                                           uint64
+}
+
+// sqe is struct io_uring_sqe.
+type sqe struct {
+	opcode   uint8
+	flags    uint8
+	ioprio   uint16
+	fd       int32
+	off      uint64
+	addr     uint64
+	len      uint32
+	rwFlags  uint32
+	userData uint64
+	pad      [3]uint64
+}
+
+// cqe is struct io_uring_cqe.
+type cqe struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// Ring is an io_uring instance. Requests can be submitted concurrently. They
+// are queued to a dedicated submitter goroutine which puts all queued requests
+// to the submission queue and submits them with one syscall. Completions are
+// reaped by another dedicated goroutine.
+type Ring struct {
+	fd     int
+	sqRing []byte
+	cqRing []byte
+	sqes   []byte
+
+	sqHead, sqTail, sqMask *uint32
+	sqArray                unsafe.Pointer
+	cqHead, cqTail, cqMask *uint32
+	cqes                   unsafe.Pointer
+
+	slots    chan struct{} // limits the in-flight requests not to overflow the rings
+	requests chan request  // requests waiting for the submitter
+
+	pending   map[uint64]chan int32
+	pendingMu sync.Mutex
+	nextID    uint64 // accessed only by the submitter
+	reapErr   error
+
+	// noNowaitRead and noNowaitWrite are non-zero if RWF_NOWAIT isn't
+	// supported for reads and writes. Accessed atomically.
+	noNowaitRead, noNowaitWrite int32
+
+	closeOnce sync.Once
+	closeErr  error // set by the submitter before it exits
+	closing   chan struct{}
+	submitted chan struct{} // closed when the submitter exits
+	reaped    chan struct{}
+}
+
+// request is a request queued to the submitter.
+type request struct {
+	sqe sqe
+	ch  chan int32
+}
+
+// New creates a new ring with the specified number of entries. This fails if
+// the kernel doesn't support io_uring or the operations used by this package.
+func New(entries uint32) (_ *Ring, retErr error) {
+	var p params
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errors.Wrap(errno, "failed to setup io_uring")
+	}
+	r := &Ring{
+		fd:        int(fd),
+		pending:   make(map[uint64]chan int32),
+		nextID:    closeUserData + 1,
+		closing:   make(chan struct{}),
+		submitted: make(chan struct{}),
+		reaped:    make(chan struct{}),
+	}
+	defer func() {
+		if retErr != nil && r != nil {
+			r.release()
+		}
+	}()
+	var err error
+	r.sqRing, err = unix.Mmap(r.fd, offSQRing, int(p.sqOff.array+p.sqEntries*4),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to map submission queue")
+	}
+	r.cqRing, err = unix.Mmap(r.fd, offCQRing, int(p.cqOff.cqes+p.cqEntries*cqeSize),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to map completion queue")
+	}
+	r.sqes, err = unix.Mmap(r.fd, offSQEs, int(p.sqEntries*sqeSize),
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to map submission queue entries")
+	}
+	r.sqHead = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.head]))
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqArray = unsafe.Pointer(&r.sqRing[p.sqOff.array])
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Pointer(&r.cqRing[p.cqOff.cqes])
+
+	// One slot is reserved for the request for closing.
+	r.slots = make(chan struct{}, p.sqEntries-1)
+	r.requests = make(chan request, p.sqEntries-1)
+	go r.submitLoop(p.sqEntries)
+	go r.reap()
+	if err := r.probe(); err != nil {
+		r.Close()
+		r = nil // already released
+		return nil, err
+	}
+	return r, nil
+}
+
+// probe checks that the kernel supports the operations used by this package.
+func (r *Ring) probe() error {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := r.ReadAt(f, make([]byte, 1), 0); err != nil && err != io.EOF {
+		return errors.Wrap(err, "io_uring doesn't support read operation")
+	}
+	return nil
+}
+
+// ReadAt reads len(p) bytes from the file at the offset. This follows the
+// semantics of io.ReaderAt.
+func (r *Ring) ReadAt(f *os.File, p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		b := p[n:]
+		if len(b) > maxIOSize {
+			b = b[:maxIOSize]
+		}
+		res, err := r.nowaitOrDo(opRead, f, b, off+int64(n))
+		if err != nil {
+			return n, err
+		}
+		if res == 0 {
+			return n, io.EOF
+		}
+		n += res
+	}
+	return n, nil
+}
+
+// WriteAt writes len(p) bytes to the file at the offset. This follows the
+// semantics of io.WriterAt.
+func (r *Ring) WriteAt(f *os.File, p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		b := p[n:]
+		if len(b) > maxIOSize {
+			b = b[:maxIOSize]
+		}
+		res, err := r.nowaitOrDo(opWrite, f, b, off+int64(n))
+		if err != nil {
+			return n, err
+		}
+		if res == 0 {
+			return n, io.ErrShortWrite
+		}
+		n += res
+	}
+	return n, nil
+}
+
+// nowaitOrDo performs the I/O with RWF_NOWAIT. If it would block, the request
+// is submitted to the ring instead.
+func (r *Ring) nowaitOrDo(op uint8, f *os.File, b []byte, off int64) (int, error) {
+	disabled := &r.noNowaitRead
+	if op == opWrite {
+		disabled = &r.noNowaitWrite
+	}
+	if len(b) > 0 && atomic.LoadInt32(disabled) == 0 {
+		var (
+			n   int
+			err error
+		)
+		if op == opWrite {
+			n, err = unix.Pwritev2(int(f.Fd()), [][]byte{b}, off, unix.RWF_NOWAIT)
+		} else {
+			n, err = unix.Preadv2(int(f.Fd()), [][]byte{b}, off, unix.RWF_NOWAIT)
+		}
+		runtime.KeepAlive(f)
+		switch err {
+		case nil:
+			return n, nil
+		case syscall.EAGAIN, syscall.EINTR:
+			// Would block. Use the ring.
+		case syscall.EOPNOTSUPP, syscall.EINVAL, syscall.ENOSYS:
+			// The kernel or the filesystem doesn't support RWF_NOWAIT.
+			atomic.StoreInt32(disabled, 1)
+		default:
+			return 0, err
+		}
+	}
+	return r.do(op, f, b, off)
+}
+
+// do submits a request and waits for its completion.
+func (r *Ring) do(op uint8, f *os.File, b []byte, off int64) (int, error) {
+	for {
+		e := sqe{
+			opcode: op,
+			fd:     int32(f.Fd()),
+			off:    uint64(off),
+			len:    uint32(len(b)),
+		}
+		if len(b) > 0 {
+			e.addr = uint64(uintptr(unsafe.Pointer(&b[0])))
+		}
+		ch, err := r.submit(e)
+		if err != nil {
+			return 0, err
+		}
+		res := <-ch
+		runtime.KeepAlive(b)
+		runtime.KeepAlive(f)
+		if res < 0 {
+			if errno := syscall.Errno(-res); errno == syscall.EINTR || errno == syscall.EAGAIN {
+				continue
+			}
+			return 0, syscall.Errno(-res)
+		}
+		return int(res), nil
+	}
+}
+
+// submit queues the request to the submitter. The returned channel receives
+// the result of the request.
+func (r *Ring) submit(e sqe) (<-chan int32, error) {
+	r.slots <- struct{}{}
+	r.pendingMu.Lock()
+	err := r.reapErr
+	r.pendingMu.Unlock()
+	if err != nil {
+		<-r.slots
+		return nil, err
+	}
+	ch := make(chan int32, 1)
+	r.requests <- request{sqe: e, ch: ch}
+	return ch, nil
+}
+
+// submitLoop submits the queued requests in batches until the ring is closed.
+// This is the only writer of the submission queue so no lock is needed for
+// filling it.
+func (r *Ring) submitLoop(entries uint32) {
+	defer close(r.submitted)
+	batch := make([]request, 0, entries)
+	for {
+		select {
+		case req := <-r.requests:
+			batch = append(batch[:0], req)
+		case <-r.closing:
+			// All slots are occupied by Close so no request is queued.
+			_, r.closeErr = r.enqueue([]request{{sqe: sqe{opcode: opNop, userData: closeUserData}}})
+			return
+		}
+	drain:
+		for len(batch) < cap(batch) {
+			select {
+			case req := <-r.requests:
+				batch = append(batch, req)
+			default:
+				break drain
+			}
+		}
+		r.pendingMu.Lock()
+		if r.reapErr != nil {
+			// Nobody reaps the completions anymore.
+			r.pendingMu.Unlock()
+			r.fail(batch, r.reapErr)
+			continue
+		}
+		for i := range batch {
+			batch[i].sqe.userData = r.nextID
+			r.pending[r.nextID] = batch[i].ch
+			r.nextID++
+		}
+		r.pendingMu.Unlock()
+		if failed, err := r.enqueue(batch); err != nil {
+			r.pendingMu.Lock()
+			for _, req := range failed {
+				delete(r.pending, req.sqe.userData)
+			}
+			r.pendingMu.Unlock()
+			r.fail(failed, err)
+		}
+	}
+}
+
+// fail notifies the error to the requests which weren't submitted.
+func (r *Ring) fail(reqs []request, err error) {
+	errno, ok := errors.Cause(err).(syscall.Errno)
+	if !ok {
+		errno = syscall.EIO
+	}
+	for _, req := range reqs {
+		req.ch <- -int32(errno)
+		<-r.slots
+	}
+}
+
+// enqueue puts the requests to the submission queue and submits them to the
+// kernel. This returns the requests which weren't consumed by the kernel on
+// failure. Only the submitter calls this.
+func (r *Ring) enqueue(reqs []request) ([]request, error) {
+	tail := atomic.LoadUint32(r.sqTail)
+	mask := atomic.LoadUint32(r.sqMask)
+	for i, req := range reqs {
+		idx := (tail + uint32(i)) & mask
+		*(*sqe)(unsafe.Pointer(&r.sqes[uintptr(idx)*sqeSize])) = req.sqe
+		*(*uint32)(unsafe.Pointer(uintptr(r.sqArray) + uintptr(idx)*4)) = idx
+	}
+	end := tail + uint32(len(reqs))
+	atomic.StoreUint32(r.sqTail, end)
+	for {
+		head := atomic.LoadUint32(r.sqHead)
+		if head == end {
+			return nil, nil
+		}
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(end-head), 0, 0, 0, 0)
+		if errno == 0 || errno == syscall.EINTR || errno == syscall.EAGAIN || errno == syscall.EBUSY {
+			if errno == syscall.EAGAIN || errno == syscall.EBUSY {
+				runtime.Gosched()
+			}
+			continue
+		}
+		// The kernel didn't consume the rest of the entries. Withdraw them.
+		head = atomic.LoadUint32(r.sqHead)
+		atomic.StoreUint32(r.sqTail, head)
+		return reqs[head-tail:], errors.Wrap(errno, "failed to submit io_uring requests")
+	}
+}
+
+// reap receives completions and notifies the waiters until the ring is closed.
+func (r *Ring) reap() {
+	defer close(r.reaped)
+	for {
+		_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), 0, 1, enterGetEvents, 0, 0)
+		if errno != 0 && errno != syscall.EINTR {
+			// Unexpected failure. Fail all pending requests.
+			r.pendingMu.Lock()
+			r.reapErr = errors.Wrap(errno, "failed to reap io_uring completions")
+			for id, ch := range r.pending {
+				ch <- -int32(errno)
+				delete(r.pending, id)
+				<-r.slots
+			}
+			r.pendingMu.Unlock()
+			return
+		}
+		head, tail := atomic.LoadUint32(r.cqHead), atomic.LoadUint32(r.cqTail)
+		mask := atomic.LoadUint32(r.cqMask)
+		closed := false
+		for ; head != tail; head++ {
+			c := *(*cqe)(unsafe.Pointer(uintptr(r.cqes) + uintptr(head&mask)*cqeSize))
+			if c.userData == closeUserData {
+				closed = true
+				continue
+			}
+			r.pendingMu.Lock()
+			ch, ok := r.pending[c.userData]
+			delete(r.pending, c.userData)
+			r.pendingMu.Unlock()
+			if ok {
+				ch <- c.res
+				<-r.slots
+			}
+		}
+		atomic.StoreUint32(r.cqHead, head)
+		if closed {
+			return
+		}
+	}
+}
+
+// Close waits for the in-flight requests and releases the ring.
+func (r *Ring) Close() (err error) {
+	r.closeOnce.Do(func() {
+		// Occupy all slots to wait for the in-flight requests.
+		for i := 0; i < cap(r.slots); i++ {
+			r.slots <- struct{}{}
+		}
+		close(r.closing)
+		<-r.submitted
+		select {
+		case <-r.reaped:
+		default:
+			if r.closeErr != nil {
+				err = r.closeErr
+				return
+			}
+			<-r.reaped
+		}
+		err = r.release()
+	})
+	return
+}
+
+func (r *Ring) release() error {
+	for _, m := range [][]byte{r.sqes, r.cqRing, r.sqRing} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+	return unix.Close(r.fd)
+}
@@ -0,0 +1,181 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package iouring
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReadWrite(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		nowait bool
+	}{
+		{name: "nowait", nowait: true},
+		// All requests are submitted to the ring.
+		{name: "ring", nowait: false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := New(8)
+			if err != nil {
+				t.Skipf("io_uring is unavailable: %v", err)
+			}
+			defer r.Close()
+			if !tt.nowait {
+				r.noNowaitRead, r.noNowaitWrite = 1, 1
+			}
+			testReadWrite(t, r)
+		})
+	}
+}
+
+func testReadWrite(t *testing.T, r *Ring) {
+
+	f, err := ioutil.TempFile("", "iouringtest")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Concurrent requests more than the entries of the ring.
+	const chunkSize, chunks = 4096, 64
+	var wg sync.WaitGroup
+	errCh := make(chan error, chunks)
+	for i := 0; i < chunks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := bytes.Repeat([]byte{byte(i)}, chunkSize)
+			if _, err := r.WriteAt(f, b, int64(i*chunkSize)); err != nil {
+				errCh <- fmt.Errorf("failed to write chunk %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < chunks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b := make([]byte, chunkSize)
+			if _, err := r.ReadAt(f, b, int64(i*chunkSize)); err != nil {
+				errCh <- fmt.Errorf("failed to read chunk %d: %v", i, err)
+				return
+			}
+			if !bytes.Equal(b, bytes.Repeat([]byte{byte(i)}, chunkSize)) {
+				errCh <- fmt.Errorf("unexpected contents of chunk %d", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+
+	// Reading over the end of file must return io.EOF.
+	b := make([]byte, 10)
+	n, err := r.ReadAt(f, b, chunkSize*chunks-5)
+	if n != 5 || err != io.EOF {
+		t.Errorf("got (%d, %v); want (5, EOF)", n, err)
+	}
+}
+
+// BenchmarkReadAt compares reads through the ring with pread(2) under
+// concurrent random reads as done by FUSE requests served from the cache.
+// "buffered" reads hit the page cache so they don't block. "direct" reads use
+// O_DIRECT so all of them block on the disk (skipped if the filesystem of the
+// temporary directory doesn't support it). "ring" submits all reads to the
+// ring without trying RWF_NOWAIT first.
+func BenchmarkReadAt(b *testing.B) {
+	const fileSize, readSize = 64 << 20, 4096
+	dir := b.TempDir()
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, bytes.Repeat([]byte{1}, fileSize), 0600); err != nil {
+		b.Fatalf("failed to write temp file: %v", err)
+	}
+	r, err := New(defaultEntries)
+	if err != nil {
+		b.Skipf("io_uring is unavailable: %v", err)
+	}
+	defer r.Close()
+	ringOnly, err := New(defaultEntries)
+	if err != nil {
+		b.Fatalf("failed to create ring: %v", err)
+	}
+	defer ringOnly.Close()
+	ringOnly.noNowaitRead, ringOnly.noNowaitWrite = 1, 1
+
+	for _, mode := range []struct {
+		name string
+		flag int
+	}{
+		{"buffered", 0},
+		{"direct", unix.O_DIRECT},
+	} {
+		f, err := os.OpenFile(name, os.O_RDONLY|mode.flag, 0)
+		if err != nil {
+			b.Logf("skipping %s reads: %v", mode.name, err)
+			continue
+		}
+		defer f.Close()
+		for _, bb := range []struct {
+			name   string
+			readAt func(p []byte, off int64) (int, error)
+		}{
+			{"pread", f.ReadAt},
+			{"io_uring", func(p []byte, off int64) (int, error) { return r.ReadAt(f, p, off) }},
+			{"ring", func(p []byte, off int64) (int, error) { return ringOnly.ReadAt(f, p, off) }},
+		} {
+			bb := bb
+			b.Run(mode.name+"/"+bb.name, func(b *testing.B) {
+				b.SetBytes(readSize)
+				b.SetParallelism(16)
+				b.RunParallel(func(pb *testing.PB) {
+					p := alignedBuffer(readSize)
+					off := int64(0)
+					for pb.Next() {
+						// Strided offsets not to read the same page successively.
+						off = (off + 7*readSize) % (fileSize - readSize)
+						if _, err := bb.readAt(p, off); err != nil {
+							b.Errorf("failed to read: %v", err)
+							return
+						}
+					}
+				})
+			})
+		}
+	}
+}
+
+// alignedBuffer returns a buffer aligned to the page as required by O_DIRECT.
+func alignedBuffer(size int) []byte {
+	const align = 4096
+	b := make([]byte, size+align)
+	off := (align - int(uintptr(unsafe.Pointer(&b[0]))%align)) % align
+	return b[off : off+size]
+}
@@ -30,6 +30,17 @@ type Cache struct {
 	cache *lru.Cache
 	mu    sync.Mutex
 
+	// pinned holds contents which are exempt from eviction.
+	pinned map[string]*refCounter
+
+	// unpinned holds contents in the lru cache.
+	unpinned map[string]*refCounter
+
+	// finalized holds contents which nobody refers to anymore. OnEvicted is
+	// called for them after mu is released so that slow callbacks (e.g.
+	// closing caches on disk) don't block other operations on the cache.
+	finalized []*refCounter
+
 	// OnEvicted optionally specifies a callback function to be
 	// executed when an entry is purged from the cache.
 	OnEvicted func(key string, value interface{})
@@ -37,14 +48,48 @@ type Cache struct {
 
 // New creates new cache.
 func New(maxEntries int) *Cache {
-	inner := lru.New(maxEntries)
-	inner.OnEvicted = func(key lru.Key, value interface{}) {
+	c := &Cache{
+		cache:    lru.New(maxEntries),
+		pinned:   make(map[string]*refCounter),
+		unpinned: make(map[string]*refCounter),
+	}
+	c.cache.OnEvicted = func(key lru.Key, value interface{}) {
+		rc := value.(*refCounter)
+		delete(c.unpinned, rc.key)
+		if rc.pinned {
+			return // moved to the pinned contents
+		}
 		// Decrease the ref count incremented in Add().
 		// When nobody refers to this value, this value will be finalized via refCounter.
-		value.(*refCounter).finalize()
+		c.finalize(rc)
 	}
-	return &Cache{
-		cache: inner,
+	return c
+}
+
+// unlock releases mu and calls OnEvicted for the contents finalized while mu
+// is held.
+func (c *Cache) unlock() {
+	finalized := c.finalized
+	c.finalized = nil
+	c.mu.Unlock()
+	for _, rc := range finalized {
+		if rc.onEvicted != nil {
+			rc.onEvicted(rc.key, rc.v)
+		}
+	}
+}
+
+// finalize decreases the ref count incremented on Add. mu must be held.
+func (c *Cache) finalize(rc *refCounter) {
+	if rc.finalize() {
+		c.finalized = append(c.finalized, rc)
+	}
+}
+
+// dec decreases the ref count. mu must be held.
+func (c *Cache) dec(rc *refCounter) {
+	if rc.dec() {
+		c.finalized = append(c.finalized, rc)
 	}
 }
 
@@ -53,25 +98,34 @@ func New(maxEntries int) *Cache {
 // will no longer be used.
 func (c *Cache) Get(key string) (value interface{}, done func(), ok bool) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	o, ok := c.cache.Get(key)
+	defer c.unlock()
+	rc, ok := c.get(key)
 	if !ok {
 		return nil, nil, false
 	}
-	rc := o.(*refCounter)
 	rc.inc()
 	return rc.v, c.decreaseOnceFunc(rc), true
 }
 
+func (c *Cache) get(key string) (*refCounter, bool) {
+	if rc, ok := c.pinned[key]; ok {
+		return rc, true
+	}
+	o, ok := c.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	return o.(*refCounter), true
+}
+
 // Add adds object to the cache and returns the cached contents with incrementing the reference count.
 // If the specified content already exists in the cache, this sets `added` to false and returns
 // "already cached" content (i.e. doesn't replace the content with the new one). Client must call
 // `done` callback to decrease the counter when the value will no longer be used.
 func (c *Cache) Add(key string, value interface{}) (cachedValue interface{}, done func(), added bool) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
-	if o, ok := c.cache.Get(key); ok {
-		rc := o.(*refCounter)
+	defer c.unlock()
+	if rc, ok := c.get(key); ok {
 		rc.inc()
 		return rc.v, c.decreaseOnceFunc(rc), false
 	}
@@ -83,6 +137,7 @@ func (c *Cache) Add(key string, value interface{}) (cachedValue interface{}, don
 	rc.initialize() // Keep this object having at least 1 ref count (will be decreased in OnEviction)
 	rc.inc()        // The client references this object (will be decreased on "done")
 	c.cache.Add(key, rc)
+	c.unpinned[key] = rc
 	return rc.v, c.decreaseOnceFunc(rc), true
 }
 
@@ -90,16 +145,79 @@ func (c *Cache) Add(key string, value interface{}) (cachedValue interface{}, don
 // nobody refers to the removed content.
 func (c *Cache) Remove(key string) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
+	defer c.unlock()
+	if rc, ok := c.pinned[key]; ok {
+		delete(c.pinned, key)
+		rc.pinned = false
+		c.finalize(rc)
+		return
+	}
 	c.cache.Remove(key)
 }
 
+// Pin makes the specified content exempt from eviction until Unpin or Remove is
+// called. False is returned if the content doesn't exist in the cache.
+func (c *Cache) Pin(key string) bool {
+	c.mu.Lock()
+	defer c.unlock()
+	if _, ok := c.pinned[key]; ok {
+		return true
+	}
+	o, ok := c.cache.Get(key)
+	if !ok {
+		return false
+	}
+	rc := o.(*refCounter)
+	rc.pinned = true
+	c.cache.Remove(key)
+	c.pinned[key] = rc
+	return true
+}
+
+// Unpin makes the pinned content evictable again.
+func (c *Cache) Unpin(key string) {
+	c.mu.Lock()
+	defer c.unlock()
+	rc, ok := c.pinned[key]
+	if !ok {
+		return
+	}
+	delete(c.pinned, key)
+	rc.pinned = false
+	c.cache.Add(key, rc)
+	c.unpinned[key] = rc
+}
+
+// RemoveUnused removes the contents which nobody refers to except the cache.
+// Pinned contents aren't removed. The keys of the removed contents are
+// returned. OnEvicted callback is called for them.
+func (c *Cache) RemoveUnused() (removed []string) {
+	c.mu.Lock()
+	defer c.unlock()
+	for key, rc := range c.unpinned {
+		if rc.count() <= 1 { // only the cache refers to it
+			removed = append(removed, key)
+		}
+	}
+	for _, key := range removed {
+		c.cache.Remove(key)
+	}
+	return
+}
+
+// Len returns the number of contents in the cache including pinned ones.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.unlock()
+	return c.cache.Len() + len(c.pinned)
+}
+
 func (c *Cache) decreaseOnceFunc(rc *refCounter) func() {
 	var once sync.Once
 	return func() {
 		c.mu.Lock()
-		defer c.mu.Unlock()
-		once.Do(func() { rc.dec() })
+		defer c.unlock()
+		once.Do(func() { c.dec(rc) })
 	}
 }
 
@@ -109,6 +227,7 @@ type refCounter struct {
 	key       string
 	v         interface{}
 	refCounts int64
+	pinned    bool // protected by Cache.mu
 
 	mu sync.Mutex
 
@@ -122,20 +241,26 @@ func (r *refCounter) inc() {
 	r.refCounts++
 }
 
-func (r *refCounter) dec() {
+func (r *refCounter) count() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.refCounts
+}
+
+// dec decreases the ref count and returns true if nobody refers to this object
+// anymore.
+func (r *refCounter) dec() bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	r.refCounts--
-	if r.refCounts <= 0 && r.onEvicted != nil {
-		// nobody will refer this object
-		r.onEvicted(r.key, r.v)
-	}
+	return r.refCounts == 0
 }
 
 func (r *refCounter) initialize() {
 	r.initializeOnce.Do(func() { r.inc() })
 }
 
-func (r *refCounter) finalize() {
-	r.finalizeOnce.Do(func() { r.dec() })
+func (r *refCounter) finalize() (evicted bool) {
+	r.finalizeOnce.Do(func() { evicted = r.dec() })
+	return
 }
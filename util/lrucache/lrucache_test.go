@@ -150,3 +150,120 @@ func TestEviction(t *testing.T) {
 		return
 	}
 }
+
+func TestEvictionOutsideLock(t *testing.T) {
+	var evicted []string
+	c := New(1)
+	c.OnEvicted = func(key string, value interface{}) {
+		// The cache must be available from the callback.
+		if _, done, ok := c.Get(key); ok {
+			done()
+			t.Errorf("evicted content %q must not be in the cache", key)
+		}
+		evicted = append(evicted, key)
+	}
+	_, done1, _ := c.Add("key1", "abcd1")
+	done1()
+	_, done2, _ := c.Add("key2", "abcd2") // evicts key1
+	done2()
+	_, done3, _ := c.Add("key3", "abcd3") // evicts key2
+	c.Remove("key3")
+	done3()
+	if len(evicted) != 3 {
+		t.Errorf("3 contents must be evicted but got %v", evicted)
+	}
+}
+
+func TestPin(t *testing.T) {
+	var evicted []string
+	c := New(1)
+	c.OnEvicted = func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	}
+	key1, value1 := "key1", "abcd1"
+	if c.Pin(key1) {
+		t.Errorf("nonexistent content must not be pinned")
+	}
+	_, done1, _ := c.Add(key1, value1)
+	done1()
+	if !c.Pin(key1) {
+		t.Fatalf("failed to pin %q", key1)
+	}
+
+	// Pinned content isn't evicted by overflow.
+	_, done2, _ := c.Add("key2", "abcd2")
+	done2()
+	c.Add("key3", "abcd3")
+	if len(evicted) != 1 || evicted[0] != "key2" {
+		t.Fatalf("only unpinned content must be evicted but got %v", evicted)
+	}
+	if n := c.Len(); n != 2 {
+		t.Errorf("pinned content must be counted; len = %d; want 2", n)
+	}
+	v, done12, ok := c.Get(key1)
+	if !ok || v.(string) != value1 {
+		t.Fatalf("failed to get pinned content %q", key1)
+	}
+	done12()
+	if _, done, added := c.Add(key1, "dummy"); added {
+		t.Errorf("pinned content %q must not be replaced", key1)
+	} else {
+		done()
+	}
+
+	// Unpinned content can be evicted again.
+	c.Unpin(key1)
+	c.Add("key4", "abcd4")
+	if len(evicted) != 2 || evicted[1] != key1 {
+		t.Fatalf("unpinned content %q must be evicted but got %v", key1, evicted)
+	}
+
+	// Removing pinned content evicts it.
+	_, done5, _ := c.Add("key5", "abcd5")
+	done5()
+	c.Pin("key5")
+	c.Remove("key5")
+	if len(evicted) < 3 || evicted[len(evicted)-1] != "key5" {
+		t.Fatalf("removed content must be evicted but got %v", evicted)
+	}
+}
+
+func TestRemoveUnused(t *testing.T) {
+	var evicted []string
+	c := New(10)
+	c.OnEvicted = func(key string, value interface{}) {
+		evicted = append(evicted, key)
+	}
+	_, done1, _ := c.Add("key1", "abcd1")
+	done1()
+	_, done2, _ := c.Add("key2", "abcd2") // in use
+	_, done3, _ := c.Add("key3", "abcd3")
+	done3()
+	if !c.Pin("key3") {
+		t.Fatalf("failed to pin key3")
+	}
+
+	removed := c.RemoveUnused()
+	if len(removed) != 1 || removed[0] != "key1" {
+		t.Fatalf("only unused content must be removed but got %v", removed)
+	}
+	if len(evicted) != 1 || evicted[0] != "key1" {
+		t.Fatalf("removed content must be evicted but got %v", evicted)
+	}
+	if n := c.Len(); n != 2 {
+		t.Errorf("len = %d; want 2", n)
+	}
+
+	// Content becomes removable after it's released.
+	done2()
+	if removed := c.RemoveUnused(); len(removed) != 1 || removed[0] != "key2" {
+		t.Fatalf("released content must be removed but got %v", removed)
+	}
+	c.Unpin("key3")
+	if removed := c.RemoveUnused(); len(removed) != 1 || removed[0] != "key3" {
+		t.Fatalf("unpinned content must be removed but got %v", removed)
+	}
+	if n := c.Len(); n != 0 {
+		t.Errorf("len = %d; want 0", n)
+	}
+}
@@ -0,0 +1,325 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+// This utility helps test codes to record registry interactions and replay
+// them without network access.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+)
+
+// Cassette is a set of recorded interactions with registries.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is a pair of a request and the response.
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedRequest is a recorded request. Only headers which affect responses
+// of registries (i.e. Range and Accept) are recorded so credentials in request
+// headers (e.g. Authorization) aren't recorded. Signed query parameters of the
+// URL are redacted.
+type RecordedRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header,omitempty"`
+}
+
+// RecordedResponse is a recorded response. Credentials in headers (e.g.
+// Set-Cookie and signed URLs in Location) and tokens in JSON bodies (e.g.
+// responses of token servers) are redacted. Bodies of redirects aren't
+// recorded.
+type RecordedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+}
+
+// recordedHeaders are request headers used for matching requests.
+var recordedHeaders = []string{"Range", "Accept"}
+
+// redacted replaces credentials in cassettes.
+const redacted = "REDACTED"
+
+var (
+	// redactedResponseHeaders are response headers which can carry credentials.
+	redactedResponseHeaders = []string{"Authorization", "Proxy-Authorization", "Set-Cookie"}
+
+	// redactedQueryParams are query parameters of signed URLs (e.g. redirects
+	// to S3, GCS or Azure Blob) and tokens. Matched case-insensitively.
+	redactedQueryParams = []string{
+		"X-Amz-Signature", "X-Amz-Credential", "X-Amz-Security-Token",
+		"X-Goog-Signature", "X-Goog-Credential",
+		"Signature", "sig", "token", "access_token",
+	}
+
+	// redactedBodyFields are fields of JSON bodies which carry tokens (e.g.
+	// responses of token servers).
+	redactedBodyFields = []string{"token", "access_token", "refresh_token", "id_token"}
+)
+
+// LoadCassette loads a cassette saved by Recorder.Save.
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Cassette
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Recorder is a RoundTripper which records all interactions through it.
+type Recorder struct {
+	inner http.RoundTripper
+
+	mu       sync.Mutex
+	cassette Cassette
+}
+
+// NewRecorder returns a Recorder which sends requests using the inner
+// RoundTripper. If inner is nil, http.DefaultTransport is used.
+func NewRecorder(inner http.RoundTripper) *Recorder {
+	if inner == nil {
+		inner = http.DefaultTransport
+	}
+	return &Recorder{inner: inner}
+}
+
+// RoundTrip sends the request and records the interaction.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := r.inner.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.mu.Lock()
+	r.cassette.Interactions = append(r.cassette.Interactions, Interaction{
+		Request: recordRequest(req),
+		Response: RecordedResponse{
+			StatusCode: res.StatusCode,
+			Header:     redactHeader(res.Header),
+			Body:       redactBody(res, body),
+		},
+	})
+	r.mu.Unlock()
+	return res, nil
+}
+
+// Cassette returns the interactions recorded so far.
+func (r *Recorder) Cassette() *Cassette {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return &Cassette{Interactions: append([]Interaction{}, r.cassette.Interactions...)}
+}
+
+// Save saves the recorded interactions to the file.
+func (r *Recorder) Save(path string) error {
+	data, err := json.MarshalIndent(r.Cassette(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Replayer is a RoundTripper which replays the interactions recorded in a
+// cassette without network access. Requests are matched by the method, the URL
+// and the recorded headers. If the same request is recorded several times, the
+// responses are replayed in the recorded order and the last one is repeated.
+// Unknown requests fail.
+type Replayer struct {
+	mu           sync.Mutex
+	interactions map[string][]RecordedResponse
+}
+
+// NewReplayer returns a Replayer of the cassette.
+func NewReplayer(c *Cassette) *Replayer {
+	r := &Replayer{interactions: make(map[string][]RecordedResponse)}
+	for _, i := range c.Interactions {
+		k := requestKey(i.Request)
+		r.interactions[k] = append(r.interactions[k], i.Response)
+	}
+	return r
+}
+
+// RoundTrip returns the recorded response of the request.
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	k := requestKey(recordRequest(req))
+	r.mu.Lock()
+	responses := r.interactions[k]
+	if len(responses) == 0 {
+		r.mu.Unlock()
+		return nil, fmt.Errorf("no recorded interaction for %s %s", req.Method, req.URL)
+	}
+	res := responses[0]
+	if len(responses) > 1 {
+		r.interactions[k] = responses[1:]
+	}
+	r.mu.Unlock()
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", res.StatusCode, http.StatusText(res.StatusCode)),
+		StatusCode:    res.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        res.Header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(res.Body)),
+		ContentLength: int64(len(res.Body)),
+		Request:       req,
+	}, nil
+}
+
+// WrapHosts returns RegistryHosts whose clients send requests through the
+// RoundTripper returned by wrap. This can be used to record or replay the
+// interactions of the filesystem with registries.
+func WrapHosts(hosts source.RegistryHosts, wrap func(http.RoundTripper) http.RoundTripper) source.RegistryHosts {
+	return func(refspec reference.Spec) ([]docker.RegistryHost, error) {
+		hs, err := hosts(refspec)
+		if err != nil {
+			return nil, err
+		}
+		for i := range hs {
+			tr := http.DefaultTransport
+			if hs[i].Client != nil && hs[i].Client.Transport != nil {
+				tr = hs[i].Client.Transport
+			}
+			c := &http.Client{}
+			if hs[i].Client != nil {
+				*c = *hs[i].Client
+			}
+			c.Transport = wrap(tr)
+			hs[i].Client = c
+		}
+		return hs, nil
+	}
+}
+
+func recordRequest(req *http.Request) RecordedRequest {
+	h := make(http.Header)
+	for _, k := range recordedHeaders {
+		if v := req.Header.Values(k); len(v) > 0 {
+			h[k] = v
+		}
+	}
+	return RecordedRequest{
+		Method: req.Method,
+		URL:    redactURL(req.URL.String()),
+		Header: h,
+	}
+}
+
+// redactURL redacts the signed query parameters of the URL. Requests are
+// redacted in the same way on replay so they match the recorded ones.
+func redactURL(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.RawQuery == "" {
+		return u
+	}
+	q := parsed.Query()
+	found := false
+	for k := range q {
+		for _, p := range redactedQueryParams {
+			if strings.EqualFold(k, p) {
+				q[k] = []string{redacted}
+				found = true
+			}
+		}
+	}
+	if !found {
+		return u
+	}
+	parsed.RawQuery = q.Encode()
+	return parsed.String()
+}
+
+// redactHeader returns the copy of the response header with credentials
+// redacted.
+func redactHeader(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range redactedResponseHeaders {
+		if len(h.Values(k)) > 0 {
+			h.Set(k, redacted)
+		}
+	}
+	if l := h.Get("Location"); l != "" {
+		h.Set("Location", redactURL(l))
+	}
+	return h
+}
+
+// redactBody redacts tokens in the JSON object. Bodies of redirects are dropped
+// because they can contain the signed URL. Other bodies are returned as is.
+func redactBody(res *http.Response, body []byte) []byte {
+	if res.StatusCode >= 300 && res.StatusCode < 400 && res.Header.Get("Location") != "" {
+		return nil
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return body
+	}
+	found := false
+	for _, f := range redactedBodyFields {
+		if _, ok := obj[f]; ok {
+			obj[f], _ = json.Marshal(redacted)
+			found = true
+		}
+	}
+	if !found {
+		return body
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return body
+	}
+	return b
+}
+
+func requestKey(req RecordedRequest) string {
+	key := req.Method + " " + req.URL
+	for _, k := range recordedHeaders {
+		for _, v := range req.Header.Values(k) {
+			key += "\n" + k + ": " + v
+		}
+	}
+	return key
+}
@@ -0,0 +1,128 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCassetteRedaction(t *testing.T) {
+	const (
+		secretToken     = "secret-token"
+		secretRefresh   = "secret-refresh"
+		secretSignature = "secret-signature"
+		secretCred      = "secret-credential"
+		secretCookie    = "secret-cookie"
+		secretAuth      = "secret-authorization"
+		blobData        = "blob data"
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"token":         secretToken,
+			"refresh_token": secretRefresh,
+			"expires_in":    300,
+		})
+	})
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/blob?X-Amz-Signature="+secretSignature+"&x-amz-credential="+secretCred+"&part=1", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/blob", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: secretCookie})
+		w.Write([]byte(blobData))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	get := func(c *http.Client, path string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+secretAuth)
+		res, err := c.Do(req)
+		if err != nil {
+			t.Fatalf("failed to get %q: %v", path, err)
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("failed to read %q: %v", path, err)
+		}
+		return res, body
+	}
+
+	// Record. The client sees the original responses.
+	rec := NewRecorder(nil)
+	if _, body := get(&http.Client{Transport: rec}, "/token"); !strings.Contains(string(body), secretToken) {
+		t.Errorf("recorder must not modify responses: %q", body)
+	}
+	if _, body := get(&http.Client{Transport: rec}, "/redirect"); string(body) != blobData {
+		t.Errorf("unexpected blob %q", body)
+	}
+	cassette := filepath.Join(t.TempDir(), "cassette.json")
+	if err := rec.Save(cassette); err != nil {
+		t.Fatalf("failed to save cassette: %v", err)
+	}
+	c, err := LoadCassette(cassette)
+	if err != nil {
+		t.Fatalf("failed to load cassette: %v", err)
+	}
+	// Bodies are encoded in the file so check them decoded.
+	var data []byte
+	for _, i := range c.Interactions {
+		b, err := json.Marshal([]interface{}{i.Request, i.Response.Header, string(i.Response.Body)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = append(data, b...)
+	}
+	for _, secret := range []string{secretToken, secretRefresh, secretSignature, secretCred, secretCookie, secretAuth} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("cassette contains %q:\n%s", secret, data)
+		}
+	}
+	if !strings.Contains(string(data), "part=1") || !strings.Contains(string(data), "expires_in") {
+		t.Errorf("fields other than credentials must be kept:\n%s", data)
+	}
+
+	// Replay the redacted interactions.
+	client := &http.Client{Transport: NewReplayer(c)}
+	_, body := get(client, "/token")
+	var tok map[string]interface{}
+	if err := json.Unmarshal(body, &tok); err != nil {
+		t.Fatalf("invalid token response %q: %v", body, err)
+	}
+	if tok["token"] != redacted || tok["refresh_token"] != redacted || tok["expires_in"] != float64(300) {
+		t.Errorf("unexpected token response %v", tok)
+	}
+	res, body := get(client, "/redirect")
+	if string(body) != blobData {
+		t.Errorf("unexpected blob replayed through the redacted redirect: %q", body)
+	}
+	if v := res.Header.Get("Set-Cookie"); v != redacted {
+		t.Errorf("Set-Cookie %q; want %q", v, redacted)
+	}
+}
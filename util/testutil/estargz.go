@@ -19,9 +19,11 @@ package testutil
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
 
 	"github.com/containerd/stargz-snapshotter/estargz"
 	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 type buildEStargzOptions struct {
@@ -63,3 +65,63 @@ func BuildEStargz(ents []TarEntry, opts ...BuildEStargzOption) (*io.SectionReade
 
 	return io.NewSectionReader(bytes.NewReader(vsbb), 0, int64(len(vsbb))), rc.TOCDigest(), nil
 }
+
+// Layer is an eStargz layer which can be pushed to the Registry.
+type Layer struct {
+	// Data is the contents of the layer blob.
+	Data []byte
+
+	// Desc is the descriptor of the layer. The TOC digest is contained in the
+	// annotations.
+	Desc ocispec.Descriptor
+
+	// DiffID is the uncompressed digest of the layer.
+	DiffID digest.Digest
+
+	// ExternalTOC is the TOC blob of the layer if the layer is built with
+	// estargz.WithExternalTOC. This is pushed to the Registry with the layer.
+	ExternalTOC []byte
+}
+
+// BuildEStargzLayer builds an eStargz layer which contains the entries.
+func BuildEStargzLayer(ents []TarEntry, opts ...BuildEStargzOption) (Layer, error) {
+	var beOpts buildEStargzOptions
+	for _, o := range opts {
+		if err := o(&beOpts); err != nil {
+			return Layer{}, err
+		}
+	}
+	tarBuf := new(bytes.Buffer)
+	if _, err := io.Copy(tarBuf, BuildTar(ents)); err != nil {
+		return Layer{}, err
+	}
+	tarData := tarBuf.Bytes()
+	rc, err := estargz.Build(
+		io.NewSectionReader(bytes.NewReader(tarData), 0, int64(len(tarData))),
+		beOpts.estargzOptions...)
+	if err != nil {
+		return Layer{}, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return Layer{}, err
+	}
+	l := Layer{
+		Data: data,
+		Desc: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    digest.FromBytes(data),
+			Size:      int64(len(data)),
+			Annotations: map[string]string{
+				estargz.TOCJSONDigestAnnotation: rc.TOCDigest().String(),
+			},
+		},
+		DiffID:      rc.DiffID(),
+		ExternalTOC: rc.ExternalTOC(),
+	}
+	if l.ExternalTOC != nil {
+		l.Desc.Annotations[estargz.ExternalTOCAnnotation] = digest.FromBytes(l.ExternalTOC).String()
+	}
+	return l, nil
+}
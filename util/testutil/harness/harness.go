@@ -0,0 +1,138 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package harness runs stargz snapshotter in-process against images served by
+// testutil.Registry. This helps users embedding this library to write
+// end-to-end tests of lazy pulling (including FUSE mounts) as unit tests,
+// without external registries or containerd. Mounting snapshots requires root
+// privileges and /dev/fuse.
+package harness
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/snapshots"
+	stargzfs "github.com/containerd/stargz-snapshotter/fs"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/containerd/stargz-snapshotter/snapshot"
+	"github.com/containerd/stargz-snapshotter/util/testutil"
+	"github.com/opencontainers/image-spec/identity"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// targetSnapshotLabel is the label passed by containerd to let the snapshotter
+// commit the snapshot with the specified name.
+const targetSnapshotLabel = "containerd.io/snapshot.ref"
+
+// Env is stargz snapshotter running in-process.
+type Env struct {
+	// Snapshotter is the stargz snapshotter. Remote snapshots are mounted
+	// using FUSE.
+	Snapshotter snapshots.Snapshotter
+}
+
+// New starts stargz snapshotter under root, which pulls images from the
+// registry. Prometheus metrics are disabled so that multiple Envs can run in
+// the same process.
+func New(ctx context.Context, root string, registry *testutil.Registry, cfg config.Config, opts ...snapshot.Opt) (*Env, error) {
+	cfg.NoPrometheus = true
+	fs, err := stargzfs.NewFilesystem(filepath.Join(root, "stargz"), cfg,
+		stargzfs.WithGetSources(source.FromDefaultLabels(registry.Hosts())))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure filesystem")
+	}
+	sn, err := snapshot.NewSnapshotter(ctx, filepath.Join(root, "snapshotter"), fs, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to configure snapshotter")
+	}
+	return &Env{Snapshotter: sn}, nil
+}
+
+// Close closes the snapshotter. All remote snapshots are unmounted.
+func (e *Env) Close() error {
+	return e.Snapshotter.Close()
+}
+
+// PrepareImage prepares all layers of the image as remote snapshots (as
+// containerd does during lazy pulling) and prepares an active snapshot with
+// the key on top of them. The mounts of the active snapshot are returned. This
+// fails if any layer can't be prepared as a remote snapshot.
+func (e *Env) PrepareImage(ctx context.Context, img testutil.Image, key string) ([]mount.Mount, error) {
+	layers, err := layerLabels(ctx, img)
+	if err != nil {
+		return nil, err
+	}
+	chainIDs := identity.ChainIDs(append(img.DiffIDs[:0:0], img.DiffIDs...))
+	var parent string
+	for i, labels := range layers {
+		chainID := chainIDs[i].String()
+		labels[targetSnapshotLabel] = chainID
+		extractKey := fmt.Sprintf("extract-%s-%s", key, chainID)
+		_, err := e.Snapshotter.Prepare(ctx, extractKey, parent, snapshots.WithLabels(labels))
+		if err == nil {
+			e.Snapshotter.Remove(ctx, extractKey)
+			return nil, fmt.Errorf("layer %d (%s) isn't prepared as a remote snapshot",
+				i, img.Manifest.Layers[i].Digest)
+		} else if !errdefs.IsAlreadyExists(err) {
+			return nil, errors.Wrapf(err, "failed to prepare layer %d (%s)",
+				i, img.Manifest.Layers[i].Digest)
+		}
+		parent = chainID
+	}
+	return e.Snapshotter.Prepare(ctx, key, parent)
+}
+
+// layerLabels returns the snapshot labels of each layer of the image, which
+// are passed by containerd during lazy pulling.
+func layerLabels(ctx context.Context, img testutil.Image) ([]map[string]string, error) {
+	h := source.AppendDefaultLabelsHandlerWrapper(img.Ref, 0)(
+		images.HandlerFunc(func(ctx context.Context, desc ocispec.Descriptor) ([]ocispec.Descriptor, error) {
+			var layers []ocispec.Descriptor
+			for _, l := range img.Manifest.Layers {
+				l.Annotations = copyLabels(l.Annotations)
+				layers = append(layers, l)
+			}
+			return layers, nil
+		}))
+	layers, err := h.Handle(ctx, img.Target)
+	if err != nil {
+		return nil, err
+	}
+	if len(layers) != len(img.DiffIDs) {
+		return nil, fmt.Errorf("number of layers (%d) doesn't match to diffIDs (%d)",
+			len(layers), len(img.DiffIDs))
+	}
+	var labels []map[string]string
+	for _, l := range layers {
+		labels = append(labels, l.Annotations)
+	}
+	return labels, nil
+}
+
+func copyLabels(m map[string]string) map[string]string {
+	res := make(map[string]string)
+	for k, v := range m {
+		res[k] = v
+	}
+	return res
+}
@@ -0,0 +1,96 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package harness
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/containerd/containerd/mount"
+	"github.com/containerd/containerd/pkg/testutil"
+	"github.com/containerd/stargz-snapshotter/fs/config"
+	stargztestutil "github.com/containerd/stargz-snapshotter/util/testutil"
+)
+
+func TestLazyPull(t *testing.T) {
+	testutil.RequiresRoot(t)
+	ctx := context.TODO()
+
+	reg := stargztestutil.NewRegistry()
+	defer reg.Close()
+	var layers []stargztestutil.Layer
+	for _, ents := range [][]stargztestutil.TarEntry{
+		{
+			stargztestutil.Dir("a/"),
+			stargztestutil.File("a/foo", "foo"),
+		},
+		{
+			stargztestutil.Dir("a/"),
+			stargztestutil.File("a/bar", "bar"),
+		},
+	} {
+		l, err := stargztestutil.BuildEStargzLayer(ents)
+		if err != nil {
+			t.Fatalf("failed to build layer: %v", err)
+		}
+		layers = append(layers, l)
+	}
+	img, err := reg.PushImage("test", "latest", layers...)
+	if err != nil {
+		t.Fatalf("failed to push image: %v", err)
+	}
+
+	root, err := ioutil.TempDir("", "harness")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	env, err := New(ctx, root, reg, config.Config{})
+	if err != nil {
+		t.Fatalf("failed to start snapshotter: %v", err)
+	}
+	defer env.Close()
+	mounts, err := env.PrepareImage(ctx, img, "rootfs")
+	if err != nil {
+		t.Fatalf("failed to prepare image: %v", err)
+	}
+	target := filepath.Join(root, "rootfs")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := mount.All(mounts, target); err != nil {
+		t.Fatalf("failed to mount rootfs: %v", err)
+	}
+	defer mount.UnmountAll(target, 0)
+	for name, want := range map[string]string{"a/foo": "foo", "a/bar": "bar"} {
+		data, err := ioutil.ReadFile(filepath.Join(target, name))
+		if err != nil {
+			t.Fatalf("failed to read %q: %v", name, err)
+		}
+		if string(data) != want {
+			t.Errorf("unexpected contents of %q: %q; want %q", name, string(data), want)
+		}
+	}
+	for _, l := range layers {
+		if reg.BlobRequests(l.Desc.Digest) == 0 {
+			t.Errorf("layer %s must be fetched from the registry", l.Desc.Digest)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+// This utility helps test codes to serve sample images from an in-process
+// registry.
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Registry is an in-process registry which serves images over the OCI
+// distribution API (HTTP). Range requests to blobs are supported so the
+// snapshotter can lazily pull images from this registry. Blobs and manifests
+// can also be pushed with monolithic uploads.
+type Registry struct {
+	server *httptest.Server
+
+	mu           sync.Mutex
+	blobs        map[digest.Digest][]byte
+	manifests    map[string]manifest // keyed by "<name>:<tag|digest>"
+	blobRequests map[digest.Digest]int
+	uploads      int
+}
+
+type manifest struct {
+	data      []byte
+	mediaType string
+}
+
+// Image is an image pushed to the Registry.
+type Image struct {
+	// Ref is the reference of the image (e.g. "127.0.0.1:5000/test:latest").
+	Ref string
+
+	// Target is the descriptor of the manifest.
+	Target ocispec.Descriptor
+
+	// Manifest is the manifest of the image.
+	Manifest ocispec.Manifest
+
+	// DiffIDs are the uncompressed digests of the layers.
+	DiffIDs []digest.Digest
+}
+
+// NewRegistry starts a new in-process registry. Close must be called after use.
+func NewRegistry() *Registry {
+	r := &Registry{
+		blobs:        make(map[digest.Digest][]byte),
+		manifests:    make(map[string]manifest),
+		blobRequests: make(map[digest.Digest]int),
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+// Manifest returns the manifest pushed with the name and the tag (or digest).
+func (r *Registry) Manifest(name, ref string) (ocispec.Manifest, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.manifests[name+":"+ref]
+	if !ok {
+		return ocispec.Manifest{}, false
+	}
+	var mf ocispec.Manifest
+	if err := json.Unmarshal(m.data, &mf); err != nil {
+		return ocispec.Manifest{}, false
+	}
+	return mf, true
+}
+
+// Close stops the registry.
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+// Host returns the host (<address>:<port>) of the registry.
+func (r *Registry) Host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+// Hosts returns RegistryHosts which resolves all references to this registry
+// over plain HTTP.
+func (r *Registry) Hosts() source.RegistryHosts {
+	return func(reference.Spec) ([]docker.RegistryHost, error) {
+		return []docker.RegistryHost{{
+			Client:       r.server.Client(),
+			Host:         r.Host(),
+			Scheme:       "http",
+			Path:         "/v2",
+			Capabilities: docker.HostCapabilityPull | docker.HostCapabilityResolve | docker.HostCapabilityPush,
+		}}, nil
+	}
+}
+
+// BlobRequests returns the number of requests to the blob. This is useful to
+// check if the blob is lazily pulled.
+func (r *Registry) BlobRequests(dgst digest.Digest) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.blobRequests[dgst]
+}
+
+// PushImage pushes an image which consists of the layers to the registry with
+// the specified name and tag.
+func (r *Registry) PushImage(name, tag string, layers ...Layer) (Image, error) {
+	var (
+		descs   []ocispec.Descriptor
+		diffIDs []digest.Digest
+	)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, l := range layers {
+		r.blobs[l.Desc.Digest] = l.Data
+		if l.ExternalTOC != nil {
+			r.addBlob(ocispec.MediaTypeImageLayerGzip, l.ExternalTOC)
+		}
+		descs = append(descs, l.Desc)
+		diffIDs = append(diffIDs, l.DiffID)
+	}
+	configData, err := json.Marshal(ocispec.Image{
+		Architecture: "amd64",
+		OS:           "linux",
+		RootFS: ocispec.RootFS{
+			Type:    "layers",
+			DiffIDs: diffIDs,
+		},
+	})
+	if err != nil {
+		return Image{}, err
+	}
+	configDesc := r.addBlob(ocispec.MediaTypeImageConfig, configData)
+	m := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    configDesc,
+		Layers:    descs,
+	}
+	mData, err := json.Marshal(m)
+	if err != nil {
+		return Image{}, err
+	}
+	target := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(mData),
+		Size:      int64(len(mData)),
+	}
+	mf := manifest{data: mData, mediaType: target.MediaType}
+	r.manifests[name+":"+tag] = mf
+	r.manifests[name+":"+target.Digest.String()] = mf
+	return Image{
+		Ref:      fmt.Sprintf("%s/%s:%s", r.Host(), name, tag),
+		Target:   target,
+		Manifest: m,
+		DiffIDs:  diffIDs,
+	}, nil
+}
+
+func (r *Registry) addBlob(mediaType string, data []byte) ocispec.Descriptor {
+	dgst := digest.FromBytes(data)
+	r.blobs[dgst] = data
+	return ocispec.Descriptor{
+		MediaType: mediaType,
+		Digest:    dgst,
+		Size:      int64(len(data)),
+	}
+}
+
+func (r *Registry) serve(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodPut:
+		r.servePush(w, req)
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if p == "" || p == req.URL.Path {
+		w.WriteHeader(http.StatusOK) // API version check
+		return
+	}
+	if i := strings.LastIndex(p, "/manifests/"); i >= 0 {
+		r.mu.Lock()
+		m, ok := r.manifests[p[:i]+":"+p[i+len("/manifests/"):]]
+		r.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.data).String())
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(m.data))
+		return
+	}
+	if i := strings.LastIndex(p, "/blobs/"); i >= 0 {
+		dgst, err := digest.Parse(p[i+len("/blobs/"):])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		data, ok := r.blobs[dgst]
+		if ok && req.Method == http.MethodGet {
+			r.blobRequests[dgst]++
+		}
+		r.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// servePush serves monolithic uploads of blobs and manifests.
+func (r *Registry) servePush(w http.ResponseWriter, req *http.Request) {
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	if i := strings.LastIndex(p, "/blobs/uploads/"); i >= 0 {
+		if req.Method == http.MethodPost {
+			r.mu.Lock()
+			r.uploads++
+			id := r.uploads
+			r.mu.Unlock()
+			w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", p[:i], id))
+			w.Header().Set("Docker-Upload-UUID", fmt.Sprintf("%d", id))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		dgst, err := digest.Parse(req.URL.Query().Get("digest"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil || digest.FromBytes(data) != dgst {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		r.blobs[dgst] = data
+		r.mu.Unlock()
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", p[:i], dgst))
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	if i := strings.LastIndex(p, "/manifests/"); i >= 0 && req.Method == http.MethodPut {
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		dgst := digest.FromBytes(data)
+		mf := manifest{data: data, mediaType: req.Header.Get("Content-Type")}
+		r.mu.Lock()
+		r.manifests[p[:i]+":"+p[i+len("/manifests/"):]] = mf
+		r.manifests[p[:i]+":"+dgst.String()] = mf
+		r.mu.Unlock()
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
@@ -0,0 +1,301 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package warmup warms up all images of a multi-container application (e.g.
+// a compose file or a Kubernetes pod spec) as a unit. Images are resolved and
+// pulled in parallel using stargz snapshotter so that eStargz layers are
+// mounted lazily and their prioritized files are prefetched before the
+// application starts.
+package warmup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/fs/source"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	defaultSnapshotter    = "stargz"
+	defaultPrefetchSize   = 10 * 1024 * 1024
+	defaultMaxConcurrency = 4
+)
+
+type warmupOpts struct {
+	resolver       remotes.Resolver
+	snapshotter    string
+	prefetchSize   int64
+	maxConcurrency int64
+	labels         map[string]string
+}
+
+// Option is configuration of warm-up.
+type Option func(opts *warmupOpts)
+
+// WithResolver is the resolver used for pulling images.
+func WithResolver(resolver remotes.Resolver) Option {
+	return func(opts *warmupOpts) {
+		opts.resolver = resolver
+	}
+}
+
+// WithSnapshotter is the snapshotter to use (default: "stargz").
+func WithSnapshotter(snapshotter string) Option {
+	return func(opts *warmupOpts) {
+		opts.snapshotter = snapshotter
+	}
+}
+
+// WithPrefetchSize is the size to prefetch from layers without landmarks.
+func WithPrefetchSize(size int64) Option {
+	return func(opts *warmupOpts) {
+		opts.prefetchSize = size
+	}
+}
+
+// WithMaxConcurrency is the maximum number of images pulled in parallel.
+func WithMaxConcurrency(n int64) Option {
+	return func(opts *warmupOpts) {
+		opts.maxConcurrency = n
+	}
+}
+
+// WithLabels is the labels of the pulled images.
+func WithLabels(labels map[string]string) Option {
+	return func(opts *warmupOpts) {
+		opts.labels = labels
+	}
+}
+
+// ImageReport is the result of warming up an image.
+type ImageReport struct {
+	// Ref is the reference of the image.
+	Ref string `json:"ref"`
+
+	// Layers is the number of layers of the image.
+	Layers int `json:"layers"`
+
+	// EStargzLayers is the number of eStargz layers of the image. These layers
+	// are lazily pulled and prefetched by stargz snapshotter.
+	EStargzLayers int `json:"estargz_layers"`
+
+	// Duration is the time taken to warm up the image.
+	Duration time.Duration `json:"duration"`
+}
+
+// Warmup pulls all images in parallel using stargz snapshotter. This makes
+// stargz snapshotter mount eStargz layers and start prefetching them so that
+// all containers of the application can start quickly. Images are pulled at
+// most once even if they're specified multiple times. Reports are sorted by
+// the references.
+func Warmup(ctx context.Context, client *containerd.Client, refs []string, opts ...Option) ([]ImageReport, error) {
+	wOpts := warmupOpts{
+		snapshotter:    defaultSnapshotter,
+		prefetchSize:   defaultPrefetchSize,
+		maxConcurrency: defaultMaxConcurrency,
+	}
+	for _, o := range opts {
+		o(&wOpts)
+	}
+
+	var (
+		reports   []ImageReport
+		reportsMu sync.Mutex
+		sem       = semaphore.NewWeighted(wOpts.maxConcurrency)
+	)
+	eg, egCtx := errgroup.WithContext(ctx)
+	for _, ref := range uniqueRefs(refs) {
+		ref := ref
+		eg.Go(func() error {
+			if err := sem.Acquire(egCtx, 1); err != nil {
+				return err
+			}
+			defer sem.Release(1)
+			r, err := warmupImage(egCtx, client, ref, &wOpts)
+			if err != nil {
+				return errors.Wrapf(err, "failed to warm up %q", ref)
+			}
+			reportsMu.Lock()
+			reports = append(reports, *r)
+			reportsMu.Unlock()
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Ref < reports[j].Ref })
+	return reports, nil
+}
+
+func warmupImage(ctx context.Context, client *containerd.Client, ref string, opts *warmupOpts) (*ImageReport, error) {
+	start := time.Now()
+	log.G(ctx).WithField("image", ref).Debug("warming up")
+	pullOpts := []containerd.RemoteOpt{
+		containerd.WithPullLabels(opts.labels),
+		containerd.WithSchema1Conversion,
+		containerd.WithPullUnpack,
+		containerd.WithPullSnapshotter(opts.snapshotter),
+		containerd.WithImageHandlerWrapper(source.AppendDefaultLabelsHandlerWrapper(ref, opts.prefetchSize)),
+	}
+	if opts.resolver != nil {
+		pullOpts = append(pullOpts, containerd.WithResolver(opts.resolver))
+	}
+	img, err := client.Pull(ctx, ref, pullOpts...)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := images.Manifest(ctx, client.ContentStore(), img.Target(), platforms.Default())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get manifest")
+	}
+	r := &ImageReport{Ref: ref, Layers: len(manifest.Layers), Duration: time.Since(start)}
+	for _, l := range manifest.Layers {
+		if _, ok := l.Annotations[estargz.TOCJSONDigestAnnotation]; ok {
+			r.EStargzLayers++
+		}
+	}
+	return r, nil
+}
+
+func uniqueRefs(refs []string) (res []string) {
+	seen := make(map[string]struct{})
+	for _, r := range refs {
+		if _, ok := seen[r]; ok || r == "" {
+			continue
+		}
+		seen[r] = struct{}{}
+		res = append(res, r)
+	}
+	return res
+}
+
+// specDocument is a document of a compose file or a Kubernetes manifest.
+type specDocument struct {
+	// Services is the services of a compose file.
+	Services map[string]struct {
+		Image string      `json:"image"`
+		Build interface{} `json:"build"`
+	} `json:"services"`
+
+	// Kind is the kind of a Kubernetes object.
+	Kind string `json:"kind"`
+
+	// Spec is the spec of a Kubernetes object. This contains a pod spec for
+	// pods and a pod template for workloads (e.g. deployments and jobs).
+	Spec struct {
+		corev1.PodSpec
+
+		Template struct {
+			Spec corev1.PodSpec `json:"spec"`
+		} `json:"template"`
+
+		JobTemplate struct {
+			Spec struct {
+				Template struct {
+					Spec corev1.PodSpec `json:"spec"`
+				} `json:"template"`
+			} `json:"spec"`
+		} `json:"jobTemplate"`
+	} `json:"spec"`
+}
+
+// ImagesFromSpec returns the images used by a compose file or Kubernetes
+// manifests (e.g. pods, deployments and jobs; multiple documents separated by
+// "---" are supported). Images are normalized (e.g. "nginx" is
+// "docker.io/library/nginx:latest") and duplicated ones are removed. Services
+// of compose files which are only built locally (i.e. "build" without "image")
+// are skipped.
+func ImagesFromSpec(data []byte) ([]string, error) {
+	var refs []string
+	for i, d := range bytes.Split(data, []byte("\n---")) {
+		if len(bytes.TrimSpace(d)) == 0 {
+			continue
+		}
+		var doc specDocument
+		if err := yaml.Unmarshal(d, &doc); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse document %d", i)
+		}
+		if len(doc.Services) > 0 {
+			var names []string
+			for name := range doc.Services {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				svc := doc.Services[name]
+				if svc.Image == "" {
+					if svc.Build != nil {
+						log.L.Debugf("ignoring service %q built locally", name)
+						continue
+					}
+					return nil, fmt.Errorf("service %q doesn't specify image", name)
+				}
+				refs = append(refs, svc.Image)
+			}
+			continue
+		}
+		switch doc.Kind {
+		case "Pod":
+			refs = append(refs, podImages(doc.Spec.PodSpec)...)
+		case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job":
+			refs = append(refs, podImages(doc.Spec.Template.Spec)...)
+		case "CronJob":
+			refs = append(refs, podImages(doc.Spec.JobTemplate.Spec.Template.Spec)...)
+		case "":
+			return nil, fmt.Errorf("document %d is neither compose file nor Kubernetes object", i)
+		default:
+			log.L.Debugf("ignoring unsupported kind %q", doc.Kind)
+		}
+	}
+	for i, r := range refs {
+		if r == "" {
+			continue
+		}
+		named, err := docker.ParseDockerRef(r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid image reference %q", r)
+		}
+		refs[i] = named.String()
+	}
+	return uniqueRefs(refs), nil
+}
+
+func podImages(spec corev1.PodSpec) (refs []string) {
+	for _, c := range spec.InitContainers {
+		refs = append(refs, c.Image)
+	}
+	for _, c := range spec.Containers {
+		refs = append(refs, c.Image)
+	}
+	return refs
+}
@@ -0,0 +1,173 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package warmup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestImagesFromSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "compose",
+			spec: `
+version: "3"
+services:
+  web:
+    image: ghcr.io/stargz-containers/nginx:1.18-esgz
+    ports:
+      - "80:80"
+  db:
+    image: ghcr.io/stargz-containers/postgres:13.1-esgz
+  cache:
+    image: ghcr.io/stargz-containers/nginx:1.18-esgz
+`,
+			want: []string{
+				"ghcr.io/stargz-containers/nginx:1.18-esgz",
+				"ghcr.io/stargz-containers/postgres:13.1-esgz",
+			},
+		},
+		{
+			name: "compose with services built locally",
+			spec: `
+services:
+  web:
+    build: .
+  app:
+    build:
+      context: ./app
+  db:
+    image: ghcr.io/stargz-containers/postgres:13.1-esgz
+`,
+			want: []string{
+				"ghcr.io/stargz-containers/postgres:13.1-esgz",
+			},
+		},
+		{
+			name: "compose without image",
+			spec: `
+services:
+  web:
+    ports:
+      - "80:80"
+`,
+			wantErr: true,
+		},
+		{
+			name: "normalized references",
+			spec: `
+services:
+  a:
+    image: nginx
+  b:
+    image: docker.io/library/nginx:latest
+  c:
+    image: library/nginx
+  d:
+    image: stargz-containers/python:3.9-esgz
+  e:
+    image: ghcr.io/stargz-containers/nginx:1.18-esgz@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef
+`,
+			want: []string{
+				"docker.io/library/nginx:latest",
+				"docker.io/stargz-containers/python:3.9-esgz",
+				"ghcr.io/stargz-containers/nginx@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+			},
+		},
+		{
+			name: "invalid reference",
+			spec: `
+apiVersion: v1
+kind: Pod
+spec:
+  containers:
+  - name: app
+    image: "UPPER/case:tag"
+`,
+			wantErr: true,
+		},
+		{
+			name: "pod and workloads",
+			spec: `
+apiVersion: v1
+kind: Pod
+metadata:
+  name: app
+spec:
+  initContainers:
+  - name: init
+    image: ghcr.io/stargz-containers/alpine:3.10.2-esgz
+  containers:
+  - name: app
+    image: ghcr.io/stargz-containers/python:3.9-esgz
+---
+apiVersion: apps/v1
+kind: Deployment
+spec:
+  template:
+    spec:
+      containers:
+      - name: web
+        image: ghcr.io/stargz-containers/nginx:1.18-esgz
+---
+apiVersion: batch/v1beta1
+kind: CronJob
+spec:
+  jobTemplate:
+    spec:
+      template:
+        spec:
+          containers:
+          - name: job
+            image: ghcr.io/stargz-containers/python:3.9-esgz
+---
+apiVersion: v1
+kind: Service
+spec:
+  ports:
+  - port: 80
+`,
+			want: []string{
+				"ghcr.io/stargz-containers/alpine:3.10.2-esgz",
+				"ghcr.io/stargz-containers/python:3.9-esgz",
+				"ghcr.io/stargz-containers/nginx:1.18-esgz",
+			},
+		},
+		{
+			name:    "unknown",
+			spec:    "foo: bar\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ImagesFromSpec([]byte(tt.spec))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected result: %v; wantErr=%v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("images = %v; want %v", got, tt.want)
+			}
+		})
+	}
+}